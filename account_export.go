@@ -4,22 +4,35 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/ipfs/boxo/path"
 	"github.com/ipfs/go-cid"
 	cbornode "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
 	coreiface "github.com/ipfs/kubo/core/coreiface"
+	"github.com/ipfs/kubo/core/coreiface/options"
 	mh "github.com/multiformats/go-multihash"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
+	"berty.tech/go-ipfs-log/enc"
+	"berty.tech/go-ipfs-log/entry"
+	logio "berty.tech/go-ipfs-log/io"
 	orbitdb "berty.tech/go-orbit-db"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
 )
 
 const (
@@ -27,9 +40,44 @@ const (
 	exportAccountProofKeyFilename = "account_proof.key"
 	exportOrbitDBEntriesPrefix    = "entries/"
 	exportOrbitDBHeadsPrefix      = "heads/"
+
+	// exportQuiescenceWindow is the duration during which the heads of a
+	// group must remain unchanged for it to be considered as synced
+	exportQuiescenceWindow = time.Millisecond * 250
+	// exportQuiescenceTimeout is the maximum duration to wait for a group to
+	// be synced before giving up
+	exportQuiescenceTimeout      = time.Second * 5
+	exportQuiescencePollInterval = time.Millisecond * 50
 )
 
-func (s *service) export(ctx context.Context, output io.Writer) error {
+// exportOptions are the options of an export, they are set by the request of
+// ServiceExportData
+type exportOptions struct {
+	// force exports the groups without waiting for them to be done syncing
+	force bool
+
+	// format is the encoding of the manifest, no manifest is written with
+	// the default format
+	format protocoltypes.ExportFormat
+
+	// localState exports the local state of the groups, such as the read
+	// markers and the pinned messages
+	localState bool
+}
+
+// export writes a snapshot of the account keys and of the opened groups, unless
+// opts.force is set it waits for each group to be done syncing before
+// exporting it so the backup doesn't contain partial heads. A manifest encoded
+// with opts.format is written last, unless the default format is used.
+func (s *service) export(ctx context.Context, output io.Writer, opts exportOptions) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Export")
+	defer func() { endSpan(span, err) }()
+
+	manifest, err := newExportManifest(opts.format)
+	if err != nil {
+		return err
+	}
+
 	tw := tar.NewWriter(output)
 	defer tw.Close()
 
@@ -47,21 +95,105 @@ func (s *service) export(ctx context.Context, output io.Writer) error {
 	s.lock.RUnlock()
 
 	for _, gc := range groups {
-		if err := s.exportGroupContext(ctx, gc, tw); err != nil {
+		if !opts.force {
+			if err := waitForGroupQuiescence(ctx, gc); err != nil {
+				return err
+			}
+		}
+
+		group, err := s.exportGroupContext(ctx, gc, tw)
+		if err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		manifest.Groups = append(manifest.Groups, group)
+
+		if opts.localState {
+			if err := s.exportGroupLocalState(ctx, gc, tw); err != nil {
+				return errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+		}
+	}
+
+	if opts.localState {
+		manifest.LocalStatePrefix = exportLocalStatePrefix
+	}
+
+	if opts.format != protocoltypes.ExportFormat_ExportFormatDefault {
+		if err := writeExportManifest(tw, manifest); err != nil {
 			return errcode.ErrCode_ErrInternal.Wrap(err)
 		}
 	}
 
+	s.odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeAccountExported,
+	})
+
 	return nil
 }
 
-func (s *service) exportGroupContext(ctx context.Context, gc *GroupContext, tw *tar.Writer) error {
-	if err := s.exportOrbitDBStore(ctx, gc.metadataStore, tw); err != nil {
-		return errcode.ErrCode_ErrInternal.Wrap(err)
+// waitForGroupQuiescence waits for the heads of the group stores to remain
+// unchanged during exportQuiescenceWindow, ErrExportWhileSyncing is returned
+// if they are still changing after exportQuiescenceTimeout
+func waitForGroupQuiescence(ctx context.Context, gc *GroupContext) error {
+	timeout := time.NewTimer(exportQuiescenceTimeout)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(exportQuiescencePollInterval)
+	defer ticker.Stop()
+
+	heads := groupHeadsFingerprint(gc)
+	stableSince := time.Now()
+
+	for time.Since(stableSince) < exportQuiescenceWindow {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return errcode.ErrCode_ErrExportWhileSyncing.Wrap(fmt.Errorf("group %s is still syncing", gc.group.GroupIDAsString()))
+		case <-ticker.C:
+		}
+
+		if current := groupHeadsFingerprint(gc); current != heads {
+			heads = current
+			stableSince = time.Now()
+		}
 	}
 
-	if err := s.exportOrbitDBStore(ctx, gc.messageStore, tw); err != nil {
-		return errcode.ErrCode_ErrInternal.Wrap(err)
+	return nil
+}
+
+// groupHeadsFingerprint returns a value identifying the current heads of the
+// group stores
+func groupHeadsFingerprint(gc *GroupContext) string {
+	fingerprint := strings.Builder{}
+
+	for _, store := range []orbitdb.Store{gc.metadataStore, gc.messageStore} {
+		rawHeads := store.OpLog().RawHeads().Slice()
+		heads := make([]string, len(rawHeads))
+		for i, raw := range rawHeads {
+			heads[i] = raw.GetHash().KeyString()
+		}
+		sort.Strings(heads)
+
+		fingerprint.WriteString(strings.Join(heads, ","))
+		fingerprint.WriteString("/")
+	}
+
+	return fingerprint.String()
+}
+
+// exportGroupContext writes the entries and the heads of a group, it returns
+// the description of the group for the archive manifest
+func (s *service) exportGroupContext(ctx context.Context, gc *GroupContext, tw *tar.Writer) (*protocoltypes.AccountExportManifest_Group, error) {
+	metadataEntries, err := s.exportOrbitDBStore(ctx, gc.metadataStore, tw)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	messagesEntries, err := s.exportOrbitDBStore(ctx, gc.messageStore, tw)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
 	}
 
 	metaRawHeads := gc.metadataStore.OpLog().RawHeads()
@@ -77,17 +209,26 @@ func (s *service) exportGroupContext(ctx context.Context, gc *GroupContext, tw *
 	}
 
 	if err := s.exportOrbitDBGroupHeads(gc, cidsMeta, cidsMessages, tw); err != nil {
-		return errcode.ErrCode_ErrInternal.Wrap(err)
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
 	}
 
-	return nil
+	return &protocoltypes.AccountExportManifest_Group{
+		PublicKey:     gc.group.PublicKey,
+		GroupType:     gc.group.GroupType,
+		HeadsFile:     exportGroupHeadsFilename(gc.group.PublicKey),
+		MetadataHeads: cidsToStrings(cidsMeta),
+		MessagesHeads: cidsToStrings(cidsMessages),
+		Entries:       int64(metadataEntries + messagesEntries),
+	}, nil
 }
 
-func (s *service) exportOrbitDBStore(ctx context.Context, store orbitdb.Store, tw *tar.Writer) error {
+// exportOrbitDBStore writes the entries of a store, it returns the number of
+// exported entries
+func (s *service) exportOrbitDBStore(ctx context.Context, store orbitdb.Store, tw *tar.Writer) (int, error) {
 	allCIDs := store.OpLog().GetEntries().Keys()
 
 	if len(allCIDs) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	for _, idStr := range allCIDs {
@@ -96,11 +237,11 @@ func (s *service) exportOrbitDBStore(ctx context.Context, store orbitdb.Store, t
 				err = multierr.Append(err, clErr)
 			}
 
-			return errcode.ErrCode_ErrInternal.Wrap(err)
+			return 0, errcode.ErrCode_ErrInternal.Wrap(err)
 		}
 	}
 
-	return nil
+	return len(allCIDs), nil
 }
 
 func (s *service) exportAccountKeys(tw *tar.Writer) error {
@@ -155,8 +296,7 @@ func (s *service) exportOrbitDBGroupHeads(gc *GroupContext, headsMetadata []cid.
 		MessagesHeadsCids: cidsMessages,
 		LinkKey:           linkKeyArr[:],
 	}
-
-	entryName := base64.RawURLEncoding.EncodeToString(gc.group.PublicKey)
+	headsExport.KeysChecksum = groupKeysChecksum(headsExport)
 
 	data, err := proto.Marshal(headsExport)
 	if err != nil {
@@ -165,7 +305,7 @@ func (s *service) exportOrbitDBGroupHeads(gc *GroupContext, headsMetadata []cid.
 
 	if err := tw.WriteHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
-		Name:     fmt.Sprintf("%s%s", exportOrbitDBHeadsPrefix, entryName),
+		Name:     exportGroupHeadsFilename(gc.group.PublicKey),
 		Mode:     0o600,
 		Size:     int64(len(data)),
 	}); err != nil {
@@ -184,6 +324,12 @@ func (s *service) exportOrbitDBGroupHeads(gc *GroupContext, headsMetadata []cid.
 	return nil
 }
 
+// exportGroupHeadsFilename returns the name of the archive file holding the
+// heads of a group
+func exportGroupHeadsFilename(groupPK []byte) string {
+	return exportOrbitDBHeadsPrefix + base64.RawURLEncoding.EncodeToString(groupPK)
+}
+
 func exportPrivateKey(tw *tar.Writer, marshalledPrivateKey []byte, filename string) error {
 	if err := tw.WriteHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
@@ -297,6 +443,85 @@ func readExportOrbitDBGroupHeads(expectedSize int64, reader *tar.Reader) (*proto
 	return groupHeads, metaCIDs, messagesCIDs, nil
 }
 
+// groupKeysChecksum returns a checksum of the keys of an exported group
+func groupKeysChecksum(heads *protocoltypes.GroupHeadsExport) []byte {
+	h := sha256.New()
+	for _, key := range [][]byte{heads.PublicKey, heads.SignPub, heads.LinkKey} {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(key)))
+		h.Write(key)
+	}
+
+	return h.Sum(nil)
+}
+
+// checkGroupKeys verifies that the keys of an exported group are usable and
+// match the checksum computed during the export, the exports made before the
+// checksum was added are only checked for usable keys
+func checkGroupKeys(heads *protocoltypes.GroupHeadsExport, g *protocoltypes.Group) error {
+	if _, err := g.GetPubKey(); err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("invalid group public key: %w", err))
+	}
+
+	if _, err := g.GetSigningPubKey(); err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("invalid signing key: %w", err))
+	}
+
+	if _, err := g.GetLinkKeyArray(); err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("invalid link key: %w", err))
+	}
+
+	if heads.KeysChecksum == nil {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare(heads.KeysChecksum, groupKeysChecksum(heads)) != 1 {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("group keys don't match the export checksum"))
+	}
+
+	return nil
+}
+
+// openExportedHead opens a restored metadata head of a group, the entry is
+// decrypted using the link key of the group, then its payload is opened using
+// the group secret if it is known. It fails with ErrGroupKeyMismatch if the
+// keys of the group can't open the head.
+func openExportedHead(ctx context.Context, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB, g *protocoltypes.Group, head cid.Cid) error {
+	// the heads are part of the export, they are never fetched from the
+	// network
+	offlineAPI, err := coreAPI.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	linkKey, err := g.GetLinkKeyArray()
+	if err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("invalid link key: %w", err))
+	}
+
+	sk, err := enc.NewSecretbox(linkKey[:])
+	if err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("invalid link key: %w", err))
+	}
+
+	cborIO := logio.CBOR()
+	cborIO.ApplyOptions(&logio.CBOROptions{LinkKey: sk})
+
+	e, err := entry.FromMultihashWithIO(ctx, offlineAPI, head, odb.keyStore.getIdentityProvider(), cborIO)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("unable to decrypt head %s using the link key: %w", head, err))
+	}
+
+	if len(g.Secret) == 0 {
+		return nil
+	}
+
+	if _, _, err := openMetadataEntry(nil, e, g, odb.secretStore.CipherSuites(), odb.sigVerifier.withoutReport()); err != nil {
+		return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("unable to open head %s using the group keys: %w", head, err))
+	}
+
+	return nil
+}
+
 func readExportCBORNode(expectedSize int64, cidStr string, reader *tar.Reader) (*cbornode.Node, error) {
 	if expectedSize == 0 {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid expected node size"))
@@ -336,6 +561,35 @@ type RestoreAccountHandler struct {
 
 type restoreAccountState struct {
 	keys map[string][]byte
+
+	// entries and groups are tracked to roll back an incomplete restore
+	entries []cid.Cid
+	groups  []*protocoltypes.Group
+	mu      sync.Mutex
+
+	// localStates are restored once everything else has been restored
+	localStates []*protocoltypes.GroupLocalStateExport
+
+	// heads are the restored heads by group public key, they are used to
+	// check the account keys before importing them
+	heads map[string]*restoredGroupHeads
+
+	// checkpoint is set when the restore can be resumed
+	checkpoint *restoreCheckpoint
+}
+
+func newRestoreAccountState(checkpoint *restoreCheckpoint) *restoreAccountState {
+	return &restoreAccountState{
+		keys:       map[string][]byte{},
+		heads:      map[string]*restoredGroupHeads{},
+		checkpoint: checkpoint,
+	}
+}
+
+// restoredGroupHeads holds the keys and the metadata heads of a restored group
+type restoredGroupHeads struct {
+	export        *protocoltypes.GroupHeadsExport
+	metadataHeads []cid.Cid
 }
 
 func (state *restoreAccountState) readKey(keyName string) RestoreAccountHandler {
@@ -361,6 +615,67 @@ func (state *restoreAccountState) readKey(keyName string) RestoreAccountHandler
 	}
 }
 
+// checkAccountKeys verifies that the account keys of the archive are the keys
+// of the exported account group, a metadata head of the account group must be
+// opened using the group derived from the keys
+func (state *restoreAccountState) checkAccountKeys(ctx context.Context, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB) RestoreAccountHandler {
+	return RestoreAccountHandler{
+		PostProcess: func() error {
+			accountKey, accountProofKey := state.keys[exportAccountKeyFilename], state.keys[exportAccountProofKeyFilename]
+			if accountKey == nil || accountProofKey == nil {
+				// reported by the import of the keys
+				return nil
+			}
+
+			g, err := secretstore.GetGroupForAccountKeys(accountKey, accountProofKey)
+			if err != nil {
+				return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(err)
+			}
+
+			state.mu.Lock()
+			restored, ok := state.heads[string(g.PublicKey)]
+			state.mu.Unlock()
+
+			if !ok {
+				// the heads of the account group have been restored by a
+				// previous attempt
+				if state.checkpoint.hasGroup(g.PublicKey) {
+					return nil
+				}
+
+				return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("the account group of the keys isn't part of the export"))
+			}
+
+			signPub, err := g.GetSigningPubKey()
+			if err != nil {
+				return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(err)
+			}
+
+			signPubBytes, err := signPub.Raw()
+			if err != nil {
+				return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(err)
+			}
+
+			linkKey, err := g.GetLinkKeyArray()
+			if err != nil {
+				return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(err)
+			}
+
+			if !bytes.Equal(signPubBytes, restored.export.SignPub) || !bytes.Equal(linkKey[:], restored.export.LinkKey) {
+				return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("the account keys don't match the exported account group"))
+			}
+
+			for _, head := range restored.metadataHeads {
+				if err := openExportedHead(ctx, coreAPI, odb, g, head); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
 func (state *restoreAccountState) restoreKeys(odb *WeshOrbitDB) RestoreAccountHandler {
 	return RestoreAccountHandler{
 		PostProcess: func() error {
@@ -373,7 +688,7 @@ func (state *restoreAccountState) restoreKeys(odb *WeshOrbitDB) RestoreAccountHa
 	}
 }
 
-func restoreOrbitDBEntry(ctx context.Context, coreAPI coreiface.CoreAPI) RestoreAccountHandler {
+func (state *restoreAccountState) restoreOrbitDBEntry(ctx context.Context, coreAPI coreiface.CoreAPI) RestoreAccountHandler {
 	return RestoreAccountHandler{
 		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
 			if !strings.HasPrefix(header.Name, exportOrbitDBEntriesPrefix) {
@@ -381,22 +696,42 @@ func restoreOrbitDBEntry(ctx context.Context, coreAPI coreiface.CoreAPI) Restore
 			}
 
 			cidStr := strings.TrimPrefix(header.Name, exportOrbitDBEntriesPrefix)
+			if state.checkpoint.hasEntry(cidStr) {
+				return true, nil
+			}
 
 			node, err := readExportCBORNode(header.Size, cidStr, reader)
 			if err != nil {
 				return true, errcode.ErrCode_ErrInternal.Wrap(err)
 			}
 
+			// the entries which were already there before the restore must
+			// be kept on rollback
+			existed, err := hasLocalBlock(ctx, coreAPI, node.Cid())
+			if err != nil {
+				return true, err
+			}
+
 			if err := coreAPI.Dag().Add(ctx, node); err != nil {
 				return true, errcode.ErrCode_ErrInternal.Wrap(err)
 			}
 
+			if !existed {
+				state.mu.Lock()
+				state.entries = append(state.entries, node.Cid())
+				state.mu.Unlock()
+			}
+
+			if err := state.checkpoint.addEntry(ctx, node.Cid().String()); err != nil {
+				return true, err
+			}
+
 			return true, nil
 		},
 	}
 }
 
-func restoreOrbitDBHeads(ctx context.Context, odb *WeshOrbitDB) RestoreAccountHandler {
+func (state *restoreAccountState) restoreOrbitDBHeads(ctx context.Context, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB) RestoreAccountHandler {
 	return RestoreAccountHandler{
 		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
 			if !strings.HasPrefix(header.Name, exportOrbitDBHeadsPrefix) {
@@ -408,37 +743,145 @@ func restoreOrbitDBHeads(ctx context.Context, odb *WeshOrbitDB) RestoreAccountHa
 				return true, errcode.ErrCode_ErrInternal.Wrap(err)
 			}
 
-			if err := odb.setHeadsForGroup(ctx, &protocoltypes.Group{
+			if state.checkpoint.hasGroup(heads.PublicKey) {
+				return true, nil
+			}
+
+			g := &protocoltypes.Group{
 				PublicKey: heads.PublicKey,
 				SignPub:   heads.SignPub,
 				LinkKey:   heads.LinkKey,
-			}, metaCIDs, messageCIDs); err != nil {
+			}
+
+			if err := checkGroupKeys(heads, g); err != nil {
+				return true, err
+			}
+
+			// the link key must decrypt the heads, the secret of the group
+			// is not part of the export, it is checked once known
+			if len(metaCIDs) > 0 {
+				if err := openExportedHead(ctx, coreAPI, odb, g, metaCIDs[0]); err != nil {
+					return true, err
+				}
+			}
+
+			state.mu.Lock()
+			state.heads[string(heads.PublicKey)] = &restoredGroupHeads{export: heads, metadataHeads: metaCIDs}
+			state.mu.Unlock()
+
+			// the stores of the groups which were already there before the
+			// restore must be kept on rollback
+			existed, err := odb.groupHasLocalData(ctx, g)
+			if err != nil {
+				return true, err
+			}
+
+			if !existed {
+				state.mu.Lock()
+				state.groups = append(state.groups, g)
+				state.mu.Unlock()
+			}
+
+			if err := odb.setHeadsForGroup(ctx, g, metaCIDs, messageCIDs); err != nil {
 				return true, errcode.ErrCode_ErrOrbitDBAppend.Wrap(fmt.Errorf("error while restoring db head: %w", err))
 			}
 
+			if err := state.checkpoint.addGroup(ctx, heads.PublicKey); err != nil {
+				return true, err
+			}
+
 			return true, nil
 		},
 	}
 }
 
-func RestoreAccountExport(ctx context.Context, reader io.Reader, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB, logger *zap.Logger, handlers ...RestoreAccountHandler) error {
-	tr := tar.NewReader(reader)
-	state := restoreAccountState{
-		keys: map[string][]byte{},
+// rollback removes the entries and the group stores added by the restore so
+// far, leaving the datastore as it was before the restore, the ones which
+// were already there are kept. Account keys are imported last so they are
+// never part of an incomplete restore.
+func (state *restoreAccountState) rollback(coreAPI coreiface.CoreAPI, odb *WeshOrbitDB) error {
+	// the restore context is likely to be canceled at this point
+	ctx := context.Background()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	var errs error
+
+	for _, g := range state.groups {
+		if err := odb.dropStoresForGroup(ctx, g); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	if len(state.entries) > 0 {
+		if err := coreAPI.Dag().RemoveMany(ctx, state.entries); err != nil {
+			errs = multierr.Append(errs, errcode.ErrCode_ErrDBDestroy.Wrap(err))
+		}
 	}
 
+	state.groups, state.entries = nil, nil
+
+	return errs
+}
+
+// RestoreAccountExport restores an account export, what has been restored is
+// rolled back if the restore fails. It doesn't use a checkpoint, see
+// RestoreAccountExportWithCheckpoint: resuming needs an archive which can be
+// read twice and has a manifest identifying it, and leaves the partially
+// restored data in place on failure, which the callers of this function
+// don't expect.
+func RestoreAccountExport(ctx context.Context, reader io.Reader, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB, logger *zap.Logger, handlers ...RestoreAccountHandler) (err error) {
+	ctx, span := contextTracer(ctx).Start(ctx, "RestoreAccountExport")
+	defer func() { endSpan(span, err) }()
+
+	state := newRestoreAccountState(nil)
+	if err := state.restore(ctx, reader, coreAPI, odb, logger, handlers); err != nil {
+		if rollbackErr := state.rollback(coreAPI, odb); rollbackErr != nil {
+			logger.Error("unable to roll back incomplete restore", zap.Error(rollbackErr))
+			return multierr.Append(err, rollbackErr)
+		}
+
+		return err
+	}
+
+	odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeAccountRestored,
+	})
+
+	return nil
+}
+
+// restore runs the restore handlers followed by the given ones on the archive,
+// the account keys are imported last
+func (state *restoreAccountState) restore(ctx context.Context, reader io.Reader, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB, logger *zap.Logger, handlers []RestoreAccountHandler) error {
 	handlers = append(
 		[]RestoreAccountHandler{
 			state.readKey(exportAccountKeyFilename),
 			state.readKey(exportAccountProofKeyFilename),
-			state.restoreKeys(odb),
-			restoreOrbitDBEntry(ctx, coreAPI),
-			restoreOrbitDBHeads(ctx, odb),
+			state.restoreOrbitDBEntry(ctx, coreAPI),
+			state.restoreOrbitDBHeads(ctx, coreAPI, odb),
+			state.restoreLocalState(ctx, odb),
+			checkExportManifest(),
 		},
 		handlers...,
 	)
 
+	// the keys are imported once every other step has succeeded, as their
+	// import can't be rolled back
+	handlers = append(handlers, state.checkAccountKeys(ctx, coreAPI, odb), state.restoreKeys(odb))
+
+	return restoreAccountExport(ctx, tar.NewReader(reader), logger, handlers)
+}
+
+// restoreAccountExport runs the handlers on every entry of the archive, it
+// stops as soon as the context is done
+func restoreAccountExport(ctx context.Context, tr *tar.Reader, logger *zap.Logger, handlers []RestoreAccountHandler) error {
 	for {
+		if err := ctx.Err(); err != nil {
+			return errcode.ErrCode_ErrDBRestore.Wrap(err)
+		}
+
 		header, err := tr.Next()
 
 		if err == io.EOF {
@@ -475,6 +918,10 @@ func RestoreAccountExport(ctx context.Context, reader io.Reader, coreAPI coreifa
 		}
 	}
 
+	if err := ctx.Err(); err != nil {
+		return errcode.ErrCode_ErrDBRestore.Wrap(err)
+	}
+
 	for _, h := range handlers {
 		if h.PostProcess == nil {
 			continue
@@ -487,3 +934,22 @@ func RestoreAccountExport(ctx context.Context, reader io.Reader, coreAPI coreifa
 
 	return nil
 }
+
+// hasLocalBlock checks whether a block is in the local blockstore, it is never
+// fetched from the network
+func hasLocalBlock(ctx context.Context, coreAPI coreiface.CoreAPI, id cid.Cid) (bool, error) {
+	offlineAPI, err := coreAPI.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return false, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if _, err := offlineAPI.Block().Stat(ctx, path.FromCid(id)); err != nil {
+		if ipld.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,360 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	coreiface "github.com/ipfs/kubo/core/coreiface"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// restoreCheckpointInterval is the number of entries restored between two
+// saves of the checkpoint, the entries restored since the last save are
+// restored again if the process is killed
+const restoreCheckpointInterval = 100
+
+var (
+	// restoreCheckpointKey holds the manifest hash of the archive being
+	// restored
+	restoreCheckpointKey = datastore.NewKey("current")
+
+	// restoreCheckpointEntriesKey and restoreCheckpointGroupsKey hold one key
+	// per restored entry and group, so saving the checkpoint only writes what
+	// has been restored since the previous save
+	restoreCheckpointEntriesKey = datastore.NewKey("entries")
+	restoreCheckpointGroupsKey  = datastore.NewKey("groups")
+)
+
+// restoreCheckpoint tracks the progress of a resumable restore, a nil
+// checkpoint tracks nothing
+type restoreCheckpoint struct {
+	ds           datastore.Batching
+	manifestHash []byte
+	entries      map[string]struct{}
+	groups       map[string]struct{}
+	unsaved      []string
+	started      bool
+	mu           sync.Mutex
+}
+
+// loadRestoreCheckpoint returns the checkpoint of the restore of the archive
+// with the given manifest hash, it is empty if no restore is in progress.
+// ErrRestoreCheckpointMismatch is returned if the checkpoint belongs to
+// another archive.
+func loadRestoreCheckpoint(ctx context.Context, d datastore.Batching, manifestHash []byte) (*restoreCheckpoint, error) {
+	checkpoint := &restoreCheckpoint{
+		ds:           d,
+		manifestHash: manifestHash,
+		entries:      make(map[string]struct{}),
+		groups:       make(map[string]struct{}),
+	}
+
+	data, err := d.Get(ctx, restoreCheckpointKey)
+	if err == datastore.ErrNotFound {
+		return checkpoint, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	saved := &protocoltypes.AccountRestoreCheckpoint{}
+	if err := proto.Unmarshal(data, saved); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if !bytes.Equal(saved.ManifestHash, manifestHash) {
+		return nil, errcode.ErrCode_ErrRestoreCheckpointMismatch.Wrap(fmt.Errorf("a restore of another archive is in progress"))
+	}
+
+	checkpoint.started = true
+
+	err = forEachCheckpointKey(ctx, d, restoreCheckpointEntriesKey, func(key datastore.Key) error {
+		checkpoint.entries[key.BaseNamespace()] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEachCheckpointKey(ctx, d, restoreCheckpointGroupsKey, func(key datastore.Key) error {
+		pk, err := hex.DecodeString(key.BaseNamespace())
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		checkpoint.groups[string(pk)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+// forEachCheckpointKey calls fn for each key under prefix
+func forEachCheckpointKey(ctx context.Context, d datastore.Datastore, prefix datastore.Key, fn func(key datastore.Key) error) error {
+	results, err := d.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		if err := fn(datastore.RawKey(result.Key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *restoreCheckpoint) hasEntry(id string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[id]
+	return ok
+}
+
+// addEntry records a restored entry, the entries are saved by batches of
+// restoreCheckpointInterval
+func (c *restoreCheckpoint) addEntry(ctx context.Context, id string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[id]; ok {
+		return nil
+	}
+
+	c.entries[id] = struct{}{}
+	if c.unsaved = append(c.unsaved, id); len(c.unsaved) < restoreCheckpointInterval {
+		return nil
+	}
+
+	return c.saveLocked(ctx)
+}
+
+func (c *restoreCheckpoint) hasGroup(groupPK []byte) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.groups[string(groupPK)]
+	return ok
+}
+
+// addGroup records a group whose heads are restored, it is saved right away
+// along with the pending entries
+func (c *restoreCheckpoint) addGroup(ctx context.Context, groupPK []byte) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.groups[string(groupPK)] = struct{}{}
+
+	return c.saveLocked(ctx, groupPK)
+}
+
+func (c *restoreCheckpoint) save(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.saveLocked(ctx)
+}
+
+// saveLocked writes the pending entries and the given groups, the manifest
+// hash is written along with the first save
+func (c *restoreCheckpoint) saveLocked(ctx context.Context, groupPKs ...[]byte) error {
+	batch, err := c.ds.Batch(ctx)
+	if err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if !c.started {
+		data, err := proto.Marshal(&protocoltypes.AccountRestoreCheckpoint{ManifestHash: c.manifestHash})
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if err := batch.Put(ctx, restoreCheckpointKey, data); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	for _, id := range c.unsaved {
+		if err := batch.Put(ctx, restoreCheckpointEntriesKey.ChildString(id), []byte{}); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	for _, pk := range groupPKs {
+		if err := batch.Put(ctx, restoreCheckpointGroupsKey.ChildString(hex.EncodeToString(pk)), []byte{}); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	c.started = true
+	c.unsaved = c.unsaved[:0]
+
+	return nil
+}
+
+// deleteRestoreCheckpoint removes the checkpoint, the manifest hash is
+// removed last so a partially removed checkpoint is still found
+func deleteRestoreCheckpoint(ctx context.Context, d datastore.Batching) error {
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	for _, prefix := range []datastore.Key{restoreCheckpointEntriesKey, restoreCheckpointGroupsKey} {
+		err := forEachCheckpointKey(ctx, d, prefix, func(key datastore.Key) error {
+			if err := batch.Delete(ctx, key); err != nil {
+				return errcode.ErrCode_ErrDBWrite.Wrap(err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := d.Delete(ctx, restoreCheckpointKey); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// exportManifestHash returns the SHA-256 of the manifest file of an archive,
+// the reader is then moved back to its initial position
+func exportManifestHash(reader io.ReadSeeker) ([]byte, error) {
+	start, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	var sum []byte
+
+	tr := tar.NewReader(reader)
+	for sum == nil {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no manifest in the archive, it is required to resume a restore"))
+		} else if err != nil {
+			return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		if header.Name != exportManifestProtobufFilename && header.Name != exportManifestJSONFilename {
+			continue
+		}
+
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		sum = h.Sum(nil)
+	}
+
+	if _, err := reader.Seek(start, io.SeekStart); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	return sum, nil
+}
+
+// RestoreAccountExportWithCheckpoint restores an account export like
+// RestoreAccountExport, except that an interrupted restore isn't rolled back:
+// its progress is saved in a checkpoint and the next restore of the same
+// archive skips the entries and the groups already restored. The archive must
+// have a manifest, its hash identifies the archive of the checkpoint.
+// ErrRestoreCheckpointMismatch is returned if the restore of another archive
+// is in progress, see DiscardAccountRestoreCheckpoint. The checkpoint is
+// removed once the restore is done.
+func RestoreAccountExportWithCheckpoint(ctx context.Context, archive io.ReadSeeker, coreAPI coreiface.CoreAPI, odb *WeshOrbitDB, logger *zap.Logger, handlers ...RestoreAccountHandler) (err error) {
+	ctx, span := contextTracer(ctx).Start(ctx, "RestoreAccountExportWithCheckpoint")
+	defer func() { endSpan(span, err) }()
+
+	manifestHash, err := exportManifestHash(archive)
+	if err != nil {
+		return err
+	}
+
+	checkpoint, err := loadRestoreCheckpoint(ctx, odb.restoreCheckpoints, manifestHash)
+	if err != nil {
+		return err
+	}
+
+	state := newRestoreAccountState(checkpoint)
+	if err := state.restore(ctx, archive, coreAPI, odb, logger, handlers); err != nil {
+		// the restore context is likely to be canceled at this point
+		if saveErr := checkpoint.save(context.Background()); saveErr != nil {
+			logger.Error("unable to save the restore checkpoint", zap.Error(saveErr))
+			return multierr.Append(err, saveErr)
+		}
+
+		return err
+	}
+
+	if err := deleteRestoreCheckpoint(ctx, odb.restoreCheckpoints); err != nil {
+		return err
+	}
+
+	odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeAccountRestored,
+	})
+
+	return nil
+}
+
+// DiscardAccountRestoreCheckpoint removes the checkpoint of an interrupted
+// restore, the next restore starts over. What has already been restored is
+// kept.
+func DiscardAccountRestoreCheckpoint(ctx context.Context, odb *WeshOrbitDB) error {
+	return deleteRestoreCheckpoint(ctx, odb.restoreCheckpoints)
+}
@@ -0,0 +1,309 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/pubsub/pubsubraw"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+// interruptingReader cancels the given context once limit bytes have been
+// read since the reader was moved back to the start of the archive, which
+// happens once the manifest has been hashed
+type interruptingReader struct {
+	io.ReadSeeker
+	cancel context.CancelFunc
+	limit  int64
+	read   int64
+	armed  bool
+}
+
+func (r *interruptingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if r.armed {
+		r.read += int64(n)
+		if r.read >= r.limit {
+			r.cancel()
+		}
+	}
+
+	return n, err
+}
+
+func (r *interruptingReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		r.armed = true
+	}
+
+	return r.ReadSeeker.Seek(offset, whence)
+}
+
+type restoreTestNode struct {
+	secretStore secretstore.SecretStore
+	ipfs        ipfsutil.CoreAPIMock
+	odb         *WeshOrbitDB
+}
+
+func newRestoreTestNode(ctx context.Context, t *testing.T, mn mocknet.Mocknet, logger *zap.Logger) *restoreTestNode {
+	t.Helper()
+
+	dsNode := dsync.MutexWrap(ds.NewMapDatastore())
+	secretStore, err := secretstore.NewSecretStore(dsNode, nil)
+	require.NoError(t, err)
+
+	ipfsNode := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+		Mocknet:   mn,
+		Datastore: dsNode,
+	})
+
+	odb, err := NewWeshOrbitDB(ctx, ipfsNode.API(), &NewOrbitDBOptions{
+		NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+			PubSub: pubsubraw.NewPubSub(ipfsNode.PubSub(), ipfsNode.MockNode().PeerHost.ID(), logger, nil),
+			Logger: logger,
+		},
+		Datastore:   dsNode,
+		SecretStore: secretStore,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = odb.Close() })
+
+	return &restoreTestNode{secretStore: secretStore, ipfs: ipfsNode, odb: odb}
+}
+
+// restoredHeads returns the heads and the number of entries of the stores of
+// a restored group
+func (n *restoreTestNode) restoredHeads(ctx context.Context, t *testing.T, groupPK []byte) ([][]string, []int) {
+	t.Helper()
+
+	g, ok := n.odb.groups.Load((&protocoltypes.Group{PublicKey: groupPK}).GroupIDAsString())
+	require.True(t, ok)
+
+	stores, err := n.odb.openStoresWithoutReplication(ctx, g.(*protocoltypes.Group))
+	require.NoError(t, err)
+
+	heads, lengths := [][]string{}, []int{}
+	for _, store := range stores {
+		storeHeads := []string{}
+		for _, head := range store.OpLog().RawHeads().Slice() {
+			storeHeads = append(storeHeads, head.GetHash().String())
+		}
+		sort.Strings(storeHeads)
+
+		heads = append(heads, storeHeads)
+		lengths = append(lengths, store.OpLog().Len())
+
+		require.NoError(t, store.Close())
+	}
+
+	return heads, lengths
+}
+
+func TestRestoreAccountExportWithCheckpoint(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	tmpFile, err := os.CreateTemp(os.TempDir(), "test-export-")
+	require.NoError(t, err)
+
+	defer os.Remove(tmpFile.Name())
+
+	exportedEntries := []cid.Cid{}
+	var accountPrivateKeyA []byte
+
+	{
+		dsA := dsync.MutexWrap(ds.NewMapDatastore())
+		nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+			Mocknet: mn,
+		}, dsA)
+
+		serviceA, ok := nodeA.Service.(*service)
+		require.True(t, ok)
+
+		accountPrivateKeyA, _, err = serviceA.secretStore.ExportAccountKeysForBackup()
+		require.NoError(t, err)
+
+		created, err := nodeA.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+		require.NoError(t, err)
+
+		for _, gc := range []*GroupContext{serviceA.getAccountGroup(), serviceA.openedGroups[string(created.GroupPk)]} {
+			require.NotNil(t, gc)
+
+			for i := 0; i < 30; i++ {
+				op, err := gc.messageStore.AddMessage(ctx, []byte(fmt.Sprintf("testMessage%d", i)))
+				require.NoError(t, err)
+
+				exportedEntries = append(exportedEntries, op.GetEntry().GetHash())
+			}
+		}
+
+		require.NoError(t, serviceA.export(ctx, tmpFile, exportOptions{format: protocoltypes.ExportFormat_ExportFormatProtobuf}))
+
+		closeNodeA()
+		require.NoError(t, dsA.Close())
+	}
+
+	stat, err := tmpFile.Stat()
+	require.NoError(t, err)
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	manifest, err := ReadAccountExportManifest(tmpFile)
+	require.NoError(t, err)
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	manifestHash, err := exportManifestHash(tmpFile)
+	require.NoError(t, err)
+
+	nodeB := newRestoreTestNode(ctx, t, mn, logger)
+
+	// interrupt the restore halfway through the archive
+	restoreCtx, restoreCancel := context.WithCancel(ctx)
+	defer restoreCancel()
+
+	reader := &interruptingReader{ReadSeeker: tmpFile, cancel: restoreCancel, limit: stat.Size() / 2}
+
+	err = RestoreAccountExportWithCheckpoint(restoreCtx, reader, nodeB.ipfs.API(), nodeB.odb, logger)
+	require.Error(t, err)
+
+	// the progress is kept
+	checkpoint, err := loadRestoreCheckpoint(ctx, nodeB.odb.restoreCheckpoints, manifestHash)
+	require.NoError(t, err)
+	require.NotEmpty(t, checkpoint.entries)
+	require.Less(t, len(checkpoint.entries), len(exportedEntries))
+
+	for id := range checkpoint.entries {
+		c, err := cid.Parse(id)
+		require.NoError(t, err)
+
+		_, err = nodeB.ipfs.API().Dag().Get(ctx, c)
+		require.NoError(t, err)
+	}
+
+	// the checkpoint can't be used with another archive
+	_, err = loadRestoreCheckpoint(ctx, nodeB.odb.restoreCheckpoints, []byte("another manifest"))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrRestoreCheckpointMismatch))
+
+	accountPrivateKeyB, _, err := nodeB.secretStore.ExportAccountKeysForBackup()
+	require.NoError(t, err)
+	require.NotEqual(t, accountPrivateKeyA, accountPrivateKeyB)
+
+	// resume the restore
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	require.NoError(t, RestoreAccountExportWithCheckpoint(ctx, tmpFile, nodeB.ipfs.API(), nodeB.odb, logger))
+
+	// the whole checkpoint is removed
+	results, err := nodeB.odb.restoreCheckpoints.Query(ctx, query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	remaining, err := results.Rest()
+	require.NoError(t, err)
+	require.Empty(t, remaining)
+
+	// restore the archive on another node at once
+	nodeC := newRestoreTestNode(ctx, t, mn, logger)
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	require.NoError(t, RestoreAccountExport(ctx, tmpFile, nodeC.ipfs.API(), nodeC.odb, logger))
+
+	// both restores lead to the same state
+	accountPrivateKeyB, _, err = nodeB.secretStore.ExportAccountKeysForBackup()
+	require.NoError(t, err)
+	require.Equal(t, accountPrivateKeyA, accountPrivateKeyB)
+
+	for _, c := range exportedEntries {
+		getCtx, getCancel := context.WithTimeout(ctx, time.Second)
+		_, err := nodeB.ipfs.API().Dag().Get(getCtx, c)
+		getCancel()
+		require.NoError(t, err, "entry %s should have been restored", c.String())
+	}
+
+	require.Len(t, manifest.Groups, 2)
+	for _, group := range manifest.Groups {
+		headsB, lengthsB := nodeB.restoredHeads(ctx, t, group.PublicKey)
+		headsC, lengthsC := nodeC.restoredHeads(ctx, t, group.PublicKey)
+
+		require.Equal(t, headsC, headsB)
+		require.Equal(t, lengthsC, lengthsB)
+
+		expectedMetadataHeads := append([]string{}, group.MetadataHeads...)
+		sort.Strings(expectedMetadataHeads)
+		expectedMessagesHeads := append([]string{}, group.MessagesHeads...)
+		sort.Strings(expectedMessagesHeads)
+
+		require.Equal(t, [][]string{expectedMetadataHeads, expectedMessagesHeads}, headsB)
+	}
+}
+
+func TestRestoreCheckpointSave(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := dsync.MutexWrap(ds.NewMapDatastore())
+	manifestHash := []byte("manifest")
+
+	checkpoint, err := loadRestoreCheckpoint(ctx, store, manifestHash)
+	require.NoError(t, err)
+
+	countKeys := func(prefix ds.Key) int {
+		results, err := store.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+		require.NoError(t, err)
+		entries, err := results.Rest()
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	// the entries are saved by batches, each entry has its own key
+	for i := 0; i < restoreCheckpointInterval*2+1; i++ {
+		require.NoError(t, checkpoint.addEntry(ctx, fmt.Sprintf("entry%d", i)))
+	}
+	require.Equal(t, restoreCheckpointInterval*2, countKeys(restoreCheckpointEntriesKey))
+
+	// the pending entries are saved along with a group
+	require.NoError(t, checkpoint.addGroup(ctx, []byte("group")))
+	require.Equal(t, restoreCheckpointInterval*2+1, countKeys(restoreCheckpointEntriesKey))
+	require.Equal(t, 1, countKeys(restoreCheckpointGroupsKey))
+
+	loaded, err := loadRestoreCheckpoint(ctx, store, manifestHash)
+	require.NoError(t, err)
+	require.Equal(t, checkpoint.entries, loaded.entries)
+	require.True(t, loaded.hasGroup([]byte("group")))
+
+	_, err = loadRestoreCheckpoint(ctx, store, []byte("another manifest"))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrRestoreCheckpointMismatch))
+
+	require.NoError(t, deleteRestoreCheckpoint(ctx, store))
+	require.Zero(t, countKeys(ds.NewKey("/")))
+}
@@ -0,0 +1,229 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// exportEntryLogIDField is the field of an orbitdb entry holding the ID of
+// the log it belongs to
+const exportEntryLogIDField = "id"
+
+// AccountExportDiff lists the differences between two account exports
+type AccountExportDiff struct {
+	// GroupsOnlyInA and GroupsOnlyInB are the public keys of the groups
+	// exported in a single archive
+	GroupsOnlyInA [][]byte
+	GroupsOnlyInB [][]byte
+
+	// Groups are the groups exported in both archives with different
+	// messages
+	Groups []*GroupExportDiff
+}
+
+// GroupExportDiff lists the messages of a group exported in a single archive
+type GroupExportDiff struct {
+	GroupPK         []byte
+	MessagesOnlyInA []cid.Cid
+	MessagesOnlyInB []cid.Cid
+}
+
+// IsEmpty returns true if both archives contain the same groups and messages
+func (d *AccountExportDiff) IsEmpty() bool {
+	return len(d.GroupsOnlyInA) == 0 && len(d.GroupsOnlyInB) == 0 && len(d.Groups) == 0
+}
+
+// exportSummary is the list of the messages of each group of an account
+// export, only the CIDs are kept so large archives can be compared
+type exportSummary struct {
+	// entriesLogID is the log ID of each entry of the archive
+	entriesLogID map[cid.Cid]string
+	// messagesHeads are the heads of the message log of each group, by group
+	// public key
+	messagesHeads map[string][]cid.Cid
+}
+
+// DiffAccountExports compares two account exports, it reports the groups
+// exported in a single archive and the messages exported in a single archive
+// for the other groups. The archives are only read, nothing is restored.
+func DiffAccountExports(a, b io.Reader) (*AccountExportDiff, error) {
+	summaryA, err := readExportSummary(a)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the first export: %w", err)
+	}
+
+	summaryB, err := readExportSummary(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the second export: %w", err)
+	}
+
+	diff := &AccountExportDiff{}
+
+	for _, groupPK := range sortedKeys(summaryA.messagesHeads) {
+		if _, ok := summaryB.messagesHeads[groupPK]; !ok {
+			diff.GroupsOnlyInA = append(diff.GroupsOnlyInA, []byte(groupPK))
+			continue
+		}
+
+		messagesA, messagesB := summaryA.groupMessages(groupPK), summaryB.groupMessages(groupPK)
+		groupDiff := &GroupExportDiff{
+			GroupPK:         []byte(groupPK),
+			MessagesOnlyInA: cidsDifference(messagesA, messagesB),
+			MessagesOnlyInB: cidsDifference(messagesB, messagesA),
+		}
+
+		if len(groupDiff.MessagesOnlyInA) > 0 || len(groupDiff.MessagesOnlyInB) > 0 {
+			diff.Groups = append(diff.Groups, groupDiff)
+		}
+	}
+
+	for _, groupPK := range sortedKeys(summaryB.messagesHeads) {
+		if _, ok := summaryA.messagesHeads[groupPK]; !ok {
+			diff.GroupsOnlyInB = append(diff.GroupsOnlyInB, []byte(groupPK))
+		}
+	}
+
+	return diff, nil
+}
+
+func readExportSummary(reader io.Reader) (*exportSummary, error) {
+	summary := &exportSummary{
+		entriesLogID:  map[cid.Cid]string{},
+		messagesHeads: map[string][]cid.Cid{},
+	}
+
+	handlers := []RestoreAccountHandler{
+		skipExportFile(exportAccountKeyFilename),
+		skipExportFile(exportAccountProofKeyFilename),
+		checkExportManifest(),
+		summary.readEntry(),
+		summary.readHeads(),
+	}
+
+	if err := restoreAccountExport(context.Background(), tar.NewReader(reader), zap.NewNop(), handlers); err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// skipExportFile ignores a file of the archive
+func skipExportFile(filename string) RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, _ *tar.Reader) (bool, error) {
+			return header.Name == filename, nil
+		},
+	}
+}
+
+func (summary *exportSummary) readEntry() RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			if !strings.HasPrefix(header.Name, exportOrbitDBEntriesPrefix) {
+				return false, nil
+			}
+
+			cidStr := strings.TrimPrefix(header.Name, exportOrbitDBEntriesPrefix)
+
+			node, err := readExportCBORNode(header.Size, cidStr, reader)
+			if err != nil {
+				return true, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			logID, _, err := node.Resolve([]string{exportEntryLogIDField})
+			if err != nil {
+				return true, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("unable to get the log of entry %s: %w", cidStr, err))
+			}
+
+			logIDStr, ok := logID.(string)
+			if !ok {
+				return true, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid log ID for entry %s", cidStr))
+			}
+
+			summary.entriesLogID[node.Cid()] = logIDStr
+
+			return true, nil
+		},
+	}
+}
+
+func (summary *exportSummary) readHeads() RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			if !strings.HasPrefix(header.Name, exportOrbitDBHeadsPrefix) {
+				return false, nil
+			}
+
+			heads, _, messageCIDs, err := readExportOrbitDBGroupHeads(header.Size, reader)
+			if err != nil {
+				return true, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			if header.Name != exportGroupHeadsFilename(heads.PublicKey) {
+				return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group heads filename doesn't match the group public key"))
+			}
+
+			summary.messagesHeads[string(heads.PublicKey)] = messageCIDs
+
+			return true, nil
+		},
+	}
+}
+
+// groupMessages returns the entries of the message log of a group, the log is
+// identified by the ID of its heads as the links between the entries are
+// encrypted
+func (summary *exportSummary) groupMessages(groupPK string) map[cid.Cid]struct{} {
+	logIDs := map[string]struct{}{}
+	for _, head := range summary.messagesHeads[groupPK] {
+		if logID, ok := summary.entriesLogID[head]; ok {
+			logIDs[logID] = struct{}{}
+		}
+	}
+
+	messages := map[cid.Cid]struct{}{}
+	for id, logID := range summary.entriesLogID {
+		if _, ok := logIDs[logID]; ok {
+			messages[id] = struct{}{}
+		}
+	}
+
+	return messages
+}
+
+// cidsDifference returns the sorted CIDs of a which are not in b
+func cidsDifference(a, b map[cid.Cid]struct{}) []cid.Cid {
+	diff := []cid.Cid{}
+	for id := range a {
+		if _, ok := b[id]; !ok {
+			diff = append(diff, id)
+		}
+	}
+
+	sort.Slice(diff, func(i, j int) bool {
+		return bytes.Compare(diff[i].Bytes(), diff[j].Bytes()) < 0
+	})
+
+	return diff
+}
+
+func sortedKeys(m map[string][]cid.Cid) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,195 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+type testExportGroup struct {
+	group    *protocoltypes.Group
+	messages []*cbornode.Node
+}
+
+func newTestExportGroup(t *testing.T, messages int) *testExportGroup {
+	t.Helper()
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	group := &testExportGroup{group: g}
+	for i := 0; i < messages; i++ {
+		group.addMessage(t, fmt.Sprintf("message %d", i))
+	}
+
+	return group
+}
+
+func (g *testExportGroup) addMessage(t *testing.T, payload string) {
+	t.Helper()
+
+	node, err := cbornode.WrapObject(map[string]interface{}{
+		exportEntryLogIDField: "/orbitdb/" + base64.RawURLEncoding.EncodeToString(g.group.PublicKey) + "_messages",
+		"payload":             payload,
+	}, mh.SHA2_256, -1)
+	require.NoError(t, err)
+
+	g.messages = append(g.messages, node)
+}
+
+func writeTestExport(t *testing.T, groups ...*testExportGroup) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	writeFile := func(name string, data []byte) {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o600,
+			Size:     int64(len(data)),
+		}))
+		_, err := tw.Write(data)
+		require.NoError(t, err)
+	}
+
+	writeFile(exportAccountKeyFilename, []byte("account key"))
+	writeFile(exportAccountProofKeyFilename, []byte("account proof key"))
+
+	for _, g := range groups {
+		for _, node := range g.messages {
+			writeFile(exportOrbitDBEntriesPrefix+node.Cid().String(), node.RawData())
+		}
+
+		heads := &protocoltypes.GroupHeadsExport{
+			PublicKey: g.group.PublicKey,
+			SignPub:   g.group.SignPub,
+			LinkKey:   g.group.LinkKey,
+		}
+		if len(g.messages) > 0 {
+			heads.MessagesHeadsCids = [][]byte{g.messages[len(g.messages)-1].Cid().Bytes()}
+		}
+
+		data, err := proto.Marshal(heads)
+		require.NoError(t, err)
+
+		writeFile(exportOrbitDBHeadsPrefix+base64.RawURLEncoding.EncodeToString(g.group.PublicKey), data)
+	}
+
+	require.NoError(t, tw.Close())
+
+	return buf
+}
+
+func TestDiffAccountExports(t *testing.T) {
+	shared := newTestExportGroup(t, 3)
+	onlyInA := newTestExportGroup(t, 2)
+	onlyInB := newTestExportGroup(t, 0)
+
+	sharedInB := &testExportGroup{
+		group:    shared.group,
+		messages: append([]*cbornode.Node{}, shared.messages[:2]...),
+	}
+	sharedInB.addMessage(t, "only in b 1")
+	sharedInB.addMessage(t, "only in b 2")
+
+	// identical archives
+	diff, err := DiffAccountExports(writeTestExport(t, shared, onlyInA), writeTestExport(t, onlyInA, shared))
+	require.NoError(t, err)
+	require.True(t, diff.IsEmpty())
+
+	diff, err = DiffAccountExports(writeTestExport(t, shared, onlyInA), writeTestExport(t, sharedInB, onlyInB))
+	require.NoError(t, err)
+	require.False(t, diff.IsEmpty())
+
+	require.Equal(t, [][]byte{onlyInA.group.PublicKey}, diff.GroupsOnlyInA)
+	require.Equal(t, [][]byte{onlyInB.group.PublicKey}, diff.GroupsOnlyInB)
+
+	require.Len(t, diff.Groups, 1)
+	require.Equal(t, shared.group.PublicKey, diff.Groups[0].GroupPK)
+	require.Equal(t, []cid.Cid{shared.messages[2].Cid()}, diff.Groups[0].MessagesOnlyInA)
+	require.ElementsMatch(t, []cid.Cid{sharedInB.messages[2].Cid(), sharedInB.messages[3].Cid()}, diff.Groups[0].MessagesOnlyInB)
+
+	// a truncated archive is reported
+	truncated := writeTestExport(t, shared)
+	truncated.Truncate(truncated.Len() / 2)
+
+	_, err = DiffAccountExports(writeTestExport(t, shared), truncated)
+	require.Error(t, err)
+}
+
+func TestDiffAccountExportsOfService(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, closeNode := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet: mn,
+	}, dsync.MutexWrap(ds.NewMapDatastore()))
+	defer closeNode()
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	accountGroup := s.getAccountGroup()
+	require.NotNil(t, accountGroup)
+
+	addMessages := func(count int) []cid.Cid {
+		added := []cid.Cid{}
+		for i := 0; i < count; i++ {
+			op, err := accountGroup.messageStore.AddMessage(ctx, []byte(fmt.Sprintf("test message %d", i)))
+			require.NoError(t, err)
+
+			added = append(added, op.GetEntry().GetHash())
+		}
+
+		return added
+	}
+
+	export := func() []byte {
+		buf := &bytes.Buffer{}
+		require.NoError(t, s.export(ctx, buf, exportOptions{}))
+		return buf.Bytes()
+	}
+
+	addMessages(3)
+	exportA := export()
+
+	// exporting again the same data gives the same groups and messages
+	diff, err := DiffAccountExports(bytes.NewReader(exportA), bytes.NewReader(export()))
+	require.NoError(t, err)
+	require.True(t, diff.IsEmpty())
+
+	added := addMessages(2)
+	exportB := export()
+
+	diff, err = DiffAccountExports(bytes.NewReader(exportA), bytes.NewReader(exportB))
+	require.NoError(t, err)
+	require.Empty(t, diff.GroupsOnlyInA)
+	require.Empty(t, diff.GroupsOnlyInB)
+
+	require.Len(t, diff.Groups, 1)
+	require.Equal(t, accountGroup.Group().PublicKey, diff.Groups[0].GroupPK)
+	require.Empty(t, diff.Groups[0].MessagesOnlyInA)
+	require.ElementsMatch(t, added, diff.Groups[0].MessagesOnlyInB)
+}
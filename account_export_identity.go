@@ -0,0 +1,150 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	exportIdentitySaltFilename = "identity.salt"
+	exportIdentityKeysFilename = "identity.keys"
+
+	// maxIdentityExportEntrySize is large enough for the encrypted account keys
+	maxIdentityExportEntrySize = 16 * 1024
+)
+
+// ExportIdentity writes a lightweight backup of the account containing only
+// the account keys, encrypted using a key derived from the passphrase. Unlike
+// a full export it doesn't contain any group data, the account group and the
+// contact groups derived from the account key are synced back from other
+// peers once the identity is restored.
+func (s *service) ExportIdentity(ctx context.Context, output io.Writer, passphrase []byte) (err error) {
+	ctx, span := s.tracer.Start(ctx, "ExportIdentity")
+	defer func() { endSpan(span, err) }()
+
+	if len(passphrase) == 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	keys := new(bytes.Buffer)
+	ktw := tar.NewWriter(keys)
+	if err := s.exportAccountKeys(ktw); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if err := ktw.Close(); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	key, salt, err := cryptoutil.DeriveKey(passphrase, nil)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedKeys, err := cryptoutil.AESGCMEncrypt(key, keys.Bytes())
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	tw := tar.NewWriter(output)
+	defer tw.Close()
+
+	if err := exportPrivateKey(tw, salt, exportIdentitySaltFilename); err != nil {
+		return err
+	}
+
+	if err := exportPrivateKey(tw, encryptedKeys, exportIdentityKeysFilename); err != nil {
+		return err
+	}
+
+	s.odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeIdentityExported,
+	})
+
+	return nil
+}
+
+// RestoreIdentity imports the account keys from a backup written by
+// ExportIdentity. The groups aren't restored, they are synced from the other
+// devices of the account once the service is started.
+func RestoreIdentity(ctx context.Context, reader io.Reader, passphrase []byte, odb *WeshOrbitDB, logger *zap.Logger) (err error) {
+	ctx, span := contextTracer(ctx).Start(ctx, "RestoreIdentity")
+	defer func() { endSpan(span, err) }()
+
+	if len(passphrase) == 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	files := map[string][]byte{}
+
+	tr := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return errcode.ErrCode_ErrDBRestore.Wrap(err)
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		switch header.Name {
+		case exportIdentitySaltFilename, exportIdentityKeysFilename:
+		default:
+			logger.Warn("unknown identity export entry", zap.String("filename", header.Name))
+			continue
+		}
+
+		if header.Size > maxIdentityExportEntrySize {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("identity export entry is too large"))
+		}
+
+		if files[header.Name], err = readExportSecretKeyFile(header.Size, tr); err != nil {
+			return err
+		}
+	}
+
+	salt, encryptedKeys := files[exportIdentitySaltFilename], files[exportIdentityKeysFilename]
+	if salt == nil || encryptedKeys == nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing identity export entries"))
+	}
+
+	key, _, err := cryptoutil.DeriveKey(passphrase, salt)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	keys, err := cryptoutil.AESGCMDecrypt(key, encryptedKeys)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	state := restoreAccountState{
+		keys: map[string][]byte{},
+	}
+
+	if err := restoreAccountExport(ctx, tar.NewReader(bytes.NewReader(keys)), logger, []RestoreAccountHandler{
+		state.readKey(exportAccountKeyFilename),
+		state.readKey(exportAccountProofKeyFilename),
+		state.restoreKeys(odb),
+	}); err != nil {
+		return err
+	}
+
+	odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeAccountRestored,
+	})
+
+	return nil
+}
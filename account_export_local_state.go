@@ -0,0 +1,149 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// exportLocalStatePrefix prefixes the archive files holding the local state
+// of the groups, it is kept apart from the protocol data as it is never sent
+// to the other peers
+const exportLocalStatePrefix = "local/"
+
+// exportGroupLocalStateFilename returns the name of the archive file holding
+// the local state of a group
+func exportGroupLocalStateFilename(groupPK []byte) string {
+	return exportLocalStatePrefix + base64.RawURLEncoding.EncodeToString(groupPK)
+}
+
+// exportGroupLocalState writes the read marker and the pinned messages of a
+// group, nothing is written if the group has none of them
+func (s *service) exportGroupLocalState(ctx context.Context, gc *GroupContext, tw *tar.Writer) error {
+	groupPK := gc.Group().PublicKey
+
+	marker, err := s.odb.readMarkers.Get(ctx, groupPK)
+	if err != nil {
+		return err
+	}
+
+	pins, err := s.odb.messagePins.List(ctx, groupPK)
+	if err != nil {
+		return err
+	}
+
+	if !marker.Defined() && len(pins) == 0 {
+		return nil
+	}
+
+	localState := &protocoltypes.GroupLocalStateExport{
+		PublicKey:      groupPK,
+		PinnedMessages: make([][]byte, len(pins)),
+	}
+
+	if marker.Defined() {
+		localState.ReadMarker = marker.Bytes()
+	}
+
+	for i, id := range pins {
+		localState.PinnedMessages[i] = id.Bytes()
+	}
+
+	data, err := proto.Marshal(localState)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return exportPrivateKey(tw, data, exportGroupLocalStateFilename(groupPK))
+}
+
+func readExportGroupLocalState(expectedSize int64, reader *tar.Reader) (*protocoltypes.GroupLocalStateExport, error) {
+	if expectedSize == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid expected local state size"))
+	}
+
+	contents := new(bytes.Buffer)
+	size, err := io.Copy(contents, reader)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to read %d bytes: %w", expectedSize, err))
+	}
+
+	if size != expectedSize {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unexpected file size"))
+	}
+
+	localState := &protocoltypes.GroupLocalStateExport{}
+	if err := proto.Unmarshal(contents.Bytes(), localState); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if len(localState.PublicKey) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing group public key"))
+	}
+
+	return localState, nil
+}
+
+// restoreLocalState restores the local state of the groups once the rest of
+// the archive has been restored, the archives exported without it are
+// restored as is
+func (state *restoreAccountState) restoreLocalState(ctx context.Context, odb *WeshOrbitDB) RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			if !strings.HasPrefix(header.Name, exportLocalStatePrefix) {
+				return false, nil
+			}
+
+			localState, err := readExportGroupLocalState(header.Size, reader)
+			if err != nil {
+				return true, err
+			}
+
+			state.mu.Lock()
+			state.localStates = append(state.localStates, localState)
+			state.mu.Unlock()
+
+			return true, nil
+		},
+		PostProcess: func() error {
+			state.mu.Lock()
+			defer state.mu.Unlock()
+
+			for _, localState := range state.localStates {
+				if len(localState.ReadMarker) > 0 {
+					marker, err := cid.Cast(localState.ReadMarker)
+					if err != nil {
+						return errcode.ErrCode_ErrDeserialization.Wrap(err)
+					}
+
+					if err := odb.readMarkers.Set(ctx, localState.PublicKey, marker); err != nil {
+						return err
+					}
+				}
+
+				for _, pinned := range localState.PinnedMessages {
+					id, err := cid.Cast(pinned)
+					if err != nil {
+						return errcode.ErrCode_ErrDeserialization.Wrap(err)
+					}
+
+					if err := odb.messagePins.Pin(ctx, localState.PublicKey, id); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,153 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/pubsub/pubsubraw"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func archiveHasPrefix(t *testing.T, archive []byte, prefix string) bool {
+	t.Helper()
+
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return false
+		}
+		require.NoError(t, err)
+
+		if strings.HasPrefix(header.Name, prefix) {
+			return true
+		}
+	}
+}
+
+func TestRestoreAccountLocalState(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	var (
+		groupPK      []byte
+		marker       cid.Cid
+		pinned       []cid.Cid
+		withState    = new(bytes.Buffer)
+		withoutState = new(bytes.Buffer)
+	)
+
+	{
+		dsA := dsync.MutexWrap(ds.NewMapDatastore())
+		nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+			Mocknet: mn,
+		}, dsA)
+
+		serviceA, ok := nodeA.Service.(*service)
+		require.True(t, ok)
+
+		accountGroup := serviceA.getAccountGroup()
+		require.NotNil(t, accountGroup)
+		groupPK = accountGroup.Group().PublicKey
+
+		ids := []cid.Cid{}
+		for i := 0; i < 5; i++ {
+			op, err := accountGroup.messageStore.AddMessage(ctx, []byte(fmt.Sprintf("testMessage%d", i)))
+			require.NoError(t, err)
+
+			ids = append(ids, op.GetEntry().GetHash())
+		}
+
+		marker, pinned = ids[3], []cid.Cid{ids[0], ids[2]}
+		require.NoError(t, serviceA.odb.readMarkers.Set(ctx, groupPK, marker))
+		for _, id := range pinned {
+			require.NoError(t, serviceA.odb.messagePins.Pin(ctx, groupPK, id))
+		}
+
+		require.NoError(t, serviceA.export(ctx, withState, exportOptions{format: protocoltypes.ExportFormat_ExportFormatProtobuf, localState: true}))
+		require.NoError(t, serviceA.export(ctx, withoutState, exportOptions{}))
+
+		closeNodeA()
+		require.NoError(t, dsA.Close())
+	}
+
+	// the local state is a separate section of the archive, only written
+	// when requested
+	require.True(t, archiveHasPrefix(t, withState.Bytes(), exportLocalStatePrefix))
+	require.False(t, archiveHasPrefix(t, withoutState.Bytes(), exportLocalStatePrefix))
+
+	manifest, err := ReadAccountExportManifest(bytes.NewReader(withState.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, exportLocalStatePrefix, manifest.LocalStatePrefix)
+
+	restore := func(archive []byte) *WeshOrbitDB {
+		dsB := dsync.MutexWrap(ds.NewMapDatastore())
+		secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+		require.NoError(t, err)
+
+		ipfsNodeB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+			Mocknet:   mn,
+			Datastore: dsB,
+		})
+
+		odb, err := NewWeshOrbitDB(ctx, ipfsNodeB.API(), &NewOrbitDBOptions{
+			NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+				PubSub: pubsubraw.NewPubSub(ipfsNodeB.PubSub(), ipfsNodeB.MockNode().PeerHost.ID(), logger, nil),
+				Logger: logger,
+			},
+			Datastore:   dsB,
+			SecretStore: secretStoreB,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { odb.Close() })
+
+		require.NoError(t, RestoreAccountExport(ctx, bytes.NewReader(archive), ipfsNodeB.API(), odb, logger))
+
+		return odb
+	}
+
+	// the read marker and the pins are restored along with the account
+	odb := restore(withState.Bytes())
+
+	restoredMarker, err := odb.readMarkers.Get(ctx, groupPK)
+	require.NoError(t, err)
+	require.Equal(t, marker, restoredMarker)
+
+	restoredPins, err := odb.messagePins.List(ctx, groupPK)
+	require.NoError(t, err)
+	require.ElementsMatch(t, pinned, restoredPins)
+
+	// the minimal backups are restored without local state
+	odb = restore(withoutState.Bytes())
+
+	restoredMarker, err = odb.readMarkers.Get(ctx, groupPK)
+	require.NoError(t, err)
+	require.False(t, restoredMarker.Defined())
+
+	restoredPins, err = odb.messagePins.List(ctx, groupPK)
+	require.NoError(t, err)
+	require.Empty(t, restoredPins)
+}
@@ -0,0 +1,167 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	exportManifestProtobufFilename = "manifest.pb"
+	exportManifestJSONFilename     = "manifest.json"
+
+	// exportManifestVersion is the version of the archive layout described by
+	// the manifest, it must be incremented on incompatible changes
+	exportManifestVersion = 1
+)
+
+// newExportManifest returns an empty manifest for an export encoded with the
+// given format
+func newExportManifest(format protocoltypes.ExportFormat) (*protocoltypes.AccountExportManifest, error) {
+	switch format {
+	case protocoltypes.ExportFormat_ExportFormatDefault,
+		protocoltypes.ExportFormat_ExportFormatProtobuf,
+		protocoltypes.ExportFormat_ExportFormatJSON:
+	default:
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", format))
+	}
+
+	return &protocoltypes.AccountExportManifest{
+		Version:             exportManifestVersion,
+		Format:              format,
+		CreatedAt:           time.Now().Unix(),
+		AccountKeyFile:      exportAccountKeyFilename,
+		AccountProofKeyFile: exportAccountProofKeyFilename,
+		EntriesPrefix:       exportOrbitDBEntriesPrefix,
+	}, nil
+}
+
+func marshalExportManifest(manifest *protocoltypes.AccountExportManifest) (filename string, data []byte, err error) {
+	switch manifest.Format {
+	case protocoltypes.ExportFormat_ExportFormatProtobuf:
+		data, err = proto.Marshal(manifest)
+		filename = exportManifestProtobufFilename
+	case protocoltypes.ExportFormat_ExportFormatJSON:
+		data, err = protojson.MarshalOptions{Multiline: true}.Marshal(manifest)
+		filename = exportManifestJSONFilename
+	default:
+		return "", nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no manifest for the export format %s", manifest.Format))
+	}
+
+	if err != nil {
+		return "", nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return filename, data, nil
+}
+
+func writeExportManifest(tw *tar.Writer, manifest *protocoltypes.AccountExportManifest) error {
+	filename, data, err := marshalExportManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filename,
+		Mode:     0o600,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	size, err := tw.Write(data)
+	if err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	if size != len(data) {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(fmt.Errorf("wrote %d bytes instead of %d", size, len(data)))
+	}
+
+	return nil
+}
+
+// readExportManifest decodes the manifest file of an archive, handled is false
+// if the file isn't a manifest
+func readExportManifest(header *tar.Header, reader *tar.Reader) (manifest *protocoltypes.AccountExportManifest, handled bool, err error) {
+	var unmarshal func([]byte, proto.Message) error
+	switch header.Name {
+	case exportManifestProtobufFilename:
+		unmarshal = proto.Unmarshal
+	case exportManifestJSONFilename:
+		unmarshal = protojson.Unmarshal
+	default:
+		return nil, false, nil
+	}
+
+	data := new(bytes.Buffer)
+	size, err := io.Copy(data, reader)
+	if err != nil {
+		return nil, true, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	if size != header.Size {
+		return nil, true, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unexpected file size"))
+	}
+
+	manifest = &protocoltypes.AccountExportManifest{}
+	if err := unmarshal(data.Bytes(), manifest); err != nil {
+		return nil, true, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if manifest.Version > exportManifestVersion {
+		return nil, true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unsupported export version %d, expected at most %d", manifest.Version, exportManifestVersion))
+	}
+
+	return manifest, true, nil
+}
+
+// ReadAccountExportManifest returns the manifest of an account export, the
+// archive is only read. ErrNotFound is returned for the archives exported
+// with the default format, which have no manifest.
+func ReadAccountExportManifest(reader io.Reader) (*protocoltypes.AccountExportManifest, error) {
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no manifest in the archive"))
+		} else if err != nil {
+			return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		manifest, handled, err := readExportManifest(header, tr)
+		if handled {
+			return manifest, err
+		}
+	}
+}
+
+// checkExportManifest ensures that the archive to restore has a supported
+// layout
+func checkExportManifest() RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			_, handled, err := readExportManifest(header, reader)
+			return handled, err
+		},
+	}
+}
+
+func cidsToStrings(ids []cid.Cid) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+
+	return strs
+}
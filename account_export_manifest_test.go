@@ -0,0 +1,154 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestExportManifestRoundTrip(t *testing.T) {
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	for _, format := range []protocoltypes.ExportFormat{
+		protocoltypes.ExportFormat_ExportFormatProtobuf,
+		protocoltypes.ExportFormat_ExportFormatJSON,
+	} {
+		t.Run(format.String(), func(t *testing.T) {
+			manifest, err := newExportManifest(format)
+			require.NoError(t, err)
+
+			manifest.Groups = append(manifest.Groups, &protocoltypes.AccountExportManifest_Group{
+				PublicKey:     g.PublicKey,
+				GroupType:     g.GroupType,
+				HeadsFile:     exportGroupHeadsFilename(g.PublicKey),
+				MetadataHeads: []string{"bafyreiaixnpf23vkyecj5xqispjq5ubcwgsntnnurw2bjby7khe4wnjihu"},
+				Entries:       3,
+			})
+
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			require.NoError(t, exportPrivateKey(tw, []byte("key"), exportAccountKeyFilename))
+			require.NoError(t, writeExportManifest(tw, manifest))
+			require.NoError(t, tw.Close())
+
+			read, err := ReadAccountExportManifest(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			require.True(t, proto.Equal(manifest, read), "%v != %v", manifest, read)
+
+			require.Equal(t, uint32(exportManifestVersion), read.Version)
+			require.Equal(t, format, read.Format)
+			require.NotZero(t, read.CreatedAt)
+			require.Equal(t, exportAccountKeyFilename, read.AccountKeyFile)
+			require.Equal(t, exportAccountProofKeyFilename, read.AccountProofKeyFile)
+			require.Equal(t, exportOrbitDBEntriesPrefix, read.EntriesPrefix)
+
+			// the JSON manifest can be read without the protobuf definitions
+			if format == protocoltypes.ExportFormat_ExportFormatJSON {
+				tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+				for {
+					header, err := tr.Next()
+					require.NoError(t, err)
+
+					if header.Name == exportManifestJSONFilename {
+						break
+					}
+				}
+
+				var raw map[string]interface{}
+				require.NoError(t, json.NewDecoder(tr).Decode(&raw))
+				require.Equal(t, exportAccountKeyFilename, raw["accountKeyFile"])
+				require.Len(t, raw["groups"], 1)
+			}
+		})
+	}
+
+	_, err = newExportManifest(protocoltypes.ExportFormat(42))
+	require.Error(t, err)
+
+	// newer layouts are rejected
+	manifest, err := newExportManifest(protocoltypes.ExportFormat_ExportFormatProtobuf)
+	require.NoError(t, err)
+	manifest.Version = exportManifestVersion + 1
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, writeExportManifest(tw, manifest))
+	require.NoError(t, tw.Close())
+
+	_, err = ReadAccountExportManifest(buf)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+}
+
+func TestServiceExportManifest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cleanup()
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	config, err := node.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	export := func(format protocoltypes.ExportFormat) []byte {
+		buf := &bytes.Buffer{}
+		require.NoError(t, s.export(ctx, buf, exportOptions{force: true, format: format}))
+		return buf.Bytes()
+	}
+
+	// the default layout is unchanged
+	_, err = ReadAccountExportManifest(bytes.NewReader(export(protocoltypes.ExportFormat_ExportFormatDefault)))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrNotFound))
+
+	for _, format := range []protocoltypes.ExportFormat{
+		protocoltypes.ExportFormat_ExportFormatProtobuf,
+		protocoltypes.ExportFormat_ExportFormatJSON,
+	} {
+		archive := export(format)
+
+		manifest, err := ReadAccountExportManifest(bytes.NewReader(archive))
+		require.NoError(t, err)
+		require.Equal(t, format, manifest.Format)
+		require.Equal(t, uint32(exportManifestVersion), manifest.Version)
+
+		var accountGroup *protocoltypes.AccountExportManifest_Group
+		for _, group := range manifest.Groups {
+			if bytes.Equal(group.PublicKey, config.AccountGroupPk) {
+				accountGroup = group
+			}
+		}
+		require.NotNil(t, accountGroup)
+		require.Equal(t, protocoltypes.GroupType_GroupTypeAccount, accountGroup.GroupType)
+		require.NotEmpty(t, accountGroup.MetadataHeads)
+		require.NotZero(t, accountGroup.Entries)
+
+		// the files referenced by the manifest are in the archive
+		files := map[string]struct{}{}
+		tr := tar.NewReader(bytes.NewReader(archive))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			files[header.Name] = struct{}{}
+		}
+
+		for _, name := range []string{manifest.AccountKeyFile, manifest.AccountProofKeyFile, accountGroup.HeadsFile, manifest.EntriesPrefix + accountGroup.MetadataHeads[0]} {
+			require.Contains(t, files, name)
+		}
+	}
+}
@@ -2,19 +2,29 @@ package weshnet
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
+	crand "crypto/rand"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dsync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 
 	orbitdb "berty.tech/go-orbit-db"
 	"berty.tech/go-orbit-db/pubsub/pubsubraw"
+	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/ipfsutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/secretstore"
@@ -73,6 +83,429 @@ func Test_service_exportAccountKeys(t *testing.T) {
 	require.Equal(t, accountProofPrivateKey, inStoreAccountProofPrivateKeyBytes)
 }
 
+func Test_waitForGroupQuiescence(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers, _, cleanup := CreatePeersWithGroupTest(ctx, t, "/tmp/export_test", 2, 1)
+	defer cleanup()
+
+	// nothing is being replicated, the group is considered as synced
+	require.NoError(t, waitForGroupQuiescence(ctx, peers[0].GC))
+
+	// keep adding messages on the second peer while the first one is
+	// replicating them
+	syncCtx, syncCancel := context.WithCancel(ctx)
+	syncDone := make(chan struct{})
+	go func() {
+		defer close(syncDone)
+
+		for syncCtx.Err() == nil {
+			if _, err := peers[1].GC.MessageStore().AddMessage(syncCtx, []byte("test message")); err != nil {
+				return
+			}
+
+			time.Sleep(exportQuiescencePollInterval / 2)
+		}
+	}()
+
+	err := waitForGroupQuiescence(ctx, peers[0].GC)
+	require.Error(t, err)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrExportWhileSyncing))
+
+	syncCancel()
+	<-syncDone
+
+	// once the replication is over, the wait succeeds
+	require.NoError(t, waitForGroupQuiescence(ctx, peers[0].GC))
+}
+
+// cancelingReader cancels the given context once limit bytes have been read
+type cancelingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+	limit  int64
+	read   int64
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if r.read >= r.limit {
+		r.cancel()
+	}
+
+	return n, err
+}
+
+func TestRestoreAccountCanceled(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	tmpFile, err := os.CreateTemp(os.TempDir(), "test-export-")
+	require.NoError(t, err)
+
+	defer os.Remove(tmpFile.Name())
+
+	exportedEntries := []cid.Cid{}
+	var accountPrivateKeyA []byte
+
+	{
+		dsA := dsync.MutexWrap(ds.NewMapDatastore())
+		nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+			Mocknet: mn,
+		}, dsA)
+
+		serviceA, ok := nodeA.Service.(*service)
+		require.True(t, ok)
+
+		accountPrivateKeyA, _, err = serviceA.secretStore.ExportAccountKeysForBackup()
+		require.NoError(t, err)
+
+		accountGroup := serviceA.getAccountGroup()
+		require.NotNil(t, accountGroup)
+
+		for i := 0; i < 20; i++ {
+			op, err := accountGroup.messageStore.AddMessage(ctx, []byte(fmt.Sprintf("testMessage%d", i)))
+			require.NoError(t, err)
+
+			exportedEntries = append(exportedEntries, op.GetEntry().GetHash())
+		}
+
+		require.NoError(t, serviceA.export(ctx, tmpFile, exportOptions{}))
+
+		closeNodeA()
+		require.NoError(t, dsA.Close())
+	}
+
+	stat, err := tmpFile.Stat()
+	require.NoError(t, err)
+
+	_, err = tmpFile.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	dsB := dsync.MutexWrap(ds.NewMapDatastore())
+	secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+	require.NoError(t, err)
+
+	ipfsNodeB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+		Mocknet:   mn,
+		Datastore: dsB,
+	})
+
+	odb, err := NewWeshOrbitDB(ctx, ipfsNodeB.API(), &NewOrbitDBOptions{
+		NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+			PubSub: pubsubraw.NewPubSub(ipfsNodeB.PubSub(), ipfsNodeB.MockNode().PeerHost.ID(), logger, nil),
+			Logger: logger,
+		},
+		Datastore:   dsB,
+		SecretStore: secretStoreB,
+	})
+	require.NoError(t, err)
+	defer odb.Close()
+
+	// cancel the restore halfway through the export
+	restoreCtx, restoreCancel := context.WithCancel(ctx)
+	defer restoreCancel()
+
+	reader := &cancelingReader{Reader: tmpFile, cancel: restoreCancel, limit: stat.Size() / 2}
+
+	err = RestoreAccountExport(restoreCtx, reader, ipfsNodeB.API(), odb, logger)
+	require.Error(t, err)
+
+	// account keys must not have been imported
+	accountPrivateKeyB, _, err := secretStoreB.ExportAccountKeysForBackup()
+	require.NoError(t, err)
+	require.NotEqual(t, accountPrivateKeyA, accountPrivateKeyB)
+
+	// restored entries must have been removed
+	for _, c := range exportedEntries {
+		getCtx, getCancel := context.WithTimeout(ctx, time.Millisecond*100)
+		_, err := ipfsNodeB.API().Dag().Get(getCtx, c)
+		getCancel()
+		require.Error(t, err, "entry %s should have been removed", c.String())
+	}
+}
+
+func TestRestoreAccountRollbackKeepsExistingData(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	export := new(bytes.Buffer)
+	exportedEntries := []cid.Cid{}
+	var sharedEntry ipld.Node
+
+	{
+		dsA := dsync.MutexWrap(ds.NewMapDatastore())
+		nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+			Mocknet: mn,
+		}, dsA)
+
+		serviceA, ok := nodeA.Service.(*service)
+		require.True(t, ok)
+
+		accountGroup := serviceA.getAccountGroup()
+		require.NotNil(t, accountGroup)
+
+		for i := 0; i < 5; i++ {
+			op, err := accountGroup.messageStore.AddMessage(ctx, []byte(fmt.Sprintf("testMessage%d", i)))
+			require.NoError(t, err)
+
+			exportedEntries = append(exportedEntries, op.GetEntry().GetHash())
+		}
+
+		var err error
+		sharedEntry, err = nodeA.IpfsCoreAPI.Dag().Get(ctx, exportedEntries[0])
+		require.NoError(t, err)
+
+		require.NoError(t, serviceA.export(ctx, export, exportOptions{}))
+
+		closeNodeA()
+		require.NoError(t, dsA.Close())
+	}
+
+	// the node restoring the export already has data, including one of the
+	// exported entries
+	dsB := dsync.MutexWrap(ds.NewMapDatastore())
+	nodeB, closeNodeB := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet: mn,
+	}, dsB)
+	defer closeNodeB()
+
+	serviceB, ok := nodeB.Service.(*service)
+	require.True(t, ok)
+
+	ownEntries := []cid.Cid{}
+	for i := 0; i < 5; i++ {
+		op, err := serviceB.getAccountGroup().messageStore.AddMessage(ctx, []byte(fmt.Sprintf("ownMessage%d", i)))
+		require.NoError(t, err)
+
+		ownEntries = append(ownEntries, op.GetEntry().GetHash())
+	}
+
+	require.NoError(t, nodeB.IpfsCoreAPI.Dag().Add(ctx, sharedEntry))
+
+	accountPrivateKeyB, _, err := serviceB.secretStore.ExportAccountKeysForBackup()
+	require.NoError(t, err)
+
+	// the restore fails after every entry has been restored
+	err = RestoreAccountExport(ctx, export, nodeB.IpfsCoreAPI, serviceB.odb, logger, RestoreAccountHandler{
+		PostProcess: func() error { return fmt.Errorf("failing restore step") },
+	})
+	require.Error(t, err)
+
+	// the account keys haven't been imported
+	accountPrivateKey, _, err := serviceB.secretStore.ExportAccountKeysForBackup()
+	require.NoError(t, err)
+	require.Equal(t, accountPrivateKeyB, accountPrivateKey)
+
+	hasBlock := func(id cid.Cid) bool {
+		has, err := hasLocalBlock(ctx, nodeB.IpfsCoreAPI, id)
+		require.NoError(t, err)
+		return has
+	}
+
+	// the data which was there before the restore is kept
+	for _, id := range append(ownEntries, sharedEntry.Cid()) {
+		require.True(t, hasBlock(id), "entry %s should have been kept", id)
+	}
+
+	// the entries added by the restore are removed
+	for _, id := range exportedEntries[1:] {
+		require.False(t, hasBlock(id), "entry %s should have been removed", id)
+	}
+}
+
+func TestCheckGroupKeys(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	signPub, err := g.GetSigningPubKey()
+	require.NoError(t, err)
+
+	signPubBytes, err := signPub.Raw()
+	require.NoError(t, err)
+
+	linkKey, err := g.GetLinkKeyArray()
+	require.NoError(t, err)
+
+	newHeads := func() (*protocoltypes.GroupHeadsExport, *protocoltypes.Group) {
+		heads := &protocoltypes.GroupHeadsExport{
+			PublicKey: g.PublicKey,
+			SignPub:   signPubBytes,
+			LinkKey:   append([]byte{}, linkKey[:]...),
+		}
+		heads.KeysChecksum = groupKeysChecksum(heads)
+
+		return heads, &protocoltypes.Group{
+			PublicKey: heads.PublicKey,
+			SignPub:   heads.SignPub,
+			LinkKey:   heads.LinkKey,
+		}
+	}
+
+	heads, restored := newHeads()
+	require.NoError(t, checkGroupKeys(heads, restored))
+
+	// exports made without a checksum are still accepted
+	heads.KeysChecksum = nil
+	require.NoError(t, checkGroupKeys(heads, restored))
+
+	heads, restored = newHeads()
+	heads.LinkKey[0] ^= 0xff
+	require.True(t, errcode.Has(checkGroupKeys(heads, restored), errcode.ErrCode_ErrGroupKeyMismatch))
+
+	heads, restored = newHeads()
+	heads.SignPub = heads.SignPub[1:]
+	restored.SignPub = heads.SignPub
+	require.True(t, errcode.Has(checkGroupKeys(heads, restored), errcode.ErrCode_ErrGroupKeyMismatch))
+}
+
+func TestRestoreAccountGroupKeyMismatch(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	export := new(bytes.Buffer)
+
+	{
+		dsA := dsync.MutexWrap(ds.NewMapDatastore())
+		nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+			Mocknet: mn,
+		}, dsA)
+
+		serviceA, ok := nodeA.Service.(*service)
+		require.True(t, ok)
+
+		accountGroup := serviceA.getAccountGroup()
+		require.NotNil(t, accountGroup)
+
+		_, err := accountGroup.messageStore.AddMessage(ctx, []byte("testMessage"))
+		require.NoError(t, err)
+
+		require.NoError(t, serviceA.export(ctx, export, exportOptions{}))
+
+		closeNodeA()
+		require.NoError(t, dsA.Close())
+	}
+
+	cases := map[string]func(name string, data []byte) []byte{
+		// corrupt the link key of the exported groups, the checksum is
+		// updated so the mismatch has to be caught when opening the heads
+		"link key": func(name string, data []byte) []byte {
+			if !strings.HasPrefix(name, exportOrbitDBHeadsPrefix) {
+				return data
+			}
+
+			heads := &protocoltypes.GroupHeadsExport{}
+			require.NoError(t, proto.Unmarshal(data, heads))
+
+			heads.LinkKey[0] ^= 0xff
+			heads.KeysChecksum = groupKeysChecksum(heads)
+
+			data, err := proto.Marshal(heads)
+			require.NoError(t, err)
+
+			return data
+		},
+		// replace the account proof key, the account group derived from
+		// the keys does not match the exported one anymore
+		"account proof key": func(name string, data []byte) []byte {
+			if name != exportAccountProofKeyFilename {
+				return data
+			}
+
+			sk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+			require.NoError(t, err)
+
+			data, err = crypto.MarshalPrivateKey(sk)
+			require.NoError(t, err)
+
+			return data
+		},
+	}
+
+	for name, tamper := range cases {
+		t.Run(name, func(t *testing.T) {
+			testRestoreTamperedAccountExport(ctx, t, mn, logger, export.Bytes(), tamper)
+		})
+	}
+}
+
+func testRestoreTamperedAccountExport(ctx context.Context, t *testing.T, mn mocknet.Mocknet, logger *zap.Logger, export []byte, tamper func(name string, data []byte) []byte) {
+	t.Helper()
+
+	tampered := new(bytes.Buffer)
+	tr, tw := tar.NewReader(bytes.NewReader(export)), tar.NewWriter(tampered)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		data = tamper(header.Name, data)
+		header.Size = int64(len(data))
+
+		require.NoError(t, tw.WriteHeader(header))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	dsB := dsync.MutexWrap(ds.NewMapDatastore())
+	secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+	require.NoError(t, err)
+
+	ipfsNodeB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+		Mocknet:   mn,
+		Datastore: dsB,
+	})
+
+	odb, err := NewWeshOrbitDB(ctx, ipfsNodeB.API(), &NewOrbitDBOptions{
+		NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+			PubSub: pubsubraw.NewPubSub(ipfsNodeB.PubSub(), ipfsNodeB.MockNode().PeerHost.ID(), logger, nil),
+			Logger: logger,
+		},
+		Datastore:   dsB,
+		SecretStore: secretStoreB,
+	})
+	require.NoError(t, err)
+	defer odb.Close()
+
+	err = RestoreAccountExport(ctx, tampered, ipfsNodeB.API(), odb, logger)
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupKeyMismatch))
+}
+
 func getKeyFromTar(t *testing.T, tr *tar.Reader, expectedFilename string) []byte {
 	header, err := tr.Next()
 	require.NoError(t, err)
@@ -158,7 +591,7 @@ func TestFlappyRestoreAccount(t *testing.T) {
 
 		expectedMessages[op.GetEntry().GetHash()] = testPayload4
 
-		require.NoError(t, serviceA.export(ctx, tmpFile))
+		require.NoError(t, serviceA.export(ctx, tmpFile, exportOptions{}))
 
 		closeNodeA()
 		require.NoError(t, dsA.Close())
@@ -251,3 +684,144 @@ func TestFlappyRestoreAccount(t *testing.T) {
 	}
 	// TODO: test account metadata entries
 }
+
+func TestRestoreIdentity(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+	passphrase := []byte("identity passphrase")
+
+	dsA := dsync.MutexWrap(ds.NewMapDatastore())
+	nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+	}, dsA)
+	defer closeNodeA()
+
+	nodeAInstanceConfig, err := nodeA.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	created, err := nodeA.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	backup := new(bytes.Buffer)
+	require.NoError(t, nodeA.Service.ExportIdentity(ctx, backup, passphrase))
+
+	dsB := dsync.MutexWrap(ds.NewMapDatastore())
+	secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+	require.NoError(t, err)
+
+	ipfsNodeB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		Datastore:       dsB,
+	})
+
+	odb, err := NewWeshOrbitDB(ctx, ipfsNodeB.API(), &NewOrbitDBOptions{
+		NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+			PubSub: pubsubraw.NewPubSub(ipfsNodeB.PubSub(), ipfsNodeB.MockNode().PeerHost.ID(), logger, nil),
+			Logger: logger,
+		},
+		Datastore:   dsB,
+		SecretStore: secretStoreB,
+	})
+	require.NoError(t, err)
+
+	// a wrong passphrase must not import anything
+	err = RestoreIdentity(ctx, bytes.NewReader(backup.Bytes()), []byte("wrong passphrase"), odb, logger)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt))
+
+	err = RestoreIdentity(ctx, bytes.NewReader(backup.Bytes()), passphrase, odb, logger)
+	require.NoError(t, err)
+
+	nodeB, closeNodeB := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		SecretStore:     secretStoreB,
+		CoreAPIMock:     ipfsNodeB,
+		OrbitDB:         odb,
+	}, dsB)
+	defer closeNodeB()
+
+	nodeBInstanceConfig, err := nodeB.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+	require.Equal(t, nodeAInstanceConfig.AccountPk, nodeBInstanceConfig.AccountPk)
+	require.Equal(t, nodeAInstanceConfig.AccountGroupPk, nodeBInstanceConfig.AccountGroupPk)
+	require.NotEqual(t, nodeAInstanceConfig.DevicePk, nodeBInstanceConfig.DevicePk)
+
+	ConnectAll(t, mn)
+
+	serviceA, ok := nodeA.Service.(*service)
+	require.True(t, ok)
+
+	hasDevice := func(devices []crypto.PubKey, devicePK []byte) bool {
+		for _, device := range devices {
+			if raw, err := device.Raw(); err == nil && bytes.Equal(raw, devicePK) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// node A learns the new device of the account
+	require.Eventually(t, func() bool {
+		return hasDevice(serviceA.getAccountGroup().MetadataStore().ListDevices(), nodeBInstanceConfig.DevicePk)
+	}, time.Second*30, time.Millisecond*100)
+
+	// the group is learned from the account group synced with node A
+	require.Eventually(t, func() bool {
+		_, err := nodeB.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: created.GroupPk})
+		return err == nil
+	}, time.Second*30, time.Millisecond*200)
+
+	groupPK, err := crypto.UnmarshalEd25519PublicKey(created.GroupPk)
+	require.NoError(t, err)
+
+	devicePKA, err := crypto.UnmarshalEd25519PublicKey(nodeAInstanceConfig.DevicePk)
+	require.NoError(t, err)
+
+	// node A shares its chain key with the new device once it has joined the
+	// group
+	require.Eventually(t, func() bool {
+		return nodeB.SecretStore.IsChainKeyKnownForDevice(ctx, groupPK, devicePKA)
+	}, time.Second*30, time.Millisecond*100)
+
+	sub, err := nodeB.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			evt, err := sub.Recv()
+			if err != nil {
+				return
+			}
+
+			received <- evt.Message
+		}
+	}()
+
+	// the messages sent once the chain key is known are readable by node B
+	_, err = nodeA.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: created.GroupPk,
+		Payload: []byte("test"),
+	})
+	require.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		require.Equal(t, []byte("test"), msg)
+	case <-time.After(time.Second * 30):
+		require.FailNow(t, "the message should be received by node B")
+	}
+}
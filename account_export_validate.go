@@ -0,0 +1,61 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// AccountKeyFingerprint returns the fingerprint of an account public key, as
+// returned by ServiceGetConfiguration, see ValidateAccountExport
+func AccountKeyFingerprint(accountPK []byte) []byte {
+	sum := sha256.Sum256(accountPK)
+	return sum[:]
+}
+
+// ValidateAccountExport checks that an account export holds a valid account
+// key, only the key material of the archive is read. If expectedFingerprint
+// isn't empty, ErrAccountMismatch is returned unless the archive belongs to
+// the account with this fingerprint, see AccountKeyFingerprint.
+func ValidateAccountExport(reader io.Reader, expectedFingerprint []byte) error {
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no account key in the archive"))
+		} else if err != nil {
+			return errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		if header.Typeflag != tar.TypeReg || header.Name != exportAccountKeyFilename {
+			continue
+		}
+
+		data, err := readExportSecretKeyFile(header.Size, tr)
+		if err != nil {
+			return err
+		}
+
+		sk, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		pk, err := sk.GetPublic().Raw()
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if len(expectedFingerprint) > 0 && !bytes.Equal(AccountKeyFingerprint(pk), expectedFingerprint) {
+			return errcode.ErrCode_ErrAccountMismatch.Wrap(fmt.Errorf("the archive belongs to another account"))
+		}
+
+		return nil
+	}
+}
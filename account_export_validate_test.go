@@ -0,0 +1,59 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+func writeTestKeysExport(t *testing.T, accountSK crypto.PrivKey) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	if accountSK != nil {
+		data, err := crypto.MarshalPrivateKey(accountSK)
+		require.NoError(t, err)
+		require.NoError(t, exportPrivateKey(tw, data, exportAccountKeyFilename))
+	}
+
+	require.NoError(t, exportPrivateKey(tw, []byte("account proof key"), exportAccountProofKeyFilename))
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func TestValidateAccountExport(t *testing.T) {
+	accountSK, accountPK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	accountPKBytes, err := accountPK.Raw()
+	require.NoError(t, err)
+
+	_, otherPK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	otherPKBytes, err := otherPK.Raw()
+	require.NoError(t, err)
+
+	archive := writeTestKeysExport(t, accountSK)
+
+	// without a fingerprint only the account key is checked
+	require.NoError(t, ValidateAccountExport(bytes.NewReader(archive), nil))
+
+	require.NoError(t, ValidateAccountExport(bytes.NewReader(archive), AccountKeyFingerprint(accountPKBytes)))
+
+	err = ValidateAccountExport(bytes.NewReader(archive), AccountKeyFingerprint(otherPKBytes))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrAccountMismatch))
+
+	// an archive without account key is rejected
+	err = ValidateAccountExport(bytes.NewReader(writeTestKeysExport(t, nil)), AccountKeyFingerprint(accountPKBytes))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrNotFound))
+}
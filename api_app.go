@@ -1,11 +1,14 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 
 	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
@@ -18,13 +21,24 @@ func (s *service) AppMetadataSend(ctx context.Context, req *protocoltypes.AppMet
 	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Sending app metadata to group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
 	defer func() { endSection(err, "") }()
 
+	ctx, span := s.tracer.Start(ctx, "AppMetadataSend", trace.WithAttributes(traceGroupPK(req.GroupPk)))
+	defer func() { endSpan(span, err) }()
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	gc, err := s.GetContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
 	}
 	tyberLogGroupContext(ctx, s.logger, gc)
 
-	op, err := gc.MetadataStore().SendAppMetadata(ctx, req.Payload)
+	appendCtx, appendSpan := s.tracer.Start(ctx, "StoreAppend")
+	op, err := gc.MetadataStore().SendAppMetadata(appendCtx, req.Payload)
+	endSpan(appendSpan, err)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
@@ -36,13 +50,31 @@ func (s *service) AppMessageSend(ctx context.Context, req *protocoltypes.AppMess
 	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Sending message to group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
 	defer func() { endSection(err, "") }()
 
+	ctx, span := s.tracer.Start(ctx, "AppMessageSend", trace.WithAttributes(traceGroupPK(req.GroupPk)))
+	defer func() { endSpan(span, err) }()
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	gc, err := s.GetContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
 	}
 	tyberLogGroupContext(ctx, s.logger, gc)
 
-	op, err := gc.MessageStore().AddMessage(ctx, req.Payload)
+	interceptCtx, interceptSpan := s.tracer.Start(ctx, "InterceptOutgoingMessage")
+	payload, err := s.interceptOutgoingMessage(interceptCtx, req.GroupPk, req.Payload)
+	endSpan(interceptSpan, err)
+	if err != nil {
+		return nil, err
+	}
+
+	appendCtx, appendSpan := s.tracer.Start(ctx, "StoreAppend")
+	op, err := gc.MessageStore().AddMessage(appendCtx, payload)
+	endSpan(appendSpan, err)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
@@ -50,6 +82,150 @@ func (s *service) AppMessageSend(ctx context.Context, req *protocoltypes.AppMess
 	return &protocoltypes.AppMessageSend_Reply{Cid: op.GetEntry().GetHash().Bytes()}, nil
 }
 
+// AppMessageEdit adds a new version of a message sent by the same member, the
+// original message is kept in the log
+func (s *service) AppMessageEdit(ctx context.Context, req *protocoltypes.AppMessageEdit_Request) (_ *protocoltypes.AppMessageEdit_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Editing message on group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
+	defer func() { endSection(err, "") }()
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	tyberLogGroupContext(ctx, s.logger, gc)
+
+	id, err := cid.Cast(req.Cid)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	original, err := gc.MessageStore().GetMessageEventByCID(ctx, id)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to open the message to edit: %w", err))
+	}
+
+	if len(original.EditOf) > 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an edit can't be edited, edit the original message instead"))
+	}
+
+	if original.StreamChunk {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a chunk of a streamed message can't be edited"))
+	}
+
+	if err := checkMessageAuthor(gc.MetadataStore(), original, gc.MemberPubKey()); err != nil {
+		return nil, err
+	}
+
+	payload, err := s.interceptOutgoingMessage(ctx, req.GroupPk, req.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := gc.MessageStore().AddMessageEdit(ctx, payload, original)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.AppMessageEdit_Reply{Cid: op.GetEntry().GetHash().Bytes()}, nil
+}
+
+// AppMessageSendStream adds a message whose payload is streamed in chunks by
+// the client, the chunks are added to the message store as they are received.
+// The outgoing message interceptor needs the whole payload, when one is set
+// the payload is read entirely before being intercepted and added.
+func (s *service) AppMessageSendStream(stream protocoltypes.ProtocolService_AppMessageSendStreamServer) (err error) {
+	ctx, span := s.tracer.Start(stream.Context(), "AppMessageSendStream")
+	defer func() { endSpan(span, err) }()
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the group of the message must be sent first"))
+	} else if err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	gc, err := s.GetContextGroupForID(first.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	tyberLogGroupContext(ctx, s.logger, gc)
+
+	payload := &sendStreamReader{stream: stream, current: first.Payload}
+	if s.outgoingInterceptor != nil {
+		return s.sendInterceptedStream(ctx, stream, gc, first.GroupPk, payload)
+	}
+
+	op, err := gc.MessageStore().AddMessageStream(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&protocoltypes.AppMessageSendStream_Reply{
+		Cid:  op.GetEntry().GetHash().Bytes(),
+		Size: payload.size,
+	})
+}
+
+// sendInterceptedStream reads the whole streamed payload, passes it to the
+// outgoing message interceptor and adds the returned payload in chunks
+func (s *service) sendInterceptedStream(ctx context.Context, stream protocoltypes.ProtocolService_AppMessageSendStreamServer, gc *GroupContext, groupPK []byte, r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	payload, err := s.interceptOutgoingMessage(ctx, groupPK, raw)
+	if err != nil {
+		return err
+	}
+
+	op, err := gc.MessageStore().AddMessageStream(ctx, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&protocoltypes.AppMessageSendStream_Reply{
+		Cid:  op.GetEntry().GetHash().Bytes(),
+		Size: uint64(len(payload)),
+	})
+}
+
+// sendStreamReader reads the payload streamed to AppMessageSendStream
+type sendStreamReader struct {
+	stream  protocoltypes.ProtocolService_AppMessageSendStreamServer
+	current []byte
+	size    uint64
+}
+
+func (r *sendStreamReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+
+		r.current = req.Payload
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	r.size += uint64(n)
+
+	return n, nil
+}
+
 // OutOfStoreReceive parses a payload received outside a synchronized store
 func (s *service) OutOfStoreReceive(ctx context.Context, request *protocoltypes.OutOfStoreReceive_Request) (*protocoltypes.OutOfStoreReceive_Reply, error) {
 	outOfStoreMessage, group, clearPayload, alreadyDecrypted, err := s.secretStore.OpenOutOfStoreMessage(ctx, request.Payload)
@@ -1,16 +1,23 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"sort"
 	"sync"
 
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/tyber"
 )
 
-func (s *service) ServiceExportData(_ *protocoltypes.ServiceExportData_Request, server protocoltypes.ProtocolService_ServiceExportDataServer) (err error) {
+func (s *service) ServiceExportData(req *protocoltypes.ServiceExportData_Request, server protocoltypes.ProtocolService_ServiceExportDataServer) (err error) {
 	ctx, _, endSection := tyber.Section(server.Context(), s.logger, "Exporting protocol instance data")
 	defer func() { endSection(err, "") }()
 
@@ -42,7 +49,20 @@ func (s *service) ServiceExportData(_ *protocoltypes.ServiceExportData_Request,
 		}
 	}()
 
-	if err := s.export(ctx, w); err != nil {
+	opts := exportOptions{
+		force:      req.Force,
+		format:     req.Format,
+		localState: req.IncludeLocalState,
+	}
+
+	if err := s.export(ctx, w, opts); err != nil {
+		_ = w.CloseWithError(err)
+		wg.Wait()
+
+		if errcode.Is(err, errcode.ErrCode_ErrExportWhileSyncing) {
+			return err
+		}
+
 		return errcode.ErrCode_ErrInternal.Wrap(err)
 	}
 	_ = w.Close()
@@ -88,10 +108,419 @@ func (s *service) ServiceGetConfiguration(ctx context.Context, _ *protocoltypes.
 	}
 
 	return &protocoltypes.ServiceGetConfiguration_Reply{
-		AccountPk:      member,
-		DevicePk:       device,
-		AccountGroupPk: accountGroup.Group().PublicKey,
-		PeerId:         key.ID().String(),
-		Listeners:      listeners,
+		AccountPk:              member,
+		DevicePk:               device,
+		AccountGroupPk:         accountGroup.Group().PublicKey,
+		PeerId:                 key.ID().String(),
+		Listeners:              listeners,
+		ProtocolVersion:        ProtocolVersion,
+		SeparateEncryptionKeys: s.secretStore.EncryptionKeysSeparated(),
+	}, nil
+}
+
+// ServiceIsPeerConnected checks the swarm connectedness of the last known peer
+// of the given device
+func (s *service) ServiceIsPeerConnected(_ context.Context, req *protocoltypes.ServiceIsPeerConnected_Request) (*protocoltypes.ServiceIsPeerConnected_Reply, error) {
+	if len(req.DevicePk) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no device pk provided"))
+	}
+
+	pid, ok := s.odb.GetPeerIDForDevicePK(req.DevicePk)
+	if !ok {
+		return &protocoltypes.ServiceIsPeerConnected_Reply{}, nil
+	}
+
+	reply := &protocoltypes.ServiceIsPeerConnected_Reply{
+		PeerId:    pid.String(),
+		Connected: s.host.Network().Connectedness(pid) == network.Connected,
+	}
+
+	if reply.Connected {
+		for _, conn := range s.host.Network().ConnsToPeer(pid) {
+			reply.Transports = append(reply.Transports, connTransport(conn.RemoteMultiaddr()))
+		}
+	}
+
+	return reply, nil
+}
+
+// ServiceGetAuditLog lists the security relevant operations recorded locally
+func (s *service) ServiceGetAuditLog(ctx context.Context, req *protocoltypes.ServiceGetAuditLog_Request) (*protocoltypes.ServiceGetAuditLog_Reply, error) {
+	entries, err := s.odb.auditLog.List(ctx, req.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceGetAuditLog_Reply{
+		Entries: entries,
+	}, nil
+}
+
+// ServiceSubscribeAuditLog streams the entries recorded in the audit log from
+// now on
+func (s *service) ServiceSubscribeAuditLog(req *protocoltypes.ServiceSubscribeAuditLog_Request, srv protocoltypes.ProtocolService_ServiceSubscribeAuditLogServer) error {
+	sub, err := s.odb.auditLog.Subscribe()
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	eventTypes := map[protocoltypes.AuditEventType]struct{}{}
+	for _, eventType := range req.EventTypes {
+		eventTypes[eventType] = struct{}{}
+	}
+
+	for {
+		var e interface{}
+
+		select {
+		case e = <-sub.Out():
+		case <-srv.Context().Done():
+			return nil
+		case <-s.ctx.Done():
+			return nil
+		}
+
+		entry := e.(*protocoltypes.AuditLogEntry)
+		if _, ok := eventTypes[entry.EventType]; len(eventTypes) > 0 && !ok {
+			continue
+		}
+
+		if err := srv.Send(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// ServiceCompactStorage reclaims the disk space used by deleted or overwritten data
+func (s *service) ServiceCompactStorage(ctx context.Context, _ *protocoltypes.ServiceCompactStorage_Request) (*protocoltypes.ServiceCompactStorage_Reply, error) {
+	return s.compactStorage(ctx)
+}
+
+// ServiceGetGroupStorageUsage estimates the disk space used by each group
+func (s *service) ServiceGetGroupStorageUsage(ctx context.Context, _ *protocoltypes.ServiceGetGroupStorageUsage_Request) (*protocoltypes.ServiceGetGroupStorageUsage_Reply, error) {
+	return s.groupStorageUsage(ctx)
+}
+
+// ServiceGetGroupBlockCIDs lists the CIDs of the blocks holding the log
+// entries of a group, e.g. to pin them
+func (s *service) ServiceGetGroupBlockCIDs(req *protocoltypes.ServiceGetGroupBlockCIDs_Request, sub protocoltypes.ProtocolService_ServiceGetGroupBlockCIDsServer) error {
+	return s.groupBlockCIDs(sub.Context(), req.GroupPk, sub.Send)
+}
+
+func (s *service) ServiceSetReplicationMode(ctx context.Context, req *protocoltypes.ServiceSetReplicationMode_Request) (_ *protocoltypes.ServiceSetReplicationMode_Reply, err error) {
+	_, _, endSection := tyber.Section(ctx, s.logger, "Setting replication mode to "+req.Mode.String())
+	defer func() { endSection(err, "") }()
+
+	if err := s.setReplicationMode(req.Mode); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceSetReplicationMode_Reply{}, nil
+}
+
+func (s *service) ServiceImportFromPeer(ctx context.Context, req *protocoltypes.ServiceImportFromPeer_Request) (*protocoltypes.ServiceImportFromPeer_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	info, err := peerAddrInfo(req.PeerId, req.Addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	imported, err := s.importFromPeer(ctx, gc, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceImportFromPeer_Reply{ImportedEntries: imported}, nil
+}
+
+func (s *service) ServiceResyncAccount(ctx context.Context, _ *protocoltypes.ServiceResyncAccount_Request) (*protocoltypes.ServiceResyncAccount_Reply, error) {
+	return s.resyncAccount(ctx)
+}
+
+// ServiceGetBandwidthStats returns the bandwidth used by the weshnet protocols
+// and the proximity transports
+func (s *service) ServiceGetBandwidthStats(_ context.Context, _ *protocoltypes.ServiceGetBandwidthStats_Request) (*protocoltypes.ServiceGetBandwidthStats_Reply, error) {
+	if s.bandwidthReporter == nil {
+		return nil, errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("no bandwidth reporter configured"))
+	}
+
+	return bandwidthStats(s.bandwidthReporter), nil
+}
+
+// ServiceListAllGroups lists the groups the account is a member of, including
+// the ones which are not activated
+func (s *service) ServiceListAllGroups(_ context.Context, _ *protocoltypes.ServiceListAllGroups_Request) (*protocoltypes.ServiceListAllGroups_Reply, error) {
+	groups, err := s.listAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceListAllGroups_Reply{Groups: groups}, nil
+}
+
+// ServiceGetRuntimeStats returns the goroutines of the weshnet worker pools
+// and the memory used by the message caches
+func (s *service) ServiceGetRuntimeStats(_ context.Context, _ *protocoltypes.ServiceGetRuntimeStats_Request) (*protocoltypes.ServiceGetRuntimeStats_Reply, error) {
+	return s.runtimeStats(), nil
+}
+
+// ServiceLeaveGroup leaves a multi-member group, the other devices of the
+// account are notified and the group is deactivated, its local data is kept
+func (s *service) ServiceLeaveGroup(ctx context.Context, req *protocoltypes.ServiceLeaveGroup_Request) (_ *protocoltypes.ServiceLeaveGroup_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Leaving group")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the group is activated to notify its members, it must not be opened
+	// once the groups have been deactivated by the shutdown
+	if req.NotifyMembers {
+		var done func()
+		if ctx, done, err = s.beginWrite(ctx); err != nil {
+			return nil, err
+		}
+		defer done()
+	}
+
+	if err := s.leaveGroup(ctx, pk, req.NotifyMembers); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceLeaveGroup_Reply{}, nil
+}
+
+// ServiceSetGroupPriority sets the replication priority of a group
+func (s *service) ServiceSetGroupPriority(ctx context.Context, req *protocoltypes.ServiceSetGroupPriority_Request) (*protocoltypes.ServiceSetGroupPriority_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if err := s.setGroupPriority(ctx, pk, req.Priority); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceSetGroupPriority_Reply{}, nil
+}
+
+// ServiceSetReplicationAllowlist restricts the replication to the given groups
+func (s *service) ServiceSetReplicationAllowlist(ctx context.Context, req *protocoltypes.ServiceSetReplicationAllowlist_Request) (*protocoltypes.ServiceSetReplicationAllowlist_Reply, error) {
+	var groupPKs []crypto.PubKey
+	if !req.Disabled {
+		groupPKs = make([]crypto.PubKey, len(req.GroupPks))
+		for i, groupPK := range req.GroupPks {
+			pk, err := crypto.UnmarshalEd25519PublicKey(groupPK)
+			if err != nil {
+				return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+			}
+
+			groupPKs[i] = pk
+		}
+	}
+
+	// the groups are reactivated, they must not be opened once the groups
+	// have been deactivated by the shutdown
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := s.setReplicationAllowlist(ctx, groupPKs); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceSetReplicationAllowlist_Reply{}, nil
+}
+
+// ServiceSetGroupTopic overrides the pubsub topics used by the stores of a
+// group with a custom topic
+func (s *service) ServiceSetGroupTopic(ctx context.Context, req *protocoltypes.ServiceSetGroupTopic_Request) (*protocoltypes.ServiceSetGroupTopic_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the group is reactivated, it must not be opened once the groups have
+	// been deactivated by the shutdown
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := s.setGroupTopic(ctx, pk, req.Topic); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceSetGroupTopic_Reply{}, nil
+}
+
+// ServiceSetRendezvousPeers replaces the rendezvous points used for
+// discovery
+func (s *service) ServiceSetRendezvousPeers(_ context.Context, req *protocoltypes.ServiceSetRendezvousPeers_Request) (*protocoltypes.ServiceSetRendezvousPeers_Reply, error) {
+	if err := s.setRendezvousPeers(req.Addrs); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceSetRendezvousPeers_Reply{}, nil
+}
+
+// ServicePinMessage pins or unpins a message of a group, the pinned messages
+// don't expire on the device
+func (s *service) ServicePinMessage(ctx context.Context, req *protocoltypes.ServicePinMessage_Request) (*protocoltypes.ServicePinMessage_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	id, err := cid.Cast(req.Cid)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if !req.Unpin {
+		if _, ok := gc.MessageStore().OpLog().Get(id); !ok {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown message %s", id))
+		}
+	}
+
+	// the chunks of a streamed message are pinned along with it
+	chunks, err := gc.MessageStore().streamChunksOf(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Unpin {
+		if err := s.odb.messagePins.Unpin(ctx, gc.Group().PublicKey, id, chunks...); err != nil {
+			return nil, err
+		}
+
+		return &protocoltypes.ServicePinMessage_Reply{}, nil
+	}
+
+	if err := s.odb.messagePins.Pin(ctx, gc.Group().PublicKey, id, chunks...); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServicePinMessage_Reply{}, nil
+}
+
+// ServiceListPinnedMessages lists the messages pinned in a group
+func (s *service) ServiceListPinnedMessages(ctx context.Context, req *protocoltypes.ServiceListPinnedMessages_Request) (*protocoltypes.ServiceListPinnedMessages_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	ids, err := s.odb.messagePins.List(ctx, gc.Group().PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceListPinnedMessages_Reply{
+		Cids: cidsToBytes(ids),
+	}, nil
+}
+
+// ServiceMarkRead marks the messages of a group as read up to a message
+func (s *service) ServiceMarkRead(ctx context.Context, req *protocoltypes.ServiceMarkRead_Request) (*protocoltypes.ServiceMarkRead_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	id, err := cid.Cast(req.Cid)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if _, ok := gc.MessageStore().OpLog().Get(id); !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown message %s", id))
+	}
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := s.odb.readMarkers.Set(ctx, gc.Group().PublicKey, id); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceMarkRead_Reply{}, nil
+}
+
+// ServiceGetUnreadCounts returns the number of unread messages of each
+// activated group
+func (s *service) ServiceGetUnreadCounts(ctx context.Context, _ *protocoltypes.ServiceGetUnreadCounts_Request) (*protocoltypes.ServiceGetUnreadCounts_Reply, error) {
+	s.lock.RLock()
+	groups := make([]*GroupContext, 0, len(s.openedGroups))
+	for _, gc := range s.openedGroups {
+		if gc.group.GroupType == protocoltypes.GroupType_GroupTypeAccount || gc.messageStore == nil {
+			continue
+		}
+
+		groups = append(groups, gc)
+	}
+	s.lock.RUnlock()
+
+	sort.Slice(groups, func(i, j int) bool {
+		return bytes.Compare(groups[i].group.PublicKey, groups[j].group.PublicKey) < 0
+	})
+
+	reply := &protocoltypes.ServiceGetUnreadCounts_Reply{}
+	for _, gc := range groups {
+		marker, err := s.odb.readMarkers.Get(ctx, gc.group.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		streams, err := gc.messageStore.messageStreams(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		unread := unreadCount(gc.messageStore, marker, streams.isChunk)
+		reply.Groups = append(reply.Groups, &protocoltypes.ServiceGetUnreadCounts_Reply_Group{
+			GroupPk: gc.group.PublicKey,
+			Unread:  unread,
+		})
+		reply.Total += unread
+	}
+
+	return reply, nil
+}
+
+// ServiceReprocessGroup rebuilds the state derived from the local logs of a
+// group, without fetching anything from the other peers
+func (s *service) ServiceReprocessGroup(ctx context.Context, req *protocoltypes.ServiceReprocessGroup_Request) (*protocoltypes.ServiceReprocessGroup_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	messages, err := gc.reprocess(ctx, s.messageIndexer)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBReplay.Wrap(err)
+	}
+
+	return &protocoltypes.ServiceReprocessGroup_Reply{
+		Messages: messages,
 	}, nil
 }
@@ -0,0 +1,294 @@
+package weshnet
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestServiceIsPeerConnected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := TestingOpts{
+		Mocknet:     mn,
+		Logger:      logger,
+		ConnectFunc: ConnectAll,
+	}
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := CreateMultiMemberGroupInstance(ctx, t, pts...)
+
+	info, err := pts[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	local, remote := pts[0].Opts.Host.ID(), pts[1].Opts.Host.ID()
+
+	isConnected := func() *protocoltypes.ServiceIsPeerConnected_Reply {
+		reply, err := pts[0].Client.ServiceIsPeerConnected(ctx, &protocoltypes.ServiceIsPeerConnected_Request{
+			DevicePk: info.DevicePk,
+		})
+		require.NoError(t, err)
+		return reply
+	}
+
+	require.Eventually(t, func() bool { return isConnected().Connected }, time.Second*10, time.Millisecond*100)
+
+	reply := isConnected()
+	require.Equal(t, remote.String(), reply.PeerId)
+	require.NotEmpty(t, reply.Transports)
+
+	// close the connections
+	require.NoError(t, mn.UnlinkPeers(local, remote))
+	require.NoError(t, mn.DisconnectPeers(local, remote))
+
+	require.Eventually(t, func() bool { return !isConnected().Connected }, time.Second*10, time.Millisecond*100)
+
+	reply = isConnected()
+	require.Equal(t, remote.String(), reply.PeerId)
+	require.Empty(t, reply.Transports)
+
+	// open a new connection
+	_, err = mn.LinkPeers(local, remote)
+	require.NoError(t, err)
+	_, err = mn.ConnectPeers(local, remote)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return isConnected().Connected }, time.Second*10, time.Millisecond*100)
+
+	// the peer of an unknown device can't be connected
+	reply, err = pts[0].Client.ServiceIsPeerConnected(ctx, &protocoltypes.ServiceIsPeerConnected_Request{
+		DevicePk: group.PublicKey,
+	})
+	require.NoError(t, err)
+	require.False(t, reply.Connected)
+	require.Empty(t, reply.PeerId)
+}
+
+func TestServiceGetConfigurationProtocolVersion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	require.Regexp(t, regexp.MustCompile(`^\d+\.\d+\.\d+$`), ProtocolVersion)
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &TestingOpts{Mocknet: mn, Logger: logger}, nil, 2)
+	defer cleanup()
+
+	// the version doesn't depend on the node nor change between calls
+	for _, pt := range append(pts, pts[0]) {
+		config, err := pt.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+		require.NoError(t, err)
+		require.Equal(t, ProtocolVersion, config.ProtocolVersion)
+	}
+}
+
+func TestServiceGetRuntimeStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	svc, ok := node.Service.(*service)
+	require.True(t, ok)
+	svc.maxGoroutines = 1_000_000
+
+	stats, err := node.Client.ServiceGetRuntimeStats(ctx, &protocoltypes.ServiceGetRuntimeStats_Request{})
+	require.NoError(t, err)
+
+	inbound := stats.WorkerPools[inboundPoolName]
+	require.NotNil(t, inbound)
+	require.Equal(t, int64(defaultInboundWorkers), inbound.Size)
+	require.Equal(t, int64(defaultInboundWorkers), inbound.Limit)
+	require.Equal(t, inbound.Running, stats.WeshnetGoroutines)
+	require.GreaterOrEqual(t, stats.Goroutines, stats.WeshnetGoroutines)
+	require.False(t, stats.Shedding)
+
+	// the replication concurrency is reduced above the soft cap
+	svc.checkGoroutinesCap(svc.maxGoroutines + 1)
+
+	stats, err = node.Client.ServiceGetRuntimeStats(ctx, &protocoltypes.ServiceGetRuntimeStats_Request{})
+	require.NoError(t, err)
+	require.True(t, stats.Shedding)
+	require.Equal(t, int64(1), stats.WorkerPools[inboundPoolName].Limit)
+
+	// and restored under it
+	svc.checkGoroutinesCap(svc.maxGoroutines - 1)
+
+	stats, err = node.Client.ServiceGetRuntimeStats(ctx, &protocoltypes.ServiceGetRuntimeStats_Request{})
+	require.NoError(t, err)
+	require.False(t, stats.Shedding)
+	require.Equal(t, int64(defaultInboundWorkers), stats.WorkerPools[inboundPoolName].Limit)
+}
+
+func TestServiceSetReplicationModeInboundLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	inboundLimit := func() int64 {
+		stats, err := node.Client.ServiceGetRuntimeStats(ctx, &protocoltypes.ServiceGetRuntimeStats_Request{})
+		require.NoError(t, err)
+		return stats.WorkerPools[inboundPoolName].Limit
+	}
+
+	setMode := func(mode protocoltypes.ServiceSetReplicationMode_Mode) {
+		_, err := node.Client.ServiceSetReplicationMode(ctx, &protocoltypes.ServiceSetReplicationMode_Request{Mode: mode})
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int64(defaultInboundWorkers), inboundLimit())
+
+	setMode(protocoltypes.ServiceSetReplicationMode_Reduced)
+	require.Equal(t, int64(defaultInboundWorkers/2), inboundLimit())
+
+	setMode(protocoltypes.ServiceSetReplicationMode_Paused)
+	require.Equal(t, int64(1), inboundLimit())
+
+	// switching back to active restores the whole pool right away
+	setMode(protocoltypes.ServiceSetReplicationMode_Active)
+	require.Equal(t, int64(defaultInboundWorkers), inboundLimit())
+
+	_, err := node.Client.ServiceSetReplicationMode(ctx, &protocoltypes.ServiceSetReplicationMode_Request{Mode: 42})
+	require.Error(t, err)
+}
+
+func TestServiceSetReplicationAllowlist(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+	}, nil)
+	defer cleanup()
+
+	listTopics := func() map[string]struct{} {
+		topics := map[string]struct{}{}
+		for _, advertise := range listTopicsDetails(ctx, t, node) {
+			topics[advertise.Topic] = struct{}{}
+		}
+
+		return topics
+	}
+
+	s := node.Service.(*service)
+	groupState := func(groupPK []byte) (restricted bool, localOnly bool) {
+		_, err := s.GetContextGroupForID(groupPK)
+		require.NoError(t, err)
+
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+
+		_, restricted = s.replicationRestricted[string(groupPK)]
+		_, localOnly = s.localOnlyGroups[string(groupPK)]
+		return restricted, localOnly
+	}
+
+	// only the account group can be replicated
+	_, err := node.Client.ServiceSetReplicationAllowlist(ctx, &protocoltypes.ServiceSetReplicationAllowlist_Request{})
+	require.NoError(t, err)
+
+	before := listTopics()
+
+	// a group outside of the allowlist is only activated locally, its stores
+	// never start advertising
+	allowed, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	restricted, _ := groupState(allowed.GroupPk)
+	require.True(t, restricted)
+	require.Equal(t, before, listTopics())
+
+	// it is advertised once allowed
+	_, err = node.Client.ServiceSetReplicationAllowlist(ctx, &protocoltypes.ServiceSetReplicationAllowlist_Request{
+		GroupPks: [][]byte{allowed.GroupPk},
+	})
+	require.NoError(t, err)
+
+	restricted, _ = groupState(allowed.GroupPk)
+	require.False(t, restricted)
+
+	require.Eventually(t, func() bool {
+		return len(listTopics()) > len(before)
+	}, time.Second*5, time.Millisecond*100)
+
+	// while the other groups are not
+	other, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	restricted, _ = groupState(other.GroupPk)
+	require.True(t, restricted)
+
+	// a group activated locally by the app stays local
+	local, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPk: local.GroupPk})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: local.GroupPk, LocalOnly: true})
+	require.NoError(t, err)
+
+	restricted, localOnly := groupState(local.GroupPk)
+	require.False(t, restricted)
+	require.True(t, localOnly)
+
+	// the account group stays activated
+	config, err := node.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	_, err = s.GetContextGroupForID(config.AccountGroupPk)
+	require.NoError(t, err)
+
+	// all the groups are advertised once the allowlist is removed, except the
+	// one activated locally
+	withAllowed := listTopics()
+
+	_, err = node.Client.ServiceSetReplicationAllowlist(ctx, &protocoltypes.ServiceSetReplicationAllowlist_Request{Disabled: true})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(listTopics()) > len(withAllowed)
+	}, time.Second*5, time.Millisecond*100)
+
+	restricted, _ = groupState(other.GroupPk)
+	require.False(t, restricted)
+
+	restricted, localOnly = groupState(local.GroupPk)
+	require.False(t, restricted)
+	require.True(t, localOnly)
+}
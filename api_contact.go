@@ -81,7 +81,9 @@ func (s *service) RefreshContactRequest(ctx context.Context, req *protocoltypes.
 	s.refreshprocess[key] = cancel
 	s.muRefreshprocess.Unlock()
 
-	peers, err := s.swiper.RefreshContactRequest(ctx, req.ContactPk)
+	lookupCtx, span := s.tracer.Start(ctx, "DiscoveryLookup")
+	peers, err := s.swiper.RefreshContactRequest(lookupCtx, req.ContactPk)
+	endSpan(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("unable to refresh group: %w", err)
 	}
@@ -91,7 +93,7 @@ func (s *service) RefreshContactRequest(ctx context.Context, req *protocoltypes.
 	}
 	for _, p := range peers {
 		// check if we can connect to this peers
-		if err := s.host.Connect(ctx, p); err != nil {
+		if err := s.connectPeer(ctx, p); err != nil {
 			continue
 		}
 
@@ -2,12 +2,17 @@ package weshnet
 
 import (
 	"context"
+	crand "crypto/rand"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
+	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/testutil"
 )
@@ -50,3 +55,225 @@ func TestShareContact(t *testing.T) {
 	require.Equal(t, contact.Contact.Pk, config.AccountPk)
 	require.Equal(t, contact.Contact.PublicRendezvousSeed, contactRequestRef.PublicRendezvousSeed)
 }
+
+func TestShareContactQR(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet: mocknet.New(),
+		Logger:  logger,
+	}
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	token := []byte("one-time token")
+
+	config0, err := pts[0].Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	config1, err := pts[1].Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	qr, err := pts[0].Client.ShareContactQR(ctx, &protocoltypes.ShareContactQR_Request{Token: token})
+	require.NoError(t, err)
+
+	// the token is limited to keep the payload compact
+	_, err = pts[0].Client.ShareContactQR(ctx, &protocoltypes.ShareContactQR_Request{Token: make([]byte, contactQRMaxTokenSize+1)})
+	require.Error(t, err)
+
+	// Scanned by the other device.
+	decoded, err := pts[1].Client.DecodeContactQR(ctx, &protocoltypes.DecodeContactQR_Request{Payload: qr.Payload})
+	require.NoError(t, err)
+	require.Equal(t, config0.AccountPk, decoded.Contact.Pk)
+	require.Equal(t, token, decoded.Token)
+
+	// The token is only returned once.
+	_, err = pts[1].Client.DecodeContactQR(ctx, &protocoltypes.DecodeContactQR_Request{Payload: qr.Payload})
+	require.Error(t, err)
+	require.Equal(t, errcode.ErrCode_ErrInvalidInput, errcode.LastCode(err))
+
+	contactRequestRef, err := pts[0].Client.ContactRequestReference(ctx, &protocoltypes.ContactRequestReference_Request{})
+	require.NoError(t, err)
+	require.True(t, contactRequestRef.Enabled)
+	require.Equal(t, contactRequestRef.PublicRendezvousSeed, decoded.Contact.PublicRendezvousSeed)
+
+	// A tampered payload is rejected.
+	signed := &protocoltypes.ContactQRPayload{}
+	require.NoError(t, proto.Unmarshal(qr.Payload, signed))
+	contact := &protocoltypes.ContactQRPayload_Contact{}
+	require.NoError(t, proto.Unmarshal(signed.Contact, contact))
+
+	contact.PublicRendezvousSeed = []byte("tampered rendezvous seed")
+	signed.Contact, err = proto.Marshal(contact)
+	require.NoError(t, err)
+	tampered, err := proto.Marshal(signed)
+	require.NoError(t, err)
+
+	_, err = pts[1].Client.DecodeContactQR(ctx, &protocoltypes.DecodeContactQR_Request{Payload: tampered})
+	require.Error(t, err)
+	require.Equal(t, errcode.ErrCode_ErrCryptoSignatureVerification, errcode.LastCode(err))
+
+	// The decoded contact is ready to be sent a contact request.
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	subMeta0, err := pts[0].Client.GroupMetadataList(subCtx, &protocoltypes.GroupMetadataList_Request{
+		GroupPk: config0.AccountGroupPk,
+	})
+	require.NoError(t, err)
+
+	_, err = pts[1].Client.ContactRequestSend(ctx, &protocoltypes.ContactRequestSend_Request{
+		Contact:     decoded.Contact,
+		OwnMetadata: decoded.Token,
+	})
+	require.NoError(t, err)
+
+	found := false
+	for !found {
+		evt, err := subMeta0.Recv()
+		if err == io.EOF || subMeta0.Context().Err() != nil {
+			break
+		}
+		require.NoError(t, err)
+
+		if evt == nil || evt.Metadata.EventType != protocoltypes.EventType_EventTypeAccountContactRequestIncomingReceived {
+			continue
+		}
+
+		req := &protocoltypes.AccountContactRequestIncomingReceived{}
+		require.NoError(t, proto.Unmarshal(evt.Event, req))
+		require.Equal(t, config1.AccountPk, req.ContactPk)
+		require.Equal(t, token, req.ContactMetadata)
+		found = true
+	}
+	subCancel()
+	require.True(t, found)
+
+	_, err = pts[0].Client.ContactRequestAccept(ctx, &protocoltypes.ContactRequestAccept_Request{
+		ContactPk: config1.AccountPk,
+	})
+	require.NoError(t, err)
+
+	grpInfo0, err := pts[0].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{ContactPk: config1.AccountPk})
+	require.NoError(t, err)
+
+	grpInfo1, err := pts[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{ContactPk: config0.AccountPk})
+	require.NoError(t, err)
+	require.Equal(t, grpInfo0.Group.PublicKey, grpInfo1.Group.PublicKey)
+}
+
+func TestContactRequestMonitor(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet: mocknet.New(),
+		Logger:  logger,
+	}
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	config := make([]*protocoltypes.ServiceGetConfiguration_Reply, len(pts))
+	refs := make([]*protocoltypes.ContactRequestResetReference_Reply, len(pts))
+	for i, pt := range pts {
+		_, err := pt.Client.ContactRequestEnable(ctx, &protocoltypes.ContactRequestEnable_Request{})
+		require.NoError(t, err)
+
+		config[i], err = pt.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+		require.NoError(t, err)
+
+		refs[i], err = pt.Client.ContactRequestResetReference(ctx, &protocoltypes.ContactRequestResetReference_Request{})
+		require.NoError(t, err)
+	}
+
+	mon0, err := pts[0].Client.ContactRequestMonitor(ctx, &protocoltypes.ContactRequestMonitor_Request{})
+	require.NoError(t, err)
+
+	mon1, err := pts[1].Client.ContactRequestMonitor(ctx, &protocoltypes.ContactRequestMonitor_Request{})
+	require.NoError(t, err)
+
+	expectEvent := func(mon protocoltypes.ProtocolService_ContactRequestMonitorClient, typ protocoltypes.ContactRequestMonitor_Type, contactPK []byte) *protocoltypes.ContactRequestMonitor_Reply {
+		t.Helper()
+
+		reply, err := mon.Recv()
+		require.NoError(t, err)
+		require.Equal(t, typ, reply.Type)
+		require.Equal(t, contactPK, reply.ContactPk)
+		require.NotEmpty(t, reply.EventId)
+
+		return reply
+	}
+
+	// the request of the second account is sent then received by the first one
+	metadata := []byte("sender_1")
+	_, err = pts[1].Client.ContactRequestSend(ctx, &protocoltypes.ContactRequestSend_Request{
+		Contact: &protocoltypes.ShareableContact{
+			Pk:                   config[0].AccountPk,
+			PublicRendezvousSeed: refs[0].PublicRendezvousSeed,
+		},
+		OwnMetadata: metadata,
+	})
+	require.NoError(t, err)
+
+	expectEvent(mon1, protocoltypes.ContactRequestMonitor_TypeOutgoingSent, config[0].AccountPk)
+
+	received := expectEvent(mon0, protocoltypes.ContactRequestMonitor_TypeIncomingReceived, config[1].AccountPk)
+	require.Equal(t, metadata, received.ContactMetadata)
+
+	_, err = pts[0].Client.ContactRequestAccept(ctx, &protocoltypes.ContactRequestAccept_Request{
+		ContactPk: config[1].AccountPk,
+	})
+	require.NoError(t, err)
+
+	accepted := expectEvent(mon0, protocoltypes.ContactRequestMonitor_TypeIncomingAccepted, config[1].AccountPk)
+	require.NotEmpty(t, accepted.GroupPk)
+
+	// a request to an offline contact is canceled before being sent
+	_, offlinePK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	offlinePKBytes, err := offlinePK.Raw()
+	require.NoError(t, err)
+
+	_, err = pts[0].Client.ContactRequestSend(ctx, &protocoltypes.ContactRequestSend_Request{
+		Contact: &protocoltypes.ShareableContact{
+			Pk:                   offlinePKBytes,
+			PublicRendezvousSeed: refs[1].PublicRendezvousSeed,
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = pts[0].Client.CancelContactRequest(ctx, &protocoltypes.CancelContactRequest_Request{
+		ContactPk: offlinePKBytes,
+	})
+	require.NoError(t, err)
+
+	expectEvent(mon0, protocoltypes.ContactRequestMonitor_TypeOutgoingCanceled, offlinePKBytes)
+
+	// a request received from the offline contact is discarded
+	_, err = pts[1].Service.(*service).getAccountGroup().MetadataStore().ContactRequestIncomingReceived(ctx, &protocoltypes.ShareableContact{
+		Pk:                   offlinePKBytes,
+		PublicRendezvousSeed: refs[0].PublicRendezvousSeed,
+	})
+	require.NoError(t, err)
+
+	expectEvent(mon1, protocoltypes.ContactRequestMonitor_TypeIncomingReceived, offlinePKBytes)
+
+	_, err = pts[1].Client.ContactRequestDiscard(ctx, &protocoltypes.ContactRequestDiscard_Request{
+		ContactPk: offlinePKBytes,
+	})
+	require.NoError(t, err)
+
+	expectEvent(mon1, protocoltypes.ContactRequestMonitor_TypeIncomingDiscarded, offlinePKBytes)
+}
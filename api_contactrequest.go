@@ -4,6 +4,8 @@ import (
 	"context"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
 	"berty.tech/weshnet/v2/pkg/errcode"
@@ -152,6 +154,11 @@ func (s *service) ContactRequestAccept(ctx context.Context, req *protocoltypes.C
 		return nil, err
 	}
 
+	s.odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeContactRequestAccepted,
+		ContactPk: req.ContactPk,
+	})
+
 	return &protocoltypes.ContactRequestAccept_Reply{}, nil
 }
 
@@ -174,42 +181,165 @@ func (s *service) ContactRequestDiscard(ctx context.Context, req *protocoltypes.
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
 
+	s.odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeContactRequestDiscarded,
+		ContactPk: req.ContactPk,
+	})
+
 	return &protocoltypes.ContactRequestDiscard_Reply{}, nil
 }
 
-// ShareContact uses ContactRequestReference to get the contact information for the current account and
-// returns the Protobuf encoding which you can further encode and share. If needed, his will reset the
-// contact request reference and enable contact requests.
-func (s *service) ShareContact(ctx context.Context, _ *protocoltypes.ShareContact_Request) (_ *protocoltypes.ShareContact_Reply, err error) {
+// ListPendingContactRequests lists the outgoing contact requests which haven't been sent yet
+func (s *service) ListPendingContactRequests(context.Context, *protocoltypes.ListPendingContactRequests_Request) (*protocoltypes.ListPendingContactRequests_Reply, error) {
 	accountGroup := s.getAccountGroup()
 	if accountGroup == nil {
 		return nil, errcode.ErrCode_ErrGroupMissing
 	}
 
-	enabled, shareableContact := accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
-	rdvSeed := []byte(nil)
+	return &protocoltypes.ListPendingContactRequests_Reply{
+		Contacts: accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateToRequest),
+	}, nil
+}
 
-	if shareableContact != nil {
-		rdvSeed = shareableContact.PublicRendezvousSeed
+// CancelContactRequest retracts an outgoing contact request, pending or
+// already sent, the contact is then back to its initial state
+func (s *service) CancelContactRequest(ctx context.Context, req *protocoltypes.CancelContactRequest_Request) (_ *protocoltypes.CancelContactRequest_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Canceling contact request")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().ContactRequestOutgoingCancel(ctx, pk); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.CancelContactRequest_Reply{}, nil
+}
+
+// ContactRequestMonitor streams the contact requests of the account as they
+// progress from now on
+func (s *service) ContactRequestMonitor(_ *protocoltypes.ContactRequestMonitor_Request, srv protocoltypes.ProtocolService_ContactRequestMonitorServer) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	sub, err := accountGroup.MetadataStore().EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent),
+		eventbus.Name("weshnet/api/contact-request-monitor"), eventbus.BufSize(32))
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
 	}
+	defer sub.Close()
+
+	for {
+		var e interface{}
+
+		select {
+		case e = <-sub.Out():
+		case <-srv.Context().Done():
+			return nil
+		case <-s.ctx.Done():
+			return nil
+		}
 
-	if !enabled || len(rdvSeed) == 0 {
-		// We need to enable and reset the contact request reference.
-		if _, err := accountGroup.MetadataStore().ContactRequestEnable(ctx); err != nil {
-			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		reply, err := contactRequestMonitorReply(e.(*protocoltypes.GroupMetadataEvent))
+		if err != nil {
+			s.logger.Error("unable to decode contact request event", zap.Error(err))
+			continue
 		}
 
-		if _, err := accountGroup.MetadataStore().ContactRequestReferenceReset(ctx); err != nil {
-			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		if reply == nil {
+			continue
+		}
+
+		if err := srv.Send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// contactRequestMonitorReply returns the reply of ContactRequestMonitor for an
+// event of the account group, it is nil if the event isn't relevant
+func contactRequestMonitorReply(evt *protocoltypes.GroupMetadataEvent) (*protocoltypes.ContactRequestMonitor_Reply, error) {
+	reply := &protocoltypes.ContactRequestMonitor_Reply{
+		EventId: evt.GetEventContext().GetId(),
+	}
+
+	switch evt.GetMetadata().GetEventType() {
+	case protocoltypes.EventType_EventTypeAccountContactRequestIncomingReceived:
+		e := &protocoltypes.AccountContactRequestIncomingReceived{}
+		if err := proto.Unmarshal(evt.Event, e); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
 		}
 
-		// Refresh the info.
-		_, shareableContact = accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
-		rdvSeed = []byte(nil)
+		reply.Type = protocoltypes.ContactRequestMonitor_TypeIncomingReceived
+		reply.ContactPk = e.ContactPk
+		reply.ContactMetadata = e.ContactMetadata
 
-		if shareableContact != nil {
-			rdvSeed = shareableContact.PublicRendezvousSeed
+	case protocoltypes.EventType_EventTypeAccountContactRequestIncomingAccepted:
+		e := &protocoltypes.AccountContactRequestIncomingAccepted{}
+		if err := proto.Unmarshal(evt.Event, e); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
 		}
+
+		reply.Type = protocoltypes.ContactRequestMonitor_TypeIncomingAccepted
+		reply.ContactPk = e.ContactPk
+		reply.GroupPk = e.GroupPk
+
+	case protocoltypes.EventType_EventTypeAccountContactRequestIncomingDiscarded:
+		e := &protocoltypes.AccountContactRequestIncomingDiscarded{}
+		if err := proto.Unmarshal(evt.Event, e); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		reply.Type = protocoltypes.ContactRequestMonitor_TypeIncomingDiscarded
+		reply.ContactPk = e.ContactPk
+
+	case protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent:
+		e := &protocoltypes.AccountContactRequestOutgoingSent{}
+		if err := proto.Unmarshal(evt.Event, e); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		reply.Type = protocoltypes.ContactRequestMonitor_TypeOutgoingSent
+		reply.ContactPk = e.ContactPk
+
+	case protocoltypes.EventType_EventTypeAccountContactRequestOutgoingCanceled:
+		e := &protocoltypes.AccountContactRequestOutgoingCanceled{}
+		if err := proto.Unmarshal(evt.Event, e); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		reply.Type = protocoltypes.ContactRequestMonitor_TypeOutgoingCanceled
+		reply.ContactPk = e.ContactPk
+
+	default:
+		return nil, nil
+	}
+
+	return reply, nil
+}
+
+// ShareContact uses ContactRequestReference to get the contact information for the current account and
+// returns the Protobuf encoding which you can further encode and share. If needed, his will reset the
+// contact request reference and enable contact requests.
+func (s *service) ShareContact(ctx context.Context, _ *protocoltypes.ShareContact_Request) (_ *protocoltypes.ShareContact_Reply, err error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	rdvSeed, err := ensureContactRequestReference(ctx, accountGroup)
+	if err != nil {
+		return nil, err
 	}
 
 	// Get the client's AccountPK.
@@ -231,6 +361,40 @@ func (s *service) ShareContact(ctx context.Context, _ *protocoltypes.ShareContac
 	}, nil
 }
 
+// ensureContactRequestReference returns the public rendezvous seed of the account, contact requests are enabled and
+// the contact request reference is reset if needed.
+func ensureContactRequestReference(ctx context.Context, accountGroup *GroupContext) ([]byte, error) {
+	enabled, shareableContact := accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	rdvSeed := []byte(nil)
+
+	if shareableContact != nil {
+		rdvSeed = shareableContact.PublicRendezvousSeed
+	}
+
+	if enabled && len(rdvSeed) != 0 {
+		return rdvSeed, nil
+	}
+
+	// We need to enable and reset the contact request reference.
+	if _, err := accountGroup.MetadataStore().ContactRequestEnable(ctx); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	if _, err := accountGroup.MetadataStore().ContactRequestReferenceReset(ctx); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	// Refresh the info.
+	_, shareableContact = accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
+	rdvSeed = []byte(nil)
+
+	if shareableContact != nil {
+		rdvSeed = shareableContact.PublicRendezvousSeed
+	}
+
+	return rdvSeed, nil
+}
+
 // DecodeContact decodes the Protobuf encoding of a shareable contact which was returned by ShareContact.
 func (s *service) DecodeContact(_ context.Context, req *protocoltypes.DecodeContact_Request) (_ *protocoltypes.DecodeContact_Reply, err error) {
 	contact := &protocoltypes.ShareableContact{}
@@ -242,3 +406,47 @@ func (s *service) DecodeContact(_ context.Context, req *protocoltypes.DecodeCont
 		Contact: contact,
 	}, nil
 }
+
+// ShareContactQR returns a compact payload, signed by the account, encoding the contact information of the current
+// account and an optional one-time token, meant to be displayed as a QR code. If needed, this will reset the contact
+// request reference and enable contact requests.
+func (s *service) ShareContactQR(ctx context.Context, req *protocoltypes.ShareContactQR_Request) (*protocoltypes.ShareContactQR_Reply, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	rdvSeed, err := ensureContactRequestReference(ctx, accountGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := encodeContactQRPayload(accountGroup.ownMemberDevice, rdvSeed, req.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ShareContactQR_Reply{
+		Payload: payload,
+	}, nil
+}
+
+// DecodeContactQR verifies the signature of a payload returned by ShareContactQR and decodes it. The one-time token of
+// the payload is consumed, decoding it again fails.
+func (s *service) DecodeContactQR(ctx context.Context, req *protocoltypes.DecodeContactQR_Request) (*protocoltypes.DecodeContactQR_Reply, error) {
+	contact, token, err := decodeContactQRPayload(req.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(token) > 0 {
+		if err := s.odb.contactQRTokens.Consume(ctx, contact.Pk, token); err != nil {
+			return nil, err
+		}
+	}
+
+	return &protocoltypes.DecodeContactQR_Reply{
+		Contact: contact,
+		Token:   token,
+	}, nil
+}
@@ -1,8 +1,10 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,9 +15,11 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
+	ipfslog "berty.tech/go-ipfs-log"
 	"berty.tech/go-orbit-db/stores/operation"
 	"berty.tech/weshnet/v2/internal/sysutil"
 	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 )
 
@@ -117,7 +121,7 @@ func (s *service) DebugInspectGroupStore(req *protocoltypes.DebugInspectGroupSto
 
 			if op, err := operation.ParseOperation(e); err != nil {
 				s.logger.Error("unable to parse operation", zap.Error(err))
-			} else if meta, event, err := openGroupEnvelope(cg.group, op.GetValue()); err != nil {
+			} else if meta, event, err := openGroupEnvelope(cg.group, op.GetValue(), cg.metadataStore.secretStore.CipherSuites(), cg.metadataStore.sigVerifier.withoutReport()); err != nil {
 				s.logger.Error("unable to open group envelope", zap.Error(err))
 			} else if metaEvent, err := newGroupMetadataEventFromEntry(log, e, meta, event, cg.group); err != nil {
 				s.logger.Error("unable to get group metadata event from entry", zap.Error(err))
@@ -176,6 +180,261 @@ func (s *service) DebugGroup(ctx context.Context, request *protocoltypes.DebugGr
 	return rep, nil
 }
 
+func (s *service) DebugListAdvertises(_ context.Context, _ *protocoltypes.DebugListAdvertises_Request) (*protocoltypes.DebugListAdvertises_Reply, error) {
+	if s.swiper == nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("discovery is disabled"))
+	}
+
+	infos := s.swiper.tinder.ListAdvertises()
+	rep := &protocoltypes.DebugListAdvertises_Reply{
+		Advertises: make([]*protocoltypes.DebugListAdvertises_Advertise, len(infos)),
+	}
+
+	for i, info := range infos {
+		advertise := &protocoltypes.DebugListAdvertises_Advertise{
+			Topic:  info.Topic,
+			Driver: info.Driver,
+			TtlMs:  info.TTL.Milliseconds(),
+		}
+
+		if !info.LastAdvertise.IsZero() {
+			advertise.LastAdvertiseAt = info.LastAdvertise.Unix()
+		}
+
+		if info.Error != nil {
+			advertise.Error = info.Error.Error()
+		}
+
+		rep.Advertises[i] = advertise
+	}
+
+	return rep, nil
+}
+
+func (s *service) DebugRefreshAdvertises(_ context.Context, request *protocoltypes.DebugRefreshAdvertises_Request) (*protocoltypes.DebugRefreshAdvertises_Reply, error) {
+	if s.swiper == nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("discovery is disabled"))
+	}
+
+	count := s.swiper.tinder.RefreshAdvertises(request.Topic)
+	if request.Topic != "" && count == 0 {
+		return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("topic is not advertised"))
+	}
+
+	return &protocoltypes.DebugRefreshAdvertises_Reply{
+		Count: int64(count),
+	}, nil
+}
+
+// DebugGroupReplicationLag returns the replication lag observed for each
+// device of a group through the delivery acks of the messages of the current
+// device
+func (s *service) DebugGroupReplicationLag(_ context.Context, request *protocoltypes.DebugGroupReplicationLag_Request) (*protocoltypes.DebugGroupReplicationLag_Reply, error) {
+	if _, err := s.GetContextGroupForID(request.GroupPk); err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	lags := s.odb.replicationLag.Group(request.GroupPk)
+	rep := &protocoltypes.DebugGroupReplicationLag_Reply{
+		Devices: make([]*protocoltypes.DebugGroupReplicationLag_Device, len(lags)),
+	}
+
+	for i, lag := range lags {
+		device := &protocoltypes.DebugGroupReplicationLag_Device{
+			DevicePk:     lag.DevicePK,
+			Samples:      lag.Samples,
+			LastLagMs:    lag.Last.Milliseconds(),
+			AverageLagMs: lag.Average.Milliseconds(),
+			MaxLagMs:     lag.Max.Milliseconds(),
+		}
+
+		if pid, ok := s.odb.GetPeerIDForDevicePK(lag.DevicePK); ok {
+			device.PeerId = pid.String()
+		}
+
+		rep.Devices[i] = device
+	}
+
+	return rep, nil
+}
+
+// ServiceDebugGroup returns a dump of the state of a group for the support and
+// the bug reports, the payloads of the entries are never included. The logs
+// of a group which isn't activated are read from the local data without
+// opening its stores, its members are the ones which added a device in its
+// metadata log. The recorded errors are redacted like the logs.
+func (s *service) ServiceDebugGroup(ctx context.Context, request *protocoltypes.ServiceDebugGroup_Request) (*protocoltypes.ServiceDebugGroup_Reply, error) {
+	rep := &protocoltypes.ServiceDebugGroup_Reply{GroupPk: request.GroupPk}
+
+	var inactive *protocoltypes.Group
+	if gc, err := s.GetContextGroupForID(request.GroupPk); err == nil {
+		rep.Active = true
+		rep.GroupType = gc.Group().GroupType
+
+		peers, err := s.GroupListConnectedPeers(ctx, &protocoltypes.GroupListConnectedPeers_Request{GroupPk: request.GroupPk})
+		if err != nil {
+			return nil, err
+		}
+
+		rep.ConnectedPeers = peers.Peers
+
+		for _, member := range gc.MetadataStore().ListMembers() {
+			dumped, err := debugGroupMember(gc.MetadataStore(), member)
+			if err != nil {
+				return nil, err
+			}
+
+			rep.Members = append(rep.Members, dumped)
+		}
+	} else {
+		pk, err := crypto.UnmarshalEd25519PublicKey(request.GroupPk)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if inactive, err = s.getGroupForPK(ctx, pk); err != nil {
+			return nil, err
+		}
+
+		rep.GroupType = inactive.GroupType
+	}
+
+	logs, err := s.groupLogs(ctx, request.GroupPk)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, log := range logs {
+		dumped, err := s.debugGroupStore(ctx, log)
+		if err != nil {
+			return nil, err
+		}
+
+		if log.Kind() == storeKindMetadata {
+			rep.MetadataStore = dumped
+		} else {
+			rep.MessageStore = dumped
+		}
+	}
+
+	// the members of an inactive group are read from its metadata log
+	if inactive != nil {
+		if rep.Members, err = s.debugLoggedMembers(ctx, inactive, logs[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(rep.Members, func(i, j int) bool {
+		return bytes.Compare(rep.Members[i].MemberPk, rep.Members[j].MemberPk) < 0
+	})
+
+	// the errors may contain private data
+	for _, groupErr := range s.odb.groupErrors.Group(request.GroupPk) {
+		rep.Errors = append(rep.Errors, &protocoltypes.ServiceDebugGroup_Error{
+			Timestamp: groupErr.At.Unix(),
+			Store:     groupErr.Store,
+			Error:     logutil.Redact(groupErr.Err),
+		})
+	}
+
+	return rep, nil
+}
+
+func (s *service) debugGroupStore(ctx context.Context, log groupLog) (*protocoltypes.ServiceDebugGroup_Store, error) {
+	address := log.Address()
+	dumped := &protocoltypes.ServiceDebugGroup_Store{
+		Address: address,
+		Topic:   s.odb.groupTopics.storeTopic(address),
+	}
+
+	err := log.Walk(ctx, func(ipfslog.Entry) error {
+		dumped.Entries++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, head := range log.Heads() {
+		dumped.Heads = append(dumped.Heads, head.String())
+	}
+	sort.Strings(dumped.Heads)
+
+	return dumped, nil
+}
+
+// debugLoggedMembers returns the members which added a device in the metadata
+// log of a group along with their devices
+func (s *service) debugLoggedMembers(ctx context.Context, g *protocoltypes.Group, metadataLog groupLog) ([]*protocoltypes.ServiceDebugGroup_Member, error) {
+	devices := map[string]map[string]struct{}{}
+	err := metadataLog.Walk(ctx, func(e ipfslog.Entry) error {
+		_, event, err := openMetadataEntry(nil, e, g, s.odb.secretStore.CipherSuites(), s.odb.sigVerifier.withoutReport())
+		if err != nil {
+			return nil
+		}
+
+		added, ok := event.(*protocoltypes.GroupMemberDeviceAdded)
+		if !ok {
+			return nil
+		}
+
+		if devices[string(added.MemberPk)] == nil {
+			devices[string(added.MemberPk)] = map[string]struct{}{}
+		}
+		devices[string(added.MemberPk)][string(added.DevicePk)] = struct{}{}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := []*protocoltypes.ServiceDebugGroup_Member{}
+	for memberPK, memberDevices := range devices {
+		dumped := &protocoltypes.ServiceDebugGroup_Member{MemberPk: []byte(memberPK)}
+		for devicePK := range memberDevices {
+			dumped.DevicePks = append(dumped.DevicePks, []byte(devicePK))
+		}
+
+		sort.Slice(dumped.DevicePks, func(i, j int) bool {
+			return bytes.Compare(dumped.DevicePks[i], dumped.DevicePks[j]) < 0
+		})
+
+		members = append(members, dumped)
+	}
+
+	return members, nil
+}
+
+func debugGroupMember(metadataStore *MetadataStore, member crypto.PubKey) (*protocoltypes.ServiceDebugGroup_Member, error) {
+	memberPK, err := member.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	dumped := &protocoltypes.ServiceDebugGroup_Member{MemberPk: memberPK}
+
+	devices, err := metadataStore.GetDevicesForMember(member)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	for _, device := range devices {
+		devicePK, err := device.Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		dumped.DevicePks = append(dumped.DevicePks, devicePK)
+	}
+
+	sort.Slice(dumped.DevicePks, func(i, j int) bool {
+		return bytes.Compare(dumped.DevicePks[i], dumped.DevicePks[j]) < 0
+	})
+
+	return dumped, nil
+}
+
 func (s *service) SystemInfo(ctx context.Context, _ *protocoltypes.SystemInfo_Request) (*protocoltypes.SystemInfo_Reply, error) {
 	reply := protocoltypes.SystemInfo_Reply{}
 
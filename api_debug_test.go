@@ -0,0 +1,193 @@
+package weshnet
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestDebugListAndRefreshAdvertises(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+	}, nil)
+	defer cleanup()
+
+	listTopics := func() map[string]struct{} {
+		topics := map[string]struct{}{}
+		for _, advertise := range listTopicsDetails(ctx, t, node) {
+			topics[advertise.Topic] = struct{}{}
+		}
+
+		return topics
+	}
+
+	before := listTopics()
+
+	// joining a group advertises its topics
+	createRep, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(listTopics()) > len(before)
+	}, time.Second*5, time.Millisecond*100)
+
+	var groupTopic *protocoltypes.DebugListAdvertises_Advertise
+	for _, advertise := range listTopicsDetails(ctx, t, node) {
+		if _, ok := before[advertise.Topic]; !ok {
+			groupTopic = advertise
+			break
+		}
+	}
+	require.NotNil(t, groupTopic)
+
+	require.Eventually(t, func() bool {
+		for _, advertise := range listTopicsDetails(ctx, t, node) {
+			if advertise.Topic == groupTopic.Topic && advertise.LastAdvertiseAt != 0 {
+				groupTopic = advertise
+				return true
+			}
+		}
+		return false
+	}, time.Second*5, time.Millisecond*100)
+
+	// a forced advertise updates the last advertise time
+	time.Sleep(time.Second)
+
+	refreshRep, err := node.Client.DebugRefreshAdvertises(ctx, &protocoltypes.DebugRefreshAdvertises_Request{Topic: groupTopic.Topic})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, refreshRep.Count, int64(1))
+
+	require.Eventually(t, func() bool {
+		for _, advertise := range listTopicsDetails(ctx, t, node) {
+			if advertise.Topic == groupTopic.Topic && advertise.LastAdvertiseAt > groupTopic.LastAdvertiseAt {
+				return true
+			}
+		}
+		return false
+	}, time.Second*5, time.Millisecond*100)
+
+	// refreshing an unknown topic fails
+	_, err = node.Client.DebugRefreshAdvertises(ctx, &protocoltypes.DebugRefreshAdvertises_Request{Topic: "unknown"})
+	require.Error(t, err)
+}
+
+func listTopicsDetails(ctx context.Context, t *testing.T, node *TestingProtocol) []*protocoltypes.DebugListAdvertises_Advertise {
+	t.Helper()
+
+	rep, err := node.Client.DebugListAdvertises(ctx, &protocoltypes.DebugListAdvertises_Request{})
+	require.NoError(t, err)
+
+	return rep.Advertises
+}
+
+func TestServiceDebugGroup(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := TestingOpts{
+		Mocknet:     mn,
+		Logger:      logger,
+		ConnectFunc: ConnectAll,
+	}
+
+	nodes, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	for i := 0; i < 3; i++ {
+		_, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: group.PublicKey,
+			Payload: []byte("test"),
+		})
+		require.NoError(t, err)
+	}
+
+	gc, err := nodes[0].Service.(*service).GetContextGroupForID(group.PublicKey)
+	require.NoError(t, err)
+
+	heads := func(store iface.Store) []string {
+		ids := []string{}
+		for _, head := range store.OpLog().RawHeads().Slice() {
+			ids = append(ids, head.GetHash().String())
+		}
+		sort.Strings(ids)
+
+		return ids
+	}
+
+	// the stores may still be receiving the acks of the other node
+	require.Eventually(t, func() bool {
+		dump, err := nodes[0].Client.ServiceDebugGroup(ctx, &protocoltypes.ServiceDebugGroup_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+
+		return len(dump.ConnectedPeers) == 1 &&
+			reflect.DeepEqual(heads(gc.MetadataStore()), dump.MetadataStore.Heads) &&
+			reflect.DeepEqual(heads(gc.MessageStore()), dump.MessageStore.Heads) &&
+			int64(gc.MessageStore().OpLog().Len()) == dump.MessageStore.Entries
+	}, time.Second*10, time.Millisecond*100)
+
+	dump, err := nodes[0].Client.ServiceDebugGroup(ctx, &protocoltypes.ServiceDebugGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	require.Equal(t, group.PublicKey, dump.GroupPk)
+	require.Equal(t, protocoltypes.GroupType_GroupTypeMultiMember, dump.GroupType)
+	require.True(t, dump.Active)
+	require.GreaterOrEqual(t, dump.MessageStore.Entries, int64(3))
+	require.NotEmpty(t, dump.MessageStore.Topic)
+
+	require.Len(t, dump.Members, 2)
+	for _, member := range dump.Members {
+		require.Len(t, member.DevicePks, 1)
+	}
+
+	require.Len(t, dump.ConnectedPeers, 1)
+	require.Equal(t, nodes[1].Opts.Host.ID().String(), dump.ConnectedPeers[0].PeerId)
+
+	// the logs of an inactive group are read without opening its stores
+	_, err = nodes[0].Client.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	inactive, err := nodes[0].Client.ServiceDebugGroup(ctx, &protocoltypes.ServiceDebugGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	require.False(t, inactive.Active)
+	require.Empty(t, inactive.ConnectedPeers)
+	require.Len(t, inactive.Members, 2)
+	require.Equal(t, dump.MessageStore.Address, inactive.MessageStore.Address)
+	require.GreaterOrEqual(t, inactive.MessageStore.Entries, dump.MessageStore.Entries)
+	require.NotEmpty(t, inactive.MessageStore.Heads)
+
+	_, err = nodes[0].Service.(*service).GetContextGroupForID(group.PublicKey)
+	require.Error(t, err)
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
 
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
@@ -48,6 +52,11 @@ func (s *service) GroupMetadataList(req *protocoltypes.GroupMetadataList_Request
 		return err
 	}
 
+	eventTypes := map[protocoltypes.EventType]struct{}{}
+	for _, eventType := range req.EventTypes {
+		eventTypes[eventType] = struct{}{}
+	}
+
 	// Subscribe to new metadata events if requested
 	var newEvents <-chan interface{}
 	if req.UntilId == nil && !req.UntilNow {
@@ -112,6 +121,10 @@ func (s *service) GroupMetadataList(req *protocoltypes.GroupMetadataList_Request
 			continue
 		}
 
+		if _, ok := eventTypes[msg.Metadata.GetEventType()]; len(eventTypes) > 0 && !ok {
+			continue
+		}
+
 		if err := sub.Send(msg); err != nil {
 			return err
 		}
@@ -152,6 +165,13 @@ func (s *service) GroupMessageList(req *protocoltypes.GroupMessageList_Request,
 	// Subscribe to previous message events and stream them if requested
 	previousEvents := make(chan *protocoltypes.GroupMessageEvent)
 	if !req.SinceNow {
+		// the edits are merged into the message they replace, even if they
+		// are out of the requested range
+		edits, err := cg.MessageStore().messageEdits(ctx)
+		if err != nil {
+			return err
+		}
+
 		pevt, err := cg.MessageStore().ListEvents(ctx, req.SinceId, req.UntilId, req.ReverseOrder)
 		if err != nil {
 			return err
@@ -179,31 +199,285 @@ func (s *service) GroupMessageList(req *protocoltypes.GroupMessageList_Request,
 					return
 				}
 
+				if evt = applyMessageEdits(cg.MetadataStore(), evt, edits, req.IncludeEditHistory); evt == nil {
+					continue
+				}
+
 				previousEvents <- evt
 			}
 		}()
 	}
 
+	send := func(msg *protocoltypes.GroupMessageEvent) error {
+		// the chunks of the streamed messages are read using
+		// GroupMessageReadStream
+		if msg.EventContext == nil || msg.StreamChunk {
+			return nil
+		}
+
+		// new edits are streamed as is so the original message can be updated
+		if len(msg.EditOf) > 0 {
+			if err := checkMessageEdit(ctx, cg, msg); err != nil {
+				cg.logger.Warn("GroupMessageList: ignoring invalid message edit", zap.Error(err))
+				return nil
+			}
+		}
+
+		if err := sub.Send(msg); err != nil {
+			return err
+		}
+
+		cg.logger.Info("service - message store - sent 1 event from log subscription")
+		return nil
+	}
+
+	var ordered *orderedMessageEvents
+	if req.Ordered {
+		ordered = newOrderedMessageEvents(cg.MessageStore(), req.SinceNow)
+	}
+
 	// Subscribe to new message events and stream them if requested
-	// listPreviouseMessageDone := false
 	for {
-		var event interface{}
+		var (
+			event    interface{}
+			previous bool
+		)
 		select {
 		case <-ctx.Done():
 			return nil
 		case event = <-previousEvents:
+			previous = true
 		case event = <-newEvents:
 		}
 
 		msg := event.(*protocoltypes.GroupMessageEvent)
-		if msg.EventContext == nil {
+		if ordered == nil {
+			if err := send(msg); err != nil {
+				return err
+			}
+
 			continue
 		}
 
-		if err := sub.Send(msg); err != nil {
+		var msgs []*protocoltypes.GroupMessageEvent
+		if previous {
+			msgs = ordered.history(msg)
+		} else {
+			// the events already received are sorted along with this one
+			ordered.add(msg)
+			for drained := false; !drained; {
+				select {
+				case event := <-newEvents:
+					ordered.add(event.(*protocoltypes.GroupMessageEvent))
+				default:
+					drained = true
+				}
+			}
+
+			msgs = ordered.flush()
+		}
+
+		for _, msg := range msgs {
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GroupMessageReadStream reads the payload of a message in chunks, the chunks
+// of a streamed message are opened one at a time so the payload is never
+// fully held in memory
+func (s *service) GroupMessageReadStream(req *protocoltypes.GroupMessageReadStream_Request, sub protocoltypes.ProtocolService_GroupMessageReadStreamServer) error {
+	cg, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	id, err := cid.Cast(req.Cid)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	payload, err := cg.MessageStore().OpenMessageStream(sub.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// the sent messages can be used lazily, a new buffer is needed each time
+		buf := make([]byte, messageStreamChunkSize)
+
+		n, err := payload.Read(buf)
+		if n > 0 {
+			if err := sub.Send(&protocoltypes.GroupMessageReadStream_Reply{Payload: buf[:n]}); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
 			return err
 		}
+	}
+}
 
-		cg.logger.Info("service - message store - sent 1 event from log subscription")
+// GroupGetRawLog lists the raw entries of the message log of a group, their
+// payload isn't decrypted so the entries waiting for the key of their device
+// are listed too. The entries aren't sorted, the causal order is given by
+// their next pointers.
+func (s *service) GroupGetRawLog(req *protocoltypes.GroupGetRawLog_Request, sub protocoltypes.ProtocolService_GroupGetRawLogServer) error {
+	cg, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	for _, e := range cg.MessageStore().OpLog().GetEntries().Slice() {
+		if err := sub.Context().Err(); err != nil {
+			return err
+		}
+
+		reply := &protocoltypes.GroupGetRawLog_Reply{
+			Cid:      e.GetHash().Bytes(),
+			LogId:    e.GetLogID(),
+			NextCids: cidsToBytes(e.GetNext()),
+			RefCids:  cidsToBytes(e.GetRefs()),
+			Sig:      e.GetSig(),
+		}
+
+		if clock := e.GetClock(); clock != nil {
+			reply.ClockId = clock.GetID()
+			reply.ClockTime = int64(clock.GetTime())
+		}
+
+		if identity := e.GetIdentity(); identity != nil {
+			reply.IdentityPk = identity.PublicKey
+		}
+
+		if req.IncludePayload {
+			reply.Payload = e.GetPayload()
+		}
+
+		if err := sub.Send(reply); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cidsToBytes(ids []cid.Cid) [][]byte {
+	raw := make([][]byte, len(ids))
+	for i, id := range ids {
+		raw[i] = id.Bytes()
+	}
+
+	return raw
+}
+
+// GroupMessageSearch returns the messages of a group containing all the words
+// of the query, optionally sent by a given device. The configured
+// MessageIndexer is used when available, the search then waits for the
+// history of the group to be indexed. The messages are scanned otherwise.
+func (s *service) GroupMessageSearch(ctx context.Context, req *protocoltypes.GroupMessageSearch_Request) (*protocoltypes.GroupMessageSearch_Reply, error) {
+	cg, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	query := &MessageQuery{
+		Tokens:   TokenizeMessage([]byte(req.Query)),
+		DevicePK: req.DevicePk,
+	}
+
+	if len(query.Tokens) == 0 && len(query.DevicePK) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no query or device provided"))
+	}
+
+	if s.messageIndexer != nil {
+		// the history of the group must be indexed for the results to be
+		// complete
+		if err := cg.WaitHistoryIndexed(ctx); err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		ids, err := s.messageIndexer.SearchMessages(ctx, req.GroupPk, query)
+		switch {
+		case err == nil:
+			messages, err := getIndexedMessages(ctx, cg, ids)
+			if err != nil {
+				return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			return &protocoltypes.GroupMessageSearch_Reply{Messages: messages}, nil
+
+		case !errcode.Has(err, errcode.ErrCode_ErrNotImplemented):
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		cg.logger.Debug("GroupMessageSearch: query not supported by the indexer, scanning messages")
 	}
+
+	edits, err := cg.MessageStore().messageEdits(ctx)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	messages, err := cg.MessageStore().ListEvents(ctx, nil, nil, false)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	// the latest version of the edited messages is searched
+	reply := &protocoltypes.GroupMessageSearch_Reply{}
+	for evt := range messages {
+		if evt = applyMessageEdits(cg.MetadataStore(), evt, edits, false); evt == nil {
+			continue
+		}
+
+		msg, err := newIndexedMessage(evt, time.Time{})
+		if err != nil {
+			continue
+		}
+
+		if query.matches(msg) {
+			reply.Messages = append(reply.Messages, evt)
+		}
+	}
+
+	return reply, nil
+}
+
+// getIndexedMessages opens the latest version of the messages returned by an
+// indexer, the messages which can't be opened or which have expired are
+// skipped
+func getIndexedMessages(ctx context.Context, cg *GroupContext, ids []cid.Cid) ([]*protocoltypes.GroupMessageEvent, error) {
+	edits, err := cg.MessageStore().messageEdits(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*protocoltypes.GroupMessageEvent, 0, len(ids))
+	now := time.Now()
+
+	for _, id := range ids {
+		evt, err := cg.MessageStore().GetMessageEventByCID(ctx, id)
+		if err != nil {
+			cg.logger.Debug("GroupMessageSearch: unable to open indexed message", zap.Error(err))
+			continue
+		}
+
+		if cg.MessageStore().isExpired(ctx, evt, now) {
+			continue
+		}
+
+		if evt = applyMessageEdits(cg.MetadataStore(), evt, edits, false); evt == nil {
+			continue
+		}
+
+		messages = append(messages, evt)
+	}
+
+	return messages, nil
 }
@@ -1,18 +1,26 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
 	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
 	"berty.tech/weshnet/v2/pkg/logutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 )
@@ -63,19 +71,247 @@ func (s *service) GroupInfo(ctx context.Context, req *protocoltypes.GroupInfo_Re
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	return &protocoltypes.GroupInfo_Reply{
+	reply := &protocoltypes.GroupInfo_Reply{
 		Group:    g,
 		MemberPk: member,
 		DevicePk: device,
+	}
+
+	if gc, err := s.GetContextGroupForID(g.PublicKey); err == nil {
+		reply.Devices = s.groupDevicesLastSeen(gc)
+		reply.MessageExpiration = int64(gc.MetadataStore().MessageExpiration() / time.Second)
+		reply.SignedReceipts = gc.MetadataStore().SignedReceipts()
+		reply.DeliveryAcks = gc.MetadataStore().DeliveryAcks()
+	}
+
+	return reply, nil
+}
+
+// groupDevicesLastSeen lists the known devices of a group along with the last
+// time some activity has been observed from them
+func (s *service) groupDevicesLastSeen(gc *GroupContext) []*protocoltypes.GroupInfo_DeviceLastSeen {
+	devicePKs := gc.MetadataStore().ListDevices()
+	devices := make([]*protocoltypes.GroupInfo_DeviceLastSeen, 0, len(devicePKs))
+
+	for _, devicePK := range devicePKs {
+		devicePKRaw, err := devicePK.Raw()
+		if err != nil {
+			continue
+		}
+
+		device := &protocoltypes.GroupInfo_DeviceLastSeen{
+			DevicePk: devicePKRaw,
+		}
+
+		if memberPK, err := gc.MetadataStore().GetMemberByDevice(devicePK); err == nil {
+			device.MemberPk, _ = memberPK.Raw()
+		}
+
+		if lastSeen, ok := s.odb.lastSeen.LastSeen(devicePKRaw); ok {
+			device.LastSeenAt = lastSeen.Unix()
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices
+}
+
+func (s *service) GroupMessageDeliveryStatus(_ context.Context, req *protocoltypes.GroupMessageDeliveryStatus_Request) (*protocoltypes.GroupMessageDeliveryStatus_Reply, error) {
+	if len(req.MessageId) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no message id provided"))
+	}
+
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	ackedDevices, totalDevices := gc.MetadataStore().MessageDeliveryStatus(req.MessageId)
+
+	receipts := []*protocoltypes.GroupMessageDeliveryStatus_DeliveryReceipt{}
+	signatures := gc.MetadataStore().MessageDeliveryReceipts(req.MessageId)
+	for _, device := range ackedDevices {
+		if signature, ok := signatures[string(device)]; ok {
+			receipts = append(receipts, &protocoltypes.GroupMessageDeliveryStatus_DeliveryReceipt{
+				DevicePk:  device,
+				Signature: signature,
+			})
+		}
+	}
+
+	return &protocoltypes.GroupMessageDeliveryStatus_Reply{
+		AckedDevices: int64(len(ackedDevices)),
+		TotalDevices: int64(totalDevices),
+		DevicePks:    ackedDevices,
+		Receipts:     receipts,
+	}, nil
+}
+
+// GroupSelfInfo retrieves the keys used by the current device in an opened
+// group, useful to diagnose signature mismatches
+func (s *service) GroupSelfInfo(_ context.Context, req *protocoltypes.GroupSelfInfo_Request) (*protocoltypes.GroupSelfInfo_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	member, err := gc.MemberPubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	device, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	identity := gc.MetadataStore().Identity()
+
+	identityPK, err := identity.GetPublicKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	identityPKRaw, err := identityPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return &protocoltypes.GroupSelfInfo_Reply{
+		MemberPk:   member,
+		DevicePk:   device,
+		IdentityId: identity.ID,
+		IdentityPk: identityPKRaw,
+	}, nil
+}
+
+// GroupMessageExpirationSet sets the disappearing messages timer of a group
+func (s *service) GroupMessageExpirationSet(ctx context.Context, req *protocoltypes.GroupMessageExpirationSet_Request) (*protocoltypes.GroupMessageExpirationSet_Reply, error) {
+	if req.Expiration < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expiration can't be negative"))
+	}
+
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().SetMessageExpiration(ctx, time.Duration(req.Expiration)*time.Second); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupMessageExpirationSet_Reply{}, nil
+}
+
+// GroupSignedReceiptsSet enables or disables the signed delivery receipts of a
+// group
+func (s *service) GroupSignedReceiptsSet(ctx context.Context, req *protocoltypes.GroupSignedReceiptsSet_Request) (*protocoltypes.GroupSignedReceiptsSet_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().SetSignedReceipts(ctx, req.Enabled); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSignedReceiptsSet_Reply{}, nil
+}
+
+// GroupDeliveryAcksSet enables or disables the delivery acknowledgements of a
+// group
+func (s *service) GroupDeliveryAcksSet(ctx context.Context, req *protocoltypes.GroupDeliveryAcksSet_Request) (*protocoltypes.GroupDeliveryAcksSet_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	if _, err := gc.MetadataStore().SetDeliveryAcks(ctx, req.Enabled); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupDeliveryAcksSet_Reply{}, nil
+}
+
+// GroupSnapshotGet returns the latest snapshot of a multi-member group, a
+// snapshot is taken if none has been published yet
+func (s *service) GroupSnapshotGet(ctx context.Context, req *protocoltypes.GroupSnapshotGet_Request) (*protocoltypes.GroupSnapshotGet_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil, errcode.ErrCode_ErrGroupInvalidType.Wrap(fmt.Errorf("only multi-member groups have snapshots"))
+	}
+
+	snapshot, id := gc.latestSnapshot()
+	if snapshot == nil {
+		if snapshot, id, err = s.publishGroupSnapshot(ctx, gc); err != nil {
+			return nil, err
+		}
+	}
+
+	return &protocoltypes.GroupSnapshotGet_Reply{
+		Snapshot: snapshot,
+		Cid:      id.Bytes(),
 	}, nil
 }
 
+// GroupSnapshotApply bootstraps an activated multi-member group from a
+// snapshot taken by another member
+func (s *service) GroupSnapshotApply(ctx context.Context, req *protocoltypes.GroupSnapshotApply_Request) (*protocoltypes.GroupSnapshotApply_Reply, error) {
+	if (req.Snapshot == nil) == (len(req.Cid) == 0) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expected either a snapshot or its cid"))
+	}
+
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil, errcode.ErrCode_ErrGroupInvalidType.Wrap(fmt.Errorf("only multi-member groups have snapshots"))
+	}
+
+	snapshot := req.Snapshot
+	if snapshot == nil {
+		id, err := cid.Cast(req.Cid)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+		}
+
+		if snapshot, err = s.fetchGroupSnapshot(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.applyGroupSnapshot(gc, snapshot); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSnapshotApply_Reply{}, nil
+}
+
+// groupsBatchConcurrency bounds the number of groups processed concurrently
+// by ActivateGroups and DeactivateGroups
+const groupsBatchConcurrency = 4
+
 func (s *service) ActivateGroup(ctx context.Context, req *protocoltypes.ActivateGroup_Request) (*protocoltypes.ActivateGroup_Reply, error) {
 	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
+	// the group must not be opened once the groups have been deactivated by
+	// the shutdown
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	err = s.activateGroup(ctx, pk, req.LocalOnly)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
@@ -97,6 +333,85 @@ func (s *service) DeactivateGroup(_ context.Context, req *protocoltypes.Deactiva
 	return &protocoltypes.DeactivateGroup_Reply{}, nil
 }
 
+// ActivateGroups activates several groups, the failures are reported by group
+func (s *service) ActivateGroups(ctx context.Context, req *protocoltypes.ActivateGroups_Request) (*protocoltypes.ActivateGroups_Reply, error) {
+	if len(req.GroupPks) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no group provided"))
+	}
+
+	// a single write spans the batch, none of the groups must be opened once
+	// the groups have been deactivated by the shutdown
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	results := processGroupsBatch(req.GroupPks, func(pk crypto.PubKey) error {
+		if err := s.activateGroup(ctx, pk, req.LocalOnly); err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		return nil
+	})
+
+	return &protocoltypes.ActivateGroups_Reply{Results: results}, nil
+}
+
+// DeactivateGroups deactivates several groups, the failures are reported by
+// group
+func (s *service) DeactivateGroups(_ context.Context, req *protocoltypes.DeactivateGroups_Request) (*protocoltypes.DeactivateGroups_Reply, error) {
+	if len(req.GroupPks) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no group provided"))
+	}
+
+	results := processGroupsBatch(req.GroupPks, func(pk crypto.PubKey) error {
+		if err := s.deactivateGroup(pk); err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		return nil
+	})
+
+	return &protocoltypes.DeactivateGroups_Reply{Results: results}, nil
+}
+
+// processGroupsBatch calls process for each group, at most
+// groupsBatchConcurrency at a time. The results are in the order of the
+// groups, an error on a group doesn't prevent the others from being processed.
+func processGroupsBatch(groupPKs [][]byte, process func(pk crypto.PubKey) error) []*protocoltypes.GroupActivationResult {
+	results := make([]*protocoltypes.GroupActivationResult, len(groupPKs))
+	sem := make(chan struct{}, groupsBatchConcurrency)
+	wg := sync.WaitGroup{}
+
+	for i, groupPK := range groupPKs {
+		result := &protocoltypes.GroupActivationResult{GroupPk: groupPK}
+		results[i] = result
+
+		pk, err := crypto.UnmarshalEd25519PublicKey(groupPK)
+		if err != nil {
+			result.Error = errcode.ErrCode_ErrInvalidInput.Wrap(err).Error()
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := process(pk); err != nil {
+				result.Error = err.Error()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
 func (s *service) GroupDeviceStatus(req *protocoltypes.GroupDeviceStatus_Request, srv protocoltypes.ProtocolService_GroupDeviceStatusServer) error {
 	ctx := srv.Context()
 	gkey := hex.EncodeToString(req.GroupPk)
@@ -161,6 +476,74 @@ func (s *service) GroupDeviceStatus(req *protocoltypes.GroupDeviceStatus_Request
 	}
 }
 
+// GroupListConnectedPeers lists the connected peers replicating a group, ie.
+// the peers which exchanged the heads of the group or the ones of its known
+// devices
+func (s *service) GroupListConnectedPeers(_ context.Context, req *protocoltypes.GroupListConnectedPeers_Request) (*protocoltypes.GroupListConnectedPeers_Reply, error) {
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	groupPK := gc.Group().PublicKey
+
+	// devices are the devices of the group, by peer
+	devices := map[peer.ID]crypto.PubKey{}
+	for _, p := range s.peerStatusManager.GroupPeers(hex.EncodeToString(groupPK)) {
+		devices[p] = nil
+
+		// a peer is only mapped to the last group it exchanged heads for
+		if pdg, ok := s.odb.GetDevicePKForPeerID(p); ok && pdg.Group != nil && bytes.Equal(pdg.Group.PublicKey, groupPK) {
+			devices[p] = pdg.DevicePK
+		}
+	}
+
+	for _, device := range gc.MetadataStore().ListDevices() {
+		raw, err := device.Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if p, ok := s.odb.GetPeerIDForDevicePK(raw); ok {
+			devices[p] = device
+		}
+	}
+
+	reply := &protocoltypes.GroupListConnectedPeers_Reply{
+		Peers: []*protocoltypes.GroupListConnectedPeers_Reply_Peer{},
+	}
+
+	for p, device := range devices {
+		if p == s.host.ID() || s.host.Network().Connectedness(p) != network.Connected {
+			continue
+		}
+
+		connected := &protocoltypes.GroupListConnectedPeers_Reply_Peer{
+			PeerId: p.String(),
+		}
+
+		if device != nil {
+			if connected.DevicePk, err = device.Raw(); err != nil {
+				return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+			}
+
+			if member, err := gc.MetadataStore().GetMemberByDevice(device); err == nil {
+				if connected.MemberPk, err = member.Raw(); err != nil {
+					return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+				}
+			}
+		}
+
+		reply.Peers = append(reply.Peers, connected)
+	}
+
+	sort.Slice(reply.Peers, func(i, j int) bool {
+		return reply.Peers[i].PeerId < reply.Peers[j].PeerId
+	})
+
+	return reply, nil
+}
+
 func (s *service) craftPeerConnectedMessage(peer peer.ID) (*protocoltypes.GroupDeviceStatus_Reply_PeerConnected, error) {
 	pdg, ok := s.odb.GetDevicePKForPeerID(peer)
 	if !ok {
@@ -177,33 +560,48 @@ func (s *service) craftPeerConnectedMessage(peer peer.ID) (*protocoltypes.GroupD
 		DevicePk: devicePKRaw,
 	}
 
-	activeConns := s.host.Network().ConnsToPeer(peer)
+	setConnsStatus(&connected, s.host.Network().ConnsToPeer(peer))
+
+	return &connected, nil
+}
+
+// setConnsStatus reports the address, the transport and the direction of the
+// active conns with a peer
+func setConnsStatus(connected *protocoltypes.GroupDeviceStatus_Reply_PeerConnected, activeConns []network.Conn) {
 	connected.Transports = make([]protocoltypes.GroupDeviceStatus_Transport, len(activeConns))
 	connected.Maddrs = make([]string, len(activeConns))
+	connected.Directions = make([]protocoltypes.Direction, len(activeConns))
 
-CONN_LOOP:
 	for i, conn := range activeConns {
 		connected.Maddrs[i] = conn.RemoteMultiaddr().String()
+		connected.Transports[i] = connTransport(conn.RemoteMultiaddr())
+		connected.Directions[i] = connDirection(conn.Stat().Direction)
+	}
+}
 
-		// check for proximity transport
-		protocols := conn.RemoteMultiaddr().Protocols()
-		for _, protocol := range protocols {
-			switch protocol.Name {
-			case "nearby", "mc", "ble":
-				connected.Transports[i] = protocoltypes.GroupDeviceStatus_TptProximity
-				continue CONN_LOOP
-			}
-		}
+func connTransport(remote ma.Multiaddr) protocoltypes.GroupDeviceStatus_Transport {
+	// check for proximity transport
+	if ipfsutil.ConnTransportType(remote) == ipfsutil.ConnTransportProximity {
+		return protocoltypes.GroupDeviceStatus_TptProximity
+	}
 
-		// otherwise, check for WAN/LAN addr
-		if manet.IsPrivateAddr(conn.RemoteMultiaddr()) {
-			connected.Transports[i] = protocoltypes.GroupDeviceStatus_TptLAN
-		} else {
-			connected.Transports[i] = protocoltypes.GroupDeviceStatus_TptWAN
-		}
+	// otherwise, check for WAN/LAN addr
+	if manet.IsPrivateAddr(remote) {
+		return protocoltypes.GroupDeviceStatus_TptLAN
 	}
 
-	return &connected, nil
+	return protocoltypes.GroupDeviceStatus_TptWAN
+}
+
+func connDirection(dir network.Direction) protocoltypes.Direction {
+	switch dir {
+	case network.DirInbound:
+		return protocoltypes.Direction_InboundDir
+	case network.DirOutbound:
+		return protocoltypes.Direction_OutboundDir
+	}
+
+	return protocoltypes.Direction_UnknownDir
 }
 
 func (s *service) craftDeviceDisconnectedMessage(peer peer.ID) *protocoltypes.GroupDeviceStatus_Reply_PeerDisconnected {
@@ -0,0 +1,612 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+// newLinkedProximityHost returns a host only reachable through the proximity
+// transport of the driver
+func newLinkedProximityHost(ctx context.Context, t *testing.T, driver *proximity.LinkedDriver) host.Host {
+	t.Helper()
+
+	sw := swarmt.GenSwarm(t, swarmt.OptDialOnly)
+	t.Cleanup(func() { sw.Close() })
+
+	transport, err := proximity.NewTransport(ctx, nil, driver)(sw, swarmt.GenUpgrader(t, sw, nil))
+	require.NoError(t, err)
+	require.NoError(t, sw.AddTransport(transport))
+	driver.Transport = transport
+	driver.LocalPID = sw.LocalPeer().String()
+
+	h, err := bhost.NewHost(sw, &bhost.HostOpts{})
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	h.Start()
+
+	require.NoError(t, sw.Listen(ma.StringCast(driver.DefaultAddr())))
+
+	return h
+}
+
+func TestConnTransportAndDirection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	hostA, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	hostB, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	require.NoError(t, mn.LinkAll())
+
+	_, err = mn.ConnectPeers(hostA.ID(), hostB.ID())
+	require.NoError(t, err)
+
+	status := func(local, remote host.Host) *protocoltypes.GroupDeviceStatus_Reply_PeerConnected {
+		connected := &protocoltypes.GroupDeviceStatus_Reply_PeerConnected{}
+		setConnsStatus(connected, local.Network().ConnsToPeer(remote.ID()))
+		require.Len(t, connected.Transports, 1)
+
+		return connected
+	}
+
+	// A dialed B, mocknet conns are ip conns
+	statusA, statusB := status(hostA, hostB), status(hostB, hostA)
+	require.Equal(t, protocoltypes.Direction_OutboundDir, statusA.Directions[0])
+	require.Equal(t, protocoltypes.Direction_InboundDir, statusB.Directions[0])
+	require.NotEqual(t, protocoltypes.GroupDeviceStatus_TptProximity, statusA.Transports[0])
+	require.NotEqual(t, protocoltypes.GroupDeviceStatus_TptUnknown, statusA.Transports[0])
+
+	require.Equal(t, protocoltypes.GroupDeviceStatus_TptLAN, connTransport(ma.StringCast("/ip4/192.168.1.2/tcp/4242")))
+	require.Equal(t, protocoltypes.GroupDeviceStatus_TptWAN, connTransport(ma.StringCast("/ip4/1.2.3.4/tcp/4242")))
+
+	// the conn established through the proximity transport is reported as
+	// such, the peer with the smallest id dials
+	driverC := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverD := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverC, driverD)
+
+	hostC := newLinkedProximityHost(ctx, t, driverC)
+	hostD := newLinkedProximityHost(ctx, t, driverD)
+
+	dialer, accepter := hostC, hostD
+	dialerDriver, accepterDriver := driverC, driverD
+	if driverD.LocalPID < driverC.LocalPID {
+		dialer, accepter = hostD, hostC
+		dialerDriver, accepterDriver = driverD, driverC
+	}
+
+	require.True(t, accepterDriver.Transport.HandleFoundPeer(dialerDriver.LocalPID))
+	require.True(t, dialerDriver.Transport.HandleFoundPeer(accepterDriver.LocalPID))
+
+	go driverC.Deliver(ctx)
+	go driverD.Deliver(ctx)
+
+	require.Eventually(t, func() bool {
+		return len(dialer.Network().ConnsToPeer(accepter.ID())) > 0 &&
+			len(accepter.Network().ConnsToPeer(dialer.ID())) > 0
+	}, time.Second*10, time.Millisecond*50)
+
+	dialerStatus, accepterStatus := status(dialer, accepter), status(accepter, dialer)
+	require.Equal(t, protocoltypes.GroupDeviceStatus_TptProximity, dialerStatus.Transports[0])
+	require.Equal(t, protocoltypes.GroupDeviceStatus_TptProximity, accepterStatus.Transports[0])
+	require.Equal(t, protocoltypes.Direction_OutboundDir, dialerStatus.Directions[0])
+	require.Equal(t, protocoltypes.Direction_InboundDir, accepterStatus.Directions[0])
+	require.Equal(t, "/"+dialerDriver.ProtocolName()+"/"+accepter.ID().String(), dialerStatus.Maddrs[0])
+}
+
+func TestGroupSelfInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	config, err := node.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	info, err := node.Client.GroupSelfInfo(ctx, &protocoltypes.GroupSelfInfo_Request{GroupPk: config.AccountGroupPk})
+	require.NoError(t, err)
+
+	require.Equal(t, config.DevicePk, info.DevicePk)
+	require.Equal(t, config.AccountPk, info.MemberPk)
+	require.NotEmpty(t, info.IdentityId)
+	require.NotEmpty(t, info.IdentityPk)
+
+	// the group must be opened
+	_, err = node.Client.GroupSelfInfo(ctx, &protocoltypes.GroupSelfInfo_Request{GroupPk: []byte("unknown")})
+	require.Error(t, err)
+}
+
+func TestServiceListAllGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	config, err := node.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	active, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	inactive, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPk: inactive.GroupPk})
+	require.NoError(t, err)
+
+	list, err := node.Client.ServiceListAllGroups(ctx, &protocoltypes.ServiceListAllGroups_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.Groups, 3)
+
+	// the account group is always listed first
+	require.Equal(t, config.AccountGroupPk, list.Groups[0].GroupPk)
+	require.Equal(t, protocoltypes.GroupType_GroupTypeAccount, list.Groups[0].GroupType)
+	require.True(t, list.Groups[0].Active)
+
+	status := map[string]bool{}
+	for _, entry := range list.Groups[1:] {
+		require.Equal(t, protocoltypes.GroupType_GroupTypeMultiMember, entry.GroupType)
+		status[string(entry.GroupPk)] = entry.Active
+	}
+
+	require.Equal(t, map[string]bool{
+		string(active.GroupPk):   true,
+		string(inactive.GroupPk): false,
+	}, status)
+}
+
+func TestActivateGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	groupPKs := [][]byte{}
+	for i := 0; i < 5; i++ {
+		created, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+		require.NoError(t, err)
+
+		groupPKs = append(groupPKs, created.GroupPk)
+	}
+
+	activeGroups := func() map[string]bool {
+		list, err := node.Client.ServiceListAllGroups(ctx, &protocoltypes.ServiceListAllGroups_Request{})
+		require.NoError(t, err)
+
+		status := map[string]bool{}
+		for _, entry := range list.Groups {
+			status[string(entry.GroupPk)] = entry.Active
+		}
+
+		return status
+	}
+
+	deactivated, err := node.Client.DeactivateGroups(ctx, &protocoltypes.DeactivateGroups_Request{GroupPks: groupPKs})
+	require.NoError(t, err)
+	require.Len(t, deactivated.Results, len(groupPKs))
+
+	status := activeGroups()
+	for i, result := range deactivated.Results {
+		require.Equal(t, groupPKs[i], result.GroupPk)
+		require.Empty(t, result.Error)
+		require.False(t, status[string(groupPKs[i])])
+	}
+
+	// an invalid group doesn't abort the batch
+	activated, err := node.Client.ActivateGroups(ctx, &protocoltypes.ActivateGroups_Request{
+		GroupPks: append(append([][]byte{}, groupPKs...), []byte("invalid")),
+	})
+	require.NoError(t, err)
+	require.Len(t, activated.Results, len(groupPKs)+1)
+	require.NotEmpty(t, activated.Results[len(groupPKs)].Error)
+
+	status = activeGroups()
+	for i, result := range activated.Results[:len(groupPKs)] {
+		require.Equal(t, groupPKs[i], result.GroupPk)
+		require.Empty(t, result.Error)
+		require.True(t, status[string(groupPKs[i])])
+	}
+
+	_, err = node.Client.ActivateGroups(ctx, &protocoltypes.ActivateGroups_Request{})
+	require.Error(t, err)
+}
+
+func TestGroupMetadataListEventTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	group, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.GroupPk})
+	require.NoError(t, err)
+
+	eventTypes := []protocoltypes.EventType{
+		protocoltypes.EventType_EventTypeGroupMemberDeviceAdded,
+		protocoltypes.EventType_EventTypeGroupSignedReceiptsUpdated,
+	}
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	live, err := node.Client.GroupMetadataList(subCtx, &protocoltypes.GroupMetadataList_Request{
+		GroupPk:    group.GroupPk,
+		SinceNow:   true,
+		EventTypes: eventTypes,
+	})
+	require.NoError(t, err)
+
+	_, err = node.Client.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{
+		GroupPk: group.GroupPk,
+		Payload: []byte("app metadata"),
+	})
+	require.NoError(t, err)
+
+	_, err = node.Client.GroupSignedReceiptsSet(ctx, &protocoltypes.GroupSignedReceiptsSet_Request{
+		GroupPk: group.GroupPk,
+		Enabled: true,
+	})
+	require.NoError(t, err)
+
+	// the app metadata sent first is skipped
+	evt, err := live.Recv()
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.EventType_EventTypeGroupSignedReceiptsUpdated, evt.Metadata.EventType)
+
+	// the previous events are filtered as well
+	sub, err := node.Client.GroupMetadataList(ctx, &protocoltypes.GroupMetadataList_Request{
+		GroupPk:    group.GroupPk,
+		UntilNow:   true,
+		EventTypes: eventTypes,
+	})
+	require.NoError(t, err)
+
+	received := map[protocoltypes.EventType]int{}
+	for {
+		evt, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		received[evt.Metadata.EventType]++
+	}
+
+	require.Equal(t, map[protocoltypes.EventType]int{
+		protocoltypes.EventType_EventTypeGroupMemberDeviceAdded:     1,
+		protocoltypes.EventType_EventTypeGroupSignedReceiptsUpdated: 1,
+	}, received)
+}
+
+func TestServiceLeaveGroup(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet:         mocknet.New(),
+		Logger:          logger,
+		ConnectFunc:     ConnectAll,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+	}
+	defer opts.Mocknet.Close()
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	member, node := pts[0], pts[1]
+
+	listTopics := func() map[string]struct{} {
+		topics := map[string]struct{}{}
+		for _, advertise := range listTopicsDetails(ctx, t, node) {
+			topics[advertise.Topic] = struct{}{}
+		}
+
+		return topics
+	}
+
+	before := listTopics()
+
+	group := CreateMultiMemberGroupInstance(ctx, t, member, node)
+
+	require.Eventually(t, func() bool {
+		return len(listTopics()) > len(before)
+	}, time.Second*5, time.Millisecond*100)
+
+	groupTopics := map[string]struct{}{}
+	for topic := range listTopics() {
+		if _, ok := before[topic]; !ok {
+			groupTopics[topic] = struct{}{}
+		}
+	}
+
+	info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	memberGroup, err := member.Service.(*service).GetContextGroupForID(group.PublicKey)
+	require.NoError(t, err)
+
+	hasMember := func() bool {
+		for _, pk := range memberGroup.MetadataStore().ListMembers() {
+			if raw, err := pk.Raw(); err == nil && bytes.Equal(raw, info.MemberPk) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	require.Eventually(t, hasMember, time.Second*10, time.Millisecond*100)
+
+	// contact and account groups can't be left
+	config, err := node.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.ServiceLeaveGroup(ctx, &protocoltypes.ServiceLeaveGroup_Request{GroupPk: config.AccountGroupPk})
+	require.Error(t, err)
+
+	_, err = node.Client.ServiceLeaveGroup(ctx, &protocoltypes.ServiceLeaveGroup_Request{
+		GroupPk:       group.PublicKey,
+		NotifyMembers: true,
+	})
+	require.NoError(t, err)
+
+	list, err := node.Client.ServiceListAllGroups(ctx, &protocoltypes.ServiceListAllGroups_Request{})
+	require.NoError(t, err)
+
+	var entry *protocoltypes.ServiceListAllGroups_GroupEntry
+	for _, g := range list.Groups {
+		if bytes.Equal(g.GroupPk, group.PublicKey) {
+			entry = g
+		}
+	}
+	require.NotNil(t, entry)
+	require.True(t, entry.Left)
+	require.False(t, entry.Active)
+
+	// the group topics are no longer advertised
+	require.Eventually(t, func() bool {
+		for topic := range listTopics() {
+			if _, ok := groupTopics[topic]; ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond*100)
+
+	// the other member drops the member who left
+	require.Eventually(t, func() bool { return !hasMember() }, time.Second*10, time.Millisecond*100)
+
+	memberPK, err := crypto.UnmarshalEd25519PublicKey(info.MemberPk)
+	require.NoError(t, err)
+
+	devices, err := memberGroup.MetadataStore().GetDevicesForMember(memberPK)
+	require.Error(t, err)
+	require.Empty(t, devices)
+
+	// the departure has been announced to the group, its data is kept
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.PublicKey, LocalOnly: true})
+	require.NoError(t, err)
+
+	sub, err := node.Client.GroupMetadataList(ctx, &protocoltypes.GroupMetadataList_Request{
+		GroupPk:  group.PublicKey,
+		UntilNow: true,
+	})
+	require.NoError(t, err)
+
+	memberLeft := false
+	for {
+		evt, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		if evt.Metadata.EventType == protocoltypes.EventType_EventTypeGroupMemberLeft {
+			memberLeft = true
+		}
+	}
+	require.True(t, memberLeft)
+
+	// a group can only be left once
+	_, err = node.Client.ServiceLeaveGroup(ctx, &protocoltypes.ServiceLeaveGroup_Request{GroupPk: group.PublicKey})
+	require.Error(t, err)
+
+	// reading the history of the left group doesn't announce the device again
+	nodeGroup, err := node.Service.(*service).GetContextGroupForID(group.PublicKey)
+	require.NoError(t, err)
+
+	_, err = nodeGroup.MetadataStore().GetMemberByDevice(nodeGroup.DevicePubKey())
+	require.Error(t, err)
+
+	// the member is indexed again once it joins the group again
+	_, err = node.Client.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	_, err = node.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: group})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	require.Eventually(t, hasMember, time.Second*10, time.Millisecond*100)
+}
+
+func TestGroupGetRawLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	created, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	// each message is written on top of the previous one
+	sent := [][]byte{}
+	for i := 0; i < 3; i++ {
+		reply, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte("test"),
+		})
+		require.NoError(t, err)
+
+		sent = append(sent, reply.Cid)
+	}
+
+	listRawLog := func(includePayload bool) map[string]*protocoltypes.GroupGetRawLog_Reply {
+		sub, err := node.Client.GroupGetRawLog(ctx, &protocoltypes.GroupGetRawLog_Request{
+			GroupPk:        created.GroupPk,
+			IncludePayload: includePayload,
+		})
+		require.NoError(t, err)
+
+		entries := map[string]*protocoltypes.GroupGetRawLog_Reply{}
+		for {
+			entry, err := sub.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			entries[string(entry.Cid)] = entry
+		}
+
+		return entries
+	}
+
+	entries := listRawLog(false)
+	require.Len(t, entries, len(sent))
+
+	for i, id := range sent {
+		entry, ok := entries[string(id)]
+		require.True(t, ok)
+
+		require.NotEmpty(t, entry.LogId)
+		require.NotEmpty(t, entry.ClockId)
+		require.NotEmpty(t, entry.Sig)
+		require.NotEmpty(t, entry.IdentityPk)
+		require.Empty(t, entry.Payload)
+
+		if i == 0 {
+			require.Empty(t, entry.NextCids)
+		} else {
+			require.Equal(t, [][]byte{sent[i-1]}, entry.NextCids)
+			require.Greater(t, entry.ClockTime, entries[string(sent[i-1])].ClockTime)
+		}
+	}
+
+	for _, entry := range listRawLog(true) {
+		require.NotEmpty(t, entry.Payload)
+	}
+
+	// the group must be opened
+	sub, err := node.Client.GroupGetRawLog(ctx, &protocoltypes.GroupGetRawLog_Request{GroupPk: []byte("unknown")})
+	require.NoError(t, err)
+	_, err = sub.Recv()
+	require.Error(t, err)
+}
+
+func TestGroupListConnectedPeers(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet:     mocknet.New(),
+		Logger:      logger,
+		ConnectFunc: ConnectAll,
+	}
+	defer opts.Mocknet.Close()
+
+	// the third node is connected but isn't a member of the group
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 3)
+	defer cleanup()
+
+	group := CreateMultiMemberGroupInstance(ctx, t, pts[0], pts[1])
+
+	for i, j := range []int{1, 0} {
+		node, other := pts[i], pts[j]
+
+		info, err := other.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			reply, err := node.Client.GroupListConnectedPeers(ctx, &protocoltypes.GroupListConnectedPeers_Request{GroupPk: group.PublicKey})
+			require.NoError(t, err)
+
+			for _, p := range reply.Peers {
+				require.NotEqual(t, pts[2].IpfsCoreAPI.ID().String(), p.PeerId)
+			}
+
+			return len(reply.Peers) == 1 &&
+				reply.Peers[0].PeerId == other.IpfsCoreAPI.ID().String() &&
+				bytes.Equal(reply.Peers[0].DevicePk, info.DevicePk) &&
+				bytes.Equal(reply.Peers[0].MemberPk, info.MemberPk)
+		}, time.Second*10, time.Millisecond*100)
+	}
+
+	// the peers aren't listed once disconnected
+	require.NoError(t, opts.Mocknet.UnlinkPeers(pts[0].IpfsCoreAPI.ID(), pts[1].IpfsCoreAPI.ID()))
+	require.NoError(t, opts.Mocknet.DisconnectPeers(pts[0].IpfsCoreAPI.ID(), pts[1].IpfsCoreAPI.ID()))
+
+	require.Eventually(t, func() bool {
+		reply, err := pts[0].Client.GroupListConnectedPeers(ctx, &protocoltypes.GroupListConnectedPeers_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+
+		return len(reply.Peers) == 0
+	}, time.Second*10, time.Millisecond*100)
+}
@@ -21,6 +21,14 @@ func (s *service) MultiMemberGroupCreate(ctx context.Context, _ *protocoltypes.M
 		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
 	}
 
+	// the group is activated once joined, it must not be opened once the
+	// groups have been deactivated by the shutdown
+	var done func()
+	if ctx, done, err = s.beginWrite(ctx); err != nil {
+		return nil, err
+	}
+	defer done()
+
 	accountGroup := s.getAccountGroup()
 	if accountGroup == nil {
 		return nil, errcode.ErrCode_ErrGroupMissing
@@ -55,7 +63,8 @@ func (s *service) MultiMemberGroupCreate(ctx context.Context, _ *protocoltypes.M
 	}, nil
 }
 
-// MultiMemberGroupJoin joins an existing MultiMember group using an invitation
+// MultiMemberGroupJoin joins an existing MultiMember group using an invitation,
+// the invitation must come from a contact if Opts.ContactInvitationsOnly is set
 func (s *service) MultiMemberGroupJoin(ctx context.Context, req *protocoltypes.MultiMemberGroupJoin_Request) (_ *protocoltypes.MultiMemberGroupJoin_Reply, err error) {
 	ctx, _, endSection := tyber.Section(ctx, s.logger, "Joining MultiMember group")
 	defer func() { endSection(err, "") }()
@@ -65,6 +74,12 @@ func (s *service) MultiMemberGroupJoin(ctx context.Context, req *protocoltypes.M
 		return nil, errcode.ErrCode_ErrGroupMissing
 	}
 
+	if s.contactInvitationsOnly {
+		if err := checkGroupInvitation(accountGroup, req); err != nil {
+			return nil, err
+		}
+	}
+
 	if _, err := accountGroup.MetadataStore().GroupJoin(ctx, req.Group); err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
@@ -82,18 +97,8 @@ func (s *service) MultiMemberGroupLeave(ctx context.Context, req *protocoltypes.
 		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
-	accountGroup := s.getAccountGroup()
-	if accountGroup == nil {
-		return nil, errcode.ErrCode_ErrGroupMissing
-	}
-
-	_, err = accountGroup.MetadataStore().GroupLeave(ctx, pk)
-	if err != nil {
-		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
-	}
-
-	if err := s.deactivateGroup(pk); err != nil {
-		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	if err := s.leaveGroup(ctx, pk, false); err != nil {
+		return nil, err
 	}
 
 	return &protocoltypes.MultiMemberGroupLeave_Reply{}, nil
@@ -119,6 +124,31 @@ func (s *service) MultiMemberGroupAdminRoleGrant(context.Context, *protocoltypes
 	return nil, errcode.ErrCode_ErrNotImplemented
 }
 
+// MultiMemberGroupRekey rotates the epoch key of a MultiMember group
+func (s *service) MultiMemberGroupRekey(ctx context.Context, req *protocoltypes.MultiMemberGroupRekey_Request) (_ *protocoltypes.MultiMemberGroupRekey_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Rekeying MultiMember group")
+	defer func() { endSection(err, "") }()
+
+	cg, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	epoch, err := cg.MetadataStore().MultiMemberGroupRekey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeGroupRekeyed,
+		GroupPk:   req.GroupPk,
+	})
+
+	return &protocoltypes.MultiMemberGroupRekey_Reply{
+		Epoch: epoch,
+	}, nil
+}
+
 // MultiMemberGroupInvitationCreate creates a group invitation
 func (s *service) MultiMemberGroupInvitationCreate(_ context.Context, req *protocoltypes.MultiMemberGroupInvitationCreate_Request) (*protocoltypes.MultiMemberGroupInvitationCreate_Reply, error) {
 	cg, err := s.GetContextGroupForID(req.GroupPk)
@@ -126,7 +156,19 @@ func (s *service) MultiMemberGroupInvitationCreate(_ context.Context, req *proto
 		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
 	}
 
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	inviterPK, inviterSig, err := signGroupInvitation(accountGroup, cg.Group().PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return &protocoltypes.MultiMemberGroupInvitationCreate_Reply{
-		Group: cg.Group(),
+		Group:      cg.Group(),
+		InviterPk:  inviterPK,
+		InviterSig: inviterSig,
 	}, nil
 }
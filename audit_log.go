@@ -0,0 +1,264 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// auditLog is a local append-only log of the security relevant operations
+// made on the account. Entries only reference the keys involved in the
+// operation, they never contain any payload and are never sent to other peers.
+// The recorded entries are also emitted, see Subscribe.
+type auditLog struct {
+	ds     datastore.Batching
+	logger *zap.Logger
+	seq    uint64
+	mu     sync.Mutex
+	subs   map[*auditLogSubscription]struct{}
+	subsMu sync.Mutex
+}
+
+// auditLogSubscriptionBufSize is the number of entries buffered for a
+// subscriber, the next ones are dropped until the subscriber catches up
+const auditLogSubscriptionBufSize = 32
+
+// auditLogSubscription receives the entries recorded in the audit log, a
+// slow subscriber misses entries instead of blocking the operations recorded
+type auditLogSubscription struct {
+	log       *auditLog
+	out       chan interface{}
+	closeOnce sync.Once
+}
+
+var _ event.Subscription = (*auditLogSubscription)(nil)
+
+func (s *auditLogSubscription) Out() <-chan interface{} { return s.out }
+
+func (s *auditLogSubscription) Name() string { return "weshnet/audit-log" }
+
+func (s *auditLogSubscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.log.subsMu.Lock()
+		delete(s.log.subs, s)
+		close(s.out)
+		s.log.subsMu.Unlock()
+	})
+
+	return nil
+}
+
+func newAuditLog(ctx context.Context, ds datastore.Batching, logger *zap.Logger) (*auditLog, error) {
+	l := &auditLog{
+		ds:     ds,
+		logger: logger,
+		subs:   make(map[*auditLogSubscription]struct{}),
+	}
+
+	// resume the sequence after the last recorded entry
+	results, err := ds.Query(ctx, query.Query{
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Limit:    1,
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(res.Error)
+		}
+
+		if l.seq, err = strconv.ParseUint(datastore.RawKey(res.Key).BaseNamespace(), 10, 64); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+	}
+
+	return l, nil
+}
+
+func auditLogKey(seq uint64) datastore.Key {
+	// keys are padded so they are sorted in the recording order
+	return datastore.NewKey(fmt.Sprintf("%020d", seq))
+}
+
+// Record appends an entry to the log. Failures are only logged as they must
+// not prevent the operation from being made.
+func (l *auditLog) Record(ctx context.Context, entry *protocoltypes.AuditLogEntry) {
+	if l == nil {
+		return
+	}
+
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		l.logger.Warn("unable to marshal audit log entry", zap.Error(err))
+		return
+	}
+
+	l.mu.Lock()
+	err = l.ds.Put(ctx, auditLogKey(l.seq+1), data)
+	if err == nil {
+		l.seq++
+	}
+	l.mu.Unlock()
+
+	if err != nil {
+		l.logger.Warn("unable to record audit log entry", zap.String("type", entry.EventType.String()), zap.Error(err))
+		return
+	}
+
+	l.emit(entry)
+}
+
+// emit sends an entry to the subscribers without waiting for them, the
+// concurrently recorded entries may be emitted out of order
+func (l *auditLog) emit(entry *protocoltypes.AuditLogEntry) {
+	l.subsMu.Lock()
+	defer l.subsMu.Unlock()
+
+	for sub := range l.subs {
+		select {
+		case sub.out <- entry:
+		default:
+			l.logger.Warn("audit log subscriber is too slow, entry dropped", zap.String("type", entry.EventType.String()))
+		}
+	}
+}
+
+// Subscribe returns a subscription to the entries recorded from now on, the
+// entries are dropped while its buffer is full
+func (l *auditLog) Subscribe() (event.Subscription, error) {
+	if l == nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("audit log isn't available"))
+	}
+
+	sub := &auditLogSubscription{
+		log: l,
+		out: make(chan interface{}, auditLogSubscriptionBufSize),
+	}
+
+	l.subsMu.Lock()
+	l.subs[sub] = struct{}{}
+	l.subsMu.Unlock()
+
+	return sub, nil
+}
+
+// List returns the entries recorded at or after the given unix timestamp,
+// from the oldest to the newest
+func (l *auditLog) List(ctx context.Context, since int64) ([]*protocoltypes.AuditLogEntry, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	results, err := l.ds.Query(ctx, query.Query{
+		Orders: []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	entries := []*protocoltypes.AuditLogEntry{}
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(res.Error)
+		}
+
+		entry := &protocoltypes.AuditLogEntry{}
+		if err := proto.Unmarshal(res.Value, entry); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if entry.Timestamp >= since {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// startLinkedDevicesMonitor records the devices added to the account group
+// after the service has started. The current device is recorded as well if it
+// has just been linked to an existing account.
+func (s *service) startLinkedDevicesMonitor() {
+	metadataStore := s.accountGroupCtx.metadataStore
+
+	if s.accountGroupCtx.deviceAdded && len(metadataStore.ListDevices()) > 1 {
+		s.odb.auditLog.Record(s.ctx, &protocoltypes.AuditLogEntry{
+			EventType: protocoltypes.AuditEventType_AuditEventTypeDeviceLinked,
+			GroupPk:   s.accountGroupCtx.Group().PublicKey,
+			DevicePk:  metadataStore.devicePublicKeyRaw,
+		})
+	}
+
+	sub, err := metadataStore.EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent),
+		eventbus.Name("weshnet/service/monitor-linked-devices"))
+	if err != nil {
+		s.logger.Warn("unable to subscribe to account group metadata events", zap.Error(err))
+		return
+	}
+
+	known := map[string]struct{}{
+		string(metadataStore.devicePublicKeyRaw): {},
+	}
+	for _, device := range metadataStore.ListDevices() {
+		if raw, err := device.Raw(); err == nil {
+			known[string(raw)] = struct{}{}
+		}
+	}
+
+	go func() {
+		defer sub.Close()
+
+		for {
+			var e interface{}
+
+			select {
+			case e = <-sub.Out():
+			case <-s.ctx.Done():
+				return
+			}
+
+			evt := e.(*protocoltypes.GroupMetadataEvent)
+			if evt.GetMetadata().GetEventType() != protocoltypes.EventType_EventTypeGroupMemberDeviceAdded {
+				continue
+			}
+
+			added := &protocoltypes.GroupMemberDeviceAdded{}
+			if err := proto.Unmarshal(evt.Event, added); err != nil {
+				s.logger.Warn("unable to unmarshal device added event", zap.Error(err))
+				continue
+			}
+
+			if _, ok := known[string(added.DevicePk)]; ok {
+				continue
+			}
+			known[string(added.DevicePk)] = struct{}{}
+
+			s.odb.auditLog.Record(s.ctx, &protocoltypes.AuditLogEntry{
+				EventType: protocoltypes.AuditEventType_AuditEventTypeDeviceLinked,
+				GroupPk:   evt.GetEventContext().GetGroupPk(),
+				DevicePk:  added.DevicePk,
+			})
+		}
+	}()
+}
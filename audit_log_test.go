@@ -0,0 +1,244 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/pubsub/pubsubraw"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestAuditLogAppend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := dsync.MutexWrap(ds.NewMapDatastore())
+
+	log, err := newAuditLog(ctx, store, zap.NewNop())
+	require.NoError(t, err)
+
+	log.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeAccountExported,
+		Timestamp: 10,
+	})
+	log.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeContactRequestAccepted,
+		ContactPk: []byte("contact"),
+		Timestamp: 20,
+	})
+
+	// entries recorded by a previous instance are kept
+	log, err = newAuditLog(ctx, store, zap.NewNop())
+	require.NoError(t, err)
+
+	log.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeGroupRekeyed,
+		GroupPk:   []byte("group"),
+	})
+
+	entries, err := log.List(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, protocoltypes.AuditEventType_AuditEventTypeAccountExported, entries[0].EventType)
+	require.Equal(t, protocoltypes.AuditEventType_AuditEventTypeContactRequestAccepted, entries[1].EventType)
+	require.Equal(t, []byte("contact"), entries[1].ContactPk)
+	require.Equal(t, protocoltypes.AuditEventType_AuditEventTypeGroupRekeyed, entries[2].EventType)
+	require.NotZero(t, entries[2].Timestamp)
+
+	entries, err = log.List(ctx, 20)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, protocoltypes.AuditEventType_AuditEventTypeContactRequestAccepted, entries[0].EventType)
+}
+
+func TestAuditLogSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log, err := newAuditLog(ctx, dsync.MutexWrap(ds.NewMapDatastore()), zap.NewNop())
+	require.NoError(t, err)
+
+	// entries recorded before subscribing are not emitted
+	log.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeAccountExported,
+	})
+
+	sub, err := log.Subscribe()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	log.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeDeviceLinked,
+		DevicePk:  []byte("device"),
+	})
+
+	select {
+	case e := <-sub.Out():
+		entry := e.(*protocoltypes.AuditLogEntry)
+		require.Equal(t, protocoltypes.AuditEventType_AuditEventTypeDeviceLinked, entry.EventType)
+		require.Equal(t, []byte("device"), entry.DevicePk)
+		require.NotZero(t, entry.Timestamp)
+	case <-time.After(time.Second):
+		require.FailNow(t, "entry should have been emitted")
+	}
+
+	select {
+	case e := <-sub.Out():
+		require.FailNow(t, "unexpected entry", e)
+	default:
+	}
+}
+
+func TestAuditLogSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log, err := newAuditLog(ctx, dsync.MutexWrap(ds.NewMapDatastore()), zap.NewNop())
+	require.NoError(t, err)
+
+	sub, err := log.Subscribe()
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// the entries are recorded even if the subscriber doesn't read them
+	for i := 0; i < auditLogSubscriptionBufSize*2; i++ {
+		log.Record(ctx, &protocoltypes.AuditLogEntry{
+			EventType: protocoltypes.AuditEventType_AuditEventTypeDeviceLinked,
+		})
+	}
+
+	entries, err := log.List(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, auditLogSubscriptionBufSize*2)
+
+	// the entries emitted while the buffer was full are dropped
+	require.Len(t, sub.Out(), auditLogSubscriptionBufSize)
+
+	require.NoError(t, sub.Close())
+	require.NoError(t, sub.Close())
+}
+
+func TestAuditLogExportAndDeviceLink(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+
+	nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		Logger:          logger.Named("A"),
+	}, nil)
+	defer closeNodeA()
+
+	auditLogEntries := func(node *TestingProtocol, eventType protocoltypes.AuditEventType) []*protocoltypes.AuditLogEntry {
+		reply, err := node.Client.ServiceGetAuditLog(ctx, &protocoltypes.ServiceGetAuditLog_Request{})
+		require.NoError(t, err)
+
+		entries := []*protocoltypes.AuditLogEntry{}
+		for _, entry := range reply.Entries {
+			if entry.EventType == eventType {
+				entries = append(entries, entry)
+			}
+		}
+
+		return entries
+	}
+
+	require.Empty(t, auditLogEntries(nodeA, protocoltypes.AuditEventType_AuditEventTypeAccountExported))
+
+	export := &bytes.Buffer{}
+	require.NoError(t, nodeA.Service.(*service).export(ctx, export, exportOptions{}))
+	require.Len(t, auditLogEntries(nodeA, protocoltypes.AuditEventType_AuditEventTypeAccountExported), 1)
+
+	// link a new device to the account by restoring the export
+	dsB := dsync.MutexWrap(ds.NewMapDatastore())
+	secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+	require.NoError(t, err)
+
+	ipfsNodeB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+		Mocknet:   mn,
+		Datastore: dsB,
+	})
+
+	odb, err := NewWeshOrbitDB(ctx, ipfsNodeB.API(), &NewOrbitDBOptions{
+		NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+			PubSub: pubsubraw.NewPubSub(ipfsNodeB.PubSub(), ipfsNodeB.MockNode().PeerHost.ID(), logger, nil),
+			Logger: logger,
+		},
+		Datastore:   dsB,
+		SecretStore: secretStoreB,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, RestoreAccountExport(ctx, export, ipfsNodeB.API(), odb, logger))
+
+	nodeB, closeNodeB := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		Logger:          logger.Named("B"),
+		SecretStore:     secretStoreB,
+		CoreAPIMock:     ipfsNodeB,
+		OrbitDB:         odb,
+	}, dsB)
+	defer closeNodeB()
+
+	require.Len(t, auditLogEntries(nodeB, protocoltypes.AuditEventType_AuditEventTypeAccountRestored), 1)
+
+	configB, err := nodeB.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	// the new device records its own link to the account
+	linked := auditLogEntries(nodeB, protocoltypes.AuditEventType_AuditEventTypeDeviceLinked)
+	require.Len(t, linked, 1)
+	require.Equal(t, configB.DevicePk, linked[0].DevicePk)
+	require.Equal(t, configB.AccountGroupPk, linked[0].GroupPk)
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	sub, err := nodeA.Client.ServiceSubscribeAuditLog(subCtx, &protocoltypes.ServiceSubscribeAuditLog_Request{
+		EventTypes: []protocoltypes.AuditEventType{protocoltypes.AuditEventType_AuditEventTypeDeviceLinked},
+	})
+	require.NoError(t, err)
+
+	ConnectAll(t, mn)
+
+	// the first device is notified once the new device is added to the
+	// account group
+	require.Eventually(t, func() bool {
+		return len(auditLogEntries(nodeA, protocoltypes.AuditEventType_AuditEventTypeDeviceLinked)) > 0
+	}, time.Second*30, time.Millisecond*100)
+
+	linked = auditLogEntries(nodeA, protocoltypes.AuditEventType_AuditEventTypeDeviceLinked)
+	require.Len(t, linked, 1)
+	require.Equal(t, configB.DevicePk, linked[0].DevicePk)
+	require.Equal(t, configB.AccountGroupPk, linked[0].GroupPk)
+
+	// the entry is streamed to the subscribers as well
+	entry, err := sub.Recv()
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.AuditEventType_AuditEventTypeDeviceLinked, entry.EventType)
+	require.Equal(t, configB.DevicePk, entry.DevicePk)
+}
@@ -81,6 +81,24 @@ func (m *ConnectednessManager) UpdateState(peer peer.ID, update ConnectednessTyp
 	}
 }
 
+// GroupPeers returns the peers associated to a group
+func (m *ConnectednessManager) GroupPeers(gkey string) []peer.ID {
+	m.muState.Lock()
+	defer m.muState.Unlock()
+
+	sg, ok := m.groupState[gkey]
+	if !ok {
+		return nil
+	}
+
+	peers := make([]peer.ID, 0, len(sg.peers))
+	for p := range sg.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
+
 // WaitForConnectednessChange wait until the given `current` peers status differ from `local` peers state
 func (m *ConnectednessManager) WaitForConnectednessChange(ctx context.Context, gkey string, current PeersConnectedness) ([]peer.ID, bool) {
 	m.muState.Lock()
@@ -5,9 +5,16 @@ import (
 )
 
 const (
-	NamespaceOrbitDBDatastore = "orbitdb_datastore"
-	NamespaceOrbitDBDirectory = "orbitdb"
-	NamespaceIPFSDatastore    = "ipfs_datastore"
+	NamespaceOrbitDBDatastore  = "orbitdb_datastore"
+	NamespaceOrbitDBDirectory  = "orbitdb"
+	NamespaceIPFSDatastore     = "ipfs_datastore"
+	NamespaceAuditLog          = "audit_log"
+	NamespaceMessagePins       = "message_pins"
+	NamespaceReadMarkers       = "read_markers"
+	NamespaceRestoreCheckpoint = "restore_checkpoint"
+	NamespaceGroupStoreDirs    = "group_store_dirs"
+	NamespaceGroupTopics       = "group_topics"
+	NamespaceContactQRTokens   = "contact_qr_tokens"
 )
 
 var InMemoryDirectory = cacheleveldown.InMemoryDirectory
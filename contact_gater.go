@@ -0,0 +1,39 @@
+package weshnet
+
+import (
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/contactgater"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+// contactGaterKeys returns the keys proving that a peer is a device of the
+// account or of an added contact, respectively the secret of the account
+// group and the ones of the contact groups
+func contactGaterKeys(accountGroup *GroupContext, secretStore secretstore.SecretStore) contactgater.KeysFunc {
+	return func() ([]contactgater.Key, error) {
+		accountPK, err := accountGroup.MemberPubKey().Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		keys := []contactgater.Key{{ContactPK: accountPK, Secret: accountGroup.Group().Secret}}
+		for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+			contactPK, err := crypto.UnmarshalEd25519PublicKey(contact.Pk)
+			if err != nil {
+				return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+			}
+
+			group, err := secretStore.GetGroupForContact(contactPK)
+			if err != nil {
+				return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			keys = append(keys, contactgater.Key{ContactPK: contact.Pk, Secret: group.Secret})
+		}
+
+		return keys, nil
+	}
+}
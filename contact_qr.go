@@ -0,0 +1,159 @@
+package weshnet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+const (
+	// contactQRMaxTokenSize is the maximum size of the one-time token of a
+	// contact QR payload, the payload must stay small enough to be scanned
+	contactQRMaxTokenSize = 64
+
+	// contactQRMaxPayloadSize is the maximum size of a scanned payload
+	contactQRMaxPayloadSize = 512
+
+	// contactQRSigPrefix is prepended to the contact signed by the account,
+	// so the signature can't be mistaken for another one made with the
+	// account key
+	contactQRSigPrefix = "weshnet/contact-qr:"
+)
+
+func contactQRSignedData(contact []byte) []byte {
+	return append([]byte(contactQRSigPrefix), contact...)
+}
+
+// encodeContactQRPayload returns the Protobuf encoding of a ContactQRPayload
+// for the account of device, signed by its member key
+func encodeContactQRPayload(device secretstore.OwnMemberDevice, rdvSeed []byte, token []byte) ([]byte, error) {
+	if len(rdvSeed) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no public rendezvous seed"))
+	}
+
+	if len(token) > contactQRMaxTokenSize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("token is %d bytes, max is %d", len(token), contactQRMaxTokenSize))
+	}
+
+	accountPK, err := device.Member().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	contact, err := proto.Marshal(&protocoltypes.ContactQRPayload_Contact{
+		Pk:                   accountPK,
+		PublicRendezvousSeed: rdvSeed,
+		Token:                token,
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	sig, err := device.MemberSign(contactQRSignedData(contact))
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	payload, err := proto.Marshal(&protocoltypes.ContactQRPayload{
+		Contact: contact,
+		Sig:     sig,
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return payload, nil
+}
+
+// decodeContactQRPayload decodes a payload returned by
+// encodeContactQRPayload, it returns the contact and its token once the
+// signature has been verified with the account key of the contact
+func decodeContactQRPayload(payload []byte) (*protocoltypes.ShareableContact, []byte, error) {
+	if len(payload) == 0 || len(payload) > contactQRMaxPayloadSize {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid payload size %d", len(payload)))
+	}
+
+	signed := &protocoltypes.ContactQRPayload{}
+	if err := proto.Unmarshal(payload, signed); err != nil {
+		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	contact := &protocoltypes.ContactQRPayload_Contact{}
+	if err := proto.Unmarshal(signed.Contact, contact); err != nil {
+		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountPK, err := crypto.UnmarshalEd25519PublicKey(contact.Pk)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := accountPK.Verify(contactQRSignedData(signed.Contact), signed.Sig); err != nil || !ok {
+		return nil, nil, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid contact signature"))
+	}
+
+	if len(contact.PublicRendezvousSeed) == 0 {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no public rendezvous seed"))
+	}
+
+	if len(contact.Token) > contactQRMaxTokenSize {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("token is %d bytes, max is %d", len(contact.Token), contactQRMaxTokenSize))
+	}
+
+	return &protocoltypes.ShareableContact{
+		Pk:                   contact.Pk,
+		PublicRendezvousSeed: contact.PublicRendezvousSeed,
+	}, contact.Token, nil
+}
+
+// contactQRTokens holds the one-time tokens of the decoded contact QR
+// payloads, they are kept in the datastore so a payload can't be replayed
+// after a restart
+type contactQRTokens struct {
+	ds datastore.Batching
+	mu sync.Mutex
+}
+
+func newContactQRTokens(ds datastore.Batching) *contactQRTokens {
+	return &contactQRTokens{ds: ds}
+}
+
+func contactQRTokenKey(accountPK []byte, token []byte) datastore.Key {
+	// the tokens are hashed to keep the keys short
+	sum := sha256.Sum256(token)
+	return datastore.NewKey(hex.EncodeToString(accountPK)).ChildString(hex.EncodeToString(sum[:]))
+}
+
+// Consume marks the token of an account as used, an error is returned if it
+// has already been consumed
+func (t *contactQRTokens) Consume(ctx context.Context, accountPK []byte, token []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := contactQRTokenKey(accountPK, token)
+
+	has, err := t.ds.Has(ctx, key)
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if has {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("token has already been used"))
+	}
+
+	if err := t.ds.Put(ctx, key, []byte{}); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
@@ -12,9 +12,11 @@ import (
 
 	ipfscid "github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
@@ -29,6 +31,11 @@ import (
 
 const contactRequestV1 = "/wesh/contact_req/1.0.0"
 
+const (
+	contactRequestRetryMinBackoff = time.Second
+	contactRequestRetryMaxBackoff = time.Minute
+)
+
 type contactRequestsManager struct {
 	muManager sync.Mutex
 
@@ -42,6 +49,9 @@ type contactRequestsManager struct {
 	logger *zap.Logger
 
 	enabled bool
+	// retry keeps retrying to send the outgoing requests, see
+	// Opts.ContactRequestRetry
+	retry bool
 
 	ownRendezvousSeed []byte
 	accountPrivateKey crypto.PrivKey
@@ -49,9 +59,13 @@ type contactRequestsManager struct {
 	ipfs          ipfsutil.ExtendedCoreAPI
 	swiper        *Swiper
 	metadataStore *MetadataStore
+
+	// tracer emits the spans of the connections to the contacts, see
+	// Opts.TracerProvider
+	tracer trace.Tracer
 }
 
-func newContactRequestsManager(s *Swiper, store *MetadataStore, ipfs ipfsutil.ExtendedCoreAPI, logger *zap.Logger) (*contactRequestsManager, error) {
+func newContactRequestsManager(s *Swiper, store *MetadataStore, ipfs ipfsutil.ExtendedCoreAPI, logger *zap.Logger, tracer trace.Tracer, retry bool) (*contactRequestsManager, error) {
 	accountPrivateKey, err := store.secretStore.GetAccountPrivateKey()
 	if err != nil {
 		return nil, err
@@ -68,6 +82,8 @@ func newContactRequestsManager(s *Swiper, store *MetadataStore, ipfs ipfsutil.Ex
 		ctx:               ctx,
 		cancel:            cancel,
 		swiper:            s,
+		retry:             retry,
+		tracer:            tracer,
 	}
 
 	go cm.metadataWatcher(ctx)
@@ -108,6 +124,7 @@ func (c *contactRequestsManager) metadataWatcher(ctx context.Context) {
 		protocoltypes.EventType_EventTypeAccountContactRequestEnabled:          c.metadataRequestEnabled,
 		protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset:   c.metadataRequestReset,
 		protocoltypes.EventType_EventTypeAccountContactRequestOutgoingEnqueued: c.metadataRequestEnqueued,
+		protocoltypes.EventType_EventTypeAccountContactRequestOutgoingCanceled: c.metadataRequestCanceled,
 
 		// @FIXME: looks like we don't need those events
 		protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent:     c.metadataRequestSent,
@@ -295,6 +312,17 @@ func (c *contactRequestsManager) metadataRequestSent(_ context.Context, evt *pro
 	return nil
 }
 
+func (c *contactRequestsManager) metadataRequestCanceled(_ context.Context, evt *protocoltypes.GroupMetadataEvent) error {
+	e := &protocoltypes.AccountContactRequestOutgoingCanceled{}
+	if err := proto.Unmarshal(evt.Event, e); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the request has been retracted, stop looking for the contact
+	c.cancelContactLookup(e.ContactPk)
+	return nil
+}
+
 func (c *contactRequestsManager) metadataRequestReceived(_ context.Context, evt *protocoltypes.GroupMetadataEvent) error {
 	e := &protocoltypes.AccountContactRequestIncomingReceived{}
 	if err := proto.Unmarshal(evt.Event, e); err != nil {
@@ -388,6 +416,14 @@ func (c *contactRequestsManager) enqueueRequest(ctx context.Context, to *protoco
 	cpeers := c.swiper.WatchTopic(ctx, to.Pk, to.PublicRendezvousSeed)
 	go func() {
 		var err error
+		if c.retry {
+			err = c.sendContactRequestWithRetry(ctx, to, otherPK, cpeers)
+
+			c.cancelContactLookup(to.Pk)
+			endSection(err, "")
+			return
+		}
+
 		for peer := range cpeers {
 			// get our sharable contact to send to other contact
 			if err = c.SendContactRequest(ctx, to, otherPK, peer); err != nil {
@@ -411,6 +447,94 @@ func (c *contactRequestsManager) enqueueRequest(ctx context.Context, to *protoco
 	return nil
 }
 
+// sendContactRequestWithRetry sends the contact request to the peers found
+// for the contact, the peers which failed to receive it are retried with an
+// exponential backoff each time they are connected, until the request is sent
+// or the lookup is canceled
+func (c *contactRequestsManager) sendContactRequestWithRetry(ctx context.Context, to *protocoltypes.ShareableContact, otherPK crypto.PubKey, cpeers <-chan peer.AddrInfo) error {
+	sub, err := c.ipfs.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged),
+		eventbus.Name("weshnet/rqmngr/contact-request-retry"))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to connectedness events: %w", err)
+	}
+	defer sub.Close()
+
+	var (
+		candidates  = map[peer.ID]peer.AddrInfo{}
+		backoff     = contactRequestRetryMinBackoff
+		nextAttempt time.Time
+		retry       <-chan time.Time
+	)
+
+	// send tries to send the request to the given peer, the next attempt is
+	// delayed on failure
+	send := func(p peer.AddrInfo) bool {
+		if wait := time.Until(nextAttempt); wait > 0 {
+			if retry == nil {
+				retry = time.After(wait)
+			}
+			return false
+		}
+
+		if err := c.SendContactRequest(ctx, to, otherPK, p); err != nil {
+			c.logger.Warn("unable to send contact request, retrying once the peer is connected", zap.Error(err), zap.Duration("backoff", backoff))
+
+			nextAttempt = time.Now().Add(backoff)
+			if backoff *= 2; backoff > contactRequestRetryMaxBackoff {
+				backoff = contactRequestRetryMaxBackoff
+			}
+
+			return false
+		}
+
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case p, ok := <-cpeers:
+			if !ok {
+				cpeers = nil
+				continue
+			}
+
+			candidates[p.ID] = p
+			if send(p) {
+				return nil
+			}
+
+		case e := <-sub.Out():
+			evt := e.(event.EvtPeerConnectednessChanged)
+			p, ok := candidates[evt.Peer]
+			if !ok || evt.Connectedness != network.Connected {
+				continue
+			}
+
+			if send(p) {
+				return nil
+			}
+
+		case <-retry:
+			retry = nil
+
+			// only the connected peers are retried, the others are retried
+			// once connected
+			for _, p := range candidates {
+				if c.ipfs.Network().Connectedness(p.ID) != network.Connected {
+					continue
+				}
+
+				if send(p) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
 // SendContactRequest try to perform contact request with the given remote peer
 func (c *contactRequestsManager) SendContactRequest(ctx context.Context, to *protocoltypes.ShareableContact, otherPK crypto.PubKey, peer peer.AddrInfo) (err error) {
 	ctx, _, endSection := tyber.Section(ctx, c.logger, "sending contact request")
@@ -433,7 +557,10 @@ func (c *contactRequestsManager) SendContactRequest(ctx context.Context, to *pro
 	own.Metadata = ownMetadata
 
 	// make sure to have connection with the remote peer
-	if err := c.ipfs.Swarm().Connect(ctx, peer); err != nil {
+	connectCtx, span := c.tracer.Start(ctx, "Connect", trace.WithAttributes(tracePeerID(peer.ID)))
+	err = c.ipfs.Swarm().Connect(connectCtx, peer)
+	endSpan(span, err)
+	if err != nil {
 		return fmt.Errorf("unable to connect: %w", err)
 	}
 
@@ -1,11 +1,14 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
+	crand "crypto/rand"
 	"io"
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -13,6 +16,7 @@ import (
 
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
 )
 
 func TestContactRequestFlow(t *testing.T) {
@@ -232,3 +236,179 @@ func TestContactRequestFlowWithoutIncoming(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestContactRequestCancelPending(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*20)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet: mocknet.New(),
+		Logger:  logger,
+	}
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 1)
+	defer cleanup()
+
+	// the contact is never online, so the request stays pending
+	_, contactPK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	contactPKBytes, err := contactPK.Raw()
+	require.NoError(t, err)
+
+	rdvSeed := make([]byte, 32)
+	_, err = crand.Read(rdvSeed)
+	require.NoError(t, err)
+
+	_, err = pts[0].Client.ContactRequestSend(ctx, &protocoltypes.ContactRequestSend_Request{
+		Contact: &protocoltypes.ShareableContact{
+			Pk:                   contactPKBytes,
+			PublicRendezvousSeed: rdvSeed,
+		},
+	})
+	require.NoError(t, err)
+
+	pending, err := pts[0].Client.ListPendingContactRequests(ctx, &protocoltypes.ListPendingContactRequests_Request{})
+	require.NoError(t, err)
+	require.Len(t, pending.Contacts, 1)
+	require.Equal(t, contactPKBytes, pending.Contacts[0].Pk)
+	require.Equal(t, rdvSeed, pending.Contacts[0].PublicRendezvousSeed)
+
+	_, err = pts[0].Client.CancelContactRequest(ctx, &protocoltypes.CancelContactRequest_Request{
+		ContactPk: contactPKBytes,
+	})
+	require.NoError(t, err)
+
+	pending, err = pts[0].Client.ListPendingContactRequests(ctx, &protocoltypes.ListPendingContactRequests_Request{})
+	require.NoError(t, err)
+	require.Empty(t, pending.Contacts)
+
+	// the request is no longer pending, it can't be canceled twice
+	_, err = pts[0].Client.CancelContactRequest(ctx, &protocoltypes.CancelContactRequest_Request{
+		ContactPk: contactPKBytes,
+	})
+	require.Error(t, err)
+
+	// a new request can be sent once canceled
+	_, err = pts[0].Client.ContactRequestSend(ctx, &protocoltypes.ContactRequestSend_Request{
+		Contact: &protocoltypes.ShareableContact{
+			Pk:                   contactPKBytes,
+			PublicRendezvousSeed: rdvSeed,
+		},
+	})
+	require.NoError(t, err)
+
+	pending, err = pts[0].Client.ListPendingContactRequests(ctx, &protocoltypes.ListPendingContactRequests_Request{})
+	require.NoError(t, err)
+	require.Len(t, pending.Contacts, 1)
+
+	// a request already sent can be canceled too
+	metadataStore := pts[0].Service.(*service).getAccountGroup().MetadataStore()
+	_, err = metadataStore.ContactRequestOutgoingSent(ctx, contactPK)
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.ContactState_ContactStateAdded, metadataStore.getContactStatus(contactPK))
+
+	_, err = pts[0].Client.CancelContactRequest(ctx, &protocoltypes.CancelContactRequest_Request{
+		ContactPk: contactPKBytes,
+	})
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.ContactState_ContactStateUndefined, metadataStore.getContactStatus(contactPK))
+
+	// a cancellation doesn't create an unknown contact
+	_, otherPK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	_, err = metadataStore.contactAction(ctx, otherPK, &protocoltypes.AccountContactRequestOutgoingCanceled{}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingCanceled)
+	require.NoError(t, err)
+
+	_, err = metadataStore.Index().(*metadataStoreIndex).getContact(otherPK)
+	require.Error(t, err)
+}
+
+func TestContactRequestRetry(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+	discoveryServer := tinder.NewMockDriverServer()
+
+	pt0, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{
+		Logger:          logger.Named("mock0"),
+		Mocknet:         mn,
+		DiscoveryServer: discoveryServer,
+	}, nil)
+	defer cleanup()
+
+	pt1, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{
+		Logger:              logger.Named("mock1"),
+		Mocknet:             mn,
+		DiscoveryServer:     discoveryServer,
+		ContactRequestRetry: true,
+	}, nil)
+	defer cleanup()
+
+	_, err := pt0.Client.ContactRequestEnable(ctx, &protocoltypes.ContactRequestEnable_Request{})
+	require.NoError(t, err)
+
+	config0, err := pt0.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	config1, err := pt1.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	ref0, err := pt0.Client.ContactRequestResetReference(ctx, &protocoltypes.ContactRequestResetReference_Request{})
+	require.NoError(t, err)
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	subMeta0, err := pt0.Client.GroupMetadataList(subCtx, &protocoltypes.GroupMetadataList_Request{
+		GroupPk: config0.AccountGroupPk,
+	})
+	require.NoError(t, err)
+
+	// the peers aren't linked yet, the target is found but can't be reached
+	_, err = pt1.Client.ContactRequestSend(ctx, &protocoltypes.ContactRequestSend_Request{
+		Contact: &protocoltypes.ShareableContact{
+			Pk:                   config0.AccountPk,
+			PublicRendezvousSeed: ref0.PublicRendezvousSeed,
+		},
+	})
+	require.NoError(t, err)
+
+	time.Sleep(time.Second * 2)
+
+	pending, err := pt1.Client.ListPendingContactRequests(ctx, &protocoltypes.ListPendingContactRequests_Request{})
+	require.NoError(t, err)
+	require.Len(t, pending.Contacts, 1)
+
+	// the target comes online, the request is sent once connected
+	ConnectAll(t, mn)
+
+	found := false
+	for !found {
+		evt, err := subMeta0.Recv()
+		if err == io.EOF || subMeta0.Context().Err() != nil {
+			break
+		}
+		require.NoError(t, err)
+
+		if evt == nil || evt.Metadata.EventType != protocoltypes.EventType_EventTypeAccountContactRequestIncomingReceived {
+			continue
+		}
+
+		req := &protocoltypes.AccountContactRequestIncomingReceived{}
+		require.NoError(t, proto.Unmarshal(evt.Event, req))
+		found = bytes.Equal(config1.AccountPk, req.ContactPk)
+	}
+	subCancel()
+
+	require.True(t, found)
+}
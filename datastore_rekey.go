@@ -0,0 +1,341 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+
+	encrepo "berty.tech/go-ipfs-repo-encrypted"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// rootDatastoreFilename is the encrypted database of the root datastore
+	// in its directory, see GetRootDatastoreForPath
+	rootDatastoreFilename = "datastore.sqlite"
+
+	// rootDatastoreRekeySuffix is appended to the database filename while it
+	// is being copied under a new key
+	rootDatastoreRekeySuffix = ".rekey"
+
+	// rekeyBatchSize is the number of entries written per transaction while
+	// copying the datastore
+	rekeyBatchSize = 1000
+)
+
+// sqliteSideFileSuffixes are the suffixes of the files sqlite keeps next to a
+// database while it is open
+var sqliteSideFileSuffixes = []string{"-wal", "-shm", "-journal"}
+
+func openSQLCipherDatastore(dbPath string, key []byte, salt []byte) (datastore.Batching, error) {
+	sqldsOpts := encrepo.SQLCipherDatastoreOptions{JournalMode: "WAL", PlaintextHeader: len(salt) != 0, Salt: salt}
+	ds, err := encrepo.NewSQLCipherDatastore("sqlite3", dbPath, "blocks", key, sqldsOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// ServiceRekeyStorage requests the rekey of the root datastore, it is
+// applied by RekeyRootDatastore once the service is closed and the datastore
+// released, see rekeyReleasedDatastore
+func (s *service) ServiceRekeyStorage(ctx context.Context, req *protocoltypes.ServiceRekeyStorage_Request) (*protocoltypes.ServiceRekeyStorage_Reply, error) {
+	if len(s.datastoreKey) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the root datastore hasn't been opened by the service with a key"))
+	}
+
+	if subtle.ConstantTimeCompare(req.OldKey, s.datastoreKey) != 1 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the old key doesn't match the key of the root datastore"))
+	}
+
+	if len(req.NewKey) == 0 || bytes.Equal(req.OldKey, req.NewKey) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the new key must be set and differ from the previous one"))
+	}
+
+	s.muPendingDatastoreKey.Lock()
+	s.pendingDatastoreKey = append([]byte{}, req.NewKey...)
+	s.muPendingDatastoreKey.Unlock()
+
+	s.logger.Info("root datastore rekey requested, it will be applied once the service is closed")
+
+	return &protocoltypes.ServiceRekeyStorage_Reply{}, nil
+}
+
+// rekeyReleasedDatastore rekeys the root datastore with the key requested by
+// ServiceRekeyStorage, if any, it must only be called once the datastore has
+// been released
+func (s *service) rekeyReleasedDatastore(ctx context.Context) error {
+	s.muPendingDatastoreKey.Lock()
+	newKey := s.pendingDatastoreKey
+	s.pendingDatastoreKey = nil
+	s.muPendingDatastoreKey.Unlock()
+
+	if newKey == nil {
+		return nil
+	}
+
+	return RekeyRootDatastore(ctx, s.datastoreDir, s.datastoreKey, newKey, s.datastoreSalt, s.logger)
+}
+
+// RekeyRootDatastore re-encrypts the root datastore stored in dir, as opened
+// by GetRootDatastoreForPath, with newKey. The datastore must be closed, the
+// side files left next to it by a process interrupted while it was opened
+// are replayed first.
+//
+// The entries are copied from the database opened with oldKey to a new
+// database encrypted with newKey, the decrypted values are only kept in
+// memory. The new database replaces the previous one with an atomic rename
+// once the copy has been checked, so an interrupted rekey leaves a datastore
+// readable with either oldKey or newKey. The partial copy left by an
+// interruption is discarded by the next rekey, which returns right away if
+// the datastore has already been replaced.
+func RekeyRootDatastore(ctx context.Context, dir string, oldKey, newKey, salt []byte, logger *zap.Logger) error {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if dir == InMemoryDir {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an in-memory datastore can't be rekeyed"))
+	}
+
+	if len(newKey) == 0 || bytes.Equal(oldKey, newKey) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the new key must be set and differ from the previous one"))
+	}
+
+	dbPath := filepath.Join(dir, rootDatastoreFilename)
+	rekeyPath := dbPath + rootDatastoreRekeySuffix
+
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no datastore in %s", dir))
+	} else if err != nil {
+		return errcode.ErrCode_ErrDBOpen.Wrap(err)
+	}
+
+	currentKey, err := recoverRootDatastore(ctx, dbPath, oldKey, newKey, salt)
+	if err != nil {
+		return err
+	}
+
+	// discard the copy of an interrupted rekey
+	if err := removeSQLiteDatabase(rekeyPath); err != nil {
+		return errcode.ErrCode_ErrDBDestroy.Wrap(err)
+	}
+
+	if bytes.Equal(currentKey, newKey) {
+		logger.Info("root datastore already rekeyed")
+		return nil
+	}
+
+	count, err := copyDatastoreWithKey(ctx, dbPath, rekeyPath, oldKey, newKey, salt)
+	if err != nil {
+		_ = removeSQLiteDatabase(rekeyPath)
+		return err
+	}
+
+	if err := checkRekeyedDatastore(ctx, rekeyPath, newKey, salt, count); err != nil {
+		_ = removeSQLiteDatabase(rekeyPath)
+		return err
+	}
+
+	if err := syncPath(rekeyPath); err != nil {
+		_ = removeSQLiteDatabase(rekeyPath)
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := os.Rename(rekeyPath, dbPath); err != nil {
+		_ = removeSQLiteDatabase(rekeyPath)
+		return errcode.ErrCode_ErrDBWrite.Wrap(fmt.Errorf("unable to replace the datastore: %w", err))
+	}
+
+	// persist the rename
+	if err := syncPath(dir); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	logger.Info("root datastore rekeyed", zap.Int("entries", count))
+
+	return nil
+}
+
+// recoverRootDatastore opens the database at dbPath with oldKey, or with
+// newKey if an interrupted rekey has already replaced it, and closes it
+// cleanly, so the side files left by an interrupted process are replayed and
+// removed by sqlite. It returns the key of the database.
+func recoverRootDatastore(ctx context.Context, dbPath string, oldKey, newKey, salt []byte) ([]byte, error) {
+	for _, key := range [][]byte{oldKey, newKey} {
+		if err := checkSQLCipherDatastore(ctx, dbPath, key, salt); err != nil {
+			continue
+		}
+
+		// sqlite keeps the side files as long as another connection is opened
+		if sideFile, ok := sqliteSideFile(dbPath); ok {
+			return nil, errcode.ErrCode_ErrDBOpen.Wrap(fmt.Errorf("the datastore is still open, found %s", sideFile))
+		}
+
+		return key, nil
+	}
+
+	return nil, errcode.ErrCode_ErrDBOpen.Wrap(fmt.Errorf("the datastore can't be read with either key"))
+}
+
+// checkSQLCipherDatastore ensures the database at dbPath can be read with
+// key, it is closed before returning
+func checkSQLCipherDatastore(ctx context.Context, dbPath string, key, salt []byte) (err error) {
+	ds, err := openSQLCipherDatastore(dbPath, key, salt)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := ds.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	results, err := ds.Query(ctx, query.Query{KeysOnly: true, Limit: 1})
+	if err != nil {
+		return err
+	}
+
+	_, err = results.Rest()
+	return err
+}
+
+// copyDatastoreWithKey copies all the entries of the database at src,
+// encrypted with srcKey, to a new database at dst encrypted with dstKey, it
+// returns the number of copied entries
+func copyDatastoreWithKey(ctx context.Context, src, dst string, srcKey, dstKey, salt []byte) (count int, err error) {
+	srcDS, err := openSQLCipherDatastore(src, srcKey, salt)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBOpen.Wrap(err)
+	}
+	defer func() {
+		if cerr := srcDS.Close(); cerr != nil && err == nil {
+			err = errcode.ErrCode_ErrDBClose.Wrap(cerr)
+		}
+	}()
+
+	dstDS, err := openSQLCipherDatastore(dst, dstKey, salt)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBOpen.Wrap(err)
+	}
+	defer func() {
+		if cerr := dstDS.Close(); cerr != nil && err == nil {
+			err = errcode.ErrCode_ErrDBClose.Wrap(cerr)
+		}
+	}()
+
+	results, err := srcDS.Query(ctx, query.Query{})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	batch, err := dstDS.Batch(ctx)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	pending := 0
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		if err := batch.Put(ctx, datastore.NewKey(result.Key), result.Value); err != nil {
+			return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		count++
+		pending++
+
+		if pending < rekeyBatchSize {
+			continue
+		}
+
+		if err := batch.Commit(ctx); err != nil {
+			return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if batch, err = dstDS.Batch(ctx); err != nil {
+			return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+		pending = 0
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return count, nil
+}
+
+// checkRekeyedDatastore ensures the database at path can be read with key
+// and holds the expected number of entries
+func checkRekeyedDatastore(ctx context.Context, path string, key, salt []byte, expected int) (err error) {
+	rekeyed, err := openSQLCipherDatastore(path, key, salt)
+	if err != nil {
+		return errcode.ErrCode_ErrDBOpen.Wrap(err)
+	}
+	defer func() {
+		if cerr := rekeyed.Close(); cerr != nil && err == nil {
+			err = errcode.ErrCode_ErrDBClose.Wrap(cerr)
+		}
+	}()
+
+	results, err := rekeyed.Query(ctx, query.Query{KeysOnly: true})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if len(entries) != expected {
+		return errcode.ErrCode_ErrDBRead.Wrap(fmt.Errorf("rekeyed datastore has %d entries instead of %d", len(entries), expected))
+	}
+
+	return nil
+}
+
+func sqliteSideFile(dbPath string) (string, bool) {
+	for _, suffix := range sqliteSideFileSuffixes {
+		if _, err := os.Stat(dbPath + suffix); err == nil {
+			return dbPath + suffix, true
+		}
+	}
+
+	return "", false
+}
+
+// removeSQLiteDatabase removes a database and its side files if they exist
+func removeSQLiteDatabase(dbPath string) error {
+	for _, suffix := range append([]string{""}, sqliteSideFileSuffixes...) {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncPath flushes a file or a directory to the disk
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
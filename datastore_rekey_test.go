@@ -0,0 +1,178 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestRekeyRootDatastore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	oldKey := []byte("42424242424242424242424242424242")
+	newKey := []byte("24242424242424242424242424242424")
+	salt := []byte("2121212121212121")
+
+	// more entries than a single copy transaction
+	const entries = rekeyBatchSize + 10
+
+	rootDS, err := GetRootDatastoreForPath(dir, oldKey, salt, zap.NewNop())
+	require.NoError(t, err)
+
+	for i := 0; i < entries; i++ {
+		require.NoError(t, rootDS.Put(ctx, ds.NewKey(fmt.Sprintf("/entries/%d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+
+	// the datastore must be closed
+	err = RekeyRootDatastore(ctx, dir, oldKey, newKey, salt, zap.NewNop())
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrDBOpen))
+
+	require.NoError(t, rootDS.Close())
+
+	// the copy left by an interrupted rekey is discarded
+	require.NoError(t, os.WriteFile(filepath.Join(dir, rootDatastoreFilename+rootDatastoreRekeySuffix), []byte("partial copy"), 0o600))
+
+	err = RekeyRootDatastore(ctx, dir, oldKey, oldKey, salt, zap.NewNop())
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	require.NoError(t, RekeyRootDatastore(ctx, dir, oldKey, newKey, salt, zap.NewNop()))
+
+	_, err = os.Stat(filepath.Join(dir, rootDatastoreFilename+rootDatastoreRekeySuffix))
+	require.True(t, os.IsNotExist(err))
+
+	// the previous key can't read the datastore anymore
+	require.False(t, readableWithKey(ctx, dir, oldKey, salt))
+
+	rootDS, err = GetRootDatastoreForPath(dir, newKey, salt, zap.NewNop())
+	require.NoError(t, err)
+	defer rootDS.Close()
+
+	for i := 0; i < entries; i++ {
+		value, err := rootDS.Get(ctx, ds.NewKey(fmt.Sprintf("/entries/%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value %d", i), string(value))
+	}
+}
+
+func TestRekeyRootDatastoreRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, crashedDir := t.TempDir(), t.TempDir()
+	oldKey := []byte("42424242424242424242424242424242")
+	newKey := []byte("24242424242424242424242424242424")
+	salt := []byte("2121212121212121")
+
+	const entries = 100
+
+	rootDS, err := GetRootDatastoreForPath(dir, oldKey, salt, zap.NewNop())
+	require.NoError(t, err)
+
+	for i := 0; i < entries; i++ {
+		require.NoError(t, rootDS.Put(ctx, ds.NewKey(fmt.Sprintf("/entries/%d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+
+	// copy the files of the opened datastore, as left by an interrupted
+	// process, the entries are still in the WAL
+	for _, suffix := range append([]string{""}, sqliteSideFileSuffixes...) {
+		data, err := os.ReadFile(filepath.Join(dir, rootDatastoreFilename+suffix))
+		if os.IsNotExist(err) {
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(crashedDir, rootDatastoreFilename+suffix), data, 0o600))
+	}
+	require.NoError(t, rootDS.Close())
+
+	_, hasSideFile := sqliteSideFile(filepath.Join(crashedDir, rootDatastoreFilename))
+	require.True(t, hasSideFile)
+
+	require.NoError(t, RekeyRootDatastore(ctx, crashedDir, oldKey, newKey, salt, zap.NewNop()))
+
+	_, hasSideFile = sqliteSideFile(filepath.Join(crashedDir, rootDatastoreFilename))
+	require.False(t, hasSideFile)
+
+	// the rekey is done once the datastore has been replaced
+	require.NoError(t, RekeyRootDatastore(ctx, crashedDir, oldKey, newKey, salt, zap.NewNop()))
+
+	require.False(t, readableWithKey(ctx, crashedDir, oldKey, salt))
+
+	rootDS, err = GetRootDatastoreForPath(crashedDir, newKey, salt, zap.NewNop())
+	require.NoError(t, err)
+	defer rootDS.Close()
+
+	for i := 0; i < entries; i++ {
+		value, err := rootDS.Get(ctx, ds.NewKey(fmt.Sprintf("/entries/%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value %d", i), string(value))
+	}
+}
+
+func TestServiceRekeyStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	oldKey := []byte("42424242424242424242424242424242")
+	newKey := []byte("24242424242424242424242424242424")
+	salt := []byte("2121212121212121")
+
+	opts := &Opts{DatastoreDir: dir, DatastoreKey: oldKey, DatastoreSalt: salt, Logger: zap.NewNop()}
+	require.NoError(t, opts.applyDefaultsGetDatastore())
+	require.NoError(t, opts.RootDatastore.Put(ctx, ds.NewKey("/entries/0"), []byte("value 0")))
+
+	s := &service{
+		logger:        zap.NewNop(),
+		close:         opts.close,
+		datastoreDir:  dir,
+		datastoreKey:  opts.rootDatastoreKey,
+		datastoreSalt: opts.DatastoreSalt,
+	}
+
+	// the current key must be given
+	_, err := s.ServiceRekeyStorage(ctx, &protocoltypes.ServiceRekeyStorage_Request{OldKey: newKey, NewKey: newKey})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	_, err = s.ServiceRekeyStorage(ctx, &protocoltypes.ServiceRekeyStorage_Request{OldKey: oldKey})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	_, err = s.ServiceRekeyStorage(ctx, &protocoltypes.ServiceRekeyStorage_Request{OldKey: oldKey, NewKey: newKey})
+	require.NoError(t, err)
+
+	// the datastore is rekeyed once released
+	require.True(t, readableWithKey(ctx, dir, oldKey, salt))
+
+	require.NoError(t, s.close())
+	require.NoError(t, s.rekeyReleasedDatastore(ctx))
+
+	require.False(t, readableWithKey(ctx, dir, oldKey, salt))
+	require.True(t, readableWithKey(ctx, dir, newKey, salt))
+
+	// the root datastore can't be rekeyed if it hasn't been opened by the
+	// service with a key
+	s = &service{logger: zap.NewNop(), datastoreDir: dir}
+	_, err = s.ServiceRekeyStorage(ctx, &protocoltypes.ServiceRekeyStorage_Request{OldKey: oldKey, NewKey: newKey})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+}
+
+func readableWithKey(ctx context.Context, dir string, key, salt []byte) bool {
+	rootDS, err := GetRootDatastoreForPath(dir, key, salt, zap.NewNop())
+	if err != nil {
+		return false
+	}
+	defer rootDS.Close()
+
+	_, err = rootDS.Get(ctx, ds.NewKey("/entries/0"))
+	return err == nil
+}
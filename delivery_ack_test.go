@@ -0,0 +1,282 @@
+package weshnet_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+// enableDeliveryAcks enables the delivery acknowledgements of the group and
+// waits for all the nodes to know it
+func enableDeliveryAcks(ctx context.Context, t *testing.T, groupPK []byte, nodes ...*weshnet.TestingProtocol) {
+	t.Helper()
+
+	_, err := nodes[0].Client.GroupDeliveryAcksSet(ctx, &protocoltypes.GroupDeliveryAcksSet_Request{
+		GroupPk: groupPK,
+		Enabled: true,
+	})
+	require.NoError(t, err)
+
+	for _, node := range nodes {
+		require.Eventually(t, func() bool {
+			info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: groupPK})
+			require.NoError(t, err)
+			return info.DeliveryAcks
+		}, time.Second*30, time.Millisecond*100)
+	}
+}
+
+// hasGroupEvent returns true if the node has received the message or the
+// metadata event of the group with the given id
+func hasGroupEvent(ctx context.Context, t *testing.T, node *weshnet.TestingProtocol, groupPK []byte, id []byte) bool {
+	t.Helper()
+
+	messages, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{GroupPk: groupPK, UntilNow: true})
+	require.NoError(t, err)
+
+	for {
+		evt, err := messages.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		if bytes.Equal(evt.EventContext.Id, id) {
+			return true
+		}
+	}
+
+	metadata, err := node.Client.GroupMetadataList(ctx, &protocoltypes.GroupMetadataList_Request{GroupPk: groupPK, UntilNow: true})
+	require.NoError(t, err)
+
+	for {
+		evt, err := metadata.Recv()
+		if err == io.EOF {
+			return false
+		}
+		require.NoError(t, err)
+
+		if bytes.Equal(evt.EventContext.Id, id) {
+			return true
+		}
+	}
+}
+
+func TestGroupMessageDeliveryStatus(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: msrv,
+		ConnectFunc:     weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 3)
+	defer cleanup()
+
+	// this node doesn't acknowledge the messages it receives
+	privateNode, privateCleanup := weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+		Mocknet:             mn,
+		Logger:              logger.Named("private"),
+		DiscoveryServer:     msrv,
+		DisableDeliveryAcks: true,
+	}, nil)
+	defer privateCleanup()
+
+	weshnet.ConnectAll(t, mn)
+
+	allNodes := append(nodes, privateNode)
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, allNodes...)
+
+	// the delivery acknowledgements are disabled by default
+	silentGroup := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+	for _, node := range nodes {
+		info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: silentGroup.PublicKey})
+		require.NoError(t, err)
+		require.False(t, info.DeliveryAcks)
+	}
+
+	silentSent, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: silentGroup.PublicKey,
+		Payload: []byte("test"),
+	})
+	require.NoError(t, err)
+
+	enableDeliveryAcks(ctx, t, group.PublicKey, allNodes...)
+
+	sent, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("test"),
+	})
+	require.NoError(t, err)
+
+	expectedDevices := [][]byte{}
+	for _, node := range nodes[1:] {
+		info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+
+		expectedDevices = append(expectedDevices, info.DevicePk)
+	}
+
+	getStatus := func() *protocoltypes.GroupMessageDeliveryStatus_Reply {
+		status, err := nodes[0].Client.GroupMessageDeliveryStatus(ctx, &protocoltypes.GroupMessageDeliveryStatus_Request{
+			GroupPk:   group.PublicKey,
+			MessageId: sent.Cid,
+		})
+		require.NoError(t, err)
+		return status
+	}
+
+	// the delivery count must only increase as the other nodes ack the message
+	lastCount := int64(0)
+	require.Eventually(t, func() bool {
+		status := getStatus()
+		require.GreaterOrEqual(t, status.AckedDevices, lastCount)
+		lastCount = status.AckedDevices
+		return status.AckedDevices == int64(len(expectedDevices))
+	}, time.Second*30, time.Millisecond*100)
+
+	status := getStatus()
+	require.ElementsMatch(t, expectedDevices, status.DevicePks)
+	require.Equal(t, int64(len(allNodes)-1), status.TotalDevices)
+
+	// the private node has received the message but must not ack it, an ack
+	// sent once the message received would be replicated along with the
+	// metadata it sends afterward
+	require.Eventually(t, func() bool {
+		return hasGroupEvent(ctx, t, privateNode, group.PublicKey, sent.Cid)
+	}, time.Second*30, time.Millisecond*100)
+
+	barrier, err := privateNode.Client.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("barrier"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return hasGroupEvent(ctx, t, nodes[0], group.PublicKey, barrier.Cid)
+	}, time.Second*30, time.Millisecond*100)
+
+	require.Equal(t, int64(len(expectedDevices)), getStatus().AckedDevices)
+
+	// nor are the messages of the group without delivery acknowledgements
+	silentStatus, err := nodes[0].Client.GroupMessageDeliveryStatus(ctx, &protocoltypes.GroupMessageDeliveryStatus_Request{
+		GroupPk:   silentGroup.PublicKey,
+		MessageId: silentSent.Cid,
+	})
+	require.NoError(t, err)
+	require.Zero(t, silentStatus.AckedDevices)
+	require.Equal(t, int64(len(nodes)-1), silentStatus.TotalDevices)
+}
+
+func TestGroupMessageDeliverySignedReceipts(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:     mn,
+		Logger:      logger,
+		ConnectFunc: weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+	enableDeliveryAcks(ctx, t, group.PublicKey, nodes...)
+
+	receiverInfo, err := nodes[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+	require.False(t, receiverInfo.SignedReceipts)
+
+	waitForAck := func(messageID []byte) *protocoltypes.GroupMessageDeliveryStatus_Reply {
+		var status *protocoltypes.GroupMessageDeliveryStatus_Reply
+		require.Eventually(t, func() bool {
+			var err error
+			status, err = nodes[0].Client.GroupMessageDeliveryStatus(ctx, &protocoltypes.GroupMessageDeliveryStatus_Request{
+				GroupPk:   group.PublicKey,
+				MessageId: messageID,
+			})
+			require.NoError(t, err)
+			return status.AckedDevices == 1
+		}, time.Second*30, time.Millisecond*100)
+
+		return status
+	}
+
+	// the receipts are not signed by default
+	sent, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("unsigned"),
+	})
+	require.NoError(t, err)
+	require.Empty(t, waitForAck(sent.Cid).Receipts)
+
+	_, err = nodes[0].Client.GroupSignedReceiptsSet(ctx, &protocoltypes.GroupSignedReceiptsSet_Request{
+		GroupPk: group.PublicKey,
+		Enabled: true,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		info, err := nodes[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+		return info.SignedReceipts
+	}, time.Second*30, time.Millisecond*100)
+
+	sent, err = nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("signed"),
+	})
+	require.NoError(t, err)
+
+	status := waitForAck(sent.Cid)
+	require.Len(t, status.Receipts, 1)
+
+	receipt := status.Receipts[0]
+	require.Equal(t, receiverInfo.DevicePk, receipt.DevicePk)
+
+	// the receipt is a signature of the prefixed message cid by the receiving
+	// device
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(receipt.DevicePk)
+	require.NoError(t, err)
+
+	ok, err := devicePK.Verify(append([]byte("weshnet/delivery-receipt:"), sent.Cid...), receipt.Signature)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = devicePK.Verify(sent.Cid, receipt.Signature)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
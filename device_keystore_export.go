@@ -0,0 +1,210 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+const (
+	exportDeviceKeystoreSaltFilename = "device_keystore.salt"
+	exportDeviceKeystoreKeysFilename = "device_keystore.keys"
+
+	// exportDeviceChainKeyPrefix prefixes the chain keys of the device in the
+	// encrypted keys, they are kept apart from the private keys
+	exportDeviceChainKeyPrefix = "chain_key/"
+
+	// maxDeviceKeystoreExportEntrySize is large enough for the encrypted keys
+	// of a device which has joined many groups
+	maxDeviceKeystoreExportEntrySize = 4 * 1024 * 1024
+)
+
+// ExportDeviceKeystore writes the keys of the current device, encrypted
+// using a key derived from the passphrase. Unlike ExportIdentity it contains
+// the device keys along the account keys, and the chain keys of the device
+// with their counters, an instance importing them using ImportDeviceKeystore
+// becomes the same device rather than a new device of the account. The
+// current instance must not be used anymore once the keystore has been
+// imported elsewhere.
+func (s *service) ExportDeviceKeystore(ctx context.Context, output io.Writer, passphrase []byte) (err error) {
+	ctx, span := s.tracer.Start(ctx, "ExportDeviceKeystore")
+	defer func() { endSpan(span, err) }()
+
+	if len(passphrase) == 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	deviceKeys, err := s.secretStore.ExportDeviceKeystore()
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	chainKeys, err := s.secretStore.ExportOwnChainKeys(ctx)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	keys := new(bytes.Buffer)
+	ktw := tar.NewWriter(keys)
+	for name, key := range deviceKeys {
+		if err := exportPrivateKey(ktw, key, name); err != nil {
+			return err
+		}
+	}
+
+	for i, chainKey := range chainKeys {
+		data, err := proto.Marshal(chainKey)
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if err := exportPrivateKey(ktw, data, fmt.Sprintf("%s%d", exportDeviceChainKeyPrefix, i)); err != nil {
+			return err
+		}
+	}
+
+	if err := ktw.Close(); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	key, salt, err := cryptoutil.DeriveKey(passphrase, nil)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedKeys, err := cryptoutil.AESGCMEncrypt(key, keys.Bytes())
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	tw := tar.NewWriter(output)
+	defer tw.Close()
+
+	if err := exportPrivateKey(tw, salt, exportDeviceKeystoreSaltFilename); err != nil {
+		return err
+	}
+
+	if err := exportPrivateKey(tw, encryptedKeys, exportDeviceKeystoreKeysFilename); err != nil {
+		return err
+	}
+
+	s.odb.auditLog.Record(ctx, &protocoltypes.AuditLogEntry{
+		EventType: protocoltypes.AuditEventType_AuditEventTypeDeviceKeystoreExported,
+	})
+
+	return nil
+}
+
+// ImportDeviceKeystore imports the keys of a device from an export written by
+// ExportDeviceKeystore into an unused secret store, along with its chain keys
+// so the other members can still open its messages. Neither the groups nor
+// the messages are imported, they are synced from the other peers once the
+// service is started.
+func ImportDeviceKeystore(ctx context.Context, reader io.Reader, passphrase []byte, secretStore secretstore.SecretStore, logger *zap.Logger) error {
+	if len(passphrase) == 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	files := map[string][]byte{}
+
+	tr := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return errcode.ErrCode_ErrDBRestore.Wrap(err)
+		}
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		switch header.Name {
+		case exportDeviceKeystoreSaltFilename, exportDeviceKeystoreKeysFilename:
+		default:
+			logger.Warn("unknown device keystore export entry", zap.String("filename", header.Name))
+			continue
+		}
+
+		if header.Size > maxDeviceKeystoreExportEntrySize {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device keystore export entry is too large"))
+		}
+
+		if files[header.Name], err = readExportSecretKeyFile(header.Size, tr); err != nil {
+			return err
+		}
+	}
+
+	salt, encryptedKeys := files[exportDeviceKeystoreSaltFilename], files[exportDeviceKeystoreKeysFilename]
+	if salt == nil || encryptedKeys == nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing device keystore export entries"))
+	}
+
+	key, _, err := cryptoutil.DeriveKey(passphrase, salt)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	keys, err := cryptoutil.AESGCMDecrypt(key, encryptedKeys)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	deviceKeys := map[string][]byte{}
+	chainKeys := []*protocoltypes.DeviceChainKeyExport(nil)
+
+	ktr := tar.NewReader(bytes.NewReader(keys))
+	for {
+		header, err := ktr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if strings.HasPrefix(header.Name, exportDeviceChainKeyPrefix) {
+			data, err := readExportSecretKeyFile(header.Size, ktr)
+			if err != nil {
+				return err
+			}
+
+			chainKey := &protocoltypes.DeviceChainKeyExport{}
+			if err := proto.Unmarshal(data, chainKey); err != nil {
+				return errcode.ErrCode_ErrDeserialization.Wrap(err)
+			}
+
+			chainKeys = append(chainKeys, chainKey)
+			continue
+		}
+
+		if deviceKeys[header.Name] != nil {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("multiple keys found in archive"))
+		}
+
+		if deviceKeys[header.Name], err = readExportSecretKeyFile(header.Size, ktr); err != nil {
+			return err
+		}
+	}
+
+	if err := secretStore.ImportDeviceKeystore(deviceKeys); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if err := secretStore.ImportOwnChainKeys(ctx, chainKeys); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestExportImportDeviceKeystore(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	passphrase := []byte("device keystore passphrase")
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+
+	newNode := func(name string, secretStore secretstore.SecretStore, ds datastore.Batching) (*TestingProtocol, func()) {
+		return NewTestingProtocol(ctx, t, &TestingOpts{
+			Logger:          logger.Named(name),
+			Mocknet:         mn,
+			DiscoveryServer: msrv,
+			SecretStore:     secretStore,
+		}, ds)
+	}
+
+	nodeA, closeNodeA := newNode("a", nil, nil)
+	nodeC, closeNodeC := newNode("c", nil, nil)
+	defer closeNodeC()
+
+	ConnectAll(t, mn)
+
+	configA, err := nodeA.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	group := CreateMultiMemberGroupInstance(ctx, t, nodeA, nodeC)
+
+	infoA, err := nodeA.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	hasMessage := func(node *TestingProtocol, payload []byte) bool {
+		sub, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  group.PublicKey,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		found := false
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				return found
+			}
+			require.NoError(t, err)
+
+			found = found || bytes.Equal(evt.Message, payload)
+		}
+	}
+
+	// the device has already used its chain key before being exported
+	_, err = nodeA.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("before export"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return hasMessage(nodeC, []byte("before export"))
+	}, time.Second*30, time.Millisecond*100)
+
+	// a passphrase is required
+	require.Error(t, nodeA.Service.ExportDeviceKeystore(ctx, new(bytes.Buffer), nil))
+
+	export := new(bytes.Buffer)
+	require.NoError(t, nodeA.Service.ExportDeviceKeystore(ctx, export, passphrase))
+
+	// the exported instance must not be used anymore
+	closeNodeA()
+
+	dsB := dsync.MutexWrap(datastore.NewMapDatastore())
+	secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+	require.NoError(t, err)
+
+	// a wrong passphrase must not import anything
+	err = ImportDeviceKeystore(ctx, bytes.NewReader(export.Bytes()), []byte("wrong passphrase"), secretStoreB, logger)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt))
+
+	require.NoError(t, ImportDeviceKeystore(ctx, bytes.NewReader(export.Bytes()), passphrase, secretStoreB, logger))
+
+	// the keys can't be imported twice
+	require.Error(t, ImportDeviceKeystore(ctx, bytes.NewReader(export.Bytes()), passphrase, secretStoreB, logger))
+
+	// the imported instance signs with the same device key in the group
+	memberDeviceB, err := secretStoreB.GetOwnMemberDeviceForGroup(infoA.Group)
+	require.NoError(t, err)
+
+	payload := []byte("payload")
+	sig, err := memberDeviceB.DeviceSign(payload)
+	require.NoError(t, err)
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(infoA.DevicePk)
+	require.NoError(t, err)
+
+	ok, err := devicePK.Verify(payload, sig)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	nodeB, closeNodeB := newNode("b", secretStoreB, dsB)
+	defer closeNodeB()
+
+	configB, err := nodeB.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+	require.Equal(t, configA.AccountPk, configB.AccountPk)
+	require.Equal(t, configA.AccountGroupPk, configB.AccountGroupPk)
+	require.Equal(t, configA.DevicePk, configB.DevicePk)
+
+	ConnectAll(t, mn)
+
+	_, err = nodeB.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: group})
+	require.NoError(t, err)
+
+	_, err = nodeB.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	// the imported device keeps sealing its messages with the chain key the
+	// other members already know, from where the exported device stopped
+	_, err = nodeB.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("after import"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return hasMessage(nodeC, []byte("after import"))
+	}, time.Second*30, time.Millisecond*100)
+}
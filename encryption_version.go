@@ -0,0 +1,53 @@
+package weshnet
+
+import (
+	"sync/atomic"
+
+	"berty.tech/weshnet/v2/internal/capabilities"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+// groupEncryption picks the encryption version of the new group entries. The
+// version bound to the group is only used once it has been negotiated with
+// every connected peer, the older peers couldn't open the entries otherwise.
+type groupEncryption struct {
+	capabilities atomic.Pointer[capabilities.Manager]
+}
+
+// setCapabilities sets the manager negotiating the version with the peers
+func (e *groupEncryption) setCapabilities(m *capabilities.Manager) {
+	e.capabilities.Store(m)
+}
+
+// version returns the encryption version of the new entries, the entries are
+// encrypted using the group secret as is until a version is negotiated
+func (e *groupEncryption) version() uint32 {
+	if e == nil {
+		return secretstore.EncryptionVersionUnbound
+	}
+
+	m := e.capabilities.Load()
+	if m == nil {
+		return secretstore.EncryptionVersionUnbound
+	}
+
+	version, ok := m.MinVersion(capabilities.FeatureGroupEncryption)
+	if !ok {
+		return secretstore.EncryptionVersionUnbound
+	}
+
+	if version > secretstore.EncryptionVersionCurrent {
+		return secretstore.EncryptionVersionCurrent
+	}
+
+	return version
+}
+
+// groupEncryptionFeature is the feature advertised to the peers to negotiate
+// the encryption version
+func groupEncryptionFeature() *capabilities.Feature {
+	return &capabilities.Feature{
+		Name:    capabilities.FeatureGroupEncryption,
+		Version: secretstore.EncryptionVersionCurrent,
+	}
+}
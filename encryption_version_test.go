@@ -0,0 +1,143 @@
+package weshnet
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/internal/capabilities"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+func TestGroupEnvelopeEncryptionVersion(t *testing.T) {
+	groupA, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	// group B shares the secret of group A
+	other, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	groupB := proto.Clone(groupA).(*protocoltypes.Group)
+	groupB.PublicKey = other.PublicKey
+
+	deviceSK, devicePK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	devicePKBytes, err := devicePK.Raw()
+	require.NoError(t, err)
+
+	payload := &protocoltypes.AccountGroupJoined{
+		Group:    groupA,
+		DevicePk: devicePKBytes,
+	}
+
+	payloadBytes, err := proto.Marshal(payload)
+	require.NoError(t, err)
+
+	sig, err := deviceSK.Sign(payloadBytes)
+	require.NoError(t, err)
+
+	// the signature isn't checked by this test
+	verifier := newSignatureVerifier(nil, nil, true).withoutReport()
+
+	seal := func(version uint32) []byte {
+		data, err := sealGroupEnvelope(groupA, secretstore.DefaultCipherSuite(), version, protocoltypes.EventType_EventTypeAccountGroupJoined, payload, sig)
+		require.NoError(t, err)
+
+		env := &protocoltypes.GroupEnvelope{}
+		require.NoError(t, proto.Unmarshal(data, env))
+		require.Equal(t, version, env.EncryptionVersion)
+
+		return data
+	}
+
+	// the entries bound to group A can't be opened in group B
+	bound := seal(secretstore.EncryptionVersionGroupBound)
+
+	_, event, err := openGroupEnvelope(groupA, bound, nil, verifier)
+	require.NoError(t, err)
+	require.Equal(t, devicePKBytes, event.(*protocoltypes.AccountGroupJoined).DevicePk)
+
+	_, _, err = openGroupEnvelope(groupB, bound, nil, verifier)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrGroupMemberLogEventOpen))
+
+	// the entries sealed for the older peers are still opened
+	unbound := seal(secretstore.EncryptionVersionUnbound)
+
+	_, event, err = openGroupEnvelope(groupA, unbound, nil, verifier)
+	require.NoError(t, err)
+	require.Equal(t, devicePKBytes, event.(*protocoltypes.AccountGroupJoined).DevicePk)
+}
+
+func TestGroupEncryptionNegotiatedVersion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the entries are sealed for the older peers until a version is
+	// negotiated
+	var encryption *groupEncryption
+	require.Equal(t, secretstore.EncryptionVersionUnbound, encryption.version())
+
+	encryption = &groupEncryption{}
+	require.Equal(t, secretstore.EncryptionVersionUnbound, encryption.version())
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	newManager := func(features ...*capabilities.Feature) (host.Host, *capabilities.Manager) {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+
+		m, err := capabilities.NewManager(zap.NewNop(), h, &capabilities.Capabilities{
+			Version:  capabilities.Version,
+			Features: features,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { m.Close() })
+
+		return h, m
+	}
+
+	localHost, local := newManager(groupEncryptionFeature())
+	encryption.setCapabilities(local)
+
+	// the current version is used while no peer is connected
+	require.Equal(t, secretstore.EncryptionVersionCurrent, encryption.version())
+
+	upToDateHost, _ := newManager(groupEncryptionFeature())
+	olderHost, _ := newManager()
+	require.NoError(t, mn.LinkAll())
+
+	connect := func(h host.Host) {
+		err := localHost.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			_, ok := local.Remote(h.ID())
+			return ok
+		}, time.Second*5, time.Millisecond*10)
+	}
+
+	connect(upToDateHost)
+	require.Equal(t, secretstore.EncryptionVersionCurrent, encryption.version())
+
+	// an older peer couldn't open the entries bound to the group
+	connect(olderHost)
+	require.Equal(t, secretstore.EncryptionVersionUnbound, encryption.version())
+
+	require.NoError(t, localHost.Network().ClosePeer(olderHost.ID()))
+	require.Eventually(t, func() bool {
+		return encryption.version() == secretstore.EncryptionVersionCurrent
+	}, time.Second*5, time.Millisecond*10)
+}
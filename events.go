@@ -1,16 +1,18 @@
 package weshnet
 
 import (
+	"errors"
 	"fmt"
 
 	cid "github.com/ipfs/go-cid"
-	"golang.org/x/crypto/nacl/secretbox"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
 	ipfslog "berty.tech/go-ipfs-log"
 	"berty.tech/weshnet/v2/pkg/cryptoutil"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
 )
 
 var eventTypesMapper = map[protocoltypes.EventType]struct {
@@ -31,10 +33,17 @@ var eventTypesMapper = map[protocoltypes.EventType]struct {
 	protocoltypes.EventType_EventTypeAccountContactRequestIncomingAccepted:  {Message: &protocoltypes.AccountContactRequestIncomingAccepted{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountContactBlocked:                  {Message: &protocoltypes.AccountContactBlocked{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountContactUnblocked:                {Message: &protocoltypes.AccountContactUnblocked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactRequestOutgoingCanceled:  {Message: &protocoltypes.AccountContactRequestOutgoingCanceled{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeContactAliasKeyAdded:                   {Message: &protocoltypes.ContactAliasKeyAdded{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeMultiMemberGroupAliasResolverAdded:     {Message: &protocoltypes.MultiMemberGroupAliasResolverAdded{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeMultiMemberGroupInitialMemberAnnounced: {Message: &protocoltypes.MultiMemberGroupInitialMemberAnnounced{}, SigChecker: sigCheckerGroupSigned},
 	protocoltypes.EventType_EventTypeMultiMemberGroupAdminRoleGranted:       {Message: &protocoltypes.MultiMemberGroupAdminRoleGranted{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupEpochKeyAdded:          {Message: &protocoltypes.MultiMemberGroupEpochKeyAdded{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupMessageDeliveryAcked:              {Message: &protocoltypes.GroupMessageDeliveryAcked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupMessageExpirationUpdated:          {Message: &protocoltypes.GroupMessageExpirationUpdated{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupMemberLeft:                        {Message: &protocoltypes.GroupMemberLeft{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupSignedReceiptsUpdated:             {Message: &protocoltypes.GroupSignedReceiptsUpdated{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupDeliveryAcksUpdated:               {Message: &protocoltypes.GroupDeliveryAcksUpdated{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeGroupMetadataPayloadSent:               {Message: &protocoltypes.GroupMetadataPayloadSent{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeGroupReplicating:                       {Message: &protocoltypes.GroupReplicating{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountVerifiedCredentialRegistered:    {Message: &protocoltypes.AccountVerifiedCredentialRegistered{}, SigChecker: sigCheckerDeviceSigned},
@@ -105,7 +114,7 @@ func newGroupMetadataEventFromEntry(_ ipfslog.Log, e ipfslog.Entry, metadata *pr
 	return &gme, nil
 }
 
-func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte) (*protocoltypes.GroupMetadata, proto.Message, error) {
+func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte, suites *secretstore.CipherSuites, verifier *signatureVerifier) (*protocoltypes.GroupMetadata, proto.Message, error) {
 	env := &protocoltypes.GroupEnvelope{}
 	if err := proto.Unmarshal(envelopeBytes, env); err != nil {
 		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
@@ -116,9 +125,19 @@ func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte) (*protocolt
 		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	data, ok := secretbox.Open(nil, env.Event, nonce, g.GetSharedSecret())
-	if !ok {
-		return nil, nil, errcode.ErrCode_ErrGroupMemberLogEventOpen
+	key, err := secretstore.GroupEncryptionKey(g, env.EncryptionVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	suite, err := suites.Get(env.CipherSuite)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := suite.Open(env.Event, nonce, key)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrGroupMemberLogEventOpen.Wrap(err)
 	}
 
 	metadataEvent := &protocoltypes.GroupMetadata{}
@@ -138,14 +157,26 @@ func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte) (*protocolt
 		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
-	if err := et.SigChecker(g, metadataEvent, payload); err != nil {
-		return nil, nil, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	if err := verifier.check(storeKindMetadata, et.SigChecker(g, metadataEvent, payload)); err != nil {
+		return nil, nil, err
 	}
 
 	return metadataEvent, payload, nil
 }
 
-func sealGroupEnvelope(g *protocoltypes.Group, eventType protocoltypes.EventType, payload proto.Message, payloadSig []byte) ([]byte, error) {
+// logOpenError logs the failure to open a group entry, the entries encrypted
+// using a cipher suite unsupported by this node are expected and skipped with
+// a warning
+func logOpenError(logger *zap.Logger, msg string, err error) {
+	if errors.Is(err, secretstore.ErrCipherSuiteUnsupported) {
+		logger.Warn(msg+", unsupported cipher suite", zap.Error(err))
+		return
+	}
+
+	logger.Error(msg, zap.Error(err))
+}
+
+func sealGroupEnvelope(g *protocoltypes.Group, suite secretstore.CipherSuite, encryptionVersion uint32, eventType protocoltypes.EventType, payload proto.Message, payloadSig []byte) ([]byte, error) {
 	payloadBytes, err := proto.Marshal(payload)
 	if err != nil {
 		return nil, errcode.ErrCode_TODO.Wrap(err)
@@ -168,11 +199,21 @@ func sealGroupEnvelope(g *protocoltypes.Group, eventType protocoltypes.EventType
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	eventBytes := secretbox.Seal(nil, eventClearBytes, nonce, g.GetSharedSecret())
+	key, err := secretstore.GroupEncryptionKey(g, encryptionVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	eventBytes, err := suite.Seal(eventClearBytes, nonce, key)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
 
 	env := &protocoltypes.GroupEnvelope{
-		Event: eventBytes,
-		Nonce: nonce[:],
+		Event:             eventBytes,
+		Nonce:             nonce[:],
+		EncryptionVersion: encryptionVersion,
+		CipherSuite:       suite.ID(),
 	}
 
 	return proto.Marshal(env)
@@ -16,6 +16,14 @@ func NewGroupMultiMember() (*protocoltypes.Group, crypto.PrivKey, error) {
 	return protocoltypes.NewGroupMultiMember()
 }
 
+// DeriveWellKnownGroup derives a public multi-member group from a name, the
+// clients deriving the same name join the same group without exchanging an
+// invitation. Anyone knowing the name can join the group and read its
+// messages, see protocoltypes.DeriveWellKnownGroup.
+func DeriveWellKnownGroup(name string) (*protocoltypes.Group, crypto.PrivKey, error) {
+	return protocoltypes.DeriveWellKnownGroup(name)
+}
+
 func getAndFilterGroupDeviceChainKeyAddedPayload(m *protocoltypes.GroupMetadata, localMemberPublicKey crypto.PubKey) (crypto.PubKey, []byte, error) {
 	if m == nil || m.EventType != protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded {
 		return nil, nil, errcode.ErrCode_ErrInvalidInput
@@ -42,3 +50,30 @@ func getAndFilterGroupDeviceChainKeyAddedPayload(m *protocoltypes.GroupMetadata,
 
 	return senderDevicePubKey, s.Payload, nil
 }
+
+func getAndFilterMultiMemberGroupEpochKeyAddedPayload(m *protocoltypes.GroupMetadata, localMemberPublicKey crypto.PubKey) (crypto.PubKey, []byte, error) {
+	if m == nil || m.EventType != protocoltypes.EventType_EventTypeMultiMemberGroupEpochKeyAdded {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	s := &protocoltypes.MultiMemberGroupEpochKeyAdded{}
+	if err := proto.Unmarshal(m.Payload, s); err != nil {
+		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	senderDevicePubKey, err := crypto.UnmarshalEd25519PublicKey(s.DevicePk)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	destMemberPubKey, err := crypto.UnmarshalEd25519PublicKey(s.DestMemberPk)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if !localMemberPublicKey.Equals(destMemberPubKey) {
+		return nil, nil, errcode.ErrCode_ErrGroupSecretOtherDestMember
+	}
+
+	return senderDevicePubKey, s.Payload, nil
+}
@@ -0,0 +1,317 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	exportGroupBundleFilename     = "group.bundle"
+	exportGroupBundleSaltFilename = "group_bundle.salt"
+	exportGroupBundleDataFilename = "group_bundle.data"
+)
+
+// ExportGroupBundle writes a multi-member group along with its history, the
+// bundle can be imported by another account using ImportGroupBundle to join
+// the group with its full backlog. Only the group secrets and the keys of the
+// messages already opened by the current device are written, the keys of the
+// account are never part of a bundle. The bundle is encrypted using a key
+// derived from the passphrase unless it is empty.
+func (s *service) ExportGroupBundle(ctx context.Context, output io.Writer, groupPK []byte, passphrase []byte) (err error) {
+	ctx, span := s.tracer.Start(ctx, "ExportGroupBundle", trace.WithAttributes(traceGroupPK(groupPK)))
+	defer func() { endSpan(span, err) }()
+
+	gc, err := s.GetContextGroupForID(groupPK)
+	if err != nil {
+		return err
+	}
+
+	if gc.Group().GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("only multi-member groups can be exported as a bundle"))
+	}
+
+	if err := waitForGroupQuiescence(ctx, gc); err != nil {
+		return err
+	}
+
+	// listing the messages opens them, their keys are then known
+	events, err := gc.MessageStore().ListEvents(ctx, nil, nil, false)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+	for range events {
+	}
+
+	entries := gc.MessageStore().OpLog().GetEntries().Keys()
+	msgCIDs := make([]cid.Cid, len(entries))
+	for i, idStr := range entries {
+		if msgCIDs[i], err = cid.Parse(idStr); err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+	}
+
+	msgKeys, err := s.secretStore.ExportMessageKeys(ctx, msgCIDs)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	bundle, err := proto.Marshal(&protocoltypes.GroupBundle{
+		Group:       gc.Group(),
+		MessageKeys: msgKeys,
+	})
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if len(passphrase) == 0 {
+		return s.writeGroupBundle(ctx, gc, bundle, output)
+	}
+
+	data := new(bytes.Buffer)
+	if err := s.writeGroupBundle(ctx, gc, bundle, data); err != nil {
+		return err
+	}
+
+	key, salt, err := cryptoutil.DeriveKey(passphrase, nil)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedData, err := cryptoutil.AESGCMEncrypt(key, data.Bytes())
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	tw := tar.NewWriter(output)
+	defer tw.Close()
+
+	if err := exportPrivateKey(tw, salt, exportGroupBundleSaltFilename); err != nil {
+		return err
+	}
+
+	return exportPrivateKey(tw, encryptedData, exportGroupBundleDataFilename)
+}
+
+// writeGroupBundle writes the bundle descriptor first, followed by the entries
+// and the heads of the group
+func (s *service) writeGroupBundle(ctx context.Context, gc *GroupContext, bundle []byte, output io.Writer) error {
+	tw := tar.NewWriter(output)
+
+	if err := exportPrivateKey(tw, bundle, exportGroupBundleFilename); err != nil {
+		return err
+	}
+
+	if _, err := s.exportGroupContext(ctx, gc, tw); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// ImportGroupBundle imports a group bundle written by ExportGroupBundle and
+// joins the group, the passphrase must be provided if the bundle is
+// encrypted. The group is returned so it can be activated, its history can
+// then be read without waiting for the other members to share their keys.
+// A bundle doesn't identify who shared it, it is rejected with
+// ErrGroupInviterNotContact if Opts.ContactInvitationsOnly is set, like an
+// invitation without inviter.
+func (s *service) ImportGroupBundle(ctx context.Context, reader io.Reader, passphrase []byte) (_ *protocoltypes.Group, err error) {
+	ctx, span := s.tracer.Start(ctx, "ImportGroupBundle")
+	defer func() { endSpan(span, err) }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if s.contactInvitationsOnly {
+		return nil, errcode.ErrCode_ErrGroupInviterNotContact.Wrap(fmt.Errorf("a group bundle doesn't identify its inviter, only the invitations of the contacts are accepted"))
+	}
+
+	tr := tar.NewReader(reader)
+	if len(passphrase) > 0 {
+		data, err := readEncryptedGroupBundle(ctx, tr, passphrase, s.logger)
+		if err != nil {
+			return nil, err
+		}
+
+		tr = tar.NewReader(bytes.NewReader(data))
+	}
+
+	state := restoreAccountState{
+		keys: map[string][]byte{},
+	}
+	bundle := (*protocoltypes.GroupBundle)(nil)
+
+	err = restoreAccountExport(ctx, tr, s.logger, []RestoreAccountHandler{
+		{
+			Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+				switch header.Name {
+				case exportGroupBundleSaltFilename, exportGroupBundleDataFilename:
+					return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group bundle is encrypted, no passphrase provided"))
+				case exportGroupBundleFilename:
+				default:
+					return false, nil
+				}
+
+				if bundle != nil {
+					return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("multiple group bundle descriptors found"))
+				}
+
+				var err error
+				if bundle, err = s.readGroupBundle(ctx, header.Size, reader); err != nil {
+					return true, err
+				}
+
+				return true, nil
+			},
+		},
+		{
+			// the descriptor is written first, it is checked before anything
+			// is restored so an already known group is never rolled back
+			Handler: func(header *tar.Header, _ *tar.Reader) (bool, error) {
+				if bundle == nil && (strings.HasPrefix(header.Name, exportOrbitDBEntriesPrefix) || strings.HasPrefix(header.Name, exportOrbitDBHeadsPrefix)) {
+					return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group bundle descriptor not found"))
+				}
+
+				return false, nil
+			},
+		},
+		state.restoreOrbitDBEntry(ctx, s.ipfsCoreAPI),
+		state.restoreOrbitDBHeads(ctx, s.ipfsCoreAPI, s.odb),
+		{
+			PostProcess: func() error {
+				if bundle == nil {
+					return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group bundle descriptor not found"))
+				}
+
+				if len(state.groups) != 1 || !bytes.Equal(state.groups[0].PublicKey, bundle.Group.PublicKey) ||
+					!bytes.Equal(state.groups[0].SignPub, bundle.Group.SignPub) || !bytes.Equal(state.groups[0].LinkKey, bundle.Group.LinkKey) {
+					return errcode.ErrCode_ErrGroupKeyMismatch.Wrap(fmt.Errorf("group heads don't match the bundle descriptor"))
+				}
+
+				// the secret of the group is known from the descriptor
+				if restored, ok := state.heads[string(bundle.Group.PublicKey)]; ok {
+					for _, head := range restored.metadataHeads {
+						if err := openExportedHead(ctx, s.ipfsCoreAPI, s.odb, bundle.Group, head); err != nil {
+							return err
+						}
+					}
+				}
+
+				// only the keys of the imported messages are kept
+				restored := make(map[string]struct{}, len(state.entries))
+				for _, id := range state.entries {
+					restored[id.KeyString()] = struct{}{}
+				}
+
+				msgKeys := []*protocoltypes.MessageKeyExport(nil)
+				for _, msgKey := range bundle.MessageKeys {
+					if _, ok := restored[string(msgKey.Cid)]; ok {
+						msgKeys = append(msgKeys, msgKey)
+					}
+				}
+
+				if err := s.secretStore.ImportMessageKeys(ctx, msgKeys); err != nil {
+					return errcode.ErrCode_ErrInternal.Wrap(err)
+				}
+
+				if _, err := accountGroup.MetadataStore().GroupJoin(ctx, bundle.Group); err != nil {
+					return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+				}
+
+				return nil
+			},
+		},
+	})
+	if err != nil {
+		if rollbackErr := state.rollback(s.ipfsCoreAPI, s.odb); rollbackErr != nil {
+			s.logger.Error("unable to roll back incomplete group bundle import", zap.Error(rollbackErr))
+			return nil, multierr.Append(err, rollbackErr)
+		}
+
+		return nil, err
+	}
+
+	return bundle.Group, nil
+}
+
+// readGroupBundle reads the bundle descriptor, it fails if the group isn't a
+// multi-member group or is already known by the account
+func (s *service) readGroupBundle(ctx context.Context, expectedSize int64, reader *tar.Reader) (*protocoltypes.GroupBundle, error) {
+	data, err := readExportSecretKeyFile(expectedSize, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &protocoltypes.GroupBundle{}
+	if err := proto.Unmarshal(data, bundle); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if bundle.Group == nil || bundle.Group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group bundle doesn't contain a multi-member group"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(bundle.Group.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := s.secretStore.FetchGroupByPublicKey(ctx, pk); err == nil || s.odb.IsGroupLoaded(bundle.Group.GroupIDAsString()) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group is already known"))
+	}
+
+	return bundle, nil
+}
+
+// readEncryptedGroupBundle returns the decrypted content of a group bundle
+// written with a passphrase
+func readEncryptedGroupBundle(ctx context.Context, tr *tar.Reader, passphrase []byte, logger *zap.Logger) ([]byte, error) {
+	state := restoreAccountState{
+		keys: map[string][]byte{},
+	}
+
+	if err := restoreAccountExport(ctx, tr, logger, []RestoreAccountHandler{
+		state.readKey(exportGroupBundleSaltFilename),
+		state.readKey(exportGroupBundleDataFilename),
+	}); err != nil {
+		return nil, err
+	}
+
+	salt, encryptedData := state.keys[exportGroupBundleSaltFilename], state.keys[exportGroupBundleDataFilename]
+	if salt == nil || encryptedData == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group bundle isn't encrypted"))
+	}
+
+	key, _, err := cryptoutil.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	data, err := cryptoutil.AESGCMDecrypt(key, encryptedData)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return data, nil
+}
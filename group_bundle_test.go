@@ -0,0 +1,146 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestGroupBundle(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+
+	// the nodes are never connected, the history comes from the bundle
+	nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+		Logger:          logger.Named("nodeA"),
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+	}, nil)
+	defer closeNodeA()
+
+	created, err := nodeA.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	messages := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		payload := fmt.Sprintf("message %d", i)
+		messages[payload] = false
+
+		_, err := nodeA.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte(payload),
+		})
+		require.NoError(t, err)
+	}
+
+	// the account group can't be bundled
+	config, err := nodeA.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	err = nodeA.Service.ExportGroupBundle(ctx, io.Discard, config.AccountGroupPk, nil)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	passphrase := []byte("bundle passphrase")
+
+	bundle := new(bytes.Buffer)
+	require.NoError(t, nodeA.Service.ExportGroupBundle(ctx, bundle, created.GroupPk, passphrase))
+
+	plainBundle := new(bytes.Buffer)
+	require.NoError(t, nodeA.Service.ExportGroupBundle(ctx, plainBundle, created.GroupPk, nil))
+
+	// the account keys of node A are never exported
+	tr := tar.NewReader(bytes.NewReader(plainBundle.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NotEqual(t, exportAccountKeyFilename, header.Name)
+		require.NotEqual(t, exportAccountProofKeyFilename, header.Name)
+	}
+
+	// the bundles are rejected when only the invitations of the contacts are
+	// accepted
+	nodeC, closeNodeC := NewTestingProtocol(ctx, t, &TestingOpts{
+		Logger:                 logger.Named("nodeC"),
+		Mocknet:                mn,
+		DiscoveryServer:        msrv,
+		ContactInvitationsOnly: true,
+	}, nil)
+	defer closeNodeC()
+
+	_, err = nodeC.Service.ImportGroupBundle(ctx, bytes.NewReader(plainBundle.Bytes()), nil)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrGroupInviterNotContact))
+
+	_, err = nodeC.Service.(*service).GetContextGroupForID(created.GroupPk)
+	require.Error(t, err)
+
+	nodeB, closeNodeB := NewTestingProtocol(ctx, t, &TestingOpts{
+		Logger:          logger.Named("nodeB"),
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+	}, nil)
+	defer closeNodeB()
+
+	_, err = nodeB.Service.ImportGroupBundle(ctx, bytes.NewReader(bundle.Bytes()), nil)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	_, err = nodeB.Service.ImportGroupBundle(ctx, bytes.NewReader(bundle.Bytes()), []byte("wrong passphrase"))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt))
+
+	group, err := nodeB.Service.ImportGroupBundle(ctx, bytes.NewReader(bundle.Bytes()), passphrase)
+	require.NoError(t, err)
+	require.Equal(t, created.GroupPk, group.PublicKey)
+
+	// a group can't be imported twice
+	_, err = nodeB.Service.ImportGroupBundle(ctx, bytes.NewReader(plainBundle.Bytes()), nil)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	_, err = nodeB.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+
+	sub, err := nodeB.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+		GroupPk:  created.GroupPk,
+		UntilNow: true,
+	})
+	require.NoError(t, err)
+
+	for {
+		evt, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		_, ok := messages[string(evt.Message)]
+		require.True(t, ok)
+		messages[string(evt.Message)] = true
+	}
+
+	for payload, received := range messages {
+		require.True(t, received, payload)
+	}
+}
@@ -1,6 +1,7 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
@@ -36,6 +38,28 @@ type GroupContext struct {
 	muDevicesAdded    sync.RWMutex
 	selfAnnounced     chan struct{}
 	selfAnnouncedOnce sync.Once
+	ackDeliveredOnce  sync.Once
+	indexMessagesOnce sync.Once
+
+	// historyIndexing is the number of ongoing indexings of the history of
+	// the group, historyIndexed is closed once they are all done
+	muHistoryIndexing sync.Mutex
+	historyIndexing   int
+	historyIndexed    chan struct{}
+
+	// deviceAdded is true if the current device has been added to the group
+	// by ActivateGroupContext
+	deviceAdded bool
+
+	// left is set when the account has left the group, the current device
+	// isn't announced again by ActivateGroupContext
+	left bool
+
+	// snapshot is the last snapshot of the group published by the current
+	// device, stored on IPFS as snapshotCID
+	snapshot    *protocoltypes.GroupSnapshot
+	snapshotCID cid.Cid
+	muSnapshot  sync.Mutex
 }
 
 func (gc *GroupContext) SecretStore() secretstore.SecretStore {
@@ -169,6 +193,12 @@ func (gc *GroupContext) ActivateGroupContext(contactPK crypto.PubKey) (err error
 		wgExistingMembers.Wait()
 	}
 
+	// the device which left the group is announced again once the group is
+	// joined again
+	if gc.left {
+		return nil
+	}
+
 	start := time.Now()
 	op, err := gc.MetadataStore().AddDeviceToGroup(gc.ctx)
 	if err != nil {
@@ -183,6 +213,8 @@ func (gc *GroupContext) ActivateGroupContext(contactPK crypto.PubKey) (err error
 			return ctx.Err()
 		case <-gc.selfAnnounced: // device has been selfAnnounced
 		}
+
+		gc.deviceAdded = true
 	}
 
 	return nil
@@ -205,12 +237,25 @@ func (gc *GroupContext) handleGroupMetadataEvent(e *protocoltypes.GroupMetadataE
 			gc.selfAnnouncedOnce.Do(func() { close(gc.selfAnnounced) }) // mark has self announced
 		}
 
+		// the secrets are not sent to a rejected device
+		if err := gc.MetadataStore().validateMembership(event); err != nil {
+			gc.logger.Warn("member device rejected", zap.Error(err))
+			return nil
+		}
+
+		// the messages of the device held until it was added can be applied
+		gc.MessageStore().ProcessMessageQueueForDevicePK(gc.ctx, event.DevicePk)
+
 		if _, err := gc.MetadataStore().SendSecret(gc.ctx, memberPK); err != nil {
 			if !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) {
 				return fmt.Errorf("unable to send secret to member: %w", err)
 			}
 		}
 
+		if err := gc.sendEpochKey(memberPK); err != nil {
+			return fmt.Errorf("unable to send epoch key to member: %w", err)
+		}
+
 	case protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded:
 		senderPublicKey, encryptedDeviceChainKey, err := getAndFilterGroupDeviceChainKeyAddedPayload(e.Metadata, gc.ownMemberDevice.Member())
 		switch err {
@@ -222,6 +267,12 @@ func (gc *GroupContext) handleGroupMetadataEvent(e *protocoltypes.GroupMetadataE
 			return fmt.Errorf("an error occurred while opening device secrets: %w", err)
 		}
 
+		// the messages of a rejected device must not be opened
+		if gc.MetadataStore().isDeviceRejected(senderPublicKey) {
+			gc.logger.Warn("ignoring the chain key of a rejected device")
+			return nil
+		}
+
 		if err = gc.SecretStore().RegisterChainKey(gc.ctx, gc.Group(), senderPublicKey, encryptedDeviceChainKey); err != nil {
 			return fmt.Errorf("unable to register chain key: %w", err)
 		}
@@ -232,6 +283,66 @@ func (gc *GroupContext) handleGroupMetadataEvent(e *protocoltypes.GroupMetadataE
 			// process queued message and check if cached messages can be opened with it
 			gc.MessageStore().ProcessMessageQueueForDevicePK(gc.ctx, rawPK)
 		}
+
+	case protocoltypes.EventType_EventTypeMultiMemberGroupEpochKeyAdded:
+		senderPublicKey, encryptedEpochKey, err := getAndFilterMultiMemberGroupEpochKeyAddedPayload(e.Metadata, gc.ownMemberDevice.Member())
+		switch err {
+		case nil: // ok
+		case errcode.ErrCode_ErrInvalidInput, errcode.ErrCode_ErrGroupSecretOtherDestMember:
+			return nil
+		default:
+			return fmt.Errorf("an error occurred while opening epoch key: %w", err)
+		}
+
+		if err := gc.registerEpochKey(senderPublicKey, encryptedEpochKey); err != nil {
+			return fmt.Errorf("unable to register epoch key: %w", err)
+		}
+
+	case protocoltypes.EventType_EventTypeGroupMessageDeliveryAcked:
+		event := &protocoltypes.GroupMessageDeliveryAcked{}
+		if err := proto.Unmarshal(e.Event, event); err != nil {
+			return fmt.Errorf("unable to unmarshal delivery ack: %w", err)
+		}
+
+		gc.MessageStore().replicationLag.Acked(gc.group.PublicKey, event.MessageId, event.DevicePk, time.Now())
+	}
+
+	return nil
+}
+
+// registerEpochKey records an epoch key sent by a device allowed to rekey the
+// group, queued messages are processed again as they might have been
+// encrypted using this key
+func (gc *GroupContext) registerEpochKey(senderPublicKey crypto.PubKey, encryptedEpochKey []byte) error {
+	if !gc.MetadataStore().CanRekey(senderPublicKey) {
+		return errcode.ErrCode_ErrGroupPermissionDenied
+	}
+
+	if err := gc.SecretStore().RegisterEpochKey(gc.ctx, gc.Group(), senderPublicKey, encryptedEpochKey); err != nil {
+		return err
+	}
+
+	for _, devicePK := range gc.MetadataStore().ListDevices() {
+		if rawPK, err := devicePK.Raw(); err == nil {
+			gc.MessageStore().ProcessMessageQueueForDevicePK(gc.ctx, rawPK)
+		}
+	}
+
+	return nil
+}
+
+// sendEpochKey shares the current epoch key with a member, it is a no-op if
+// the group has never been rekeyed or if the current device is not allowed to
+// rekey the group
+func (gc *GroupContext) sendEpochKey(memberPK crypto.PubKey) error {
+	if gc.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil
+	}
+
+	if _, err := gc.MetadataStore().SendEpochKey(gc.ctx, memberPK); err != nil {
+		if !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) && !errcode.Is(err, errcode.ErrCode_ErrGroupPermissionDenied) {
+			return err
+		}
 	}
 
 	return nil
@@ -241,6 +352,10 @@ func (gc *GroupContext) fillMessageKeysHolderUsingPreviousData() {
 	publishedSecrets := gc.metadataStoreListSecrets()
 
 	for senderPublicKey, encryptedSecret := range publishedSecrets {
+		if gc.MetadataStore().isDeviceRejected(senderPublicKey) {
+			continue
+		}
+
 		if err := gc.SecretStore().RegisterChainKey(gc.ctx, gc.Group(), senderPublicKey, encryptedSecret); err != nil {
 			gc.logger.Error("unable to register chain key", zap.Error(err))
 			continue
@@ -250,6 +365,49 @@ func (gc *GroupContext) fillMessageKeysHolderUsingPreviousData() {
 			gc.MessageStore().ProcessMessageQueueForDevicePK(gc.ctx, rawPK)
 		}
 	}
+
+	if gc.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return
+	}
+
+	for _, epochKey := range gc.metadataStoreListEpochKeys() {
+		if err := gc.registerEpochKey(epochKey.sender, epochKey.encrypted); err != nil {
+			gc.logger.Error("unable to register epoch key", zap.Error(err))
+		}
+	}
+}
+
+type publishedEpochKey struct {
+	sender    crypto.PubKey
+	encrypted []byte
+}
+
+func (gc *GroupContext) metadataStoreListEpochKeys() []publishedEpochKey {
+	epochKeys := []publishedEpochKey(nil)
+
+	metadatas, err := gc.MetadataStore().ListEvents(gc.ctx, nil, nil, false)
+	if err != nil {
+		return nil
+	}
+	for metadata := range metadatas {
+		if metadata == nil {
+			continue
+		}
+
+		pk, encryptedEpochKey, err := getAndFilterMultiMemberGroupEpochKeyAddedPayload(metadata.Metadata, gc.MemberPubKey())
+		if errcode.Is(err, errcode.ErrCode_ErrInvalidInput) || errcode.Is(err, errcode.ErrCode_ErrGroupSecretOtherDestMember) {
+			continue
+		}
+
+		if err != nil {
+			gc.logger.Error("unable to open epoch key", zap.Error(err))
+			continue
+		}
+
+		epochKeys = append(epochKeys, publishedEpochKey{sender: pk, encrypted: encryptedEpochKey})
+	}
+
+	return epochKeys
 }
 
 func (gc *GroupContext) metadataStoreListSecrets() map[crypto.PubKey][]byte {
@@ -316,6 +474,10 @@ func (gc *GroupContext) sendSecretsToExistingMembers(contact crypto.PubKey) {
 		} else {
 			gc.logger.Info("sent secret to existing member", logutil.PrivateString("memberpk", base64.StdEncoding.EncodeToString(rawPK)))
 		}
+
+		if err := gc.sendEpochKey(pk); err != nil {
+			gc.logger.Error("unable to send epoch key to existing member", logutil.PrivateString("memberpk", base64.StdEncoding.EncodeToString(rawPK)), zap.Error(err))
+		}
 	}
 }
 
@@ -357,6 +519,171 @@ func (gc *GroupContext) TagGroupContextPeers(ipfsCoreAPI ipfsutil.ExtendedCoreAP
 	}()
 }
 
+// AckDeliveredMessages acknowledges the delivery of the messages received
+// from the other devices of the group, while the delivery acknowledgements
+// are enabled on the group
+func (gc *GroupContext) AckDeliveredMessages() {
+	gc.ackDeliveredOnce.Do(gc.ackDeliveredMessages)
+}
+
+func (gc *GroupContext) ackDeliveredMessages() {
+	sub, err := gc.messageStore.EventBus().Subscribe(new(*protocoltypes.GroupMessageEvent))
+	if err != nil {
+		gc.logger.Warn("unable to subscribe to group message events", zap.Error(err))
+		return
+	}
+
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+		defer sub.Close()
+
+		for {
+			var e interface{}
+
+			select {
+			case e = <-sub.Out():
+			case <-gc.ctx.Done():
+				return
+			}
+
+			if !gc.metadataStore.DeliveryAcks() {
+				continue
+			}
+
+			// the chunks of a streamed message are acknowledged along with
+			// the message listing them
+			evt := e.(*protocoltypes.GroupMessageEvent)
+			if evt.StreamChunk || bytes.Equal(evt.GetHeaders().GetDevicePk(), gc.metadataStore.devicePublicKeyRaw) {
+				continue
+			}
+
+			if _, err := gc.metadataStore.SendMessageDeliveryAck(gc.ctx, evt.GetEventContext().GetId()); err != nil {
+				gc.logger.Warn("unable to acknowledge message delivery", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// IndexMessages adds the messages of the group to the given indexer, the
+// history is indexed first then the messages are indexed as they are received
+func (gc *GroupContext) IndexMessages(indexer MessageIndexer) {
+	gc.indexMessagesOnce.Do(func() { gc.indexMessages(indexer) })
+}
+
+func (gc *GroupContext) indexMessages(indexer MessageIndexer) {
+	// subscribe before listing the history to avoid missing messages, the
+	// indexer ignores the messages indexed twice
+	sub, err := gc.messageStore.EventBus().Subscribe(new(*protocoltypes.GroupMessageEvent))
+	if err != nil {
+		gc.logger.Warn("unable to subscribe to group message events", zap.Error(err))
+		return
+	}
+
+	indexed := gc.startHistoryIndexing()
+
+	gc.tasks.Add(2)
+	go func() {
+		defer gc.tasks.Done()
+		defer indexed()
+
+		history, err := gc.messageStore.ListEvents(gc.ctx, nil, nil, false)
+		if err != nil {
+			gc.logger.Warn("unable to list group messages", zap.Error(err))
+			return
+		}
+
+		for evt := range history {
+			gc.indexMessage(gc.ctx, indexer, evt)
+		}
+	}()
+
+	go func() {
+		defer gc.tasks.Done()
+		defer sub.Close()
+
+		for {
+			var e interface{}
+
+			select {
+			case e = <-sub.Out():
+			case <-gc.ctx.Done():
+				return
+			}
+
+			gc.indexMessage(gc.ctx, indexer, e.(*protocoltypes.GroupMessageEvent))
+		}
+	}()
+}
+
+// startHistoryIndexing marks the history of the group as being indexed until
+// the returned function is called, see WaitHistoryIndexed
+func (gc *GroupContext) startHistoryIndexing() (done func()) {
+	gc.muHistoryIndexing.Lock()
+	defer gc.muHistoryIndexing.Unlock()
+
+	if gc.historyIndexing == 0 {
+		gc.historyIndexed = make(chan struct{})
+	}
+	gc.historyIndexing++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			gc.muHistoryIndexing.Lock()
+			defer gc.muHistoryIndexing.Unlock()
+
+			gc.historyIndexing--
+			if gc.historyIndexing == 0 {
+				close(gc.historyIndexed)
+			}
+		})
+	}
+}
+
+// WaitHistoryIndexed blocks until the history of the group has been indexed,
+// the results of the indexer are partial meanwhile
+func (gc *GroupContext) WaitHistoryIndexed(ctx context.Context) error {
+	gc.muHistoryIndexing.Lock()
+	indexed := gc.historyIndexed
+	gc.muHistoryIndexing.Unlock()
+
+	if indexed == nil {
+		return nil
+	}
+
+	select {
+	case <-indexed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// indexMessage indexes the latest version of a message, an edit updates the
+// message it replaces
+func (gc *GroupContext) indexMessage(ctx context.Context, indexer MessageIndexer, evt *protocoltypes.GroupMessageEvent) {
+	if evt.StreamChunk {
+		return
+	}
+
+	latest, err := latestMessageVersion(ctx, gc, evt)
+	if err != nil {
+		gc.logger.Warn("unable to read message to index", zap.Error(err))
+		return
+	}
+
+	msg, err := newIndexedMessage(latest, time.Now())
+	if err != nil {
+		gc.logger.Warn("unable to read message to index", zap.Error(err))
+		return
+	}
+
+	if err := indexer.IndexMessage(ctx, msg); err != nil {
+		gc.logger.Warn("unable to index message", zap.Error(err))
+	}
+}
+
 func (gc *GroupContext) WaitForDeviceAdded(ctx context.Context, devicePK crypto.PubKey) (found chan struct{}) {
 	gc.muDevicesAdded.Lock()
 	defer gc.muDevicesAdded.Unlock()
@@ -0,0 +1,71 @@
+package weshnet
+
+import (
+	"sync"
+	"time"
+)
+
+// maxGroupErrors is the number of errors kept for each group, the oldest ones
+// are dropped first
+const maxGroupErrors = 32
+
+// groupError is an error which occurred while processing an entry of a group
+type groupError struct {
+	At    time.Time
+	Store string
+	Err   string
+}
+
+// groupErrorTracker keeps the last errors which occurred while processing the
+// entries of each group, for the debug dumps. It is local only, the errors
+// are lost when the service stops.
+type groupErrorTracker struct {
+	groups map[string][]groupError // group pk -> errors, oldest first
+	mu     sync.Mutex
+}
+
+func newGroupErrorTracker() *groupErrorTracker {
+	return &groupErrorTracker{
+		groups: make(map[string][]groupError),
+	}
+}
+
+// Record records an error which occurred while processing an entry of the
+// given store kind of a group
+func (t *groupErrorTracker) Record(groupPK []byte, store string, err error) {
+	if t == nil || err == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	errs := t.groups[string(groupPK)]
+	if len(errs) >= maxGroupErrors {
+		errs = errs[1:]
+	}
+
+	t.groups[string(groupPK)] = append(errs, groupError{
+		At:    time.Now(),
+		Store: store,
+		Err:   err.Error(),
+	})
+}
+
+// Group returns the errors recorded for a group, newest first
+func (t *groupErrorTracker) Group(groupPK []byte) []groupError {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	errs := t.groups[string(groupPK)]
+	ret := make([]groupError, len(errs))
+	for i, e := range errs {
+		ret[len(errs)-1-i] = e
+	}
+
+	return ret
+}
@@ -0,0 +1,61 @@
+package weshnet
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// groupInvitationSigPrefix is prepended to the group public key signed by
+// the inviter, so the signature can't be mistaken for another one made with
+// the account key
+const groupInvitationSigPrefix = "weshnet/group-invitation:"
+
+func groupInvitationSignedData(groupPK []byte) []byte {
+	return append([]byte(groupInvitationSigPrefix), groupPK...)
+}
+
+// signGroupInvitation signs an invitation to a group with the account key,
+// the invitees can then check who invited them
+func signGroupInvitation(accountGroup *GroupContext, groupPK []byte) (inviterPK []byte, sig []byte, err error) {
+	inviterPK, err = accountGroup.MemberPubKey().Raw()
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	sig, err = accountGroup.ownMemberDevice.MemberSign(groupInvitationSignedData(groupPK))
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return inviterPK, sig, nil
+}
+
+// checkGroupInvitation checks that an invitation has been signed by a contact
+// of the account, ErrGroupInviterNotContact is returned otherwise
+func checkGroupInvitation(accountGroup *GroupContext, req *protocoltypes.MultiMemberGroupJoin_Request) error {
+	if len(req.InviterPk) == 0 || len(req.InviterSig) == 0 {
+		return errcode.ErrCode_ErrGroupInviterNotContact.Wrap(fmt.Errorf("the invitation doesn't identify its inviter, only the invitations of the contacts are accepted"))
+	}
+
+	inviterPK, err := crypto.UnmarshalEd25519PublicKey(req.InviterPk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := inviterPK.Verify(groupInvitationSignedData(req.GetGroup().GetPublicKey()), req.InviterSig); err != nil || !ok {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid invitation signature"))
+	}
+
+	for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		if bytes.Equal(contact.Pk, req.InviterPk) {
+			return nil
+		}
+	}
+
+	return errcode.ErrCode_ErrGroupInviterNotContact.Wrap(fmt.Errorf("the inviter isn't a contact, only the invitations of the contacts are accepted"))
+}
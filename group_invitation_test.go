@@ -0,0 +1,96 @@
+package weshnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestMultiMemberGroupJoinContactInvitationsOnly(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:                mn,
+		Logger:                 logger,
+		DiscoveryServer:        tinder.NewMockDriverServer(),
+		ConnectFunc:            weshnet.ConnectAll,
+		ContactInvitationsOnly: true,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 3)
+	defer cleanup()
+
+	joiner, contact, stranger := nodes[0], nodes[1], nodes[2]
+
+	addAsContact(ctx, t, []*weshnet.TestingProtocol{contact}, []*weshnet.TestingProtocol{joiner})
+
+	createInvitation := func(inviter *weshnet.TestingProtocol) *protocoltypes.MultiMemberGroupInvitationCreate_Reply {
+		created, err := inviter.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+		require.NoError(t, err)
+
+		invitation, err := inviter.Client.MultiMemberGroupInvitationCreate(ctx, &protocoltypes.MultiMemberGroupInvitationCreate_Request{
+			GroupPk: created.GroupPk,
+		})
+		require.NoError(t, err)
+
+		return invitation
+	}
+
+	join := func(invitation *protocoltypes.MultiMemberGroupInvitationCreate_Reply) error {
+		_, err := joiner.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{
+			Group:      invitation.Group,
+			InviterPk:  invitation.InviterPk,
+			InviterSig: invitation.InviterSig,
+		})
+		return err
+	}
+
+	// the invitation of a stranger is rejected
+	fromStranger := createInvitation(stranger)
+	err := join(fromStranger)
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupInviterNotContact))
+
+	// an invitation which doesn't identify its inviter is rejected
+	fromContact := createInvitation(contact)
+	_, err = joiner.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{
+		Group: fromContact.Group,
+	})
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupInviterNotContact))
+
+	// the contact can't be impersonated using the signature of another group
+	err = join(&protocoltypes.MultiMemberGroupInvitationCreate_Reply{
+		Group:      fromStranger.Group,
+		InviterPk:  fromContact.InviterPk,
+		InviterSig: fromContact.InviterSig,
+	})
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrCryptoSignatureVerification))
+
+	// the invitation of a contact is accepted
+	require.NoError(t, join(fromContact))
+
+	_, err = joiner.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{
+		GroupPk: fromContact.Group.PublicKey,
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,233 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	coreiface "github.com/ipfs/kubo/core/coreiface"
+	"github.com/ipfs/kubo/core/coreiface/options"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-ipfs-log/enc"
+	"berty.tech/go-ipfs-log/entry"
+	logio "berty.tech/go-ipfs-log/io"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// storeHeadsCacheKeys are the keys under which orbit-db keeps the local and
+// the replicated heads of a store in its cache
+var storeHeadsCacheKeys = []ds.Key{ds.NewKey("_localHeads"), ds.NewKey("_remoteHeads")}
+
+// groupLog is the log of a store of a group, either opened or read from the
+// local data of the store
+type groupLog interface {
+	// Kind is the kind of the store, storeKindMetadata or storeKindMessage
+	Kind() string
+
+	// Address is the address of the store
+	Address() string
+
+	// Heads are the heads of the log
+	Heads() []cid.Cid
+
+	// Cache is the datastore holding the cache of the store
+	Cache() ds.Datastore
+
+	// Walk calls fn for each entry of the log available locally, it stops at
+	// the first error returned by fn
+	Walk(ctx context.Context, fn func(e ipfslog.Entry) error) error
+}
+
+// openedGroupLog is the log of an opened store
+type openedGroupLog struct {
+	kind  string
+	store iface.Store
+}
+
+func (l *openedGroupLog) Kind() string { return l.kind }
+
+func (l *openedGroupLog) Address() string { return l.store.Address().String() }
+
+func (l *openedGroupLog) Cache() ds.Datastore { return l.store.Cache() }
+
+func (l *openedGroupLog) Heads() []cid.Cid {
+	heads := []cid.Cid{}
+	for _, head := range l.store.OpLog().RawHeads().Slice() {
+		heads = append(heads, head.GetHash())
+	}
+
+	return heads
+}
+
+func (l *openedGroupLog) Walk(ctx context.Context, fn func(e ipfslog.Entry) error) error {
+	for _, e := range l.store.OpLog().GetEntries().Slice() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closedGroupLog is the log of a store which isn't opened, its heads are read
+// from the cache of the store and its entries from the local blocks. Unlike
+// opening the store, nothing is registered for the group and no entry is
+// processed, the group can be activated meanwhile.
+type closedGroupLog struct {
+	kind    string
+	address string
+	cache   ds.Datastore
+	heads   []cid.Cid
+	fetch   func(ctx context.Context, id cid.Cid) (ipfslog.Entry, error)
+}
+
+func (l *closedGroupLog) Kind() string { return l.kind }
+
+func (l *closedGroupLog) Address() string { return l.address }
+
+func (l *closedGroupLog) Cache() ds.Datastore { return l.cache }
+
+func (l *closedGroupLog) Heads() []cid.Cid { return l.heads }
+
+// Walk follows the entries from the heads, one at a time, the entries which
+// haven't been replicated or can't be decrypted are skipped along with their
+// ancestors
+func (l *closedGroupLog) Walk(ctx context.Context, fn func(e ipfslog.Entry) error) error {
+	visited := map[cid.Cid]struct{}{}
+	pending := append([]cid.Cid{}, l.heads...)
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+
+		e, err := l.fetch(ctx, id)
+		if err != nil {
+			continue
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+
+		pending = append(pending, e.GetNext()...)
+	}
+
+	return nil
+}
+
+// closedGroupLogs returns the logs of the metadata and the message stores of
+// a group which isn't opened, see closedGroupLog. The entries are never
+// fetched from the network.
+func (s *WeshOrbitDB) closedGroupLogs(ctx context.Context, coreAPI coreiface.CoreAPI, g *protocoltypes.Group) ([]groupLog, error) {
+	offlineAPI, err := coreAPI.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	linkKey, err := g.GetLinkKeyArray()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	sk, err := enc.NewSecretbox(linkKey[:])
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	cborIO := logio.CBOR()
+	cborIO.ApplyOptions(&logio.CBOROptions{LinkKey: sk})
+
+	provider := s.keyStore.getIdentityProvider()
+	fetch := func(ctx context.Context, id cid.Cid) (ipfslog.Entry, error) {
+		return entry.FromMultihashWithIO(ctx, offlineAPI, id, provider, cborIO)
+	}
+
+	groupCache := s.groupCache(g.GroupIDAsString())
+
+	logs := []groupLog{}
+	for _, store := range []struct{ kind, storeType string }{
+		{storeKindMetadata, s.groupMetadataStoreType},
+		{storeKindMessage, s.groupMessageStoreType},
+	} {
+		ac, err := defaultACForGroup(g, store.storeType)
+		if err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprintf("%s_%s", g.GroupIDAsString(), store.storeType)
+		addr, err := s.DetermineAddress(ctx, name, store.storeType, &orbitdb.DetermineAddressOptions{AccessController: ac})
+		if err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+		}
+
+		// the directory is ignored by the datastore caches
+		storeCache, err := groupCache.Load("", addr)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		heads, err := cachedStoreHeads(ctx, storeCache)
+		if err != nil {
+			return nil, err
+		}
+
+		logs = append(logs, &closedGroupLog{
+			kind:    store.kind,
+			address: addr.String(),
+			cache:   storeCache,
+			heads:   heads,
+			fetch:   fetch,
+		})
+	}
+
+	return logs, nil
+}
+
+// cachedStoreHeads returns the local and the replicated heads kept in the
+// cache of a store
+func cachedStoreHeads(ctx context.Context, storeCache ds.Datastore) ([]cid.Cid, error) {
+	seen := map[cid.Cid]struct{}{}
+	heads := []cid.Cid{}
+	for _, key := range storeHeadsCacheKeys {
+		data, err := storeCache.Get(ctx, key)
+		if err == ds.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		entries := []*entry.Entry{}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		for _, e := range entries {
+			if _, ok := seen[e.GetHash()]; ok {
+				continue
+			}
+
+			seen[e.GetHash()] = struct{}{}
+			heads = append(heads, e.GetHash())
+		}
+	}
+
+	return heads, nil
+}
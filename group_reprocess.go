@@ -0,0 +1,47 @@
+package weshnet
+
+import (
+	"context"
+)
+
+// reprocess processes the local logs of the group again from scratch: the
+// metadata and edit indexes are rebuilt and the messages are decrypted and
+// indexed again.
+// It returns the number of messages decrypted.
+func (gc *GroupContext) reprocess(ctx context.Context, indexer MessageIndexer) (uint64, error) {
+	if err := gc.metadataStore.Index().(*metadataStoreIndex).rebuild(gc.metadataStore.OpLog()); err != nil {
+		return 0, err
+	}
+
+	if indexer != nil {
+		// the index is partial until the history is indexed again
+		defer gc.startHistoryIndexing()()
+	}
+
+	if resetter, ok := indexer.(MessageIndexResetter); ok {
+		if err := resetter.ResetGroup(ctx, gc.group.PublicKey); err != nil {
+			return 0, err
+		}
+	}
+
+	gc.messageStore.edits.reset()
+	gc.messageStore.streams.reset()
+
+	// the messages which can't be decrypted yet are queued until the key of
+	// their device is received
+	history, err := gc.messageStore.ListEvents(ctx, nil, nil, false)
+	if err != nil {
+		return 0, err
+	}
+
+	messages := uint64(0)
+	for evt := range history {
+		messages++
+
+		if indexer != nil {
+			gc.indexMessage(ctx, indexer, evt)
+		}
+	}
+
+	return messages, ctx.Err()
+}
@@ -0,0 +1,84 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestServiceReprocessGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	indexer := NewInMemoryMessageIndexer()
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger, MessageIndexer: indexer}, nil)
+	defer cleanup()
+
+	created, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	sent := []cid.Cid{}
+	for _, payload := range []string{"hello world", "hello there"} {
+		reply, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte(payload),
+		})
+		require.NoError(t, err)
+
+		id, err := cid.Cast(reply.Cid)
+		require.NoError(t, err)
+		sent = append(sent, id)
+	}
+
+	search := func() []cid.Cid {
+		ids, err := indexer.SearchMessages(ctx, created.GroupPk, &MessageQuery{Tokens: []string{"hello"}})
+		require.NoError(t, err)
+		return ids
+	}
+
+	require.Eventually(t, func() bool {
+		return len(search()) == len(sent)
+	}, time.Second*5, time.Millisecond*100)
+
+	gc, err := node.Service.(*service).GetContextGroupForID(created.GroupPk)
+	require.NoError(t, err)
+
+	index := gc.metadataStore.Index().(*metadataStoreIndex)
+	members, devices := index.MemberCount(), index.DeviceCount()
+	require.NotZero(t, members)
+	require.NotZero(t, devices)
+
+	// corrupt the member list and the message index
+	index.lock.Lock()
+	index.members = map[string][]secretstore.MemberDevice{}
+	index.devices = map[string]secretstore.MemberDevice{}
+	index.lock.Unlock()
+	require.Zero(t, index.MemberCount())
+
+	bogus, err := cid.Parse("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	require.NoError(t, err)
+	require.NoError(t, indexer.IndexMessage(ctx, &IndexedMessage{GroupPK: created.GroupPk, ID: bogus, Tokens: []string{"hello"}}))
+	require.Len(t, search(), len(sent)+1)
+
+	reply, err := node.Client.ServiceReprocessGroup(ctx, &protocoltypes.ServiceReprocessGroup_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(sent)), reply.Messages)
+
+	// the state is rebuilt from the local logs only
+	require.Equal(t, members, index.MemberCount())
+	require.Equal(t, devices, index.DeviceCount())
+	require.ElementsMatch(t, sent, search())
+
+	_, err = node.Client.ServiceReprocessGroup(ctx, &protocoltypes.ServiceReprocessGroup_Request{GroupPk: []byte("unknown")})
+	require.Error(t, err)
+}
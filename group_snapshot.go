@@ -0,0 +1,353 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-ipfs-log/entry"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// groupSnapshotFetchTimeout bounds the retrieval of a snapshot on IPFS
+	groupSnapshotFetchTimeout = time.Minute
+	// groupSnapshotPrefetchConcurrency is the number of message entries of a
+	// snapshot fetched concurrently
+	groupSnapshotPrefetchConcurrency = 16
+)
+
+// newGroupSnapshot takes a snapshot of the current state of the group, signed
+// by the current device and with the signing key of the group
+func (gc *GroupContext) newGroupSnapshot() (*protocoltypes.GroupSnapshot, error) {
+	devicePK, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	members, err := gc.metadataStore.Index().(*metadataStoreIndex).listSnapshotMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &protocoltypes.GroupSnapshot{
+		GroupPk:           gc.group.PublicKey,
+		DevicePk:          devicePK,
+		CreatedAt:         time.Now().UnixNano(),
+		MetadataHeads:     storeHeads(gc.metadataStore),
+		MessageHeads:      storeHeads(gc.messageStore),
+		Members:           members,
+		SignedReceipts:    gc.metadataStore.SignedReceipts(),
+		DeliveryAcks:      gc.metadataStore.DeliveryAcks(),
+		MessageExpiration: int64(gc.metadataStore.MessageExpiration() / time.Second),
+	}
+
+	snapshot.MessageIndex = newMessageIndex(gc.messageStore.OpLog().GetEntries().Slice())
+
+	data, err := marshalGroupSnapshotForSignature(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot.Signature, err = gc.ownMemberDevice.DeviceSign(data); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	groupSK, err := gc.group.GetSigningPrivKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if snapshot.GroupSig, err = groupSK.Sign(data); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return snapshot, nil
+}
+
+// newMessageIndex returns the compacted index of the given message entries,
+// ordered by lamport clock with the most recent entries first
+func newMessageIndex(entries []ipfslog.Entry) []*protocoltypes.GroupSnapshot_MessageIndexEntry {
+	sorted := make([]ipfslog.Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].GetClock().GetTime() > sorted[j].GetClock().GetTime()
+	})
+
+	index := make([]*protocoltypes.GroupSnapshot_MessageIndexEntry, len(sorted))
+	for i, e := range sorted {
+		index[i] = &protocoltypes.GroupSnapshot_MessageIndexEntry{
+			Cid:       e.GetHash().Bytes(),
+			ClockTime: int64(e.GetClock().GetTime()),
+		}
+	}
+
+	return index
+}
+
+// latestSnapshot returns the last snapshot published by the current device
+func (gc *GroupContext) latestSnapshot() (*protocoltypes.GroupSnapshot, cid.Cid) {
+	gc.muSnapshot.Lock()
+	defer gc.muSnapshot.Unlock()
+
+	return gc.snapshot, gc.snapshotCID
+}
+
+func storeHeads(store orbitdb.Store) [][]byte {
+	rawHeads := store.OpLog().RawHeads()
+
+	heads := make([][]byte, rawHeads.Len())
+	for i, raw := range rawHeads.Slice() {
+		heads[i] = raw.GetHash().Bytes()
+	}
+
+	return heads
+}
+
+// marshalGroupSnapshotForSignature returns the signed part of a snapshot,
+// ie. the snapshot without its signatures
+func marshalGroupSnapshotForSignature(snapshot *protocoltypes.GroupSnapshot) ([]byte, error) {
+	unsigned := proto.Clone(snapshot).(*protocoltypes.GroupSnapshot)
+	unsigned.Signature = nil
+	unsigned.GroupSig = nil
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return data, nil
+}
+
+// verifyGroupSnapshot checks that a snapshot of the group has been signed by
+// one of the devices it lists and with the signing key of the group, so it
+// can't have been made by a peer outside of the group
+func verifyGroupSnapshot(g *protocoltypes.Group, snapshot *protocoltypes.GroupSnapshot) error {
+	if snapshot == nil || !bytes.Equal(snapshot.GroupPk, g.PublicKey) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("snapshot doesn't belong to the group"))
+	}
+
+	listed := false
+	for _, member := range snapshot.Members {
+		for _, devicePK := range member.DevicePks {
+			listed = listed || bytes.Equal(devicePK, snapshot.DevicePk)
+		}
+	}
+
+	if !listed {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("snapshot device isn't a member of the group"))
+	}
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(snapshot.DevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	data, err := marshalGroupSnapshotForSignature(snapshot)
+	if err != nil {
+		return err
+	}
+
+	if ok, err := devicePK.Verify(data, snapshot.Signature); err != nil || !ok {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid snapshot signature"))
+	}
+
+	groupPK, err := g.GetSigningPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := groupPK.Verify(data, snapshot.GroupSig); err != nil || !ok {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid snapshot group signature"))
+	}
+
+	return nil
+}
+
+// publishGroupSnapshot takes a snapshot of the group and stores it on IPFS so
+// the other peers can fetch it
+func (s *service) publishGroupSnapshot(ctx context.Context, gc *GroupContext) (*protocoltypes.GroupSnapshot, cid.Cid, error) {
+	snapshot, err := gc.newGroupSnapshot()
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return nil, cid.Undef, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	stat, err := s.ipfsCoreAPI.Block().Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		return nil, cid.Undef, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	id := stat.Path().RootCid()
+
+	gc.muSnapshot.Lock()
+	gc.snapshot, gc.snapshotCID = snapshot, id
+	gc.muSnapshot.Unlock()
+
+	return snapshot, id, nil
+}
+
+// startGroupSnapshots publishes a snapshot of the group at each interval
+func (s *service) startGroupSnapshots(gc *GroupContext, interval time.Duration) {
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-gc.ctx.Done():
+				return
+			}
+
+			if _, _, err := s.publishGroupSnapshot(gc.ctx, gc); err != nil {
+				gc.logger.Warn("unable to publish group snapshot", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// fetchGroupSnapshot retrieves a snapshot published by another peer on IPFS
+func (s *service) fetchGroupSnapshot(ctx context.Context, id cid.Cid) (*protocoltypes.GroupSnapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, groupSnapshotFetchTimeout)
+	defer cancel()
+
+	reader, err := s.ipfsCoreAPI.Block().Get(ctx, path.FromCid(id))
+	if err != nil {
+		return nil, errcode.ErrCode_ErrNotFound.Wrap(err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	snapshot := &protocoltypes.GroupSnapshot{}
+	if err := proto.Unmarshal(data, snapshot); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return snapshot, nil
+}
+
+// applyGroupSnapshot bootstraps the group from a snapshot taken by another
+// member: its members and settings are indexed right away, then the logs are
+// replicated from its heads. The message entries listed by the index of the
+// snapshot are fetched concurrently beforehand, the most recent first, instead
+// of one after the other while walking the log. The log replaces the snapshot
+// once its metadata heads have been replicated, peers without a snapshot still
+// get the same state through the replication.
+func (s *service) applyGroupSnapshot(gc *GroupContext, snapshot *protocoltypes.GroupSnapshot) error {
+	if err := verifyGroupSnapshot(gc.group, snapshot); err != nil {
+		return err
+	}
+
+	if err := gc.metadataStore.Index().(*metadataStoreIndex).applySnapshot(snapshot); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	metadataHeads, err := missingStoreEntries(gc.metadataStore, snapshot.MetadataHeads)
+	if err != nil {
+		return err
+	}
+
+	messageHeads, err := missingStoreEntries(gc.messageStore, snapshot.MessageHeads)
+	if err != nil {
+		return err
+	}
+
+	indexed := make([][]byte, len(snapshot.MessageIndex))
+	for i, e := range snapshot.MessageIndex {
+		indexed[i] = e.Cid
+	}
+
+	messageEntries, err := missingStoreEntries(gc.messageStore, indexed)
+	if err != nil {
+		return err
+	}
+
+	if len(metadataHeads) > 0 {
+		gc.metadataStore.Replicator().Load(gc.ctx, metadataHeads)
+	}
+
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+
+		s.prefetchStoreEntries(gc.ctx, messageEntries)
+
+		if len(messageHeads) > 0 && gc.ctx.Err() == nil {
+			gc.messageStore.Replicator().Load(gc.ctx, messageHeads)
+		}
+	}()
+
+	return nil
+}
+
+// missingStoreEntries returns the entries with the given cids which aren't
+// part of the log of the store yet
+func missingStoreEntries(store orbitdb.Store, ids [][]byte) ([]ipfslog.Entry, error) {
+	entries := []ipfslog.Entry{}
+	for _, idBytes := range ids {
+		id, err := cid.Cast(idBytes)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if _, ok := store.OpLog().Get(id); !ok {
+			entries = append(entries, &entry.Entry{Hash: id})
+		}
+	}
+
+	return entries, nil
+}
+
+// prefetchStoreEntries fetches the blocks of the entries so they are found
+// locally once the log is walked, the entries which can't be fetched are
+// skipped
+func (s *service) prefetchStoreEntries(ctx context.Context, entries []ipfslog.Entry) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	sem := make(chan struct{}, groupSnapshotPrefetchConcurrency)
+	for _, e := range entries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fetchCtx, cancel := context.WithTimeout(ctx, groupSnapshotFetchTimeout)
+			defer cancel()
+
+			if _, err := s.ipfsCoreAPI.Block().Get(fetchCtx, path.FromCid(e.GetHash())); err != nil {
+				s.logger.Debug("unable to prefetch snapshot entry", zap.Error(err))
+			}
+		}()
+	}
+}
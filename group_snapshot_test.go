@@ -0,0 +1,213 @@
+package weshnet_test
+
+import (
+	"context"
+	crand "crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestGroupSnapshotBootstrap(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	// the nodes use distinct discovery servers so they can't find each other
+	// until they are connected explicitly
+	newNode := func(name string) (*weshnet.TestingProtocol, func()) {
+		return weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+			Mocknet:         mn,
+			Logger:          logger.Named(name),
+			DiscoveryServer: tinder.NewMockDriverServer(),
+		}, nil)
+	}
+
+	nodeA, cleanupA := newNode("a")
+	defer cleanupA()
+
+	nodeB, cleanupB := newNode("b")
+	defer cleanupB()
+
+	nodeC, cleanupC := newNode("c")
+	defer cleanupC()
+
+	group, _, err := weshnet.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	join := func(node *weshnet.TestingProtocol) {
+		_, err := node.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: group})
+		require.NoError(t, err)
+
+		_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+	}
+
+	join(nodeA)
+
+	const backlog = 10
+	for i := 0; i < backlog; i++ {
+		_, err := nodeA.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: group.PublicKey,
+			Payload: []byte("backlog"),
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = nodeA.Client.GroupSignedReceiptsSet(ctx, &protocoltypes.GroupSignedReceiptsSet_Request{
+		GroupPk: group.PublicKey,
+		Enabled: true,
+	})
+	require.NoError(t, err)
+
+	snapshot, err := nodeA.Client.GroupSnapshotGet(ctx, &protocoltypes.GroupSnapshotGet_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+	require.NotEmpty(t, snapshot.Cid)
+	require.Len(t, snapshot.Snapshot.MessageIndex, backlog)
+	for i := 1; i < backlog; i++ {
+		require.GreaterOrEqual(t, snapshot.Snapshot.MessageIndex[i-1].ClockTime, snapshot.Snapshot.MessageIndex[i].ClockTime)
+	}
+
+	infoA, err := nodeA.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	join(nodeB)
+	join(nodeC)
+
+	hasDevice := func(node *weshnet.TestingProtocol, devicePK []byte) bool {
+		info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+
+		for _, device := range info.Devices {
+			if string(device.DevicePk) == string(devicePK) {
+				return true
+			}
+		}
+		return false
+	}
+
+	signedReceipts := func(node *weshnet.TestingProtocol) bool {
+		info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+		return info.SignedReceipts
+	}
+
+	// a snapshot must be provided by value or by cid
+	_, err = nodeB.Client.GroupSnapshotApply(ctx, &protocoltypes.GroupSnapshotApply_Request{GroupPk: group.PublicKey})
+	require.Error(t, err)
+
+	// a tampered snapshot is rejected
+	tampered := proto.Clone(snapshot.Snapshot).(*protocoltypes.GroupSnapshot)
+	tampered.SignedReceipts = false
+	_, err = nodeB.Client.GroupSnapshotApply(ctx, &protocoltypes.GroupSnapshotApply_Request{
+		GroupPk:  group.PublicKey,
+		Snapshot: tampered,
+	})
+	require.Error(t, err)
+
+	// a device lists itself as a member of a snapshot it signs, the snapshot
+	// is only accepted if it is also signed with the secret of the group
+	memberSK, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	deviceSK, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	memberPK, err := memberSK.GetPublic().Raw()
+	require.NoError(t, err)
+
+	devicePK, err := deviceSK.GetPublic().Raw()
+	require.NoError(t, err)
+
+	forged := proto.Clone(snapshot.Snapshot).(*protocoltypes.GroupSnapshot)
+	forged.DevicePk = devicePK
+	forged.GroupSig = nil
+	forged.Signature = nil
+	forged.Members = append(forged.Members, &protocoltypes.GroupSnapshot_Member{
+		MemberPk:  memberPK,
+		DevicePks: [][]byte{devicePK},
+	})
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(forged)
+	require.NoError(t, err)
+
+	forged.Signature, err = deviceSK.Sign(data)
+	require.NoError(t, err)
+
+	_, err = nodeB.Client.GroupSnapshotApply(ctx, &protocoltypes.GroupSnapshotApply_Request{
+		GroupPk:  group.PublicKey,
+		Snapshot: forged,
+	})
+	require.Error(t, err)
+
+	groupSK, err := group.GetSigningPrivKey()
+	require.NoError(t, err)
+
+	forged.GroupSig, err = groupSK.Sign(data)
+	require.NoError(t, err)
+
+	_, err = nodeB.Client.GroupSnapshotApply(ctx, &protocoltypes.GroupSnapshotApply_Request{
+		GroupPk:  group.PublicKey,
+		Snapshot: forged,
+	})
+	require.NoError(t, err)
+
+	// the node bootstrapped from the snapshot knows the state of the group
+	// before having replicated a single entry, unlike the other new member
+	require.True(t, hasDevice(nodeB, infoA.DevicePk))
+	require.True(t, hasDevice(nodeB, devicePK))
+	require.True(t, signedReceipts(nodeB))
+
+	require.False(t, hasDevice(nodeC, infoA.DevicePk))
+	require.False(t, signedReceipts(nodeC))
+
+	weshnet.ConnectAll(t, mn)
+
+	countMessages := func(node *weshnet.TestingProtocol) int {
+		sub, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  group.PublicKey,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		count := 0
+		for {
+			_, err := sub.Recv()
+			if err == io.EOF {
+				return count
+			}
+			require.NoError(t, err)
+			count++
+		}
+	}
+
+	// both new members then reach the same state by replication
+	for _, node := range []*weshnet.TestingProtocol{nodeB, nodeC} {
+		require.Eventually(t, func() bool {
+			return hasDevice(node, infoA.DevicePk) && signedReceipts(node) && countMessages(node) == backlog
+		}, time.Second*30, time.Millisecond*100)
+	}
+
+	// the members only listed by the snapshot are dropped once the log has
+	// been replicated up to its heads
+	require.Eventually(t, func() bool {
+		return !hasDevice(nodeB, devicePK)
+	}, time.Second*30, time.Millisecond*100)
+}
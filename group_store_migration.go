@@ -0,0 +1,448 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"berty.tech/go-orbit-db/cache"
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/internal/datastoreutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// groupStoreBlocksNamespace holds the blocks of the entries copied to the
+// datastore of a migrated group
+const groupStoreBlocksNamespace = "blocks"
+
+// ServiceMigrateGroupStore moves the stores of an activated group to a
+// datastore in another directory, see MigrateGroupStore
+func (s *service) ServiceMigrateGroupStore(ctx context.Context, req *protocoltypes.ServiceMigrateGroupStore_Request) (*protocoltypes.ServiceMigrateGroupStore_Reply, error) {
+	if err := s.MigrateGroupStore(ctx, req.GroupPk, req.TargetDir); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ServiceMigrateGroupStore_Reply{}, nil
+}
+
+// MigrateGroupStore moves the stores of an opened group to the datastore in
+// targetDir, their logs and the blocks of their entries are copied so they
+// don't have to be replicated again from the other members. targetDir is
+// either InMemoryDirectory or a directory inside the datastore directory of
+// the service, a relative path is resolved from it.
+// The blocks are read back from the target once copied, then the directory of
+// the group is recorded in the root datastore and the group is reopened on
+// the target. The previous directory is recorded again and the group is
+// reopened on its previous datastore if any of these steps fail or if the
+// heads of the copied stores don't match the heads of the source stores, so
+// the group is never left recorded on a partial copy. The source datastore is
+// left untouched. The group is opened locally only again if it was.
+// A group moved to an in memory datastore is opened from the default one
+// after a restart.
+func (s *service) MigrateGroupStore(ctx context.Context, groupPK []byte, targetDir string) error {
+	if targetDir == "" {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no target directory provided"))
+	}
+
+	dir, err := s.groupStoreDir(targetDir)
+	if err != nil {
+		return err
+	}
+
+	ctx, done, err := s.beginWrite(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	gc, err := s.GetContextGroupForID(groupPK)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+
+	if gc.Group().GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		return errcode.ErrCode_ErrGroupInvalidType.Wrap(fmt.Errorf("the account group can't be migrated"))
+	}
+
+	pk, err := gc.Group().GetPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	target, err := s.openGroupStoreDatastore(dir)
+	if err != nil {
+		return errcode.ErrCode_ErrDBMigrate.Wrap(err)
+	}
+
+	groupID := gc.Group().GroupIDAsString()
+	sourceCache := s.odb.groupCache(groupID)
+	targetCache := NewOrbitDatastoreCache(target)
+	localOnly := s.isGroupLocalOnly(groupPK)
+
+	previousDir, err := s.rootDatastore.Get(ctx, groupStoreDirKey(groupID))
+	if err == ds.ErrNotFound {
+		previousDir = nil
+	} else if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	// the stores are closed so their caches are flushed before being copied
+	if err := s.deactivateGroup(pk); err != nil {
+		return errcode.ErrCode_ErrGroupDeactivate.Wrap(err)
+	}
+
+	stores := []iface.Store{gc.MetadataStore(), gc.MessageStore()}
+	sourceHeads := make([][][]byte, len(stores))
+	for i, store := range stores {
+		sourceHeads[i] = storeHeads(store)
+	}
+
+	if err := copyStoreCaches(ctx, sourceCache, targetCache, stores); err != nil {
+		return multierr.Append(errcode.ErrCode_ErrDBMigrate.Wrap(err), s.reopenGroupStores(ctx, gc, sourceCache, localOnly))
+	}
+
+	if err := s.copyStoreBlocks(ctx, target, stores); err != nil {
+		return multierr.Append(errcode.ErrCode_ErrDBMigrate.Wrap(err), s.reopenGroupStores(ctx, gc, sourceCache, localOnly))
+	}
+
+	// rollback records the previous directory of the group and reopens it on
+	// its previous datastore
+	rollback := func(err error, opened bool) error {
+		if opened {
+			if derr := s.deactivateGroup(pk); derr != nil {
+				return multierr.Append(err, errcode.ErrCode_ErrGroupDeactivate.Wrap(derr))
+			}
+		}
+
+		if serr := s.setGroupStoreDir(ctx, groupID, previousDir); serr != nil {
+			err = multierr.Append(err, serr)
+		}
+
+		return multierr.Append(err, s.reopenGroupStores(ctx, gc, sourceCache, localOnly))
+	}
+
+	// the directory is recorded first so the group is never opened on the
+	// target without being reopened on it after a restart
+	if targetDir == InMemoryDirectory {
+		err = s.setGroupStoreDir(ctx, groupID, nil)
+	} else {
+		err = s.setGroupStoreDir(ctx, groupID, []byte(targetDir))
+	}
+	if err != nil {
+		return rollback(err, false)
+	}
+
+	if err := s.reopenGroupStores(ctx, gc, targetCache, localOnly); err != nil {
+		return rollback(errcode.ErrCode_ErrDBMigrate.Wrap(err), false)
+	}
+
+	migrated, err := s.GetContextGroupForID(groupPK)
+	if err != nil {
+		return rollback(errcode.ErrCode_ErrGroupMissing.Wrap(err), false)
+	}
+
+	for i, store := range []iface.Store{migrated.MetadataStore(), migrated.MessageStore()} {
+		if equalHeads(sourceHeads[i], storeHeads(store)) {
+			continue
+		}
+
+		s.logger.Error("the heads of a migrated store don't match the source, rolling back", zap.String("store", store.Address().String()))
+
+		return rollback(errcode.ErrCode_ErrDBMigrate.Wrap(fmt.Errorf("the heads of the store %s don't match the source", store.Address())), true)
+	}
+
+	return nil
+}
+
+// groupStoreDir returns the directory of the datastore of a migrated group,
+// dir must be InMemoryDirectory or a directory inside the datastore directory
+// of the service
+func (s *service) groupStoreDir(dir string) (string, error) {
+	if dir == InMemoryDirectory {
+		return dir, nil
+	}
+
+	if s.datastoreDir == "" || s.datastoreDir == InMemoryDirectory {
+		return "", errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the datastore of the service is in memory, the groups can only be moved in memory"))
+	}
+
+	root, err := filepath.Abs(s.datastoreDir)
+	if err != nil {
+		return "", errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+
+	rel, err := filepath.Rel(root, filepath.Clean(dir))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the target directory must be inside the datastore directory"))
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// setGroupStoreDir records the directory the stores of a group are opened
+// from, the record is removed if dir is nil
+func (s *service) setGroupStoreDir(ctx context.Context, groupID string, dir []byte) error {
+	var err error
+	if dir == nil {
+		err = s.rootDatastore.Delete(ctx, groupStoreDirKey(groupID))
+	} else {
+		err = s.rootDatastore.Put(ctx, groupStoreDirKey(groupID), dir)
+	}
+	if err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return s.rootDatastore.Sync(ctx, groupStoreDirKey(groupID))
+}
+
+func groupStoreDirKey(groupID string) ds.Key {
+	return ds.NewKey(NamespaceGroupStoreDirs).ChildString(groupID)
+}
+
+// openGroupStoreDatastore returns the datastore in dir, it is opened once
+// and closed along with the service
+func (s *service) openGroupStoreDatastore(dir string) (ds.Batching, error) {
+	s.muGroupStoreDatastores.Lock()
+	defer s.muGroupStoreDatastores.Unlock()
+
+	if dir != InMemoryDirectory {
+		if opened, ok := s.groupStoreDatastores[dir]; ok {
+			return opened, nil
+		}
+	}
+
+	var opened ds.Batching
+	if dir == InMemoryDirectory {
+		opened = ds_sync.MutexWrap(ds.NewMapDatastore())
+	} else {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+
+		bds, err := newBadgerDatastore(dir)
+		if err != nil {
+			return nil, err
+		}
+		opened = bds
+	}
+
+	if s.groupStoreDatastores == nil {
+		s.groupStoreDatastores = make(map[string]ds.Batching)
+	}
+	if dir != InMemoryDirectory {
+		s.groupStoreDatastores[dir] = opened
+	}
+
+	return opened, nil
+}
+
+// restoreGroupStore makes the stores of a migrated group open from the
+// datastore it has been migrated to, see MigrateGroupStore
+func (s *service) restoreGroupStore(ctx context.Context, g *protocoltypes.Group) error {
+	groupID := g.GroupIDAsString()
+	if _, ok := s.odb.groupCaches.Load(groupID); ok {
+		return nil
+	}
+
+	dir, err := s.rootDatastore.Get(ctx, groupStoreDirKey(groupID))
+	if err == ds.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	resolved, err := s.groupStoreDir(string(dir))
+	if err != nil {
+		return err
+	}
+
+	target, err := s.openGroupStoreDatastore(resolved)
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	s.odb.setGroupCache(groupID, NewOrbitDatastoreCache(target))
+
+	return nil
+}
+
+// closeGroupStoreDatastores closes the datastores of the migrated groups
+func (s *service) closeGroupStoreDatastores() error {
+	s.muGroupStoreDatastores.Lock()
+	defer s.muGroupStoreDatastores.Unlock()
+
+	var err error
+	for dir, opened := range s.groupStoreDatastores {
+		err = multierr.Append(err, opened.Close())
+		delete(s.groupStoreDatastores, dir)
+	}
+
+	return err
+}
+
+// copyStoreBlocks copies the blocks of the entries of each store to the
+// target, each block is checked against its cid before being written and
+// once read back from the target
+func (s *service) copyStoreBlocks(ctx context.Context, target ds.Batching, stores []iface.Store) error {
+	blocks := datastoreutil.NewNamespacedDatastore(target, ds.NewKey(groupStoreBlocksNamespace))
+
+	copied := []cid.Cid{}
+	for _, store := range stores {
+		for _, e := range store.OpLog().GetEntries().Slice() {
+			id := e.GetHash()
+
+			reader, err := s.ipfsCoreAPI.Block().Get(ctx, path.FromCid(id))
+			if err != nil {
+				return fmt.Errorf("unable to get the block %s: %w", id, err)
+			}
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return fmt.Errorf("unable to read the block %s: %w", id, err)
+			}
+
+			if err := checkBlock(id, data); err != nil {
+				return err
+			}
+
+			if err := blocks.Put(ctx, ds.NewKey(id.String()), data); err != nil {
+				return err
+			}
+
+			copied = append(copied, id)
+		}
+	}
+
+	if err := target.Sync(ctx, ds.NewKey("/")); err != nil {
+		return err
+	}
+
+	for _, id := range copied {
+		data, err := blocks.Get(ctx, ds.NewKey(id.String()))
+		if err != nil {
+			return fmt.Errorf("unable to read back the block %s: %w", id, err)
+		}
+
+		if err := checkBlock(id, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkBlock checks that data is the content of the block id
+func checkBlock(id cid.Cid, data []byte) error {
+	sum, err := id.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+
+	if !sum.Equals(id) {
+		return fmt.Errorf("the block %s doesn't match its cid", id)
+	}
+
+	return nil
+}
+
+// reopenGroupStores activates again a group deactivated for a migration,
+// its stores are opened from the given cache
+func (s *service) reopenGroupStores(ctx context.Context, gc *GroupContext, c cache.Interface, localOnly bool) error {
+	groupID := gc.Group().GroupIDAsString()
+
+	if c == s.odb.cache {
+		s.odb.setGroupCache(groupID, nil)
+	} else {
+		s.odb.setGroupCache(groupID, c)
+	}
+
+	pk, err := gc.Group().GetPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if err := s.activateGroup(ctx, pk, localOnly); err != nil {
+		return errcode.ErrCode_ErrGroupActivate.Wrap(err)
+	}
+
+	return nil
+}
+
+// copyStoreCaches copies the cache of each store, ie. its heads, from the
+// source to the target, the entries themselves are kept in the blockstore
+func copyStoreCaches(ctx context.Context, source, target cache.Interface, stores []iface.Store) error {
+	for _, store := range stores {
+		// the directory is ignored by the datastore caches
+		src, err := source.Load("", store.Address())
+		if err != nil {
+			return err
+		}
+
+		dst, err := target.Load("", store.Address())
+		if err != nil {
+			return err
+		}
+
+		results, err := src.Query(ctx, query.Query{})
+		if err != nil {
+			return err
+		}
+
+		for result := range results.Next() {
+			if result.Error != nil {
+				results.Close()
+				return result.Error
+			}
+
+			if err := dst.Put(ctx, ds.NewKey(result.Key), result.Value); err != nil {
+				results.Close()
+				return err
+			}
+		}
+
+		if err := results.Close(); err != nil {
+			return err
+		}
+
+		if err := dst.Sync(ctx, ds.NewKey("/")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func equalHeads(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	heads := make(map[string]struct{}, len(a))
+	for _, head := range a {
+		heads[string(head)] = struct{}{}
+	}
+
+	for _, head := range b {
+		if _, ok := heads[string(head)]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,202 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestMigrateGroupStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Mocknet: mn}, nil)
+	defer cleanup()
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	createRep, err := s.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	// populate the group
+	sent := map[string]struct{}{}
+	for i := 0; i < 5; i++ {
+		rep, err := s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: createRep.GroupPk,
+			Payload: []byte(fmt.Sprintf("message %d", i)),
+		})
+		require.NoError(t, err)
+
+		_, id, err := cid.CidFromBytes(rep.Cid)
+		require.NoError(t, err)
+		sent[id.String()] = struct{}{}
+	}
+
+	gc, err := s.GetContextGroupForID(createRep.GroupPk)
+	require.NoError(t, err)
+	messageHeads := storeHeads(gc.MessageStore())
+	metadataEntries := gc.MetadataStore().OpLog().GetEntries().Len()
+
+	s.datastoreDir = t.TempDir()
+	targetDir := filepath.Join(s.datastoreDir, "migrated")
+
+	// the target must be inside the datastore directory
+	for _, outside := range []string{t.TempDir(), "../outside", s.datastoreDir} {
+		_, err = s.ServiceMigrateGroupStore(ctx, &protocoltypes.ServiceMigrateGroupStore_Request{GroupPk: createRep.GroupPk, TargetDir: outside})
+		require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput), outside)
+	}
+
+	// a group must be opened to be migrated
+	_, err = s.ServiceMigrateGroupStore(ctx, &protocoltypes.ServiceMigrateGroupStore_Request{GroupPk: []byte("unknown"), TargetDir: targetDir})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrGroupMissing))
+
+	_, err = s.ServiceMigrateGroupStore(ctx, &protocoltypes.ServiceMigrateGroupStore_Request{GroupPk: createRep.GroupPk})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	_, err = s.ServiceMigrateGroupStore(ctx, &protocoltypes.ServiceMigrateGroupStore_Request{GroupPk: createRep.GroupPk, TargetDir: targetDir})
+	require.NoError(t, err)
+
+	s.muGroupStoreDatastores.Lock()
+	target, ok := s.groupStoreDatastores[targetDir]
+	s.muGroupStoreDatastores.Unlock()
+	require.True(t, ok)
+
+	// the caches of the stores have been copied to the target
+	results, err := target.Query(ctx, query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	copied, err := results.Rest()
+	require.NoError(t, err)
+	require.NotEmpty(t, copied)
+
+	// along with the blocks of their entries
+	for _, e := range gc.MessageStore().OpLog().GetEntries().Slice() {
+		has, err := target.Has(ctx, ds.NewKey(groupStoreBlocksNamespace).ChildString(e.GetHash().String()))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// the directory of the group is kept
+	dir, err := s.rootDatastore.Get(ctx, groupStoreDirKey(gc.Group().GroupIDAsString()))
+	require.NoError(t, err)
+	require.Equal(t, targetDir, string(dir))
+
+	// the group has been reopened with the same logs
+	migrated, err := s.GetContextGroupForID(createRep.GroupPk)
+	require.NoError(t, err)
+	require.NotSame(t, gc, migrated)
+	require.ElementsMatch(t, messageHeads, storeHeads(migrated.MessageStore()))
+	require.Equal(t, metadataEntries, migrated.MetadataStore().OpLog().GetEntries().Len())
+
+	for _, e := range migrated.MessageStore().OpLog().GetEntries().Slice() {
+		delete(sent, e.GetHash().String())
+	}
+	require.Empty(t, sent)
+
+	// the new messages follow the migrated log
+	rep, err := s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: createRep.GroupPk,
+		Payload: []byte("after migration"),
+	})
+	require.NoError(t, err)
+
+	_, id, err := cid.CidFromBytes(rep.Cid)
+	require.NoError(t, err)
+
+	e, ok := migrated.MessageStore().OpLog().Get(id)
+	require.True(t, ok)
+
+	next := make([][]byte, len(e.GetNext()))
+	for i, c := range e.GetNext() {
+		next[i] = c.Bytes()
+	}
+	require.ElementsMatch(t, messageHeads, next)
+	require.ElementsMatch(t, [][]byte{rep.Cid}, storeHeads(migrated.MessageStore()))
+}
+
+func TestMigrateGroupStoreReopened(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Mocknet: mn}, nil)
+	defer cleanup()
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	createRep, err := s.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	_, err = s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: createRep.GroupPk,
+		Payload: []byte("before migration"),
+	})
+	require.NoError(t, err)
+
+	// a relative target is resolved from the datastore directory
+	s.datastoreDir = t.TempDir()
+	require.NoError(t, s.MigrateGroupStore(ctx, createRep.GroupPk, "migrated"))
+
+	s.muGroupStoreDatastores.Lock()
+	_, ok = s.groupStoreDatastores[filepath.Join(s.datastoreDir, "migrated")]
+	s.muGroupStoreDatastores.Unlock()
+	require.True(t, ok)
+
+	gc, err := s.GetContextGroupForID(createRep.GroupPk)
+	require.NoError(t, err)
+	messageHeads := storeHeads(gc.MessageStore())
+
+	pk, err := gc.Group().GetPubKey()
+	require.NoError(t, err)
+
+	// the store selection is lost by the stores, as after a restart
+	groupID := gc.Group().GroupIDAsString()
+	require.NoError(t, s.deactivateGroup(pk))
+	s.odb.setGroupCache(groupID, nil)
+
+	// the group is opened again from the directory it has been moved to
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	_, ok = s.odb.groupCaches.Load(groupID)
+	require.True(t, ok)
+
+	reopened, err := s.GetContextGroupForID(createRep.GroupPk)
+	require.NoError(t, err)
+	require.ElementsMatch(t, messageHeads, storeHeads(reopened.MessageStore()))
+
+	// a group opened locally is reopened locally
+	require.NoError(t, s.deactivateGroup(pk))
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk, LocalOnly: true})
+	require.NoError(t, err)
+
+	// the in memory targets are not kept
+	require.NoError(t, s.MigrateGroupStore(ctx, createRep.GroupPk, InMemoryDirectory))
+	require.True(t, s.isGroupLocalOnly(createRep.GroupPk))
+
+	_, err = s.rootDatastore.Get(ctx, groupStoreDirKey(groupID))
+	require.ErrorIs(t, err, ds.ErrNotFound)
+}
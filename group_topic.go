@@ -0,0 +1,141 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// pubsubDiscoveryNamespacePrefix is prepended by pubsub to the topics it
+// advertises and looks up, it isn't exported by go-libp2p-pubsub
+const pubsubDiscoveryNamespacePrefix = "floodsub:"
+
+// groupTopicPattern is the format of the custom topics of the groups
+var groupTopicPattern = regexp.MustCompile(`^[a-zA-Z0-9._/-]{1,128}$`)
+
+func validateGroupTopic(topic string) error {
+	if !groupTopicPattern.MatchString(topic) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid group topic %q", topic))
+	}
+
+	return nil
+}
+
+// groupTopics holds the custom pubsub topics of the groups and of their
+// stores. The stores of the groups without a custom topic use their address
+// as topic. The topics of the groups are kept in the datastore so they are
+// applied again when the groups are activated after a restart.
+type groupTopics struct {
+	ds       datastore.Batching
+	muTopics sync.RWMutex
+	groups   map[string]string // group id -> custom topic
+	stores   map[string]string // store address -> pubsub topic
+}
+
+func newGroupTopics(ctx context.Context, ds datastore.Batching) (*groupTopics, error) {
+	t := &groupTopics{
+		ds:     ds,
+		groups: make(map[string]string),
+		stores: make(map[string]string),
+	}
+
+	results, err := ds.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		t.groups[datastore.RawKey(result.Key).BaseNamespace()] = string(result.Value)
+	}
+
+	return t, nil
+}
+
+func groupTopicKey(groupID string) datastore.Key {
+	return datastore.NewKey(groupID)
+}
+
+// setGroup sets the custom topic of a group, the topic is removed if empty.
+// An error is returned if the topic is already used by another group.
+func (t *groupTopics) setGroup(ctx context.Context, groupID string, topic string) error {
+	t.muTopics.Lock()
+	defer t.muTopics.Unlock()
+
+	if topic == "" {
+		if err := t.ds.Delete(ctx, groupTopicKey(groupID)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		delete(t.groups, groupID)
+		return nil
+	}
+
+	for id, other := range t.groups {
+		if id != groupID && other == topic {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group topic %q is already used by another group", topic))
+		}
+	}
+
+	if err := t.ds.Put(ctx, groupTopicKey(groupID), []byte(topic)); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	t.groups[groupID] = topic
+	return nil
+}
+
+// registerStore maps the address of a store of the group to the pubsub topic
+// it must use, the store must be opened afterward
+func (t *groupTopics) registerStore(groupID string, address string, storeType string) {
+	t.muTopics.Lock()
+	defer t.muTopics.Unlock()
+
+	topic, ok := t.groups[groupID]
+	if !ok {
+		delete(t.stores, address)
+		return
+	}
+
+	t.stores[address] = fmt.Sprintf("%s_%s", topic, storeType)
+}
+
+// storeTopic returns the pubsub topic used by the store at the given address
+func (t *groupTopics) storeTopic(address string) string {
+	t.muTopics.RLock()
+	defer t.muTopics.RUnlock()
+
+	if topic, ok := t.stores[address]; ok {
+		return topic
+	}
+
+	return address
+}
+
+// storeDiscoveryNamespace returns the namespace under which pubsub advertises
+// and looks up the peers of the store at the given address
+func (t *groupTopics) storeDiscoveryNamespace(address string) string {
+	return pubsubDiscoveryNamespacePrefix + t.storeTopic(address)
+}
+
+// groupTopicsPubSub subscribes the stores to their custom topic if any
+type groupTopicsPubSub struct {
+	iface.PubSubInterface
+
+	topics *groupTopics
+}
+
+func (p *groupTopicsPubSub) TopicSubscribe(ctx context.Context, topic string) (iface.PubSubTopic, error) {
+	return p.PubSubInterface.TopicSubscribe(ctx, p.topics.storeTopic(topic))
+}
@@ -0,0 +1,103 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+func TestGroupTopicsPersisted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := dsync.MutexWrap(ds.NewMapDatastore())
+
+	topics, err := newGroupTopics(ctx, store)
+	require.NoError(t, err)
+
+	require.NoError(t, topics.setGroup(ctx, "group_a", "bridge/a"))
+	require.NoError(t, topics.setGroup(ctx, "group_b", "bridge/b"))
+	require.NoError(t, topics.setGroup(ctx, "group_b", ""))
+
+	// the topics are loaded again on restart and applied to the stores
+	topics, err = newGroupTopics(ctx, store)
+	require.NoError(t, err)
+
+	topics.registerStore("group_a", "/orbitdb/a_metadata", "metadata")
+	require.Equal(t, "bridge/a_metadata", topics.storeTopic("/orbitdb/a_metadata"))
+
+	topics.registerStore("group_b", "/orbitdb/b_metadata", "metadata")
+	require.Equal(t, "/orbitdb/b_metadata", topics.storeTopic("/orbitdb/b_metadata"))
+
+	// the topic of a group is still reserved after a restart
+	err = topics.setGroup(ctx, "group_b", "bridge/a")
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+}
+
+// advertisedDiscovery reports the namespaces advertised by pubsub
+type advertisedDiscovery struct {
+	advertised chan string
+}
+
+func (d *advertisedDiscovery) Advertise(_ context.Context, ns string, _ ...discovery.Option) (time.Duration, error) {
+	select {
+	case d.advertised <- ns:
+	default:
+	}
+
+	return time.Hour, nil
+}
+
+func (d *advertisedDiscovery) FindPeers(context.Context, string, ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	ch := make(chan peer.AddrInfo)
+	close(ch)
+	return ch, nil
+}
+
+func TestGroupTopicsDiscoveryNamespace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topics, err := newGroupTopics(ctx, dsync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, err)
+
+	require.NoError(t, topics.setGroup(ctx, "group_a", "bridge/a"))
+	topics.registerStore("group_a", "/orbitdb/a_metadata", "metadata")
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	disc := &advertisedDiscovery{advertised: make(chan string, 1)}
+	ps, err := pubsub.NewGossipSub(ctx, h, pubsub.WithDiscovery(disc))
+	require.NoError(t, err)
+
+	topic, err := ps.Join(topics.storeTopic("/orbitdb/a_metadata"))
+	require.NoError(t, err)
+	defer topic.Close()
+
+	sub, err := topic.Subscribe()
+	require.NoError(t, err)
+	defer sub.Cancel()
+
+	// the namespace must match the one advertised by pubsub for the topic of
+	// the store
+	select {
+	case ns := <-disc.advertised:
+		require.Equal(t, topics.storeDiscoveryNamespace("/orbitdb/a_metadata"), ns)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the topic of the store should be advertised")
+	}
+}
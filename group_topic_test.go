@@ -0,0 +1,87 @@
+package weshnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestServiceSetGroupTopic(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		ConnectFunc:     weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	const topic = "bridge/external-group"
+	for _, node := range nodes {
+		_, err := node.Client.ServiceSetGroupTopic(ctx, &protocoltypes.ServiceSetGroupTopic_Request{
+			GroupPk: group.PublicKey,
+			Topic:   topic,
+		})
+		require.NoError(t, err)
+	}
+
+	// the stores of the group are subscribed to the custom topics
+	require.Eventually(t, func() bool {
+		subscribed := map[string]bool{}
+		for _, name := range nodes[0].Opts.PubSub.GetTopics() {
+			subscribed[name] = true
+		}
+
+		return subscribed[topic+"_wesh_group_metadata"] && subscribed[topic+"_wesh_group_messages"]
+	}, time.Second*10, time.Millisecond*100)
+
+	sendMessageOnGroup(ctx, t, nodes, nodes, group.PublicKey, []string{"through the custom topic"})
+
+	// the topic can't be used by another group
+	other := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes[0])
+	_, err := nodes[0].Client.ServiceSetGroupTopic(ctx, &protocoltypes.ServiceSetGroupTopic_Request{
+		GroupPk: other.PublicKey,
+		Topic:   topic,
+	})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	// nor have an invalid format
+	_, err = nodes[0].Client.ServiceSetGroupTopic(ctx, &protocoltypes.ServiceSetGroupTopic_Request{
+		GroupPk: other.PublicKey,
+		Topic:   "invalid topic!",
+	})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	// the topic of the account group can't be set
+	config, err := nodes[0].Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	_, err = nodes[0].Client.ServiceSetGroupTopic(ctx, &protocoltypes.ServiceSetGroupTopic_Request{
+		GroupPk: config.AccountGroupPk,
+		Topic:   "account",
+	})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+}
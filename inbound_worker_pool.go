@@ -0,0 +1,376 @@
+package weshnet
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// defaultInboundWorkers is the default number of entries received from the
+// group stores which can be processed concurrently
+const defaultInboundWorkers = 4
+
+// workerPoolLabel is the pprof label set on the goroutines of the worker
+// pools, goroutine profiles can be filtered on it
+const workerPoolLabel = "weshnet-pool"
+
+// inboundWorkerPool bounds the number of entries received from the group
+// stores which are processed (decrypted, validated and indexed) concurrently,
+// whatever the number of opened groups is.
+// Submitting a task blocks until a worker is available, meanwhile the stores
+// stop consuming their events which applies backpressure on the replication
+// instead of piling up goroutines.
+// The tasks of a group are picked according to its priority, see
+// setGroupPriority.
+// The context given to a task marks it as running on a worker, a task
+// submitting another one with it runs it inline instead of waiting for a
+// worker which may never be available.
+type inboundWorkerPool struct {
+	ctx  context.Context
+	size int
+
+	// queues holds the submitted tasks by priority of their group, the
+	// workers drain a queue before picking from the next one
+	muQueues sync.Mutex
+	queues   [priorityLevels][]*inboundTask
+	// queued is signaled when a task is queued
+	queued chan struct{}
+	// throttled is held while a task of a throttled group is submitted or
+	// processed, so a single one is processed at a time
+	throttled chan struct{}
+
+	muPriorities sync.RWMutex
+	priorities   map[string]protocoltypes.GroupPriority
+
+	// limit is the number of workers allowed to process tasks, the other
+	// ones stay idle until it is raised, see setLimit
+	limit   atomic.Int32
+	running atomic.Int32
+	busy    atomic.Int32
+	// peak is the highest number of tasks processed concurrently
+	peak atomic.Int32
+
+	muLimit      sync.Mutex
+	limitChanged chan struct{}
+}
+
+// newInboundWorkerPool starts size workers, they are stopped once ctx is done
+func newInboundWorkerPool(ctx context.Context, size int) *inboundWorkerPool {
+	if size <= 0 {
+		size = defaultInboundWorkers
+	}
+
+	p := &inboundWorkerPool{
+		ctx:          ctx,
+		size:         size,
+		queued:       make(chan struct{}, 1),
+		throttled:    make(chan struct{}, 1),
+		priorities:   make(map[string]protocoltypes.GroupPriority),
+		limitChanged: make(chan struct{}),
+	}
+	p.limit.Store(int32(size))
+
+	labels := pprof.Labels(workerPoolLabel, "inbound")
+	for i := 0; i < size; i++ {
+		p.running.Add(1)
+		go pprof.Do(ctx, labels, func(context.Context) {
+			defer p.running.Add(-1)
+			p.work(int32(i))
+		})
+	}
+
+	return p
+}
+
+func (p *inboundWorkerPool) work(index int32) {
+	for {
+		// get the channel before the limit, so a change between both isn't
+		// missed
+		limitChanged := p.getLimitChanged()
+
+		if index >= p.limit.Load() {
+			// pass on a signal this worker may have consumed
+			p.signalIfQueued()
+
+			select {
+			case <-limitChanged:
+				continue
+			case <-p.ctx.Done():
+				return
+			}
+		}
+
+		if task, ok := p.nextTask(); ok {
+			p.run(task)
+			continue
+		}
+
+		select {
+		case <-p.queued:
+		case <-limitChanged:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// nextTask pops the oldest task of the highest priority queue without
+// waiting, the throttled tasks are only picked up when no other task is queued
+func (p *inboundWorkerPool) nextTask() (*inboundTask, bool) {
+	p.muQueues.Lock()
+	defer p.muQueues.Unlock()
+
+	for level, queue := range p.queues {
+		if len(queue) == 0 {
+			continue
+		}
+
+		task := queue[0]
+		queue[0] = nil
+		p.queues[level] = queue[1:]
+		task.started = true
+
+		// let another worker pick up the remaining tasks
+		p.signalIfQueuedLocked()
+
+		return task, true
+	}
+
+	return nil, false
+}
+
+// push queues a task at the given priority level and wakes up a worker
+func (p *inboundWorkerPool) push(level int, task *inboundTask) {
+	p.muQueues.Lock()
+	defer p.muQueues.Unlock()
+
+	p.queues[level] = append(p.queues[level], task)
+	p.signalLocked()
+}
+
+// remove drops a task which hasn't been picked up by a worker yet, it returns
+// false if the task has already started
+func (p *inboundWorkerPool) remove(level int, task *inboundTask) bool {
+	p.muQueues.Lock()
+	defer p.muQueues.Unlock()
+
+	if task.started {
+		return false
+	}
+
+	queue := p.queues[level]
+	for i, queued := range queue {
+		if queued == task {
+			p.queues[level] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+
+	return true
+}
+
+// pending returns the number of tasks queued at the given priority level
+func (p *inboundWorkerPool) pending(level int) int {
+	p.muQueues.Lock()
+	defer p.muQueues.Unlock()
+
+	return len(p.queues[level])
+}
+
+func (p *inboundWorkerPool) signalIfQueued() {
+	p.muQueues.Lock()
+	defer p.muQueues.Unlock()
+
+	p.signalIfQueuedLocked()
+}
+
+func (p *inboundWorkerPool) signalIfQueuedLocked() {
+	for _, queue := range p.queues {
+		if len(queue) > 0 {
+			p.signalLocked()
+			return
+		}
+	}
+}
+
+func (p *inboundWorkerPool) signalLocked() {
+	select {
+	case p.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (p *inboundWorkerPool) run(task *inboundTask) {
+	busy := p.busy.Add(1)
+	defer p.busy.Add(-1)
+
+	for peak := p.peak.Load(); busy > peak; peak = p.peak.Load() {
+		if p.peak.CompareAndSwap(peak, busy) {
+			break
+		}
+	}
+
+	defer close(task.done)
+
+	task.run()
+}
+
+func (p *inboundWorkerPool) getLimitChanged() <-chan struct{} {
+	p.muLimit.Lock()
+	defer p.muLimit.Unlock()
+
+	return p.limitChanged
+}
+
+// setLimit sets the number of workers allowed to process tasks, between 1
+// and the size of the pool. The tasks being processed are not interrupted.
+func (p *inboundWorkerPool) setLimit(limit int) {
+	if p == nil {
+		return
+	}
+
+	if limit < 1 {
+		limit = 1
+	} else if limit > p.size {
+		limit = p.size
+	}
+
+	p.muLimit.Lock()
+	defer p.muLimit.Unlock()
+
+	if p.limit.Swap(int32(limit)) == int32(limit) {
+		return
+	}
+
+	close(p.limitChanged)
+	p.limitChanged = make(chan struct{})
+}
+
+// stats returns the current state of the pool
+func (p *inboundWorkerPool) stats() *protocoltypes.WorkerPoolStats {
+	if p == nil {
+		return &protocoltypes.WorkerPoolStats{}
+	}
+
+	return &protocoltypes.WorkerPoolStats{
+		Size:    int64(p.size),
+		Limit:   int64(p.limit.Load()),
+		Running: int64(p.running.Load()),
+		Busy:    int64(p.busy.Load()),
+	}
+}
+
+// setGroupPriority sets the priority of the tasks of a group submitted with
+// DoForGroup, GroupPriorityNormal restores the default
+func (p *inboundWorkerPool) setGroupPriority(groupPK []byte, priority protocoltypes.GroupPriority) {
+	if p == nil {
+		return
+	}
+
+	p.muPriorities.Lock()
+	defer p.muPriorities.Unlock()
+
+	if priority == protocoltypes.GroupPriority_GroupPriorityNormal {
+		delete(p.priorities, string(groupPK))
+	} else {
+		p.priorities[string(groupPK)] = priority
+	}
+}
+
+func (p *inboundWorkerPool) groupPriority(groupPK []byte) protocoltypes.GroupPriority {
+	p.muPriorities.RLock()
+	defer p.muPriorities.RUnlock()
+
+	return p.priorities[string(groupPK)]
+}
+
+// Do runs task on a worker and waits for its completion, so the tasks
+// submitted by a single goroutine are processed in order. The task is run on
+// the calling goroutine if the pool is nil or if ctx is the one of a task
+// already running on a worker of the pool.
+func (p *inboundWorkerPool) Do(ctx context.Context, task func(ctx context.Context)) error {
+	return p.do(ctx, protocoltypes.GroupPriority_GroupPriorityNormal, task)
+}
+
+// DoForGroup is like Do, the task is picked up according to the priority of
+// the group
+func (p *inboundWorkerPool) DoForGroup(ctx context.Context, groupPK []byte, task func(ctx context.Context)) error {
+	if p == nil {
+		task(ctx)
+		return nil
+	}
+
+	return p.do(ctx, p.groupPriority(groupPK), task)
+}
+
+func (p *inboundWorkerPool) do(ctx context.Context, priority protocoltypes.GroupPriority, task func(ctx context.Context)) error {
+	if p == nil || ctx.Value(inboundWorkerKey{}) == p {
+		// the caller already holds a worker
+		task(ctx)
+		return nil
+	}
+
+	level := priorityLevel(priority)
+	if priority == protocoltypes.GroupPriority_GroupPriorityThrottled {
+		select {
+		case p.throttled <- struct{}{}:
+			defer func() { <-p.throttled }()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+	}
+
+	workerCtx := context.WithValue(ctx, inboundWorkerKey{}, p)
+	t := &inboundTask{run: func() { task(workerCtx) }, done: make(chan struct{})}
+	p.push(level, t)
+
+	var err error
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.ctx.Done():
+		err = p.ctx.Err()
+	}
+
+	if p.remove(level, t) {
+		return err
+	}
+
+	// the task is being processed, wait for its completion
+	<-t.done
+	return nil
+}
+
+// priorityLevels is the number of priority queues of the pool
+const priorityLevels = 3
+
+// priorityLevel returns the index of the queue of a priority, the lower the
+// sooner its tasks are picked up
+func priorityLevel(priority protocoltypes.GroupPriority) int {
+	switch priority {
+	case protocoltypes.GroupPriority_GroupPriorityHigh:
+		return 0
+	case protocoltypes.GroupPriority_GroupPriorityThrottled:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// inboundWorkerKey is the context key marking the tasks running on a worker
+type inboundWorkerKey struct{}
+
+// inboundTask is a task queued on the pool, started is guarded by the lock of
+// the queues
+type inboundTask struct {
+	run     func()
+	done    chan struct{}
+	started bool
+}
@@ -0,0 +1,420 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestInboundWorkerPoolBounded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		workers    = 3
+		stores     = 20
+		perStore   = 100
+		taskLength = time.Millisecond
+	)
+
+	pool := newInboundWorkerPool(ctx, workers)
+
+	var running, maxRunning, processed int64
+
+	// simulate a replication burst on many groups at once, the entries
+	// processed for each store are checked once the burst is over
+	orders := make([][]int, stores)
+	errs := make(chan error, stores)
+	for i := 0; i < stores; i++ {
+		go func(i int) {
+			for j := 0; j < perStore; j++ {
+				j := j
+				err := pool.Do(ctx, func(context.Context) {
+					current := atomic.AddInt64(&running, 1)
+					defer atomic.AddInt64(&running, -1)
+
+					for {
+						highest := atomic.LoadInt64(&maxRunning)
+						if current <= highest || atomic.CompareAndSwapInt64(&maxRunning, highest, current) {
+							break
+						}
+					}
+
+					orders[i] = append(orders[i], j)
+
+					time.Sleep(taskLength)
+					atomic.AddInt64(&processed, 1)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+
+	for i := 0; i < stores; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// entries of a store are processed in order
+	expected := make([]int, perStore)
+	for j := range expected {
+		expected[j] = j
+	}
+	for i, order := range orders {
+		require.Equal(t, expected, order, "store %d", i)
+	}
+
+	require.Equal(t, int64(stores*perStore), atomic.LoadInt64(&processed))
+	require.LessOrEqual(t, atomic.LoadInt64(&maxRunning), int64(workers))
+	require.Greater(t, atomic.LoadInt64(&maxRunning), int64(1))
+}
+
+func TestInboundWorkerPoolClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pool := newInboundWorkerPool(ctx, 1)
+
+	// block the only worker
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = pool.Do(context.Background(), func(context.Context) {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	// tasks can't be submitted once the caller context is done
+	callerCtx, callerCancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer callerCancel()
+	require.ErrorIs(t, pool.Do(callerCtx, func(context.Context) {}), context.DeadlineExceeded)
+
+	// nor once the pool is stopped
+	cancel()
+	require.ErrorIs(t, pool.Do(context.Background(), func(context.Context) {}), context.Canceled)
+	close(release)
+
+	// a nil pool runs the tasks inline
+	var nilPool *inboundWorkerPool
+	called := false
+	require.NoError(t, nilPool.Do(context.Background(), func(context.Context) { called = true }))
+	require.True(t, called)
+}
+
+func TestInboundWorkerPoolLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const workers = 3
+
+	pool := newInboundWorkerPool(ctx, workers)
+
+	require.Eventually(t, func() bool {
+		return pool.stats().Running == workers
+	}, time.Second, time.Millisecond*10)
+
+	// load all the workers
+	release := make(chan struct{})
+	errs := make(chan error, workers*4)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- pool.Do(ctx, func(context.Context) { <-release })
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return pool.stats().Busy == workers
+	}, time.Second, time.Millisecond*10)
+
+	stats := pool.stats()
+	require.Equal(t, int64(workers), stats.Size)
+	require.Equal(t, int64(workers), stats.Limit)
+	require.Equal(t, int64(workers), stats.Running)
+
+	// the tasks being processed are not interrupted when the limit is lowered
+	pool.setLimit(1)
+	require.Equal(t, int64(1), pool.stats().Limit)
+	require.Equal(t, int64(workers), pool.stats().Busy)
+
+	close(release)
+	for i := 0; i < workers; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// then a single task is processed at a time
+	var running, maxRunning int64
+	for i := 0; i < workers*4; i++ {
+		go func() {
+			errs <- pool.Do(ctx, func(context.Context) {
+				current := atomic.AddInt64(&running, 1)
+				defer atomic.AddInt64(&running, -1)
+
+				if current > atomic.LoadInt64(&maxRunning) {
+					atomic.StoreInt64(&maxRunning, current)
+				}
+
+				time.Sleep(time.Millisecond * 5)
+			})
+		}()
+	}
+	for i := 0; i < workers*4; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	require.Equal(t, int64(1), atomic.LoadInt64(&maxRunning))
+
+	// the limit is bounded by the size of the pool
+	pool.setLimit(workers * 2)
+	require.Equal(t, int64(workers), pool.stats().Limit)
+
+	// the idle workers are still running
+	require.Equal(t, int64(workers), pool.stats().Running)
+
+	cancel()
+	require.Eventually(t, func() bool {
+		return pool.stats().Running == 0
+	}, time.Second, time.Millisecond*10)
+}
+
+func TestInboundWorkerPoolGroupPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool := newInboundWorkerPool(ctx, 1)
+
+	highGroup, throttledGroup, normalGroup := []byte("high"), []byte("throttled"), []byte("normal")
+	pool.setGroupPriority(highGroup, protocoltypes.GroupPriority_GroupPriorityHigh)
+	pool.setGroupPriority(throttledGroup, protocoltypes.GroupPriority_GroupPriorityThrottled)
+
+	// the throttled group has a backlog when the entries of the other groups
+	// are received
+	const (
+		backlog   = 10
+		entries   = 5
+		submitted = 1 + backlog + 2*entries
+	)
+	errs := make(chan error, submitted)
+
+	// block the only worker
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		errs <- pool.Do(ctx, func(context.Context) {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	var (
+		mu        sync.Mutex
+		processed []string
+	)
+	submit := func(groupPK []byte) {
+		go func() {
+			errs <- pool.DoForGroup(ctx, groupPK, func(context.Context) {
+				mu.Lock()
+				processed = append(processed, string(groupPK))
+				mu.Unlock()
+			})
+		}()
+	}
+
+	for i := 0; i < backlog; i++ {
+		submit(throttledGroup)
+	}
+	for i := 0; i < entries; i++ {
+		submit(normalGroup)
+		submit(highGroup)
+	}
+
+	// wait for the tasks to be queued, a single task of the throttled group
+	// is queued at a time
+	require.Eventually(t, func() bool {
+		return pool.pending(priorityLevel(protocoltypes.GroupPriority_GroupPriorityHigh)) == entries &&
+			pool.pending(priorityLevel(protocoltypes.GroupPriority_GroupPriorityNormal)) == entries &&
+			pool.pending(priorityLevel(protocoltypes.GroupPriority_GroupPriorityThrottled)) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	close(release)
+	for i := 0; i < submitted; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// the priority queue is drained first, the throttled group is processed
+	// once the other groups are done
+	expected := []string{}
+	for _, group := range [][]byte{highGroup, normalGroup} {
+		for i := 0; i < entries; i++ {
+			expected = append(expected, string(group))
+		}
+	}
+	for i := 0; i < backlog; i++ {
+		expected = append(expected, string(throttledGroup))
+	}
+
+	mu.Lock()
+	require.Equal(t, expected, processed)
+	mu.Unlock()
+
+	// the default priority is restored
+	pool.setGroupPriority(throttledGroup, protocoltypes.GroupPriority_GroupPriorityNormal)
+	require.Equal(t, protocoltypes.GroupPriority_GroupPriorityNormal, pool.groupPriority(throttledGroup))
+}
+
+func TestInboundWorkerPoolThrottled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		workers = 3
+		tasks   = workers * 4
+	)
+
+	pool := newInboundWorkerPool(ctx, workers)
+
+	throttledGroup := []byte("throttled")
+	pool.setGroupPriority(throttledGroup, protocoltypes.GroupPriority_GroupPriorityThrottled)
+
+	// a single task of the throttled groups is processed at a time, even if
+	// workers are idle
+	var running int64
+	started := make(chan int64)
+	release := make(chan struct{})
+	errs := make(chan error, tasks)
+	for i := 0; i < tasks; i++ {
+		go func() {
+			errs <- pool.DoForGroup(ctx, throttledGroup, func(context.Context) {
+				defer atomic.AddInt64(&running, -1)
+
+				started <- atomic.AddInt64(&running, 1)
+				<-release
+			})
+		}()
+	}
+
+	for i := 0; i < tasks; i++ {
+		require.Equal(t, int64(1), <-started)
+
+		// the other tasks are waiting for the running one
+		require.Equal(t, 0, pool.pending(priorityLevel(protocoltypes.GroupPriority_GroupPriorityThrottled)))
+		release <- struct{}{}
+	}
+
+	for i := 0; i < tasks; i++ {
+		require.NoError(t, <-errs)
+	}
+}
+
+func TestInboundWorkerPoolNested(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const workers = 2
+
+	pool := newInboundWorkerPool(ctx, workers)
+
+	// every worker runs a task submitting another one, none is available
+	// for the nested tasks
+	var started sync.WaitGroup
+	started.Add(workers)
+
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			var nestedErr error
+			err := pool.Do(ctx, func(ctx context.Context) {
+				started.Done()
+				started.Wait()
+
+				nestedErr = pool.DoForGroup(ctx, []byte("group"), func(context.Context) {})
+			})
+			if err == nil {
+				err = nestedErr
+			}
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < workers; i++ {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, "nested task hasn't been processed")
+		}
+	}
+
+	require.LessOrEqual(t, pool.peak.Load(), int32(workers))
+}
+
+func TestInboundWorkerPoolReplicationBurst(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	const (
+		workers  = 2
+		messages = 200
+	)
+
+	opts := TestingOpts{
+		Mocknet:         mocknet.New(),
+		Logger:          logger,
+		ConnectFunc:     ConnectAll,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		InboundWorkers:  workers,
+	}
+	defer opts.Mocknet.Close()
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	sender, receiver := pts[0], pts[1]
+	group := CreateMultiMemberGroupInstance(ctx, t, sender, receiver)
+
+	for i := 0; i < messages; i++ {
+		_, err := sender.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: group.PublicKey,
+			Payload: []byte(fmt.Sprintf("message %d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	gc, err := receiver.Service.(*service).GetContextGroupForID(group.PublicKey)
+	require.NoError(t, err)
+
+	// the whole burst is received
+	require.Eventually(t, func() bool {
+		events, err := gc.MessageStore().ListEvents(ctx, nil, nil, false)
+		if err != nil {
+			return false
+		}
+
+		return countEntries(events) == messages
+	}, time.Second*60, time.Millisecond*200)
+
+	// without processing more entries concurrently than the pool allows
+	pool := receiver.Service.(*service).odb.inboundPool
+	require.Equal(t, int64(workers), pool.stats().Size)
+	require.Greater(t, pool.peak.Load(), int32(0))
+	require.LessOrEqual(t, pool.peak.Load(), int32(workers))
+}
@@ -0,0 +1,289 @@
+// Package capabilities implements a lightweight handshake used by peers to
+// advertise the optional features they support.
+//
+// Capabilities are sent once per connection on a dedicated stream and stored
+// per peer. Before using an optional feature with a peer, callers must check
+// that it is part of the negotiated set, which is the intersection of the
+// local and remote capabilities. Unknown peers are assumed to only support the
+// minimal feature set.
+package capabilities
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protoio"
+)
+
+const (
+	ProtocolID = protocol.ID("wesh/p2p/capabilities/1.0.0")
+
+	// Version is the version of the capabilities protocol
+	Version = 1
+
+	maxCapabilitiesSize = 4096
+)
+
+// Optional features which can be negotiated
+const (
+	FeatureCompression    = "compression"
+	FeatureTypedMessages  = "typed_messages"
+	FeatureChunkedFraming = "chunked_framing"
+
+	// FeatureGroupEncryption is advertised with the latest encryption
+	// version of the group entries the peer can open
+	FeatureGroupEncryption = "group_encryption"
+)
+
+// Minimal returns the feature set assumed for peers which haven't sent their
+// capabilities
+func Minimal() *Capabilities {
+	return &Capabilities{Version: Version}
+}
+
+// Negotiate returns the features supported by both sides, using the lowest
+// version of each feature
+func Negotiate(local, remote *Capabilities) *Capabilities {
+	negotiated := Minimal()
+	if local == nil || remote == nil {
+		return negotiated
+	}
+
+	if remote.Version < negotiated.Version {
+		negotiated.Version = remote.Version
+	}
+
+	remoteFeatures := make(map[string]uint32, len(remote.Features))
+	for _, f := range remote.Features {
+		remoteFeatures[f.Name] = f.Version
+	}
+
+	for _, f := range local.Features {
+		remoteVersion, ok := remoteFeatures[f.Name]
+		if !ok {
+			continue
+		}
+
+		version := f.Version
+		if remoteVersion < version {
+			version = remoteVersion
+		}
+
+		negotiated.Features = append(negotiated.Features, &Feature{Name: f.Name, Version: version})
+	}
+
+	return negotiated
+}
+
+// FeatureVersion returns the version of the given feature, ok is false if the
+// feature isn't supported
+func (c *Capabilities) FeatureVersion(name string) (version uint32, ok bool) {
+	for _, f := range c.GetFeatures() {
+		if f.Name == name {
+			return f.Version, true
+		}
+	}
+
+	return 0, false
+}
+
+// Manager exchanges capabilities with connected peers and keeps track of
+// what has been negotiated with each of them
+type Manager struct {
+	rootCtx    context.Context
+	rootCancel context.CancelFunc
+
+	h      host.Host
+	logger *zap.Logger
+	local  *Capabilities
+
+	peers   map[peer.ID]*Capabilities
+	muPeers sync.RWMutex
+}
+
+func NewManager(logger *zap.Logger, h host.Host, local *Capabilities) (*Manager, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if local == nil {
+		local = Minimal()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		rootCtx:    ctx,
+		rootCancel: cancel,
+		h:          h,
+		logger:     logger.Named("capabilities"),
+		local:      local,
+		peers:      make(map[peer.ID]*Capabilities),
+	}
+
+	h.SetStreamHandler(ProtocolID, m.handleStream)
+	if err := m.monitorConnection(ctx); err != nil {
+		h.RemoveStreamHandler(ProtocolID)
+		cancel()
+		return nil, fmt.Errorf("unable to monitor connection: %w", err)
+	}
+
+	return m, nil
+}
+
+// Local returns the capabilities advertised to other peers
+func (m *Manager) Local() *Capabilities {
+	return m.local
+}
+
+// Remote returns the capabilities sent by the given peer, ok is false if the
+// peer hasn't sent them yet
+func (m *Manager) Remote(p peer.ID) (c *Capabilities, ok bool) {
+	m.muPeers.RLock()
+	c, ok = m.peers[p]
+	m.muPeers.RUnlock()
+	return c, ok
+}
+
+// Negotiated returns the features which can be used with the given peer, it
+// is the minimal feature set if the peer hasn't sent its capabilities
+func (m *Manager) Negotiated(p peer.ID) *Capabilities {
+	remote, ok := m.Remote(p)
+	if !ok {
+		return Minimal()
+	}
+
+	return Negotiate(m.local, remote)
+}
+
+// Supports returns true if the given feature can be used with the given peer
+func (m *Manager) Supports(p peer.ID, feature string) bool {
+	_, ok := m.Negotiated(p).FeatureVersion(feature)
+	return ok
+}
+
+// MinVersion returns the lowest version of the given feature negotiated
+// with the connected peers, ok is false if one of them doesn't support it.
+// It is the local version of the feature if no peer is connected.
+func (m *Manager) MinVersion(feature string) (version uint32, ok bool) {
+	version, ok = m.local.FeatureVersion(feature)
+	if !ok {
+		return 0, false
+	}
+
+	for _, p := range m.h.Network().Peers() {
+		negotiated, ok := m.Negotiated(p).FeatureVersion(feature)
+		if !ok {
+			return 0, false
+		}
+
+		if negotiated < version {
+			version = negotiated
+		}
+	}
+
+	return version, true
+}
+
+func (m *Manager) Close() error {
+	m.rootCancel()
+	m.h.RemoveStreamHandler(ProtocolID)
+	return nil
+}
+
+// Called when a stream is opened by a remote peer
+func (m *Manager) handleStream(s network.Stream) {
+	defer s.Reset() // nolint:errcheck
+
+	remote := s.Conn().RemotePeer()
+
+	reader := protoio.NewDelimitedReader(s, maxCapabilitiesSize)
+	caps := &Capabilities{}
+	if err := reader.ReadMsg(caps); err != nil {
+		m.logger.Error("handleStream receive invalid capabilities", zap.Error(err))
+		return
+	}
+
+	m.logger.Debug("received capabilities",
+		logutil.PrivateString("peer", remote.String()),
+		zap.Uint32("version", caps.Version),
+		zap.Int("features", len(caps.Features)))
+
+	m.muPeers.Lock()
+	m.peers[remote] = caps
+	m.muPeers.Unlock()
+}
+
+func (m *Manager) sendCapabilitiesTo(ctx context.Context, p peer.ID) error {
+	s, err := m.h.NewStream(ctx, p, ProtocolID)
+	if err != nil {
+		return fmt.Errorf("unable to create stream: %w", err)
+	}
+	defer s.Close()
+
+	pbw := protoio.NewDelimitedWriter(s)
+	if err := pbw.WriteMsg(m.local); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Manager) handleConnection(ctx context.Context, p peer.ID) {
+	if p == m.h.ID() {
+		return
+	}
+
+	go func() {
+		if err := m.sendCapabilitiesTo(ctx, p); err != nil {
+			m.logger.Warn("unable to send capabilities", logutil.PrivateString("peer", p.String()), zap.Error(err))
+		}
+	}()
+}
+
+func (m *Manager) monitorConnection(ctx context.Context) error {
+	sub, err := m.h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged),
+		eventbus.Name("weshnet/capabilities/monitor-connection"))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to `EvtPeerConnectednessChanged`: %w", err)
+	}
+
+	// check already connected peers
+	for _, p := range m.h.Network().Peers() {
+		m.handleConnection(ctx, p)
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			var e interface{}
+			select {
+			case e = <-sub.Out():
+			case <-ctx.Done():
+				return
+			}
+
+			evt := e.(event.EvtPeerConnectednessChanged)
+			switch evt.Connectedness {
+			case network.Connected:
+				m.handleConnection(ctx, evt.Peer)
+			case network.NotConnected:
+				// capabilities are exchanged again on the next connection
+				m.muPeers.Lock()
+				delete(m.peers, evt.Peer)
+				m.muPeers.Unlock()
+			}
+		}
+	}()
+
+	return nil
+}
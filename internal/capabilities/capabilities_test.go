@@ -0,0 +1,124 @@
+package capabilities
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := &Capabilities{
+		Version: Version,
+		Features: []*Feature{
+			{Name: FeatureCompression, Version: 2},
+			{Name: FeatureChunkedFraming, Version: 1},
+		},
+	}
+
+	remote := &Capabilities{
+		Version: Version,
+		Features: []*Feature{
+			{Name: FeatureCompression, Version: 1},
+			{Name: FeatureTypedMessages, Version: 1},
+		},
+	}
+
+	negotiated := Negotiate(local, remote)
+
+	version, ok := negotiated.FeatureVersion(FeatureCompression)
+	require.True(t, ok)
+	require.Equal(t, uint32(1), version)
+
+	_, ok = negotiated.FeatureVersion(FeatureChunkedFraming)
+	require.False(t, ok)
+
+	_, ok = negotiated.FeatureVersion(FeatureTypedMessages)
+	require.False(t, ok)
+
+	require.Empty(t, Negotiate(local, nil).Features)
+}
+
+func TestManagerNegotiatesCommonFeatures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	hostA, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	hostB, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	require.NoError(t, mn.LinkAll())
+
+	managerA, err := NewManager(zap.NewNop(), hostA, &Capabilities{
+		Version: Version,
+		Features: []*Feature{
+			{Name: FeatureCompression, Version: 2},
+			{Name: FeatureTypedMessages, Version: 1},
+		},
+	})
+	require.NoError(t, err)
+	defer managerA.Close()
+
+	managerB, err := NewManager(zap.NewNop(), hostB, &Capabilities{
+		Version: Version,
+		Features: []*Feature{
+			{Name: FeatureCompression, Version: 1},
+			{Name: FeatureChunkedFraming, Version: 1},
+		},
+	})
+	require.NoError(t, err)
+	defer managerB.Close()
+
+	// unknown peers only support the minimal feature set
+	require.False(t, managerA.Supports(hostB.ID(), FeatureCompression))
+	require.Empty(t, managerA.Negotiated(hostB.ID()).Features)
+
+	// the local version is used while no peer is connected
+	version, ok := managerA.MinVersion(FeatureCompression)
+	require.True(t, ok)
+	require.Equal(t, uint32(2), version)
+
+	err = hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: hostB.Addrs()})
+	require.NoError(t, err)
+
+	waitForCapabilities := func(m *Manager, p peer.ID) {
+		require.Eventually(t, func() bool {
+			_, ok := m.Remote(p)
+			return ok
+		}, time.Second*5, time.Millisecond*10)
+	}
+
+	waitForCapabilities(managerA, hostB.ID())
+	waitForCapabilities(managerB, hostA.ID())
+
+	for _, negotiated := range []*Capabilities{
+		managerA.Negotiated(hostB.ID()),
+		managerB.Negotiated(hostA.ID()),
+	} {
+		require.Len(t, negotiated.Features, 1)
+
+		version, ok := negotiated.FeatureVersion(FeatureCompression)
+		require.True(t, ok)
+		require.Equal(t, uint32(1), version)
+	}
+
+	require.True(t, managerA.Supports(hostB.ID(), FeatureCompression))
+	require.False(t, managerA.Supports(hostB.ID(), FeatureTypedMessages))
+	require.False(t, managerB.Supports(hostA.ID(), FeatureChunkedFraming))
+
+	version, ok = managerA.MinVersion(FeatureCompression)
+	require.True(t, ok)
+	require.Equal(t, uint32(1), version)
+
+	_, ok = managerA.MinVersion(FeatureTypedMessages)
+	require.False(t, ok)
+}
@@ -0,0 +1,243 @@
+package datastoreutil
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+)
+
+const (
+	DefaultRetryMaxRetries = 5
+	DefaultRetryMinBackoff = time.Millisecond * 50
+	DefaultRetryMaxBackoff = time.Second * 2
+)
+
+// RetryOptions configures the retries of NewRetryDatastore
+type RetryOptions struct {
+	// MaxRetries is the number of times a write failing with a transient
+	// error is retried, DefaultRetryMaxRetries if 0, the writes are not
+	// retried if negative
+	MaxRetries int
+
+	// MinBackoff is the delay before the first retry, it is doubled after
+	// each retry up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// IsTransient tells if an error is transient, IsTransientError if nil
+	IsTransient func(error) bool
+}
+
+func (o *RetryOptions) applyDefaults() {
+	if o.MaxRetries == 0 {
+		o.MaxRetries = DefaultRetryMaxRetries
+	}
+
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = DefaultRetryMinBackoff
+	}
+
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = DefaultRetryMaxBackoff
+		if o.MaxBackoff < o.MinBackoff {
+			o.MaxBackoff = o.MinBackoff
+		}
+	}
+
+	if o.IsTransient == nil {
+		o.IsTransient = IsTransientError
+	}
+}
+
+// IsTransientError returns true if the error is likely to go away by itself,
+// e.g. a locked database or a full disk, the operation can be retried
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// the root datastore is backed by sqlite, its errors don't wrap the
+	// errno of the failed system call
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrFull:
+			return true
+		}
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EBUSY} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type retryDatastore struct {
+	ds.Batching
+
+	opts RetryOptions
+}
+
+// NewRetryDatastore wraps a datastore so its writes failing with a transient
+// error are retried with an exponential backoff, the other errors are
+// returned right away. The reads are not retried.
+func NewRetryDatastore(child ds.Batching, opts *RetryOptions) ds.Batching {
+	if opts == nil {
+		opts = &RetryOptions{}
+	}
+
+	o := *opts
+	o.applyDefaults()
+
+	r := &retryDatastore{
+		Batching: child,
+		opts:     o,
+	}
+
+	if _, ok := child.(ds.TxnDatastore); ok {
+		return &retryTxnDatastore{retryDatastore: r}
+	}
+
+	return r
+}
+
+func (r *retryDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, r.Batching)
+}
+
+func (r *retryDatastore) Check(ctx context.Context) error {
+	if c, ok := r.Batching.(ds.CheckedDatastore); ok {
+		return c.Check(ctx)
+	}
+	return nil
+}
+
+func (r *retryDatastore) Scrub(ctx context.Context) error {
+	if c, ok := r.Batching.(ds.ScrubbedDatastore); ok {
+		return c.Scrub(ctx)
+	}
+	return nil
+}
+
+func (r *retryDatastore) CollectGarbage(ctx context.Context) error {
+	if c, ok := r.Batching.(ds.GCDatastore); ok {
+		return c.CollectGarbage(ctx)
+	}
+	return nil
+}
+
+// retryTxnDatastore is used when the child supports the transactions, they
+// are forwarded as is since a failed transaction has to be replayed by the
+// caller
+type retryTxnDatastore struct {
+	*retryDatastore
+}
+
+func (r *retryTxnDatastore) NewTransaction(ctx context.Context, readOnly bool) (ds.Txn, error) {
+	return r.Batching.(ds.TxnDatastore).NewTransaction(ctx, readOnly)
+}
+
+func (r *retryDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return r.retry(ctx, func() error {
+		return r.Batching.Put(ctx, key, value)
+	})
+}
+
+func (r *retryDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return r.retry(ctx, func() error {
+		return r.Batching.Delete(ctx, key)
+	})
+}
+
+func (r *retryDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return r.retry(ctx, func() error {
+		return r.Batching.Sync(ctx, prefix)
+	})
+}
+
+// Batch returns a batch whose commit is retried, the child batch is only
+// created on commit so a failed commit can be retried with a new one
+func (r *retryDatastore) Batch(_ context.Context) (ds.Batch, error) {
+	return &retryBatch{datastore: r}, nil
+}
+
+// retry runs op until it succeeds, fails with an error which isn't
+// transient, the retries are exhausted or ctx is done
+func (r *retryDatastore) retry(ctx context.Context, op func() error) error {
+	backoff := r.opts.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= r.opts.MaxRetries || !r.opts.IsTransient(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+
+		if backoff *= 2; backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
+
+type batchOp struct {
+	key    ds.Key
+	value  []byte
+	delete bool
+}
+
+// retryBatch records the operations of a batch, they are applied to a batch
+// of the child datastore on commit
+type retryBatch struct {
+	datastore *retryDatastore
+	ops       []batchOp
+}
+
+func (b *retryBatch) Put(_ context.Context, key ds.Key, value []byte) error {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+	return nil
+}
+
+func (b *retryBatch) Delete(_ context.Context, key ds.Key) error {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+	return nil
+}
+
+func (b *retryBatch) Commit(ctx context.Context) error {
+	return b.datastore.retry(ctx, func() error {
+		batch, err := b.datastore.Batching.Batch(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, op := range b.ops {
+			if op.delete {
+				err = batch.Delete(ctx, op.key)
+			} else {
+				err = batch.Put(ctx, op.key, op.value)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return batch.Commit(ctx)
+	})
+}
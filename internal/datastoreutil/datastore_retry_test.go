@@ -0,0 +1,258 @@
+package datastoreutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDatastore fails its first writes with the given error
+type flakyDatastore struct {
+	ds.Batching
+
+	err      error
+	failures int
+	writes   int
+	mu       sync.Mutex
+}
+
+func newFlakyDatastore(failures int, err error) *flakyDatastore {
+	return &flakyDatastore{
+		Batching: dssync.MutexWrap(ds.NewMapDatastore()),
+		err:      err,
+		failures: failures,
+	}
+}
+
+func (f *flakyDatastore) fail() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.writes++
+	if f.writes <= f.failures {
+		return f.err
+	}
+
+	return nil
+}
+
+func (f *flakyDatastore) writeCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writes
+}
+
+func (f *flakyDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+
+	return f.Batching.Put(ctx, key, value)
+}
+
+func (f *flakyDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	batch, err := f.Batching.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &flakyBatch{Batch: batch, datastore: f}, nil
+}
+
+type flakyBatch struct {
+	ds.Batch
+
+	datastore *flakyDatastore
+}
+
+func (b *flakyBatch) Commit(ctx context.Context) error {
+	if err := b.datastore.fail(); err != nil {
+		return err
+	}
+
+	return b.Batch.Commit(ctx)
+}
+
+var testRetryOptions = &RetryOptions{
+	MaxRetries: 5,
+	MinBackoff: time.Millisecond,
+	MaxBackoff: time.Millisecond * 5,
+}
+
+func TestRetryDatastoreTransientErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := ds.NewKey("/key")
+
+	for _, err := range []error{
+		syscall.ENOSPC,
+		syscall.EAGAIN,
+		fmt.Errorf("unable to write: %w", syscall.EBUSY),
+		sqlite3.Error{Code: sqlite3.ErrBusy},
+		fmt.Errorf("unable to commit: %w", sqlite3.Error{Code: sqlite3.ErrFull}),
+	} {
+		t.Run(err.Error(), func(t *testing.T) {
+			flaky := newFlakyDatastore(3, err)
+			retry := NewRetryDatastore(flaky, testRetryOptions)
+
+			require.NoError(t, retry.Put(ctx, key, []byte("value")))
+			require.Equal(t, 4, flaky.writeCount())
+
+			value, err := retry.Get(ctx, key)
+			require.NoError(t, err)
+			require.Equal(t, "value", string(value))
+		})
+	}
+
+	// the retries are bounded
+	flaky := newFlakyDatastore(10, syscall.ENOSPC)
+	retry := NewRetryDatastore(flaky, testRetryOptions)
+	require.ErrorIs(t, retry.Put(ctx, key, []byte("value")), syscall.ENOSPC)
+	require.Equal(t, testRetryOptions.MaxRetries+1, flaky.writeCount())
+
+	// and can be disabled
+	flaky = newFlakyDatastore(1, syscall.ENOSPC)
+	retry = NewRetryDatastore(flaky, &RetryOptions{MaxRetries: -1})
+	require.ErrorIs(t, retry.Put(ctx, key, []byte("value")), syscall.ENOSPC)
+	require.Equal(t, 1, flaky.writeCount())
+}
+
+func TestRetryDatastorePermanentErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	permanent := errors.New("corrupted")
+
+	flaky := newFlakyDatastore(3, permanent)
+	retry := NewRetryDatastore(flaky, testRetryOptions)
+
+	require.ErrorIs(t, retry.Put(ctx, ds.NewKey("/key"), []byte("value")), permanent)
+	require.Equal(t, 1, flaky.writeCount())
+
+	// only some of the sqlite errors are transient
+	constraint := sqlite3.Error{Code: sqlite3.ErrConstraint}
+	flaky = newFlakyDatastore(3, constraint)
+	retry = NewRetryDatastore(flaky, testRetryOptions)
+	require.ErrorIs(t, retry.Put(ctx, ds.NewKey("/key"), []byte("value")), constraint)
+	require.Equal(t, 1, flaky.writeCount())
+
+	// a custom classification can make it transient
+	flaky = newFlakyDatastore(3, permanent)
+	retry = NewRetryDatastore(flaky, &RetryOptions{
+		MinBackoff:  time.Millisecond,
+		IsTransient: func(err error) bool { return errors.Is(err, permanent) },
+	})
+	require.NoError(t, retry.Put(ctx, ds.NewKey("/key"), []byte("value")))
+}
+
+func TestRetryDatastoreBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flaky := newFlakyDatastore(2, syscall.ENOSPC)
+	retry := NewRetryDatastore(flaky, testRetryOptions)
+
+	require.NoError(t, retry.Put(ctx, ds.NewKey("/deleted"), []byte("value")))
+
+	batch, err := retry.Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/a"), []byte("a")))
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/b"), []byte("b")))
+	require.NoError(t, batch.Delete(ctx, ds.NewKey("/deleted")))
+
+	require.NoError(t, batch.Commit(ctx))
+	require.Equal(t, 4, flaky.writeCount())
+
+	for key, expected := range map[string]string{"/a": "a", "/b": "b"} {
+		value, err := retry.Get(ctx, ds.NewKey(key))
+		require.NoError(t, err)
+		require.Equal(t, expected, string(value))
+	}
+
+	has, err := retry.Has(ctx, ds.NewKey("/deleted"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestRetryDatastoreContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	flaky := newFlakyDatastore(1, syscall.ENOSPC)
+	retry := NewRetryDatastore(flaky, &RetryOptions{MinBackoff: time.Hour})
+
+	// the backoff is interrupted and the last error is returned
+	require.ErrorIs(t, retry.Put(ctx, ds.NewKey("/key"), []byte("value")), syscall.ENOSPC)
+	require.Equal(t, 1, flaky.writeCount())
+}
+
+// featuredDatastore implements the optional interfaces of the datastores
+type featuredDatastore struct {
+	ds.Batching
+
+	checked, scrubbed, collected bool
+}
+
+func (f *featuredDatastore) DiskUsage(context.Context) (uint64, error) { return 42, nil }
+func (f *featuredDatastore) Check(context.Context) error               { f.checked = true; return nil }
+func (f *featuredDatastore) Scrub(context.Context) error               { f.scrubbed = true; return nil }
+
+func (f *featuredDatastore) CollectGarbage(context.Context) error {
+	f.collected = true
+	return nil
+}
+
+type txnDatastore struct {
+	ds.Batching
+
+	transactions int
+}
+
+func (t *txnDatastore) NewTransaction(context.Context, bool) (ds.Txn, error) {
+	t.transactions++
+	return nil, nil
+}
+
+func TestRetryDatastoreOptionalInterfaces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	child := &featuredDatastore{Batching: ds.NewMapDatastore()}
+	retry := NewRetryDatastore(child, nil)
+
+	usage, err := ds.DiskUsage(ctx, retry)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), usage)
+
+	require.NoError(t, retry.(ds.CheckedDatastore).Check(ctx))
+	require.NoError(t, retry.(ds.ScrubbedDatastore).Scrub(ctx))
+	require.NoError(t, retry.(ds.GCDatastore).CollectGarbage(ctx))
+	require.True(t, child.checked)
+	require.True(t, child.scrubbed)
+	require.True(t, child.collected)
+
+	// the transactions are only exposed when the child supports them
+	_, ok := retry.(ds.TxnDatastore)
+	require.False(t, ok)
+
+	txnChild := &txnDatastore{Batching: ds.NewMapDatastore()}
+	retry = NewRetryDatastore(txnChild, nil)
+
+	txnRetry, ok := retry.(ds.TxnDatastore)
+	require.True(t, ok)
+
+	_, err = txnRetry.NewTransaction(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, txnChild.transactions)
+}
@@ -0,0 +1,64 @@
+package weshnet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// lastSeenTracker keeps track of the last time some activity has been
+// observed from a device, it is local only and best effort: it is fed using
+// the entries received on the group stores and the connection events
+type lastSeenTracker struct {
+	devices map[string]time.Time
+	mu      sync.RWMutex
+}
+
+func newLastSeenTracker() *lastSeenTracker {
+	return &lastSeenTracker{
+		devices: make(map[string]time.Time),
+	}
+}
+
+// Seen records an activity of the given device, older observations are
+// ignored
+func (t *lastSeenTracker) Seen(devicePKRaw []byte, at time.Time) {
+	if t == nil || len(devicePKRaw) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	if current, ok := t.devices[string(devicePKRaw)]; !ok || at.After(current) {
+		t.devices[string(devicePKRaw)] = at
+	}
+	t.mu.Unlock()
+}
+
+// SeenPubKey is the same as Seen using a device public key
+func (t *lastSeenTracker) SeenPubKey(devicePK crypto.PubKey, at time.Time) {
+	if devicePK == nil {
+		return
+	}
+
+	devicePKRaw, err := devicePK.Raw()
+	if err != nil {
+		return
+	}
+
+	t.Seen(devicePKRaw, at)
+}
+
+// LastSeen returns the last time some activity has been observed from the
+// given device
+func (t *lastSeenTracker) LastSeen(devicePKRaw []byte) (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	at, ok := t.devices[string(devicePKRaw)]
+	return at, ok
+}
@@ -0,0 +1,40 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+// MembershipValidator is called before a device announced in a group is added
+// to the local list of the group members. It returns an error to reject the
+// device, which is then neither listed as a member nor sent the secrets of the
+// current device, and whose messages are not opened as its chain key is not
+// registered. The entry itself is kept in the group log.
+// The validator is called each time the group index is rebuilt, so it must
+// give the same answer for the same device. It is not called for the devices
+// of the current member.
+type MembershipValidator func(ctx context.Context, group *protocoltypes.Group, added *protocoltypes.GroupMemberDeviceAdded) error
+
+// validateMembership runs the validator on a device added to the group, the
+// returned error is wrapped with ErrGroupMemberRejected
+func validateMembership(ctx context.Context, validator MembershipValidator, group *protocoltypes.Group, ownMemberDevice secretstore.MemberDevice, added *protocoltypes.GroupMemberDeviceAdded) error {
+	if validator == nil {
+		return nil
+	}
+
+	if ownMemberDevice != nil {
+		if ownMemberPK, err := ownMemberDevice.Member().Raw(); err == nil && bytes.Equal(ownMemberPK, added.MemberPk) {
+			return nil
+		}
+	}
+
+	if err := validator(ctx, group, added); err != nil {
+		return errcode.ErrCode_ErrGroupMemberRejected.Wrap(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestMembershipValidator(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+	discoveryServer := tinder.NewMockDriverServer()
+
+	var (
+		rejectedMemberPK []byte
+		rejections       int
+		mu               sync.Mutex
+	)
+
+	validator := func(_ context.Context, _ *protocoltypes.Group, added *protocoltypes.GroupMemberDeviceAdded) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if rejectedMemberPK != nil && bytes.Equal(added.MemberPk, rejectedMemberPK) {
+			rejections++
+			return fmt.Errorf("untrusted member")
+		}
+
+		return nil
+	}
+
+	// only the first node validates the members
+	pts := make([]*TestingProtocol, 3)
+	for i := range pts {
+		opts := &TestingOpts{
+			Logger:          logger.Named(fmt.Sprintf("mock%d", i)),
+			Mocknet:         mn,
+			DiscoveryServer: discoveryServer,
+		}
+		if i == 0 {
+			opts.MembershipValidator = validator
+		}
+
+		var cleanup func()
+		pts[i], cleanup = NewTestingProtocol(ctx, t, opts, nil)
+		defer cleanup()
+	}
+	ConnectAll(t, mn)
+
+	group := CreateMultiMemberGroupInstance(ctx, t, pts[0], pts[1])
+
+	_, err := pts[2].Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: group})
+	require.NoError(t, err)
+
+	info, err := pts[2].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	mu.Lock()
+	rejectedMemberPK = info.MemberPk
+	mu.Unlock()
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	sub, err := pts[0].Client.GroupMetadataList(subCtx, &protocoltypes.GroupMetadataList_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	// the device announces itself once the group is activated
+	_, err = pts[2].Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	// the raw entry is still received
+	found := false
+	for !found {
+		evt, err := sub.Recv()
+		if err == io.EOF || sub.Context().Err() != nil {
+			break
+		}
+		require.NoError(t, err)
+
+		if evt.Metadata.EventType != protocoltypes.EventType_EventTypeGroupMemberDeviceAdded {
+			continue
+		}
+
+		added := &protocoltypes.GroupMemberDeviceAdded{}
+		require.NoError(t, proto.Unmarshal(evt.Event, added))
+		found = bytes.Equal(added.MemberPk, info.MemberPk)
+	}
+	subCancel()
+	require.True(t, found)
+
+	isMember := func(pt *TestingProtocol) bool {
+		gc, err := pt.Service.(*service).GetContextGroupForID(group.PublicKey)
+		require.NoError(t, err)
+
+		for _, member := range gc.MetadataStore().ListMembers() {
+			raw, err := member.Raw()
+			require.NoError(t, err)
+
+			if bytes.Equal(raw, info.MemberPk) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// the other node lists the member
+	require.Eventually(t, func() bool { return isMember(pts[1]) }, time.Second*10, time.Millisecond*100)
+
+	mu.Lock()
+	require.NotZero(t, rejections)
+	mu.Unlock()
+
+	require.False(t, isMember(pts[0]))
+
+	gc, err := pts[0].Service.(*service).GetContextGroupForID(group.PublicKey)
+	require.NoError(t, err)
+	require.Len(t, gc.MetadataStore().ListMembers(), 2)
+
+	hasMessage := func(pt *TestingProtocol, payload []byte) bool {
+		sub, err := pt.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  group.PublicKey,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		found := false
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				return found
+			}
+			require.NoError(t, err)
+
+			found = found || bytes.Equal(evt.Message, payload)
+		}
+	}
+
+	// the message of the rejected device is only delivered to the other node
+	rejectedPayload := []byte("from the rejected device")
+	_, err = pts[2].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: rejectedPayload,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return hasMessage(pts[1], rejectedPayload) }, time.Second*10, time.Millisecond*100)
+
+	// the message sent afterward by the other node is delivered, the message
+	// of the rejected device had been replicated by then
+	trustedPayload := []byte("from a trusted device")
+	_, err = pts[1].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: trustedPayload,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return hasMessage(pts[0], trustedPayload) }, time.Second*10, time.Millisecond*100)
+	require.False(t, hasMessage(pts[0], rejectedPayload))
+}
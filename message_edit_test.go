@@ -0,0 +1,147 @@
+package weshnet_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestAppMessageEdit(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		ConnectFunc:     weshnet.ConnectAll,
+		MessageIndexer:  weshnet.NewInMemoryMessageIndexer(),
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	listMessages := func(node *weshnet.TestingProtocol, withHistory bool) []*protocoltypes.GroupMessageEvent {
+		sub, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:            group.PublicKey,
+			UntilNow:           true,
+			IncludeEditHistory: withHistory,
+		})
+		require.NoError(t, err)
+
+		messages := []*protocoltypes.GroupMessageEvent{}
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				return messages
+			}
+			require.NoError(t, err)
+
+			messages = append(messages, evt)
+		}
+	}
+
+	sent, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("original"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(listMessages(nodes[1], false)) == 1
+	}, time.Second*5, time.Millisecond*100)
+
+	// only the author of a message can edit it
+	_, err = nodes[1].Client.AppMessageEdit(ctx, &protocoltypes.AppMessageEdit_Request{
+		GroupPk: group.PublicKey,
+		Cid:     sent.Cid,
+		Payload: []byte("not the author"),
+	})
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupPermissionDenied))
+
+	var firstEdit *protocoltypes.AppMessageEdit_Reply
+	for _, payload := range []string{"first edit", "second edit"} {
+		edit, err := nodes[0].Client.AppMessageEdit(ctx, &protocoltypes.AppMessageEdit_Request{
+			GroupPk: group.PublicKey,
+			Cid:     sent.Cid,
+			Payload: []byte(payload),
+		})
+		require.NoError(t, err)
+
+		if firstEdit == nil {
+			firstEdit = edit
+		}
+	}
+
+	// edits can't be edited
+	_, err = nodes[0].Client.AppMessageEdit(ctx, &protocoltypes.AppMessageEdit_Request{
+		GroupPk: group.PublicKey,
+		Cid:     firstEdit.Cid,
+		Payload: []byte("edit of an edit"),
+	})
+	require.Error(t, err)
+
+	// the latest edit supersedes the original message for all the members
+	for _, node := range nodes {
+		require.Eventually(t, func() bool {
+			messages := listMessages(node, false)
+			return len(messages) == 1 && string(messages[0].Message) == "second edit"
+		}, time.Second*5, time.Millisecond*100)
+
+		messages := listMessages(node, false)
+		require.Equal(t, sent.Cid, messages[0].EventContext.Id)
+		require.True(t, messages[0].Edited)
+		require.Empty(t, messages[0].PreviousVersions)
+
+		messages = listMessages(node, true)
+		require.Len(t, messages, 1)
+		require.Len(t, messages[0].PreviousVersions, 2)
+		require.Equal(t, "original", string(messages[0].PreviousVersions[0].Message))
+		require.Equal(t, "first edit", string(messages[0].PreviousVersions[1].Message))
+	}
+
+	search := func(query string) []*protocoltypes.GroupMessageEvent {
+		reply, err := nodes[1].Client.GroupMessageSearch(ctx, &protocoltypes.GroupMessageSearch_Request{
+			GroupPk: group.PublicKey,
+			Query:   query,
+		})
+		require.NoError(t, err)
+		return reply.Messages
+	}
+
+	// the latest version of the message is indexed, the edits aren't
+	// returned on their own
+	require.Eventually(t, func() bool {
+		return len(search("second")) == 1
+	}, time.Second*5, time.Millisecond*100)
+
+	found := search("edit")
+	require.Len(t, found, 1)
+	require.Equal(t, sent.Cid, found[0].EventContext.Id)
+	require.Equal(t, "second edit", string(found[0].Message))
+	require.True(t, found[0].Edited)
+
+	require.Empty(t, search("original"))
+	require.Empty(t, search("first"))
+}
@@ -0,0 +1,174 @@
+package weshnet_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestGroupMessageExpiration(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		ConnectFunc:     weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	listMessages := func(node *weshnet.TestingProtocol) []*protocoltypes.GroupMessageEvent {
+		sub, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  group.PublicKey,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		messages := []*protocoltypes.GroupMessageEvent{}
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				return messages
+			}
+			require.NoError(t, err)
+
+			messages = append(messages, evt)
+		}
+	}
+
+	hasMessage := func(node *weshnet.TestingProtocol, payload string) bool {
+		for _, evt := range listMessages(node) {
+			if string(evt.Message) == payload {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	_, err := nodes[0].Client.GroupMessageExpirationSet(ctx, &protocoltypes.GroupMessageExpirationSet_Request{
+		GroupPk:    group.PublicKey,
+		Expiration: -1,
+	})
+	require.Error(t, err)
+
+	_, err = nodes[0].Client.GroupMessageExpirationSet(ctx, &protocoltypes.GroupMessageExpirationSet_Request{
+		GroupPk:    group.PublicKey,
+		Expiration: 2,
+	})
+	require.NoError(t, err)
+
+	// the timer is a group metadata event, all the members must agree on it
+	for _, node := range nodes {
+		require.Eventually(t, func() bool {
+			info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+			require.NoError(t, err)
+			return info.MessageExpiration == 2
+		}, time.Second*10, time.Millisecond*100)
+	}
+
+	sentAt := time.Now()
+	sent, err := nodes[1].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("ephemeral"),
+	})
+	require.NoError(t, err)
+
+	ephemeralID, err := cid.Cast(sent.Cid)
+	require.NoError(t, err)
+
+	// the messages added to the store without the API follow the timer too
+	gc, err := nodes[0].Service.(weshnet.ServiceMethods).GetContextGroupForID(group.PublicKey)
+	require.NoError(t, err)
+
+	op, err := gc.MessageStore().AddMessage(ctx, []byte("ephemeral from the store"))
+	require.NoError(t, err)
+	storeID := op.GetEntry().GetHash()
+
+	for _, node := range nodes {
+		require.Eventually(t, func() bool {
+			return hasMessage(node, "ephemeral") && hasMessage(node, "ephemeral from the store")
+		}, time.Second*5, time.Millisecond*100)
+	}
+
+	for _, evt := range listMessages(nodes[0]) {
+		switch string(evt.Message) {
+		case "ephemeral", "ephemeral from the store":
+			require.InDelta(t, sentAt.Add(2*time.Second).UnixMilli(), evt.ExpiresAt, float64(time.Second.Milliseconds()))
+		}
+	}
+
+	// once the timer has elapsed the keys of the messages are deleted
+	// locally by all the members, the entries stay in the log
+	for _, node := range nodes {
+		require.Eventually(t, func() bool {
+			return !hasMessage(node, "ephemeral") && !hasMessage(node, "ephemeral from the store")
+		}, time.Second*5, time.Millisecond*100)
+
+		for _, id := range []cid.Cid{ephemeralID, storeID} {
+			require.Eventually(t, func() bool {
+				return !node.SecretStore.IsMessageKeyKnown(ctx, id)
+			}, time.Second*5, time.Millisecond*100)
+
+			gc, err := node.Service.(weshnet.ServiceMethods).GetContextGroupForID(group.PublicKey)
+			require.NoError(t, err)
+
+			_, ok := gc.MessageStore().OpLog().Get(id)
+			require.True(t, ok)
+
+			_, err = gc.MessageStore().GetMessageEventByCID(ctx, id)
+			require.True(t, errcode.Has(err, errcode.ErrCode_ErrMessageKeyDeleted))
+		}
+	}
+
+	// disabling the timer only applies to the messages sent afterward
+	_, err = nodes[0].Client.GroupMessageExpirationSet(ctx, &protocoltypes.GroupMessageExpirationSet_Request{
+		GroupPk:    group.PublicKey,
+		Expiration: 0,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		info, err := nodes[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+		return info.MessageExpiration == 0
+	}, time.Second*10, time.Millisecond*100)
+
+	_, err = nodes[1].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("persistent"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return hasMessage(nodes[0], "persistent")
+	}, time.Second*5, time.Millisecond*100)
+
+	time.Sleep(time.Second * 3)
+	require.True(t, hasMessage(nodes[0], "persistent"))
+	require.False(t, hasMessage(nodes[0], "ephemeral"))
+}
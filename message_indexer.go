@@ -0,0 +1,270 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/ipfs/go-cid"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// MessageIndexer indexes the messages processed on the opened groups to speed
+// up GroupMessageSearch, the messages are scanned when the indexer can't
+// answer a query.
+type MessageIndexer interface {
+	// IndexMessage records a message, it must be idempotent as a message can
+	// be indexed more than once. The content of an edited message replaces
+	// the one already indexed, see IndexedMessage.Edited.
+	IndexMessage(ctx context.Context, msg *IndexedMessage) error
+
+	// SearchMessages returns the ids of the messages of a group matching the
+	// query, from the first indexed to the last one. It returns an
+	// ErrNotImplemented error if the query can't be answered.
+	SearchMessages(ctx context.Context, groupPK []byte, query *MessageQuery) ([]cid.Cid, error)
+}
+
+// MessageIndexResetter is implemented by the MessageIndexers able to forget
+// the messages of a group, the group is then indexed from scratch by
+// ServiceReprocessGroup. Otherwise its messages are indexed again on top of
+// the existing index.
+type MessageIndexResetter interface {
+	// ResetGroup drops the messages indexed for a group
+	ResetGroup(ctx context.Context, groupPK []byte) error
+}
+
+// IndexedMessage contains the indexed fields of a message
+type IndexedMessage struct {
+	GroupPK  []byte
+	ID       cid.Cid
+	DevicePK []byte
+	// Timestamp is the time the message has been processed locally
+	Timestamp time.Time
+	// Tokens are the words contained in the message, see TokenizeMessage
+	Tokens []string
+	// Edited is set when the message has been edited, the tokens are the
+	// ones of its latest version
+	Edited bool
+}
+
+// MessageQuery describes the messages searched in a group
+type MessageQuery struct {
+	// Tokens must all be contained in the message, see TokenizeMessage
+	Tokens []string
+	// DevicePK is the device which has sent the message, ignored if empty
+	DevicePK []byte
+}
+
+func (q *MessageQuery) matches(msg *IndexedMessage) bool {
+	if len(q.DevicePK) > 0 && !bytes.Equal(q.DevicePK, msg.DevicePK) {
+		return false
+	}
+
+	for _, token := range q.Tokens {
+		found := false
+		for _, msgToken := range msg.Tokens {
+			if token == msgToken {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TokenizeMessage splits a message payload in unique lower case words
+func TokenizeMessage(payload []byte) []string {
+	words := strings.FieldsFunc(strings.ToLower(string(payload)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]struct{}, len(words))
+	tokens := make([]string, 0, len(words))
+	for _, word := range words {
+		if _, ok := seen[word]; ok {
+			continue
+		}
+
+		seen[word] = struct{}{}
+		tokens = append(tokens, word)
+	}
+
+	return tokens
+}
+
+// newIndexedMessage extracts the indexed fields of a message event
+func newIndexedMessage(evt *protocoltypes.GroupMessageEvent, timestamp time.Time) (*IndexedMessage, error) {
+	id, err := cid.Cast(evt.GetEventContext().GetId())
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return &IndexedMessage{
+		GroupPK:   evt.GetEventContext().GetGroupPk(),
+		ID:        id,
+		DevicePK:  evt.GetHeaders().GetDevicePk(),
+		Timestamp: timestamp,
+		Tokens:    TokenizeMessage(evt.GetMessage()),
+		Edited:    evt.GetEdited(),
+	}, nil
+}
+
+type inMemoryIndexedMessage struct {
+	*IndexedMessage
+	seq int
+}
+
+type inMemoryGroupIndex struct {
+	messages map[cid.Cid]*inMemoryIndexedMessage
+	tokens   map[string][]*inMemoryIndexedMessage
+	devices  map[string][]*inMemoryIndexedMessage
+}
+
+type inMemoryMessageIndexer struct {
+	groups map[string]*inMemoryGroupIndex
+	seq    int
+	mu     sync.RWMutex
+}
+
+// NewInMemoryMessageIndexer returns a MessageIndexer keeping the index in
+// memory, the history of a group is indexed again each time it is opened
+func NewInMemoryMessageIndexer() MessageIndexer {
+	return &inMemoryMessageIndexer{
+		groups: map[string]*inMemoryGroupIndex{},
+	}
+}
+
+func (i *inMemoryMessageIndexer) IndexMessage(_ context.Context, msg *IndexedMessage) error {
+	if msg == nil || !msg.ID.Defined() {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no message id provided"))
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	group, ok := i.groups[string(msg.GroupPK)]
+	if !ok {
+		group = &inMemoryGroupIndex{
+			messages: map[cid.Cid]*inMemoryIndexedMessage{},
+			tokens:   map[string][]*inMemoryIndexedMessage{},
+			devices:  map[string][]*inMemoryIndexedMessage{},
+		}
+		i.groups[string(msg.GroupPK)] = group
+	}
+
+	if indexed, ok := group.messages[msg.ID]; ok {
+		if msg.Edited {
+			group.replaceTokens(indexed, msg.Tokens)
+		}
+
+		return nil
+	}
+
+	i.seq++
+	indexed := &inMemoryIndexedMessage{IndexedMessage: msg, seq: i.seq}
+
+	group.messages[msg.ID] = indexed
+	group.devices[string(msg.DevicePK)] = append(group.devices[string(msg.DevicePK)], indexed)
+	for _, token := range msg.Tokens {
+		group.tokens[token] = append(group.tokens[token], indexed)
+	}
+
+	return nil
+}
+
+// replaceTokens indexes a message with the tokens of its latest version
+func (g *inMemoryGroupIndex) replaceTokens(indexed *inMemoryIndexedMessage, tokens []string) {
+	for _, token := range indexed.Tokens {
+		list := g.tokens[token][:0]
+		for _, other := range g.tokens[token] {
+			if other != indexed {
+				list = append(list, other)
+			}
+		}
+
+		if len(list) == 0 {
+			delete(g.tokens, token)
+		} else {
+			g.tokens[token] = list
+		}
+	}
+
+	indexed.IndexedMessage = &IndexedMessage{
+		GroupPK:   indexed.GroupPK,
+		ID:        indexed.ID,
+		DevicePK:  indexed.DevicePK,
+		Timestamp: indexed.Timestamp,
+		Tokens:    tokens,
+		Edited:    true,
+	}
+
+	for _, token := range tokens {
+		g.tokens[token] = append(g.tokens[token], indexed)
+	}
+}
+
+func (i *inMemoryMessageIndexer) ResetGroup(_ context.Context, groupPK []byte) error {
+	i.mu.Lock()
+	delete(i.groups, string(groupPK))
+	i.mu.Unlock()
+
+	return nil
+}
+
+func (i *inMemoryMessageIndexer) SearchMessages(_ context.Context, groupPK []byte, query *MessageQuery) ([]cid.Cid, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	group, ok := i.groups[string(groupPK)]
+	if !ok {
+		return []cid.Cid{}, nil
+	}
+
+	// start from the smallest list of candidates
+	var candidates []*inMemoryIndexedMessage
+	switch {
+	case len(query.DevicePK) > 0:
+		candidates = group.devices[string(query.DevicePK)]
+	case len(query.Tokens) > 0:
+		candidates = group.tokens[query.Tokens[0]]
+	default:
+		candidates = make([]*inMemoryIndexedMessage, 0, len(group.messages))
+		for _, msg := range group.messages {
+			candidates = append(candidates, msg)
+		}
+	}
+
+	for _, token := range query.Tokens {
+		if list := group.tokens[token]; len(list) < len(candidates) {
+			candidates = list
+		}
+	}
+
+	matching := []*inMemoryIndexedMessage{}
+	for _, msg := range candidates {
+		if query.matches(msg.IndexedMessage) {
+			matching = append(matching, msg)
+		}
+	}
+
+	sort.Slice(matching, func(a, b int) bool { return matching[a].seq < matching[b].seq })
+
+	ids := make([]cid.Cid, len(matching))
+	for j, msg := range matching {
+		ids[j] = msg.ID
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,312 @@
+package weshnet_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestTokenizeMessage(t *testing.T) {
+	require.Equal(t, []string{"hello", "world", "42"}, weshnet.TokenizeMessage([]byte("Hello, WORLD! hello 42...")))
+	require.Empty(t, weshnet.TokenizeMessage([]byte(" ?! ")))
+}
+
+func TestInMemoryMessageIndexer(t *testing.T) {
+	ctx := context.Background()
+	indexer := weshnet.NewInMemoryMessageIndexer()
+
+	groupPK, otherGroupPK := []byte("group"), []byte("other group")
+	deviceA, deviceB := []byte("device a"), []byte("device b")
+
+	newID := func(data string) cid.Cid {
+		hash, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+		require.NoError(t, err)
+		return cid.NewCidV1(cid.Raw, hash)
+	}
+
+	messages := []*weshnet.IndexedMessage{
+		{GroupPK: groupPK, ID: newID("1"), DevicePK: deviceA, Tokens: weshnet.TokenizeMessage([]byte("hello world"))},
+		{GroupPK: groupPK, ID: newID("2"), DevicePK: deviceB, Tokens: weshnet.TokenizeMessage([]byte("hello there"))},
+		{GroupPK: groupPK, ID: newID("3"), DevicePK: deviceA, Tokens: weshnet.TokenizeMessage([]byte("goodbye world"))},
+		{GroupPK: otherGroupPK, ID: newID("4"), DevicePK: deviceA, Tokens: weshnet.TokenizeMessage([]byte("hello world"))},
+	}
+
+	for _, msg := range messages {
+		require.NoError(t, indexer.IndexMessage(ctx, msg))
+	}
+
+	// indexing a message twice must not duplicate it
+	require.NoError(t, indexer.IndexMessage(ctx, messages[0]))
+	require.Error(t, indexer.IndexMessage(ctx, &weshnet.IndexedMessage{GroupPK: groupPK}))
+
+	search := func(groupPK []byte, query *weshnet.MessageQuery) []cid.Cid {
+		ids, err := indexer.SearchMessages(ctx, groupPK, query)
+		require.NoError(t, err)
+		return ids
+	}
+
+	require.Equal(t, []cid.Cid{messages[0].ID, messages[1].ID}, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"hello"}}))
+	require.Equal(t, []cid.Cid{messages[0].ID}, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"hello", "world"}}))
+	require.Equal(t, []cid.Cid{messages[0].ID, messages[2].ID}, search(groupPK, &weshnet.MessageQuery{DevicePK: deviceA}))
+	require.Equal(t, []cid.Cid{messages[0].ID, messages[2].ID}, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"world"}, DevicePK: deviceA}))
+	require.Empty(t, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"world"}, DevicePK: deviceB}))
+	require.Empty(t, search([]byte("unknown group"), &weshnet.MessageQuery{Tokens: []string{"hello"}}))
+
+	// an edit replaces the indexed content of the message, the original
+	// content indexed again doesn't revert it
+	edited := &weshnet.IndexedMessage{GroupPK: groupPK, ID: messages[1].ID, DevicePK: deviceB, Tokens: weshnet.TokenizeMessage([]byte("goodbye there")), Edited: true}
+	require.NoError(t, indexer.IndexMessage(ctx, edited))
+	require.NoError(t, indexer.IndexMessage(ctx, messages[1]))
+	require.Equal(t, []cid.Cid{messages[0].ID}, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"hello"}}))
+	require.Equal(t, []cid.Cid{messages[1].ID, messages[2].ID}, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"goodbye"}}))
+	require.Equal(t, []cid.Cid{messages[1].ID}, search(groupPK, &weshnet.MessageQuery{DevicePK: deviceB}))
+
+	// only the messages of the reset group are dropped
+	require.NoError(t, indexer.(weshnet.MessageIndexResetter).ResetGroup(ctx, groupPK))
+	require.Empty(t, search(groupPK, &weshnet.MessageQuery{Tokens: []string{"hello"}}))
+	require.Equal(t, []cid.Cid{messages[3].ID}, search(otherGroupPK, &weshnet.MessageQuery{Tokens: []string{"hello"}}))
+}
+
+func TestGroupMessageSearch(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+
+	// the first node uses an indexer while the second one scans its messages
+	indexedNode, indexedCleanup := weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger.Named("indexed"),
+		DiscoveryServer: msrv,
+		MessageIndexer:  weshnet.NewInMemoryMessageIndexer(),
+	}, nil)
+	defer indexedCleanup()
+
+	scanningNode, scanningCleanup := weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger.Named("scanning"),
+		DiscoveryServer: msrv,
+	}, nil)
+	defer scanningCleanup()
+
+	weshnet.ConnectAll(t, mn)
+
+	nodes := []*weshnet.TestingProtocol{indexedNode, scanningNode}
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	payloads := map[*weshnet.TestingProtocol][]string{
+		indexedNode:  {"hello world", "see you later"},
+		scanningNode: {"Hello there", "goodbye world"},
+	}
+
+	for node, messages := range payloads {
+		for _, payload := range messages {
+			_, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+				GroupPk: group.PublicKey,
+				Payload: []byte(payload),
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	scanningInfo, err := scanningNode.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	search := func(node *weshnet.TestingProtocol, req *protocoltypes.GroupMessageSearch_Request) []string {
+		req.GroupPk = group.PublicKey
+		reply, err := node.Client.GroupMessageSearch(ctx, req)
+		require.NoError(t, err)
+
+		messages := []string{}
+		for _, evt := range reply.Messages {
+			messages = append(messages, string(evt.Message))
+		}
+
+		return messages
+	}
+
+	for _, tc := range []struct {
+		req      *protocoltypes.GroupMessageSearch_Request
+		expected []string
+	}{
+		{&protocoltypes.GroupMessageSearch_Request{Query: "hello"}, []string{"hello world", "Hello there"}},
+		{&protocoltypes.GroupMessageSearch_Request{Query: "WORLD"}, []string{"hello world", "goodbye world"}},
+		{&protocoltypes.GroupMessageSearch_Request{Query: "hello world"}, []string{"hello world"}},
+		{&protocoltypes.GroupMessageSearch_Request{DevicePk: scanningInfo.DevicePk}, []string{"Hello there", "goodbye world"}},
+		{&protocoltypes.GroupMessageSearch_Request{Query: "world", DevicePk: scanningInfo.DevicePk}, []string{"goodbye world"}},
+		{&protocoltypes.GroupMessageSearch_Request{Query: "unknown"}, []string{}},
+	} {
+		// both nodes must return the same results once all the messages are
+		// received and indexed
+		for _, node := range nodes {
+			require.Eventually(t, func() bool {
+				return assertElementsMatch(tc.expected, search(node, tc.req))
+			}, time.Second*30, time.Millisecond*100)
+		}
+	}
+
+	_, err = indexedNode.Client.GroupMessageSearch(ctx, &protocoltypes.GroupMessageSearch_Request{
+		GroupPk: group.PublicKey,
+		Query:   " ?! ",
+	})
+	require.Error(t, err)
+}
+
+// gatedMessageIndexer blocks the indexing while its gate is closed
+type gatedMessageIndexer struct {
+	weshnet.MessageIndexer
+
+	mu   sync.Mutex
+	gate chan struct{}
+}
+
+func newGatedMessageIndexer() *gatedMessageIndexer {
+	gate := make(chan struct{})
+	close(gate)
+
+	return &gatedMessageIndexer{
+		MessageIndexer: weshnet.NewInMemoryMessageIndexer(),
+		gate:           gate,
+	}
+}
+
+// closeGate blocks the indexing until the returned function is called
+func (i *gatedMessageIndexer) closeGate() (open func()) {
+	gate := make(chan struct{})
+
+	i.mu.Lock()
+	i.gate = gate
+	i.mu.Unlock()
+
+	return func() { close(gate) }
+}
+
+func (i *gatedMessageIndexer) IndexMessage(ctx context.Context, msg *weshnet.IndexedMessage) error {
+	i.mu.Lock()
+	gate := i.gate
+	i.mu.Unlock()
+
+	select {
+	case <-gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return i.MessageIndexer.IndexMessage(ctx, msg)
+}
+
+func (i *gatedMessageIndexer) ResetGroup(ctx context.Context, groupPK []byte) error {
+	return i.MessageIndexer.(weshnet.MessageIndexResetter).ResetGroup(ctx, groupPK)
+}
+
+func TestGroupMessageSearchWaitsForIndexing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	indexer := newGatedMessageIndexer()
+	node, cleanup := weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+		Mocknet:        mn,
+		Logger:         logger,
+		MessageIndexer: indexer,
+	}, nil)
+	defer cleanup()
+
+	createRep, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	const messages = 3
+	for i := 0; i < messages; i++ {
+		_, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: createRep.GroupPk,
+			Payload: []byte("hello"),
+		})
+		require.NoError(t, err)
+	}
+
+	search := func(ctx context.Context) (*protocoltypes.GroupMessageSearch_Reply, error) {
+		return node.Client.GroupMessageSearch(ctx, &protocoltypes.GroupMessageSearch_Request{
+			GroupPk: createRep.GroupPk,
+			Query:   "hello",
+		})
+	}
+
+	require.Eventually(t, func() bool {
+		reply, err := search(ctx)
+		return err == nil && len(reply.Messages) == messages
+	}, time.Second*10, time.Millisecond*100)
+
+	// the index of the group is rebuilt, it is empty until its history is
+	// indexed again
+	open := indexer.closeGate()
+
+	reprocessed := make(chan error, 1)
+	go func() {
+		_, err := node.Client.ServiceReprocessGroup(ctx, &protocoltypes.ServiceReprocessGroup_Request{GroupPk: createRep.GroupPk})
+		reprocessed <- err
+	}()
+
+	// the search waits for the history to be indexed instead of returning
+	// partial results
+	require.Eventually(t, func() bool {
+		searchCtx, searchCancel := context.WithTimeout(ctx, time.Millisecond*100)
+		defer searchCancel()
+
+		_, err := search(searchCtx)
+		return err != nil
+	}, time.Second*10, time.Millisecond*100)
+
+	open()
+	require.NoError(t, <-reprocessed)
+
+	reply, err := search(ctx)
+	require.NoError(t, err)
+	require.Len(t, reply.Messages, messages)
+}
+
+func assertElementsMatch(expected, actual []string) bool {
+	if len(expected) != len(actual) {
+		return false
+	}
+
+	counts := map[string]int{}
+	for _, s := range expected {
+		counts[s]++
+	}
+
+	for _, s := range actual {
+		if counts[s] == 0 {
+			return false
+		}
+		counts[s]--
+	}
+
+	return true
+}
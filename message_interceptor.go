@@ -0,0 +1,26 @@
+package weshnet
+
+import (
+	"context"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// OutgoingMessageInterceptor is called synchronously before a message, an
+// edit or a streamed message is added to a group. It returns the payload to persist, which can be a
+// transformed version of the given one, or an error to reject the message, in
+// which case the error is returned to the sender.
+type OutgoingMessageInterceptor func(ctx context.Context, groupPK []byte, payload []byte) ([]byte, error)
+
+func (s *service) interceptOutgoingMessage(ctx context.Context, groupPK []byte, payload []byte) ([]byte, error) {
+	if s.outgoingInterceptor == nil {
+		return payload, nil
+	}
+
+	payload, err := s.outgoingInterceptor(ctx, groupPK, payload)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMessageRejected.Wrap(err)
+	}
+
+	return payload, nil
+}
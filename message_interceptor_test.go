@@ -0,0 +1,145 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestOutgoingMessageInterceptor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	var (
+		mu          sync.Mutex
+		interceptOn [][]byte
+	)
+
+	// rewrite the payloads and reject the ones containing "rejected"
+	interceptor := func(_ context.Context, groupPK []byte, payload []byte) ([]byte, error) {
+		mu.Lock()
+		interceptOn = append(interceptOn, groupPK)
+		mu.Unlock()
+
+		if bytes.Contains(payload, []byte("rejected")) {
+			return nil, fmt.Errorf("content not allowed")
+		}
+
+		return bytes.ToUpper(payload), nil
+	}
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:                    mn,
+		OutgoingMessageInterceptor: interceptor,
+	}, nil)
+	defer cleanup()
+
+	createRep, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	gc, err := node.Service.(*service).GetContextGroupForID(createRep.GroupPk)
+	require.NoError(t, err)
+
+	getMessage := func(c []byte) *protocoltypes.GroupMessageEvent {
+		_, id, err := cid.CidFromBytes(c)
+		require.NoError(t, err)
+
+		evt, err := gc.MessageStore().GetMessageEventByCID(ctx, id)
+		require.NoError(t, err)
+
+		return evt
+	}
+
+	// sent messages
+	sendRep, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: createRep.GroupPk,
+		Payload: []byte("hello"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("HELLO"), getMessage(sendRep.Cid).Message)
+
+	_, err = node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: createRep.GroupPk,
+		Payload: []byte("rejected"),
+	})
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupMessageRejected))
+
+	// edited messages
+	editRep, err := node.Client.AppMessageEdit(ctx, &protocoltypes.AppMessageEdit_Request{
+		GroupPk: createRep.GroupPk,
+		Cid:     sendRep.Cid,
+		Payload: []byte("hello again"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("HELLO AGAIN"), getMessage(editRep.Cid).Message)
+
+	_, err = node.Client.AppMessageEdit(ctx, &protocoltypes.AppMessageEdit_Request{
+		GroupPk: createRep.GroupPk,
+		Cid:     sendRep.Cid,
+		Payload: []byte("rejected"),
+	})
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupMessageRejected))
+
+	// streamed messages
+	sendStream := func(chunks ...string) (*protocoltypes.AppMessageSendStream_Reply, error) {
+		send, err := node.Client.AppMessageSendStream(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, send.Send(&protocoltypes.AppMessageSendStream_Request{GroupPk: createRep.GroupPk}))
+		for _, chunk := range chunks {
+			require.NoError(t, send.Send(&protocoltypes.AppMessageSendStream_Request{Payload: []byte(chunk)}))
+		}
+
+		return send.CloseAndRecv()
+	}
+
+	streamRep, err := sendStream("streamed ", "hello")
+	require.NoError(t, err)
+	require.Equal(t, uint64(len("STREAMED HELLO")), streamRep.Size)
+
+	_, id, err := cid.CidFromBytes(streamRep.Cid)
+	require.NoError(t, err)
+
+	r, err := gc.MessageStore().OpenMessageStream(ctx, id)
+	require.NoError(t, err)
+
+	streamed, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, []byte("STREAMED HELLO"), streamed)
+
+	_, err = sendStream("streamed ", "rejected")
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrGroupMessageRejected))
+
+	// only the accepted messages have been added: a message, an edit and a
+	// streamed message with its chunk
+	events, err := gc.MessageStore().ListEvents(ctx, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 4, countEntries(events))
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, interceptOn, 6)
+	for _, groupPK := range interceptOn {
+		require.Equal(t, createRep.GroupPk, groupPK)
+	}
+}
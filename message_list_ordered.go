@@ -0,0 +1,104 @@
+package weshnet
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// orderedMessageEvents serializes the events streamed by GroupMessageList
+// when an ordered delivery is requested: the new events are held until the
+// history has been streamed, then they are released by batch, each batch in
+// the order of the log. The events already streamed are dropped.
+type orderedMessageEvents struct {
+	store       *MessageStore
+	historyDone bool
+	pending     []*protocoltypes.GroupMessageEvent
+	sent        map[string]struct{}
+}
+
+func newOrderedMessageEvents(store *MessageStore, historyDone bool) *orderedMessageEvents {
+	return &orderedMessageEvents{
+		store:       store,
+		historyDone: historyDone,
+		sent:        make(map[string]struct{}),
+	}
+}
+
+// history records an event of the history, which is already listed in the
+// order of the log. An event without context marks the end of the history,
+// the held events are then returned.
+func (o *orderedMessageEvents) history(evt *protocoltypes.GroupMessageEvent) []*protocoltypes.GroupMessageEvent {
+	if evt.EventContext == nil {
+		o.historyDone = true
+		return o.flush()
+	}
+
+	if _, ok := o.sent[string(evt.EventContext.Id)]; ok {
+		return nil
+	}
+	o.sent[string(evt.EventContext.Id)] = struct{}{}
+
+	return []*protocoltypes.GroupMessageEvent{evt}
+}
+
+// add holds a new event until the next flush
+func (o *orderedMessageEvents) add(evt *protocoltypes.GroupMessageEvent) {
+	if evt.EventContext == nil {
+		return
+	}
+
+	o.pending = append(o.pending, evt)
+}
+
+// flush returns the held events sorted in the order of the log, nothing is
+// returned until the history has been streamed. Only the held events are
+// sorted, an event replicated after a flush is returned with the next batch
+// even if it precedes the events already returned in the log.
+func (o *orderedMessageEvents) flush() []*protocoltypes.GroupMessageEvent {
+	if !o.historyDone || len(o.pending) == 0 {
+		return nil
+	}
+
+	events := make([]*protocoltypes.GroupMessageEvent, 0, len(o.pending))
+	entries := make(map[*protocoltypes.GroupMessageEvent]ipfslog.Entry, len(o.pending))
+	for _, evt := range o.pending {
+		if _, ok := o.sent[string(evt.EventContext.Id)]; ok {
+			continue
+		}
+		o.sent[string(evt.EventContext.Id)] = struct{}{}
+
+		if id, err := cid.Cast(evt.EventContext.Id); err == nil {
+			if e, ok := o.store.OpLog().Get(id); ok {
+				entries[evt] = e
+			}
+		}
+
+		events = append(events, evt)
+	}
+	o.pending = nil
+
+	// the entries are ordered by their lamport clock in the log, the events
+	// whose entry isn't found are returned last
+	sort.SliceStable(events, func(i, j int) bool {
+		ei, okI := entries[events[i]]
+		ej, okJ := entries[events[j]]
+		if !okI || !okJ {
+			return okI && !okJ
+		}
+
+		ci, cj := ei.GetClock(), ej.GetClock()
+		switch {
+		case ci.GetTime() != cj.GetTime():
+			return ci.GetTime() < cj.GetTime()
+		default:
+			return bytes.Compare(ci.GetID(), cj.GetID()) < 0
+		}
+	})
+
+	return events
+}
@@ -0,0 +1,106 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestGroupMessageListOrdered(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	created, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	send := func(payload string) error {
+		_, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte(payload),
+		})
+		return err
+	}
+
+	const (
+		historyCount = 20
+		producers    = 5
+		perProducer  = 10
+		total        = historyCount + producers*perProducer
+	)
+
+	for i := 0; i < historyCount; i++ {
+		require.NoError(t, send(fmt.Sprintf("history %d", i)))
+	}
+
+	sub, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+		GroupPk: created.GroupPk,
+		Ordered: true,
+	})
+	require.NoError(t, err)
+
+	// the new messages are produced concurrently while the history is
+	// streamed, the errors are checked once the producers are done
+	wg := sync.WaitGroup{}
+	errs := make(chan error, producers*perProducer)
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				if err := send(fmt.Sprintf("producer %d - %d", p, i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p)
+	}
+
+	received := []string{}
+	for len(received) < total {
+		evt, err := sub.Recv()
+		require.NoError(t, err)
+
+		received = append(received, string(evt.EventContext.Id))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// the events are received once, in the order of the log
+	list, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+		GroupPk:  created.GroupPk,
+		UntilNow: true,
+	})
+	require.NoError(t, err)
+
+	expected := []string{}
+	for {
+		evt, err := list.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		expected = append(expected, string(evt.EventContext.Id))
+	}
+
+	require.Len(t, expected, total)
+	require.Equal(t, expected, received)
+}
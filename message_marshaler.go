@@ -27,6 +27,7 @@ type OrbitDBMessageMarshaler struct {
 	sharedKeys   map[string]enc.SharedKey
 	topicGroup   map[string]*protocoltypes.Group
 	deviceCaches map[peer.ID]*PeerDeviceGroup
+	devicePeers  map[string]peer.ID
 	muMarshall   sync.RWMutex
 	selfid       peer.ID
 	secretStore  secretstore.SecretStore
@@ -40,6 +41,7 @@ func NewOrbitDBMessageMarshaler(selfid peer.ID, secretStore secretstore.SecretSt
 		selfid:             selfid,
 		sharedKeys:         make(map[string]enc.SharedKey),
 		deviceCaches:       make(map[peer.ID]*PeerDeviceGroup),
+		devicePeers:        make(map[string]peer.ID),
 		topicGroup:         make(map[string]*protocoltypes.Group),
 		rp:                 rp,
 		secretStore:        secretStore,
@@ -66,6 +68,13 @@ func (m *OrbitDBMessageMarshaler) GetDevicePKForPeerID(id peer.ID) (pdg *PeerDev
 	return
 }
 
+func (m *OrbitDBMessageMarshaler) GetPeerIDForDevicePK(devicePK []byte) (id peer.ID, ok bool) {
+	m.muMarshall.RLock()
+	id, ok = m.devicePeers[string(devicePK)]
+	m.muMarshall.RUnlock()
+	return
+}
+
 func (m *OrbitDBMessageMarshaler) getSharedKeyFor(topic string) (sk enc.SharedKey, ok bool) {
 	sk, ok = m.sharedKeys[topic]
 	return
@@ -194,6 +203,7 @@ func (m *OrbitDBMessageMarshaler) Unmarshal(payload []byte, msg *iface.MessageEx
 		pdg.Group = group
 	}
 	m.deviceCaches[pid] = &pdg
+	m.devicePeers[string(box.DevicePk)] = pid
 
 	return nil
 }
@@ -0,0 +1,148 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// messagePins holds the messages pinned on the device, by group. Pins are
+// local, they are never sent to the other peers.
+type messagePins struct {
+	ds datastore.Batching
+}
+
+func newMessagePins(ds datastore.Batching) *messagePins {
+	return &messagePins{ds: ds}
+}
+
+func messagePinsGroupKey(groupPK []byte) datastore.Key {
+	return datastore.NewKey(hex.EncodeToString(groupPK))
+}
+
+func messagePinKey(groupPK []byte, id cid.Cid) datastore.Key {
+	return messagePinsGroupKey(groupPK).ChildString(id.String())
+}
+
+// messagePinChunkKey is the key of a chunk of a pinned streamed message, the
+// chunks are kept apart from the pinned messages
+func messagePinChunkKey(groupPK []byte, id cid.Cid) datastore.Key {
+	return messagePinsGroupKey(groupPK).ChildString("chunks").ChildString(id.String())
+}
+
+// Pin pins a message of the group along with the chunks of its payload if it
+// is a streamed message, pinning it again is a no-op
+func (p *messagePins) Pin(ctx context.Context, groupPK []byte, id cid.Cid, chunks ...cid.Cid) error {
+	batch, err := p.ds.Batch(ctx)
+	if err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := batch.Put(ctx, messagePinKey(groupPK, id), []byte{}); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	for _, chunk := range chunks {
+		if err := batch.Put(ctx, messagePinChunkKey(groupPK, chunk), []byte{}); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// Unpin removes the pin of a message and of its chunks, it fails if the
+// message isn't pinned
+func (p *messagePins) Unpin(ctx context.Context, groupPK []byte, id cid.Cid, chunks ...cid.Cid) error {
+	key := messagePinKey(groupPK, id)
+
+	has, err := p.ds.Has(ctx, key)
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if !has {
+		return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("message %s isn't pinned", id))
+	}
+
+	batch, err := p.ds.Batch(ctx)
+	if err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := batch.Delete(ctx, key); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	for _, chunk := range chunks {
+		if err := batch.Delete(ctx, messagePinChunkKey(groupPK, chunk)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// IsPinned checks whether a message of the group is pinned, or whether a
+// chunk belongs to a pinned streamed message
+func (p *messagePins) IsPinned(ctx context.Context, groupPK []byte, id cid.Cid) bool {
+	if p == nil {
+		return false
+	}
+
+	if has, err := p.ds.Has(ctx, messagePinKey(groupPK, id)); err == nil && has {
+		return true
+	}
+
+	has, err := p.ds.Has(ctx, messagePinChunkKey(groupPK, id))
+	return err == nil && has
+}
+
+// List returns the messages pinned in the group
+func (p *messagePins) List(ctx context.Context, groupPK []byte) ([]cid.Cid, error) {
+	results, err := p.ds.Query(ctx, query.Query{
+		Prefix:   messagePinsGroupKey(groupPK).String(),
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKey{}},
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	ids := []cid.Cid{}
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(res.Error)
+		}
+
+		// the chunks of the pinned streamed messages aren't listed
+		key := datastore.RawKey(res.Key)
+		if !key.Parent().Equal(messagePinsGroupKey(groupPK)) {
+			continue
+		}
+
+		id, err := cid.Parse(key.BaseNamespace())
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
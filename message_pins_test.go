@@ -0,0 +1,118 @@
+package weshnet
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestServicePinMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	created, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Client.GroupMessageExpirationSet(ctx, &protocoltypes.GroupMessageExpirationSet_Request{
+		GroupPk:    created.GroupPk,
+		Expiration: 1,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		info, err := node.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: created.GroupPk})
+		require.NoError(t, err)
+		return info.MessageExpiration == 1
+	}, time.Second*5, time.Millisecond*100)
+
+	sent := [][]byte{}
+	for _, payload := range []string{"first", "pinned", "last"} {
+		reply, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte(payload),
+		})
+		require.NoError(t, err)
+
+		sent = append(sent, reply.Cid)
+	}
+
+	listMessages := func() []string {
+		sub, err := node.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  created.GroupPk,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		messages := []string{}
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				return messages
+			}
+			require.NoError(t, err)
+
+			messages = append(messages, string(evt.Message))
+		}
+	}
+
+	listPinned := func() [][]byte {
+		reply, err := node.Client.ServiceListPinnedMessages(ctx, &protocoltypes.ServiceListPinnedMessages_Request{GroupPk: created.GroupPk})
+		require.NoError(t, err)
+
+		return reply.Cids
+	}
+
+	require.Empty(t, listPinned())
+
+	_, err = node.Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{GroupPk: created.GroupPk, Cid: sent[1]})
+	require.NoError(t, err)
+
+	// pinning a message twice is a no-op
+	_, err = node.Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{GroupPk: created.GroupPk, Cid: sent[1]})
+	require.NoError(t, err)
+
+	require.Equal(t, [][]byte{sent[1]}, listPinned())
+
+	// only the messages of the group can be pinned
+	unknown, err := cid.Parse("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	require.NoError(t, err)
+
+	_, err = node.Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{GroupPk: created.GroupPk, Cid: unknown.Bytes()})
+	require.Error(t, err)
+
+	_, err = node.Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{GroupPk: created.GroupPk, Cid: sent[0], Unpin: true})
+	require.Error(t, err)
+
+	// once the timer has elapsed only the pinned message is kept
+	require.Eventually(t, func() bool {
+		return len(listMessages()) == 1
+	}, time.Second*5, time.Millisecond*100)
+	require.Equal(t, []string{"pinned"}, listMessages())
+
+	// the message expires once unpinned
+	_, err = node.Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{GroupPk: created.GroupPk, Cid: sent[1], Unpin: true})
+	require.NoError(t, err)
+
+	require.Empty(t, listPinned())
+	require.Empty(t, listMessages())
+
+	id, err := cid.Cast(sent[1])
+	require.NoError(t, err)
+
+	err = node.Service.(*service).odb.messagePins.Unpin(ctx, created.GroupPk, id)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrNotFound))
+}
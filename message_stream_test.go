@@ -0,0 +1,144 @@
+package weshnet_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestAppMessageStream(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		ConnectFunc:     weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	// a few megabytes, not a multiple of the size of the chunks
+	payload := make([]byte, 5*512*1024+123)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	send, err := nodes[0].Client.AppMessageSendStream(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, send.Send(&protocoltypes.AppMessageSendStream_Request{GroupPk: group.PublicKey}))
+	for remaining := payload; len(remaining) > 0; {
+		n := min(len(remaining), 100*1024)
+		require.NoError(t, send.Send(&protocoltypes.AppMessageSendStream_Request{Payload: remaining[:n]}))
+		remaining = remaining[n:]
+	}
+
+	sent, err := send.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(payload)), sent.Size)
+
+	// only the streamed message is listed, not its chunks
+	var listed []*protocoltypes.GroupMessageEvent
+	require.Eventually(t, func() bool {
+		sub, err := nodes[1].Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  group.PublicKey,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		listed = nil
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			listed = append(listed, evt)
+		}
+
+		return len(listed) > 0
+	}, time.Second*20, time.Millisecond*200)
+
+	require.Len(t, listed, 1)
+	require.Equal(t, sent.Cid, listed[0].EventContext.Id)
+	require.Empty(t, listed[0].Message)
+	require.Equal(t, uint64(len(payload)), listed[0].StreamSize)
+	require.Len(t, listed[0].StreamChunks, 11)
+
+	// the chunks aren't counted as unread messages
+	counts, err := nodes[1].Client.ServiceGetUnreadCounts(ctx, &protocoltypes.ServiceGetUnreadCounts_Request{})
+	require.NoError(t, err)
+	for _, count := range counts.Groups {
+		if bytes.Equal(count.GroupPk, group.PublicKey) {
+			require.Equal(t, uint64(1), count.Unread)
+		}
+	}
+
+	// a chunk is pinned along with its streamed message only
+	_, err = nodes[1].Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{
+		GroupPk: group.PublicKey,
+		Cid:     listed[0].StreamChunks[0],
+	})
+	require.Error(t, err)
+
+	_, err = nodes[1].Client.ServicePinMessage(ctx, &protocoltypes.ServicePinMessage_Request{
+		GroupPk: group.PublicKey,
+		Cid:     sent.Cid,
+	})
+	require.NoError(t, err)
+
+	pinned, err := nodes[1].Client.ServiceListPinnedMessages(ctx, &protocoltypes.ServiceListPinnedMessages_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+	require.Len(t, pinned.Cids, 1)
+	require.Equal(t, sent.Cid, pinned.Cids[0])
+
+	// the payload is read back in chunks by both members
+	for _, node := range nodes {
+		read, err := node.Client.GroupMessageReadStream(ctx, &protocoltypes.GroupMessageReadStream_Request{
+			GroupPk: group.PublicKey,
+			Cid:     sent.Cid,
+		})
+		require.NoError(t, err)
+
+		received := bytes.Buffer{}
+		chunks := 0
+		for {
+			reply, err := read.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, reply.Payload)
+
+			received.Write(reply.Payload)
+			chunks++
+		}
+
+		require.Greater(t, chunks, 1)
+		require.True(t, bytes.Equal(payload, received.Bytes()), "the streamed payload should be read back as is")
+	}
+}
@@ -25,9 +25,11 @@ import (
 	"berty.tech/go-ipfs-log/io"
 	orbitdb "berty.tech/go-orbit-db"
 	"berty.tech/go-orbit-db/baseorbitdb"
+	"berty.tech/go-orbit-db/cache"
 	"berty.tech/go-orbit-db/iface"
 	"berty.tech/go-orbit-db/pubsub/pubsubcoreapi"
 	"berty.tech/go-orbit-db/stores"
+	"berty.tech/weshnet/v2/internal/datastoreutil"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/ipfsutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
@@ -60,6 +62,28 @@ type NewOrbitDBOptions struct {
 	GroupMetadataStoreType string
 	GroupMessageStoreType  string
 	ReplicationMode        bool
+
+	// InboundWorkers is the number of entries received from the group stores
+	// which can be processed concurrently, defaults to 4
+	InboundWorkers int
+
+	// DisableStrictSignatureVerification accepts the group entries failing
+	// the signature verification instead of rejecting them, a warning is
+	// logged for each of them. It must only be used for debugging.
+	DisableStrictSignatureVerification bool
+
+	// MembershipValidator is an optional hook able to reject the devices
+	// added to the groups, see MembershipValidator
+	MembershipValidator MembershipValidator
+
+	// UnknownMemberPolicy defines how the messages sent by a device which
+	// isn't a known member of their group are handled, defaults to
+	// UnknownMemberPolicyHold
+	UnknownMemberPolicy UnknownMemberPolicy
+
+	// CacheDatastore holds the caches of the stores, ie. their heads, instead
+	// of Datastore. It is ignored if Cache is set.
+	CacheDatastore datastore.Batching
 }
 
 func (n *NewOrbitDBOptions) applyDefaults() {
@@ -72,7 +96,11 @@ func (n *NewOrbitDBOptions) applyDefaults() {
 	}
 
 	if n.Cache == nil {
-		n.Cache = NewOrbitDatastoreCache(n.Datastore)
+		if n.CacheDatastore != nil {
+			n.Cache = NewOrbitDatastoreCache(n.CacheDatastore)
+		} else {
+			n.Cache = NewOrbitDatastoreCache(n.Datastore)
+		}
 	}
 
 	if n.Logger == nil {
@@ -110,17 +138,46 @@ type WeshOrbitDB struct {
 	pubSub             iface.PubSubInterface
 	rotationInterval   *rendezvous.RotationInterval
 	messageMarshaler   *OrbitDBMessageMarshaler
+	lastSeen           *lastSeenTracker
+	auditLog           *auditLog
+	messagePins        *messagePins
+	readMarkers        *readMarkers
+	contactQRTokens    *contactQRTokens
+	restoreCheckpoints datastore.Batching
+	groupTopics        *groupTopics
+	replicationLag     *replicationLagTracker
+	groupErrors        *groupErrorTracker
+	inboundPool        *inboundWorkerPool
+	sigVerifier        *signatureVerifier
 	replicationMode    bool
 	prometheusRegister prometheus.Registerer
 
+	// writes tracks the writes to the stores, they are rejected and flushed
+	// when the service shuts down
+	writes *writeGuard
+
 	groupMetadataStoreType string
 	groupMessageStoreType  string
 
+	// membershipValidator is given to the metadata stores
+	membershipValidator MembershipValidator
+
+	// encryption is the encryption version negotiated with the peers, used
+	// by the stores to encrypt the new entries
+	encryption *groupEncryption
+
+	unknownMemberPolicy UnknownMemberPolicy
+
 	ctx context.Context
 	// FIXME(gfanton): use real map instead of sync.Map
 	groups          *GroupMap           // map[string]*protocoltypes.Group
 	groupContexts   *GroupContextMap    // map[string]*GroupContext
 	groupsSigPubKey *GroupsSigPubKeyMap // map[string]crypto.PubKey
+
+	// cache is the default cache of the stores, groupCaches holds the caches
+	// of the groups whose stores have been migrated, see setGroupCache
+	cache       cache.Interface
+	groupCaches sync.Map // map[string]cache.Interface
 }
 
 func (s *WeshOrbitDB) registerGroupPrivateKey(g *protocoltypes.Group) error {
@@ -186,6 +243,14 @@ func NewWeshOrbitDB(ctx context.Context, ipfs coreiface.CoreAPI, options *NewOrb
 		options.PubSub = pubsubcoreapi.NewPubSub(ipfs, self.ID(), time.Second, options.Logger, options.Tracer)
 	}
 
+	// the stores of the groups with a custom topic are subscribed to it
+	// instead of their address
+	topics, err := newGroupTopics(ctx, datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceGroupTopics)))
+	if err != nil {
+		return nil, err
+	}
+	options.PubSub = &groupTopicsPubSub{PubSubInterface: options.PubSub, topics: topics}
+
 	mm := NewOrbitDBMessageMarshaler(self.ID(), options.SecretStore, options.RotationInterval, options.ReplicationMode)
 	options.MessageMarshaler = mm
 
@@ -194,9 +259,28 @@ func NewWeshOrbitDB(ctx context.Context, ipfs coreiface.CoreAPI, options *NewOrb
 		return nil, errcode.ErrCode_TODO.Wrap(err)
 	}
 
+	auditLog, err := newAuditLog(ctx, datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceAuditLog)), options.Logger)
+	if err != nil {
+		_ = orbitDB.Close()
+		return nil, err
+	}
+
 	bertyDB := &WeshOrbitDB{
 		ctx:                    ctx,
 		messageMarshaler:       mm,
+		lastSeen:               newLastSeenTracker(),
+		auditLog:               auditLog,
+		messagePins:            newMessagePins(datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceMessagePins))),
+		readMarkers:            newReadMarkers(datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceReadMarkers))),
+		contactQRTokens:        newContactQRTokens(datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceContactQRTokens))),
+		restoreCheckpoints:     datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceRestoreCheckpoint)),
+		groupTopics:            topics,
+		replicationLag:         newReplicationLagTracker(),
+		groupErrors:            newGroupErrorTracker(),
+		inboundPool:            newInboundWorkerPool(ctx, options.InboundWorkers),
+		sigVerifier:            newSignatureVerifier(options.PrometheusRegister, options.Logger, options.DisableStrictSignatureVerification),
+		writes:                 &writeGuard{},
+		encryption:             &groupEncryption{},
 		BaseOrbitDB:            orbitDB,
 		keyStore:               ks,
 		secretStore:            options.SecretStore,
@@ -209,6 +293,9 @@ func NewWeshOrbitDB(ctx context.Context, ipfs coreiface.CoreAPI, options *NewOrb
 		groupMessageStoreType:  options.GroupMessageStoreType,
 		replicationMode:        options.ReplicationMode,
 		prometheusRegister:     options.PrometheusRegister,
+		membershipValidator:    options.MembershipValidator,
+		unknownMemberPolicy:    options.UnknownMemberPolicy,
+		cache:                  options.Cache,
 	}
 
 	if err := bertyDB.RegisterAccessControllerType(NewSimpleAccessController); err != nil {
@@ -305,6 +392,8 @@ func (s *WeshOrbitDB) setHeadsForGroup(ctx context.Context, g *protocoltypes.Gro
 		return errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("metadata store is nil"))
 	}
 
+	linkGroupStores(metaImpl, messagesImpl)
+
 	var wg sync.WaitGroup
 
 	// load and wait heads for metadata and message stores
@@ -333,6 +422,86 @@ func (s *WeshOrbitDB) setHeadsForGroup(ctx context.Context, g *protocoltypes.Gro
 	return nil
 }
 
+// dropStoresForGroup removes the local content of the stores of a group which
+// isn't opened, it is used to roll back an incomplete restore
+func (s *WeshOrbitDB) dropStoresForGroup(ctx context.Context, g *protocoltypes.Group) error {
+	if _, err := s.getGroupContext(g.GroupIDAsString()); err == nil {
+		return errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to drop the stores of an opened group"))
+	}
+
+	for _, storeType := range []string{s.groupMetadataStoreType, s.groupMessageStoreType} {
+		store, err := s.storeForGroup(ctx, s, g, nil, storeType, GroupOpenModeReplicate)
+		if err != nil {
+			return errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+		}
+
+		if err := store.Drop(); err != nil {
+			return errcode.ErrCode_ErrDBDestroy.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// groupHasLocalData checks whether the stores of a group have entries in the
+// local data, an opened group is considered to have some
+func (s *WeshOrbitDB) groupHasLocalData(ctx context.Context, g *protocoltypes.Group) (bool, error) {
+	if _, err := s.getGroupContext(g.GroupIDAsString()); err == nil {
+		return true, nil
+	}
+
+	stores, err := s.openStoresWithoutReplication(ctx, g)
+	if err != nil {
+		return false, err
+	}
+
+	hasData := false
+	for _, store := range stores {
+		if store.OpLog().GetEntries().Len() > 0 {
+			hasData = true
+		}
+
+		_ = store.Close()
+	}
+
+	return hasData, nil
+}
+
+// openStoresWithoutReplication opens the stores of a group which isn't
+// opened, their logs are loaded from the local data and they aren't
+// replicated. The stores must be closed by the caller.
+func (s *WeshOrbitDB) openStoresWithoutReplication(ctx context.Context, g *protocoltypes.Group) ([]iface.Store, error) {
+	groupID := g.GroupIDAsString()
+	if _, err := s.getGroupContext(groupID); err == nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("the group is already opened"))
+	}
+
+	s.groups.Store(groupID, g)
+
+	if err := s.registerGroupSigningPubKey(g); err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	replicate := false
+	opened := []iface.Store{}
+	for _, storeType := range []string{s.groupMetadataStoreType, s.groupMessageStoreType} {
+		store, err := s.storeForGroup(ctx, s, g, &orbitdb.CreateDBOptions{Replicate: &replicate}, storeType, GroupOpenModeReplicate)
+		if err != nil {
+			for _, store := range opened {
+				_ = store.Close()
+			}
+
+			return nil, errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+		}
+
+		opened = append(opened, store)
+	}
+
+	linkGroupStores(opened[0], opened[1])
+
+	return opened, nil
+}
+
 func (s *WeshOrbitDB) loadHeads(ctx context.Context, store iface.Store, heads []cid.Cid) (err error) {
 	sub, err := store.EventBus().Subscribe(new(stores.EventReplicated),
 		eventbus.Name("weshnet/load-heads"))
@@ -441,6 +610,7 @@ func (s *WeshOrbitDB) OpenGroup(ctx context.Context, g *protocoltypes.Group, opt
 		return nil, errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
 	}
 	s.messageMarshaler.RegisterGroup(messagesImpl.Address().String(), g)
+	linkGroupStores(metaImpl, messagesImpl)
 
 	s.Logger().Debug("Got message store", tyber.FormatStepLogFields(s.ctx, []tyber.Detail{})...)
 
@@ -487,9 +657,27 @@ func (s *WeshOrbitDB) OpenGroupReplication(ctx context.Context, g *protocoltypes
 		return nil, nil, errors.Wrap(err, "unable to open database")
 	}
 
+	linkGroupStores(metadataStore, messageStore)
+
 	return metadataStore, messageStore, nil
 }
 
+// linkGroupStores gives the metadata store of a group to its message store,
+// which needs the members of the group to apply the unknown member policy
+func linkGroupStores(metadataStore, messageStore iface.Store) {
+	metadata, ok := metadataStore.(*MetadataStore)
+	if !ok {
+		return
+	}
+
+	messages, ok := messageStore.(*MessageStore)
+	if !ok {
+		return
+	}
+
+	messages.metadataStore.Store(metadata)
+}
+
 func (s *WeshOrbitDB) getGroupContext(id string) (*GroupContext, error) {
 	g, ok := s.groupContexts.Load(id)
 	if !ok {
@@ -510,6 +698,26 @@ func (s *WeshOrbitDB) getGroupContext(id string) (*GroupContext, error) {
 	return g.(*GroupContext), nil
 }
 
+// groupCache returns the cache holding the stores of a group
+func (s *WeshOrbitDB) groupCache(groupID string) cache.Interface {
+	if groupCache, ok := s.groupCaches.Load(groupID); ok {
+		return groupCache.(cache.Interface)
+	}
+
+	return s.cache
+}
+
+// setGroupCache sets the cache used by the stores of a group opened from now
+// on, the default cache is used again if c is nil
+func (s *WeshOrbitDB) setGroupCache(groupID string, c cache.Interface) {
+	if c == nil {
+		s.groupCaches.Delete(groupID)
+		return
+	}
+
+	s.groupCaches.Store(groupID, c)
+}
+
 // SetGroupSigPubKey registers a new group signature pubkey, mainly used to
 // replicate a store data without needing to access to its content
 func (s *WeshOrbitDB) SetGroupSigPubKey(groupID string, pubKey crypto.PubKey) error {
@@ -534,6 +742,12 @@ func (s *WeshOrbitDB) storeForGroup(ctx context.Context, o iface.BaseOrbitDB, g
 		options.EventBus = eventbus.NewBus(eventbus.WithMetricsTracer(eventbus.NewMetricsTracer(eventbus.WithRegisterer(s.prometheusRegister))))
 	}
 
+	if options.Cache == nil {
+		if groupCache, ok := s.groupCaches.Load(g.GroupIDAsString()); ok {
+			options.Cache = groupCache.(cache.Interface)
+		}
+	}
+
 	options, err := DefaultOrbitDBOptions(g, options, s.keyStore, storeType, groupOpenMode)
 	if err != nil {
 		return nil, err
@@ -550,6 +764,7 @@ func (s *WeshOrbitDB) storeForGroup(ctx context.Context, o iface.BaseOrbitDB, g
 	}
 
 	s.messageMarshaler.RegisterGroup(addr.String(), g)
+	s.groupTopics.registerStore(g.GroupIDAsString(), addr.String(), storeType)
 
 	linkKey, err := g.GetLinkKeyArray()
 	if err != nil {
@@ -668,3 +883,7 @@ func (s *WeshOrbitDB) IsGroupLoaded(groupID string) bool {
 func (s *WeshOrbitDB) GetDevicePKForPeerID(id peer.ID) (pdg *PeerDeviceGroup, ok bool) {
 	return s.messageMarshaler.GetDevicePKForPeerID(id)
 }
+
+func (s *WeshOrbitDB) GetPeerIDForDevicePK(devicePK []byte) (id peer.ID, ok bool) {
+	return s.messageMarshaler.GetPeerIDForDevicePK(devicePK)
+}
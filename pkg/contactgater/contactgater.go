@@ -0,0 +1,123 @@
+// Package contactgater restricts the connections of a node to the devices of
+// its contacts.
+//
+// The inbound connections of the peers which aren't known devices of the
+// contacts are rejected by the connection gater. When a peer connects, over
+// any transport including the proximity ones, it is sent a challenge on a
+// dedicated stream. The peer answers with a proof per contact, made with the
+// secret of the group shared with the contact and bound to the IDs of both
+// peers. The connections of the peers which can't prove they know the secret
+// of a contact are closed, the peers are then rejected by the connection
+// gater for a while.
+//
+// The Gater answers the challenges of the other nodes with a Responder. A
+// node which doesn't enforce the verification can run a Responder alone to
+// be accepted by the nodes enforcing it.
+package contactgater
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	mrand "math/rand"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	ProtocolID = protocol.ID("wesh/p2p/contact-proof/1.0.0")
+
+	nonceSize      = 32
+	maxMessageSize = 256 * 1024
+
+	// proofPadding is the granularity of the number of proofs sent, so the
+	// contacts can't be counted precisely
+	proofPadding = 16
+
+	proofPrefix = "weshnet/contact-proof:"
+)
+
+// Key is a secret shared with a contact, the peers knowing it are considered
+// to be devices of the contact
+type Key struct {
+	// ContactPK identifies the contact
+	ContactPK []byte
+	Secret    []byte
+}
+
+// KeysFunc returns the keys of the current contacts, it is called each time
+// a challenge is made or answered so the contacts added or removed since are
+// taken into account
+type KeysFunc func() ([]Key, error)
+
+// makeProof returns the proof that prover knows secret, it is only valid for
+// the given nonce and verifier
+func makeProof(secret []byte, nonce []byte, prover, verifier peer.ID) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(proofPrefix))
+	mac.Write(nonce)
+	mac.Write([]byte(prover))
+	mac.Write([]byte(verifier))
+	return mac.Sum(nil)
+}
+
+// makeProofs returns the proofs of all the given keys, padded with random
+// values and shuffled
+func makeProofs(keys []Key, nonce []byte, prover, verifier peer.ID) ([][]byte, error) {
+	count := (len(keys)/proofPadding + 1) * proofPadding
+	proofs := make([][]byte, 0, count)
+	for _, key := range keys {
+		proofs = append(proofs, makeProof(key.Secret, nonce, prover, verifier))
+	}
+
+	for len(proofs) < count {
+		padding := make([]byte, sha256.Size)
+		if _, err := rand.Read(padding); err != nil {
+			return nil, fmt.Errorf("unable to generate padding: %w", err)
+		}
+
+		proofs = append(proofs, padding)
+	}
+
+	mrand.Shuffle(len(proofs), func(i, j int) {
+		proofs[i], proofs[j] = proofs[j], proofs[i]
+	})
+
+	return proofs, nil
+}
+
+// checkProofs returns the contact whose key has been used for one of the
+// proofs, ok is false if none of them is valid
+func checkProofs(keys []Key, proofs [][]byte, nonce []byte, prover, verifier peer.ID) (contactPK []byte, ok bool) {
+	expected := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		expected[string(makeProof(key.Secret, nonce, prover, verifier))] = key.ContactPK
+	}
+
+	for _, proof := range proofs {
+		if contactPK, ok := expected[string(proof)]; ok {
+			return contactPK, true
+		}
+	}
+
+	return nil, false
+}
+
+// resetOnDone resets s once ctx is done, as not all the transports support
+// deadlines, the returned func must be called once s isn't used anymore
+func resetOnDone(ctx context.Context, s network.Stream) (release func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Reset()
+		case <-done:
+		}
+	}()
+
+	return func() { close(done) }
+}
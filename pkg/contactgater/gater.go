@@ -0,0 +1,389 @@
+package contactgater
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protoio"
+)
+
+const (
+	DefaultVerifyTimeout = time.Second * 10
+	DefaultDenyDuration  = time.Minute * 5
+
+	// expectDuration is how long the inbound connections of a peer dialed by
+	// the node are accepted, so two contacts which discovered each other can
+	// connect even if they never met before
+	expectDuration = time.Minute * 5
+)
+
+// Gater verifies that the connected peers are devices of the contacts and
+// closes the connections of the other ones. It also implements
+// connmgr.ConnectionGater, it should be given to the libp2p host with
+// libp2p.ConnectionGater so the inbound connections of the peers which
+// aren't known devices of the contacts are rejected before being upgraded.
+// A peer is known once it has been verified, or while the node is dialing
+// it. The connections of a host without the gater are still closed once the
+// verification fails.
+//
+// The outbound connections are accepted then verified like the inbound ones,
+// whatever the protocols of the peer are. The peers which don't answer the
+// challenges, such as the relays, the rendezvous points and the DHT nodes,
+// must be given to WithAllowedPeers or AllowPeers to be kept.
+type Gater struct {
+	logger        *zap.Logger
+	verifyTimeout time.Duration
+	denyDuration  time.Duration
+
+	allowed   map[peer.ID]struct{}
+	muAllowed sync.RWMutex
+
+	rootCtx    context.Context
+	rootCancel context.CancelFunc
+	h          host.Host
+	keys       KeysFunc
+
+	responder *Responder
+
+	verified map[peer.ID][]byte
+	known    map[peer.ID]struct{}
+	expected map[peer.ID]time.Time
+	denied   map[peer.ID]time.Time
+	muPeers  sync.RWMutex
+}
+
+var _ connmgr.ConnectionGater = (*Gater)(nil)
+
+type Option func(g *Gater)
+
+// WithAllowedPeers allows the given peers without verification, such as the
+// relays, the rendezvous points and the bootstrap nodes
+func WithAllowedPeers(peers ...peer.ID) Option {
+	return func(g *Gater) {
+		for _, p := range peers {
+			g.allowed[p] = struct{}{}
+		}
+	}
+}
+
+// WithVerifyTimeout sets the time given to a peer to answer the challenge,
+// DefaultVerifyTimeout is used by default
+func WithVerifyTimeout(timeout time.Duration) Option {
+	return func(g *Gater) {
+		g.verifyTimeout = timeout
+	}
+}
+
+// WithDenyDuration sets how long the peers which failed the verification are
+// rejected by the connection gater, DefaultDenyDuration is used by default
+func WithDenyDuration(duration time.Duration) Option {
+	return func(g *Gater) {
+		g.denyDuration = duration
+	}
+}
+
+// New returns a gater which doesn't verify anything until it is started, so
+// it can be given to the host before the contacts are known
+func New(logger *zap.Logger, opts ...Option) *Gater {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	g := &Gater{
+		logger:        logger.Named("contactgater"),
+		verifyTimeout: DefaultVerifyTimeout,
+		denyDuration:  DefaultDenyDuration,
+		allowed:       make(map[peer.ID]struct{}),
+		verified:      make(map[peer.ID][]byte),
+		known:         make(map[peer.ID]struct{}),
+		expected:      make(map[peer.ID]time.Time),
+		denied:        make(map[peer.ID]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	return g
+}
+
+// Start verifies the peers connected to h, using the keys of the contacts
+// returned by keys. It also answers the challenges of the contacts, with the
+// same keys.
+func (g *Gater) Start(h host.Host, keys KeysFunc) error {
+	if g.isStarted() {
+		return fmt.Errorf("gater already started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g.rootCtx, g.rootCancel = ctx, cancel
+	g.keys = keys
+
+	g.muPeers.Lock()
+	g.h = h
+	g.muPeers.Unlock()
+
+	g.responder = NewResponder(g.logger, h, keys)
+
+	if err := g.monitorConnection(ctx); err != nil {
+		cancel()
+		_ = g.responder.Close()
+		return fmt.Errorf("unable to monitor connection: %w", err)
+	}
+
+	return nil
+}
+
+func (g *Gater) Close() error {
+	if g.rootCancel != nil {
+		g.rootCancel()
+	}
+
+	if g.responder != nil {
+		return g.responder.Close()
+	}
+
+	return nil
+}
+
+// Verified returns the contact of a connected peer, ok is false if the peer
+// hasn't been verified yet
+func (g *Gater) Verified(p peer.ID) (contactPK []byte, ok bool) {
+	g.muPeers.RLock()
+	contactPK, ok = g.verified[p]
+	g.muPeers.RUnlock()
+	return contactPK, ok
+}
+
+func (g *Gater) isStarted() bool {
+	g.muPeers.RLock()
+	defer g.muPeers.RUnlock()
+	return g.h != nil
+}
+
+// AllowPeers allows the given peers without verification, like
+// WithAllowedPeers, e.g. for the rendezvous points set at runtime
+func (g *Gater) AllowPeers(peers ...peer.ID) {
+	g.muAllowed.Lock()
+	for _, p := range peers {
+		g.allowed[p] = struct{}{}
+	}
+	g.muAllowed.Unlock()
+}
+
+func (g *Gater) isAllowed(p peer.ID) bool {
+	g.muAllowed.RLock()
+	_, ok := g.allowed[p]
+	g.muAllowed.RUnlock()
+	return ok
+}
+
+// isKnown returns true if p has been verified or is being dialed by the node
+func (g *Gater) isKnown(p peer.ID) bool {
+	g.muPeers.RLock()
+	defer g.muPeers.RUnlock()
+
+	if _, ok := g.known[p]; ok {
+		return true
+	}
+
+	until, ok := g.expected[p]
+	return ok && time.Now().Before(until)
+}
+
+// expect accepts the inbound connections of p for a while
+func (g *Gater) expect(p peer.ID) {
+	now := time.Now()
+
+	g.muPeers.Lock()
+	for expected, until := range g.expected {
+		if now.After(until) {
+			delete(g.expected, expected)
+		}
+	}
+	g.expected[p] = now.Add(expectDuration)
+	g.muPeers.Unlock()
+}
+
+func (g *Gater) isDenied(p peer.ID) bool {
+	g.muPeers.RLock()
+	until, ok := g.denied[p]
+	g.muPeers.RUnlock()
+
+	return ok && time.Now().Before(until)
+}
+
+func (g *Gater) deny(p peer.ID) {
+	g.muPeers.Lock()
+	g.denied[p] = time.Now().Add(g.denyDuration)
+	delete(g.verified, p)
+	delete(g.known, p)
+	delete(g.expected, p)
+	g.muPeers.Unlock()
+}
+
+func (g *Gater) InterceptPeerDial(p peer.ID) (allow bool) {
+	if g.isDenied(p) {
+		return false
+	}
+
+	g.expect(p)
+	return true
+}
+
+func (g *Gater) InterceptAddrDial(peer.ID, ma.Multiaddr) (allow bool) {
+	return true
+}
+
+func (g *Gater) InterceptAccept(network.ConnMultiaddrs) (allow bool) {
+	return true
+}
+
+func (g *Gater) InterceptSecured(dir network.Direction, p peer.ID, _ network.ConnMultiaddrs) (allow bool) {
+	switch {
+	case g.isAllowed(p):
+		return true
+	case g.isDenied(p):
+		return false
+	case dir == network.DirOutbound, !g.isStarted():
+		// the outbound connections are verified once connected, the
+		// connections made before the contacts are known are verified on
+		// start
+		return true
+	default:
+		return g.isKnown(p)
+	}
+}
+
+func (g *Gater) InterceptUpgraded(network.Conn) (allow bool, reason control.DisconnectReason) {
+	return true, 0
+}
+
+// challenge sends a challenge to p and checks its proofs
+func (g *Gater) challenge(ctx context.Context, p peer.ID) ([]byte, error) {
+	keys, err := g.keys()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get contact keys: %w", err)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	s, err := g.h.NewStream(network.WithAllowLimitedConn(ctx, "contactgater"), p, ProtocolID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create stream: %w", err)
+	}
+	defer s.Close()
+	defer resetOnDone(ctx, s)()
+
+	if err := protoio.NewDelimitedWriter(s).WriteMsg(&Challenge{Nonce: nonce}); err != nil {
+		return nil, fmt.Errorf("write error: %w", err)
+	}
+
+	proof := &Proof{}
+	if err := protoio.NewDelimitedReader(s, maxMessageSize).ReadMsg(proof); err != nil {
+		return nil, fmt.Errorf("read error: %w", err)
+	}
+
+	contactPK, ok := checkProofs(keys, proof.Proofs, nonce, p, g.h.ID())
+	if !ok {
+		return nil, fmt.Errorf("the peer isn't a device of a contact")
+	}
+
+	return contactPK, nil
+}
+
+func (g *Gater) verify(ctx context.Context, p peer.ID) {
+	if p == g.h.ID() || g.isAllowed(p) {
+		return
+	}
+
+	if _, ok := g.Verified(p); ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.verifyTimeout)
+	defer cancel()
+
+	contactPK, err := g.challenge(ctx, p)
+	if err != nil {
+		if g.rootCtx.Err() != nil {
+			// the gater is closing
+			return
+		}
+
+		g.logger.Warn("closing the connections of an unverified peer", logutil.PrivateString("peer", p.String()), zap.Error(err))
+		g.deny(p)
+		if err := g.h.Network().ClosePeer(p); err != nil {
+			g.logger.Warn("unable to close peer", logutil.PrivateString("peer", p.String()), zap.Error(err))
+		}
+
+		return
+	}
+
+	g.logger.Debug("peer verified", logutil.PrivateString("peer", p.String()))
+
+	g.muPeers.Lock()
+	g.verified[p] = contactPK
+	g.known[p] = struct{}{}
+	g.muPeers.Unlock()
+}
+
+func (g *Gater) monitorConnection(ctx context.Context) error {
+	sub, err := g.h.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged),
+		eventbus.Name("weshnet/contactgater/monitor-connection"))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to peer events: %w", err)
+	}
+
+	// check already connected peers
+	for _, p := range g.h.Network().Peers() {
+		go g.verify(ctx, p)
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			var e interface{}
+			select {
+			case e = <-sub.Out():
+			case <-ctx.Done():
+				return
+			}
+
+			evt := e.(event.EvtPeerConnectednessChanged)
+			switch evt.Connectedness {
+			case network.Connected, network.Limited:
+				// every connected peer is challenged, whatever the
+				// direction of its connection and its protocols are
+				go g.verify(ctx, evt.Peer)
+			case network.NotConnected:
+				// peers are verified again on the next connection, unless
+				// they already connected again
+				if g.h.Network().Connectedness(evt.Peer) == network.NotConnected {
+					g.muPeers.Lock()
+					delete(g.verified, evt.Peer)
+					g.muPeers.Unlock()
+				}
+			}
+		}
+	}()
+
+	return nil
+}
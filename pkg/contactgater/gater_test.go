@@ -0,0 +1,247 @@
+package contactgater
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func staticKeys(keys ...Key) KeysFunc {
+	return func() ([]Key, error) { return keys, nil }
+}
+
+// newHost returns a host dialing and listening over TCP, using gater as the
+// connection gater if not nil
+func newHost(t *testing.T, gater connmgr.ConnectionGater) host.Host {
+	t.Helper()
+
+	// the swarm and the host must share the bus, for the gater to see both
+	// the connections and the identifications
+	bus := eventbus.NewBus()
+	opts := []swarmt.Option{swarmt.EventBus(bus), swarmt.OptDisableQUIC}
+	if gater != nil {
+		opts = append(opts, swarmt.OptConnGater(gater))
+	}
+
+	h, err := bhost.NewHost(swarmt.GenSwarm(t, opts...), &bhost.HostOpts{EventBus: bus})
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	h.Start()
+
+	return h
+}
+
+func connect(ctx context.Context, from, to host.Host) error {
+	return from.Connect(ctx, peer.AddrInfo{ID: to.ID(), Addrs: to.Addrs()})
+}
+
+func TestGaterDropsNonContacts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	contactKey := Key{ContactPK: []byte("contact"), Secret: []byte("contact group secret")}
+	otherKey := Key{ContactPK: []byte("other"), Secret: []byte("other group secret")}
+	gatedKey := Key{ContactPK: []byte("gated"), Secret: []byte("contact group secret")}
+
+	gater := New(zap.NewNop(), WithVerifyTimeout(time.Second*5))
+	gated := newHost(t, gater)
+	require.NoError(t, gater.Start(gated, staticKeys(otherKey, contactKey)))
+	defer gater.Close()
+
+	contact, stranger := newHost(t, nil), newHost(t, nil)
+	for h, keys := range map[host.Host]KeysFunc{
+		contact:  staticKeys(gatedKey),
+		stranger: staticKeys(Key{ContactPK: []byte("gated"), Secret: []byte("another secret")}),
+	} {
+		responder := NewResponder(zap.NewNop(), h, keys)
+		defer responder.Close()
+	}
+
+	// the inbound connections of the unknown peers are rejected before
+	// being upgraded
+	require.Error(t, connect(ctx, contact, gated))
+	require.Error(t, connect(ctx, stranger, gated))
+	require.False(t, gater.InterceptSecured(network.DirInbound, contact.ID(), nil))
+
+	// the connection of a contact dialed by the node is verified and kept
+	require.NoError(t, connect(ctx, gated, contact))
+	require.Eventually(t, func() bool {
+		_, ok := gater.Verified(contact.ID())
+		return ok
+	}, time.Second*5, time.Millisecond*10)
+
+	contactPK, _ := gater.Verified(contact.ID())
+	require.Equal(t, contactKey.ContactPK, contactPK)
+	require.Equal(t, network.Connected, gated.Network().Connectedness(contact.ID()))
+
+	// the contact is then known, its inbound connections are accepted
+	require.NoError(t, gated.Network().ClosePeer(contact.ID()))
+	require.Eventually(t, func() bool {
+		return contact.Network().Connectedness(gated.ID()) == network.NotConnected
+	}, time.Second*5, time.Millisecond*10)
+	require.NoError(t, connect(ctx, contact, gated))
+	require.Eventually(t, func() bool {
+		_, ok := gater.Verified(contact.ID())
+		return ok
+	}, time.Second*5, time.Millisecond*10)
+
+	// the connection of a stranger dialed by the node is dropped
+	require.NoError(t, connect(ctx, gated, stranger))
+	require.Eventually(t, func() bool {
+		return gated.Network().Connectedness(stranger.ID()) == network.NotConnected
+	}, time.Second*5, time.Millisecond*10)
+
+	_, ok := gater.Verified(stranger.ID())
+	require.False(t, ok)
+
+	// then it is rejected by the connection gater
+	require.False(t, gater.InterceptPeerDial(stranger.ID()))
+	require.False(t, gater.InterceptSecured(network.DirInbound, stranger.ID(), nil))
+	require.Error(t, connect(ctx, stranger, gated))
+
+	require.Equal(t, network.Connected, gated.Network().Connectedness(contact.ID()))
+}
+
+func TestGaterContactsDialingEachOther(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secret := []byte("contact group secret")
+
+	gaterA := New(zap.NewNop(), WithVerifyTimeout(time.Second*5))
+	hostA := newHost(t, gaterA)
+	require.NoError(t, gaterA.Start(hostA, staticKeys(Key{ContactPK: []byte("b"), Secret: secret})))
+	defer gaterA.Close()
+
+	gaterB := New(zap.NewNop(), WithVerifyTimeout(time.Second*5))
+	hostB := newHost(t, gaterB)
+	require.NoError(t, gaterB.Start(hostB, staticKeys(Key{ContactPK: []byte("a"), Secret: secret})))
+	defer gaterB.Close()
+
+	// b doesn't know a yet, but a now expects b
+	require.Error(t, connect(ctx, hostA, hostB))
+
+	// so b can connect once it found a too, and both verify each other
+	require.NoError(t, connect(ctx, hostB, hostA))
+	require.Eventually(t, func() bool {
+		contactA, okA := gaterB.Verified(hostA.ID())
+		contactB, okB := gaterA.Verified(hostB.ID())
+		return okA && okB && string(contactA) == "a" && string(contactB) == "b"
+	}, time.Second*5, time.Millisecond*10)
+
+	require.Equal(t, network.Connected, hostA.Network().Connectedness(hostB.ID()))
+}
+
+func TestGaterDropsPeersWithoutChallenges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gater := New(zap.NewNop(), WithVerifyTimeout(time.Millisecond*500))
+	gated := newHost(t, gater)
+	require.NoError(t, gater.Start(gated, staticKeys()))
+	defer gater.Close()
+
+	// a rendezvous point which isn't allowed is challenged even if it has
+	// been dialed by the node, it doesn't answer so it is dropped
+	rdvp := newHost(t, nil)
+	require.NoError(t, connect(ctx, gated, rdvp))
+	require.Eventually(t, func() bool {
+		return gated.Network().Connectedness(rdvp.ID()) == network.NotConnected
+	}, time.Second*5, time.Millisecond*10)
+
+	_, ok := gater.Verified(rdvp.ID())
+	require.False(t, ok)
+
+	// then it can't dial the node
+	require.False(t, gater.InterceptSecured(network.DirInbound, rdvp.ID(), nil))
+	require.Error(t, connect(ctx, rdvp, gated))
+}
+
+func TestGaterAllowedPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	relay := newHost(t, nil)
+
+	// the allowed peers aren't challenged, the relay doesn't even answer
+	gater := New(zap.NewNop(), WithAllowedPeers(relay.ID()), WithVerifyTimeout(time.Millisecond*500))
+	gated := newHost(t, gater)
+	require.NoError(t, gater.Start(gated, staticKeys()))
+	defer gater.Close()
+
+	require.NoError(t, connect(ctx, relay, gated))
+
+	// the peers can also be allowed once the gater is started
+	rdvp := newHost(t, nil)
+	gater.AllowPeers(rdvp.ID())
+	require.NoError(t, connect(ctx, gated, rdvp))
+
+	time.Sleep(time.Second)
+
+	require.Equal(t, network.Connected, gated.Network().Connectedness(relay.ID()))
+	require.True(t, gater.InterceptPeerDial(relay.ID()))
+	require.Equal(t, network.Connected, gated.Network().Connectedness(rdvp.ID()))
+}
+
+func TestResponderRateLimit(t *testing.T) {
+	h := newHost(t, nil)
+
+	responder := NewResponder(zap.NewNop(), h, staticKeys())
+	defer responder.Close()
+
+	p, other := peer.ID("peer"), peer.ID("other")
+
+	// the first challenge is answered right away, the second one is delayed
+	wait, ok := responder.reserve(p)
+	require.True(t, ok)
+	require.Zero(t, wait)
+
+	wait, ok = responder.reserve(p)
+	require.True(t, ok)
+	require.InDelta(t, responseInterval, wait, float64(time.Millisecond*100))
+
+	// and the next ones are rejected
+	_, ok = responder.reserve(p)
+	require.False(t, ok)
+
+	wait, ok = responder.reserve(other)
+	require.True(t, ok)
+	require.Zero(t, wait)
+
+	// a peer can be answered again after a while
+	responder.muAnswers.Lock()
+	responder.nextAnswers[p] = time.Now()
+	responder.muAnswers.Unlock()
+
+	wait, ok = responder.reserve(p)
+	require.True(t, ok)
+	require.Zero(t, wait)
+}
+
+func TestProofsArePadded(t *testing.T) {
+	prover, verifier := peer.ID("prover"), peer.ID("verifier")
+	nonce := make([]byte, nonceSize)
+
+	keys := []Key{{ContactPK: []byte("a"), Secret: []byte("a")}, {ContactPK: []byte("b"), Secret: []byte("b")}}
+	proofs, err := makeProofs(keys, nonce, prover, verifier)
+	require.NoError(t, err)
+	require.Len(t, proofs, proofPadding)
+
+	contactPK, ok := checkProofs(keys[1:], proofs, nonce, prover, verifier)
+	require.True(t, ok)
+	require.Equal(t, []byte("b"), contactPK)
+
+	// the proofs are bound to the peers
+	_, ok = checkProofs(keys, proofs, nonce, verifier, prover)
+	require.False(t, ok)
+}
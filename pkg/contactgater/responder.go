@@ -0,0 +1,160 @@
+package contactgater
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protoio"
+)
+
+const (
+	// responseTimeout is the time given to a peer to send its challenge
+	responseTimeout = time.Second * 10
+
+	// responseInterval is the minimum time between two challenges answered
+	// to the same peer, a challenge received earlier is delayed and the
+	// following ones are rejected
+	responseInterval = time.Second
+
+	// maxPendingResponses is the number of challenges answered at the same
+	// time, the other ones are rejected
+	maxPendingResponses = 16
+)
+
+// Responder answers the challenges of the peers verifying the identity of
+// the node, it is started by the Gater. The challenges are rate limited, as
+// answering them costs a proof per contact.
+type Responder struct {
+	h      host.Host
+	logger *zap.Logger
+	keys   KeysFunc
+
+	pending     chan struct{}
+	nextAnswers map[peer.ID]time.Time
+	muAnswers   sync.Mutex
+}
+
+func NewResponder(logger *zap.Logger, h host.Host, keys KeysFunc) *Responder {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	r := &Responder{
+		h:      h,
+		logger: logger.Named("contactgater"),
+		keys:   keys,
+
+		pending:     make(chan struct{}, maxPendingResponses),
+		nextAnswers: make(map[peer.ID]time.Time),
+	}
+
+	h.SetStreamHandler(ProtocolID, r.handleStream)
+
+	return r
+}
+
+func (r *Responder) Close() error {
+	r.h.RemoveStreamHandler(ProtocolID)
+	return nil
+}
+
+// reserve returns how long to wait before answering the challenge of p, ok
+// is false if the challenge must be rejected
+func (r *Responder) reserve(p peer.ID) (wait time.Duration, ok bool) {
+	now := time.Now()
+
+	r.muAnswers.Lock()
+	defer r.muAnswers.Unlock()
+
+	next, found := r.nextAnswers[p]
+	if found && next.Sub(now) > responseInterval {
+		return 0, false
+	}
+
+	for other, next := range r.nextAnswers {
+		if now.After(next) {
+			delete(r.nextAnswers, other)
+		}
+	}
+
+	if next.Before(now) {
+		next = now
+	}
+	r.nextAnswers[p] = next.Add(responseInterval)
+
+	return next.Sub(now), true
+}
+
+// Called when a stream is opened by a remote peer
+func (r *Responder) handleStream(s network.Stream) {
+	defer s.Close()
+
+	remote := s.Conn().RemotePeer()
+
+	wait, ok := r.reserve(remote)
+	if !ok {
+		r.logger.Debug("too many challenges, rejecting", logutil.PrivateString("peer", remote.String()))
+		_ = s.Reset()
+		return
+	}
+
+	select {
+	case r.pending <- struct{}{}:
+		defer func() { <-r.pending }()
+	default:
+		r.logger.Debug("too many pending challenges, rejecting", logutil.PrivateString("peer", remote.String()))
+		_ = s.Reset()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), responseTimeout)
+	defer cancel()
+	defer resetOnDone(ctx, s)()
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	challenge := &Challenge{}
+	if err := protoio.NewDelimitedReader(s, maxMessageSize).ReadMsg(challenge); err != nil {
+		r.logger.Error("handleStream receive invalid challenge", zap.Error(err))
+		_ = s.Reset()
+		return
+	}
+
+	if len(challenge.Nonce) != nonceSize {
+		r.logger.Error("handleStream receive invalid nonce", zap.Int("size", len(challenge.Nonce)))
+		_ = s.Reset()
+		return
+	}
+
+	keys, err := r.keys()
+	if err != nil {
+		r.logger.Error("unable to get contact keys", zap.Error(err))
+		_ = s.Reset()
+		return
+	}
+
+	proofs, err := makeProofs(keys, challenge.Nonce, r.h.ID(), remote)
+	if err != nil {
+		r.logger.Error("unable to make proofs", zap.Error(err))
+		_ = s.Reset()
+		return
+	}
+
+	if err := protoio.NewDelimitedWriter(s).WriteMsg(&Proof{Proofs: proofs}); err != nil {
+		r.logger.Warn("unable to send proofs", logutil.PrivateString("peer", remote.String()), zap.Error(err))
+		_ = s.Reset()
+	}
+}
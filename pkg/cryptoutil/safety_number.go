@@ -0,0 +1,78 @@
+package cryptoutil
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+const (
+	safetyNumberVersion    = 0
+	safetyNumberIterations = 5200
+	// safetyNumberChunks is the number of 5 digits chunks derived from each key
+	safetyNumberChunks = 6
+)
+
+// ContactSafetyNumber derives a human-readable fingerprint from the public
+// keys of two contacts, it can be compared out-of-band to make sure both sides
+// are using the expected keys. The result doesn't depend on the order of the
+// keys so both contacts compute the same value.
+func ContactSafetyNumber(localPK crypto.PubKey, remotePK crypto.PubKey) (string, error) {
+	if localPK == nil || remotePK == nil {
+		return "", errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("public keys cannot be nil"))
+	}
+
+	localFingerprint, err := safetyNumberFingerprint(localPK)
+	if err != nil {
+		return "", err
+	}
+
+	remoteFingerprint, err := safetyNumberFingerprint(remotePK)
+	if err != nil {
+		return "", err
+	}
+
+	// sort the fingerprints so the result is the same on both sides
+	if bytes.Compare(localFingerprint, remoteFingerprint) > 0 {
+		localFingerprint, remoteFingerprint = remoteFingerprint, localFingerprint
+	}
+
+	chunks := make([]string, 0, safetyNumberChunks*2)
+	for _, fingerprint := range [][]byte{localFingerprint, remoteFingerprint} {
+		for i := 0; i < safetyNumberChunks; i++ {
+			chunk := fingerprint[i*5 : i*5+5]
+			value := uint64(chunk[0])<<32 | uint64(binary.BigEndian.Uint32(chunk[1:]))
+			chunks = append(chunks, fmt.Sprintf("%05d", value%100000))
+		}
+	}
+
+	return strings.Join(chunks, " "), nil
+}
+
+// safetyNumberFingerprint iteratively hashes a public key, making it
+// expensive to find another key with the same safety number
+func safetyNumberFingerprint(pk crypto.PubKey) ([]byte, error) {
+	raw, err := pk.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, safetyNumberVersion)
+
+	digest := append(version, raw...)
+	for i := 0; i < safetyNumberIterations; i++ {
+		h := sha512.New()
+		h.Write(digest)
+		h.Write(raw)
+		digest = h.Sum(nil)
+	}
+
+	return digest, nil
+}
@@ -0,0 +1,54 @@
+package cryptoutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactSafetyNumberSymmetry(t *testing.T) {
+	local, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	remote, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	localView, err := ContactSafetyNumber(local.GetPublic(), remote.GetPublic())
+	require.NoError(t, err)
+
+	remoteView, err := ContactSafetyNumber(remote.GetPublic(), local.GetPublic())
+	require.NoError(t, err)
+
+	require.Equal(t, localView, remoteView)
+	require.Len(t, localView, 12*5+11)
+
+	otherView, err := ContactSafetyNumber(local.GetPublic(), other.GetPublic())
+	require.NoError(t, err)
+	require.NotEqual(t, localView, otherView)
+}
+
+func TestContactSafetyNumberStability(t *testing.T) {
+	local, _, err := crypto.GenerateEd25519Key(bytes.NewReader(bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, err)
+
+	remote, _, err := crypto.GenerateEd25519Key(bytes.NewReader(bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, err)
+
+	safetyNumber, err := ContactSafetyNumber(local.GetPublic(), remote.GetPublic())
+	require.NoError(t, err)
+	require.Equal(t, "92218 97518 24993 19018 64738 00757 14574 12081 35963 77068 77566 12177", safetyNumber)
+}
+
+func TestContactSafetyNumberInvalidInput(t *testing.T) {
+	local, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = ContactSafetyNumber(local.GetPublic(), nil)
+	require.Error(t, err)
+}
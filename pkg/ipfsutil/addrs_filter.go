@@ -0,0 +1,32 @@
+package ipfsutil
+
+import (
+	p2p "github.com/libp2p/go-libp2p"
+	p2p_config "github.com/libp2p/go-libp2p/config"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// AddrsFilterOption returns a libp2p option restricting the addresses
+// advertised by the host to the ones kept by filter. Unlike
+// p2p.AddrsFactory, it can be combined with an address factory already set,
+// such as the one built by kubo from the Addresses config: the filter is
+// applied on the addresses returned by that factory.
+func AddrsFilterOption(filter bhost.AddrsFactory) p2p.Option {
+	return func(cfg *p2p_config.Config) error {
+		if filter == nil {
+			return nil
+		}
+
+		prev := cfg.AddrsFactory
+		if prev == nil {
+			cfg.AddrsFactory = filter
+			return nil
+		}
+
+		cfg.AddrsFactory = func(addrs []ma.Multiaddr) []ma.Multiaddr {
+			return filter(prev(addrs))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+package ipfsutil
+
+import (
+	"testing"
+
+	p2p "github.com/libp2p/go-libp2p"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestAddrsFilterOption(t *testing.T) {
+	for name, filter := range map[string]tinder.AddrsFilter{
+		"tcp only":     tinder.ProtocolAddrsOnlyFactory(ma.P_TCP),
+		"exclude quic": tinder.ExcludeProtocolAddrsFactory(ma.P_QUIC_V1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			h, err := p2p.New(
+				p2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"),
+				AddrsFilterOption(filter),
+			)
+			require.NoError(t, err)
+			defer h.Close()
+
+			// both transports listen, only the tcp addrs are advertised
+			listening := ma.FilterAddrs(h.Network().ListenAddresses(), func(addr ma.Multiaddr) bool {
+				_, err := addr.ValueForProtocol(ma.P_QUIC_V1)
+				return err == nil
+			})
+			require.NotEmpty(t, listening)
+
+			addrs := h.Addrs()
+			require.NotEmpty(t, addrs)
+			for _, addr := range addrs {
+				_, err := addr.ValueForProtocol(ma.P_QUIC_V1)
+				assert.Error(t, err, "quic addr %s should not be advertised", addr)
+			}
+		})
+	}
+}
+
+func TestAddrsFilterOptionChained(t *testing.T) {
+	relayed := ma.StringCast("/ip4/1.2.3.4/tcp/4001/p2p/QmbLHAnMoJPWSCR5Zhtx6BHJX9KiKNN6tpvbUcqanj75Nb/p2p-circuit")
+
+	h, err := p2p.New(
+		p2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		// a factory already set, like the one built by kubo from its config
+		p2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
+			return append(addrs, relayed)
+		}),
+		AddrsFilterOption(tinder.RelayAddrsOnlyFactory),
+	)
+	require.NoError(t, err)
+	defer h.Close()
+
+	addrs := h.Addrs()
+	require.Len(t, addrs, 1)
+	assert.True(t, addrs[0].Equal(relayed))
+}
@@ -0,0 +1,78 @@
+package ipfsutil
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// bandwidthHost reports the traffic of the streams opened and handled
+// through it, like the swarm does when given a metrics.Reporter
+type bandwidthHost struct {
+	host.Host
+
+	reporter metrics.Reporter
+}
+
+// NewBandwidthReporterHost wraps a host whose network doesn't report its
+// traffic, like the mocknet hosts, so the streams opened and handled through
+// the returned host are reported to the given reporter
+func NewBandwidthReporterHost(h host.Host, reporter metrics.Reporter) host.Host {
+	return &bandwidthHost{
+		Host:     h,
+		reporter: reporter,
+	}
+}
+
+func (h *bandwidthHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bandwidthStream{Stream: s, reporter: h.reporter}, nil
+}
+
+func (h *bandwidthHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, h.wrapHandler(handler))
+}
+
+func (h *bandwidthHost) SetStreamHandlerMatch(pid protocol.ID, match func(protocol.ID) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, h.wrapHandler(handler))
+}
+
+func (h *bandwidthHost) wrapHandler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		handler(&bandwidthStream{Stream: s, reporter: h.reporter})
+	}
+}
+
+type bandwidthStream struct {
+	network.Stream
+
+	reporter metrics.Reporter
+}
+
+func (s *bandwidthStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if n > 0 {
+		s.reporter.LogRecvMessage(int64(n))
+		s.reporter.LogRecvMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+	}
+
+	return n, err
+}
+
+func (s *bandwidthStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if n > 0 {
+		s.reporter.LogSentMessage(int64(n))
+		s.reporter.LogSentMessageStream(int64(n), s.Protocol(), s.Conn().RemotePeer())
+	}
+
+	return n, err
+}
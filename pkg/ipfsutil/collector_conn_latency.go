@@ -0,0 +1,196 @@
+package ipfsutil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	ma "github.com/multiformats/go-multiaddr"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// transport types of a connection, see ConnTransportType
+const (
+	ConnTransportProximity = "proximity"
+	ConnTransportRelay     = "relay"
+	ConnTransportDirect    = "direct"
+)
+
+var (
+	connTimeToFirstConnection = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prometheus.BuildFQName("ipfs", "host", "time_to_first_connection_seconds"),
+		Help:    "time spent without any connection over a transport type until one is established",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"transport"})
+	connTimeToFirstMessage = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prometheus.BuildFQName("ipfs", "host", "time_to_first_message_seconds"),
+		Help:    "time between the establishment of a connection and the end of its identification, its first message exchange",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"transport"})
+	connLatencyCollectors = []prometheus.Collector{
+		connTimeToFirstConnection,
+		connTimeToFirstMessage,
+	}
+)
+
+// proximityProtocols are the multiaddr protocols of the proximity drivers
+var proximityProtocols = map[string]struct{}{
+	"nearby": {},
+	"mc":     {},
+	"ble":    {},
+}
+
+// ConnTransportType returns the type of transport of a connection from its
+// remote address: ConnTransportProximity, ConnTransportRelay or
+// ConnTransportDirect
+func ConnTransportType(remote ma.Multiaddr) string {
+	for _, protocol := range remote.Protocols() {
+		if protocol.Code == ma.P_CIRCUIT {
+			return ConnTransportRelay
+		}
+
+		if _, ok := proximityProtocols[protocol.Name]; ok {
+			return ConnTransportProximity
+		}
+	}
+
+	return ConnTransportDirect
+}
+
+// ConnLatencyTracker records per transport type the time to the first
+// connection, since the tracker started or since the last connection over
+// this transport type was closed, and the time to the first message of each
+// connection. The first message of a connection is the identification of the
+// peers, which is exchanged by libp2p before any other protocol, its end is
+// reported on the event bus of the host. The host isn't wrapped, nothing is
+// needed from the subsystems using it.
+type ConnLatencyTracker struct {
+	host      host.Host
+	startedAt time.Time
+	sub       event.Subscription
+
+	// idleSince is when each transport type lost its last connection
+	idleSince map[string]time.Time
+	// open is the number of open connections of each transport type
+	open  map[string]int
+	conns map[network.Conn]*trackedConn
+	mu    sync.Mutex
+}
+
+type trackedConn struct {
+	transport   string
+	connectedAt time.Time
+	messaged    bool
+}
+
+var _ network.Notifiee = (*ConnLatencyTracker)(nil)
+
+// NewConnLatencyTracker starts tracking the connections of the host, the
+// histograms are registered on reg once for all the trackers
+func NewConnLatencyTracker(h host.Host, reg prometheus.Registerer) (*ConnLatencyTracker, error) {
+	if reg != nil {
+		for _, collector := range connLatencyCollectors {
+			if err := reg.Register(collector); err != nil {
+				if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+					return nil, fmt.Errorf("unable to register connection latency metrics: %w", err)
+				}
+			}
+		}
+	}
+
+	sub, err := h.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted), eventbus.Name("weshnet/conn-latency"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to subscribe to the identifications: %w", err)
+	}
+
+	t := &ConnLatencyTracker{
+		host:      h,
+		startedAt: time.Now(),
+		sub:       sub,
+		idleSince: make(map[string]time.Time),
+		open:      make(map[string]int),
+		conns:     make(map[network.Conn]*trackedConn),
+	}
+	h.Network().Notify(t)
+
+	go func() {
+		for e := range sub.Out() {
+			t.message(e.(event.EvtPeerIdentificationCompleted).Conn)
+		}
+	}()
+
+	return t, nil
+}
+
+// Close stops tracking the connections
+func (t *ConnLatencyTracker) Close() error {
+	t.host.Network().StopNotify(t)
+	return t.sub.Close()
+}
+
+func (t *ConnLatencyTracker) Listen(network.Network, ma.Multiaddr)      {}
+func (t *ConnLatencyTracker) ListenClose(network.Network, ma.Multiaddr) {}
+
+func (t *ConnLatencyTracker) Connected(_ network.Network, c network.Conn) {
+	now := time.Now()
+	transport := ConnTransportType(c.RemoteMultiaddr())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.conns[c]; ok {
+		return
+	}
+
+	if t.open[transport] == 0 {
+		idleSince, ok := t.idleSince[transport]
+		if !ok {
+			idleSince = t.startedAt
+		}
+
+		connTimeToFirstConnection.WithLabelValues(transport).Observe(now.Sub(idleSince).Seconds())
+	}
+
+	t.open[transport]++
+	t.conns[c] = &trackedConn{
+		transport:   transport,
+		connectedAt: now,
+	}
+}
+
+func (t *ConnLatencyTracker) Disconnected(_ network.Network, c network.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc, ok := t.conns[c]
+	if !ok {
+		return
+	}
+
+	delete(t.conns, c)
+
+	t.open[tc.transport]--
+	if t.open[tc.transport] == 0 {
+		t.idleSince[tc.transport] = time.Now()
+	}
+}
+
+// message records the time to the first message of a connection, once. The
+// swarm notifies the connection before any stream can be opened on it, so it
+// is always tracked by then unless it has been closed meanwhile.
+func (t *ConnLatencyTracker) message(c network.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tc, ok := t.conns[c]
+	if !ok || tc.messaged {
+		return
+	}
+
+	tc.messaged = true
+	connTimeToFirstMessage.WithLabelValues(tc.transport).Observe(time.Since(tc.connectedAt).Seconds())
+}
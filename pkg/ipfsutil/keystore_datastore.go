@@ -4,10 +4,9 @@ import (
 	"context"
 
 	datastore "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	"github.com/libp2p/go-libp2p/core/crypto"
-
-	"berty.tech/weshnet/v2/pkg/errcode"
 )
 
 type datastoreKeystore struct {
@@ -43,7 +42,22 @@ func (k *datastoreKeystore) Delete(name string) error {
 }
 
 func (k *datastoreKeystore) List() ([]string, error) {
-	return nil, errcode.ErrCode_ErrNotImplemented
+	results, err := k.ds.Query(context.TODO(), query.Query{KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	names := []string{}
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, res.Error
+		}
+
+		names = append(names, datastore.RawKey(res.Key).BaseNamespace())
+	}
+
+	return names, nil
 }
 
 func NewDatastoreKeystore(ds datastore.Datastore) keystore.Keystore {
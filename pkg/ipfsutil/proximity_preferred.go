@@ -0,0 +1,90 @@
+package ipfsutil
+
+import (
+	"time"
+
+	p2p "github.com/libp2p/go-libp2p"
+	p2p_config "github.com/libp2p/go-libp2p/config"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ProximityRelayDelay is the duration by which the dials of the relay
+// addresses of a peer are delayed when it is also reachable through a
+// proximity transport
+const ProximityRelayDelay = time.Second
+
+// ProximityPreferredDialRanker wraps a dial ranker so the proximity addresses
+// of a peer are dialed first, its relay addresses are only dialed once
+// ProximityRelayDelay has elapsed, if the proximity dials haven't succeeded.
+// The other addresses are ranked by ranker, swarm.DefaultDialRanker if nil.
+// Once connected, the swarm opens the new streams over the direct connections,
+// such as the proximity ones, rather than over the relayed connections. See
+// proximitytransport.WithPreferredOverRelay to also establish the proximity
+// connection with the peers already connected through a relay.
+func ProximityPreferredDialRanker(ranker network.DialRanker) network.DialRanker {
+	if ranker == nil {
+		ranker = swarm.DefaultDialRanker
+	}
+
+	return func(addrs []ma.Multiaddr) []network.AddrDelay {
+		proximity := []ma.Multiaddr{}
+		others := []ma.Multiaddr{}
+		for _, addr := range addrs {
+			if ConnTransportType(addr) == ConnTransportProximity {
+				proximity = append(proximity, addr)
+			} else {
+				others = append(others, addr)
+			}
+		}
+
+		if len(proximity) == 0 {
+			return ranker(addrs)
+		}
+
+		ranked := make([]network.AddrDelay, 0, len(addrs))
+		for _, addr := range proximity {
+			ranked = append(ranked, network.AddrDelay{Addr: addr})
+		}
+
+		for _, addrDelay := range ranker(others) {
+			if ConnTransportType(addrDelay.Addr) == ConnTransportRelay {
+				addrDelay.Delay += ProximityRelayDelay
+			}
+
+			ranked = append(ranked, addrDelay)
+		}
+
+		return ranked
+	}
+}
+
+// ProximityPreferredOption returns a libp2p option dialing the proximity
+// addresses of the peers before their relay addresses, see
+// ProximityPreferredDialRanker. It can be combined with a dial ranker already
+// set, which then ranks the other addresses. It is only needed if a proximity
+// transport is configured, see HasProximityListenAddrs.
+func ProximityPreferredOption() p2p.Option {
+	return func(cfg *p2p_config.Config) error {
+		cfg.DialRanker = ProximityPreferredDialRanker(cfg.DialRanker)
+		return nil
+	}
+}
+
+// HasProximityListenAddrs returns true if one of the swarm listen addrs of
+// the ipfs config is the address of a proximity transport
+func HasProximityListenAddrs(addrs []string) bool {
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+
+		if ConnTransportType(maddr) == ConnTransportProximity {
+			return true
+		}
+	}
+
+	return false
+}
@@ -263,7 +263,7 @@ func (m *coreAPIMock) Close() {
 }
 
 func MockHostOption(mn mocknet.Mocknet) ipfs_p2p.HostOption {
-	return func(id p2p_peer.ID, ps peerstore.Peerstore, _ ...libp2p.Option) (host.Host, error) {
+	return func(id p2p_peer.ID, ps peerstore.Peerstore, opts ...libp2p.Option) (host.Host, error) {
 		blackholeIP6 := net.ParseIP("100::")
 
 		pkey := ps.PrivKey(id)
@@ -293,6 +293,18 @@ func MockHostOption(mn mocknet.Mocknet) ipfs_p2p.HostOption {
 			return nil, err
 		}
 
-		return mn.AddPeerWithPeerstore(id, ps)
+		h, err := mn.AddPeerWithPeerstore(id, ps)
+		if err != nil {
+			return nil, err
+		}
+
+		// the mocknet doesn't report the bandwidth, report the streams of
+		// the host to the reporter given by ipfs instead
+		var cfg libp2p.Config
+		if err := cfg.Apply(opts...); err == nil && cfg.Reporter != nil {
+			h = NewBandwidthReporterHost(h, cfg.Reporter)
+		}
+
+		return h, nil
 	}
 }
@@ -15,9 +15,76 @@ var (
 	mu     sync.RWMutex
 )
 
+// RedactionMode defines how the private fields are written in the logs
+type RedactionMode int
+
+const (
+	// RedactionFull replaces the private values by a hash, namespaced for the
+	// current process so values can only be correlated within a single run.
+	// This is the default mode.
+	RedactionFull RedactionMode = iota
+
+	// RedactionLength replaces the private values by their length
+	RedactionLength
+
+	// RedactionNone writes the private values in plaintext, it is only
+	// available on the debug builds, built with the weshnet_debug tag
+	RedactionNone
+)
+
+func (m RedactionMode) String() string {
+	switch m {
+	case RedactionFull:
+		return "full"
+	case RedactionLength:
+		return "length"
+	case RedactionNone:
+		return "none"
+	}
+
+	return fmt.Sprintf("RedactionMode(%d)", int(m))
+}
+
+// RedactionNoneAvailable returns true if RedactionNone can be used, on the
+// debug builds only
+func RedactionNoneAvailable() bool {
+	return redactionNoneAvailable
+}
+
+// ParseRedactionMode returns the redaction mode matching the given name, as
+// returned by RedactionMode.String
+func ParseRedactionMode(name string) (RedactionMode, error) {
+	for _, mode := range []RedactionMode{RedactionFull, RedactionLength, RedactionNone} {
+		if mode.String() != name {
+			continue
+		}
+
+		if mode == RedactionNone && !redactionNoneAvailable {
+			return RedactionFull, fmt.Errorf("redaction mode %q is only available on debug builds", name)
+		}
+
+		return mode, nil
+	}
+
+	return RedactionFull, fmt.Errorf("unknown redaction mode: %q", name)
+}
+
 type PrivateField struct {
 	Namespace []byte
 	Enabled   bool
+	Mode      RedactionMode
+}
+
+func (p *PrivateField) mode() RedactionMode {
+	if !p.Enabled {
+		return RedactionNone
+	}
+
+	return p.Mode
+}
+
+func redactedLength(length int) string {
+	return fmt.Sprintf("[redacted len=%d]", length)
 }
 
 func (p *PrivateField) hash(value string) string {
@@ -35,27 +102,43 @@ func (p *PrivateField) hash(value string) string {
 	return hex.EncodeToString(hashed)
 }
 
-func (p *PrivateField) PrivateString(key string, value string) zap.Field {
-	if p.Enabled {
-		return zap.String(key, p.hash(value))
+// Redact returns the value as written by PrivateString
+func (p *PrivateField) Redact(value string) string {
+	switch p.mode() {
+	case RedactionFull:
+		return p.hash(value)
+	case RedactionLength:
+		return redactedLength(len(value))
 	}
 
-	return zap.String(key, value)
+	return value
+}
+
+func (p *PrivateField) PrivateString(key string, value string) zap.Field {
+	return zap.String(key, p.Redact(value))
 }
 
 func (p *PrivateField) PrivateStringer(key string, value fmt.Stringer) zap.Field {
-	if p.Enabled {
+	switch p.mode() {
+	case RedactionFull:
 		return zap.String(key, p.hash(value.String()))
+	case RedactionLength:
+		return zap.String(key, redactedLength(len(value.String())))
 	}
 
 	return zap.Stringer(key, value)
 }
 
 func (p *PrivateField) PrivateStrings(key string, values []string) zap.Field {
-	if p.Enabled {
+	switch mode := p.mode(); mode {
+	case RedactionFull, RedactionLength:
 		strings := make([]string, len(values))
 		for i := range values {
-			strings[i] = p.hash(values[i])
+			if mode == RedactionFull {
+				strings[i] = p.hash(values[i])
+			} else {
+				strings[i] = redactedLength(len(values[i]))
+			}
 		}
 
 		return zap.Strings(key, strings)
@@ -65,16 +148,22 @@ func (p *PrivateField) PrivateStrings(key string, values []string) zap.Field {
 }
 
 func (p *PrivateField) PrivateAny(key string, value interface{}) zap.Field {
-	if p.Enabled {
+	switch p.mode() {
+	case RedactionFull:
 		return zap.String(key, p.hash(fmt.Sprintf("%+v", value)))
+	case RedactionLength:
+		return zap.String(key, redactedLength(len(fmt.Sprintf("%+v", value))))
 	}
 
 	return zap.Any(key, value)
 }
 
 func (p *PrivateField) PrivateBinary(key string, value []byte) zap.Field {
-	if p.Enabled {
+	switch p.mode() {
+	case RedactionFull:
 		return zap.String(key, p.hash(hex.EncodeToString(value)))
+	case RedactionLength:
+		return zap.String(key, redactedLength(len(value)))
 	}
 
 	return zap.Binary(key, value)
@@ -88,6 +177,16 @@ func PrivateStrings(key string, value []string) zap.Field {
 	return g.PrivateStrings(key, value)
 }
 
+// Redact returns the value redacted with the current redaction mode, for the
+// outputs other than the logs such as the trace attributes
+func Redact(value string) string {
+	mu.RLock()
+	g := global
+	mu.RUnlock()
+
+	return g.Redact(value)
+}
+
 func PrivateString(key string, value string) zap.Field {
 	mu.RLock()
 	g := global
@@ -133,12 +232,53 @@ func DisablePrivateFields() {
 	SetGlobal(nil, false)
 }
 
-func init() { // nolint:gochecknoinits
+// SetRedactionMode sets how the private fields are written by the package
+// level helpers, it is meant to be called once at startup. The default mode
+// is RedactionFull. An error is returned for RedactionNone if it isn't
+// available, see RedactionNoneAvailable.
+func SetRedactionMode(mode RedactionMode) error {
+	if mode == RedactionNone && !redactionNoneAvailable {
+		return fmt.Errorf("redaction mode %q is only available on debug builds", mode)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the namespace has been dropped if the private fields were disabled
+	namespace := global.Namespace
+	if namespace == nil {
+		namespace = newNamespace()
+	}
+
+	global = &PrivateField{
+		Enabled:   true,
+		Namespace: namespace,
+		Mode:      mode,
+	}
+
+	return nil
+}
+
+// GetRedactionMode returns the redaction mode used by the package level
+// helpers
+func GetRedactionMode() RedactionMode {
+	mu.RLock()
+	g := global
+	mu.RUnlock()
+
+	return g.mode()
+}
+
+func newNamespace() []byte {
 	namespace := make([]byte, 32)
 	_, err := crand.Reader.Read(namespace)
 	if err != nil {
 		panic(err)
 	}
 
-	SetGlobal(namespace, true)
+	return namespace
+}
+
+func init() { // nolint:gochecknoinits
+	SetGlobal(newNamespace(), true)
 }
@@ -0,0 +1,7 @@
+//go:build !weshnet_debug
+// +build !weshnet_debug
+
+package logutil
+
+// redactionNoneAvailable allows RedactionNone on the debug builds
+const redactionNoneAvailable = false
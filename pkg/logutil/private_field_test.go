@@ -0,0 +1,114 @@
+package logutil_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+func TestRedactionModes(t *testing.T) {
+	defer logutil.SetRedactionMode(logutil.RedactionFull)
+
+	// private fields must be redacted by default
+	require.Equal(t, logutil.RedactionFull, logutil.GetRedactionMode())
+
+	cases := []struct {
+		mode   logutil.RedactionMode
+		check  func(t *testing.T, f zapcore.Field)
+		binary func(t *testing.T, f zapcore.Field)
+	}{
+		{
+			mode: logutil.RedactionFull,
+			check: func(t *testing.T, f zapcore.Field) {
+				require.Equal(t, zapcore.StringType, f.Type)
+				require.Len(t, f.String, 64)
+				require.NotContains(t, f.String, "secret")
+			},
+			binary: func(t *testing.T, f zapcore.Field) {
+				require.Equal(t, zapcore.StringType, f.Type)
+				require.Len(t, f.String, 64)
+			},
+		},
+		{
+			mode: logutil.RedactionLength,
+			check: func(t *testing.T, f zapcore.Field) {
+				require.Equal(t, zapcore.StringType, f.Type)
+				require.Equal(t, "[redacted len=6]", f.String)
+			},
+			binary: func(t *testing.T, f zapcore.Field) {
+				require.Equal(t, zapcore.StringType, f.Type)
+				require.Equal(t, "[redacted len=3]", f.String)
+			},
+		},
+		{
+			mode: logutil.RedactionNone,
+			check: func(t *testing.T, f zapcore.Field) {
+				require.Equal(t, zapcore.StringType, f.Type)
+				require.Equal(t, "secret", f.String)
+			},
+			binary: func(t *testing.T, f zapcore.Field) {
+				require.Equal(t, zapcore.BinaryType, f.Type)
+				require.Equal(t, []byte{1, 2, 3}, f.Interface)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			if tc.mode == logutil.RedactionNone && !logutil.RedactionNoneAvailable() {
+				// the private values are never written on the release builds
+				require.NoError(t, logutil.SetRedactionMode(logutil.RedactionFull))
+				require.Error(t, logutil.SetRedactionMode(tc.mode))
+				require.Equal(t, logutil.RedactionFull, logutil.GetRedactionMode())
+				return
+			}
+
+			require.NoError(t, logutil.SetRedactionMode(tc.mode))
+			require.Equal(t, tc.mode, logutil.GetRedactionMode())
+
+			f := logutil.PrivateString("key", "secret")
+			require.Equal(t, "key", f.Key)
+			tc.check(t, f)
+
+			tc.binary(t, logutil.PrivateBinary("key", []byte{1, 2, 3}))
+
+			enc := zapcore.NewMapObjectEncoder()
+			logutil.PrivateStrings("keys", []string{"secret"}).AddTo(enc)
+			values, ok := enc.Fields["keys"].([]interface{})
+			require.True(t, ok)
+			require.Len(t, values, 1)
+			tc.check(t, zapcore.Field{Type: zapcore.StringType, String: values[0].(string)})
+		})
+	}
+}
+
+func TestRedactionFullIsStable(t *testing.T) {
+	defer logutil.SetRedactionMode(logutil.RedactionFull)
+
+	require.NoError(t, logutil.SetRedactionMode(logutil.RedactionFull))
+
+	// the same value must be redacted the same way to be correlated
+	require.Equal(t, logutil.PrivateString("key", "secret").String, logutil.PrivateString("key", "secret").String)
+	require.NotEqual(t, logutil.PrivateString("key", "secret").String, logutil.PrivateString("key", "other").String)
+}
+
+func TestParseRedactionMode(t *testing.T) {
+	for _, mode := range []logutil.RedactionMode{logutil.RedactionFull, logutil.RedactionLength, logutil.RedactionNone} {
+		parsed, err := logutil.ParseRedactionMode(mode.String())
+		if mode == logutil.RedactionNone && !logutil.RedactionNoneAvailable() {
+			require.Error(t, err)
+			require.Equal(t, logutil.RedactionFull, parsed)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, mode, parsed)
+	}
+
+	mode, err := logutil.ParseRedactionMode("unknown")
+	require.Error(t, err)
+	require.Equal(t, logutil.RedactionFull, mode)
+}
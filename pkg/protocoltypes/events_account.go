@@ -28,6 +28,10 @@ func (m *AccountContactRequestOutgoingSent) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
 
+func (m *AccountContactRequestOutgoingCanceled) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
 func (m *AccountContactRequestIncomingReceived) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
@@ -52,6 +56,10 @@ func (m *AccountContactRequestOutgoingSent) SetContactPK(pk []byte) {
 	m.ContactPk = pk
 }
 
+func (m *AccountContactRequestOutgoingCanceled) SetContactPK(pk []byte) {
+	m.ContactPk = pk
+}
+
 func (m *AccountContactRequestIncomingDiscarded) SetContactPK(pk []byte) {
 	m.ContactPk = pk
 }
@@ -92,6 +100,26 @@ func (m *GroupReplicating) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
 
+func (m *GroupMessageDeliveryAcked) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupMessageExpirationUpdated) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupMemberLeft) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupSignedReceiptsUpdated) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupDeliveryAcksUpdated) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
 func (m *AccountVerifiedCredentialRegistered) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
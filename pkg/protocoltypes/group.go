@@ -3,6 +3,7 @@ package protocoltypes
 import (
 	crand "crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"io"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -84,21 +85,74 @@ const CurrentGroupVersion = 1
 // NewGroupMultiMember creates a new Group object and an invitation to be used by
 // the first member of the group
 func NewGroupMultiMember() (*Group, crypto.PrivKey, error) {
-	priv, pub, err := crypto.GenerateEd25519Key(crand.Reader)
+	priv, _, err := crypto.GenerateEd25519Key(crand.Reader)
 	if err != nil {
 		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
 	}
 
-	pubBytes, err := pub.Raw()
+	signing, _, err := crypto.GenerateEd25519Key(crand.Reader)
 	if err != nil {
-		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
 	}
 
-	signing, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	return newGroupMultiMember(priv, signing)
+}
+
+// wellKnownGroupSalt is the HKDF salt used to derive the well-known groups,
+// changing it changes all the derived groups
+const wellKnownGroupSalt = "weshnet/well-known-group/v1"
+
+// DeriveWellKnownGroup deterministically derives a multi-member group from a
+// name, all the clients deriving the same name get the same group and can
+// join it without exchanging an invitation.
+//
+// Unlike the groups created by NewGroupMultiMember, the keys of a well-known
+// group are not secret: anyone who knows or guesses the name can derive them,
+// join the group, read its messages and claim admin rights with the group
+// private key. Well-known groups must only be used for public channels.
+// The name is used as is, callers should normalize it.
+func DeriveWellKnownGroup(name string) (*Group, crypto.PrivKey, error) {
+	if name == "" {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a well-known group name can't be empty"))
+	}
+
+	kdf := hkdf.New(sha3.New256, []byte(name), []byte(wellKnownGroupSalt), nil)
+
+	seeds := [2][ed25519.SeedSize]byte{}
+	for i := range seeds {
+		if _, err := io.ReadFull(kdf, seeds[i][:]); err != nil {
+			return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+		}
+	}
+
+	priv, err := privKeyFromSeed(seeds[0][:])
 	if err != nil {
 		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
 	}
 
+	signing, err := privKeyFromSeed(seeds[1][:])
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return newGroupMultiMember(priv, signing)
+}
+
+func privKeyFromSeed(seed []byte) (crypto.PrivKey, error) {
+	edSK := ed25519.NewKeyFromSeed(seed)
+
+	sk, _, err := crypto.KeyPairFromStdKey(&edSK)
+	return sk, err
+}
+
+// newGroupMultiMember creates a multi-member group from its private key and
+// the key used to sign its messages
+func newGroupMultiMember(priv crypto.PrivKey, signing crypto.PrivKey) (*Group, crypto.PrivKey, error) {
+	pubBytes, err := priv.GetPublic().Raw()
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
 	signingBytes, err := cryptoutil.SeedFromEd25519PrivateKey(signing)
 	if err != nil {
 		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
@@ -0,0 +1,64 @@
+package proximitytransport
+
+import (
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// BandwidthProtocolPrefix prefixes the protocol under which the traffic of a
+// proximity transport is reported, see WithBandwidthReporter
+const BandwidthProtocolPrefix = "/proximity/"
+
+// BandwidthProtocolID returns the protocol under which the traffic of the
+// transport using the given driver protocol name is reported
+func BandwidthProtocolID(protocolName string) protocol.ID {
+	return protocol.ID(BandwidthProtocolPrefix + protocolName)
+}
+
+// WithBandwidthReporter reports the bytes exchanged with the native driver
+// under BandwidthProtocolID. Only the protocol and peer counters are updated,
+// the totals already include this traffic when the reporter is also given to
+// the host.
+func WithBandwidthReporter(reporter metrics.Reporter) TransportOption {
+	return func(t *proximityTransport) {
+		t.bandwidthReporter = reporter
+	}
+}
+
+// SetBandwidthReporter sets the reporter of the bytes exchanged with the
+// native driver once the transport is running, like WithBandwidthReporter
+func (t *proximityTransport) SetBandwidthReporter(reporter metrics.Reporter) {
+	t.bandwidthMutex.Lock()
+	t.bandwidthReporter = reporter
+	t.bandwidthMutex.Unlock()
+}
+
+func (t *proximityTransport) getBandwidthReporter() metrics.Reporter {
+	t.bandwidthMutex.RLock()
+	defer t.bandwidthMutex.RUnlock()
+
+	return t.bandwidthReporter
+}
+
+func (t *proximityTransport) logSentBandwidth(remotePID string, size int) {
+	reporter := t.getBandwidthReporter()
+	if reporter == nil || size == 0 {
+		return
+	}
+
+	// the peer id is only used by the peer counters, an invalid id is
+	// reported as an empty peer
+	pid, _ := peer.Decode(remotePID)
+	reporter.LogSentMessageStream(int64(size), BandwidthProtocolID(t.driver.ProtocolName()), pid)
+}
+
+func (t *proximityTransport) logRecvBandwidth(remotePID string, size int) {
+	reporter := t.getBandwidthReporter()
+	if reporter == nil || size == 0 {
+		return
+	}
+
+	pid, _ := peer.Decode(remotePID)
+	reporter.LogRecvMessageStream(int64(size), BandwidthProtocolID(t.driver.ProtocolName()), pid)
+}
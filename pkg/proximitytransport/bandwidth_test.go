@@ -0,0 +1,79 @@
+package proximitytransport_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/test"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+func TestTransportBandwidthReporter(t *testing.T) {
+	t.Run("option", func(t *testing.T) { testTransportBandwidthReporter(t, true) })
+
+	// the service sets the reporter of the transports of its host
+	t.Run("setter", func(t *testing.T) { testTransportBandwidthReporter(t, false) })
+}
+
+func testTransportBandwidthReporter(t *testing.T, withOption bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	reporter := metrics.NewBandwidthCounter()
+	opts := []proximity.TransportOption{}
+	if withOption {
+		opts = append(opts, proximity.WithBandwidthReporter(reporter))
+	}
+
+	driver := newMemoryDriver()
+	transport, err := proximity.NewTransport(ctx, nil, driver, opts...)(sw, swarmt.GenUpgrader(t, sw, nil))
+	require.NoError(t, err)
+	driver.transport = transport
+
+	listenMa, err := ma.NewMultiaddr(ble.DefaultAddr)
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	if !withOption {
+		transport.SetBandwidthReporter(reporter)
+	}
+
+	remotePID, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	remoteMa, err := ma.NewMultiaddr("/" + ble.ProtocolName + "/" + remotePID.String())
+	require.NoError(t, err)
+
+	// the handshake sent by the dialer is the outgoing traffic
+	go func() {
+		_, _ = transport.Dial(ctx, remoteMa, remotePID)
+	}()
+
+	const size = 100
+	transport.ReceiveFromPeer(remotePID.String(), make([]byte, size))
+
+	protocolID := proximity.BandwidthProtocolID(ble.ProtocolName)
+	require.Eventually(t, func() bool {
+		stats := reporter.GetBandwidthForProtocol(protocolID)
+		return stats.TotalIn == size && stats.TotalOut > 0
+	}, time.Second*5, time.Millisecond*100)
+
+	stats := reporter.GetBandwidthForPeer(remotePID)
+	require.Equal(t, int64(size), stats.TotalIn)
+
+	// the totals are left to the host
+	require.Zero(t, reporter.GetBandwidthTotals().TotalIn)
+}
@@ -0,0 +1,149 @@
+package proximitytransport
+
+import (
+	"container/list"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// CacheStat describes the memory used by the transport cache and the caches
+// of all the connections combined, see WithCacheBudget. It is only tracked
+// when a budget is set.
+type CacheStat struct {
+	// BudgetBytes is the maximum size of the cached payloads
+	BudgetBytes int
+	// Bytes is the size of the payloads currently cached
+	Bytes int
+
+	// Evictions and EvictedBytes are the number and the size of the
+	// payloads evicted to respect the budget
+	Evictions    uint64
+	EvictedBytes uint64
+}
+
+// WithCacheBudget bounds the memory used by the transport cache and the
+// caches of all the connections combined. Once maxBytes is exceeded the
+// oldest payloads of the least recently used cache are evicted, each cache
+// is still bounded by its own limits, see WithConnCacheLimits. A value lower
+// or equal to zero means no budget.
+func WithCacheBudget(maxBytes int) TransportOption {
+	return func(t *proximityTransport) {
+		if maxBytes > 0 {
+			t.cacheBudget = newCacheBudget(t.logger, maxBytes)
+		}
+	}
+}
+
+// CacheStat returns the memory used by the caches, the zero value if no
+// budget is set
+func (t *proximityTransport) CacheStat() CacheStat {
+	if t.cacheBudget == nil {
+		return CacheStat{}
+	}
+
+	return t.cacheBudget.stat()
+}
+
+// cacheBudget tracks the size of the ring buffers sharing a budget
+type cacheBudget struct {
+	maxBytes int
+	bytes    int
+
+	// lru orders the non empty ring buffers from the most to the least
+	// recently used one
+	lru     *list.List
+	entries map[*ringBuffer]*list.Element
+
+	evictions    uint64
+	evictedBytes uint64
+
+	logger *zap.Logger
+	mu     sync.Mutex
+}
+
+type cacheBudgetEntry struct {
+	buffer *ringBuffer
+	bytes  int
+}
+
+func newCacheBudget(logger *zap.Logger, maxBytes int) *cacheBudget {
+	return &cacheBudget{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[*ringBuffer]*list.Element),
+		logger:   logger.Named("CacheBudget"),
+	}
+}
+
+// update records the current size of a ring buffer, which becomes the most
+// recently used one if used is true. rb must be locked.
+func (b *cacheBudget) update(rb *ringBuffer, used bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elem, ok := b.entries[rb]
+	if !ok {
+		if rb.bytes == 0 {
+			return
+		}
+
+		elem = b.lru.PushFront(&cacheBudgetEntry{buffer: rb})
+		b.entries[rb] = elem
+	}
+
+	entry := elem.Value.(*cacheBudgetEntry)
+	b.bytes += rb.bytes - entry.bytes
+	entry.bytes = rb.bytes
+
+	switch {
+	case rb.bytes == 0:
+		b.lru.Remove(elem)
+		delete(b.entries, rb)
+	case used:
+		b.lru.MoveToFront(elem)
+	}
+}
+
+// enforce evicts the oldest payloads of the least recently used ring buffers
+// until the budget is respected. No ring buffer must be locked.
+func (b *cacheBudget) enforce() {
+	for {
+		b.mu.Lock()
+		if b.bytes <= b.maxBytes || b.lru.Len() == 0 {
+			b.mu.Unlock()
+			return
+		}
+		rb := b.lru.Back().Value.(*cacheBudgetEntry).buffer
+		b.mu.Unlock()
+
+		rb.Lock()
+		evicted, ok := rb.evictOldest()
+		if ok {
+			b.mu.Lock()
+			b.evictions++
+			b.evictedBytes += uint64(len(evicted))
+			b.mu.Unlock()
+
+			b.logger.Debug("cache budget exceeded, payload evicted", zap.Int("payload", len(evicted)), zap.Int("budget", b.maxBytes))
+		}
+		b.update(rb, false)
+		rb.Unlock()
+
+		if ok && rb.onEvict != nil {
+			rb.onEvict(rb.peerID, len(evicted))
+		}
+	}
+}
+
+func (b *cacheBudget) stat() CacheStat {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return CacheStat{
+		BudgetBytes:  b.maxBytes,
+		Bytes:        b.bytes,
+		Evictions:    b.evictions,
+		EvictedBytes: b.evictedBytes,
+	}
+}
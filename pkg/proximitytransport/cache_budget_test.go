@@ -0,0 +1,81 @@
+package proximitytransport
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheBudget(t *testing.T) {
+	const (
+		budget       = 8 * 1024
+		payloadSize  = 100
+		payloadCount = 20
+		unknownPeers = 40
+		connPeers    = 20
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"), WithCacheBudget(budget))(nil, nil)
+	require.NoError(t, err)
+
+	// the payloads of the unknown peers go to the transport cache, the
+	// payloads of the peers whose conn isn't ready to the conn caches
+	peers := make([]string, 0, unknownPeers+connPeers)
+	conns := make(map[string]*Conn)
+	for i := 0; i < unknownPeers; i++ {
+		peers = append(peers, fmt.Sprintf("unknown-%d", i))
+	}
+	for i := 0; i < connPeers; i++ {
+		pid := fmt.Sprintf("conn-%d", i)
+		c, pr := newTestPeerConn(ctx, transport, pid)
+		defer c.cancel()
+		defer pr.Close()
+
+		peers = append(peers, pid)
+		conns[pid] = c
+	}
+
+	cachedBytes := func(pid string) int {
+		cache := transport.cache
+		if c, ok := conns[pid]; ok {
+			cache = c.cache
+		}
+
+		_, bytes := cache.Stat(pid)
+		return bytes
+	}
+
+	for _, pid := range peers {
+		for i := 0; i < payloadCount; i++ {
+			transport.ReceiveFromPeer(pid, make([]byte, payloadSize))
+			require.LessOrEqual(t, transport.CacheStat().Bytes, budget)
+		}
+	}
+
+	total := 0
+	for _, pid := range peers {
+		total += cachedBytes(pid)
+	}
+
+	stat := transport.CacheStat()
+	require.LessOrEqual(t, total, budget)
+	require.Equal(t, total, stat.Bytes)
+	require.Equal(t, budget, stat.BudgetBytes)
+
+	received := len(peers) * payloadCount * payloadSize
+	require.Equal(t, uint64(received-total), stat.EvictedBytes)
+	require.Equal(t, stat.EvictedBytes/payloadSize, stat.Evictions)
+
+	// the least recently used caches are evicted first
+	require.Zero(t, cachedBytes(peers[0]))
+	require.Equal(t, payloadCount*payloadSize, cachedBytes(peers[len(peers)-1]))
+
+	// the deleted payloads no longer count
+	transport.SetPeerCaching(peers[len(peers)-1], false)
+	require.Equal(t, total-payloadCount*payloadSize, transport.CacheStat().Bytes)
+}
@@ -0,0 +1,68 @@
+package proximitytransport
+
+import (
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+// cacheEvictionQueueSize is the number of evictions waiting for the handler,
+// the next ones are dropped
+const cacheEvictionQueueSize = 256
+
+// CacheEvictionHandler is called when a payload cached for a peer is evicted
+// before being delivered, because the cache is full or because of the budget
+// shared by the caches. size is the size of the evicted payload. The upper
+// layers can use it to ask the peer to send the lost data again.
+type CacheEvictionHandler func(remotePID string, size int)
+
+// WithCacheEvictionHandler sets a handler called when a cached payload is
+// evicted before being delivered, see WithConnCacheLimits and
+// WithCacheBudget. The handler is called sequentially on its own goroutine,
+// the evictions are dropped while too many of them are waiting for a slow
+// handler.
+func WithCacheEvictionHandler(handler CacheEvictionHandler) TransportOption {
+	return func(t *proximityTransport) {
+		t.cacheEvictionHandler = handler
+		t.cacheEvictions = make(chan cacheEviction, cacheEvictionQueueSize)
+	}
+}
+
+type cacheEviction struct {
+	remotePID string
+	size      int
+}
+
+// cacheEvictionCallback returns the eviction callback of the caches, nil if
+// there is no handler
+func (t *proximityTransport) cacheEvictionCallback() func(remotePID string, size int) {
+	if t.cacheEvictionHandler == nil {
+		return nil
+	}
+
+	return t.notifyCacheEviction
+}
+
+// notifyCacheEviction queues an eviction for the handler, it never blocks the
+// caller which is on the receive path
+func (t *proximityTransport) notifyCacheEviction(remotePID string, size int) {
+	select {
+	case t.cacheEvictions <- cacheEviction{remotePID: remotePID, size: size}:
+	default:
+		t.logger.Warn("cache eviction handler is too slow, eviction dropped",
+			logutil.PrivateString("remotePID", remotePID),
+			zap.Int("payload", size),
+		)
+	}
+}
+
+func (t *proximityTransport) runCacheEvictionHandler() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case eviction := <-t.cacheEvictions:
+			t.cacheEvictionHandler(eviction.remotePID, eviction.size)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proximitytransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEvictionHandler(t *testing.T) {
+	const maxEntries = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	evictions := make(chan cacheEviction, 10)
+	transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"),
+		WithConnCacheLimits(maxEntries, 0),
+		WithCacheEvictionHandler(func(remotePID string, size int) {
+			evictions <- cacheEviction{remotePID: remotePID, size: size}
+		}),
+	)(nil, nil)
+	require.NoError(t, err)
+
+	c, pr := newTestConn(ctx, transport)
+	defer c.cancel()
+	defer pr.Close()
+
+	// nothing is evicted until the cache of the peer is full
+	for i := 0; i < maxEntries; i++ {
+		transport.ReceiveFromPeer(testRemotePID, make([]byte, 100+i))
+	}
+
+	select {
+	case eviction := <-evictions:
+		require.FailNow(t, "no payload should have been evicted", "%+v", eviction)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// the oldest payload is overwritten
+	transport.ReceiveFromPeer(testRemotePID, make([]byte, 10))
+
+	select {
+	case eviction := <-evictions:
+		require.Equal(t, cacheEviction{remotePID: testRemotePID, size: 100}, eviction)
+	case <-time.After(time.Second):
+		require.FailNow(t, "the eviction handler should have been called")
+	}
+}
+
+func TestCacheEvictionHandlerDoesNotBlock(t *testing.T) {
+	const remotePID = "unknown-peer"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unblock := make(chan struct{})
+	called := make(chan struct{}, 1)
+	transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"),
+		WithCacheEvictionHandler(func(string, int) {
+			select {
+			case called <- struct{}{}:
+			default:
+			}
+			<-unblock
+		}),
+	)(nil, nil)
+	require.NoError(t, err)
+
+	// the payloads of an unknown peer go to the transport cache, the
+	// evictions overflow the queue of the blocked handler
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < transport.cache.Size()+cacheEvictionQueueSize+10; i++ {
+			transport.ReceiveFromPeer(remotePID, make([]byte, 10))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "a blocked eviction handler shouldn't block the receive path")
+	}
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		require.FailNow(t, "the eviction handler should have been called")
+	}
+
+	close(unblock)
+}
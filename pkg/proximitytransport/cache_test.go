@@ -0,0 +1,231 @@
+package proximitytransport
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+const testRemotePID = "12D3KooWQPP6DsfYWGkTx3AvkjjF9PFwS6C1Vfs1JmkUKkZtSTDD"
+
+// newTestConn creates a not ready conn configured the same way as newConn,
+// without requiring a swarm and an upgrader
+func newTestConn(ctx context.Context, t *proximityTransport) (*Conn, *io.PipeReader) {
+	return newTestPeerConn(ctx, t, testRemotePID)
+}
+
+// newTestPeerConn is newTestConn for the given peer
+func newTestPeerConn(ctx context.Context, t *proximityTransport, remotePID string) (*Conn, *io.PipeReader) {
+	pr, pw := io.Pipe()
+	connCtx, cancel := context.WithCancel(ctx)
+
+	c := &Conn{
+		readIn:    pw,
+		readOut:   pr,
+		mp:        newMplex(connCtx, t.logger),
+		ctx:       connCtx,
+		cancel:    cancel,
+		transport: t,
+	}
+
+	if c.cache = t.newConnCache(); c.cache != nil {
+		c.mp.addInputCache(t.cache)
+		c.mp.addInputCache(c.cache)
+	}
+
+	t.connMapMutex.Lock()
+	t.connMap[remotePID] = c
+	t.connMapMutex.Unlock()
+
+	c.mp.setOutput(pw)
+	c.closePipeOnDone()
+
+	return c, pr
+}
+
+// readPayloads forwards the payloads written to the conn pipe
+func readPayloads(r io.Reader) <-chan []byte {
+	payloads := make(chan []byte, 10)
+	go func() {
+		defer close(payloads)
+		for {
+			buf := make([]byte, 64)
+			n, err := r.Read(buf)
+			if err != nil {
+				return
+			}
+			payloads <- buf[:n]
+		}
+	}()
+
+	return payloads
+}
+
+func TestReceiveFromPeerCache(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      []TransportOption
+		delivered bool
+	}{
+		{"cache enabled", nil, true},
+		{"cache disabled", []TransportOption{WithCacheDisabled()}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"), tc.opts...)(nil, nil)
+			require.NoError(t, err)
+
+			c, pr := newTestConn(ctx, transport)
+			defer c.cancel()
+			defer pr.Close()
+
+			payloads := readPayloads(pr)
+
+			// the conn is not ready yet
+			transport.ReceiveFromPeer(testRemotePID, []byte("early"))
+
+			// mark the conn as ready and flush the caches, the same way
+			// Conn.Write does
+			c.Lock()
+			c.ready = true
+			c.Unlock()
+			go c.mp.run(testRemotePID)
+
+			select {
+			case payload := <-payloads:
+				require.True(t, tc.delivered, "pre-ready payload should have been dropped")
+				require.Equal(t, []byte("early"), payload)
+			case <-time.After(time.Millisecond * 200):
+				require.False(t, tc.delivered, "pre-ready payload should have been delivered")
+			}
+
+			// once ready, payloads are always delivered
+			go transport.ReceiveFromPeer(testRemotePID, []byte("late"))
+
+			select {
+			case payload := <-payloads:
+				require.Equal(t, []byte("late"), payload)
+			case <-time.After(time.Second):
+				require.FailNow(t, "payload should have been delivered")
+			}
+		})
+	}
+}
+
+func TestSetPeerCaching(t *testing.T) {
+	const otherRemotePID = "12D3KooWHVsy6o6iW8dqVXGuF9fXUZuXXYDpdEdcSRJmbaZ3GEWh"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"))(nil, nil)
+	require.NoError(t, err)
+
+	c, pr := newTestConn(ctx, transport)
+	defer c.cancel()
+	defer pr.Close()
+
+	payloads := readPayloads(pr)
+
+	// the payloads already cached for the flagged peer are dropped
+	transport.ReceiveFromPeer(testRemotePID, []byte("cached"))
+	transport.SetPeerCaching(testRemotePID, false)
+
+	// the conn of the flagged peer is not ready yet
+	transport.ReceiveFromPeer(testRemotePID, []byte("early"))
+
+	// the other peer has no conn yet, its payloads are still cached
+	transport.ReceiveFromPeer(otherRemotePID, []byte("other"))
+
+	c.Lock()
+	c.ready = true
+	c.Unlock()
+	go c.mp.run(testRemotePID)
+
+	select {
+	case payload := <-payloads:
+		require.FailNow(t, "pre-ready payload should have been dropped", string(payload))
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	cached := [][]byte{}
+	for payload := range transport.cache.Flush(otherRemotePID) {
+		cached = append(cached, payload)
+	}
+	require.Equal(t, [][]byte{[]byte("other")}, cached)
+
+	// once ready, payloads of the flagged peer are delivered
+	go transport.ReceiveFromPeer(testRemotePID, []byte("late"))
+
+	select {
+	case payload := <-payloads:
+		require.Equal(t, []byte("late"), payload)
+	case <-time.After(time.Second):
+		require.FailNow(t, "payload should have been delivered")
+	}
+
+	// caching can be enabled again
+	transport.SetPeerCaching(testRemotePID, true)
+	require.False(t, transport.isPeerCachingDisabled(testRemotePID))
+}
+
+func TestConnCacheLimits(t *testing.T) {
+	const (
+		maxEntries = 4
+		maxBytes   = 4 * 1024
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driver := &closingDriver{
+		NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+	}
+
+	transport, err := NewTransport(ctx, nil, driver, WithConnCacheLimits(maxEntries, maxBytes))(nil, nil)
+	require.NoError(t, err)
+
+	remoteMa, err := ma.NewMultiaddr("/" + testProtocolName + "/" + testRemotePID)
+	require.NoError(t, err)
+
+	c, pr := newTestConn(ctx, transport)
+	c.remoteMa = remoteMa
+	defer pr.Close()
+
+	// the oldest payloads are evicted once the cache is full
+	for i := 0; i < maxEntries+2; i++ {
+		transport.ReceiveFromPeer(testRemotePID, make([]byte, 100))
+	}
+
+	require.Equal(t, ConnStat{
+		CacheEntries:   maxEntries,
+		CacheBytes:     maxEntries * 100,
+		CacheEvictions: 2,
+	}, c.Stat())
+	require.Empty(t, driver.closedPeers())
+
+	// a peer flooding the conn before it is ready is disconnected
+	for i := 0; i < 10 && c.ctx.Err() == nil; i++ {
+		transport.ReceiveFromPeer(testRemotePID, make([]byte, 1024))
+	}
+
+	// the conn is closed off the native callback path
+	require.Eventually(t, func() bool {
+		return c.ctx.Err() != nil && len(driver.closedPeers()) > 0
+	}, time.Second*5, time.Millisecond*10)
+	require.Equal(t, []string{testRemotePID}, driver.closedPeers())
+	require.LessOrEqual(t, c.Stat().CacheBytes, maxBytes)
+
+	transport.connMapMutex.RLock()
+	_, ok := transport.connMap[testRemotePID]
+	transport.connMapMutex.RUnlock()
+	require.False(t, ok)
+}
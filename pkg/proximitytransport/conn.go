@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
@@ -37,14 +38,35 @@ type Conn struct {
 	cache *RingBufferMap
 	mp    *mplex
 
+	// cacheEvictions is the number of payloads evicted from the cache, it is
+	// guarded by the conn mutex
+	cacheEvictions uint64
+
+	// lastReceived is the unix time in nanoseconds of the last payload
+	// received from the peer, used by the keepalive
+	lastReceived atomic.Int64
+
+	// keepAliveSending is true once the keepalive marker has been sent to
+	// the peer, it is guarded by keepAliveMutex which serializes the frames
+	// sent with it. keepAliveReceiving is true once the marker has been
+	// received from the peer.
+	keepAliveSending   bool
+	keepAliveMutex     sync.Mutex
+	keepAliveReceiving atomic.Bool
+
+	// closed is set by the first Close, the conn may be closed both by the
+	// swarm and by the transport
+	closed atomic.Bool
+
 	ctx       context.Context
 	cancel    func()
 	transport *proximityTransport
 }
 
 // newConn returns an inbound or outbound tpt.CapableConn upgraded from a Conn.
-func newConn(ctx context.Context, t *proximityTransport, remoteMa ma.Multiaddr, remotePID peer.ID, netdir network.Direction,
+func newConn(ctx context.Context, session context.Context, l *Listener, remoteMa ma.Multiaddr, remotePID peer.ID, netdir network.Direction,
 ) (tpt.CapableConn, error) {
+	t := l.transport
 	t.logger.Debug("newConn()", logutil.PrivateString("remoteMa", remoteMa.String()), zap.Bool("inbound", netdir == network.DirInbound))
 
 	if netdir == network.DirUnknown {
@@ -58,36 +80,55 @@ func newConn(ctx context.Context, t *proximityTransport, remoteMa ma.Multiaddr,
 
 	// Creates a manet.Conn
 	pr, pw := io.Pipe()
-	connCtx, cancel := context.WithCancel(t.listener.ctx)
+	connCtx, cancel := context.WithCancel(session)
 
 	maconn := &Conn{
 		readIn:    pw,
 		readOut:   pr,
-		localMa:   t.listener.localMa,
+		localMa:   l.localMa,
 		remoteMa:  remoteMa,
 		ready:     false,
-		cache:     NewRingBufferMap(t.logger, 128),
 		mp:        newMplex(connCtx, t.logger),
 		ctx:       connCtx,
 		cancel:    cancel,
 		transport: t,
 	}
 
+	// Configure the caches before the conn can be found by ReceiveFromPeer
+	if maconn.cache = t.newConnCache(); maconn.cache != nil {
+		maconn.mp.addInputCache(t.cache)
+		maconn.mp.addInputCache(maconn.cache)
+	}
+
 	// Stores the conn in connMap, will be deleted during conn.Close()
 	t.connMapMutex.Lock()
 	t.connMap[maconn.RemoteAddr().String()] = maconn
 	t.connMapMutex.Unlock()
 
 	// Configure mplex and run it
-	maconn.mp.addInputCache(t.cache)
-	maconn.mp.addInputCache(maconn.cache)
 	maconn.mp.setOutput(pw)
+	maconn.closePipeOnDone()
+
+	if t.keepAliveEnabled() {
+		maconn.lastReceived.Store(time.Now().UnixNano())
+		go maconn.keepAlive(t.keepAliveInterval, t.keepAliveTimeout)
+	}
 
 	// Returns an upgraded CapableConn (muxed, addr filtered, secured, etc...)
 	return t.upgrader.Upgrade(ctx, t, maconn, netdir, remotePID, connScope)
 }
 
-// Read reads data from the connection.
+// closePipeOnDone closes the read pipe once the conn context is done, also
+// when the session of the listener ends without the conn being closed, so a
+// blocked Read returns instead of holding the muxer reading it
+func (c *Conn) closePipeOnDone() {
+	context.AfterFunc(c.ctx, func() {
+		c.readIn.Close()
+		c.readOut.Close()
+	})
+}
+
+// Read reads data from the connection, it returns once the conn is closed.
 // Timeout handled by the native driver.
 func (c *Conn) Read(payload []byte) (n int, err error) {
 	c.transport.logger.Debug("Conn.Read", logutil.PrivateString("remoteAddr", c.RemoteAddr().String()))
@@ -124,12 +165,35 @@ func (c *Conn) Write(payload []byte) (n int, err error) {
 		go c.mp.run(c.RemoteAddr().String())
 	}
 
-	// Write to the peer's device using native driver.
-	if !c.transport.driver.SendToPeer(c.RemoteAddr().String(), payload) {
-		c.transport.logger.Error("Conn.Write failed")
-		return 0, fmt.Errorf("error: Conn.Write failed: native write failed")
+	remoteAddr := c.RemoteAddr().String()
+
+	// Encode the payload, the frames are sent in order
+	frames := [][]byte{payload}
+	if codec := c.transport.frameCodec(remoteAddr); codec != nil {
+		codec.encodeMutex.Lock()
+		defer codec.encodeMutex.Unlock()
+
+		frames = codec.encode(c.transport, remoteAddr, payload)
+	}
+
+	c.keepAliveMutex.Lock()
+	defer c.keepAliveMutex.Unlock()
+
+	header := c.keepAliveSendingLocked(remoteAddr)
+	for _, frame := range frames {
+		// Prefix the frame with the keepalive header
+		if header {
+			frame = append([]byte{frameData}, frame...)
+		}
+
+		// Write to the peer's device using native driver.
+		if !c.transport.driver.SendToPeer(remoteAddr, frame) {
+			c.transport.logger.Error("Conn.Write failed")
+			return 0, fmt.Errorf("error: Conn.Write failed: native write failed")
+		}
 	}
 	c.transport.logger.Debug("Conn.Write successful")
+	c.transport.logSentBandwidth(remoteAddr, len(payload))
 
 	return len(payload), nil
 }
@@ -138,19 +202,43 @@ func (c *Conn) Write(payload []byte) (n int, err error) {
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *Conn) Close() error {
 	c.transport.logger.Debug("Conn.Close()")
+	if c.closed.Swap(true) {
+		return nil
+	}
+
 	c.cancel()
 
 	// Closes read pipe
 	c.readIn.Close()
 	c.readOut.Close()
 
-	// Removes conn from connmgr's connMap
+	// Removes conn from connmgr's connMap, unless a newer conn to the same
+	// peer replaced it meanwhile, the peer state and the native connection
+	// then belong to the newer conn
+	remotePID := c.RemoteAddr().String()
 	c.transport.connMapMutex.Lock()
-	delete(c.transport.connMap, c.RemoteAddr().String())
+	current, found := c.transport.connMap[remotePID]
+	replaced := found && current != c
+	if !replaced {
+		delete(c.transport.connMap, remotePID)
+	}
 	c.transport.connMapMutex.Unlock()
 
-	// Disconnect the driver
-	c.transport.driver.CloseConnWithPeer(c.RemoteAddr().String())
+	if replaced {
+		c.transport.logger.Debug("Conn.Close: conn replaced by a newer one, keeping the native connection", logutil.PrivateString("remotePID", remotePID))
+		return nil
+	}
+
+	c.transport.removeFrameCodec(remotePID)
+
+	// Drops the payloads cached before the conn was ready
+	if c.cache != nil {
+		c.cache.Delete(remotePID)
+	}
+
+	// Disconnect the driver, the wait is bounded as the native call may block,
+	// e.g. when the conns of a lost peer are closed
+	c.transport.closeDriverConn(remotePID)
 
 	return nil
 }
@@ -0,0 +1,102 @@
+package proximitytransport
+
+import (
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+const (
+	// defaultConnCacheEntries is the number of payloads cached by a conn
+	// before it is ready, the oldest ones are evicted
+	defaultConnCacheEntries = 128
+
+	// defaultConnCacheMaxBytes bounds the size of the payloads cached by a
+	// conn before it is ready
+	defaultConnCacheMaxBytes = 1 << 20
+)
+
+// ConnStat describes the state of a Conn and of the cache holding the
+// payloads received before it is ready
+type ConnStat struct {
+	Ready bool
+
+	// CacheEntries and CacheBytes are the number and the size of the
+	// payloads currently cached
+	CacheEntries int
+	CacheBytes   int
+	// CacheEvictions is the number of cached payloads replaced by newer ones
+	// because the cache was full
+	CacheEvictions uint64
+}
+
+// WithConnCacheLimits bounds the cache of each connection, which holds the
+// payloads received before the connection is ready. Once maxEntries payloads
+// are cached the oldest ones are evicted, a connection whose cached payloads
+// would exceed maxBytes is closed. The default limits are used if a value
+// is not positive.
+func WithConnCacheLimits(maxEntries int, maxBytes int) TransportOption {
+	return func(t *proximityTransport) {
+		if maxEntries > 0 {
+			t.connCacheEntries = maxEntries
+		}
+
+		if maxBytes > 0 {
+			t.connCacheMaxBytes = maxBytes
+		}
+	}
+}
+
+// newConnCache returns the cache of a new conn, nil if the cache is disabled
+func (t *proximityTransport) newConnCache() *RingBufferMap {
+	if t.cacheDisabled {
+		return nil
+	}
+
+	cache := NewRingBufferMap(t.logger, t.connCacheEntries)
+	cache.budget = t.cacheBudget
+	cache.onEvict = t.cacheEvictionCallback()
+
+	return cache
+}
+
+// Stat returns the state of the conn and of its cache
+func (c *Conn) Stat() ConnStat {
+	c.Lock()
+	defer c.Unlock()
+
+	stat := ConnStat{
+		Ready:          c.ready,
+		CacheEvictions: c.cacheEvictions,
+	}
+
+	if c.cache != nil {
+		stat.CacheEntries, stat.CacheBytes = c.cache.Stat(c.RemoteAddr().String())
+	}
+
+	return stat
+}
+
+// cachePayload caches a payload received before the conn is ready, c must be
+// locked. It returns false if the payload would exceed the size bound of the
+// cache, the conn must then be closed.
+func (c *Conn) cachePayload(remotePID string, payload []byte) bool {
+	entries, bytes := c.cache.Stat(remotePID)
+
+	if bytes+len(payload) > c.transport.connCacheMaxBytes {
+		c.transport.logger.Warn("conn cache is full, the peer is disconnected",
+			logutil.PrivateString("remotePID", remotePID),
+			zap.Int("entries", entries),
+			zap.Int("bytes", bytes),
+			zap.Int("payload", len(payload)),
+		)
+		return false
+	}
+
+	if entries >= c.cache.Size() {
+		c.cacheEvictions++
+	}
+
+	c.cache.Add(remotePID, payload)
+	return true
+}
@@ -0,0 +1,127 @@
+package proximitytransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingDriver never returns from CloseConnWithPeer until release is closed
+type hangingDriver struct {
+	*NoopProximityDriver
+
+	closing chan string
+	release chan struct{}
+}
+
+func (d *hangingDriver) CloseConnWithPeer(remotePID string) {
+	d.closing <- remotePID
+	<-d.release
+}
+
+func TestConnReadReturnsOnSessionEnd(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"))(nil, nil)
+	require.NoError(t, err)
+
+	session, cancelSession := context.WithCancel(ctx)
+	defer cancelSession()
+
+	c, pr := newTestConn(session, transport)
+	defer c.cancel()
+
+	// read the pipe of the conn, Read only checks the conn context before
+	// blocking on it
+	read := make(chan error, 1)
+	go func() {
+		_, err := pr.Read(make([]byte, 64))
+		read <- err
+	}()
+
+	// the listener session ends without the conn being closed, e.g. when
+	// the transport is closed
+	cancelSession()
+
+	select {
+	case err := <-read:
+		require.Error(t, err)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "Read still blocked once the session ended")
+	}
+}
+
+func TestConnCloseDriverTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driver := &hangingDriver{
+		NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+		closing:             make(chan string, 1),
+		release:             make(chan struct{}),
+	}
+	defer close(driver.release)
+
+	transport, err := NewTransport(ctx, nil, driver, WithDriverCloseTimeout(time.Millisecond*50))(nil, nil)
+	require.NoError(t, err)
+
+	remoteMa, err := ma.NewMultiaddr("/" + testProtocolName + "/" + testRemotePID)
+	require.NoError(t, err)
+
+	c, _ := newTestConn(ctx, transport)
+	c.remoteMa = remoteMa
+
+	// Close waits for the native driver, until the timeout
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "Close still blocked by the native driver")
+	}
+	require.Equal(t, testRemotePID, <-driver.closing)
+}
+
+func TestConnCloseReplacedConn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driver := &closingDriver{
+		NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+	}
+
+	transport, err := NewTransport(ctx, nil, driver)(nil, nil)
+	require.NoError(t, err)
+
+	remoteMa, err := ma.NewMultiaddr("/" + testProtocolName + "/" + testRemotePID)
+	require.NoError(t, err)
+
+	old, _ := newTestConn(ctx, transport)
+	old.remoteMa = remoteMa
+
+	// the peer reconnected before the old conn is closed
+	newer, _ := newTestConn(ctx, transport)
+	newer.remoteMa = remoteMa
+
+	// closing the old conn keeps the native connection of the newer one
+	require.NoError(t, old.Close())
+	require.Empty(t, driver.closedPeers())
+
+	transport.connMapMutex.RLock()
+	current := transport.connMap[testRemotePID]
+	transport.connMapMutex.RUnlock()
+	require.Same(t, newer, current)
+
+	require.NoError(t, newer.Close())
+	require.Equal(t, []string{testRemotePID}, driver.closedPeers())
+
+	// closing a conn twice doesn't disconnect the driver again
+	require.NoError(t, newer.Close())
+	require.Equal(t, []string{testRemotePID}, driver.closedPeers())
+}
@@ -0,0 +1,98 @@
+package proximitytransport_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	"berty.tech/weshnet/v2/pkg/contactgater"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+// newGatedProximityPeers returns the host of a started gater and the host of
+// a peer answering its challenges with keys, linked through the proximity
+// transport. The host of the gater is the one dialing, so the peer isn't
+// rejected before being challenged.
+func newGatedProximityPeers(ctx context.Context, t *testing.T, gater *contactgater.Gater, gaterKeys, keys []contactgater.Key) (gated, other host.Host, link func()) {
+	t.Helper()
+
+	for {
+		driverGated := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+		driverOther := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+		proximity.LinkDrivers(driverGated, driverOther)
+
+		// the hosts of the previous attempts still listen, each one gets
+		// its own registry
+		gated = newGatedProximityHost(ctx, t, driverGated, gater, proximity.WithTransportRegistry(proximity.NewTransportRegistry()))
+		other = newProximityHost(ctx, t, driverOther, proximity.WithTransportRegistry(proximity.NewTransportRegistry()))
+
+		// the peer with the smallest ID dials
+		if driverOther.LocalPID < driverGated.LocalPID {
+			continue
+		}
+
+		require.NoError(t, gater.Start(gated, func() ([]contactgater.Key, error) { return gaterKeys, nil }))
+		t.Cleanup(func() { gater.Close() })
+
+		responder := contactgater.NewResponder(zap.NewNop(), other, func() ([]contactgater.Key, error) { return keys, nil })
+		t.Cleanup(func() { responder.Close() })
+
+		return gated, other, func() {
+			require.True(t, driverOther.Transport.HandleFoundPeer(driverGated.LocalPID))
+			require.True(t, driverGated.Transport.HandleFoundPeer(driverOther.LocalPID))
+
+			go driverGated.Deliver(ctx)
+			go driverOther.Deliver(ctx)
+		}
+	}
+}
+
+func TestContactGaterOverProximity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secret := []byte("contact group secret")
+	gaterKeys := []contactgater.Key{{ContactPK: []byte("contact"), Secret: secret}}
+
+	t.Run("contact", func(t *testing.T) {
+		gater := contactgater.New(zap.NewNop(), contactgater.WithVerifyTimeout(time.Second*5))
+		gated, contact, link := newGatedProximityPeers(ctx, t, gater, gaterKeys,
+			[]contactgater.Key{{ContactPK: []byte("gated"), Secret: secret}})
+		link()
+
+		// the contact is verified and its connection is kept
+		require.Eventually(t, func() bool {
+			_, ok := gater.Verified(contact.ID())
+			return ok
+		}, time.Second*10, time.Millisecond*50)
+
+		contactPK, _ := gater.Verified(contact.ID())
+		require.Equal(t, []byte("contact"), contactPK)
+		require.Equal(t, network.Connected, gated.Network().Connectedness(contact.ID()))
+	})
+
+	t.Run("stranger", func(t *testing.T) {
+		gater := contactgater.New(zap.NewNop(), contactgater.WithVerifyTimeout(time.Second*5))
+		gated, stranger, link := newGatedProximityPeers(ctx, t, gater, gaterKeys,
+			[]contactgater.Key{{ContactPK: []byte("gated"), Secret: []byte("another secret")}})
+		link()
+
+		// the stranger fails the challenge, it is denied and dropped
+		require.Eventually(t, func() bool {
+			return !gater.InterceptPeerDial(stranger.ID())
+		}, time.Second*10, time.Millisecond*50)
+		require.Eventually(t, func() bool {
+			return gated.Network().Connectedness(stranger.ID()) == network.NotConnected
+		}, time.Second*10, time.Millisecond*50)
+
+		_, ok := gater.Verified(stranger.ID())
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,83 @@
+package proximitytransport
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// WithPayloadDedup drops the payloads received from a peer which are exact
+// duplicates of one of its last window payloads. It is meant for the native
+// drivers known to deliver the same payload more than once, the libp2p
+// streams already handle the retransmissions of the other drivers.
+// Heartbeats are never deduplicated.
+func WithPayloadDedup(window int) TransportOption {
+	return func(t *proximityTransport) {
+		if window > 0 {
+			t.dedup = newPayloadDedup(window)
+		}
+	}
+}
+
+// payloadDedup remembers a short hash of the last payloads received from
+// each peer
+type payloadDedup struct {
+	window int
+	peers  map[string]*recentPayloads
+	mu     sync.Mutex
+}
+
+// recentPayloads is a ring of the hashes of the last payloads of a peer
+type recentPayloads struct {
+	hashes []uint64
+	next   int
+	seen   map[uint64]struct{}
+}
+
+func newPayloadDedup(window int) *payloadDedup {
+	return &payloadDedup{
+		window: window,
+		peers:  make(map[string]*recentPayloads),
+	}
+}
+
+// isDuplicate returns true if the payload has already been received from the
+// peer within the window, otherwise the payload is added to the window
+func (d *payloadDedup) isDuplicate(remotePID string, payload []byte) bool {
+	h := fnv.New64a()
+	_, _ = h.Write(payload)
+	sum := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recent, ok := d.peers[remotePID]
+	if !ok {
+		recent = &recentPayloads{
+			hashes: make([]uint64, 0, d.window),
+			seen:   make(map[uint64]struct{}),
+		}
+		d.peers[remotePID] = recent
+	}
+
+	if _, ok := recent.seen[sum]; ok {
+		return true
+	}
+
+	if len(recent.hashes) < d.window {
+		recent.hashes = append(recent.hashes, sum)
+	} else {
+		delete(recent.seen, recent.hashes[recent.next])
+		recent.hashes[recent.next] = sum
+		recent.next = (recent.next + 1) % d.window
+	}
+	recent.seen[sum] = struct{}{}
+
+	return false
+}
+
+// forgetPeer drops the window of a peer
+func (d *payloadDedup) forgetPeer(remotePID string) {
+	d.mu.Lock()
+	delete(d.peers, remotePID)
+	d.mu.Unlock()
+}
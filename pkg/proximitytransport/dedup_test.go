@@ -0,0 +1,87 @@
+package proximitytransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReceiveFromPeerDedup(t *testing.T) {
+	cases := []struct {
+		name       string
+		opts       []TransportOption
+		duplicated bool
+	}{
+		{"dedup disabled", nil, true},
+		{"dedup enabled", []TransportOption{WithPayloadDedup(2)}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transport, err := NewTransport(ctx, nil, NewNoopProximityDriver(0, "noop", "/noop"), tc.opts...)(nil, nil)
+			require.NoError(t, err)
+
+			c, pr := newTestConn(ctx, transport)
+			defer c.cancel()
+			defer pr.Close()
+
+			payloads := readPayloads(pr)
+
+			c.Lock()
+			c.ready = true
+			c.Unlock()
+			go c.mp.run(testRemotePID)
+
+			expectPayload := func(expected string) {
+				select {
+				case payload := <-payloads:
+					require.Equal(t, expected, string(payload))
+				case <-time.After(time.Second):
+					require.FailNow(t, "payload should have been delivered", expected)
+				}
+			}
+
+			transport.ReceiveFromPeer(testRemotePID, []byte("payload"))
+			expectPayload("payload")
+
+			// retransmission of the same payload
+			transport.ReceiveFromPeer(testRemotePID, []byte("payload"))
+			if tc.duplicated {
+				expectPayload("payload")
+			}
+
+			transport.ReceiveFromPeer(testRemotePID, []byte("next"))
+			expectPayload("next")
+
+			// the first payload is out of the window after two other ones
+			transport.ReceiveFromPeer(testRemotePID, []byte("other"))
+			expectPayload("other")
+
+			transport.ReceiveFromPeer(testRemotePID, []byte("payload"))
+			expectPayload("payload")
+		})
+	}
+}
+
+func TestPayloadDedupWindow(t *testing.T) {
+	d := newPayloadDedup(2)
+
+	require.False(t, d.isDuplicate("a", []byte("1")))
+	require.True(t, d.isDuplicate("a", []byte("1")))
+
+	// the windows are per peer
+	require.False(t, d.isDuplicate("b", []byte("1")))
+
+	require.False(t, d.isDuplicate("a", []byte("2")))
+	require.False(t, d.isDuplicate("a", []byte("3")))
+	require.False(t, d.isDuplicate("a", []byte("1")))
+	require.True(t, d.isDuplicate("a", []byte("3")))
+
+	d.forgetPeer("a")
+	require.False(t, d.isDuplicate("a", []byte("3")))
+}
@@ -0,0 +1,83 @@
+package proximitytransport
+
+import (
+	"go.uber.org/zap"
+)
+
+// DriverMode is the operating mode reported by the native driver, some
+// drivers can only partially work under OS restrictions (e.g. when a radio
+// feature is blocked in the background)
+type DriverMode int
+
+const (
+	// DriverModeFull is the normal mode, connections are accepted and
+	// initiated
+	DriverModeFull DriverMode = iota
+	// DriverModeInboundOnly is used when the driver can't initiate
+	// connections, e.g. a BLE driver only allowed to scan. The transport
+	// keeps accepting the inbound connections but declines the peers it
+	// should dial.
+	DriverModeInboundOnly
+	// DriverModeOutboundOnly is used when the driver can't accept
+	// connections. The transport keeps dialing the peers but declines the
+	// ones expected to dial it.
+	DriverModeOutboundOnly
+)
+
+func (m DriverMode) String() string {
+	switch m {
+	case DriverModeFull:
+		return "full"
+	case DriverModeInboundOnly:
+		return "inbound-only"
+	case DriverModeOutboundOnly:
+		return "outbound-only"
+	default:
+		return "unknown"
+	}
+}
+
+func (m DriverMode) inboundEnabled() bool { return m != DriverModeOutboundOnly }
+
+func (m DriverMode) outboundEnabled() bool { return m != DriverModeInboundOnly }
+
+// TransportHealth describes what the transport is currently able to do
+type TransportHealth struct {
+	// Listening is true while the listener is running
+	Listening bool
+
+	// Mode is the last mode reported by the native driver
+	Mode DriverMode
+
+	// Inbound is true when the inbound connections are accepted
+	Inbound bool
+
+	// Outbound is true when the outbound connections are initiated, it is
+	// false while the dials are disabled, see SetDialEnabled
+	Outbound bool
+}
+
+// SetDriverMode is called by the native driver when it enters or leaves a
+// degraded mode. The connections already established are kept.
+func (t *proximityTransport) SetDriverMode(mode DriverMode) {
+	t.lock.Lock()
+	t.driverMode = mode
+	t.lock.Unlock()
+
+	t.logger.Info("SetDriverMode", zap.Stringer("mode", mode))
+}
+
+// Health returns the current state of the transport
+func (t *proximityTransport) Health() TransportHealth {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	listening := t.listener != nil && t.listener.ctx.Err() == nil
+
+	return TransportHealth{
+		Listening: listening,
+		Mode:      t.driverMode,
+		Inbound:   listening && t.driverMode.inboundEnabled(),
+		Outbound:  listening && !t.dialDisabled && t.driverMode.outboundEnabled(),
+	}
+}
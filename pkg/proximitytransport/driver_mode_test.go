@@ -0,0 +1,126 @@
+package proximitytransport
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// dialRecorderDriver records the peers the transport tries to dial
+type dialRecorderDriver struct {
+	*closingDriver
+
+	dialed []string
+}
+
+func (d *dialRecorderDriver) DialPeer(remotePID string) bool {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, remotePID)
+	d.mu.Unlock()
+	return false
+}
+
+func (d *dialRecorderDriver) dialedPeers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.dialed...)
+}
+
+func TestDriverModeInboundOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	driver := &dialRecorderDriver{
+		closingDriver: &closingDriver{
+			NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+		},
+	}
+
+	transport, err := NewTransport(ctx, nil, driver)(sw, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, TransportHealth{Mode: DriverModeFull}, transport.Health())
+
+	listenMa, err := ma.NewMultiaddr(driver.DefaultAddr())
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	require.Equal(t, TransportHealth{Listening: true, Mode: DriverModeFull, Inbound: true, Outbound: true}, transport.Health())
+
+	// the driver can scan but not advertise
+	transport.SetDriverMode(DriverModeInboundOnly)
+	require.Equal(t, TransportHealth{Listening: true, Mode: DriverModeInboundOnly, Inbound: true}, transport.Health())
+
+	// find a peer to dial and a peer expected to dial us
+	var outbound, inbound peer.ID
+	for outbound == "" || inbound == "" {
+		// ed25519 ids like the local one, so peers of both directions are found
+		_, pub, err := crypto.GenerateEd25519Key(crand.Reader)
+		require.NoError(t, err)
+
+		pid, err := peer.IDFromPublicKey(pub)
+		require.NoError(t, err)
+
+		if pid.String() > sw.LocalPeer().String() {
+			outbound = pid
+		} else {
+			inbound = pid
+		}
+	}
+	outboundPID, inboundPID := outbound.String(), inbound.String()
+
+	// the peer which should be dialed is declined without dialing it
+	require.False(t, transport.HandleFoundPeer(outboundPID))
+	require.Equal(t, []string{outboundPID}, driver.closedPeers())
+
+	remoteMa, err := ma.NewMultiaddr("/" + testProtocolName + "/" + outboundPID)
+	require.NoError(t, err)
+	require.False(t, transport.CanDial(remoteMa))
+
+	// the inbound connection is still accepted
+	l := listener.(*Listener)
+	requests := make(chan connReq, 1)
+	go func() {
+		select {
+		case req := <-l.inboundConnReq:
+			requests <- req
+		case <-l.ctx.Done():
+		}
+	}()
+
+	require.True(t, transport.HandleFoundPeer(inboundPID))
+
+	select {
+	case req := <-requests:
+		require.Equal(t, inbound, req.remotePID)
+	case <-time.After(time.Second):
+		require.FailNow(t, "inbound connection not requested")
+	}
+
+	// give a chance to an unexpected async dial
+	time.Sleep(time.Millisecond * 100)
+	require.Empty(t, driver.dialedPeers())
+	require.Equal(t, []string{outboundPID}, driver.closedPeers())
+
+	// once back to the full mode, the peers are dialed again
+	transport.SetDriverMode(DriverModeFull)
+	require.True(t, transport.Health().Outbound)
+	require.True(t, transport.CanDial(remoteMa))
+
+	_, err = transport.Dial(ctx, remoteMa, outbound)
+	require.Error(t, err)
+	require.Equal(t, []string{outboundPID}, driver.dialedPeers())
+}
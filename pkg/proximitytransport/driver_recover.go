@@ -0,0 +1,82 @@
+package proximitytransport
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+// DriverPanicHandler is called after a panic of the native driver has been
+// recovered, method is the name of the driver method which panicked.
+type DriverPanicHandler func(method string, recovered interface{})
+
+// WithDriverPanicHandler sets a handler called when a method of the native
+// driver panics, e.g. to report the crash or to restart the driver.
+// The panics are always recovered and the call is handled as a failure: the
+// dial or the send fails and the connection is considered closed.
+func WithDriverPanicHandler(handler DriverPanicHandler) TransportOption {
+	return func(t *proximityTransport) {
+		t.driverPanicHandler = handler
+	}
+}
+
+// recoverDriver prevents the bugs of the native bridges from crashing the
+// node, the panics of the wrapped driver are recovered and logged
+type recoverDriver struct {
+	ProximityDriver
+
+	logger  *zap.Logger
+	handler DriverPanicHandler
+}
+
+func newRecoverDriver(driver ProximityDriver, logger *zap.Logger, handler DriverPanicHandler) *recoverDriver {
+	return &recoverDriver{
+		ProximityDriver: driver,
+		logger:          logger,
+		handler:         handler,
+	}
+}
+
+func (d *recoverDriver) recoverPanic(method string, remotePID string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	d.logger.Error("native driver panicked",
+		zap.String("method", method),
+		logutil.PrivateString("remotePID", remotePID),
+		zap.String("panic", fmt.Sprint(r)),
+		zap.Stack("stack"))
+
+	if d.handler != nil {
+		d.handler(method, r)
+	}
+}
+
+func (d *recoverDriver) Start(localPID string) {
+	defer d.recoverPanic("Start", "")
+	d.ProximityDriver.Start(localPID)
+}
+
+func (d *recoverDriver) Stop() {
+	defer d.recoverPanic("Stop", "")
+	d.ProximityDriver.Stop()
+}
+
+func (d *recoverDriver) DialPeer(remotePID string) (ok bool) {
+	defer d.recoverPanic("DialPeer", remotePID)
+	return d.ProximityDriver.DialPeer(remotePID)
+}
+
+func (d *recoverDriver) SendToPeer(remotePID string, payload []byte) (ok bool) {
+	defer d.recoverPanic("SendToPeer", remotePID)
+	return d.ProximityDriver.SendToPeer(remotePID, payload)
+}
+
+func (d *recoverDriver) CloseConnWithPeer(remotePID string) {
+	defer d.recoverPanic("CloseConnWithPeer", remotePID)
+	d.ProximityDriver.CloseConnWithPeer(remotePID)
+}
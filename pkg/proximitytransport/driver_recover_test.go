@@ -0,0 +1,92 @@
+package proximitytransport
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// panickingDriver panics when it is asked to dial or to disconnect a peer
+type panickingDriver struct {
+	*NoopProximityDriver
+}
+
+func (d *panickingDriver) DialPeer(_ string) bool { panic("native dial crashed") }
+
+func (d *panickingDriver) CloseConnWithPeer(_ string) { panic("native close crashed") }
+
+func TestDriverPanicRecovered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	driver := &panickingDriver{
+		NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+	}
+
+	panics := make(chan string, 10)
+	handler := func(method string, _ interface{}) {
+		panics <- method
+	}
+
+	// waitPanic waits for the panic of a driver method to be recovered
+	waitPanic := func(method string) {
+		t.Helper()
+
+		select {
+		case recovered := <-panics:
+			require.Equal(t, method, recovered)
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, "panic hasn't been recovered", method)
+		}
+	}
+
+	transport, err := NewTransport(ctx, nil, driver, WithDriverPanicHandler(handler), WithMaxConnections(1, LimitPolicyDecline))(sw, nil)
+	require.NoError(t, err)
+
+	listenMa, err := ma.NewMultiaddr(driver.DefaultAddr())
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	remotePID, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	// the dial fails instead of crashing the node
+	remoteMa, err := ma.NewMultiaddr("/" + testProtocolName + "/" + remotePID.String())
+	require.NoError(t, err)
+
+	_, err = transport.Dial(ctx, remoteMa, remotePID)
+	require.Error(t, err)
+	waitPanic("DialPeer")
+
+	// the peer declined by the connection limit is considered disconnected
+	// even if the driver panics while closing its connection
+	peers := []peer.ID{}
+	for len(peers) < 2 {
+		pid, err := test.RandPeerID()
+		require.NoError(t, err)
+
+		if pid.String() > sw.LocalPeer().String() {
+			peers = append(peers, pid)
+		}
+	}
+
+	require.True(t, transport.HandleFoundPeer(peers[0].String()))
+	require.False(t, transport.HandleFoundPeer(peers[1].String()))
+	waitPanic("CloseConnWithPeer")
+
+	// the transport is still usable
+	transport.HandleLostPeer(peers[0].String())
+	require.True(t, transport.HandleFoundPeer(peers[1].String()))
+}
@@ -0,0 +1,164 @@
+package proximitytransport
+
+import (
+	"bytes"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+/*
+  When the keepalive is enabled, it is advertised to the peers as the
+  KeepAliveFeature capability. Once the capability negotiator reports that a
+  peer supports it, a marker is sent to the peer and each payload sent from
+  then on starts with a one byte header telling whether it carries libp2p data
+  or a heartbeat. A ping is answered with a pong, and any payload received
+  from the peer proves that the link is still alive.
+  The payloads are sent as is to the peers which don't support the keepalive,
+  and a peer is only closed for being silent once its marker has been
+  received, or if nothing at all has been received from it since the
+  connection was opened, e.g. when it never answers the libp2p handshake.
+*/
+
+const (
+	frameData byte = iota
+	framePing
+	framePong
+)
+
+// KeepAliveFeature is the capability a peer advertises to receive the
+// keepalive frames, see WithKeepAlive
+const KeepAliveFeature = "proximity_keepalive"
+
+// keepAliveMarker announces that the payloads sent from then on start with
+// the keepalive header, like frameTransformMarker it can't be mistaken for a
+// libp2p payload
+const keepAliveMarker = "\xffkeepalive"
+
+// WithKeepAlive enables an application level keepalive on each connection.
+// A heartbeat is sent every interval and the connection is closed if nothing
+// has been received from the peer for longer than timeout, which should be
+// greater than interval. It detects the links which the native driver still
+// reports as connected while the peer is gone.
+// The keepalive is only used with the peers which support it, see
+// SetCapabilityNegotiator.
+func WithKeepAlive(interval, timeout time.Duration) TransportOption {
+	return func(t *proximityTransport) {
+		t.keepAliveInterval = interval
+		t.keepAliveTimeout = timeout
+	}
+}
+
+func (t *proximityTransport) keepAliveEnabled() bool {
+	return t.keepAliveInterval > 0 && t.keepAliveTimeout > 0
+}
+
+// handleFrame reads the header of a payload received from the native driver,
+// it returns the libp2p data, ok is false if the payload was a heartbeat or
+// the marker. The payloads are returned as is until the marker is received.
+func (t *proximityTransport) handleFrame(remotePID string, payload []byte) (data []byte, ok bool) {
+	t.connMapMutex.RLock()
+	c, found := t.connMap[remotePID]
+	t.connMapMutex.RUnlock()
+	if !found {
+		return payload, true
+	}
+
+	c.lastReceived.Store(time.Now().UnixNano())
+
+	if !c.keepAliveReceiving.Load() {
+		if bytes.Equal(payload, []byte(keepAliveMarker)) {
+			c.keepAliveReceiving.Store(true)
+			return nil, false
+		}
+
+		return payload, true
+	}
+
+	if len(payload) == 0 {
+		t.logger.Warn("handleFrame: empty payload, drop it")
+		return nil, false
+	}
+
+	switch payload[0] {
+	case frameData:
+		return payload[1:], true
+	case framePing:
+		if !c.sendHeartbeat(remotePID, framePong) {
+			t.logger.Debug("handleFrame: unable to answer ping", logutil.PrivateString("remotePID", remotePID))
+		}
+	case framePong:
+	default:
+		t.logger.Warn("handleFrame: unknown frame, drop it", zap.Uint8("type", payload[0]))
+	}
+
+	return nil, false
+}
+
+// keepAlive sends heartbeats to the peer until the conn is closed, and closes
+// it if the peer has been silent for too long
+func (c *Conn) keepAlive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	remoteAddr := c.RemoteAddr().String()
+	opened := c.lastReceived.Load()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			return
+		}
+
+		// the peer only sends heartbeats once it has sent its marker, a peer
+		// which has sent nothing yet is dead whether it supports them or not
+		lastReceived := c.lastReceived.Load()
+		silence := time.Since(time.Unix(0, lastReceived))
+		if silence > timeout && (c.keepAliveReceiving.Load() || lastReceived == opened) {
+			c.transport.logger.Warn("Conn.keepAlive: peer is silent, closing conn",
+				logutil.PrivateString("remoteAddr", remoteAddr), zap.Duration("silence", silence))
+			c.Close()
+			return
+		}
+
+		if !c.sendHeartbeat(remoteAddr, framePing) {
+			c.transport.logger.Debug("Conn.keepAlive: unable to send ping", logutil.PrivateString("remoteAddr", remoteAddr))
+		}
+	}
+}
+
+// keepAliveSendingLocked returns true if the payloads sent to the peer start
+// with the keepalive header, the marker is sent first once the peer supports
+// the keepalive. It must be called with keepAliveMutex held.
+func (c *Conn) keepAliveSendingLocked(remoteAddr string) bool {
+	if c.keepAliveSending || !c.transport.keepAliveEnabled() {
+		return c.keepAliveSending
+	}
+
+	if !c.transport.peerSupports(remoteAddr, KeepAliveFeature) {
+		return false
+	}
+
+	if !c.transport.driver.SendToPeer(remoteAddr, []byte(keepAliveMarker)) {
+		return false
+	}
+
+	c.keepAliveSending = true
+	return true
+}
+
+// sendHeartbeat sends a ping or a pong to the peer, it returns false if the
+// peer doesn't read the keepalive header
+func (c *Conn) sendHeartbeat(remoteAddr string, frame byte) bool {
+	c.keepAliveMutex.Lock()
+	defer c.keepAliveMutex.Unlock()
+
+	if !c.keepAliveSendingLocked(remoteAddr) {
+		return false
+	}
+
+	return c.transport.driver.SendToPeer(remoteAddr, []byte{frame})
+}
@@ -0,0 +1,294 @@
+package proximitytransport_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/test"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/internal/capabilities"
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+// keepAliveMarker is the payload announcing the keepalive header
+const keepAliveMarker = "\xffkeepalive"
+
+// memoryDriver is a native driver always connected to its peers, it supports
+// the keepalive and answers the pings while the peer isn't silent. Its
+// answers are delivered in order.
+type memoryDriver struct {
+	*proximity.NoopProximityDriver
+
+	transport proximity.ProximityTransport
+	answers   chan memoryAnswer
+	pings     chan struct{}
+	closed    chan string
+
+	mu       sync.Mutex
+	silent   bool
+	lastPong time.Time
+	sent     [][]byte
+}
+
+type memoryAnswer struct {
+	remotePID string
+	payload   []byte
+}
+
+func newMemoryDriver() *memoryDriver {
+	return &memoryDriver{
+		NoopProximityDriver: proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr),
+		answers:             make(chan memoryAnswer, 100),
+		pings:               make(chan struct{}, 100),
+		closed:              make(chan string, 10),
+	}
+}
+
+func (d *memoryDriver) deliver(ctx context.Context) {
+	for {
+		select {
+		case answer := <-d.answers:
+			d.transport.ReceiveFromPeer(answer.remotePID, answer.payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// setSilent stops answering the pings, it returns the time the last pong has
+// been sent
+func (d *memoryDriver) setSilent() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.silent = true
+	return d.lastPong
+}
+
+func (d *memoryDriver) sentPayloads() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([][]byte{}, d.sent...)
+}
+
+func (d *memoryDriver) DialPeer(_ string) bool { return true }
+
+func (d *memoryDriver) SendToPeer(remotePID string, payload []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sent = append(d.sent, append([]byte{}, payload...))
+
+	switch {
+	case bytes.Equal(payload, []byte(keepAliveMarker)):
+		// the peer supports the keepalive too
+		d.answers <- memoryAnswer{remotePID: remotePID, payload: payload}
+
+	case len(payload) == 1 && payload[0] == 1:
+		// 1 is the header of a ping, 2 the header of a pong
+		if !d.silent {
+			d.lastPong = time.Now()
+			d.answers <- memoryAnswer{remotePID: remotePID, payload: []byte{2}}
+		}
+
+		select {
+		case d.pings <- struct{}{}:
+		default:
+		}
+	}
+
+	return true
+}
+
+func (d *memoryDriver) CloseConnWithPeer(remotePID string) {
+	d.closed <- remotePID
+}
+
+// newKeepAliveTransport returns a transport using the keepalive with the
+// peers the negotiator reports, and dials a peer which never answers the
+// libp2p handshake so only the keepalive can close the conn
+func newKeepAliveTransport(ctx context.Context, t *testing.T, driver *memoryDriver, negotiator proximity.CapabilityNegotiator, interval, timeout time.Duration) (remotePID string, dialErr <-chan error) {
+	t.Helper()
+
+	sw := swarmt.GenSwarm(t)
+	t.Cleanup(func() { sw.Close() })
+
+	transport, err := proximity.NewTransport(ctx, nil, driver, proximity.WithKeepAlive(interval, timeout))(sw, swarmt.GenUpgrader(t, sw, nil))
+	require.NoError(t, err)
+	driver.transport = transport
+	transport.SetCapabilityNegotiator(negotiator)
+
+	go driver.deliver(ctx)
+
+	listenMa, err := ma.NewMultiaddr(ble.DefaultAddr)
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	pid, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	remoteMa, err := ma.NewMultiaddr("/" + ble.ProtocolName + "/" + pid.String())
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := transport.Dial(ctx, remoteMa, pid)
+		errCh <- err
+	}()
+
+	return pid.String(), errCh
+}
+
+func TestTransportKeepAlive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		interval = 20 * time.Millisecond
+		timeout  = time.Second
+	)
+
+	driver := newMemoryDriver()
+	remotePID, dialErr := newKeepAliveTransport(ctx, t, driver, supportedBy{proximity.KeepAliveFeature}, interval, timeout)
+
+	// the conn is kept open while the peer answers the pings
+	for i := 0; i < 5; i++ {
+		select {
+		case <-driver.pings:
+		case <-time.After(timeout):
+			require.FailNow(t, "the peer hasn't been pinged")
+		}
+	}
+	require.Empty(t, driver.closed)
+
+	lastPong := driver.setSilent()
+
+	select {
+	case closed := <-driver.closed:
+		require.Equal(t, remotePID, closed)
+		// the conn is closed once the peer has been silent for longer
+		// than the timeout
+		require.Greater(t, time.Since(lastPong), timeout)
+	case <-time.After(10 * timeout):
+		require.FailNow(t, "conn with the silent peer hasn't been closed")
+	}
+
+	select {
+	case err := <-dialErr:
+		require.Error(t, err)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "dial hasn't returned after the conn has been closed")
+	}
+}
+
+func TestTransportKeepAliveNotSupported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const (
+		interval = 20 * time.Millisecond
+		timeout  = 100 * time.Millisecond
+	)
+
+	// the peer doesn't support the keepalive, it answers nothing but the
+	// start of the libp2p handshake
+	driver := newMemoryDriver()
+	driver.setSilent()
+	remotePID, _ := newKeepAliveTransport(ctx, t, driver, supportedBy{}, interval, timeout)
+
+	// the libp2p handshake is sent as is and the conn isn't closed even
+	// though the peer is silent
+	require.Eventually(t, func() bool {
+		return len(driver.sentPayloads()) > 0
+	}, time.Second*5, time.Millisecond*10)
+
+	multistreamHeader := "/multistream/1.0.0\n"
+	driver.answers <- memoryAnswer{
+		remotePID: remotePID,
+		payload:   append([]byte{byte(len(multistreamHeader))}, multistreamHeader...),
+	}
+
+	select {
+	case <-driver.closed:
+		require.FailNow(t, "conn with a peer not supporting the keepalive has been closed")
+	case <-time.After(5 * timeout):
+	}
+
+	for _, payload := range driver.sentPayloads() {
+		require.NotEqual(t, []byte(keepAliveMarker), payload)
+		require.NotEqual(t, []byte{1}, payload)
+	}
+}
+
+func TestTransportKeepAliveWithOlderPeer(t *testing.T) {
+	cases := []struct {
+		name                   string
+		keepAliveA, keepAliveB bool
+	}{
+		{name: "both peers", keepAliveA: true, keepAliveB: true},
+		{name: "dialer only", keepAliveA: true},
+		{name: "listener only", keepAliveB: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+			driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+			proximity.LinkDrivers(driverA, driverB)
+
+			newHost := func(driver *proximity.LinkedDriver, enabled bool) host.Host {
+				if !enabled {
+					return newProximityHost(ctx, t, driver)
+				}
+
+				return newProximityHost(ctx, t, driver, proximity.WithKeepAlive(time.Millisecond*20, time.Second))
+			}
+
+			hostA := newHost(driverA, tc.keepAliveA)
+			hostB := newHost(driverB, tc.keepAliveB)
+			handleEcho(hostA)
+			handleEcho(hostB)
+
+			linkHosts(ctx, t, driverA, driverB, hostA, hostB)
+
+			newManager := func(h host.Host) *capabilities.Manager {
+				manager, err := proximity.NewCapabilitiesManager(zap.NewNop(), h)
+				require.NoError(t, err)
+				t.Cleanup(func() { manager.Close() })
+				return manager
+			}
+			managerA := newManager(hostA)
+			managerB := newManager(hostB)
+
+			require.Eventually(t, func() bool {
+				_, okA := managerA.Remote(hostB.ID())
+				_, okB := managerB.Remote(hostA.ID())
+				return okA && okB
+			}, time.Second*10, time.Millisecond*50)
+
+			supported := tc.keepAliveA && tc.keepAliveB
+			require.Equal(t, supported, managerA.Supports(hostB.ID(), proximity.KeepAliveFeature))
+
+			// both directions work whether the keepalive is used or not
+			requireEcho(ctx, t, hostA, hostB, []byte("from the dialer"))
+			requireEcho(ctx, t, hostB, hostA, []byte("from the listener"))
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package proximitytransport_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/host"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+// newProximityHost returns a host only reachable through the proximity
+// transport of the driver
+func newProximityHost(ctx context.Context, t *testing.T, driver *proximity.LinkedDriver, opts ...proximity.TransportOption) host.Host {
+	t.Helper()
+
+	return newGatedProximityHost(ctx, t, driver, nil, opts...)
+}
+
+// newGatedProximityHost returns a host only reachable through the proximity
+// transport of the driver, using gater as the connection gater if not nil
+func newGatedProximityHost(ctx context.Context, t *testing.T, driver *proximity.LinkedDriver, gater connmgr.ConnectionGater, opts ...proximity.TransportOption) host.Host {
+	t.Helper()
+
+	return newLinkedHost(t, driver, gater, nil, func(_ host.Host, sw *swarm.Swarm, u tpt.Upgrader) proximity.ProximityTransport {
+		transport, err := proximity.NewTransport(ctx, nil, driver, opts...)(sw, u)
+		require.NoError(t, err)
+		require.NoError(t, sw.AddTransport(transport))
+
+		return transport
+	})
+}
+
+// newLinkedHost returns a host listening on the address of the driver and on
+// listenAddrs, swarmOpts are given to its swarm. addTransports adds the
+// transports of the swarm and returns the proximity transport of the driver.
+func newLinkedHost(t *testing.T, driver *proximity.LinkedDriver, gater connmgr.ConnectionGater, swarmOpts []swarmt.Option, addTransports func(h host.Host, sw *swarm.Swarm, u tpt.Upgrader) proximity.ProximityTransport, listenAddrs ...ma.Multiaddr) host.Host {
+	t.Helper()
+
+	// the swarm and the host share the bus, for the gater to see the
+	// connections
+	bus := eventbus.NewBus()
+	swarmOpts = append([]swarmt.Option{swarmt.OptDialOnly, swarmt.EventBus(bus)}, swarmOpts...)
+	if gater != nil {
+		swarmOpts = append(swarmOpts, swarmt.OptConnGater(gater))
+	}
+
+	sw := swarmt.GenSwarm(t, swarmOpts...)
+	t.Cleanup(func() { sw.Close() })
+
+	h, err := bhost.NewHost(sw, &bhost.HostOpts{EventBus: bus})
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	h.Start()
+
+	driver.Transport = addTransports(h, sw, swarmt.GenUpgrader(t, sw, gater))
+	driver.LocalPID = sw.LocalPeer().String()
+
+	listenMa, err := ma.NewMultiaddr(driver.DefaultAddr())
+	require.NoError(t, err)
+	require.NoError(t, sw.Listen(append([]ma.Multiaddr{listenMa}, listenAddrs...)...))
+
+	return h
+}
+
+func sampleCount(t *testing.T, reg *prometheus.Registry, name, transport string) uint64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "transport" && label.GetValue() == transport {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestConnLatencyTracker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each end needs its own driver protocol, only one transport can listen
+	// per protocol
+	driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverA, driverB)
+
+	hostA := newProximityHost(ctx, t, driverA)
+	hostB := newProximityHost(ctx, t, driverB)
+
+	reg := prometheus.NewRegistry()
+	tracker, err := ipfsutil.NewConnLatencyTracker(hostA, reg)
+	require.NoError(t, err)
+	defer tracker.Close()
+
+	// the histograms are shared by all the trackers
+	const (
+		firstConnection = "ipfs_host_time_to_first_connection_seconds"
+		firstMessage    = "ipfs_host_time_to_first_message_seconds"
+	)
+	proximityConns := sampleCount(t, reg, firstConnection, ipfsutil.ConnTransportProximity)
+	directConns := sampleCount(t, reg, firstConnection, ipfsutil.ConnTransportDirect)
+	proximityMessages := sampleCount(t, reg, firstMessage, ipfsutil.ConnTransportProximity)
+
+	// the peer with the smallest ID dials, the other one accepts the
+	// connection once the native driver found the peer. Like the native
+	// drivers, the payloads are only delivered once both peers have been
+	// found.
+	dialer, accepter := driverA, driverB
+	if driverB.LocalPID < driverA.LocalPID {
+		dialer, accepter = driverB, driverA
+	}
+	require.True(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+	require.True(t, dialer.Transport.HandleFoundPeer(accepter.LocalPID))
+
+	go driverA.Deliver(ctx)
+	go driverB.Deliver(ctx)
+
+	// the notifiees may be called after the conn is listed
+	require.Eventually(t, func() bool {
+		return sampleCount(t, reg, firstConnection, ipfsutil.ConnTransportProximity) == proximityConns+1
+	}, time.Second*10, time.Millisecond*50)
+	require.Equal(t, directConns, sampleCount(t, reg, firstConnection, ipfsutil.ConnTransportDirect))
+
+	// the identification of the peers is the first message of the connection
+	require.Eventually(t, func() bool {
+		return sampleCount(t, reg, firstMessage, ipfsutil.ConnTransportProximity) == proximityMessages+1
+	}, time.Second*10, time.Millisecond*50)
+
+	// only one is recorded per connection
+	handleEcho(hostB)
+
+	for i := 0; i < 2; i++ {
+		sctx, scancel := context.WithTimeout(ctx, time.Second*10)
+		s, err := hostA.NewStream(sctx, hostB.ID(), echoProtocol)
+		scancel()
+		require.NoError(t, err)
+		require.NoError(t, s.Close())
+	}
+
+	require.Equal(t, proximityMessages+1, sampleCount(t, reg, firstMessage, ipfsutil.ConnTransportProximity))
+}
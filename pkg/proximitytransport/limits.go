@@ -0,0 +1,125 @@
+package proximitytransport
+
+import (
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+// LimitPolicy tells what to do when a peer is found while the maximum number
+// of connections is reached
+type LimitPolicy int
+
+const (
+	// LimitPolicyDecline declines the new peer
+	LimitPolicyDecline LimitPolicy = iota
+	// LimitPolicyEvict closes the connection with the lowest scored peer to
+	// accept the new one, the oldest peer is evicted if several have the same
+	// score. The new peer is declined if all the peers have a higher score.
+	LimitPolicyEvict
+)
+
+// PeerScorer returns the score of a peer, the peers with the lowest scores are
+// evicted first. It must not call the transport.
+type PeerScorer func(remotePID string) int
+
+// WithMaxConnections limits the number of peers connected at the same time
+// through the native driver, since radios can only maintain a few of them.
+// A value lower or equal to zero means no limit.
+func WithMaxConnections(maxConnections int, policy LimitPolicy) TransportOption {
+	return func(t *proximityTransport) {
+		t.maxConnections = maxConnections
+		t.limitPolicy = policy
+	}
+}
+
+// WithPeerScorer sets the scores used by LimitPolicyEvict, all the peers have
+// the same score by default
+func WithPeerScorer(scorer PeerScorer) TransportOption {
+	return func(t *proximityTransport) {
+		t.peerScorer = scorer
+	}
+}
+
+// reservePeer tries to book a connection slot for a found peer, it returns
+// the reservation of the slot and the peer evicted to make room for it if any
+func (t *proximityTransport) reservePeer(remotePID string) (reservation uint64, evicted string, ok bool) {
+	t.peersMutex.Lock()
+	defer t.peersMutex.Unlock()
+
+	if reservation, ok := t.peers[remotePID]; ok {
+		return reservation, "", true
+	}
+
+	if t.maxConnections <= 0 || len(t.peers) < t.maxConnections {
+		t.peersFound++
+		t.peers[remotePID] = t.peersFound
+		return t.peersFound, "", true
+	}
+
+	if t.limitPolicy != LimitPolicyEvict {
+		return 0, "", false
+	}
+
+	score := func(pid string) int {
+		if t.peerScorer == nil {
+			return 0
+		}
+		return t.peerScorer(pid)
+	}
+
+	victimScore := 0
+	for pid, found := range t.peers {
+		pidScore := score(pid)
+		if evicted == "" || pidScore < victimScore || (pidScore == victimScore && found < t.peers[evicted]) {
+			evicted, victimScore = pid, pidScore
+		}
+	}
+
+	if victimScore > score(remotePID) {
+		return 0, "", false
+	}
+
+	delete(t.peers, evicted)
+	t.peersFound++
+	t.peers[remotePID] = t.peersFound
+
+	return t.peersFound, evicted, true
+}
+
+// releasePeer frees the connection slot of a peer
+func (t *proximityTransport) releasePeer(remotePID string) {
+	t.peersMutex.Lock()
+	delete(t.peers, remotePID)
+	t.peersMutex.Unlock()
+}
+
+// releaseReservation frees the connection slot of a peer if it is still held
+// by the given reservation, it returns false if the peer has been evicted or
+// lost meanwhile, maybe found again since
+func (t *proximityTransport) releaseReservation(remotePID string, reservation uint64) bool {
+	t.peersMutex.Lock()
+	defer t.peersMutex.Unlock()
+
+	if t.peers[remotePID] != reservation {
+		return false
+	}
+
+	delete(t.peers, remotePID)
+	return true
+}
+
+// resetPeers frees all the connection slots, the native driver is restarted
+func (t *proximityTransport) resetPeers() {
+	t.peersMutex.Lock()
+	t.peers = make(map[string]uint64)
+	t.peersMutex.Unlock()
+}
+
+// evictPeer closes the connection with a peer evicted by reservePeer
+func (t *proximityTransport) evictPeer(remotePID string) {
+	t.logger.Debug("evicting peer to respect the connection limit", logutil.PrivateString("remotePID", remotePID), zap.Int("max", t.maxConnections))
+
+	t.closeDriverConn(remotePID)
+	t.HandleLostPeer(remotePID)
+}
@@ -0,0 +1,162 @@
+package proximitytransport
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/test"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testProtocolCode = 0x3f42
+	testProtocolName = "proximity-limits-test"
+)
+
+func init() {
+	if err := ma.AddProtocol(ma.Protocol{
+		Name:       testProtocolName,
+		Code:       testProtocolCode,
+		VCode:      ma.CodeToVarint(testProtocolCode),
+		Size:       -1,
+		Transcoder: ma.TranscoderUnix,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// closingDriver records the peers it is asked to disconnect from, its dials
+// block until release is closed so the connections found stay pending
+type closingDriver struct {
+	*NoopProximityDriver
+
+	closed  []string
+	mu      sync.Mutex
+	release chan struct{}
+}
+
+func (d *closingDriver) DialPeer(_ string) bool {
+	<-d.release
+	return false
+}
+
+func (d *closingDriver) CloseConnWithPeer(remotePID string) {
+	d.mu.Lock()
+	d.closed = append(d.closed, remotePID)
+	d.mu.Unlock()
+}
+
+func (d *closingDriver) closedPeers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.closed...)
+}
+
+// newLimitedTransport returns a listening transport and peers it is expected
+// to dial, the dials are pending until the end of the test
+func newLimitedTransport(t *testing.T, peersCount int, opts ...TransportOption) (*proximityTransport, *closingDriver, []string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	sw := swarmt.GenSwarm(t)
+	t.Cleanup(func() { sw.Close() })
+
+	driver := &closingDriver{
+		NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+		release:             make(chan struct{}),
+	}
+
+	transport, err := NewTransport(ctx, nil, driver, opts...)(sw, nil)
+	require.NoError(t, err)
+	require.NoError(t, sw.AddTransport(transport))
+
+	listenMa, err := ma.NewMultiaddr(driver.DefaultAddr())
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	// the failed dials release the slots and close the native connections,
+	// they must only fail once the test is done, before closing the listener
+	t.Cleanup(func() { close(driver.release) })
+
+	// the peer with the smallest id initiates the connection, use remote
+	// peers with a bigger id so they are outbound connections
+	peers := []string{}
+	for len(peers) < peersCount {
+		pid, err := test.RandPeerID()
+		require.NoError(t, err)
+
+		if pid.String() > sw.LocalPeer().String() {
+			peers = append(peers, pid.String())
+		}
+	}
+
+	return transport, driver, peers
+}
+
+func TestMaxConnectionsDecline(t *testing.T) {
+	transport, driver, peers := newLimitedTransport(t, 3, WithMaxConnections(2, LimitPolicyDecline))
+
+	require.True(t, transport.HandleFoundPeer(peers[0]))
+	require.True(t, transport.HandleFoundPeer(peers[1]))
+
+	// a peer found twice doesn't use another slot
+	require.True(t, transport.HandleFoundPeer(peers[1]))
+	require.Empty(t, driver.closedPeers())
+
+	require.False(t, transport.HandleFoundPeer(peers[2]))
+	require.Equal(t, []string{peers[2]}, driver.closedPeers())
+
+	// a slot is freed once a peer is lost
+	transport.HandleLostPeer(peers[0])
+	require.True(t, transport.HandleFoundPeer(peers[2]))
+	require.Equal(t, []string{peers[2]}, driver.closedPeers())
+}
+
+func TestMaxConnectionsEvict(t *testing.T) {
+	scores := map[string]int{}
+	var muScores sync.Mutex
+
+	scorer := func(remotePID string) int {
+		muScores.Lock()
+		defer muScores.Unlock()
+		return scores[remotePID]
+	}
+
+	transport, driver, peers := newLimitedTransport(t, 4, WithMaxConnections(2, LimitPolicyEvict), WithPeerScorer(scorer))
+
+	muScores.Lock()
+	scores[peers[0]] = 10
+	scores[peers[1]] = 1
+	scores[peers[2]] = 5
+	scores[peers[3]] = 0
+	muScores.Unlock()
+
+	require.True(t, transport.HandleFoundPeer(peers[0]))
+	require.True(t, transport.HandleFoundPeer(peers[1]))
+
+	// the lowest scored peer is evicted
+	require.True(t, transport.HandleFoundPeer(peers[2]))
+	require.Equal(t, []string{peers[1]}, driver.closedPeers())
+
+	// the new peer is declined when all the connected peers have a higher
+	// score
+	require.False(t, transport.HandleFoundPeer(peers[3]))
+	require.Equal(t, []string{peers[1], peers[3]}, driver.closedPeers())
+
+	// the oldest peer is evicted between peers with the same score
+	muScores.Lock()
+	scores[peers[0]] = 5
+	scores[peers[3]] = 5
+	muScores.Unlock()
+
+	require.True(t, transport.HandleFoundPeer(peers[3]))
+	require.Equal(t, []string{peers[1], peers[3], peers[0]}, driver.closedPeers())
+}
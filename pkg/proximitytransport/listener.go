@@ -24,6 +24,12 @@ type Listener struct {
 	inboundConnReq chan connReq // Chan used to accept inbound conn.
 	ctx            context.Context
 	cancel         func()
+
+	// session is canceled along with the connections established during
+	// the session once the native driver is restarted, see
+	// proximityTransport.Restart. It is guarded by the lock of the transport.
+	session       context.Context
+	cancelSession func()
 }
 
 // connReq holds data necessary for inbound conn creation.
@@ -32,7 +38,7 @@ type connReq struct {
 	remotePID peer.ID
 }
 
-// newListener starts the native driver then returns a new Listener.
+// newListener returns a new Listener, the caller starts the native driver.
 func newListener(ctx context.Context, localMa ma.Multiaddr, t *proximityTransport) *Listener {
 	t.logger.Debug("newListener()")
 	ctx, cancel := context.WithCancel(ctx)
@@ -44,15 +50,25 @@ func newListener(ctx context.Context, localMa ma.Multiaddr, t *proximityTranspor
 		ctx:            ctx,
 		cancel:         cancel,
 	}
-
-	// Starts the native driver.
-	// If it failed, don't return a error because no other transport
-	// on the libp2p node will be created.
-	t.driver.Start(t.swarm.LocalPeer().String())
+	listener.newSession()
 
 	return listener
 }
 
+// newSession cancels the current session, if any, and starts a new one, it
+// must be called with the lock of the transport held.
+func (l *Listener) newSession() {
+	if l.cancelSession != nil {
+		l.cancelSession()
+	}
+
+	l.session, l.cancelSession = context.WithCancel(l.ctx)
+
+	// The connection slots of the previous session are freed since the native
+	// driver is (re)started.
+	l.transport.resetPeers()
+}
+
 // Accept waits for and returns the next connection to the listener.
 // Returns a Multiaddr friendly Conn.
 func (l *Listener) Accept() (tpt.CapableConn, error) {
@@ -60,12 +76,20 @@ func (l *Listener) Accept() (tpt.CapableConn, error) {
 		select {
 		case req := <-l.inboundConnReq:
 			l.transport.logger.Debug("Listener.Accept(): incoming connection")
-			conn, err := newConn(l.ctx, l.transport, req.remoteMa, req.remotePID, network.DirInbound)
+
+			l.transport.lock.RLock()
+			session := l.session
+			l.transport.lock.RUnlock()
+
+			conn, err := newConn(session, session, l, req.remoteMa, req.remotePID, network.DirInbound)
 			// If the newConn failed for some reason, Accept won't return an error
 			// because otherwise it will close the listener
 			if err == nil {
+				l.transport.connectSucceeded(req.remotePID.String())
 				return conn, nil
 			}
+
+			l.transport.connectFailed(req.remotePID.String())
 		case <-l.ctx.Done():
 			return nil, errors.New("error: Listener.Accept failed: listener already closed")
 		}
@@ -78,18 +102,29 @@ func (l *Listener) Close() error {
 	l.transport.logger.Debug("Listener.Close()")
 	l.cancel()
 
-	// Stops the native driver.
-	l.transport.driver.Stop()
+	l.transport.driverMutex.Lock()
+	defer l.transport.driverMutex.Unlock()
 
-	// Removes listener so transport can instantiate a new one later.
 	l.transport.lock.Lock()
+
+	// The listener has already been replaced by a restart, the native driver
+	// and the transport registration now belong to the new one.
+	if l.transport.listener != l {
+		l.transport.lock.Unlock()
+		return nil
+	}
+
+	// Removes listener so transport can instantiate a new one later.
 	l.transport.listener = nil
-	l.transport.lock.Unlock()
 
 	// Unregister this transport
-	TransportMapMutex.Lock()
-	delete(TransportMap, l.transport.driver.ProtocolName())
-	TransportMapMutex.Unlock()
+	l.transport.registry.unregister(l.transport)
+
+	l.transport.lock.Unlock()
+
+	// Stops the native driver, without holding the lock as it may call the
+	// transport back while stopping.
+	l.transport.driver.Stop()
 
 	return nil
 }
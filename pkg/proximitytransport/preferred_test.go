@@ -0,0 +1,190 @@
+package proximitytransport_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/test"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+const testPreferredProtocol = "/weshnet/test/preferred/1.0.0"
+
+// newRelayedProximityHost returns a host reachable both through the proximity
+// transport of the driver and through a relay
+func newRelayedProximityHost(ctx context.Context, t *testing.T, driver *proximity.LinkedDriver) host.Host {
+	t.Helper()
+
+	swarmOpts := []swarmt.Option{
+		swarmt.OptDisableQUIC,
+		swarmt.WithSwarmOpts(swarm.WithDialRanker(ipfsutil.ProximityPreferredDialRanker(nil))),
+	}
+
+	h := newLinkedHost(t, driver, nil, swarmOpts, func(h host.Host, sw *swarm.Swarm, u tpt.Upgrader) proximity.ProximityTransport {
+		transport, err := proximity.NewTransport(ctx, nil, driver, proximity.WithPreferredOverRelay())(sw, u)
+		require.NoError(t, err)
+		require.NoError(t, sw.AddTransport(transport))
+		require.NoError(t, client.AddTransport(h, u))
+
+		return transport
+	}, ma.StringCast("/p2p-circuit"))
+
+	h.SetStreamHandler(testPreferredProtocol, func(s network.Stream) {
+		_ = s.Close()
+	})
+
+	return h
+}
+
+func TestProximityPreferredOverRelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the relay is only reachable over TCP
+	relaySwarm := swarmt.GenSwarm(t, swarmt.OptDisableQUIC)
+	defer relaySwarm.Close()
+
+	relayHost, err := bhost.NewHost(relaySwarm, &bhost.HostOpts{})
+	require.NoError(t, err)
+	defer relayHost.Close()
+	relayHost.Start()
+
+	// the relayed connections aren't limited, so the swarm doesn't rank them
+	// below the proximity connections
+	relay, err := relayv2.New(relayHost, relayv2.WithInfiniteLimits())
+	require.NoError(t, err)
+	defer relay.Close()
+
+	relayInfo := peer.AddrInfo{ID: relayHost.ID(), Addrs: relayHost.Addrs()}
+
+	driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverA, driverB)
+
+	hostA := newRelayedProximityHost(ctx, t, driverA)
+	hostB := newRelayedProximityHost(ctx, t, driverB)
+
+	require.NoError(t, hostB.Connect(ctx, relayInfo))
+	_, err = client.Reserve(ctx, hostB, relayInfo)
+	require.NoError(t, err)
+
+	relayedMa, err := ma.NewMultiaddr("/p2p/" + relayHost.ID().String() + "/p2p-circuit")
+	require.NoError(t, err)
+
+	relayedAddrs := []ma.Multiaddr{}
+	for _, addr := range relayHost.Addrs() {
+		relayedAddrs = append(relayedAddrs, addr.Encapsulate(relayedMa))
+	}
+
+	require.NoError(t, hostA.Connect(ctx, peer.AddrInfo{ID: hostB.ID(), Addrs: relayedAddrs}))
+
+	newStreamTransport := func() string {
+		s, err := hostA.NewStream(ctx, hostB.ID(), testPreferredProtocol)
+		require.NoError(t, err)
+		defer s.Reset()
+
+		require.Equal(t, protocol.ID(testPreferredProtocol), s.Protocol())
+
+		return ipfsutil.ConnTransportType(s.Conn().RemoteMultiaddr())
+	}
+
+	// the relay is used while the peer isn't reachable through proximity
+	require.Equal(t, ipfsutil.ConnTransportRelay, newStreamTransport())
+
+	// the proximity connection is established even though the peers are
+	// already connected through the relay
+	dialer, accepter := driverA, driverB
+	if driverB.LocalPID < driverA.LocalPID {
+		dialer, accepter = driverB, driverA
+	}
+	require.True(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+	require.True(t, dialer.Transport.HandleFoundPeer(accepter.LocalPID))
+
+	go driverA.Deliver(ctx)
+	go driverB.Deliver(ctx)
+
+	hasProximityConn := func() bool {
+		for _, c := range hostA.Network().ConnsToPeer(hostB.ID()) {
+			if ipfsutil.ConnTransportType(c.RemoteMultiaddr()) == ipfsutil.ConnTransportProximity {
+				return true
+			}
+		}
+		return false
+	}
+	require.Eventually(t, hasProximityConn, time.Second*10, time.Millisecond*50)
+
+	// the new streams are opened over proximity while both connections are
+	// open, by the swarm so whatever holds the host, e.g. pubsub or bitswap
+	for i := 0; i < 5; i++ {
+		require.Equal(t, ipfsutil.ConnTransportProximity, newStreamTransport())
+	}
+	require.Len(t, hostA.Network().ConnsToPeer(hostB.ID()), 2)
+
+	// the relay is used again once the proximity connection is lost
+	driverA.Transport.HandleLostPeer(driverB.LocalPID)
+	require.Eventually(t, func() bool { return !hasProximityConn() }, time.Second*10, time.Millisecond*50)
+
+	require.Equal(t, ipfsutil.ConnTransportRelay, newStreamTransport())
+}
+
+func TestProximityPreferredDialRanker(t *testing.T) {
+	pid, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	relayPID, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	proximityMa := ma.StringCast("/" + ble.ProtocolName + "/" + pid.String())
+	directMa := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	relayMa := ma.StringCast("/ip4/5.6.7.8/tcp/4001/p2p/" + relayPID.String() + "/p2p-circuit")
+
+	ranker := ipfsutil.ProximityPreferredDialRanker(nil)
+
+	delays := func(addrs ...ma.Multiaddr) map[string]time.Duration {
+		delays := map[string]time.Duration{}
+		for _, addrDelay := range ranker(addrs) {
+			delays[addrDelay.Addr.String()] = addrDelay.Delay
+		}
+
+		require.Len(t, delays, len(addrs))
+		return delays
+	}
+
+	// the proximity address is dialed first and the relay address only once
+	// the proximity dial had time to succeed
+	ranked := delays(proximityMa, directMa, relayMa)
+	require.Zero(t, ranked[proximityMa.String()])
+	require.Equal(t, swarm.DefaultDialRanker([]ma.Multiaddr{directMa})[0].Delay, ranked[directMa.String()])
+	require.GreaterOrEqual(t, ranked[relayMa.String()], ipfsutil.ProximityRelayDelay)
+
+	// the addresses are ranked by the wrapped ranker without proximity
+	// address
+	require.Equal(t, swarm.DefaultDialRanker([]ma.Multiaddr{directMa, relayMa}), ranker([]ma.Multiaddr{directMa, relayMa}))
+}
+
+func TestHasProximityListenAddrs(t *testing.T) {
+	pid, err := test.RandPeerID()
+	require.NoError(t, err)
+
+	// the proximity dial ranker is only needed with a proximity transport
+	require.False(t, ipfsutil.HasProximityListenAddrs(nil))
+	require.False(t, ipfsutil.HasProximityListenAddrs([]string{"/ip4/0.0.0.0/tcp/0", "/ip6/::/udp/0/quic-v1", "invalid"}))
+	require.True(t, ipfsutil.HasProximityListenAddrs([]string{"/ip4/0.0.0.0/tcp/0", "/" + ble.ProtocolName + "/" + pid.String()}))
+}
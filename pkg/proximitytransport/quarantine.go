@@ -0,0 +1,103 @@
+package proximitytransport
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+const (
+	// defaultQuarantineThreshold is the number of consecutive failed
+	// connections after which a peer is quarantined, see WithPeerQuarantine
+	defaultQuarantineThreshold = 5
+
+	// defaultQuarantineBackoff is the duration during which a quarantined
+	// peer is declined, see WithPeerQuarantine
+	defaultQuarantineBackoff = time.Minute
+)
+
+// peerFailures holds the consecutive failed connections with a peer
+type peerFailures struct {
+	count            int
+	quarantinedUntil time.Time
+}
+
+// WithPeerQuarantine quarantines the peers failing to connect, e.g. because
+// they keep failing the libp2p handshake. Once threshold connections with a
+// peer have failed in a row, HandleFoundPeer declines it during the backoff
+// window without attempting a connection. A successful connection resets the
+// failures of the peer. The default values are used if a value is not
+// positive. The peers are never quarantined without this option.
+func WithPeerQuarantine(threshold int, backoff time.Duration) TransportOption {
+	return func(t *proximityTransport) {
+		t.quarantineThreshold = defaultQuarantineThreshold
+		if threshold > 0 {
+			t.quarantineThreshold = threshold
+		}
+
+		t.quarantineBackoff = defaultQuarantineBackoff
+		if backoff > 0 {
+			t.quarantineBackoff = backoff
+		}
+	}
+}
+
+func (t *proximityTransport) quarantineEnabled() bool {
+	return t.quarantineThreshold > 0
+}
+
+// isQuarantined returns true if the peer must be declined
+func (t *proximityTransport) isQuarantined(remotePID string) bool {
+	t.failuresMutex.Lock()
+	defer t.failuresMutex.Unlock()
+
+	failures, ok := t.failures[remotePID]
+	if !ok || failures.quarantinedUntil.IsZero() {
+		return false
+	}
+
+	if time.Now().Before(failures.quarantinedUntil) {
+		return true
+	}
+
+	// the backoff window is over, the peer gets another threshold attempts
+	delete(t.failures, remotePID)
+	return false
+}
+
+// connectFailed records a failed connection with a peer, it is quarantined
+// once the threshold is reached
+func (t *proximityTransport) connectFailed(remotePID string) {
+	if !t.quarantineEnabled() {
+		return
+	}
+
+	t.failuresMutex.Lock()
+	defer t.failuresMutex.Unlock()
+
+	failures, ok := t.failures[remotePID]
+	if !ok {
+		failures = &peerFailures{}
+		t.failures[remotePID] = failures
+	}
+
+	failures.count++
+	if failures.count < t.quarantineThreshold {
+		return
+	}
+
+	failures.quarantinedUntil = time.Now().Add(t.quarantineBackoff)
+	t.logger.Warn("peer keeps failing to connect, quarantining it",
+		logutil.PrivateString("remotePID", remotePID),
+		zap.Int("failures", failures.count),
+		zap.Duration("backoff", t.quarantineBackoff))
+}
+
+// connectSucceeded resets the failed connections with a peer
+func (t *proximityTransport) connectSucceeded(remotePID string) {
+	t.failuresMutex.Lock()
+	delete(t.failures, remotePID)
+	t.failuresMutex.Unlock()
+}
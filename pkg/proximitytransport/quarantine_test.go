@@ -0,0 +1,121 @@
+package proximitytransport
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+// failingDriver is a native driver whose peers are always reachable but never
+// answer the libp2p handshake, the connections with them fail once the
+// keepalive times out
+type failingDriver struct {
+	*NoopProximityDriver
+
+	dials int
+	mu    sync.Mutex
+}
+
+func (d *failingDriver) DialPeer(_ string) bool {
+	d.mu.Lock()
+	d.dials++
+	d.mu.Unlock()
+	return true
+}
+
+func (d *failingDriver) dialCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func (d *failingDriver) SendToPeer(_ string, _ []byte) bool { return true }
+
+func (t *proximityTransport) connectFailures(remotePID string) int {
+	t.failuresMutex.Lock()
+	defer t.failuresMutex.Unlock()
+
+	if failures, ok := t.failures[remotePID]; ok {
+		return failures.count
+	}
+	return 0
+}
+
+func TestPeerQuarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t, swarmt.OptDialOnly)
+	defer sw.Close()
+
+	const (
+		threshold = 3
+		backoff   = 500 * time.Millisecond
+	)
+
+	driver := &failingDriver{
+		NoopProximityDriver: NewNoopProximityDriver(testProtocolCode, testProtocolName, "/"+testProtocolName+"/Qm"),
+	}
+
+	transport, err := NewTransport(ctx, nil, driver,
+		WithPeerQuarantine(threshold, backoff),
+		WithKeepAlive(20*time.Millisecond, 100*time.Millisecond),
+	)(sw, swarmt.GenUpgrader(t, sw, nil))
+	require.NoError(t, err)
+	require.NoError(t, sw.AddTransport(transport))
+
+	listenMa, err := ma.NewMultiaddr(driver.DefaultAddr())
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// the peer with the smallest id initiates the connection, use a remote
+	// peer with a bigger id so the connections are outbound
+	var remotePID string
+	for remotePID == "" {
+		_, pub, err := crypto.GenerateEd25519Key(nil)
+		require.NoError(t, err)
+
+		pid, err := peer.IDFromPublicKey(pub)
+		require.NoError(t, err)
+
+		if pid.String() > sw.LocalPeer().String() {
+			remotePID = pid.String()
+		}
+	}
+
+	for i := 1; i <= threshold; i++ {
+		require.True(t, transport.HandleFoundPeer(remotePID), "attempt %d", i)
+		require.Eventually(t, func() bool {
+			return transport.connectFailures(remotePID) == i
+		}, 5*time.Second, 10*time.Millisecond, "attempt %d", i)
+	}
+	require.Greater(t, driver.dialCount(), 0)
+
+	// the peer is declined without attempting a connection
+	dials := driver.dialCount()
+	require.False(t, transport.HandleFoundPeer(remotePID))
+	require.False(t, transport.HandleFoundPeer(remotePID))
+	require.Equal(t, dials, driver.dialCount())
+	require.Equal(t, threshold, transport.connectFailures(remotePID))
+
+	// the peer is found again once the backoff window is over
+	time.Sleep(backoff)
+	require.True(t, transport.HandleFoundPeer(remotePID))
+	require.Eventually(t, func() bool {
+		return transport.connectFailures(remotePID) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a successful connection resets the failures
+	transport.connectSucceeded(remotePID)
+	require.Equal(t, 0, transport.connectFailures(remotePID))
+}
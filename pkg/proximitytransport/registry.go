@@ -0,0 +1,78 @@
+package proximitytransport
+
+import (
+	"sync"
+)
+
+// TransportRegistry holds the listening transport of each driver protocol,
+// the native drivers use it to find the transport to call back. A nil
+// registry is the package global TransportMap.
+type TransportRegistry struct {
+	transports map[string]*proximityTransport
+	mu         sync.RWMutex
+}
+
+// NewTransportRegistry returns a registry isolated from the package global
+// TransportMap, see WithTransportRegistry
+func NewTransportRegistry() *TransportRegistry {
+	return &TransportRegistry{
+		transports: make(map[string]*proximityTransport),
+	}
+}
+
+// WithTransportRegistry registers the listening transport in the given
+// registry instead of the package global TransportMap, so independent
+// transport stacks can listen for the same driver protocol in one process.
+// The native driver must then look the transport up in that registry.
+func WithTransportRegistry(registry *TransportRegistry) TransportOption {
+	return func(t *proximityTransport) {
+		t.registry = registry
+	}
+}
+
+// Transport returns the transport listening for the given driver protocol
+func (r *TransportRegistry) Transport(protocolName string) (ProximityTransport, bool) {
+	transports, mu := r.maps()
+
+	mu.RLock()
+	t, ok := transports[protocolName]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	return t, true
+}
+
+func (r *TransportRegistry) maps() (map[string]*proximityTransport, *sync.RWMutex) {
+	if r == nil {
+		return TransportMap, &TransportMapMutex
+	}
+
+	return r.transports, &r.mu
+}
+
+// register registers t for its driver protocol, it returns false if another
+// transport is already registered
+func (r *TransportRegistry) register(t *proximityTransport) bool {
+	transports, mu := r.maps()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if other, ok := transports[t.driver.ProtocolName()]; ok && other != t {
+		return false
+	}
+
+	transports[t.driver.ProtocolName()] = t
+	return true
+}
+
+func (r *TransportRegistry) unregister(t *proximityTransport) {
+	transports, mu := r.maps()
+
+	mu.Lock()
+	delete(transports, t.driver.ProtocolName())
+	mu.Unlock()
+}
@@ -17,11 +17,28 @@ type RingBufferMap struct {
 	cache      map[string]*ringBuffer
 	bufferSize int
 	logger     *zap.Logger
+
+	// budget is shared with the other caches of the transport, nil if there
+	// is no budget, see WithCacheBudget
+	budget *cacheBudget
+
+	// onEvict is called with the size of each payload evicted before being
+	// flushed, it must not block, see WithCacheEvictionHandler
+	onEvict func(peerID string, size int)
 }
 
 type ringBuffer struct {
 	sync.Mutex
 	buffer *ring.Ring
+
+	// peerID and onEvict are those of the map holding the buffer, the
+	// budget evicts payloads without going through the map
+	peerID  string
+	onEvict func(peerID string, size int)
+
+	// entries and bytes are the number and the size of the cached payloads
+	entries int
+	bytes   int
 }
 
 // NewRingBufferMap returns a new connMgr struct
@@ -46,18 +63,40 @@ func (rbm *RingBufferMap) Add(peerID string, payload []byte) {
 	rbm.Unlock()
 	if !ok {
 		rBuffer = &ringBuffer{
-			buffer: ring.New(rbm.bufferSize),
+			buffer:  ring.New(rbm.bufferSize),
+			peerID:  peerID,
+			onEvict: rbm.onEvict,
 		}
 	}
 
+	evictedSize := -1
+
 	rBuffer.Lock()
+	if evicted, ok := rBuffer.buffer.Value.([]byte); ok {
+		rBuffer.entries--
+		rBuffer.bytes -= len(evicted)
+		evictedSize = len(evicted)
+	}
 	rBuffer.buffer.Value = payload
 	rBuffer.buffer = rBuffer.buffer.Next()
+	rBuffer.entries++
+	rBuffer.bytes += len(payload)
+	if rbm.budget != nil {
+		rbm.budget.update(rBuffer, true)
+	}
 	rBuffer.Unlock()
 
 	rbm.Lock()
 	rbm.cache[peerID] = rBuffer
 	rbm.Unlock()
+
+	if evictedSize >= 0 && rbm.onEvict != nil {
+		rbm.onEvict(peerID, evictedSize)
+	}
+
+	if rbm.budget != nil {
+		rbm.budget.enforce()
+	}
 }
 
 // Flush puts the cache contents into a chan and clears it
@@ -72,22 +111,29 @@ func (rbm *RingBufferMap) Flush(peerID string) <-chan []byte {
 		rbm.Unlock()
 
 		if ok {
+			// the payloads are taken out before being sent so the
+			// budget can't wait for the reader of the chan
 			rBuffer.Lock()
+			payloads := make([][]byte, 0, rBuffer.entries)
 			for i := 0; i < rbm.bufferSize; i++ {
-				payload, ok := rBuffer.buffer.Value.([]byte)
-				if !ok {
-					rBuffer.buffer = rBuffer.buffer.Next()
-					continue
+				if payload, ok := rBuffer.buffer.Value.([]byte); ok {
+					payloads = append(payloads, payload)
 				}
 
-				rbm.logger.Debug("flushCache", logutil.PrivateBinary("payload", payload))
-				c <- payload
-
 				rBuffer.buffer.Value = nil
 				rBuffer.buffer = rBuffer.buffer.Next()
 			}
+			rBuffer.entries, rBuffer.bytes = 0, 0
+			if rbm.budget != nil {
+				rbm.budget.update(rBuffer, false)
+			}
 			rBuffer.Unlock()
 
+			for _, payload := range payloads {
+				rbm.logger.Debug("flushCache", logutil.PrivateBinary("payload", payload))
+				c <- payload
+			}
+
 			rbm.Lock()
 			delete(rbm.cache, peerID)
 			rbm.Unlock()
@@ -104,11 +150,66 @@ func (rbm *RingBufferMap) Delete(peerID string) {
 	rbm.logger.Debug("RingBufferMap: Delete called", logutil.PrivateString("peerID", peerID))
 
 	rbm.Lock()
-	_, ok := rbm.cache[peerID]
+	rBuffer, ok := rbm.cache[peerID]
 	if ok {
 		rbm.logger.Debug("RingBufferMap: Delete: cache found", logutil.PrivateString("peerID", peerID))
 
 		delete(rbm.cache, peerID)
 	}
 	rbm.Unlock()
+
+	// the dropped payloads no longer count in the budget
+	if ok && rbm.budget != nil {
+		rBuffer.Lock()
+		for i := 0; i < rbm.bufferSize; i++ {
+			rBuffer.buffer.Value = nil
+			rBuffer.buffer = rBuffer.buffer.Next()
+		}
+		rBuffer.entries, rBuffer.bytes = 0, 0
+		rbm.budget.update(rBuffer, false)
+		rBuffer.Unlock()
+	}
+}
+
+// Stat returns the number and the size of the payloads cached for the peer
+func (rbm *RingBufferMap) Stat(peerID string) (entries int, bytes int) {
+	rbm.Lock()
+	rBuffer, ok := rbm.cache[peerID]
+	rbm.Unlock()
+
+	if !ok {
+		return 0, 0
+	}
+
+	rBuffer.Lock()
+	defer rBuffer.Unlock()
+
+	return rBuffer.entries, rBuffer.bytes
+}
+
+// evictOldest removes the oldest cached payload, rb must be locked
+func (rb *ringBuffer) evictOldest() ([]byte, bool) {
+	if rb.entries == 0 {
+		return nil, false
+	}
+
+	// the payloads are ordered from the oldest one, starting at the next
+	// slot to write
+	r := rb.buffer
+	for i := 0; i < rb.buffer.Len(); i++ {
+		if payload, ok := r.Value.([]byte); ok {
+			r.Value = nil
+			rb.entries--
+			rb.bytes -= len(payload)
+			return payload, true
+		}
+		r = r.Next()
+	}
+
+	return nil, false
+}
+
+// Size returns the maximum number of payloads cached for each peer
+func (rbm *RingBufferMap) Size() int {
+	return rbm.bufferSize
 }
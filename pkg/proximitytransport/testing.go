@@ -0,0 +1,73 @@
+package proximitytransport
+
+import "context"
+
+// LinkedDriver is a native driver for the tests delivering the payloads, in
+// order, to the transport of the driver it is linked to, see LinkDrivers. The
+// payloads are only delivered while Deliver runs.
+type LinkedDriver struct {
+	*NoopProximityDriver
+
+	// LocalPID is the peer ID of the host of the driver and Transport is the
+	// proximity transport using it, they must be set once the transport is
+	// built
+	LocalPID  string
+	Transport ProximityTransport
+
+	// Drop simulates a lossy link, the payloads for which it returns true are
+	// never delivered
+	Drop func(payload []byte) bool
+
+	// Closing is notified when the driver is asked to close the connection,
+	// which then blocks until Release is closed
+	Closing chan string
+	Release chan struct{}
+
+	remote *LinkedDriver
+	queue  chan []byte
+}
+
+func NewLinkedDriver(protocolCode int, protocolName, defaultAddr string) *LinkedDriver {
+	return &LinkedDriver{
+		NoopProximityDriver: NewNoopProximityDriver(protocolCode, protocolName, defaultAddr),
+		queue:               make(chan []byte, 1024),
+	}
+}
+
+// LinkDrivers links two drivers, the payloads sent by one of them are
+// delivered to the other one
+func LinkDrivers(a, b *LinkedDriver) {
+	a.remote, b.remote = b, a
+}
+
+func (d *LinkedDriver) DialPeer(_ string) bool { return true }
+
+func (d *LinkedDriver) SendToPeer(_ string, payload []byte) bool {
+	if d.Drop != nil && d.Drop(payload) {
+		return true
+	}
+
+	d.queue <- append([]byte{}, payload...)
+	return true
+}
+
+func (d *LinkedDriver) CloseConnWithPeer(remotePID string) {
+	if d.Closing == nil {
+		return
+	}
+
+	d.Closing <- remotePID
+	<-d.Release
+}
+
+// Deliver delivers the payloads sent by the driver until ctx is done
+func (d *LinkedDriver) Deliver(ctx context.Context) {
+	for {
+		select {
+		case payload := <-d.queue:
+			d.remote.Transport.ReceiveFromPeer(d.LocalPID, payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package proximitytransport
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/internal/capabilities"
+)
+
+// FrameTransform encodes the payloads written by libp2p into the frames sent
+// through the native driver and decodes them on the other end, e.g. to add
+// forward error correction on lossy links. A transform is created for each
+// peer, Encode and Decode may run concurrently but are never called
+// concurrently with themselves.
+type FrameTransform interface {
+	// Encode returns the frames to send to the peer for a payload
+	Encode(payload []byte) [][]byte
+
+	// Decode returns the payloads carried by a frame received from the peer,
+	// in the order they were written. It may return none, e.g. until the
+	// frames needed to recover a lost one are received.
+	Decode(frame []byte) [][]byte
+}
+
+// CapabilityNegotiator tells whether a peer supports a feature, it is
+// implemented by capabilities.Manager once the peers have exchanged their
+// capabilities
+type CapabilityNegotiator interface {
+	Supports(p peer.ID, feature string) bool
+}
+
+// FrameTransformFeature returns the capability a peer advertises to receive
+// the frames transformed by the transform registered under name, see
+// WithFrameTransform
+func FrameTransformFeature(name string) string {
+	return "proximity_frame_transform/" + name
+}
+
+// frameTransformMarker prefixes the frame announcing that the frames sent
+// from then on are transformed, it can't be mistaken for a libp2p payload
+// as those never start with 0xff
+const frameTransformMarker = "\xffframe_transform:"
+
+// WithFrameTransform transforms the frames exchanged with each peer with a
+// transform returned by newTransform, registered under name. The frames are
+// only transformed once the capability negotiator reports the peer supports
+// FrameTransformFeature(name), they are sent as is otherwise, see
+// SetCapabilityNegotiator.
+func WithFrameTransform(name string, newTransform func() FrameTransform) TransportOption {
+	return func(t *proximityTransport) {
+		t.frameTransformName = name
+		t.newFrameTransform = newTransform
+	}
+}
+
+// Features returns the capabilities the transport advertises to the peers,
+// the feature of its frame transform and the keepalive if they are enabled
+func (t *proximityTransport) Features() []string {
+	features := []string{}
+	if t.newFrameTransform != nil {
+		features = append(features, FrameTransformFeature(t.frameTransformName))
+	}
+
+	if t.keepAliveEnabled() {
+		features = append(features, KeepAliveFeature)
+	}
+
+	return features
+}
+
+// HostTransports returns the proximity transports the host listens on
+func HostTransports(h host.Host) []ProximityTransport {
+	sw, ok := h.Network().(*swarm.Swarm)
+	if !ok {
+		return nil
+	}
+
+	transports := []ProximityTransport{}
+	seen := make(map[ProximityTransport]struct{})
+	for _, addr := range sw.ListenAddresses() {
+		t, ok := sw.TransportForListening(addr).(ProximityTransport)
+		if !ok {
+			continue
+		}
+
+		if _, ok := seen[t]; ok {
+			continue
+		}
+
+		seen[t] = struct{}{}
+		transports = append(transports, t)
+	}
+
+	return transports
+}
+
+// NewCapabilitiesManager returns a capabilities manager advertising the
+// given features and the features of the proximity transports of the host,
+// the transports then only use their features with the peers supporting them
+func NewCapabilitiesManager(logger *zap.Logger, h host.Host, features ...*capabilities.Feature) (*capabilities.Manager, error) {
+	transports := HostTransports(h)
+
+	local := capabilities.Minimal()
+	local.Features = append(local.Features, features...)
+	for _, t := range transports {
+		for _, name := range t.Features() {
+			if _, ok := local.FeatureVersion(name); !ok {
+				local.Features = append(local.Features, &capabilities.Feature{Name: name, Version: 1})
+			}
+		}
+	}
+
+	m, err := capabilities.NewManager(logger, h, local)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range transports {
+		t.SetCapabilityNegotiator(m)
+	}
+
+	return m, nil
+}
+
+// SetCapabilityNegotiator sets the negotiator telling which peers support
+// the frame transform and the keepalive, the frames are sent as is to every
+// peer without it
+func (t *proximityTransport) SetCapabilityNegotiator(n CapabilityNegotiator) {
+	t.codecsMutex.Lock()
+	t.negotiator = n
+	t.codecsMutex.Unlock()
+}
+
+// peerSupportsFrameTransform returns true if the peer advertised the
+// feature of the frame transform
+func (t *proximityTransport) peerSupportsFrameTransform(remotePID string) bool {
+	return t.peerSupports(remotePID, FrameTransformFeature(t.frameTransformName))
+}
+
+// peerSupports returns true if the capability negotiator reports the peer
+// as supporting the feature
+func (t *proximityTransport) peerSupports(remotePID string, feature string) bool {
+	t.codecsMutex.Lock()
+	n := t.negotiator
+	t.codecsMutex.Unlock()
+
+	if n == nil {
+		return false
+	}
+
+	pid, err := peer.Decode(remotePID)
+	if err != nil {
+		return false
+	}
+
+	return n.Supports(pid, feature)
+}
+
+// frameCodec is the transform of a peer, its mutexes serialize the calls to
+// Encode and Decode with the sending and delivery of their output, so the
+// payloads keep their order. Each direction switches to the transform on its
+// own, once the marker is sent or received.
+type frameCodec struct {
+	transform FrameTransform
+	marker    []byte
+
+	encodeMutex sync.Mutex
+	encoding    bool
+	decodeMutex sync.Mutex
+	decoding    bool
+}
+
+// encode returns the frames to send for a payload, the marker is sent ahead
+// of the first transformed frame. It must be called with encodeMutex held.
+func (c *frameCodec) encode(t *proximityTransport, remotePID string, payload []byte) [][]byte {
+	if c.encoding {
+		return c.transform.Encode(payload)
+	}
+
+	if !t.peerSupportsFrameTransform(remotePID) {
+		return [][]byte{payload}
+	}
+
+	c.encoding = true
+	return append([][]byte{c.marker}, c.transform.Encode(payload)...)
+}
+
+// decode returns the payloads carried by a frame, the frames are delivered
+// as is until the marker is received. It must be called with decodeMutex
+// held.
+func (c *frameCodec) decode(frame []byte) [][]byte {
+	if c.decoding {
+		return c.transform.Decode(frame)
+	}
+
+	if bytes.Equal(frame, c.marker) {
+		c.decoding = true
+		return nil
+	}
+
+	return [][]byte{frame}
+}
+
+// frameCodec returns the codec of a peer, creating it if needed, it is nil
+// if the frames aren't transformed
+func (t *proximityTransport) frameCodec(remotePID string) *frameCodec {
+	if t.newFrameTransform == nil {
+		return nil
+	}
+
+	t.codecsMutex.Lock()
+	defer t.codecsMutex.Unlock()
+
+	codec, ok := t.codecs[remotePID]
+	if !ok {
+		codec = &frameCodec{
+			transform: t.newFrameTransform(),
+			marker:    []byte(frameTransformMarker + t.frameTransformName),
+		}
+		t.codecs[remotePID] = codec
+	}
+
+	return codec
+}
+
+// removeFrameCodec drops the state of the transform of a peer once its
+// connection is closed
+func (t *proximityTransport) removeFrameCodec(remotePID string) {
+	t.codecsMutex.Lock()
+	delete(t.codecs, remotePID)
+	t.codecsMutex.Unlock()
+}
@@ -0,0 +1,334 @@
+package proximitytransport_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/internal/capabilities"
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+const (
+	xorFrameData byte = iota
+	xorFrameParity
+)
+
+// xorParityTransform sends each payload along with its XOR parity with the
+// previous payload, a lost payload is recovered from its parity and the
+// previous payload. The frames start with their kind and sequence number.
+type xorParityTransform struct {
+	sent     uint32
+	lastSent []byte
+
+	next         uint32
+	lastReceived []byte
+}
+
+func newXORParityTransform() proximity.FrameTransform {
+	return &xorParityTransform{}
+}
+
+func (t *xorParityTransform) Encode(payload []byte) [][]byte {
+	seq := t.sent
+	t.sent++
+
+	parity := xorBytes(lengthPrefixed(t.lastSent), lengthPrefixed(payload))
+	t.lastSent = append([]byte{}, payload...)
+
+	return [][]byte{
+		xorFrame(xorFrameData, seq, payload),
+		xorFrame(xorFrameParity, seq, parity),
+	}
+}
+
+func (t *xorParityTransform) Decode(frame []byte) [][]byte {
+	if len(frame) < 5 {
+		return nil
+	}
+
+	// the payload has already been delivered, or can't be recovered
+	if seq := binary.BigEndian.Uint32(frame[1:5]); seq != t.next {
+		return nil
+	}
+
+	var payload []byte
+	switch frame[0] {
+	case xorFrameData:
+		payload = append([]byte{}, frame[5:]...)
+	case xorFrameParity:
+		recovered := xorBytes(frame[5:], lengthPrefixed(t.lastReceived))
+		size := binary.BigEndian.Uint32(recovered[:4])
+		if int(size) > len(recovered)-4 {
+			return nil
+		}
+		payload = recovered[4 : 4+size]
+	default:
+		return nil
+	}
+
+	t.next++
+	t.lastReceived = payload
+
+	return [][]byte{payload}
+}
+
+func xorFrame(kind byte, seq uint32, body []byte) []byte {
+	frame := make([]byte, 5, 5+len(body))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], seq)
+	return append(frame, body...)
+}
+
+func lengthPrefixed(payload []byte) []byte {
+	prefixed := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(prefixed, uint32(len(payload)))
+	return append(prefixed, payload...)
+}
+
+// xorBytes xors a and b, the shortest one is padded with zeros
+func xorBytes(a, b []byte) []byte {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+
+	out := append([]byte{}, a...)
+	for i := range b {
+		out[i] ^= b[i]
+	}
+	return out
+}
+
+// dropDataFrame returns a drop func of proximity.LinkedDriver losing the nth data frame
+// sent, dropped is closed once it has been lost
+func dropDataFrame(nth int, dropped chan struct{}) func(payload []byte) bool {
+	var (
+		count int
+		mu    sync.Mutex
+	)
+
+	return func(payload []byte) bool {
+		if len(payload) == 0 || payload[0] != xorFrameData {
+			return false
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		count++
+		if count != nth {
+			return false
+		}
+
+		close(dropped)
+		return true
+	}
+}
+
+// countingTransform counts the payloads encoded and decoded by a transform
+type countingTransform struct {
+	proximity.FrameTransform
+
+	encoded, decoded *atomic.Int32
+}
+
+func (t *countingTransform) Encode(payload []byte) [][]byte {
+	t.encoded.Add(1)
+	return t.FrameTransform.Encode(payload)
+}
+
+func (t *countingTransform) Decode(frame []byte) [][]byte {
+	t.decoded.Add(1)
+	return t.FrameTransform.Decode(frame)
+}
+
+// supportedBy is a capability negotiator reporting every peer as supporting
+// the given features
+type supportedBy []string
+
+func (s supportedBy) Supports(_ peer.ID, feature string) bool {
+	for _, f := range s {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+const xorParityTransformName = "xor-parity"
+
+// linkHosts connects the hosts of the drivers through the proximity transport
+func linkHosts(ctx context.Context, t *testing.T, driverA, driverB *proximity.LinkedDriver, hostA, hostB host.Host) {
+	t.Helper()
+
+	dialer, accepter := driverA, driverB
+	if driverB.LocalPID < driverA.LocalPID {
+		dialer, accepter = driverB, driverA
+	}
+	require.True(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+	require.True(t, dialer.Transport.HandleFoundPeer(accepter.LocalPID))
+
+	go driverA.Deliver(ctx)
+	go driverB.Deliver(ctx)
+
+	require.Eventually(t, func() bool {
+		return len(hostA.Network().ConnsToPeer(hostB.ID())) > 0
+	}, time.Second*10, time.Millisecond*50)
+}
+
+// requireEcho sends a message to the echo handler of to and checks it is
+// sent back
+func requireEcho(ctx context.Context, t *testing.T, from, to host.Host, message []byte) {
+	t.Helper()
+
+	sctx, scancel := context.WithTimeout(ctx, time.Second*10)
+	defer scancel()
+
+	s, err := from.NewStream(sctx, to.ID(), echoProtocol)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Write(message)
+	require.NoError(t, err)
+	require.NoError(t, s.CloseWrite())
+
+	echo, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, message, echo)
+}
+
+const echoProtocol = "/test/echo/1.0.0"
+
+func handleEcho(h host.Host) {
+	h.SetStreamHandler(echoProtocol, func(s network.Stream) {
+		defer s.Close()
+		_, _ = io.Copy(s, s)
+	})
+}
+
+func TestFrameTransformRecoversLostFrame(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverA, driverB)
+
+	// both ends lose a data frame during the libp2p handshake
+	droppedA, droppedB := make(chan struct{}), make(chan struct{})
+	driverA.Drop = dropDataFrame(2, droppedA)
+	driverB.Drop = dropDataFrame(2, droppedB)
+
+	hostA := newProximityHost(ctx, t, driverA, proximity.WithFrameTransform(xorParityTransformName, newXORParityTransform))
+	hostB := newProximityHost(ctx, t, driverB, proximity.WithFrameTransform(xorParityTransformName, newXORParityTransform))
+	handleEcho(hostB)
+
+	// the peers are known to support the transform before connecting, the
+	// frames of the handshake are transformed
+	supported := supportedBy{proximity.FrameTransformFeature(xorParityTransformName)}
+	driverA.Transport.SetCapabilityNegotiator(supported)
+	driverB.Transport.SetCapabilityNegotiator(supported)
+
+	linkHosts(ctx, t, driverA, driverB, hostA, hostB)
+
+	for _, dropped := range []chan struct{}{droppedA, droppedB} {
+		select {
+		case <-dropped:
+		default:
+			require.FailNow(t, "no frame has been lost")
+		}
+	}
+
+	// the data still flows once the lost frames have been recovered
+	requireEcho(ctx, t, hostA, hostB, []byte("recovered through the parity frames"))
+}
+
+func TestFrameTransformNegotiation(t *testing.T) {
+	feature := proximity.FrameTransformFeature(xorParityTransformName)
+
+	cases := []struct {
+		name string
+		// transformA and transformB tell whether each end has the transform
+		// and advertises its feature
+		transformA, transformB bool
+		transformed            bool
+	}{
+		{name: "both peers", transformA: true, transformB: true, transformed: true},
+		{name: "dialer only", transformA: true, transformB: false},
+		{name: "listener only", transformA: false, transformB: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+			driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+			proximity.LinkDrivers(driverA, driverB)
+
+			var encoded, decoded atomic.Int32
+			newHost := func(driver *proximity.LinkedDriver, enabled bool) host.Host {
+				if !enabled {
+					return newProximityHost(ctx, t, driver)
+				}
+
+				return newProximityHost(ctx, t, driver, proximity.WithFrameTransform(xorParityTransformName, func() proximity.FrameTransform {
+					return &countingTransform{FrameTransform: newXORParityTransform(), encoded: &encoded, decoded: &decoded}
+				}))
+			}
+
+			hostA := newHost(driverA, tc.transformA)
+			hostB := newHost(driverB, tc.transformB)
+			handleEcho(hostA)
+			handleEcho(hostB)
+
+			linkHosts(ctx, t, driverA, driverB, hostA, hostB)
+
+			// the capabilities are exchanged over the proximity link once
+			// connected, the frames are sent as is until then. The managers
+			// advertise the features of the host transports.
+			newManager := func(h host.Host, enabled bool) *capabilities.Manager {
+				manager, err := proximity.NewCapabilitiesManager(zap.NewNop(), h)
+				require.NoError(t, err)
+				t.Cleanup(func() { manager.Close() })
+
+				_, ok := manager.Local().FeatureVersion(feature)
+				require.Equal(t, enabled, ok)
+				return manager
+			}
+			managerA := newManager(hostA, tc.transformA)
+			managerB := newManager(hostB, tc.transformB)
+
+			require.Eventually(t, func() bool {
+				_, okA := managerA.Remote(hostB.ID())
+				_, okB := managerB.Remote(hostA.ID())
+				return okA && okB
+			}, time.Second*10, time.Millisecond*50)
+
+			// both directions work whether the frames are transformed or not
+			requireEcho(ctx, t, hostA, hostB, []byte("from the dialer"))
+			requireEcho(ctx, t, hostB, hostA, []byte("from the listener"))
+
+			if tc.transformed {
+				require.NotZero(t, encoded.Load())
+				require.NotZero(t, decoded.Load())
+			} else {
+				require.Zero(t, encoded.Load())
+				require.Zero(t, decoded.Load())
+			}
+		})
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/metrics"
 	network "github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	pstore "github.com/libp2p/go-libp2p/core/peerstore"
@@ -27,12 +29,17 @@ var _ tpt.Transport = &proximityTransport{}
 // proximityTransport is a ProximityTransport.
 var _ ProximityTransport = &proximityTransport{}
 
-// TransportMap prevents instantiating multiple Transport
+// TransportMap prevents instantiating multiple Transport, it is the default
+// registry of the listening transports, see WithTransportRegistry
 var TransportMap = make(map[string]*proximityTransport)
 
 // TransportMapMutex is the mutex for the TransportMap var
 var TransportMapMutex sync.RWMutex
 
+// defaultDriverCloseTimeout is the time given to the native driver to close
+// its connection with a peer before giving up on waiting for it
+const defaultDriverCloseTimeout = 10 * time.Second
+
 // Define log level for driver loggers
 const (
 	Verbose = iota
@@ -47,6 +54,14 @@ type ProximityTransport interface {
 	HandleLostPeer(remotePID string)
 	ReceiveFromPeer(remotePID string, payload []byte)
 	Log(level int, message string)
+	SetDialEnabled(enabled bool)
+	SetDriverMode(mode DriverMode)
+	SetPeerCaching(remotePID string, enabled bool)
+	Health() TransportHealth
+	CacheStat() CacheStat
+	Features() []string
+	SetCapabilityNegotiator(n CapabilityNegotiator)
+	SetBandwidthReporter(reporter metrics.Reporter)
 }
 
 type proximityTransport struct {
@@ -57,13 +72,134 @@ type proximityTransport struct {
 	connMapMutex sync.RWMutex
 	cache        *RingBufferMap
 	lock         sync.RWMutex
+	// driverMutex serializes the starts and stops of the native driver, they
+	// are made without holding lock as the driver may call back the transport
+	driverMutex  sync.Mutex
 	listener     *Listener
-	driver       ProximityDriver
-	logger       *zap.Logger
-	ctx          context.Context
+	localMa      ma.Multiaddr
+	dialDisabled bool
+	// driverMode is the mode reported by the native driver, see
+	// SetDriverMode
+	driverMode DriverMode
+	// cacheDisabled drops the payloads received before their connection is
+	// ready instead of buffering them
+	cacheDisabled bool
+	driver        ProximityDriver
+	logger        *zap.Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+
+	// keepAliveInterval and keepAliveTimeout configure the heartbeats sent
+	// on each connection, see WithKeepAlive
+	keepAliveInterval time.Duration
+	keepAliveTimeout  time.Duration
+
+	// driverCloseTimeout bounds the wait for the native driver to close its
+	// connection with a peer, see WithDriverCloseTimeout
+	driverCloseTimeout time.Duration
+
+	// peers are the found peers holding a connection slot along with the
+	// order in which they have been found, see WithMaxConnections
+	peers          map[string]uint64
+	peersFound     uint64
+	peersMutex     sync.Mutex
+	maxConnections int
+	limitPolicy    LimitPolicy
+	peerScorer     PeerScorer
+
+	// bandwidthReporter counts the bytes exchanged with the native driver,
+	// see WithBandwidthReporter and SetBandwidthReporter
+	bandwidthReporter metrics.Reporter
+	bandwidthMutex    sync.RWMutex
+
+	// driverPanicHandler is called when the native driver panics, see
+	// WithDriverPanicHandler
+	driverPanicHandler DriverPanicHandler
+
+	// dedup drops the duplicated payloads delivered by the native driver, see
+	// WithPayloadDedup
+	dedup *payloadDedup
+
+	// registry holds the transport while it is listening, the package global
+	// TransportMap if nil, see WithTransportRegistry
+	registry *TransportRegistry
+
+	// cacheDisabledPeers are the peers whose payloads are dropped instead of
+	// being cached, see SetPeerCaching
+	cacheDisabledPeers map[string]struct{}
+
+	// preferredOverRelay connects to the found peers even if they are already
+	// reachable through a relay, see WithPreferredOverRelay
+	preferredOverRelay bool
+
+	// connCacheEntries and connCacheMaxBytes bound the cache of each conn,
+	// see WithConnCacheLimits
+	connCacheEntries  int
+	connCacheMaxBytes int
+
+	// cacheBudget bounds the size of all the caches combined, see
+	// WithCacheBudget
+	cacheBudget *cacheBudget
+
+	// cacheEvictionHandler is called off the receive path with the payloads
+	// evicted from the caches, queued in cacheEvictions, see
+	// WithCacheEvictionHandler
+	cacheEvictionHandler CacheEvictionHandler
+	cacheEvictions       chan cacheEviction
+
+	// failures are the consecutive failed connections of each peer, they
+	// are quarantined once quarantineThreshold is reached, never if it is
+	// zero, see WithPeerQuarantine
+	failures            map[string]*peerFailures
+	failuresMutex       sync.Mutex
+	quarantineThreshold int
+	quarantineBackoff   time.Duration
+
+	// codecs are the frame transforms of each peer, created by
+	// newFrameTransform, see WithFrameTransform. negotiator tells which
+	// peers support it, see SetCapabilityNegotiator
+	codecs             map[string]*frameCodec
+	codecsMutex        sync.Mutex
+	newFrameTransform  func() FrameTransform
+	frameTransformName string
+	negotiator         CapabilityNegotiator
+}
+
+// TransportOption configures a proximity transport
+type TransportOption func(t *proximityTransport)
+
+// WithCacheDisabled disables both the transport and the connection caches:
+// payloads received from an unknown peer or on a connection which is not
+// ready yet are dropped instead of being delivered once the connection is
+// ready.
+func WithCacheDisabled() TransportOption {
+	return func(t *proximityTransport) {
+		t.cacheDisabled = true
+	}
+}
+
+// WithPreferredOverRelay connects to the peers found by the native driver
+// even if they are already connected through a relay, by default the proximity
+// connection is only established if the peer isn't connected at all. The
+// swarm then opens the new streams over the proximity connection, see
+// ipfsutil.ProximityPreferredDialRanker to also dial the proximity addresses
+// first.
+func WithPreferredOverRelay() TransportOption {
+	return func(t *proximityTransport) {
+		t.preferredOverRelay = true
+	}
+}
+
+// WithDriverCloseTimeout sets how long the transport waits for the native
+// driver to close its connection with a peer, a driver call still running
+// after timeout is left behind.
+func WithDriverCloseTimeout(timeout time.Duration) TransportOption {
+	return func(t *proximityTransport) {
+		t.driverCloseTimeout = timeout
+	}
 }
 
-func NewTransport(ctx context.Context, l *zap.Logger, driver ProximityDriver) func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error) {
+func NewTransport(ctx context.Context, l *zap.Logger, driver ProximityDriver, opts ...TransportOption) func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error) {
 	if l == nil {
 		l = zap.NewNop()
 	}
@@ -78,14 +214,39 @@ func NewTransport(ctx context.Context, l *zap.Logger, driver ProximityDriver) fu
 	l.Debug("remi: transport.go: new Transport")
 	return func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error) {
 		l.Debug("NewTransport called", zap.String("driver", driver.ProtocolName()))
+		ctx, cancel := context.WithCancel(ctx)
 		transport := &proximityTransport{
 			swarm:    swarm,
 			upgrader: u,
 			connMap:  make(map[string]*Conn),
-			cache:    NewRingBufferMap(l, 128),
+			peers:    make(map[string]uint64),
 			driver:   driver,
 			logger:   l,
 			ctx:      ctx,
+			cancel:   cancel,
+
+			driverCloseTimeout: defaultDriverCloseTimeout,
+			cacheDisabledPeers: make(map[string]struct{}),
+			connCacheEntries:   defaultConnCacheEntries,
+			connCacheMaxBytes:  defaultConnCacheMaxBytes,
+			failures:           make(map[string]*peerFailures),
+			codecs:             make(map[string]*frameCodec),
+		}
+
+		for _, opt := range opts {
+			opt(transport)
+		}
+
+		transport.driver = newRecoverDriver(driver, l, transport.driverPanicHandler)
+
+		if !transport.cacheDisabled {
+			transport.cache = NewRingBufferMap(l, 128)
+			transport.cache.budget = transport.cacheBudget
+			transport.cache.onEvict = transport.cacheEvictionCallback()
+		}
+
+		if transport.cacheEvictionHandler != nil {
+			go transport.runCacheEvictionHandler()
 		}
 
 		return transport, nil
@@ -99,6 +260,14 @@ func (t *proximityTransport) Dial(ctx context.Context, remoteMa ma.Multiaddr, re
 	// because native driver is initialized during listener creation.
 	t.lock.RLock()
 	defer t.lock.RUnlock()
+	if t.dialDisabled {
+		return nil, errors.New("error: proximityTransport.Dial: dialing is disabled")
+	}
+
+	if !t.driverMode.outboundEnabled() {
+		return nil, errors.Errorf("error: proximityTransport.Dial: driver is in %s mode", t.driverMode)
+	}
+
 	if t.listener == nil {
 		return nil, errors.New("error: proximityTransport.Dial: no active listener")
 	}
@@ -125,19 +294,84 @@ func (t *proximityTransport) Dial(ctx context.Context, remoteMa ma.Multiaddr, re
 	}
 
 	// Returns an outbound conn.
-	return newConn(ctx, t, remoteMa, remotePID, network.DirOutbound)
+	return newConn(ctx, t.listener.session, t.listener, remoteMa, remotePID, network.DirOutbound)
 }
 
 // CanDial returns true if this transport believes it can dial the given
 // multiaddr.
 func (t *proximityTransport) CanDial(remoteMa ma.Multiaddr) bool {
+	t.lock.RLock()
+	dialDisabled := t.dialDisabled || !t.driverMode.outboundEnabled()
+	t.lock.RUnlock()
+	if dialDisabled {
+		return false
+	}
+
 	// multiaddr validation checker
 	return mafmt.Base(t.driver.ProtocolCode()).Matches(remoteMa)
 }
 
+// SetDialEnabled enables or disables outgoing dials at runtime.
+// When disabled, CanDial returns false and Dial fails, but the listener and
+// the native driver keep running.
+func (t *proximityTransport) SetDialEnabled(enabled bool) {
+	t.lock.Lock()
+	t.dialDisabled = !enabled
+	t.lock.Unlock()
+
+	t.logger.Debug("SetDialEnabled", zap.Bool("enabled", enabled))
+}
+
+// SetPeerCaching enables or disables at runtime the caching of the payloads
+// received from a peer before its connection is ready. When disabled, the
+// payloads already cached for the peer are dropped as well. The other peers
+// are not affected, and it has no effect if the cache is disabled for the
+// whole transport, see WithCacheDisabled.
+func (t *proximityTransport) SetPeerCaching(remotePID string, enabled bool) {
+	t.lock.Lock()
+	if enabled {
+		delete(t.cacheDisabledPeers, remotePID)
+	} else {
+		t.cacheDisabledPeers[remotePID] = struct{}{}
+	}
+	t.lock.Unlock()
+
+	if !enabled {
+		if t.cache != nil {
+			t.cache.Delete(remotePID)
+		}
+
+		t.connMapMutex.RLock()
+		c, ok := t.connMap[remotePID]
+		t.connMapMutex.RUnlock()
+		if ok {
+			c.Lock()
+			if c.cache != nil {
+				c.cache.Delete(remotePID)
+			}
+			c.Unlock()
+		}
+	}
+
+	t.logger.Debug("SetPeerCaching", logutil.PrivateString("remotePID", remotePID), zap.Bool("enabled", enabled))
+}
+
+// isPeerCachingDisabled returns true if the caching is disabled for the peer
+func (t *proximityTransport) isPeerCachingDisabled(remotePID string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	_, ok := t.cacheDisabledPeers[remotePID]
+	return ok
+}
+
 // Listen listens on the given multiaddr.
 // Proximity connections can't listen on more than one listener.
 func (t *proximityTransport) Listen(localMa ma.Multiaddr) (tpt.Listener, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error: proximityTransport.Listen: transport closed")
+	}
+
 	// localAddr is supposed to be equal to the localPID
 	// or to DefaultAddr since multiaddr == /<protocol>/<peerID>
 	localPID := t.swarm.LocalPeer().String()
@@ -154,37 +388,133 @@ func (t *proximityTransport) Listen(localMa ma.Multiaddr) (tpt.Listener, error)
 		}
 	}
 
+	t.driverMutex.Lock()
+	defer t.driverMutex.Unlock()
+
 	// If the a listener already exists for this driver, returns an error.
-	TransportMapMutex.RLock()
-	_, ok := TransportMap[t.driver.ProtocolName()]
-	TransportMapMutex.RUnlock()
 	t.lock.RLock()
-	if ok || t.listener != nil {
-		t.lock.RUnlock()
+	listening := t.listener != nil
+	t.lock.RUnlock()
+
+	// Register this transport
+	if listening || !t.registry.register(t) {
 		return nil, errors.New("error: proximityTransport.Listen: one listener maximum")
 	}
+
+	t.lock.Lock()
+	t.localMa = localMa
+	t.listener = newListener(t.ctx, localMa, t)
+	listener := t.listener
+	t.lock.Unlock()
+
+	// Starts the native driver, without holding the lock as it may call the
+	// transport back while starting.
+	// If it failed, don't return a error because no other transport
+	// on the libp2p node will be created.
+	t.driver.Start(localPID)
+
+	return listener, err
+}
+
+// Restart restarts the native driver with a fresh session, reusing the same
+// transport and driver, so apps toggling networking on and off don't need a
+// new transport instance.
+// If a listener is running it is kept, so the swarm keeps accepting its
+// connections, and the connections of the previous session are closed.
+// Otherwise a new listener is created through the swarm, which accepts its
+// connections, closing the previous listener afterward is a no-op.
+// The transport must have listened at least once.
+func (t *proximityTransport) Restart() (tpt.Listener, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "error: proximityTransport.Restart: transport closed")
+	}
+
+	t.driverMutex.Lock()
+
+	t.lock.RLock()
+	localMa, listener := t.localMa, t.listener
 	t.lock.RUnlock()
 
-	// Register this transport
-	TransportMapMutex.Lock()
-	TransportMap[t.driver.ProtocolName()] = t
-	TransportMapMutex.Unlock()
+	if localMa == nil {
+		t.driverMutex.Unlock()
+		return nil, errors.New("error: proximityTransport.Restart: transport never listened")
+	}
+
+	if listener == nil {
+		t.driverMutex.Unlock()
+
+		// The swarm only accepts the connections of the listeners it has
+		// created, Listen is called back by the swarm.
+		if err := t.swarm.Listen(localMa); err != nil {
+			return nil, errors.Wrap(err, "error: proximityTransport.Restart: unable to listen")
+		}
+
+		t.lock.RLock()
+		defer t.lock.RUnlock()
+
+		if t.listener == nil {
+			return nil, errors.New("error: proximityTransport.Restart: listener closed while restarting")
+		}
+
+		return t.listener, nil
+	}
 
+	defer t.driverMutex.Unlock()
+
+	t.logger.Debug("Restart: restarting the native driver of the running listener")
+	t.driver.Stop()
+
+	// Block the native driver callbacks until the new session is ready.
 	t.lock.Lock()
-	defer t.lock.Unlock()
+	listener.newSession()
+	t.lock.Unlock()
 
-	t.listener = newListener(t.ctx, localMa, t)
+	t.driver.Start(t.swarm.LocalPeer().String())
 
-	return t.listener, err
+	return listener, nil
 }
 
 // ReceiveFromPeer is called by native driver when peer's device sent data.
 // If the connection is not found, data is added in the transport cache level.
 // If the connection is not actived yet, data is added in the connection cache level.
 // Cache are circular buffer, avoiding RAM memory attack.
+// If the cache is disabled, globally or for this peer, data is dropped in both
+// cases.
 func (t *proximityTransport) ReceiveFromPeer(remotePID string, payload []byte) {
 	t.logger.Debug("ReceiveFromPeer()", zap.String("remotePID", remotePID), logutil.PrivateBinary("payload", payload))
 
+	// strip the keepalive header, heartbeats are handled here
+	if t.keepAliveEnabled() {
+		var ok bool
+		if payload, ok = t.handleFrame(remotePID, payload); !ok {
+			return
+		}
+	}
+
+	// decode the frame, it may carry none or several payloads
+	if codec := t.frameCodec(remotePID); codec != nil {
+		codec.decodeMutex.Lock()
+		defer codec.decodeMutex.Unlock()
+
+		for _, data := range codec.decode(payload) {
+			t.receivePayload(remotePID, data)
+		}
+		return
+	}
+
+	t.receivePayload(remotePID, payload)
+}
+
+// receivePayload delivers a payload received from the peer to its connection
+// or caches it
+func (t *proximityTransport) receivePayload(remotePID string, payload []byte) {
+	t.logRecvBandwidth(remotePID, len(payload))
+
+	if t.dedup != nil && t.dedup.isDuplicate(remotePID, payload) {
+		t.logger.Debug("ReceiveFromPeer: duplicated payload, drop it", logutil.PrivateString("remotePID", remotePID))
+		return
+	}
+
 	// copy value from driver
 	data := make([]byte, len(payload))
 	copy(data, payload)
@@ -197,9 +527,21 @@ func (t *proximityTransport) ReceiveFromPeer(remotePID string, payload []byte) {
 		if !c.isReady() {
 			c.Lock()
 			if !c.ready {
+				if c.cache == nil || t.isPeerCachingDisabled(remotePID) {
+					c.Unlock()
+					t.logger.Warn("ReceiveFromPeer: connection is not ready to accept incoming packets and cache is disabled, drop payload")
+					return
+				}
+
 				t.logger.Info("ReceiveFromPeer: connection is not ready to accept incoming packets, add it to cache")
-				c.cache.Add(remotePID, data)
+				cached := c.cachePayload(remotePID, data)
 				c.Unlock()
+
+				// Close off the native callback path, closing waits for
+				// the native driver
+				if !cached {
+					go c.Close()
+				}
 				return
 			}
 			c.Unlock()
@@ -207,6 +549,8 @@ func (t *proximityTransport) ReceiveFromPeer(remotePID string, payload []byte) {
 
 		// Write the payload into pipe
 		c.mp.input <- data
+	} else if t.cache == nil || t.isPeerCachingDisabled(remotePID) {
+		t.logger.Warn("ReceiveFromPeer: no Conn found and cache is disabled, drop payload")
 	} else {
 		t.logger.Info("ReceiveFromPeer: no Conn found, put payload in cache")
 		t.cache.Add(remotePID, data)
@@ -232,7 +576,7 @@ func (t *proximityTransport) HandleFoundPeer(sRemotePID string) bool {
 	// Checks if a listener is currently running.
 	t.lock.RLock()
 
-	if t.listener == nil || t.listener.ctx.Err() != nil {
+	if t.listener == nil || t.listener.session.Err() != nil {
 		t.lock.RUnlock()
 		t.logger.Error("HandleFoundPeer: listener not running")
 		return false
@@ -240,33 +584,85 @@ func (t *proximityTransport) HandleFoundPeer(sRemotePID string) bool {
 
 	// Get snapshot of listener
 	listener := t.listener
+	session := listener.session
+	mode := t.driverMode
 
 	// unblock here to prevent blocking other APIs of Listener or Transport
 	t.lock.RUnlock()
 
+	// The driver must never report the local peer, no peer could init the
+	// connection below and dialing ourselves is a bug anyway.
+	localPID := listener.Addr().String()
+	if sRemotePID == localPID {
+		t.logger.Error("HandleFoundPeer: remote peerID is the local peerID, declining peer", logutil.PrivateString("remotePID", sRemotePID))
+		return false
+	}
+
+	// A peer which keeps failing to connect is declined until the end of its
+	// quarantine, without closing the native connection again.
+	if t.isQuarantined(sRemotePID) {
+		t.logger.Debug("HandleFoundPeer: peer is quarantined, declining peer", logutil.PrivateString("remotePID", sRemotePID))
+		return false
+	}
+
+	// Peer with lexicographical smallest peerID inits libp2p connection, a
+	// degraded driver may not support the required direction.
+	outbound := localPID < sRemotePID
+	if (outbound && !mode.outboundEnabled()) || (!outbound && !mode.inboundEnabled()) {
+		t.logger.Debug("HandleFoundPeer: connection direction not supported by the driver, declining peer",
+			logutil.PrivateString("remotePID", sRemotePID), zap.Bool("outbound", outbound), zap.Stringer("mode", mode))
+		t.closeDriverConn(sRemotePID)
+		return false
+	}
+
+	// Respect the connection limit
+	reservation, evicted, ok := t.reservePeer(sRemotePID)
+	if !ok {
+		t.logger.Debug("HandleFoundPeer: connection limit reached, declining peer", zap.String("remotePID", sRemotePID))
+		t.closeDriverConn(sRemotePID)
+		return false
+	}
+
+	if evicted != "" {
+		t.evictPeer(evicted)
+	}
+
 	// Adds peer to peerstore.
 	t.swarm.Peerstore().AddAddr(remotePID, remoteMa,
 		pstore.TempAddrTTL)
 
 	// Delete previous cache if it exists
-	t.cache.Delete(sRemotePID)
+	if t.cache != nil {
+		t.cache.Delete(sRemotePID)
+	}
 
-	// Peer with lexicographical smallest peerID inits libp2p connection.
-	if listener.Addr().String() < sRemotePID {
+	if outbound {
 		t.logger.Debug("HandleFoundPeer: outgoing libp2p connection")
 		// Async connect so HandleFoundPeer can return and unlock the native driver.
 		// Needed to read and write during the connect handshake.
 		go func() {
-			// Need to use listener than t.listener here to not have to check valid value of t.listener
-			err := t.connect(listener.ctx, peer.AddrInfo{
+			// Need to use the session snapshot here to not have to check valid value of t.listener
+			err := t.connect(session, peer.AddrInfo{
 				ID:    remotePID,
 				Addrs: []ma.Multiaddr{remoteMa},
 			})
 			if err != nil {
 				t.logger.Error("HandleFoundPeer: async connect error", zap.Error(err))
+
+				// the native connection of an evicted or lost peer has
+				// already been closed, and its slot may be held by a new
+				// reservation
+				if !t.releaseReservation(sRemotePID, reservation) {
+					return
+				}
+
 				t.swarm.Peerstore().SetAddr(remotePID, remoteMa, -1)
-				t.driver.CloseConnWithPeer(sRemotePID)
+				t.closeDriverConn(sRemotePID)
+				t.connectFailed(sRemotePID)
+				return
 			}
+
+			t.connectSucceeded(sRemotePID)
 		}()
 
 		return true
@@ -281,7 +677,8 @@ func (t *proximityTransport) HandleFoundPeer(sRemotePID string) bool {
 		remotePID: remotePID,
 	}:
 		return true
-	case <-listener.ctx.Done():
+	case <-session.Done():
+		t.releasePeer(sRemotePID)
 		return false
 	}
 }
@@ -292,6 +689,13 @@ func (t *proximityTransport) connect(ctx context.Context, pi peer.AddrInfo) erro
 	t.swarm.Peerstore().AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
 
 	forceDirect, _ := network.GetForceDirectDial(ctx)
+	if t.preferredOverRelay && !forceDirect {
+		// the swarm ignores the relayed connections and only dials the
+		// addresses not going through a relay
+		ctx = network.WithForceDirectDial(ctx, "proximity preferred over relay")
+		forceDirect = true
+	}
+
 	canUseLimitedConn, _ := network.GetAllowLimitedConn(ctx)
 	if !forceDirect {
 		connectedness := t.swarm.Connectedness(pi.ID)
@@ -308,6 +712,12 @@ func (t *proximityTransport) connect(ctx context.Context, pi peer.AddrInfo) erro
 // Closes connections with the peer.
 func (t *proximityTransport) HandleLostPeer(sRemotePID string) {
 	t.logger.Debug("HandleLostPeer", logutil.PrivateString("remotePID", sRemotePID))
+	t.releasePeer(sRemotePID)
+
+	if t.dedup != nil {
+		t.dedup.forgetPeer(sRemotePID)
+	}
+
 	remotePID, err := peer.Decode(sRemotePID)
 	if err != nil {
 		t.logger.Error("HandleLostPeer: wrong remote peerID")
@@ -323,8 +733,14 @@ func (t *proximityTransport) HandleLostPeer(sRemotePID string) {
 	// Remove peer's address to peerstore.
 	t.swarm.Peerstore().SetAddr(remotePID, remoteMa, -1)
 
-	// Close the peer connection
-	conns := t.swarm.ConnsToPeer(remotePID)
+	// Close the peer connections off the native callback path, the peer
+	// address has been removed so no new connection is dialed meanwhile
+	go closeLostPeerConns(remoteMa, t.swarm.ConnsToPeer(remotePID))
+}
+
+// closeLostPeerConns closes the connections with a lost peer, it doesn't
+// block on the native driver as Conn.Close disconnects it in the background
+func closeLostPeerConns(remoteMa ma.Multiaddr, conns []network.Conn) {
 	for _, conn := range conns {
 		if conn.RemoteMultiaddr().Equal(remoteMa) {
 			conn.Close()
@@ -332,6 +748,45 @@ func (t *proximityTransport) HandleLostPeer(sRemotePID string) {
 	}
 }
 
+// closeDriverConn asks the native driver to close its connection with the
+// peer and waits for it until driverCloseTimeout. A hung driver call is left
+// behind instead of blocking the caller.
+func (t *proximityTransport) closeDriverConn(remotePID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.driverCloseTimeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.driver.CloseConnWithPeer(remotePID)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.logger.Warn("closeDriverConn: native driver didn't close the connection in time",
+			logutil.PrivateString("remotePID", remotePID), zap.Duration("timeout", t.driverCloseTimeout))
+	}
+}
+
+// Close stops the running listener along with the native driver and aborts
+// the pending connections, it is called by the swarm once the host is closed.
+// The transport can't listen anymore afterward.
+func (t *proximityTransport) Close() error {
+	t.logger.Debug("Close called")
+	t.cancel()
+
+	t.lock.RLock()
+	listener := t.listener
+	t.lock.RUnlock()
+
+	if listener != nil {
+		return listener.Close()
+	}
+
+	return nil
+}
+
 func (t *proximityTransport) Log(level int, message string) {
 	switch level {
 	case Verbose, Debug:
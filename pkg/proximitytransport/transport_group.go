@@ -0,0 +1,168 @@
+package proximitytransport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// TransportGroup manages together the transports of several native drivers,
+// e.g. BLE, Multipeer Connectivity and Nearby. Each constructor returned by
+// Constructors must be passed to libp2p.Transport, the transports are then
+// handled by the group once libp2p has created them.
+type TransportGroup struct {
+	constructors []func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error)
+
+	// transports are the transports created by libp2p, by driver protocol
+	transports map[string]*proximityTransport
+	// protocols are the driver protocols, in the order of the drivers
+	protocols []string
+	mu        sync.RWMutex
+}
+
+// NewTransportGroup returns a group of transports for the given drivers, the
+// options are applied to each of them. Only one transport can listen per
+// driver protocol, so the drivers must all use a different protocol.
+func NewTransportGroup(ctx context.Context, l *zap.Logger, drivers []ProximityDriver, opts ...TransportOption) (*TransportGroup, error) {
+	if len(drivers) == 0 {
+		return nil, fmt.Errorf("error: NewTransportGroup: no driver")
+	}
+
+	g := &TransportGroup{
+		transports: make(map[string]*proximityTransport),
+	}
+
+	for _, driver := range drivers {
+		if driver == nil {
+			return nil, fmt.Errorf("error: NewTransportGroup: driver is nil")
+		}
+
+		protocolName := driver.ProtocolName()
+		for _, other := range g.protocols {
+			if other == protocolName {
+				return nil, fmt.Errorf("error: NewTransportGroup: multiple drivers for protocol %s", protocolName)
+			}
+		}
+		g.protocols = append(g.protocols, protocolName)
+
+		newTransport := NewTransport(ctx, l, driver, opts...)
+		g.constructors = append(g.constructors, func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error) {
+			t, err := newTransport(swarm, u)
+			if err != nil {
+				return nil, err
+			}
+
+			g.mu.Lock()
+			g.transports[protocolName] = t
+			g.mu.Unlock()
+
+			return t, nil
+		})
+	}
+
+	return g, nil
+}
+
+// Constructors returns the transport constructors, one per driver, to pass to
+// libp2p.Transport
+func (g *TransportGroup) Constructors() []func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error) {
+	return append([]func(swarm *swarm.Swarm, u tpt.Upgrader) (*proximityTransport, error){}, g.constructors...)
+}
+
+// Transport returns the transport of the given driver protocol, once it has
+// been created
+func (g *TransportGroup) Transport(protocolName string) (ProximityTransport, bool) {
+	g.mu.RLock()
+	t, ok := g.transports[protocolName]
+	g.mu.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	return t, true
+}
+
+// Start restarts the listener of each transport, see proximityTransport.Restart,
+// the transports which never listened are skipped. It returns the new
+// listeners, the transports failing to restart are reported in the error.
+func (g *TransportGroup) Start() ([]tpt.Listener, error) {
+	var (
+		listeners []tpt.Listener
+		errs      error
+	)
+
+	for _, t := range g.createdTransports() {
+		t.lock.RLock()
+		listened := t.localMa != nil
+		t.lock.RUnlock()
+
+		if !listened {
+			continue
+		}
+
+		listener, err := t.Restart()
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", t.driver.ProtocolName(), err))
+			continue
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, errs
+}
+
+// Stop closes the listener of each transport, which stops its native driver.
+// The transports can be started again using Start.
+func (g *TransportGroup) Stop() error {
+	var errs error
+
+	for _, t := range g.createdTransports() {
+		t.lock.RLock()
+		listener := t.listener
+		t.lock.RUnlock()
+
+		if listener == nil {
+			continue
+		}
+
+		if err := listener.Close(); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", t.driver.ProtocolName(), err))
+		}
+	}
+
+	return errs
+}
+
+// Health returns the current state of each created transport, by driver
+// protocol
+func (g *TransportGroup) Health() map[string]TransportHealth {
+	health := make(map[string]TransportHealth)
+	for _, t := range g.createdTransports() {
+		health[t.driver.ProtocolName()] = t.Health()
+	}
+
+	return health
+}
+
+// createdTransports returns the transports created so far, in the order of
+// the drivers
+func (g *TransportGroup) createdTransports() []*proximityTransport {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	transports := []*proximityTransport{}
+	for _, protocolName := range g.protocols {
+		if t, ok := g.transports[protocolName]; ok {
+			transports = append(transports, t)
+		}
+	}
+
+	return transports
+}
@@ -0,0 +1,520 @@
+package proximitytransport_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	tpt "github.com/libp2p/go-libp2p/core/transport"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+
+	ble "berty.tech/weshnet/v2/pkg/ble-driver"
+	mc "berty.tech/weshnet/v2/pkg/multipeer-connectivity-driver"
+	proximity "berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+func TestTransportSetDialEnabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	transport, err := proximity.NewTransport(ctx, nil, driver)(nil, nil)
+	require.NoError(t, err)
+
+	const remotePID = "12D3KooWQPP6DsfYWGkTx3AvkjjF9PFwS6C1Vfs1JmkUKkZtSTDD"
+
+	pid, err := peer.Decode(remotePID)
+	require.NoError(t, err)
+
+	remoteMa, err := ma.NewMultiaddr("/" + ble.ProtocolName + "/" + remotePID)
+	require.NoError(t, err)
+
+	require.True(t, transport.CanDial(remoteMa))
+
+	transport.SetDialEnabled(false)
+	require.False(t, transport.CanDial(remoteMa))
+
+	_, err = transport.Dial(ctx, remoteMa, pid)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dialing is disabled")
+
+	transport.SetDialEnabled(true)
+	require.True(t, transport.CanDial(remoteMa))
+
+	// dialing is enabled again, so Dial now fails on the missing listener
+	_, err = transport.Dial(ctx, remoteMa, pid)
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "dialing is disabled")
+}
+
+func TestTransportRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	driver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	transport, err := proximity.NewTransport(ctx, nil, driver)(sw, swarmt.GenUpgrader(t, sw, nil))
+	require.NoError(t, err)
+
+	// a closed listener is restarted through the swarm
+	require.NoError(t, sw.AddTransport(transport))
+
+	// the transport must have listened once to be restarted
+	_, err = transport.Restart()
+	require.Error(t, err)
+
+	listenMa, err := ma.NewMultiaddr(ble.DefaultAddr)
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+
+	// the peer with the smallest id initiates the connection, use a remote
+	// peer with a bigger id so HandleFoundPeer doesn't wait for an Accept
+	var remotePID string
+	for remotePID <= sw.LocalPeer().String() {
+		pid, err := test.RandPeerID()
+		require.NoError(t, err)
+		remotePID = pid.String()
+	}
+
+	require.True(t, transport.HandleFoundPeer(remotePID))
+
+	require.NoError(t, listener.Close())
+	require.False(t, transport.HandleFoundPeer(remotePID))
+
+	restarted, err := transport.Restart()
+	require.NoError(t, err)
+	require.True(t, transport.HandleFoundPeer(remotePID))
+
+	// closing the replaced listener must not stop the restarted one
+	require.NoError(t, listener.Close())
+	require.True(t, transport.HandleFoundPeer(remotePID))
+
+	// restarting a running listener keeps it, the swarm accepts its
+	// connections
+	running, err := transport.Restart()
+	require.NoError(t, err)
+	require.Equal(t, restarted, running)
+
+	// restart while the native driver keeps calling back
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				transport.HandleFoundPeer(remotePID)
+				transport.HandleLostPeer(remotePID)
+			}
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		restarted, err = transport.Restart()
+		require.NoError(t, err)
+	}
+
+	wg.Wait()
+
+	require.True(t, transport.HandleFoundPeer(remotePID))
+
+	// a new listener can't be created while the restarted one is running
+	_, err = transport.Listen(listenMa)
+	require.Error(t, err)
+
+	require.NoError(t, restarted.Close())
+	require.False(t, transport.HandleFoundPeer(remotePID))
+}
+
+func TestTransportRestartInbound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverA, driverB)
+
+	hosts := map[*proximity.LinkedDriver]host.Host{
+		driverA: newProximityHost(ctx, t, driverA),
+		driverB: newProximityHost(ctx, t, driverB),
+	}
+
+	dialer, accepter := driverA, driverB
+	if driverB.LocalPID < driverA.LocalPID {
+		dialer, accepter = driverB, driverA
+	}
+
+	// restart the accepting end while running, then once closed
+	restarter, ok := accepter.Transport.(interface{ Restart() (tpt.Listener, error) })
+	require.True(t, ok)
+
+	listener, err := restarter.Restart()
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+	require.False(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+
+	_, err = restarter.Restart()
+	require.NoError(t, err)
+
+	require.True(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+	require.True(t, dialer.Transport.HandleFoundPeer(accepter.LocalPID))
+
+	go driverA.Deliver(ctx)
+	go driverB.Deliver(ctx)
+
+	// the swarm of the accepting end accepts the inbound connection
+	require.Eventually(t, func() bool {
+		return len(hosts[accepter].Network().ConnsToPeer(hosts[dialer].ID())) > 0
+	}, time.Second*10, time.Millisecond*50)
+}
+
+func TestHandleFoundPeerSelf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	driver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	transport, err := proximity.NewTransport(ctx, nil, driver)(sw, nil)
+	require.NoError(t, err)
+
+	listenMa, err := ma.NewMultiaddr(ble.DefaultAddr)
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// the local peer is declined without waiting for an Accept
+	done := make(chan bool)
+	go func() { done <- transport.HandleFoundPeer(sw.LocalPeer().String()) }()
+
+	select {
+	case found := <-done:
+		require.False(t, found)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "HandleFoundPeer blocked on the local peer")
+	}
+
+	// the transport keeps handling the other peers
+	var remotePID string
+	for remotePID <= sw.LocalPeer().String() {
+		pid, err := test.RandPeerID()
+		require.NoError(t, err)
+		remotePID = pid.String()
+	}
+
+	require.True(t, transport.HandleFoundPeer(remotePID))
+}
+
+func TestTransportRegistry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listenMa, err := ma.NewMultiaddr(ble.DefaultAddr)
+	require.NoError(t, err)
+
+	newIsolatedTransport := func(registry *proximity.TransportRegistry) (proximity.ProximityTransport, tpt.Listener) {
+		sw := swarmt.GenSwarm(t)
+		t.Cleanup(func() { sw.Close() })
+
+		driver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+		transport, err := proximity.NewTransport(ctx, nil, driver, proximity.WithTransportRegistry(registry))(sw, nil)
+		require.NoError(t, err)
+
+		listener, err := transport.Listen(listenMa)
+		require.NoError(t, err)
+
+		return transport, listener
+	}
+
+	// both stacks listen for the same driver protocol without conflict
+	registryA, registryB := proximity.NewTransportRegistry(), proximity.NewTransportRegistry()
+	transportA, listenerA := newIsolatedTransport(registryA)
+	transportB, listenerB := newIsolatedTransport(registryB)
+	defer listenerB.Close()
+
+	registered, ok := registryA.Transport(ble.ProtocolName)
+	require.True(t, ok)
+	require.Equal(t, transportA, registered)
+
+	registered, ok = registryB.Transport(ble.ProtocolName)
+	require.True(t, ok)
+	require.Equal(t, transportB, registered)
+
+	// the package global isn't used
+	var global *proximity.TransportRegistry
+	_, ok = global.Transport(ble.ProtocolName)
+	require.False(t, ok)
+
+	// one listener per protocol in each registry
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+	driver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	transport, err := proximity.NewTransport(ctx, nil, driver, proximity.WithTransportRegistry(registryA))(sw, nil)
+	require.NoError(t, err)
+	_, err = transport.Listen(listenMa)
+	require.Error(t, err)
+
+	// closing the listener unregisters the transport
+	require.NoError(t, listenerA.Close())
+	_, ok = registryA.Transport(ble.ProtocolName)
+	require.False(t, ok)
+
+	_, ok = registryB.Transport(ble.ProtocolName)
+	require.True(t, ok)
+}
+
+func TestTransportClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	listenMa, err := ma.NewMultiaddr(ble.DefaultAddr)
+	require.NoError(t, err)
+
+	registry := proximity.NewTransportRegistry()
+	driver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	transport, err := proximity.NewTransport(ctx, nil, driver, proximity.WithTransportRegistry(registry))(sw, nil)
+	require.NoError(t, err)
+
+	listener, err := transport.Listen(listenMa)
+	require.NoError(t, err)
+
+	// closing the transport closes its listener
+	require.NoError(t, transport.Close())
+
+	_, ok := registry.Transport(ble.ProtocolName)
+	require.False(t, ok)
+	require.NoError(t, listener.Close())
+
+	// a closed transport can't listen again
+	_, err = transport.Listen(listenMa)
+	require.Error(t, err)
+
+	_, err = transport.Restart()
+	require.Error(t, err)
+
+	require.NoError(t, transport.Close())
+}
+
+func TestHandleLostPeerBlockingClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverA, driverB)
+
+	// the native driver of A blocks when closing a connection
+	driverA.Closing = make(chan string, 1)
+	driverA.Release = make(chan struct{})
+
+	hostA := newProximityHost(ctx, t, driverA)
+	hostB := newProximityHost(ctx, t, driverB)
+
+	dialer, accepter := driverA, driverB
+	if driverB.LocalPID < driverA.LocalPID {
+		dialer, accepter = driverB, driverA
+	}
+	require.True(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+	require.True(t, dialer.Transport.HandleFoundPeer(accepter.LocalPID))
+
+	go driverA.Deliver(ctx)
+	go driverB.Deliver(ctx)
+
+	require.Eventually(t, func() bool {
+		return len(hostA.Network().ConnsToPeer(hostB.ID())) > 0
+	}, time.Second*10, time.Millisecond*50)
+
+	start := time.Now()
+	driverA.Transport.HandleLostPeer(driverB.LocalPID)
+	require.Less(t, time.Since(start), time.Second)
+
+	// the peer address is removed before the connections are closed
+	remoteMa, err := ma.NewMultiaddr("/" + ble.ProtocolName + "/" + driverB.LocalPID)
+	require.NoError(t, err)
+	require.NotContains(t, hostA.Peerstore().Addrs(hostB.ID()), remoteMa)
+
+	// the connection is closed while the native driver is still blocked
+	select {
+	case remotePID := <-driverA.Closing:
+		require.Equal(t, driverB.LocalPID, remotePID)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the connection hasn't been closed")
+	}
+
+	require.Eventually(t, func() bool {
+		return len(hostA.Network().ConnsToPeer(hostB.ID())) == 0
+	}, time.Second*10, time.Millisecond*50)
+
+	close(driverA.Release)
+}
+
+func TestTransportGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bleDriver := proximity.NewNoopProximityDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	mcDriver := proximity.NewNoopProximityDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+
+	// only one transport can listen per driver protocol
+	_, err := proximity.NewTransportGroup(ctx, nil, []proximity.ProximityDriver{bleDriver, bleDriver})
+	require.Error(t, err)
+
+	group, err := proximity.NewTransportGroup(ctx, nil, []proximity.ProximityDriver{bleDriver, mcDriver}, proximity.WithTransportRegistry(proximity.NewTransportRegistry()))
+	require.NoError(t, err)
+
+	sw := swarmt.GenSwarm(t)
+	defer sw.Close()
+
+	// libp2p calls the constructors when building the host
+	constructors := group.Constructors()
+	require.Len(t, constructors, 2)
+
+	// the stopped listeners are restarted through the swarm
+	for _, newTransport := range constructors {
+		transport, err := newTransport(sw, swarmt.GenUpgrader(t, sw, nil))
+		require.NoError(t, err)
+		require.NoError(t, sw.AddTransport(transport))
+	}
+
+	for _, driver := range []proximity.ProximityDriver{bleDriver, mcDriver} {
+		transport, ok := group.Transport(driver.ProtocolName())
+		require.True(t, ok)
+
+		listenMa, err := ma.NewMultiaddr(driver.DefaultAddr())
+		require.NoError(t, err)
+
+		_, err = transport.(tpt.Transport).Listen(listenMa)
+		require.NoError(t, err)
+	}
+
+	// the peer with the smallest id initiates the connection, use a remote
+	// peer with a bigger id so HandleFoundPeer doesn't wait for an Accept
+	var remotePID string
+	for remotePID <= sw.LocalPeer().String() {
+		pid, err := test.RandPeerID()
+		require.NoError(t, err)
+		remotePID = pid.String()
+	}
+
+	bleTransport, _ := group.Transport(ble.ProtocolName)
+	mcTransport, _ := group.Transport(mc.ProtocolName)
+
+	require.True(t, bleTransport.HandleFoundPeer(remotePID))
+	require.True(t, mcTransport.HandleFoundPeer(remotePID))
+
+	// the transports operate independently
+	bleTransport.SetDriverMode(proximity.DriverModeOutboundOnly)
+
+	health := group.Health()
+	require.Len(t, health, 2)
+	require.False(t, health[ble.ProtocolName].Inbound)
+	require.True(t, health[mc.ProtocolName].Inbound)
+
+	bleTransport.SetDriverMode(proximity.DriverModeFull)
+
+	require.NoError(t, group.Stop())
+	for _, health := range group.Health() {
+		require.False(t, health.Listening)
+	}
+	require.False(t, bleTransport.HandleFoundPeer(remotePID))
+	require.False(t, mcTransport.HandleFoundPeer(remotePID))
+
+	listeners, err := group.Start()
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	for _, health := range group.Health() {
+		require.True(t, health.Listening)
+	}
+
+	// stopping one transport doesn't stop the other one
+	require.NoError(t, listeners[0].Close())
+	require.False(t, bleTransport.HandleFoundPeer(remotePID))
+	require.True(t, mcTransport.HandleFoundPeer(remotePID))
+}
+
+// newProximityGroupHost returns a host only reachable through the proximity
+// transport of the driver, created by a transport group
+func newProximityGroupHost(ctx context.Context, t *testing.T, driver *proximity.LinkedDriver) (host.Host, *proximity.TransportGroup) {
+	t.Helper()
+
+	group, err := proximity.NewTransportGroup(ctx, nil, []proximity.ProximityDriver{driver})
+	require.NoError(t, err)
+
+	h := newLinkedHost(t, driver, nil, nil, func(_ host.Host, sw *swarm.Swarm, u tpt.Upgrader) proximity.ProximityTransport {
+		for _, newTransport := range group.Constructors() {
+			transport, err := newTransport(sw, u)
+			require.NoError(t, err)
+			require.NoError(t, sw.AddTransport(transport))
+		}
+
+		transport, ok := group.Transport(driver.ProtocolName())
+		require.True(t, ok)
+
+		return transport
+	})
+
+	return h, group
+}
+
+func TestTransportGroupRestartInbound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	driverA := proximity.NewLinkedDriver(ble.ProtocolCode, ble.ProtocolName, ble.DefaultAddr)
+	driverB := proximity.NewLinkedDriver(mc.ProtocolCode, mc.ProtocolName, mc.DefaultAddr)
+	proximity.LinkDrivers(driverA, driverB)
+
+	hostA, groupA := newProximityGroupHost(ctx, t, driverA)
+	hostB, groupB := newProximityGroupHost(ctx, t, driverB)
+
+	// stop and start the groups, then start them again while running
+	for _, group := range []*proximity.TransportGroup{groupA, groupB} {
+		require.NoError(t, group.Stop())
+
+		for i := 0; i < 2; i++ {
+			listeners, err := group.Start()
+			require.NoError(t, err)
+			require.Len(t, listeners, 1)
+		}
+	}
+
+	hosts := map[*proximity.LinkedDriver]host.Host{driverA: hostA, driverB: hostB}
+
+	dialer, accepter := driverA, driverB
+	if driverB.LocalPID < driverA.LocalPID {
+		dialer, accepter = driverB, driverA
+	}
+
+	require.True(t, accepter.Transport.HandleFoundPeer(dialer.LocalPID))
+	require.True(t, dialer.Transport.HandleFoundPeer(accepter.LocalPID))
+
+	go driverA.Deliver(ctx)
+	go driverB.Deliver(ctx)
+
+	// the swarm of the accepting end accepts the inbound connection
+	require.Eventually(t, func() bool {
+		for _, conn := range hosts[accepter].Network().ConnsToPeer(hosts[dialer].ID()) {
+			if conn.Stat().Direction == network.DirInbound {
+				return true
+			}
+		}
+		return false
+	}, time.Second*10, time.Millisecond*50)
+}
@@ -0,0 +1,124 @@
+package secretstore
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// CipherSuiteIDDefault identifies the default cipher suite, XSalsa20 and
+// Poly1305 as implemented by NaCl secretbox. It is used by all the entries
+// encrypted before the cipher suites were introduced.
+const CipherSuiteIDDefault uint32 = 0
+
+// ErrCipherSuiteUnsupported is returned when opening an entry encrypted using
+// a cipher suite which isn't supported by the secret store, such an entry is
+// expected to be skipped
+var ErrCipherSuiteUnsupported = errors.New("unsupported cipher suite")
+
+// CipherSuite is an AEAD used to encrypt the metadata events, the message
+// headers and the message payloads of the groups. Its ID is recorded in the
+// encrypted entries so the other members know how to open them, they must
+// all support it.
+type CipherSuite interface {
+	// ID identifies the suite in the encrypted entries, it must not be
+	// CipherSuiteIDDefault and must not change as long as the suite is used
+	ID() uint32
+
+	// Seal encrypts and authenticates a message, a nonce is never reused
+	// for the same key
+	Seal(message []byte, nonce *[cryptoutil.NonceSize]byte, key *[cryptoutil.KeySize]byte) ([]byte, error)
+
+	// Open authenticates and decrypts a message encrypted by Seal
+	Open(sealed []byte, nonce *[cryptoutil.NonceSize]byte, key *[cryptoutil.KeySize]byte) ([]byte, error)
+}
+
+// DefaultCipherSuite returns the cipher suite identified by
+// CipherSuiteIDDefault, which is always supported
+func DefaultCipherSuite() CipherSuite {
+	return secretboxCipherSuite{}
+}
+
+type secretboxCipherSuite struct{}
+
+func (secretboxCipherSuite) ID() uint32 { return CipherSuiteIDDefault }
+
+func (secretboxCipherSuite) Seal(message []byte, nonce *[cryptoutil.NonceSize]byte, key *[cryptoutil.KeySize]byte) ([]byte, error) {
+	return secretbox.Seal(nil, message, nonce, key), nil
+}
+
+func (secretboxCipherSuite) Open(sealed []byte, nonce *[cryptoutil.NonceSize]byte, key *[cryptoutil.KeySize]byte) ([]byte, error) {
+	message, ok := secretbox.Open(nil, sealed, nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("secretbox failed to open")
+	}
+
+	return message, nil
+}
+
+// CipherSuites are the cipher suites supported by a secret store, see
+// NewSecretStoreOptions.CipherSuites. A nil value only supports the default
+// suite.
+type CipherSuites struct {
+	sealing CipherSuite
+	suites  map[uint32]CipherSuite
+}
+
+// NewCipherSuites returns the given cipher suites and the default one, the
+// new entries are encrypted using sealing, the default suite if nil
+func NewCipherSuites(sealing CipherSuite, suites ...CipherSuite) (*CipherSuites, error) {
+	if sealing == nil {
+		sealing = DefaultCipherSuite()
+	}
+
+	cs := &CipherSuites{
+		sealing: sealing,
+		suites:  map[uint32]CipherSuite{CipherSuiteIDDefault: DefaultCipherSuite()},
+	}
+
+	for _, suite := range suites {
+		if suite == nil {
+			continue
+		}
+
+		if _, ok := cs.suites[suite.ID()]; ok {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("cipher suite %d is already registered", suite.ID()))
+		}
+
+		cs.suites[suite.ID()] = suite
+	}
+
+	// the sealing suite may also be listed in suites
+	if _, ok := cs.suites[sealing.ID()]; !ok {
+		cs.suites[sealing.ID()] = sealing
+	}
+
+	return cs, nil
+}
+
+// Sealing returns the cipher suite used to encrypt the new entries
+func (cs *CipherSuites) Sealing() CipherSuite {
+	if cs == nil {
+		return DefaultCipherSuite()
+	}
+
+	return cs.sealing
+}
+
+// Get returns the cipher suite with the given ID, the returned error wraps
+// ErrCipherSuiteUnsupported if it isn't supported
+func (cs *CipherSuites) Get(id uint32) (CipherSuite, error) {
+	if cs == nil {
+		if id == CipherSuiteIDDefault {
+			return DefaultCipherSuite(), nil
+		}
+	} else if suite, ok := cs.suites[id]; ok {
+		return suite, nil
+	}
+
+	return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("%w %d", ErrCipherSuiteUnsupported, id))
+}
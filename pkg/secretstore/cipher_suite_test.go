@@ -0,0 +1,116 @@
+package secretstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// xChaCha20Poly1305Suite is an alternate cipher suite used by the tests
+type xChaCha20Poly1305Suite struct{}
+
+func (xChaCha20Poly1305Suite) ID() uint32 { return 42 }
+
+func (xChaCha20Poly1305Suite) Seal(message []byte, nonce *[cryptoutil.NonceSize]byte, key *[cryptoutil.KeySize]byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nil, nonce[:], message, nil), nil
+}
+
+func (xChaCha20Poly1305Suite) Open(sealed []byte, nonce *[cryptoutil.NonceSize]byte, key *[cryptoutil.KeySize]byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce[:], sealed, nil)
+}
+
+func TestCipherSuites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	suite := xChaCha20Poly1305Suite{}
+
+	sender, err := newInMemSecretStore(&NewSecretStoreOptions{SealingCipherSuite: suite})
+	require.NoError(t, err)
+
+	supporting, err := newInMemSecretStore(&NewSecretStoreOptions{CipherSuites: []CipherSuite{suite}})
+	require.NoError(t, err)
+
+	unsupporting, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	group, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	require.NoError(t, sender.PutGroup(ctx, group))
+	require.NoError(t, supporting.PutGroup(ctx, group))
+	require.NoError(t, unsupporting.PutGroup(ctx, group))
+
+	senderDevice, err := sender.GetOwnMemberDeviceForGroup(group)
+	require.NoError(t, err)
+
+	for _, receiver := range []*secretStore{supporting, unsupporting} {
+		receiverDevice, err := receiver.GetOwnMemberDeviceForGroup(group)
+		require.NoError(t, err)
+
+		chainKey, err := sender.GetShareableChainKey(ctx, group, receiverDevice.Member())
+		require.NoError(t, err)
+		require.NoError(t, receiver.RegisterChainKey(ctx, group, senderDevice.Device(), chainKey))
+	}
+
+	payload := []byte("test payload")
+	payloadBytes, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: payload})
+	require.NoError(t, err)
+
+	data, err := sender.SealEnvelope(ctx, group, payloadBytes)
+	require.NoError(t, err)
+
+	// the suite is recorded in the envelope
+	env := &protocoltypes.MessageEnvelope{}
+	require.NoError(t, proto.Unmarshal(data, env))
+	require.Equal(t, suite.ID(), env.CipherSuite)
+
+	// a node supporting the suite opens the message
+	env, headers, err := supporting.OpenEnvelopeHeaders(data, group)
+	require.NoError(t, err)
+
+	groupPublicKey, err := group.GetPubKey()
+	require.NoError(t, err)
+
+	receiverDevice, err := supporting.GetOwnMemberDeviceForGroup(group)
+	require.NoError(t, err)
+
+	msg, err := supporting.OpenEnvelopePayload(ctx, env, headers, groupPublicKey, receiverDevice.Device(), cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, payload, msg.Plaintext)
+
+	// the message can't be opened using the default suite
+	env.CipherSuite = CipherSuiteIDDefault
+	envBytes, err := proto.Marshal(env)
+	require.NoError(t, err)
+
+	_, _, err = supporting.OpenEnvelopeHeaders(envBytes, group)
+	require.Error(t, err)
+
+	// the other nodes report the suite as unsupported
+	_, _, err = unsupporting.OpenEnvelopeHeaders(data, group)
+	require.ErrorIs(t, err, ErrCipherSuiteUnsupported)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt))
+
+	// a suite can't be registered twice
+	_, err = NewCipherSuites(nil, suite, suite)
+	require.Error(t, err)
+}
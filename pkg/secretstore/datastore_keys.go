@@ -31,6 +31,11 @@ const (
 	// for a given CID once the corresponding message has been decrypted.
 	dsNamespaceMessageKeyForCIDs = "messageKeyForCIDs"
 
+	// dsNamespaceDeletedMessageKeys is a namespace containing the CIDs of the
+	// messages whose key has been deleted, these messages can't be opened
+	// anymore even if their key is imported again.
+	dsNamespaceDeletedMessageKeys = "deletedMessageKeys"
+
 	// dsNamespaceOutOfStoreGroupHint is a namespace where HMAC value are
 	// associated to a group public key.
 	// It is used when receiving an out-of-store message (e.g. a push
@@ -46,6 +51,15 @@ const (
 	// dsNamespaceGroupDatastore is a namespace to store groups by their public
 	// key
 	dsNamespaceGroupDatastore = "groupByPublicKey"
+
+	// dsNamespaceGroupEpochKeys is a namespace storing the epoch keys of a
+	// group by their identifier.
+	// Previous epoch keys are kept so older messages can still be opened.
+	dsNamespaceGroupEpochKeys = "groupEpochKeys"
+
+	// dsNamespaceCurrentGroupEpochKey is a namespace storing the identifier
+	// of the epoch key used to encrypt new messages for a given group.
+	dsNamespaceCurrentGroupEpochKey = "currentGroupEpochKey"
 )
 
 func dsKeyForGroup(key []byte) datastore.Key {
@@ -96,6 +110,15 @@ func dsKeyForMessageKeyByCID(id cid.Cid) datastore.Key {
 	})
 }
 
+// dsKeyForDeletedMessageKey returns a datastore.Key marking the key of the
+// message with the given CID as deleted.
+func dsKeyForDeletedMessageKey(id cid.Cid) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceDeletedMessageKeys,
+		id.String(),
+	})
+}
+
 // dsKeyForOutOfStoreMessageGroupHint returns a datastore.Key where will be
 // stored a group public key for a given push group reference.
 func dsKeyForOutOfStoreMessageGroupHint(ref []byte) datastore.Key {
@@ -115,3 +138,22 @@ func dsKeyForOutOfStoreFirstLastCounters(groupPK, devicePK []byte) datastore.Key
 		base64.RawURLEncoding.EncodeToString(devicePK),
 	})
 }
+
+// dsKeyForGroupEpochKey returns the datastore.Key where will be stored the
+// epoch key with the given identifier for a given group.
+func dsKeyForGroupEpochKey(groupPublicKey []byte, keyID []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceGroupEpochKeys,
+		hex.EncodeToString(groupPublicKey),
+		hex.EncodeToString(keyID),
+	})
+}
+
+// dsKeyForCurrentGroupEpochKey returns the datastore.Key where will be stored
+// the identifier of the current epoch key of a given group.
+func dsKeyForCurrentGroupEpochKey(groupPublicKey []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceCurrentGroupEpochKey,
+		hex.EncodeToString(groupPublicKey),
+	})
+}
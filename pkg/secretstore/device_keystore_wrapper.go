@@ -189,6 +189,21 @@ func (a *deviceKeystore) getOrComputeECDH(nameSpace string, publicKey crypto.Pub
 		return nil, errcode.ErrCode_ErrDBRead.Wrap(fmt.Errorf("unable to perform get operation on keystore: %w", err))
 	}
 
+	privateKey, err = computeECDH(publicKey, ownPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.keystore.Put(name, privateKey); err != nil {
+		return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return privateKey, nil
+}
+
+// computeECDH derives a private key via an elliptic-curve Diffie-Hellman key
+// agreement
+func computeECDH(publicKey crypto.PubKey, ownPrivateKey crypto.PrivKey) (crypto.PrivKey, error) {
 	privateKeyBytes, publicKeyBytes, err := cryptoutil.EdwardsToMontgomery(ownPrivateKey, publicKey)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
@@ -197,15 +212,11 @@ func (a *deviceKeystore) getOrComputeECDH(nameSpace string, publicKey crypto.Pub
 	secret := ecdh.X25519().ComputeSecret(privateKeyBytes, publicKeyBytes)
 	groupSecretPrivateKey := ed25519.NewKeyFromSeed(secret)
 
-	privateKey, _, err = crypto.KeyPairFromStdKey(&groupSecretPrivateKey)
+	privateKey, _, err := crypto.KeyPairFromStdKey(&groupSecretPrivateKey)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
 	}
 
-	if err := a.keystore.Put(name, privateKey); err != nil {
-		return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
-	}
-
 	return privateKey, nil
 }
 
@@ -257,3 +268,102 @@ func (a *deviceKeystore) restoreAccountKeys(accountPrivateKeyBytes []byte, accou
 
 	return nil
 }
+
+// exportKeys returns all the keys of the keystore marshalled using the LibP2P
+// format, the account keys are generated if missing
+func (a *deviceKeystore) exportKeys() (map[string][]byte, error) {
+	// the keys identifying the device must be part of the export
+	for _, getKey := range []func() (crypto.PrivKey, error){a.getAccountPrivateKey, a.getAccountProofPrivateKey, a.devicePrivateKey} {
+		if _, err := getKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names, err := a.keystore.List()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	keys := make(map[string][]byte, len(names))
+	for _, name := range names {
+		privateKey, err := a.keystore.Get(name)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		if keys[name], err = crypto.MarshalPrivateKey(privateKey); err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+	}
+
+	return keys, nil
+}
+
+// publicKeys returns the raw public keys of all the keys of the keystore
+func (a *deviceKeystore) publicKeys() (map[string]struct{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names, err := a.keystore.List()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	publicKeys := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		privateKey, err := a.keystore.Get(name)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		publicKey, err := privateKey.GetPublic().Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		publicKeys[string(publicKey)] = struct{}{}
+	}
+
+	return publicKeys, nil
+}
+
+// importKeys restores keys exported by exportKeys into the deviceKeystore, it
+// will fail if account keys are already created or imported into the keystore
+func (a *deviceKeystore) importKeys(keys map[string][]byte) error {
+	for _, keyName := range []string{keyAccount, keyAccountProof, keyDevice} {
+		if keys[keyName] == nil {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing key %s", keyName))
+		}
+	}
+
+	privateKeys := make(map[string]crypto.PrivKey, len(keys))
+	for keyName, keyBytes := range keys {
+		var err error
+		privateKeys[keyName], err = getEd25519PrivateKeyFromLibP2PFormattedBytes(keyBytes)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for keyName := range privateKeys {
+		if exists, err := a.keystore.Has(keyName); err != nil {
+			return errcode.ErrCode_ErrDBRead.Wrap(err)
+		} else if exists {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an account is already set in this keystore"))
+		}
+	}
+
+	for keyName, privateKey := range privateKeys {
+		if err := a.keystore.Put(keyName, privateKey); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
@@ -136,6 +136,74 @@ func Test_DevicePrivKey(t *testing.T) {
 	assert.False(t, memberDevice1.Device().Equals(memberDevice2.Device()))
 }
 
+func Test_ExportDeviceKeystore_ImportDeviceKeystore(t *testing.T) {
+	acc1, err := secretstore.NewInMemSecretStore(nil)
+	assert.NoError(t, err)
+
+	accGroup1, accMemberDevice1, err := acc1.GetGroupForAccount()
+	assert.NoError(t, err)
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	assert.NoError(t, err)
+
+	memberDevice1, err := acc1.GetOwnMemberDeviceForGroup(g)
+	assert.NoError(t, err)
+
+	keys, err := acc1.ExportDeviceKeystore()
+	assert.NoError(t, err)
+
+	acc2, err := secretstore.NewInMemSecretStore(nil)
+	assert.NoError(t, err)
+
+	// Testing with a missing device key
+	{
+		incomplete := map[string][]byte{}
+		for name, key := range keys {
+			incomplete[name] = key
+		}
+		delete(incomplete, "deviceSK")
+
+		assert.Error(t, acc2.ImportDeviceKeystore(incomplete))
+	}
+
+	// Valid test case
+	{
+		assert.NoError(t, acc2.ImportDeviceKeystore(keys))
+	}
+
+	// Attempting to import keys again
+	{
+		assert.Error(t, acc2.ImportDeviceKeystore(keys))
+	}
+
+	// The account and the device keys are the same on both instances
+	accGroup2, accMemberDevice2, err := acc2.GetGroupForAccount()
+	assert.NoError(t, err)
+	assert.Equal(t, accGroup1.PublicKey, accGroup2.PublicKey)
+	assert.True(t, accMemberDevice1.Device().Equals(accMemberDevice2.Device()))
+
+	memberDevice2, err := acc2.GetOwnMemberDeviceForGroup(g)
+	assert.NoError(t, err)
+	assert.True(t, memberDevice1.Member().Equals(memberDevice2.Member()))
+	assert.True(t, memberDevice1.Device().Equals(memberDevice2.Device()))
+
+	// The imported instance signs with the same device key
+	sig, err := memberDevice2.DeviceSign([]byte("payload"))
+	assert.NoError(t, err)
+
+	ok, err := memberDevice1.Device().Verify([]byte("payload"), sig)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// A store which already has an account can't import the keys
+	acc3, err := secretstore.NewInMemSecretStore(nil)
+	assert.NoError(t, err)
+
+	_, _, err = acc3.ExportAccountKeysForBackup()
+	assert.NoError(t, err)
+	assert.Error(t, acc3.ImportDeviceKeystore(keys))
+}
+
 func Test_ContactGroupPrivKey(t *testing.T) {
 	acc1, err := secretstore.NewInMemSecretStore(nil)
 	assert.NoError(t, err)
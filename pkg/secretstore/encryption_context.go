@@ -0,0 +1,79 @@
+package secretstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// EncryptionVersionUnbound is the version of the entries encrypted using
+	// the group secret as is, they can be opened by any group sharing the
+	// same secret
+	EncryptionVersionUnbound uint32 = 0
+
+	// EncryptionVersionGroupBound is the version of the entries encrypted
+	// using a key derived from the group secret and the group public key,
+	// they can only be opened within their group
+	EncryptionVersionGroupBound uint32 = 1
+
+	// EncryptionVersionCurrent is the latest version, used to encrypt the new
+	// entries unless an older one has been negotiated with the peers, see
+	// ContextWithEncryptionVersion
+	EncryptionVersionCurrent = EncryptionVersionGroupBound
+)
+
+// groupBoundKeyInfo prefixes the group public key in the info of the key
+// derivation, it must not change as long as the version exists
+const groupBoundKeyInfo = "weshnet/group-bound-key/v1"
+
+// GroupEncryptionKey returns the key used to encrypt the entries of a group
+// with the given encryption version. The message payloads are not concerned,
+// their keys are already derived using the group public key and the group
+// epoch key.
+func GroupEncryptionKey(g *protocoltypes.Group, version uint32) (*[cryptoutil.KeySize]byte, error) {
+	secret := g.GetSharedSecret()
+
+	switch version {
+	case EncryptionVersionUnbound:
+		return secret, nil
+
+	case EncryptionVersionGroupBound:
+		info := append([]byte(groupBoundKeyInfo), g.GetPublicKey()...)
+
+		var key [cryptoutil.KeySize]byte
+		kdf := hkdf.New(sha256.New, secret[:], nil, info)
+		if _, err := io.ReadFull(kdf, key[:]); err != nil {
+			return nil, errcode.ErrCode_ErrCryptoKeyDerivation.Wrap(err)
+		}
+
+		return &key, nil
+
+	default:
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unsupported encryption version %d", version))
+	}
+}
+
+type encryptionVersionKey struct{}
+
+// ContextWithEncryptionVersion returns a context in which SealEnvelope
+// encrypts the message headers with the given version instead of
+// EncryptionVersionCurrent, e.g. the version negotiated with the peers
+func ContextWithEncryptionVersion(ctx context.Context, version uint32) context.Context {
+	return context.WithValue(ctx, encryptionVersionKey{}, version)
+}
+
+func encryptionVersionFromContext(ctx context.Context) uint32 {
+	if version, ok := ctx.Value(encryptionVersionKey{}).(uint32); ok {
+		return version
+	}
+
+	return EncryptionVersionCurrent
+}
@@ -0,0 +1,95 @@
+package secretstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func Test_GroupEncryptionKey_CrossGroupReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	groupA, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := groupA.GetPubKey()
+	require.NoError(t, err)
+
+	// group B shares the secret of group A
+	other, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	groupB := proto.Clone(groupA).(*protocoltypes.Group)
+	groupB.PublicKey = other.PublicKey
+
+	mkh, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	omd, err := mkh.GetOwnMemberDeviceForGroup(groupA)
+	require.NoError(t, err)
+
+	chainKey, err := mkh.GetShareableChainKey(ctx, groupA, omd.Member())
+	require.NoError(t, err)
+	require.NoError(t, mkh.RegisterChainKey(ctx, groupA, omd.Device(), chainKey))
+
+	payload, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: []byte("group A")})
+	require.NoError(t, err)
+
+	data, err := mkh.SealEnvelope(ctx, groupA, payload)
+	require.NoError(t, err)
+
+	env, headers, err := mkh.OpenEnvelopeHeaders(data, groupA)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionVersionCurrent, env.EncryptionVersion)
+
+	// the entry can't be opened in group B
+	_, _, err = mkh.OpenEnvelopeHeaders(data, groupB)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt))
+
+	// the entries encrypted before the versioning are still opened
+	headersBytes, err := proto.Marshal(headers)
+	require.NoError(t, err)
+
+	nonce, err := cryptoutil.NonceSliceToArray(env.Nonce)
+	require.NoError(t, err)
+
+	legacy := proto.Clone(env).(*protocoltypes.MessageEnvelope)
+	legacy.EncryptionVersion = EncryptionVersionUnbound
+	legacy.MessageHeaders = secretbox.Seal(nil, headersBytes, nonce, groupA.GetSharedSecret())
+
+	legacyData, err := proto.Marshal(legacy)
+	require.NoError(t, err)
+
+	legacyEnv, legacyHeaders, err := mkh.OpenEnvelopeHeaders(legacyData, groupA)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(headers, legacyHeaders))
+
+	msg, err := mkh.OpenEnvelopePayload(ctx, legacyEnv, legacyHeaders, gPK, nil, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, []byte("group A"), msg.Plaintext)
+
+	// the version negotiated with the peers is used when given
+	unboundData, err := mkh.SealEnvelope(ContextWithEncryptionVersion(ctx, EncryptionVersionUnbound), groupA, payload)
+	require.NoError(t, err)
+
+	unboundEnv, _, err := mkh.OpenEnvelopeHeaders(unboundData, groupA)
+	require.NoError(t, err)
+	require.Equal(t, EncryptionVersionUnbound, unboundEnv.EncryptionVersion)
+
+	// the unknown versions are rejected
+	legacy.EncryptionVersion = EncryptionVersionCurrent + 1
+	unknownData, err := proto.Marshal(legacy)
+	require.NoError(t, err)
+
+	_, _, err = mkh.OpenEnvelopeHeaders(unknownData, groupA)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt))
+}
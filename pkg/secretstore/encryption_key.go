@@ -0,0 +1,112 @@
+package secretstore
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/hkdf"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// encryptionKeyPrefix marks the secrets sealed using a dedicated encryption
+// key, see NewSecretStoreOptions.SeparateEncryptionKeys. The raw public part of
+// the encryption key follows the prefix.
+var encryptionKeyPrefix = []byte("wsek")
+
+// encryptionKeyInfo namespaces the derivation of the encryption keys
+const encryptionKeyInfo = "weshnet/device-encryption-key"
+
+// encryptionKeyForGroup derives from the account key the key used by a device
+// to seal the secrets it shares on a group. The key is distinct for each group
+// and device so a nonce is never reused for a given key pair.
+func (a *deviceKeystore) encryptionKeyForGroup(group *protocoltypes.Group, devicePublicKey crypto.PubKey) (crypto.PrivKey, error) {
+	accountPrivateKey, err := a.getAccountPrivateKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	accountPrivateKeyBytes, err := accountPrivateKey.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	devicePublicKeyBytes, err := devicePublicKey.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	info := append([]byte(encryptionKeyInfo), devicePublicKeyBytes...)
+	kdf := hkdf.New(sha256.New, accountPrivateKeyBytes, group.GetPublicKey(), info)
+
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(kdf, seed); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	stdPrivateKey := ed25519.NewKeyFromSeed(seed)
+	privateKey, _, err := crypto.KeyPairFromStdKey(&stdPrivateKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return privateKey, nil
+}
+
+// sealingKeyForGroup returns the key used by the current device to seal the
+// secrets it shares on a group, the device key unless the encryption keys are
+// separated
+func (s *secretStore) sealingKeyForGroup(group *protocoltypes.Group, md *ownMemberDevice) (crypto.PrivKey, error) {
+	if !s.separateEncryptionKeys {
+		return md.device, nil
+	}
+
+	return s.deviceKeystore.encryptionKeyForGroup(group, md.Device())
+}
+
+// wrapSealedSecret prepends the public part of the sealing key to a secret
+// sealed using a dedicated encryption key, the secrets sealed using the device
+// key are returned as is
+func (s *secretStore) wrapSealedSecret(sealingKey crypto.PrivKey, sealed []byte) ([]byte, error) {
+	if !s.separateEncryptionKeys {
+		return sealed, nil
+	}
+
+	sealingPublicKeyBytes, err := sealingKey.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	payload := make([]byte, 0, len(encryptionKeyPrefix)+len(sealingPublicKeyBytes)+len(sealed))
+	payload = append(payload, encryptionKeyPrefix...)
+	payload = append(payload, sealingPublicKeyBytes...)
+
+	return append(payload, sealed...), nil
+}
+
+// openSealedSecret calls open with the public key needed to open a secret sent
+// by a device, regardless of the mode of the sender: the encryption key found
+// in the payload if any, the device key otherwise.
+func openSealedSecret(payload []byte, senderDevicePublicKey crypto.PubKey, open func(sealed []byte, senderPublicKey crypto.PubKey) error) error {
+	headerSize := len(encryptionKeyPrefix) + ed25519.PublicKeySize
+
+	if len(payload) > headerSize && bytes.HasPrefix(payload, encryptionKeyPrefix) {
+		encryptionPublicKey, err := crypto.UnmarshalEd25519PublicKey(payload[len(encryptionKeyPrefix):headerSize])
+		if err == nil && open(payload[headerSize:], encryptionPublicKey) == nil {
+			return nil
+		}
+
+		// a secret sealed using the device key may start with the prefix
+	}
+
+	if err := open(payload, senderDevicePublicKey); err != nil {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open secret: %w", err))
+	}
+
+	return nil
+}
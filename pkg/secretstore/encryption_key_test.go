@@ -0,0 +1,148 @@
+package secretstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func Test_SeparateEncryptionKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	// mkh1 separates its keys, mkh2 uses the default mode
+	mkh1, err := newInMemSecretStore(&NewSecretStoreOptions{SeparateEncryptionKeys: true})
+	require.NoError(t, err)
+	require.True(t, mkh1.EncryptionKeysSeparated())
+
+	mkh2, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	require.False(t, mkh2.EncryptionKeysSeparated())
+
+	omd1, err := mkh1.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	omd2, err := mkh2.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	encryptionKey, err := mkh1.deviceKeystore.encryptionKeyForGroup(g, omd1.Device())
+	require.NoError(t, err)
+	require.False(t, encryptionKey.GetPublic().Equals(omd1.Device()))
+
+	// the key is stable, and distinct for each group
+	sameEncryptionKey, err := mkh1.deviceKeystore.encryptionKeyForGroup(g, omd1.Device())
+	require.NoError(t, err)
+	require.True(t, encryptionKey.Equals(sameEncryptionKey))
+
+	otherGroup, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	otherEncryptionKey, err := mkh1.deviceKeystore.encryptionKeyForGroup(otherGroup, omd1.Device())
+	require.NoError(t, err)
+	require.False(t, encryptionKey.Equals(otherEncryptionKey))
+
+	encryptionPublicKeyBytes, err := encryptionKey.GetPublic().Raw()
+	require.NoError(t, err)
+
+	// the chain key is encrypted using the encryption key
+	ds1For1, err := mkh1.GetShareableChainKey(ctx, g, omd1.Member())
+	require.NoError(t, err)
+	require.NoError(t, mkh1.RegisterChainKey(ctx, g, omd1.Device(), ds1For1))
+
+	ds1For2, err := mkh1.GetShareableChainKey(ctx, g, omd2.Member())
+	require.NoError(t, err)
+
+	sealed := ds1For2[len(encryptionKeyPrefix)+len(encryptionPublicKeyBytes):]
+	require.Equal(t, encryptionKeyPrefix, ds1For2[:len(encryptionKeyPrefix)])
+	require.Equal(t, encryptionPublicKeyBytes, ds1For2[len(encryptionKeyPrefix):len(encryptionKeyPrefix)+len(encryptionPublicKeyBytes)])
+
+	_, err = decryptDeviceChainKey(sealed, g, mkh2.deviceKeystore.mustMemberPrivateKey(t, g), omd1.Device())
+	require.Error(t, err)
+
+	_, err = decryptDeviceChainKey(sealed, g, mkh2.deviceKeystore.mustMemberPrivateKey(t, g), encryptionKey.GetPublic())
+	require.NoError(t, err)
+
+	require.NoError(t, mkh2.RegisterChainKey(ctx, g, omd1.Device(), ds1For2))
+
+	// the keys sent by a device using the default mode are still accepted
+	ds2For1, err := mkh2.GetShareableChainKey(ctx, g, omd1.Member())
+	require.NoError(t, err)
+	require.NoError(t, mkh1.RegisterChainKey(ctx, g, omd2.Device(), ds2For1))
+
+	// the messages are signed using the device key
+	payload, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: []byte("separated keys")})
+	require.NoError(t, err)
+
+	data, err := mkh1.SealEnvelope(ctx, g, payload)
+	require.NoError(t, err)
+
+	env, headers, err := mkh2.OpenEnvelopeHeaders(data, g)
+	require.NoError(t, err)
+	require.Equal(t, omd1.Device(), mustUnmarshalPublicKey(t, headers.DevicePk))
+
+	msg, err := mkh2.OpenEnvelopePayload(ctx, env, headers, gPK, nil, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, []byte("separated keys"), msg.Plaintext)
+
+	ok, err := omd1.Device().Verify(payload, headers.Sig)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = encryptionKey.GetPublic().Verify(payload, headers.Sig)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the epoch keys are encrypted using the encryption key too
+	_, err = mkh1.RotateGroupEpochKey(ctx, g)
+	require.NoError(t, err)
+
+	_, encryptedEpochKey, err := mkh1.GetShareableEpochKey(ctx, g, omd2.Member())
+	require.NoError(t, err)
+	require.Equal(t, encryptionKeyPrefix, encryptedEpochKey[:len(encryptionKeyPrefix)])
+
+	_, err = decryptGroupEpochKey(encryptedEpochKey[len(encryptionKeyPrefix)+len(encryptionPublicKeyBytes):], mkh2.deviceKeystore.mustMemberPrivateKey(t, g), omd1.Device())
+	require.Error(t, err)
+
+	require.NoError(t, mkh2.RegisterEpochKey(ctx, g, omd1.Device(), encryptedEpochKey))
+
+	data, err = mkh1.SealEnvelope(ctx, g, payload)
+	require.NoError(t, err)
+
+	env, headers, err = mkh2.OpenEnvelopeHeaders(data, g)
+	require.NoError(t, err)
+	require.NotEmpty(t, headers.EpochKeyId)
+
+	msg, err = mkh2.OpenEnvelopePayload(ctx, env, headers, gPK, nil, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, []byte("separated keys"), msg.Plaintext)
+}
+
+func (a *deviceKeystore) mustMemberPrivateKey(t *testing.T, g *protocoltypes.Group) crypto.PrivKey {
+	t.Helper()
+
+	md, err := a.memberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	return md.member
+}
+
+func mustUnmarshalPublicKey(t *testing.T, data []byte) crypto.PubKey {
+	t.Helper()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(data)
+	require.NoError(t, err)
+
+	return pk
+}
@@ -0,0 +1,114 @@
+package secretstore
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// epochKeyIDSize is the size of the identifier of an epoch key
+const epochKeyIDSize = 16
+
+// newGroupEpochKey creates a new random epoch key for the given epoch
+func newGroupEpochKey(epoch uint64) (*protocoltypes.GroupEpochKey, error) {
+	secret := make([]byte, 32)
+	_, err := crand.Read(secret)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return &protocoltypes.GroupEpochKey{
+		Epoch:  epoch,
+		Secret: secret,
+	}, nil
+}
+
+// epochKeyID returns the identifier of an epoch key, it is included in the
+// headers of the messages encrypted using this key
+func epochKeyID(epochKey *protocoltypes.GroupEpochKey) []byte {
+	sum := sha256.Sum256(epochKey.Secret)
+	return sum[:epochKeyIDSize]
+}
+
+// encryptGroupEpochKey encrypts an epoch key for a target member
+func encryptGroupEpochKey(localDevicePrivateKey crypto.PrivKey, remoteMemberPubKey crypto.PubKey, epochKey *protocoltypes.GroupEpochKey) ([]byte, error) {
+	epochKeyBytes, err := proto.Marshal(epochKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	mongPriv, mongPub, err := cryptoutil.EdwardsToMontgomery(localDevicePrivateKey, remoteMemberPubKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	// Unlike chain keys, several epoch keys can be sent by a device to the
+	// same member, the group ID can't be used as a nonce here.
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return box.Seal(nonce[:], epochKeyBytes, nonce, mongPub, mongPriv), nil
+}
+
+// decryptGroupEpochKey decrypts an epoch key sent by the given device
+func decryptGroupEpochKey(encryptedEpochKey []byte, localMemberPrivateKey crypto.PrivKey, senderDevicePubKey crypto.PubKey) (*protocoltypes.GroupEpochKey, error) {
+	if len(encryptedEpochKey) < cryptoutil.NonceSize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("encrypted epoch key is too short"))
+	}
+
+	mongPriv, mongPub, err := cryptoutil.EdwardsToMontgomery(localMemberPrivateKey, senderDevicePubKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(encryptedEpochKey[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	decryptedMessage, ok := box.Open(nil, encryptedEpochKey[cryptoutil.NonceSize:], nonce, mongPub, mongPriv)
+	if !ok {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to decrypt epoch key"))
+	}
+
+	epochKey := &protocoltypes.GroupEpochKey{}
+	if err := proto.Unmarshal(decryptedMessage, epochKey); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if len(epochKey.Secret) != cryptoutil.KeySize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid epoch key size, expected %d got %d", cryptoutil.KeySize, len(epochKey.Secret)))
+	}
+
+	return epochKey, nil
+}
+
+// applyEpochKey derives a message key bound to the given epoch key, a message
+// encrypted using the derived key can't be opened using the device chain key
+// alone
+func applyEpochKey(msgKey *messageKey, epochKey *protocoltypes.GroupEpochKey, groupID []byte) (*messageKey, error) {
+	if epochKey == nil {
+		return msgKey, nil
+	}
+
+	var derived messageKey
+
+	kdf := hkdf.New(sha256.New, epochKey.Secret, msgKey[:], groupID)
+	if _, err := io.ReadFull(kdf, derived[:]); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	return &derived, nil
+}
@@ -82,6 +82,42 @@ func getKeysForGroupOfContact(contactPairPrivateKey crypto.PrivKey) (crypto.Priv
 	return groupPrivateKey, groupSecretPrivateKey, nil
 }
 
+// getGroupForAccount returns the account group of the given account keys
+func getGroupForAccount(accountPrivateKey, accountProofPrivateKey crypto.PrivKey) (*protocoltypes.Group, error) {
+	pubBytes, err := accountPrivateKey.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	signingBytes, err := cryptoutil.SeedFromEd25519PrivateKey(accountProofPrivateKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return &protocoltypes.Group{
+		PublicKey: pubBytes,
+		Secret:    signingBytes,
+		SecretSig: nil,
+		GroupType: protocoltypes.GroupType_GroupTypeAccount,
+	}, nil
+}
+
+// GetGroupForAccountKeys returns the account group of the account keys
+// exported by ExportAccountKeysForBackup
+func GetGroupForAccountKeys(accountPrivateKeyBytes []byte, accountProofPrivateKeyBytes []byte) (*protocoltypes.Group, error) {
+	accountPrivateKey, err := getEd25519PrivateKeyFromLibP2PFormattedBytes(accountPrivateKeyBytes)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountProofPrivateKey, err := getEd25519PrivateKeyFromLibP2PFormattedBytes(accountProofPrivateKeyBytes)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return getGroupForAccount(accountPrivateKey, accountProofPrivateKey)
+}
+
 // getGroupForContact returns a protocoltypes.Group instance for a contact,
 // using a private key via two accounts account keys (via an ECDH)
 func getGroupForContact(contactPairPrivateKey crypto.PrivKey) (*protocoltypes.Group, error) {
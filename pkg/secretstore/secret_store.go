@@ -34,6 +34,18 @@ type secretStore struct {
 
 	preComputedKeysCount               int
 	precomputeOutOfStoreGroupRefsCount uint64
+
+	// lenientSignatures accepts the messages with an invalid signature, see
+	// NewSecretStoreOptions.DisableStrictSignatureVerification
+	lenientSignatures bool
+
+	// separateEncryptionKeys seals the shared secrets using a key distinct
+	// from the device key, see NewSecretStoreOptions.SeparateEncryptionKeys
+	separateEncryptionKeys bool
+
+	// cipherSuites are the suites used to encrypt and open the group
+	// entries, see NewSecretStoreOptions.CipherSuites
+	cipherSuites *CipherSuites
 }
 
 func (o *NewSecretStoreOptions) applyDefaults(rootDatastore datastore.Datastore) {
@@ -71,6 +83,11 @@ func newSecretStore(rootDatastore datastore.Datastore, opts *NewSecretStoreOptio
 
 	opts.applyDefaults(rootDatastore)
 
+	cipherSuites, err := NewCipherSuites(opts.SealingCipherSuite, opts.CipherSuites...)
+	if err != nil {
+		return nil, err
+	}
+
 	devKeystore := newDeviceKeystore(opts.Keystore, opts.Logger)
 
 	store := &secretStore{
@@ -80,6 +97,9 @@ func newSecretStore(rootDatastore datastore.Datastore, opts *NewSecretStoreOptio
 
 		preComputedKeysCount:               opts.PreComputedKeysCount,
 		precomputeOutOfStoreGroupRefsCount: uint64(opts.PrecomputeOutOfStoreGroupRefsCount),
+		lenientSignatures:                  opts.DisableStrictSignatureVerification,
+		separateEncryptionKeys:             opts.SeparateEncryptionKeys,
+		cipherSuites:                       cipherSuites,
 	}
 
 	return store, nil
@@ -95,6 +115,18 @@ func newInMemSecretStore(opts *NewSecretStoreOptions) (*secretStore, error) {
 	return newSecretStore(dssync.MutexWrap(datastore.NewMapDatastore()), opts)
 }
 
+func (s *secretStore) EncryptionKeysSeparated() bool {
+	return s.separateEncryptionKeys
+}
+
+func (s *secretStore) CipherSuites() *CipherSuites {
+	if s == nil {
+		return nil
+	}
+
+	return s.cipherSuites
+}
+
 func (s *secretStore) Close() error {
 	return nil
 }
@@ -252,6 +284,14 @@ func (s *secretStore) ExportAccountKeysForBackup() (accountPrivateKeyBytes []byt
 	return accountPrivateKeyBytes, accountProofPrivateKeyBytes, nil
 }
 
+func (s *secretStore) ExportDeviceKeystore() (map[string][]byte, error) {
+	return s.deviceKeystore.exportKeys()
+}
+
+func (s *secretStore) ImportDeviceKeystore(keys map[string][]byte) error {
+	return s.deviceKeystore.importKeys(keys)
+}
+
 func (s *secretStore) GetAccountPrivateKey() (crypto.PrivKey, error) {
 	accountPrivateKey, err := s.deviceKeystore.getAccountPrivateKey()
 	if err != nil {
@@ -277,22 +317,12 @@ func (s *secretStore) GetGroupForAccount() (*protocoltypes.Group, OwnMemberDevic
 		return nil, nil, errcode.ErrCode_ErrInternal.Wrap(err)
 	}
 
-	pubBytes, err := accountPrivateKey.GetPublic().Raw()
-	if err != nil {
-		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
-	}
-
-	signingBytes, err := cryptoutil.SeedFromEd25519PrivateKey(accountProofPrivateKey)
+	g, err := getGroupForAccount(accountPrivateKey, accountProofPrivateKey)
 	if err != nil {
-		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		return nil, nil, err
 	}
 
-	return &protocoltypes.Group{
-		PublicKey: pubBytes,
-		Secret:    signingBytes,
-		SecretSig: nil,
-		GroupType: protocoltypes.GroupType_GroupTypeAccount,
-	}, newOwnMemberDevice(accountPrivateKey, devicePrivateKey), nil
+	return g, newOwnMemberDevice(accountPrivateKey, devicePrivateKey), nil
 }
 
 func (s *secretStore) GetGroupForContact(contactPublicKey crypto.PubKey) (*protocoltypes.Group, error) {
@@ -316,9 +346,19 @@ func (s *secretStore) OpenEnvelopeHeaders(data []byte, g *protocoltypes.Group) (
 		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(fmt.Errorf("unable to convert slice to array: %w", err))
 	}
 
-	headersBytes, ok := secretbox.Open(nil, env.MessageHeaders, nonce, g.GetSharedSecret())
-	if !ok {
-		return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("secretbox failed to open headers"))
+	key, err := GroupEncryptionKey(g, env.EncryptionVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	suite, err := s.CipherSuites().Get(env.CipherSuite)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	headersBytes, err := suite.Open(env.MessageHeaders, nonce, key)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open headers: %w", err))
 	}
 
 	headers := &protocoltypes.MessageHeaders{}
@@ -337,6 +377,8 @@ func (s *secretStore) SealOutOfStoreMessageEnvelope(id cid.Cid, env *protocoltyp
 		Sig:              headers.Sig,
 		EncryptedPayload: env.Message,
 		Nonce:            env.Nonce,
+		EpochKeyId:       headers.EpochKeyId,
+		CipherSuite:      env.CipherSuite,
 	}
 
 	data, err := proto.Marshal(oosMessage)
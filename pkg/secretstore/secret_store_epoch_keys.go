@@ -0,0 +1,211 @@
+package secretstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// RotateGroupEpochKey generates a new epoch key for the given group and uses
+// it to encrypt the next messages sent on the group.
+// The new key must then be shared with the other group members using
+// GetShareableEpochKey.
+func (s *secretStore) RotateGroupEpochKey(ctx context.Context, group *protocoltypes.Group) (uint64, error) {
+	if s == nil {
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	if group == nil {
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group cannot be nil"))
+	}
+
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	current, err := s.getCurrentGroupEpochKey(ctx, group.PublicKey)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	epoch := uint64(1)
+	if current != nil {
+		epoch = current.Epoch + 1
+	}
+
+	epochKey, err := newGroupEpochKey(epoch)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	if err := s.putGroupEpochKey(ctx, group.PublicKey, epochKey); err != nil {
+		return 0, errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return epoch, nil
+}
+
+// GetShareableEpochKey returns the current epoch key of the group encrypted
+// for the given member.
+// If the group has never been rekeyed, a zero epoch and a nil key are
+// returned.
+func (s *secretStore) GetShareableEpochKey(ctx context.Context, group *protocoltypes.Group, targetMemberPublicKey crypto.PubKey) (uint64, []byte, error) {
+	if s == nil {
+		return 0, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	if s.deviceKeystore == nil {
+		return 0, nil, errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	s.messageMutex.RLock()
+	epochKey, err := s.getCurrentGroupEpochKey(ctx, group.PublicKey)
+	s.messageMutex.RUnlock()
+
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	if epochKey == nil {
+		return 0, nil, nil
+	}
+
+	privateMemberDevice, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	sealingKey, err := s.sealingKeyForGroup(group, privateMemberDevice)
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedEpochKey, err := encryptGroupEpochKey(sealingKey, targetMemberPublicKey, epochKey)
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	encryptedEpochKey, err = s.wrapSealedSecret(sealingKey, encryptedEpochKey)
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	return epochKey.Epoch, encryptedEpochKey, nil
+}
+
+// RegisterEpochKey decrypts and records an epoch key sent by another device.
+// The key becomes the current one if its epoch is greater than the epoch of
+// the current key.
+func (s *secretStore) RegisterEpochKey(ctx context.Context, group *protocoltypes.Group, senderDevicePublicKey crypto.PubKey, encryptedEpochKey []byte) error {
+	if s == nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	if s.deviceKeystore == nil {
+		return errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	localMemberDevice, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	var epochKey *protocoltypes.GroupEpochKey
+	if err := openSealedSecret(encryptedEpochKey, senderDevicePublicKey, func(sealed []byte, senderPublicKey crypto.PubKey) (err error) {
+		epochKey, err = decryptGroupEpochKey(sealed, localMemberDevice.member, senderPublicKey)
+		return err
+	}); err != nil {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	if err := s.putGroupEpochKey(ctx, group.PublicKey, epochKey); err != nil {
+		return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return nil
+}
+
+// getGroupEpochKey returns the epoch key with the given identifier for a
+// group.
+func (s *secretStore) getGroupEpochKey(ctx context.Context, groupPublicKey []byte, keyID []byte) (*protocoltypes.GroupEpochKey, error) {
+	// Not mutex here
+	data, err := s.datastore.Get(ctx, dsKeyForGroupEpochKey(groupPublicKey, keyID))
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("unknown epoch key"))
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	epochKey := &protocoltypes.GroupEpochKey{}
+	if err := proto.Unmarshal(data, epochKey); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return epochKey, nil
+}
+
+// getCurrentGroupEpochKey returns the epoch key used to encrypt new messages
+// of a group, or nil if the group has never been rekeyed.
+func (s *secretStore) getCurrentGroupEpochKey(ctx context.Context, groupPublicKey []byte) (*protocoltypes.GroupEpochKey, error) {
+	// Not mutex here
+	keyID, err := s.datastore.Get(ctx, dsKeyForCurrentGroupEpochKey(groupPublicKey))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	return s.getGroupEpochKey(ctx, groupPublicKey, keyID)
+}
+
+// putGroupEpochKey stores an epoch key for a group and promotes it as the
+// current one when it supersedes it.
+// When two keys share the same epoch (e.g. two admins rekeyed concurrently),
+// the one with the lowest identifier wins so all members eventually agree.
+func (s *secretStore) putGroupEpochKey(ctx context.Context, groupPublicKey []byte, epochKey *protocoltypes.GroupEpochKey) error {
+	// Not mutex here
+	data, err := proto.Marshal(epochKey)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	keyID := epochKeyID(epochKey)
+	if err := s.datastore.Put(ctx, dsKeyForGroupEpochKey(groupPublicKey, keyID), data); err != nil {
+		return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	current, err := s.getCurrentGroupEpochKey(ctx, groupPublicKey)
+	if err != nil {
+		return errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	if current != nil {
+		if current.Epoch > epochKey.Epoch {
+			return nil
+		}
+
+		if current.Epoch == epochKey.Epoch && bytes.Compare(epochKeyID(current), keyID) <= 0 {
+			return nil
+		}
+	}
+
+	s.logger.Debug("updating current group epoch key",
+		logutil.PrivateBinary("groupPublicKey", groupPublicKey),
+	)
+
+	if err := s.datastore.Put(ctx, dsKeyForCurrentGroupEpochKey(groupPublicKey), keyID); err != nil {
+		return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return nil
+}
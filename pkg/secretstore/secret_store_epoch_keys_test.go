@@ -0,0 +1,133 @@
+package secretstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func Test_RotateGroupEpochKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	// mkh1 rekeys the group, mkh2 is a member receiving the new key, mkh3
+	// only knows the chain key of mkh1
+	stores := make([]*secretStore, 3)
+	for i := range stores {
+		stores[i], err = newInMemSecretStore(nil)
+		require.NoError(t, err)
+	}
+
+	mkh1, mkh2, mkh3 := stores[0], stores[1], stores[2]
+
+	omd1, err := mkh1.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	omd2, err := mkh2.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	omd3, err := mkh3.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	ds1For1, err := mkh1.GetShareableChainKey(ctx, g, omd1.Member())
+	require.NoError(t, err)
+	require.NoError(t, mkh1.RegisterChainKey(ctx, g, omd1.Device(), ds1For1))
+
+	ds1For2, err := mkh1.GetShareableChainKey(ctx, g, omd2.Member())
+	require.NoError(t, err)
+	require.NoError(t, mkh2.RegisterChainKey(ctx, g, omd1.Device(), ds1For2))
+
+	ds1For3, err := mkh1.GetShareableChainKey(ctx, g, omd3.Member())
+	require.NoError(t, err)
+	require.NoError(t, mkh3.RegisterChainKey(ctx, g, omd1.Device(), ds1For3))
+
+	open := func(store *secretStore, data []byte, id cid.Cid) ([]byte, error) {
+		env, headers, err := store.OpenEnvelopeHeaders(data, g)
+		require.NoError(t, err)
+
+		msg, err := store.OpenEnvelopePayload(ctx, env, headers, gPK, nil, id)
+		if err != nil {
+			return nil, err
+		}
+
+		return msg.Plaintext, nil
+	}
+
+	seal := func(plaintext []byte) []byte {
+		payload, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: plaintext})
+		require.NoError(t, err)
+
+		data, err := mkh1.SealEnvelope(ctx, g, payload)
+		require.NoError(t, err)
+
+		return data
+	}
+
+	// no epoch key has been shared yet
+	epoch, encryptedEpochKey, err := mkh1.GetShareableEpochKey(ctx, g, omd2.Member())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), epoch)
+	require.Nil(t, encryptedEpochKey)
+
+	beforeRekeyCID, err := cid.Parse("QmbdQXQh9B2bWZgZJqfbjNPV5jGN2owbQ3vjeYsaDaCDqU")
+	require.NoError(t, err)
+
+	beforeRekey := seal([]byte("before rekey"))
+
+	clear, err := open(mkh2, beforeRekey, beforeRekeyCID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before rekey"), clear)
+
+	clear, err = open(mkh3, beforeRekey, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before rekey"), clear)
+
+	// rekey the group and only share the new key with mkh2
+	epoch, err = mkh1.RotateGroupEpochKey(ctx, g)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), epoch)
+
+	epoch, encryptedEpochKey, err = mkh1.GetShareableEpochKey(ctx, g, omd2.Member())
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), epoch)
+	require.NoError(t, mkh2.RegisterEpochKey(ctx, g, omd1.Device(), encryptedEpochKey))
+
+	// mkh3 can't register a key which has been encrypted for mkh2
+	require.Error(t, mkh3.RegisterEpochKey(ctx, g, omd1.Device(), encryptedEpochKey))
+
+	afterRekey := seal([]byte("after rekey"))
+
+	_, headers, err := mkh1.OpenEnvelopeHeaders(afterRekey, g)
+	require.NoError(t, err)
+	require.NotEmpty(t, headers.EpochKeyId)
+
+	clear, err = open(mkh2, afterRekey, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after rekey"), clear)
+
+	_, err = open(mkh3, afterRekey, cid.Undef)
+	require.Error(t, err)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrCryptoDecryptPayload))
+
+	// messages sent before the rekey remain readable
+	clear, err = open(mkh2, beforeRekey, beforeRekeyCID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before rekey"), clear)
+
+	// a second rotation increments the epoch
+	epoch, err = mkh1.RotateGroupEpochKey(ctx, g)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), epoch)
+}
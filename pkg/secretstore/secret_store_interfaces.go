@@ -32,6 +32,18 @@ type SecretStore interface {
 	// ExportAccountKeysForBackup returns the account's private key and proof private key of the user for a backup
 	ExportAccountKeysForBackup() (accountPrivateKey []byte, accountProofPrivateKey []byte, err error)
 
+	// ExportDeviceKeystore returns all the private keys of the device, including its device keys, indexed by their name in the keystore, they allow the device to be moved to another instance
+	ExportDeviceKeystore() (keys map[string][]byte, err error)
+
+	// ImportDeviceKeystore restores the keys returned by ExportDeviceKeystore, it should fail if the store is already used by an account
+	ImportDeviceKeystore(keys map[string][]byte) error
+
+	// ExportOwnChainKeys returns the chain keys of the devices of the keystore along with their counters, they are moved to another instance along with the keys returned by ExportDeviceKeystore
+	ExportOwnChainKeys(ctx context.Context) (chainKeys []*protocoltypes.DeviceChainKeyExport, err error)
+
+	// ImportOwnChainKeys restores the chain keys returned by ExportOwnChainKeys, the keys of their devices must have been imported using ImportDeviceKeystore beforehand
+	ImportOwnChainKeys(ctx context.Context, chainKeys []*protocoltypes.DeviceChainKeyExport) error
+
 	// GetAccountPrivateKey returns the account's private key, avoid using it, use GetGroupForAccount to get the account public key or sign data instead
 	GetAccountPrivateKey() (accountPrivateKey crypto.PrivKey, err error)
 
@@ -64,6 +76,18 @@ type SecretStore interface {
 	// SealEnvelope creates an encrypted payload to be sent to a group
 	SealEnvelope(ctx context.Context, group *protocoltypes.Group, messagePayload []byte) (sealedEnvelope []byte, err error)
 
+	// ExportMessageKeys returns the keys of the given messages, the messages which haven't been opened yet are skipped
+	ExportMessageKeys(ctx context.Context, msgCIDs []cid.Cid) (keys []*protocoltypes.MessageKeyExport, err error)
+
+	// ImportMessageKeys records the keys of messages opened by another device, these messages can then be opened without the chain key of their device
+	ImportMessageKeys(ctx context.Context, keys []*protocoltypes.MessageKeyExport) error
+
+	// IsMessageKeyKnown checks whether the key of a message is already known
+	IsMessageKeyKnown(ctx context.Context, msgCID cid.Cid) (isKnown bool)
+
+	// DeleteMessageKeys deletes the keys of the given messages, these messages can't be opened anymore
+	DeleteMessageKeys(ctx context.Context, msgCIDs []cid.Cid) error
+
 	//
 	// Group member-device pairs methods
 	//
@@ -84,6 +108,19 @@ type SecretStore interface {
 	// IsChainKeyKnownForDevice checks whether a chain key of a device is already known
 	IsChainKeyKnownForDevice(ctx context.Context, groupPublicKey crypto.PubKey, devicePublicKey crypto.PubKey) (isKnown bool)
 
+	//
+	// Epoch-keys methods
+	//
+
+	// RotateGroupEpochKey generates a new epoch key used to encrypt the next messages sent on the group
+	RotateGroupEpochKey(ctx context.Context, group *protocoltypes.Group) (epoch uint64, err error)
+
+	// GetShareableEpochKey returns the current epoch key of a group that can be decrypted by the provided member, the epoch is 0 if the group has never been rekeyed
+	GetShareableEpochKey(ctx context.Context, group *protocoltypes.Group, targetMemberPublicKey crypto.PubKey) (epoch uint64, encryptedEpochKey []byte, err error)
+
+	// RegisterEpochKey records an epoch key sent by another device
+	RegisterEpochKey(ctx context.Context, group *protocoltypes.Group, senderDevicePublicKey crypto.PubKey, encryptedEpochKey []byte) error
+
 	//
 	// Out-of-store messages methods
 	//
@@ -97,6 +134,19 @@ type SecretStore interface {
 	// UpdateOutOfStoreGroupReferences computes references of messages which might be received outside a synchronized store
 	UpdateOutOfStoreGroupReferences(ctx context.Context, devicePublicKeyBytes []byte, first uint64, group *protocoltypes.Group) error
 
+	//
+	// Integrity methods
+	//
+
+	// VerifyKeystore re-derives the device, proof and group keys from the account keys and reports the stored values not matching them, it doesn't modify the store
+	VerifyKeystore(ctx context.Context) (report *KeystoreReport, err error)
+
+	// EncryptionKeysSeparated returns whether the shared secrets are encrypted using a key distinct from the device key, see NewSecretStoreOptions.SeparateEncryptionKeys
+	EncryptionKeysSeparated() bool
+
+	// CipherSuites returns the cipher suites used to encrypt and open the group entries, see NewSecretStoreOptions.CipherSuites
+	CipherSuites() *CipherSuites
+
 	// Close frees resources created by the secret store
 	Close() error
 }
@@ -122,6 +172,28 @@ type NewSecretStoreOptions struct {
 	// DisableOutOfStoreSupport explicitly disables support of out-of-store
 	// payloads
 	DisableOutOfStoreSupport bool
+
+	// DisableStrictSignatureVerification accepts the messages failing the
+	// signature verification instead of rejecting them, a warning is logged
+	// for each of them. It must only be used for debugging.
+	DisableStrictSignatureVerification bool
+
+	// SeparateEncryptionKeys encrypts the chain and epoch keys shared with the
+	// other members using a key derived from the account key instead of the
+	// device key, which is then only used to sign. The keys shared by the
+	// devices not using this mode can still be opened.
+	SeparateEncryptionKeys bool
+
+	// CipherSuites are the cipher suites supported to open the metadata
+	// events and the messages of the groups in addition to the default one.
+	// The entries encrypted using another suite can't be opened and are
+	// skipped.
+	CipherSuites []CipherSuite
+
+	// SealingCipherSuite is the cipher suite used to encrypt the new
+	// metadata events and messages, the default one if nil. All the members
+	// must support it, it doesn't need to be listed in CipherSuites.
+	SealingCipherSuite CipherSuite
 }
 
 // MemberDevice is the public keys of a device and its member
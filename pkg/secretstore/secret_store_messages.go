@@ -4,15 +4,16 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
 	"google.golang.org/protobuf/proto"
 
 	"berty.tech/weshnet/v2/pkg/cryptoutil"
@@ -166,12 +167,17 @@ func (s *secretStore) GetShareableChainKey(ctx context.Context, group *protocolt
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	encryptedDeviceChainKey, err := encryptDeviceChainKey(privateMemberDevice.device, targetMemberPublicKey, deviceChainKey, group)
+	sealingKey, err := s.sealingKeyForGroup(group, privateMemberDevice)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedDeviceChainKey, err := encryptDeviceChainKey(sealingKey, targetMemberPublicKey, deviceChainKey, group)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
 	}
 
-	return encryptedDeviceChainKey, nil
+	return s.wrapSealedSecret(sealingKey, encryptedDeviceChainKey)
 }
 
 // getOwnDeviceChainKeyForGroup returns the device chain key for the current
@@ -239,8 +245,11 @@ func (s *secretStore) RegisterChainKey(ctx context.Context, group *protocoltypes
 		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
 	}
 
-	deviceChainKey, err := decryptDeviceChainKey(encryptedDeviceChainKey, group, localMemberDevice.member, senderDevicePublicKey)
-	if err != nil {
+	var deviceChainKey *protocoltypes.DeviceChainKey
+	if err := openSealedSecret(encryptedDeviceChainKey, senderDevicePublicKey, func(sealed []byte, senderPublicKey crypto.PubKey) (err error) {
+		deviceChainKey, err = decryptDeviceChainKey(sealed, group, localMemberDevice.member, senderPublicKey)
+		return err
+	}); err != nil {
 		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
 	}
 
@@ -538,7 +547,12 @@ func (s *secretStore) OpenEnvelopePayload(ctx context.Context, msgEnvelope *prot
 	s.messageMutex.Lock()
 	defer s.messageMutex.Unlock()
 
-	msgBytes, decryptionCtx, err := s.openPayload(ctx, msgCID, groupPublicKey, msgEnvelope.Message, msgHeaders)
+	suite, err := s.cipherSuites.Get(msgEnvelope.CipherSuite)
+	if err != nil {
+		return nil, err
+	}
+
+	msgBytes, decryptionCtx, err := s.openPayload(ctx, suite, msgCID, groupPublicKey, msgEnvelope.Message, msgHeaders)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoDecryptPayload.Wrap(err)
 	}
@@ -560,7 +574,7 @@ func (s *secretStore) OpenEnvelopePayload(ctx context.Context, msgEnvelope *prot
 // decrypted message.
 // It retrieves the message key from the keystore or the cache to decrypt
 // the message.
-func (s *secretStore) openPayload(ctx context.Context, msgCID cid.Cid, groupPublicKey crypto.PubKey, payload []byte, msgHeaders *protocoltypes.MessageHeaders) ([]byte, *decryptionContext, error) {
+func (s *secretStore) openPayload(ctx context.Context, suite CipherSuite, msgCID cid.Cid, groupPublicKey crypto.PubKey, payload []byte, msgHeaders *protocoltypes.MessageHeaders) ([]byte, *decryptionContext, error) {
 	if s == nil {
 		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
 	}
@@ -574,6 +588,12 @@ func (s *secretStore) openPayload(ctx context.Context, msgCID cid.Cid, groupPubl
 		publicKey crypto.PubKey
 	)
 
+	if msgCID.Defined() {
+		if deleted, _ := s.datastore.Has(ctx, dsKeyForDeletedMessageKey(msgCID)); deleted {
+			return nil, nil, errcode.ErrCode_ErrMessageKeyDeleted.Wrap(fmt.Errorf("the key of message %s has been deleted", msgCID))
+		}
+	}
+
 	if decryptionCtx.messageKey, err = s.getKeyForCID(ctx, msgCID); err == nil {
 		decryptionCtx.newlyDecrypted = false
 	} else {
@@ -586,25 +606,28 @@ func (s *secretStore) openPayload(ctx context.Context, msgCID cid.Cid, groupPubl
 		if err != nil {
 			return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
 		}
+
+		decryptionCtx.messageKey, err = s.applyEpochKeyForID(ctx, groupPublicKey, decryptionCtx.messageKey, msgHeaders.EpochKeyId)
+		if err != nil {
+			return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+		}
 	}
 
-	return s.openPayloadWithMessageKey(decryptionCtx, publicKey, payload, msgHeaders)
+	return s.openPayloadWithMessageKey(suite, decryptionCtx, publicKey, payload, msgHeaders)
 }
 
 // openPayloadWithMessageKey opens the payload of a message envelope with the
 // given key and returns the decrypted message with the decryptionContext
 // struct.
-func (s *secretStore) openPayloadWithMessageKey(decryptionCtx *decryptionContext, devicePublicKey crypto.PubKey, payload []byte, headers *protocoltypes.MessageHeaders) ([]byte, *decryptionContext, error) {
-	msg, ok := secretbox.Open(nil, payload, uint64AsNonce(headers.Counter), (*[32]byte)(decryptionCtx.messageKey))
-	if !ok {
-		return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("secret box failed to open message payload"))
+func (s *secretStore) openPayloadWithMessageKey(suite CipherSuite, decryptionCtx *decryptionContext, devicePublicKey crypto.PubKey, payload []byte, headers *protocoltypes.MessageHeaders) ([]byte, *decryptionContext, error) {
+	msg, err := suite.Open(payload, uint64AsNonce(headers.Counter), (*[32]byte)(decryptionCtx.messageKey))
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open message payload: %w", err))
 	}
 
 	if decryptionCtx.newlyDecrypted {
-		if ok, err := devicePublicKey.Verify(msg, headers.Sig); !ok {
-			return nil, nil, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("unable to verify message signature"))
-		} else if err != nil {
-			return nil, nil, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+		if err := s.verifyMessageSignature(devicePublicKey, msg, headers.Sig); err != nil {
+			return nil, nil, err
 		}
 	}
 
@@ -613,6 +636,46 @@ func (s *secretStore) openPayloadWithMessageKey(decryptionCtx *decryptionContext
 	return msg, decryptionCtx, nil
 }
 
+// verifyMessageSignature checks the signature of a message by its device, the
+// failure is only logged if the strict verification is disabled
+func (s *secretStore) verifyMessageSignature(devicePublicKey crypto.PubKey, msg []byte, sig []byte) error {
+	ok, err := devicePublicKey.Verify(msg, sig)
+	if err == nil && !ok {
+		err = fmt.Errorf("unable to verify message signature")
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	if s.lenientSignatures {
+		s.logger.Warn("accepting a message with an invalid signature, strict verification is disabled", zap.Error(err))
+		return nil
+	}
+
+	return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+}
+
+// applyEpochKeyForID binds a message key to the group epoch key with the given
+// identifier, the message key is returned as is if no identifier is provided.
+func (s *secretStore) applyEpochKeyForID(ctx context.Context, groupPublicKey crypto.PubKey, msgKey *messageKey, epochKeyID []byte) (*messageKey, error) {
+	if len(epochKeyID) == 0 {
+		return msgKey, nil
+	}
+
+	groupPublicKeyRaw, err := groupPublicKey.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	epochKey, err := s.getGroupEpochKey(ctx, groupPublicKeyRaw, epochKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyEpochKey(msgKey, epochKey, groupPublicKeyRaw)
+}
+
 // getKeyForCID retrieves the message key for the given message CID.
 func (s *secretStore) getKeyForCID(ctx context.Context, msgCID cid.Cid) (*messageKey, error) {
 	if s == nil {
@@ -637,6 +700,209 @@ func (s *secretStore) getKeyForCID(ctx context.Context, msgCID cid.Cid) (*messag
 	return (*messageKey)(msgKeyArray), nil
 }
 
+// ExportMessageKeys returns the keys of the given messages, the messages which
+// haven't been opened yet are skipped.
+func (s *secretStore) ExportMessageKeys(ctx context.Context, msgCIDs []cid.Cid) ([]*protocoltypes.MessageKeyExport, error) {
+	if s == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	s.messageMutex.RLock()
+	defer s.messageMutex.RUnlock()
+
+	keys := []*protocoltypes.MessageKeyExport(nil)
+	for _, msgCID := range msgCIDs {
+		msgKey, err := s.datastore.Get(ctx, dsKeyForMessageKeyByCID(msgCID))
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+		}
+
+		keys = append(keys, &protocoltypes.MessageKeyExport{
+			Cid: msgCID.Bytes(),
+			Key: msgKey,
+		})
+	}
+
+	return keys, nil
+}
+
+// ImportMessageKeys records the keys of messages opened by another device.
+func (s *secretStore) ImportMessageKeys(ctx context.Context, keys []*protocoltypes.MessageKeyExport) error {
+	if s == nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	for _, key := range keys {
+		msgCID, err := cid.Cast(key.Cid)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		msgKey, err := cryptoutil.KeySliceToArray(key.Key)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if deleted, _ := s.datastore.Has(ctx, dsKeyForDeletedMessageKey(msgCID)); deleted {
+			continue
+		}
+
+		if err := s.putKeyForCID(ctx, msgCID, (*messageKey)(msgKey)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportOwnChainKeys returns the chain keys of the devices of the keystore,
+// the chain keys of the other devices are left out.
+func (s *secretStore) ExportOwnChainKeys(ctx context.Context) ([]*protocoltypes.DeviceChainKeyExport, error) {
+	if s == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	ownDevices, err := s.deviceKeystore.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	s.messageMutex.RLock()
+	defer s.messageMutex.RUnlock()
+
+	results, err := s.datastore.Query(ctx, query.Query{
+		Prefix: datastore.NewKey(dsNamespaceChainKeyForDeviceOnGroup).String(),
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+	defer results.Close()
+
+	chainKeys := []*protocoltypes.DeviceChainKeyExport(nil)
+	for res := range results.Next() {
+		if res.Error != nil {
+			return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(res.Error)
+		}
+
+		namespaces := datastore.NewKey(res.Key).Namespaces()
+		if len(namespaces) != 3 {
+			continue
+		}
+
+		groupPK, err := hex.DecodeString(namespaces[1])
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		devicePK, err := hex.DecodeString(namespaces[2])
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if _, ok := ownDevices[string(devicePK)]; !ok {
+			continue
+		}
+
+		chainKey := &protocoltypes.DeviceChainKey{}
+		if err := proto.Unmarshal(res.Value, chainKey); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		chainKeys = append(chainKeys, &protocoltypes.DeviceChainKeyExport{
+			GroupPk:  groupPK,
+			DevicePk: devicePK,
+			ChainKey: chainKey,
+		})
+	}
+
+	return chainKeys, nil
+}
+
+// ImportOwnChainKeys restores the chain keys of the devices of the keystore,
+// the chain keys of unknown devices are rejected.
+func (s *secretStore) ImportOwnChainKeys(ctx context.Context, chainKeys []*protocoltypes.DeviceChainKeyExport) error {
+	if s == nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	ownDevices, err := s.deviceKeystore.publicKeys()
+	if err != nil {
+		return err
+	}
+
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	for _, chainKey := range chainKeys {
+		if _, ok := ownDevices[string(chainKey.DevicePk)]; !ok || chainKey.ChainKey == nil {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("chain key of an unknown device"))
+		}
+
+		groupPublicKey, err := crypto.UnmarshalEd25519PublicKey(chainKey.GroupPk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(chainKey.DevicePk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if err := s.putDeviceChainKey(ctx, groupPublicKey, devicePublicKey, chainKey.ChainKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsMessageKeyKnown returns true if the key of the given message is known.
+func (s *secretStore) IsMessageKeyKnown(ctx context.Context, msgCID cid.Cid) (has bool) {
+	if s == nil || !msgCID.Defined() {
+		return false
+	}
+
+	s.messageMutex.RLock()
+	defer s.messageMutex.RUnlock()
+
+	has, _ = s.datastore.Has(ctx, dsKeyForMessageKeyByCID(msgCID))
+
+	return
+}
+
+// DeleteMessageKeys deletes the keys of the given messages. The precomputed
+// key of an opened message has already been deleted and its chain key has
+// been derived, so the message can't be opened anymore.
+func (s *secretStore) DeleteMessageKeys(ctx context.Context, msgCIDs []cid.Cid) error {
+	if s == nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	for _, msgCID := range msgCIDs {
+		if !msgCID.Defined() {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("undefined message CID"))
+		}
+
+		if err := s.datastore.Put(ctx, dsKeyForDeletedMessageKey(msgCID), []byte{}); err != nil {
+			return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+		}
+
+		if err := s.datastore.Delete(ctx, dsKeyForMessageKeyByCID(msgCID)); err != nil {
+			return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
 // putDeviceChainKey stores the chain key for the given group and device.
 func (s *secretStore) putDeviceChainKey(ctx context.Context, groupPublicKey crypto.PubKey, devicePublicKey crypto.PubKey, deviceChainKey *protocoltypes.DeviceChainKey) error {
 	if s == nil {
@@ -663,6 +929,8 @@ func (s *secretStore) putDeviceChainKey(ctx context.Context, groupPublicKey cryp
 
 // SealEnvelope encrypts the given payload and returns it as an envelope to be
 // published on the group's store.
+// The headers are encrypted with EncryptionVersionCurrent unless another
+// version is set with ContextWithEncryptionVersion.
 // It retrieves the device's chain key from the keystore to encrypt the payload
 // using symmetric encryption. The payload is signed using the device's long
 // term private key for the target group. It also updates the chain key and
@@ -698,7 +966,12 @@ func (s *secretStore) SealEnvelope(ctx context.Context, group *protocoltypes.Gro
 		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to get device chainkey: %w", err))
 	}
 
-	env, err := sealEnvelope(messagePayload, deviceChainKey, localMemberDevice.device, group)
+	epochKey, err := s.getCurrentGroupEpochKey(ctx, group.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to get group epoch key: %w", err))
+	}
+
+	env, err := sealEnvelope(s.cipherSuites.Sealing(), encryptionVersionFromContext(ctx), messagePayload, deviceChainKey, localMemberDevice.device, group, epochKey)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(fmt.Errorf("unable to seal envelope: %w", err))
 	}
@@ -785,6 +1058,11 @@ func (s *secretStore) OutOfStoreMessageOpen(ctx context.Context, envelope *proto
 		return nil, false, errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
+	suite, err := s.cipherSuites.Get(envelope.CipherSuite)
+	if err != nil {
+		return nil, false, err
+	}
+
 	c := cid.Undef
 	if len(envelope.Cid) > 0 {
 		_, c, err = cid.CidFromBytes(envelope.Cid)
@@ -804,21 +1082,25 @@ func (s *secretStore) OutOfStoreMessageOpen(ctx context.Context, envelope *proto
 		if err != nil {
 			return nil, false, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
 		}
+
+		decryptionCtx.messageKey, err = s.applyEpochKeyForID(ctx, groupPublicKey, decryptionCtx.messageKey, envelope.EpochKeyId)
+		if err != nil {
+			return nil, false, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+		}
 	}
 
-	clear, decryptionCtx, err := s.openPayloadWithMessageKey(decryptionCtx, devicePublicKey, envelope.EncryptedPayload, &protocoltypes.MessageHeaders{
-		Counter:  envelope.Counter,
-		DevicePk: envelope.DevicePk,
-		Sig:      envelope.Sig,
+	clear, decryptionCtx, err := s.openPayloadWithMessageKey(suite, decryptionCtx, devicePublicKey, envelope.EncryptedPayload, &protocoltypes.MessageHeaders{
+		Counter:    envelope.Counter,
+		DevicePk:   envelope.DevicePk,
+		Sig:        envelope.Sig,
+		EpochKeyId: envelope.EpochKeyId,
 	})
 	if err != nil {
 		return nil, false, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
 	}
 
-	if ok, err := devicePublicKey.Verify(clear, envelope.Sig); !ok {
-		return nil, false, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("unable to verify message signature"))
-	} else if err != nil {
-		return nil, false, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	if err := s.verifyMessageSignature(devicePublicKey, clear, envelope.Sig); err != nil {
+		return nil, false, err
 	}
 
 	if _, err = s.preComputeNextKey(ctx, groupPublicKey, devicePublicKey); err != nil {
@@ -963,8 +1245,15 @@ func (s *secretStore) putFirstLastCachedGroupRefsForMember(ctx context.Context,
 }
 
 func sealPayload(payload []byte, ds *protocoltypes.DeviceChainKey, devicePrivateKey crypto.PrivKey, g *protocoltypes.Group) ([]byte, []byte, error) {
+	return sealPayloadWithEpochKey(DefaultCipherSuite(), payload, ds, devicePrivateKey, g, nil)
+}
+
+// sealPayloadWithEpochKey encrypts a payload with the given cipher suite using
+// the next message key of the device chain, bound to the given group epoch key
+// if any.
+func sealPayloadWithEpochKey(suite CipherSuite, payload []byte, ds *protocoltypes.DeviceChainKey, devicePrivateKey crypto.PrivKey, g *protocoltypes.Group, epochKey *protocoltypes.GroupEpochKey) ([]byte, []byte, error) {
 	var (
-		msgKey [32]byte
+		msgKey messageKey
 		err    error
 	)
 
@@ -977,11 +1266,21 @@ func sealPayload(payload []byte, ds *protocoltypes.DeviceChainKey, devicePrivate
 		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
 	}
 
-	return secretbox.Seal(nil, payload, uint64AsNonce(ds.Counter+1), &msgKey), sig, nil
+	key, err := applyEpochKey(&msgKey, epochKey, g.GetPublicKey())
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedPayload, err := suite.Seal(payload, uint64AsNonce(ds.Counter+1), (*[32]byte)(key))
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	return encryptedPayload, sig, nil
 }
 
-func sealEnvelope(messagePayload []byte, deviceChainKey *protocoltypes.DeviceChainKey, devicePrivateKey crypto.PrivKey, g *protocoltypes.Group) ([]byte, error) {
-	encryptedPayload, sig, err := sealPayload(messagePayload, deviceChainKey, devicePrivateKey, g)
+func sealEnvelope(suite CipherSuite, encryptionVersion uint32, messagePayload []byte, deviceChainKey *protocoltypes.DeviceChainKey, devicePrivateKey crypto.PrivKey, g *protocoltypes.Group, epochKey *protocoltypes.GroupEpochKey) ([]byte, error) {
+	encryptedPayload, sig, err := sealPayloadWithEpochKey(suite, messagePayload, deviceChainKey, devicePrivateKey, g, epochKey)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
 	}
@@ -997,6 +1296,10 @@ func sealEnvelope(messagePayload []byte, deviceChainKey *protocoltypes.DeviceCha
 		Sig:      sig,
 	}
 
+	if epochKey != nil {
+		h.EpochKeyId = epochKeyID(epochKey)
+	}
+
 	headers, err := proto.Marshal(h)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
@@ -1007,12 +1310,22 @@ func sealEnvelope(messagePayload []byte, deviceChainKey *protocoltypes.DeviceCha
 		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
 	}
 
-	encryptedHeaders := secretbox.Seal(nil, headers, nonce, g.GetSharedSecret())
+	key, err := GroupEncryptionKey(g, encryptionVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedHeaders, err := suite.Seal(headers, nonce, key)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
 
 	env, err := proto.Marshal(&protocoltypes.MessageEnvelope{
-		MessageHeaders: encryptedHeaders,
-		Message:        encryptedPayload,
-		Nonce:          nonce[:],
+		MessageHeaders:    encryptedHeaders,
+		Message:           encryptedPayload,
+		Nonce:             nonce[:],
+		EncryptionVersion: encryptionVersion,
+		CipherSuite:       suite.ID(),
 	})
 	if err != nil {
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
@@ -421,13 +421,13 @@ func Test_EncryptMessagePayload(t *testing.T) {
 	// uint64 overflows to 0, which is the expected behaviour
 
 	// Test with a wrong counter value
-	payloadClr1, decryptInfo, err := mkh2.openPayload(ctx, cid.Undef, gPK, payloadEnc1, mustMessageHeaders(t, omd1, initialCounter+2, payloadRef1))
+	payloadClr1, decryptInfo, err := mkh2.openPayload(ctx, DefaultCipherSuite(), cid.Undef, gPK, payloadEnc1, mustMessageHeaders(t, omd1, initialCounter+2, payloadRef1))
 	assert.Error(t, err)
 	assert.Nil(t, decryptInfo)
 	assert.Equal(t, "", string(payloadClr1))
 
 	// Test with a valid counter value, but no CID (so no cache)
-	payloadClr1, decryptInfo, err = mkh2.openPayload(ctx, cid.Undef, gPK, payloadEnc1, mustMessageHeaders(t, omd1, initialCounter+1, payloadRef1))
+	payloadClr1, decryptInfo, err = mkh2.openPayload(ctx, DefaultCipherSuite(), cid.Undef, gPK, payloadEnc1, mustMessageHeaders(t, omd1, initialCounter+1, payloadRef1))
 	assert.NoError(t, err)
 	assert.Equal(t, string(payloadRef1), string(payloadClr1))
 
@@ -450,7 +450,7 @@ func Test_EncryptMessagePayload(t *testing.T) {
 	assert.NotEqual(t, hex.EncodeToString(payloadRef1), hex.EncodeToString(payloadEnc2))
 	assert.NotEqual(t, hex.EncodeToString(payloadEnc1), hex.EncodeToString(payloadEnc2))
 
-	payloadClr2, decryptInfo, err := mkh2.openPayload(ctx, cid.Undef, gPK, payloadEnc2, mustMessageHeaders(t, omd1, initialCounter+2, payloadRef1))
+	payloadClr2, decryptInfo, err := mkh2.openPayload(ctx, DefaultCipherSuite(), cid.Undef, gPK, payloadEnc2, mustMessageHeaders(t, omd1, initialCounter+2, payloadRef1))
 	assert.NoError(t, err)
 
 	err = mkh2.postDecryptActions(ctx, decryptInfo, gPK, omd2.Device(), mustMessageHeaders(t, omd1, initialCounter+2, payloadRef1))
@@ -459,7 +459,7 @@ func Test_EncryptMessagePayload(t *testing.T) {
 	assert.Equal(t, string(payloadRef1), string(payloadClr2))
 
 	// Make sure that a message without a CID can't be decrypted twice
-	payloadClr2, decryptInfo, err = mkh2.openPayload(ctx, cid.Undef, gPK, payloadEnc2, mustMessageHeaders(t, omd1, initialCounter+1, payloadRef1))
+	payloadClr2, decryptInfo, err = mkh2.openPayload(ctx, DefaultCipherSuite(), cid.Undef, gPK, payloadEnc2, mustMessageHeaders(t, omd1, initialCounter+1, payloadRef1))
 	assert.Error(t, err)
 	assert.Equal(t, "", string(payloadClr2))
 
@@ -480,18 +480,18 @@ func Test_EncryptMessagePayload(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Not decrypted message yet, wrong counter value
-	payloadClr3, decryptInfo, err := mkh2.openPayload(ctx, dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+2, payloadRef2))
+	payloadClr3, decryptInfo, err := mkh2.openPayload(ctx, DefaultCipherSuite(), dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+2, payloadRef2))
 	assert.Error(t, err)
 	assert.Equal(t, "", string(payloadClr3))
 
-	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
+	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, DefaultCipherSuite(), dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
 	assert.NoError(t, err)
 	assert.Equal(t, string(payloadRef2), string(payloadClr3))
 
 	err = mkh2.postDecryptActions(ctx, decryptInfo, gPK, omd2.Device(), mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
 	assert.NoError(t, err)
 
-	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
+	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, DefaultCipherSuite(), dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
 	assert.NoError(t, err)
 	assert.Equal(t, string(payloadRef2), string(payloadClr3))
 
@@ -499,12 +499,12 @@ func Test_EncryptMessagePayload(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Wrong CID
-	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, dummyCID2, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
+	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, DefaultCipherSuite(), dummyCID2, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+3, payloadRef2))
 	assert.Error(t, err)
 	assert.Equal(t, "", string(payloadClr3))
 
 	// Reused CID, wrong counter value
-	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+4, payloadRef2))
+	payloadClr3, decryptInfo, err = mkh2.openPayload(ctx, DefaultCipherSuite(), dummyCID1, gPK, payloadEnc3, mustMessageHeaders(t, omd1, initialCounter+4, payloadRef2))
 	assert.Error(t, err)
 	assert.Equal(t, "", string(payloadClr3))
 
@@ -526,7 +526,7 @@ func Test_EncryptMessagePayload(t *testing.T) {
 
 		counter := ds.Counter
 
-		payloadClr, decryptInfo, err := mkh2.openPayload(ctx, cid.Undef, gPK, payloadEnc, mustMessageHeaders(t, omd1, counter, payloadRef3))
+		payloadClr, decryptInfo, err := mkh2.openPayload(ctx, DefaultCipherSuite(), cid.Undef, gPK, payloadEnc, mustMessageHeaders(t, omd1, counter, payloadRef3))
 		if !assert.NoError(t, err) {
 			t.Fatalf("failed at i = %d", i)
 		}
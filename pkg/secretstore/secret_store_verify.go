@@ -0,0 +1,284 @@
+package secretstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	crypto_pb "github.com/libp2p/go-libp2p/core/crypto/pb"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// KeystoreInconsistency describes a stored key which doesn't match the value
+// derived from the account keys
+type KeystoreInconsistency struct {
+	// Name is the name of the key in the keystore, or the datastore key of
+	// a group
+	Name string
+
+	// Reason describes the inconsistency
+	Reason string
+}
+
+// KeystoreReport is the result of a keystore verification
+type KeystoreReport struct {
+	// CheckedKeys is the number of keys and groups which have been verified
+	CheckedKeys int
+
+	// Inconsistencies lists the keys and groups not matching their derived
+	// value
+	Inconsistencies []*KeystoreInconsistency
+}
+
+// OK returns whether all the checked keys are consistent
+func (r *KeystoreReport) OK() bool {
+	return len(r.Inconsistencies) == 0
+}
+
+func (r *KeystoreReport) addInconsistency(name string, format string, args ...interface{}) {
+	r.Inconsistencies = append(r.Inconsistencies, &KeystoreInconsistency{
+		Name:   name,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// VerifyKeystore checks the keys stored in the keystore and the groups stored
+// in the datastore:
+//   - the ed25519 keys must match their seed
+//   - the member keys of the multi-member groups are re-derived from the
+//     account proof key
+//   - the contact group keys are re-derived from the account key
+//   - the account and contact groups are re-derived from these keys
+//   - the secret of the multi-member groups must be signed by the group key
+//
+// The missing account keys are reported as inconsistencies as the keys derived
+// from them can't be verified, unlike GetGroupForAccount they are not generated.
+func (s *secretStore) VerifyKeystore(ctx context.Context) (*KeystoreReport, error) {
+	if s == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated secret store"))
+	}
+
+	report := &KeystoreReport{}
+
+	s.deviceKeystore.mu.Lock()
+	defer s.deviceKeystore.mu.Unlock()
+
+	names, err := s.deviceKeystore.keystore.List()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(fmt.Errorf("unable to list keystore keys: %w", err))
+	}
+
+	// the account keys are required to re-derive the other keys
+	accountKeys := map[string]crypto.PrivKey{}
+	for _, name := range []string{keyAccount, keyAccountProof, keyDevice} {
+		accountKeys[name] = s.verifyStoredKey(report, name)
+	}
+
+	contactGroups := map[string]*protocoltypes.Group{}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		nameSpace, publicKeyHex, ok := strings.Cut(name, "_")
+		if !ok {
+			continue
+		}
+
+		var ownKeyName string
+		switch nameSpace {
+		case keyMember:
+			ownKeyName = keyAccountProof
+		case keyContactGroup:
+			ownKeyName = keyAccount
+		case keyMemberDevice:
+			// device keys of multi-member groups are randomly generated
+			s.verifyStoredKey(report, name)
+			continue
+		default:
+			continue
+		}
+
+		privateKey := s.verifyStoredKey(report, name)
+		if privateKey == nil {
+			continue
+		}
+
+		ownPrivateKey := accountKeys[ownKeyName]
+		if ownPrivateKey == nil {
+			report.addInconsistency(name, "unable to re-derive the key without %s", ownKeyName)
+			continue
+		}
+
+		publicKey, err := publicKeyFromHex(publicKeyHex)
+		if err != nil {
+			report.addInconsistency(name, "invalid public key in key name: %s", err)
+			continue
+		}
+
+		expected, err := computeECDH(publicKey, ownPrivateKey)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+		}
+
+		if !expected.Equals(privateKey) {
+			report.addInconsistency(name, "key doesn't match the key derived from %s", ownKeyName)
+			continue
+		}
+
+		if nameSpace == keyContactGroup {
+			group, err := getGroupForContact(privateKey)
+			if err != nil {
+				return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+			}
+
+			contactGroups[string(group.PublicKey)] = group
+		}
+	}
+
+	if err := s.verifyStoredGroups(ctx, report, accountKeys, contactGroups); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// verifyStoredKey checks that a stored ed25519 key matches its seed, it
+// returns nil if the key is missing or inconsistent
+func (s *secretStore) verifyStoredKey(report *KeystoreReport, name string) crypto.PrivKey {
+	report.CheckedKeys++
+
+	privateKey, err := s.deviceKeystore.keystore.Get(name)
+	if err != nil {
+		if err.Error() == keystore.ErrNoSuchKey.Error() {
+			report.addInconsistency(name, "key is missing")
+		} else {
+			report.addInconsistency(name, "unable to read key: %s", err)
+		}
+
+		return nil
+	}
+
+	if privateKey.Type() != crypto_pb.KeyType_Ed25519 {
+		report.addInconsistency(name, "key is not an ed25519 key")
+		return nil
+	}
+
+	raw, err := privateKey.Raw()
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		report.addInconsistency(name, "invalid key data")
+		return nil
+	}
+
+	if !bytes.Equal(ed25519.NewKeyFromSeed(raw[:ed25519.SeedSize]), raw) {
+		report.addInconsistency(name, "public key doesn't match the key seed")
+		return nil
+	}
+
+	return privateKey
+}
+
+// verifyStoredGroups checks the groups stored in the datastore against the
+// groups derived from the account keys
+func (s *secretStore) verifyStoredGroups(ctx context.Context, report *KeystoreReport, accountKeys map[string]crypto.PrivKey, contactGroups map[string]*protocoltypes.Group) error {
+	var accountGroup *protocoltypes.Group
+	if accountKeys[keyAccount] != nil && accountKeys[keyAccountProof] != nil {
+		pubBytes, err := accountKeys[keyAccount].GetPublic().Raw()
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		signingBytes, err := cryptoutil.SeedFromEd25519PrivateKey(accountKeys[keyAccountProof])
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		accountGroup = &protocoltypes.Group{PublicKey: pubBytes, Secret: signingBytes}
+	}
+
+	results, err := s.datastore.Query(ctx, query.Query{
+		Prefix: datastore.NewKey(dsNamespaceGroupDatastore).String(),
+	})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	for res := range results.Next() {
+		if res.Error != nil {
+			return errcode.ErrCode_ErrDBRead.Wrap(res.Error)
+		}
+
+		report.CheckedKeys++
+
+		group := &protocoltypes.Group{}
+		if err := proto.Unmarshal(res.Value, group); err != nil {
+			report.addInconsistency(res.Key, "unable to decode group: %s", err)
+			continue
+		}
+
+		if dsKeyForGroup(group.PublicKey).String() != res.Key {
+			report.addInconsistency(res.Key, "group is stored under the key of another group")
+			continue
+		}
+
+		var expected *protocoltypes.Group
+		switch group.GroupType {
+		case protocoltypes.GroupType_GroupTypeAccount:
+			if accountGroup == nil {
+				report.addInconsistency(res.Key, "unable to re-derive the account group without the account keys")
+				continue
+			}
+
+			expected = accountGroup
+
+		case protocoltypes.GroupType_GroupTypeContact:
+			if expected = contactGroups[string(group.PublicKey)]; expected == nil {
+				report.addInconsistency(res.Key, "no contact group key matches the group")
+				continue
+			}
+
+		case protocoltypes.GroupType_GroupTypeMultiMember:
+			if len(group.SecretSig) > 0 {
+				if err := group.IsValid(); err != nil {
+					report.addInconsistency(res.Key, "invalid group secret signature: %s", err)
+				}
+			}
+			continue
+
+		default:
+			report.addInconsistency(res.Key, "unknown group type")
+			continue
+		}
+
+		if !bytes.Equal(expected.PublicKey, group.PublicKey) {
+			report.addInconsistency(res.Key, "group public key doesn't match the derived one")
+		} else if !bytes.Equal(expected.Secret, group.Secret) {
+			report.addInconsistency(res.Key, "group secret doesn't match the derived one")
+		}
+	}
+
+	return nil
+}
+
+// publicKeyFromHex decodes the hex encoded ed25519 public key used in the
+// names of the derived keys
+func publicKeyFromHex(publicKeyHex string) (crypto.PubKey, error) {
+	publicKeyBytes, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.UnmarshalEd25519PublicKey(publicKeyBytes)
+}
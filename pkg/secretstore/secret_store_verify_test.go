@@ -0,0 +1,74 @@
+package secretstore
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func Test_VerifyKeystore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+
+	// the keys of an unused store are not generated
+	report, err := store.VerifyKeystore(ctx)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+
+	exists, err := store.deviceKeystore.keystore.Has(keyAccount)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	accountGroup, _, err := store.GetGroupForAccount()
+	require.NoError(t, err)
+	require.NoError(t, store.PutGroup(ctx, accountGroup))
+
+	multiMemberGroup, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+	require.NoError(t, store.PutGroup(ctx, multiMemberGroup))
+
+	_, contactPublicKey, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	contactGroup, err := store.GetGroupForContact(contactPublicKey)
+	require.NoError(t, err)
+	require.NoError(t, store.PutGroup(ctx, contactGroup))
+
+	report, err = store.VerifyKeystore(ctx)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Inconsistencies)
+
+	// account, proof, device keys, member and member device keys of the
+	// multi-member group, contact group key and the three groups
+	require.Equal(t, 9, report.CheckedKeys)
+
+	// replace the member key of the multi-member group by a random key
+	memberKeyName := strings.Join([]string{keyMember, hex.EncodeToString(multiMemberGroup.PublicKey)}, "_")
+
+	corruptedKey, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, store.deviceKeystore.keystore.Delete(memberKeyName))
+	require.NoError(t, store.deviceKeystore.keystore.Put(memberKeyName, corruptedKey))
+
+	report, err = store.VerifyKeystore(ctx)
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Len(t, report.Inconsistencies, 1)
+	require.Equal(t, memberKeyName, report.Inconsistencies[0].Name)
+
+	// the corrupted key is left untouched
+	storedKey, err := store.deviceKeystore.keystore.Get(memberKeyName)
+	require.NoError(t, err)
+	require.True(t, corruptedKey.Equals(storedKey))
+}
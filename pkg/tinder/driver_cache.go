@@ -0,0 +1,159 @@
+package tinder
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// cachedDriverRefreshTimeout bounds a background refresh of the cached peers
+const cachedDriverRefreshTimeout = time.Minute
+
+var _ IDriver = (*CachedDriver)(nil)
+
+// CachedDriver caches the peers found by a driver for each namespace, so the
+// successive lookups of a namespace don't hit the driver, e.g. a rendezvous
+// point, each time. The cached peers are returned until ttl has elapsed, then
+// the stale peers are still returned while they are refreshed in the
+// background, for another ttl at most: the peers which couldn't be refreshed
+// by then expire and the driver is called again.
+// The cache is only filled by the complete lookups which found peers, and the
+// lookup options are only used when the driver is called.
+type CachedDriver struct {
+	IDriver
+
+	// clock times the cached peers, it is mocked by the tests
+	clock   clock.Clock
+	ttl     time.Duration
+	results map[string]*cachedPeers
+	mu      sync.Mutex
+}
+
+type cachedPeers struct {
+	peers      []peer.AddrInfo
+	foundAt    time.Time
+	refreshing bool
+}
+
+// NewCachedDriver wraps the driver to cache its lookups for ttl
+func NewCachedDriver(driver IDriver, ttl time.Duration) *CachedDriver {
+	return &CachedDriver{
+		IDriver: driver,
+		clock:   clock.New(),
+		ttl:     ttl,
+		results: make(map[string]*cachedPeers),
+	}
+}
+
+// FindPeers returns the cached peers of the namespace if any, the driver is
+// called otherwise
+func (d *CachedDriver) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	d.mu.Lock()
+	if cached, ok := d.results[ns]; ok && d.expired(cached) {
+		delete(d.results, ns)
+	} else if ok {
+		if d.clock.Since(cached.foundAt) >= d.ttl && !cached.refreshing {
+			cached.refreshing = true
+			go d.refresh(ns, opts...)
+		}
+
+		out := make(chan peer.AddrInfo, len(cached.peers))
+		for _, p := range cached.peers {
+			out <- p
+		}
+		close(out)
+
+		d.mu.Unlock()
+		return out, nil
+	}
+	d.mu.Unlock()
+
+	in, err := d.IDriver.FindPeers(ctx, ns, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan peer.AddrInfo)
+	go func() {
+		defer close(out)
+
+		peers := []peer.AddrInfo{}
+		for p := range in {
+			peers = append(peers, p)
+
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if ctx.Err() == nil {
+			d.store(ns, peers)
+		}
+	}()
+
+	return out, nil
+}
+
+// refresh looks up the peers of a namespace to replace the stale ones, they
+// are kept if the lookup fails
+func (d *CachedDriver) refresh(ns string, opts ...discovery.Option) {
+	ctx, cancel := context.WithTimeout(context.Background(), cachedDriverRefreshTimeout)
+	defer cancel()
+
+	peers := []peer.AddrInfo{}
+
+	in, err := d.IDriver.FindPeers(ctx, ns, opts...)
+	if err == nil {
+		for p := range in {
+			peers = append(peers, p)
+		}
+	}
+
+	if err != nil || ctx.Err() != nil {
+		d.mu.Lock()
+		if cached, ok := d.results[ns]; ok {
+			cached.refreshing = false
+		}
+		d.mu.Unlock()
+
+		return
+	}
+
+	d.store(ns, peers)
+}
+
+// store caches the peers of a namespace, nothing is cached if no peer has
+// been found so the next lookup calls the driver again. The expired
+// namespaces are removed meanwhile.
+func (d *CachedDriver) store(ns string, peers []peer.AddrInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for other, cached := range d.results {
+		if d.expired(cached) {
+			delete(d.results, other)
+		}
+	}
+
+	if len(peers) == 0 {
+		delete(d.results, ns)
+		return
+	}
+
+	d.results[ns] = &cachedPeers{
+		peers:   peers,
+		foundAt: d.clock.Now(),
+	}
+}
+
+// expired returns true if the cached peers are too old to be returned, even
+// while being refreshed
+func (d *CachedDriver) expired(cached *cachedPeers) bool {
+	return d.clock.Since(cached.foundAt) >= 2*d.ttl
+}
@@ -0,0 +1,182 @@
+package tinder
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDriver counts the lookups reaching the driver
+type countingDriver struct {
+	IDriver
+
+	lookups int32
+}
+
+func (d *countingDriver) FindPeers(ctx context.Context, ns string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	atomic.AddInt32(&d.lookups, 1)
+	return d.IDriver.FindPeers(ctx, ns, opts...)
+}
+
+func (d *countingDriver) lookupCount() int {
+	return int(atomic.LoadInt32(&d.lookups))
+}
+
+func TestCachedDriverFindPeers(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	p2, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	server := NewMockDriverServer()
+	server.Advertise(topic, p1.Peerstore().PeerInfo(p1.ID()), time.Minute)
+
+	findPeers := func(driver IDriver) []peer.ID {
+		out, err := driver.FindPeers(ctx, topic)
+		require.NoError(t, err)
+
+		peers := []peer.ID{}
+		for p := range out {
+			peers = append(peers, p.ID)
+		}
+
+		return peers
+	}
+
+	counting := &countingDriver{IDriver: server.Client(p2)}
+	cached := NewCachedDriver(counting, time.Minute)
+
+	require.Equal(t, []peer.ID{p1.ID()}, findPeers(cached))
+	require.Equal(t, 1, counting.lookupCount())
+
+	// the second lookup within the ttl is served from the cache
+	server.Advertise(topic, p2.Peerstore().PeerInfo(p2.ID()), time.Minute)
+	require.Equal(t, []peer.ID{p1.ID()}, findPeers(cached))
+	require.Equal(t, 1, counting.lookupCount())
+
+	// other namespaces aren't cached
+	out, err := cached.FindPeers(ctx, "other_topic")
+	require.NoError(t, err)
+	for range out {
+	}
+	require.Equal(t, 2, counting.lookupCount())
+}
+
+func TestCachedDriverRefresh(t *testing.T) {
+	const (
+		topic = "test_topic"
+		ttl   = time.Minute
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	p2, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	p3, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	server := NewMockDriverServer()
+	server.Advertise(topic, p1.Peerstore().PeerInfo(p1.ID()), time.Hour)
+
+	clk := clock.NewMock()
+	counting := &countingDriver{IDriver: server.Client(p3)}
+	cached := NewCachedDriver(counting, ttl)
+	cached.clock = clk
+
+	findPeers := func() []peer.ID {
+		out, err := cached.FindPeers(ctx, topic)
+		require.NoError(t, err)
+
+		peers := []peer.ID{}
+		for p := range out {
+			peers = append(peers, p.ID)
+		}
+
+		return peers
+	}
+
+	require.Len(t, findPeers(), 1)
+	server.Advertise(topic, p2.Peerstore().PeerInfo(p2.ID()), time.Hour)
+
+	clk.Add(ttl)
+
+	// the stale peers are returned while they are refreshed
+	require.Len(t, findPeers(), 1)
+
+	require.Eventually(t, func() bool {
+		return counting.lookupCount() == 2 && len(findPeers()) == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	// the peers which haven't been refreshed in time expire, the driver is
+	// called right away
+	server.Advertise(topic, p3.Peerstore().PeerInfo(p3.ID()), time.Hour)
+
+	clk.Add(ttl * 2)
+	require.Len(t, findPeers(), 3)
+	require.Equal(t, 3, counting.lookupCount())
+}
+
+func TestCachedDriverEmptyLookup(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p1, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	p2, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	server := NewMockDriverServer()
+	counting := &countingDriver{IDriver: server.Client(p2)}
+	cached := NewCachedDriver(counting, time.Minute)
+
+	findPeers := func() int {
+		out, err := cached.FindPeers(ctx, topic)
+		require.NoError(t, err)
+
+		count := 0
+		for range out {
+			count++
+		}
+
+		return count
+	}
+
+	// a lookup which found nothing isn't cached
+	require.Zero(t, findPeers())
+	require.Equal(t, 1, counting.lookupCount())
+
+	server.Advertise(topic, p1.Peerstore().PeerInfo(p1.ID()), time.Minute)
+
+	require.Equal(t, 1, findPeers())
+	require.Equal(t, 2, counting.lookupCount())
+}
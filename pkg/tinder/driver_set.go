@@ -0,0 +1,238 @@
+package tinder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var _ IDriver = (*DriverSet)(nil)
+
+// DriverSet is a driver relaying to a set of drivers which can be replaced
+// at runtime, e.g. the clients of the rendezvous points. The subscriptions in
+// progress are moved to the new drivers, the advertises use them on their
+// next run, see Service.RefreshAdvertises. The advertises wait for drivers
+// while the set is empty.
+type DriverSet struct {
+	name string
+
+	drivers []IDriver
+	changed chan struct{}
+	subs    map[*driverSetSubscription]struct{}
+	mu      sync.Mutex
+}
+
+type driverSetSubscription struct {
+	ctx    context.Context
+	topic  string
+	opts   []discovery.Option
+	out    chan peer.AddrInfo
+	cancel context.CancelFunc // cancels the subscriptions on the current drivers
+	wg     sync.WaitGroup
+}
+
+func NewDriverSet(name string, drivers ...IDriver) *DriverSet {
+	return &DriverSet{
+		name:    name,
+		drivers: drivers,
+		changed: make(chan struct{}),
+		subs:    make(map[*driverSetSubscription]struct{}),
+	}
+}
+
+func (s *DriverSet) Name() string { return s.name }
+
+// Drivers returns the current drivers of the set
+func (s *DriverSet) Drivers() []IDriver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]IDriver{}, s.drivers...)
+}
+
+// SetDrivers replaces the drivers of the set, the subscriptions in progress
+// are closed on the previous drivers and started on the new ones
+func (s *DriverSet) SetDrivers(drivers ...IDriver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.drivers = drivers
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	for sub := range s.subs {
+		s.subscribeDrivers(sub)
+	}
+}
+
+func (s *DriverSet) Advertise(ctx context.Context, topic string, opts ...discovery.Option) (time.Duration, error) {
+	drivers, err := s.waitForDrivers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		ttl     time.Duration
+		success int
+		lastErr error
+	)
+	for _, d := range drivers {
+		dttl, err := d.Advertise(ctx, topic, opts...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// the topic must be advertised again before it expires on any driver
+		if success == 0 || dttl < ttl {
+			ttl = dttl
+		}
+		success++
+	}
+
+	if success == 0 {
+		return 0, fmt.Errorf("unable to advertise on any driver of the set: %w", lastErr)
+	}
+
+	return ttl, nil
+}
+
+// waitForDrivers returns the drivers of the set once it isn't empty
+func (s *DriverSet) waitForDrivers(ctx context.Context) ([]IDriver, error) {
+	for {
+		s.mu.Lock()
+		drivers, changed := append([]IDriver{}, s.drivers...), s.changed
+		s.mu.Unlock()
+
+		if len(drivers) > 0 {
+			return drivers, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *DriverSet) FindPeers(ctx context.Context, topic string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	drivers := s.Drivers()
+	if len(drivers) == 0 {
+		return nil, ErrNotSupported
+	}
+
+	var wg sync.WaitGroup
+	out := make(chan peer.AddrInfo)
+	for _, d := range drivers {
+		in, err := d.FindPeers(ctx, topic, opts...)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardPeers(ctx, in, out)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+func (s *DriverSet) Subscribe(ctx context.Context, topic string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	sub := &driverSetSubscription{
+		ctx:   ctx,
+		topic: topic,
+		opts:  opts,
+		out:   make(chan peer.AddrInfo),
+	}
+
+	s.mu.Lock()
+	s.subs[sub] = struct{}{}
+	s.subscribeDrivers(sub)
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		delete(s.subs, sub)
+		s.mu.Unlock()
+
+		sub.wg.Wait()
+		close(sub.out)
+	}()
+
+	return sub.out, nil
+}
+
+// subscribeDrivers (re)starts the subscription on the current drivers, s.mu
+// must be held
+func (s *DriverSet) subscribeDrivers(sub *driverSetSubscription) {
+	if sub.cancel != nil {
+		sub.cancel()
+	}
+
+	var ctx context.Context
+	ctx, sub.cancel = context.WithCancel(sub.ctx)
+
+	for _, d := range s.drivers {
+		in, err := d.Subscribe(ctx, sub.topic, sub.opts...)
+		if err != nil {
+			continue
+		}
+
+		sub.wg.Add(1)
+		go func() {
+			defer sub.wg.Done()
+			forwardPeers(ctx, in, sub.out)
+		}()
+	}
+}
+
+func (s *DriverSet) Unregister(ctx context.Context, topic string, opts ...discovery.Option) error {
+	drivers := s.Drivers()
+	if len(drivers) == 0 {
+		return ErrNotSupported
+	}
+
+	var lastErr error
+	for _, d := range drivers {
+		if err := d.Unregister(ctx, topic, opts...); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// forwardPeers forwards the peers of in to out until in is closed or ctx is
+// done
+func forwardPeers(ctx context.Context, in <-chan peer.AddrInfo, out chan<- peer.AddrInfo) {
+	for {
+		select {
+		case p, ok := <-in:
+			if !ok {
+				return
+			}
+
+			select {
+			case out <- p:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tinder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDriverSetSwap(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	newPeer := func(server *MockDriverServer) (host.Host, *DriverSet, *Service) {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+
+		set := NewDriverSet("rdvp", server.Client(h))
+		service, err := NewService(h, zap.NewNop(), set)
+		require.NoError(t, err)
+		t.Cleanup(func() { service.Close() })
+
+		return h, set, service
+	}
+
+	serverA := NewMockDriverServer()
+	serverB := NewMockDriverServer()
+
+	advertiser, advertiserSet, advertiserService := newPeer(serverA)
+	_, watcherSet, watcherService := newPeer(serverA)
+
+	require.NoError(t, advertiserService.StartAdvertises(ctx, topic))
+
+	sub := watcherService.Subscribe(topic)
+	defer sub.Close()
+
+	waitForPeer := func(p peer.ID) {
+		for {
+			select {
+			case info := <-sub.Out():
+				if info.ID == p {
+					return
+				}
+			case <-time.After(time.Second * 10):
+				require.FailNow(t, "peer not found", p.String())
+			}
+		}
+	}
+
+	waitForPeer(advertiser.ID())
+
+	// the rendezvous points are replaced by a new one
+	advertiserSet.SetDrivers(serverB.Client(advertiser))
+	watcherSet.SetDrivers(serverB.Client(watcherService.host))
+	require.Equal(t, 1, advertiserService.RefreshAdvertises(topic))
+
+	// the topic is advertised on the new rendezvous point
+	require.Eventually(t, func() bool {
+		return serverB.Exist(topic, advertiser.ID())
+	}, time.Second*5, time.Millisecond*100)
+
+	// the lookups use the new rendezvous point
+	lookupCtx, lookupCancel := context.WithTimeout(ctx, time.Second*5)
+	defer lookupCancel()
+
+	info, ok := <-watcherService.FindPeers(lookupCtx, topic)
+	require.True(t, ok)
+	require.Equal(t, advertiser.ID(), info.ID)
+
+	// the subscription in progress follows the new rendezvous point
+	newcomer, _, newcomerService := newPeer(serverB)
+	require.NoError(t, newcomerService.StartAdvertises(ctx, topic))
+	waitForPeer(newcomer.ID())
+}
+
+func TestDriverSetEmpty(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	h, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	server := NewMockDriverServer()
+	set := NewDriverSet("rdvp")
+
+	// the advertise waits for the first rendezvous point
+	advertised := make(chan error, 1)
+	go func() {
+		_, err := set.Advertise(ctx, topic)
+		advertised <- err
+	}()
+
+	select {
+	case err := <-advertised:
+		require.FailNow(t, "advertise should wait for a driver", "%v", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	set.SetDrivers(server.Client(h))
+	select {
+	case err := <-advertised:
+		require.NoError(t, err)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "advertise should run once a driver is set")
+	}
+	require.True(t, server.Exist(topic, h.ID()))
+
+	// the lookups aren't supported without driver
+	set.SetDrivers()
+	_, err = set.FindPeers(ctx, topic)
+	require.ErrorIs(t, err, ErrNotSupported)
+}
@@ -16,3 +16,36 @@ func PrivateAddrsOnlyFactory(ms []ma.Multiaddr) []ma.Multiaddr {
 }
 
 func AllAddrsFactory(ms []ma.Multiaddr) []ma.Multiaddr { return ms }
+
+// keep relayed (p2p-circuit) addr only
+func RelayAddrsOnlyFactory(ms []ma.Multiaddr) []ma.Multiaddr {
+	return ProtocolAddrsOnlyFactory(ma.P_CIRCUIT)(ms)
+}
+
+// ProtocolAddrsOnlyFactory keeps the addrs using at least one of the given
+// protocol codes, e.g. the code of a proximity driver to only advertise the
+// proximity addrs.
+func ProtocolAddrsOnlyFactory(codes ...int) AddrsFilter {
+	return func(ms []ma.Multiaddr) []ma.Multiaddr {
+		return ma.FilterAddrs(ms, func(m ma.Multiaddr) bool {
+			for _, code := range codes {
+				if _, err := m.ValueForProtocol(code); err == nil {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// ExcludeProtocolAddrsFactory drops the addrs using any of the given protocol
+// codes.
+func ExcludeProtocolAddrsFactory(codes ...int) AddrsFilter {
+	keep := ProtocolAddrsOnlyFactory(codes...)
+	return func(ms []ma.Multiaddr) []ma.Multiaddr {
+		excluded := keep(ms)
+		return ma.FilterAddrs(ms, func(m ma.Multiaddr) bool {
+			return !ma.Contains(excluded, m)
+		})
+	}
+}
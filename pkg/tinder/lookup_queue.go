@@ -0,0 +1,154 @@
+package tinder
+
+import (
+	"context"
+	"sync"
+)
+
+// lookupQueue bounds the number of lookups running at the same time, the
+// other lookups wait for a free slot in the order they have been queued, the
+// lookups of the priority topics first
+type lookupQueue struct {
+	mu       sync.Mutex
+	max      int
+	running  int
+	waiting  []*lookupWaiter
+	priority map[string]struct{}
+}
+
+type lookupWaiter struct {
+	topic string
+	ready chan struct{}
+}
+
+func newLookupQueue() *lookupQueue {
+	return &lookupQueue{
+		priority: make(map[string]struct{}),
+	}
+}
+
+// acquire waits for a free slot to look up the topic, release must be called
+// once the lookup has ended
+func (q *lookupQueue) acquire(ctx context.Context, topic string) (release func(), err error) {
+	q.mu.Lock()
+
+	if q.hasFreeSlot() && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.newRelease(), nil
+	}
+
+	w := &lookupWaiter{topic: topic, ready: make(chan struct{})}
+	q.waiting = append(q.waiting, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return q.newRelease(), nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.removeWaiter(w) {
+		// the slot has been granted meanwhile, hand it to the next lookup
+		q.running--
+		q.grant()
+	}
+
+	return nil, ctx.Err()
+}
+
+func (q *lookupQueue) newRelease() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.running--
+			q.grant()
+		})
+	}
+}
+
+// grant hands the free slots to the waiting lookups, q.mu must be held
+func (q *lookupQueue) grant() {
+	for len(q.waiting) > 0 && q.hasFreeSlot() {
+		next := 0
+		for i, w := range q.waiting {
+			if _, ok := q.priority[w.topic]; ok {
+				next = i
+				break
+			}
+		}
+
+		w := q.waiting[next]
+		q.waiting = append(q.waiting[:next], q.waiting[next+1:]...)
+		q.running++
+		close(w.ready)
+	}
+}
+
+// removeWaiter removes a lookup which hasn't been granted a slot yet from
+// the queue, it returns false if it isn't waiting anymore
+func (q *lookupQueue) removeWaiter(w *lookupWaiter) bool {
+	for i, waiting := range q.waiting {
+		if waiting == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *lookupQueue) hasFreeSlot() bool {
+	return q.max <= 0 || q.running < q.max
+}
+
+func (q *lookupQueue) setMax(max int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.max = max
+	q.grant()
+}
+
+func (q *lookupQueue) setPriority(topic string, priority bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if priority {
+		q.priority[topic] = struct{}{}
+	} else {
+		delete(q.priority, topic)
+	}
+}
+
+func (q *lookupQueue) stats() (running int, waiting int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.running, len(q.waiting)
+}
+
+// SetMaxConcurrentLookups bounds the number of lookups running at the same
+// time, the other lookups are queued until a running lookup ends. The lookups
+// aren't bounded if max is 0, which is the default.
+func (s *Service) SetMaxConcurrentLookups(max int) {
+	s.lookups.setMax(max)
+}
+
+// SetTopicPriority sets whether the queued lookups of the topic run before
+// the other queued lookups, see SetMaxConcurrentLookups
+func (s *Service) SetTopicPriority(topic string, priority bool) {
+	s.lookups.setPriority(topic, priority)
+}
+
+// LookupsStats returns the number of lookups running and the number of
+// lookups waiting for a slot
+func (s *Service) LookupsStats() (running int, waiting int) {
+	return s.lookups.stats()
+}
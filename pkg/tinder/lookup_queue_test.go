@@ -0,0 +1,165 @@
+package tinder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// blockingLookupDriver keeps the lookups running until they are ended by
+// the test
+type blockingLookupDriver struct {
+	IDriver
+
+	started chan string
+
+	mu         sync.Mutex
+	lookups    map[string]chan peer.AddrInfo
+	running    int
+	maxRunning int
+}
+
+func (d *blockingLookupDriver) FindPeers(_ context.Context, topic string, _ ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	d.mu.Lock()
+	out := make(chan peer.AddrInfo)
+	d.lookups[topic] = out
+	d.running++
+	if d.running > d.maxRunning {
+		d.maxRunning = d.running
+	}
+	d.mu.Unlock()
+
+	d.started <- topic
+	return out, nil
+}
+
+func (d *blockingLookupDriver) end(topic string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.running--
+	close(d.lookups[topic])
+	delete(d.lookups, topic)
+}
+
+func TestServiceMaxConcurrentLookups(t *testing.T) {
+	const maxLookups = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	driver := &blockingLookupDriver{
+		IDriver: NewMockDriverServer().Client(p),
+		started: make(chan string, 10),
+		lookups: make(map[string]chan peer.AddrInfo),
+	}
+
+	service, err := NewService(p, zap.NewNop(), driver)
+	require.NoError(t, err)
+	defer service.Close()
+
+	service.SetMaxConcurrentLookups(maxLookups)
+
+	waitStarted := func() string {
+		select {
+		case topic := <-driver.started:
+			return topic
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, "lookup should have started")
+			return ""
+		}
+	}
+
+	requireNoneStarted := func() {
+		select {
+		case topic := <-driver.started:
+			require.FailNow(t, "lookup should be queued", topic)
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+
+	lookup := func(topic string) {
+		go func() {
+			if err := service.LookupPeers(ctx, topic); err != nil {
+				t.Errorf("lookup failed: %s", err)
+			}
+		}()
+	}
+
+	// the first lookups start right away
+	lookup("topic_0")
+	require.Equal(t, "topic_0", waitStarted())
+	lookup("topic_1")
+	require.Equal(t, "topic_1", waitStarted())
+
+	// the next ones are queued in order
+	for i := 2; i < 5; i++ {
+		topic := fmt.Sprintf("topic_%d", i)
+		lookup(topic)
+		require.Eventually(t, func() bool {
+			_, waiting := service.LookupsStats()
+			return waiting == i-1
+		}, time.Second*5, time.Millisecond*10)
+	}
+
+	requireNoneStarted()
+
+	running, waiting := service.LookupsStats()
+	require.Equal(t, maxLookups, running)
+	require.Equal(t, 3, waiting)
+
+	// the lookup of a priority topic jumps the queue
+	service.SetTopicPriority("topic_4", true)
+
+	driver.end("topic_0")
+	require.Equal(t, "topic_4", waitStarted())
+	requireNoneStarted()
+
+	driver.end("topic_1")
+	require.Equal(t, "topic_2", waitStarted())
+
+	driver.end("topic_4")
+	require.Equal(t, "topic_3", waitStarted())
+
+	// a queued lookup is dropped once its context is done
+	lookupCtx, lookupCancel := context.WithCancel(ctx)
+	errCh := make(chan error, 1)
+	go func() { errCh <- service.LookupPeers(lookupCtx, "topic_5") }()
+
+	require.Eventually(t, func() bool {
+		_, waiting := service.LookupsStats()
+		return waiting == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	lookupCancel()
+	require.Error(t, <-errCh)
+
+	running, waiting = service.LookupsStats()
+	require.Equal(t, maxLookups, running)
+	require.Equal(t, 0, waiting)
+
+	driver.end("topic_2")
+	driver.end("topic_3")
+	require.Eventually(t, func() bool {
+		running, _ := service.LookupsStats()
+		return running == 0
+	}, time.Second*5, time.Millisecond*10)
+
+	driver.mu.Lock()
+	require.Equal(t, maxLookups, driver.maxRunning)
+	driver.mu.Unlock()
+}
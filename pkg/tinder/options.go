@@ -1,5 +1,10 @@
 package tinder
 
+import (
+	"fmt"
+	"time"
+)
+
 type Filter map[string]struct{}
 
 func (f Filter) ShouldFilter(name string) (yes bool) {
@@ -13,11 +18,25 @@ func (f Filter) ShouldFilter(name string) (yes bool) {
 
 type Options struct {
 	DriverFilters Filter
+
+	// AdvertiseJitter is the maximum fraction of the advertise interval added
+	// or removed at random, so nodes started together don't advertise at the
+	// same time
+	AdvertiseJitter float64
+	// AdvertiseBackoffMin and AdvertiseBackoffMax bound the delay before
+	// retrying a failed advertise, the delay doubles on each consecutive
+	// failure
+	AdvertiseBackoffMin time.Duration
+	AdvertiseBackoffMax time.Duration
 }
 
 type Option func(opts *Options) error
 
 func (o *Options) apply(opts ...Option) error {
+	o.AdvertiseJitter = defaultAdvertiseJitter
+	o.AdvertiseBackoffMin = defaultAdvertiseBackoffMin
+	o.AdvertiseBackoffMax = defaultAdvertiseBackoffMax
+
 	for _, opt := range opts {
 		if err := opt(o); err != nil {
 			return err
@@ -27,6 +46,33 @@ func (o *Options) apply(opts ...Option) error {
 	return nil
 }
 
+// WithAdvertiseJitter sets the maximum fraction of the advertise interval
+// which is randomly added or removed, 0 disables the jitter
+func WithAdvertiseJitter(jitter float64) Option {
+	return func(opts *Options) error {
+		if jitter < 0 || jitter >= 1 {
+			return fmt.Errorf("invalid advertise jitter %f, must be in [0, 1)", jitter)
+		}
+
+		opts.AdvertiseJitter = jitter
+		return nil
+	}
+}
+
+// WithAdvertiseBackoff sets the bounds of the delay before retrying a failed
+// advertise
+func WithAdvertiseBackoff(min, max time.Duration) Option {
+	return func(opts *Options) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid advertise backoff bounds [%s, %s]", min, max)
+		}
+
+		opts.AdvertiseBackoffMin = min
+		opts.AdvertiseBackoffMax = max
+		return nil
+	}
+}
+
 func FilterOutDrivers(drivers ...string) Option {
 	return func(opts *Options) error {
 		opts.DriverFilters = map[string]struct{}{}
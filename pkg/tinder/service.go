@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"go.uber.org/zap"
@@ -19,12 +21,32 @@ type Service struct {
 	drivers       []IDriver
 	networkNotify *NetworkUpdate
 
+	// clock times the advertises and the calls spacing, it is mocked by the
+	// tests
+	clock clock.Clock
+
 	topicCounter map[string]*Subscription
 	muTopics     sync.Mutex
 
 	// subscribe
 	peersCache *peersCache
 	process    uint32
+
+	mode        Mode
+	modeChanged chan struct{}
+	muMode      sync.Mutex
+
+	// lastCalls holds the time of the driver calls made in reduced mode, the
+	// calls of a topic are spaced by callInterval
+	lastCalls    map[string]time.Time
+	callInterval time.Duration
+
+	advertises   map[*advertiseState]struct{}
+	muAdvertises sync.Mutex
+
+	// lookups bounds the number of lookups running concurrently, see
+	// SetMaxConcurrentLookups
+	lookups *lookupQueue
 }
 
 func NewService(h host.Host, logger *zap.Logger, drivers ...IDriver) (*Service, error) {
@@ -38,8 +60,15 @@ func NewService(h host.Host, logger *zap.Logger, drivers ...IDriver) (*Service,
 		logger:        logger.Named("tinder"),
 		drivers:       drivers,
 		networkNotify: nn,
+		clock:         clock.New(),
 		topicCounter:  make(map[string]*Subscription),
 		peersCache:    newPeerCache(),
+		mode:          ModeActive,
+		modeChanged:   make(chan struct{}),
+		lastCalls:     make(map[string]time.Time),
+		callInterval:  reducedModeCallInterval,
+		advertises:    make(map[*advertiseState]struct{}),
+		lookups:       newLookupQueue(),
 	}, nil
 }
 
@@ -3,6 +3,7 @@ package tinder
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"go.uber.org/zap"
@@ -10,7 +11,14 @@ import (
 	"berty.tech/weshnet/v2/pkg/logutil"
 )
 
-const defaultTTL = time.Hour
+const (
+	defaultTTL = time.Hour
+
+	// the jitter is symmetric so the average advertise interval is unchanged
+	defaultAdvertiseJitter     = 0.1
+	defaultAdvertiseBackoffMin = time.Second * 30
+	defaultAdvertiseBackoffMax = time.Minute * 10
+)
 
 // StartAdvertises topic on each of service drivers
 func (s *Service) StartAdvertises(ctx context.Context, topic string, opts ...Option) error {
@@ -31,7 +39,7 @@ func (s *Service) StartAdvertises(ctx context.Context, topic string, opts ...Opt
 
 		// start background job
 		go func(driver IDriver) {
-			if err := s.advertise(ctx, driver, topic); err != nil {
+			if err := s.advertise(ctx, driver, topic, &aopts); err != nil {
 				s.logger.Debug("advertise ended", zap.Error(err))
 			}
 		}(driver)
@@ -40,13 +48,25 @@ func (s *Service) StartAdvertises(ctx context.Context, topic string, opts ...Opt
 	return nil
 }
 
-func (s *Service) advertise(ctx context.Context, d IDriver, topic string) error {
+func (s *Service) advertise(ctx context.Context, d IDriver, topic string, opts *Options) error {
+	state := s.registerAdvertise(topic, d.Name())
+	defer s.unregisterAdvertise(state)
+
+	failures := 0
 	for {
+		// wait for the service mode to allow the advertise, or for a forced
+		// advertise
+		if err := s.waitCall(ctx, "advertise/"+d.Name()+"/"+topic, state.refresh); err != nil {
+			return err
+		}
+
+		mode, modeChanged := s.WatchMode()
+
 		currentAddrs := s.networkNotify.GetLastUpdatedAddrs(ctx)
 
-		now := time.Now()
+		now := s.clock.Now()
 		ttl, err := d.Advertise(ctx, topic)
-		took := time.Since(now)
+		took := s.clock.Since(now)
 
 		var deadline time.Duration
 		if err != nil {
@@ -56,15 +76,20 @@ func (s *Service) advertise(ctx context.Context, d IDriver, topic string) error
 			default:
 			}
 
-			// retry in 30 seconds
-			deadline = time.Second * 30
+			// retry with an exponential backoff
+			failures++
+			deadline = backoffInterval(failures, opts.AdvertiseBackoffMin, opts.AdvertiseBackoffMax)
 		} else {
 			if ttl == 0 {
 				ttl = defaultTTL
 			}
+			failures = 0
 			deadline = 4 * ttl / 5
 		}
 
+		deadline = mode.ScaleInterval(jitterInterval(deadline, opts.AdvertiseJitter, rand.Float64))
+		s.updateAdvertise(state, now, ttl, err)
+
 		s.logger.Debug("advertise",
 			zap.String("driver", d.Name()),
 			logutil.PrivateString("topic", topic),
@@ -74,8 +99,25 @@ func (s *Service) advertise(ctx context.Context, d IDriver, topic string) error
 			zap.Error(err),
 		)
 
-		waitctx, cancel := context.WithTimeout(ctx, deadline)
-		// wait for network update or waitctx expire
+		waitctx, cancel := s.clock.WithTimeout(ctx, deadline)
+		go func() {
+			// a mode update or a forced advertise also ends the wait
+			select {
+			case <-modeChanged:
+				cancel()
+			case <-state.refresh:
+				// keep the refresh pending so the advertise isn't held by
+				// the service mode
+				select {
+				case state.refresh <- struct{}{}:
+				default:
+				}
+				cancel()
+			case <-waitctx.Done():
+			}
+		}()
+
+		// wait for network update, mode update or waitctx expire
 		_, ok := s.networkNotify.WaitForUpdate(waitctx, currentAddrs)
 		cancel()
 
@@ -93,3 +135,28 @@ func (s *Service) advertise(ctx context.Context, d IDriver, topic string) error
 		}
 	}
 }
+
+// jitterInterval randomly adds or removes up to jitter * d to d, rnd must
+// return a value in [0, 1)
+func jitterInterval(d time.Duration, jitter float64, rnd func() float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+
+	return d + time.Duration(float64(d)*jitter*(2*rnd()-1))
+}
+
+// backoffInterval returns the delay before retrying after the given number of
+// consecutive failures
+func backoffInterval(failures int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
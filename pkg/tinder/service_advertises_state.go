@@ -0,0 +1,100 @@
+package tinder
+
+import (
+	"sort"
+	"time"
+)
+
+// AdvertiseInfo describes the state of a topic being advertised on a driver
+type AdvertiseInfo struct {
+	Topic  string
+	Driver string
+
+	// LastAdvertise is the time of the last advertise attempt, zero if the
+	// topic hasn't been advertised yet
+	LastAdvertise time.Time
+	// TTL is the ttl returned by the driver on the last advertise
+	TTL time.Duration
+	// Error is the error returned by the driver on the last advertise, if any
+	Error error
+}
+
+type advertiseState struct {
+	info    AdvertiseInfo
+	refresh chan struct{}
+}
+
+func (s *Service) registerAdvertise(topic, driver string) *advertiseState {
+	state := &advertiseState{
+		info: AdvertiseInfo{
+			Topic:  topic,
+			Driver: driver,
+		},
+		refresh: make(chan struct{}, 1),
+	}
+
+	s.muAdvertises.Lock()
+	s.advertises[state] = struct{}{}
+	s.muAdvertises.Unlock()
+
+	return state
+}
+
+func (s *Service) unregisterAdvertise(state *advertiseState) {
+	s.muAdvertises.Lock()
+	delete(s.advertises, state)
+	s.muAdvertises.Unlock()
+}
+
+func (s *Service) updateAdvertise(state *advertiseState, at time.Time, ttl time.Duration, err error) {
+	s.muAdvertises.Lock()
+	state.info.LastAdvertise = at
+	state.info.TTL = ttl
+	state.info.Error = err
+	s.muAdvertises.Unlock()
+}
+
+// ListAdvertises returns the topics currently advertised by the service, sorted
+// by topic and driver
+func (s *Service) ListAdvertises() []AdvertiseInfo {
+	s.muAdvertises.Lock()
+	infos := make([]AdvertiseInfo, 0, len(s.advertises))
+	for state := range s.advertises {
+		infos = append(infos, state.info)
+	}
+	s.muAdvertises.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Topic != infos[j].Topic {
+			return infos[i].Topic < infos[j].Topic
+		}
+
+		return infos[i].Driver < infos[j].Driver
+	})
+
+	return infos
+}
+
+// RefreshAdvertises forces an immediate advertise of the given topic, or of
+// every advertised topic if topic is empty. It returns the number of
+// advertises which have been triggered.
+func (s *Service) RefreshAdvertises(topic string) int {
+	s.muAdvertises.Lock()
+	defer s.muAdvertises.Unlock()
+
+	count := 0
+	for state := range s.advertises {
+		if topic != "" && state.info.Topic != topic {
+			continue
+		}
+
+		select {
+		case state.refresh <- struct{}{}:
+		default: // a refresh is already pending
+		}
+
+		count++
+	}
+
+	return count
+}
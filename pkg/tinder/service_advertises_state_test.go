@@ -0,0 +1,86 @@
+package tinder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestServiceListAndRefreshAdvertises(t *testing.T) {
+	const topicA = "test_topic_a"
+	const topicB = "test_topic_b"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	driver := &advertiseCounterDriver{
+		IDriver:    NewMockDriverServer().Client(p),
+		advertised: make(chan string, 100),
+		// use a long ttl so the topics are only advertised once
+		ttl: time.Hour,
+	}
+
+	service, err := NewService(p, zap.NewNop(), driver)
+	require.NoError(t, err)
+	defer service.Close()
+
+	require.Empty(t, service.ListAdvertises())
+
+	actx, acancel := context.WithCancel(ctx)
+	require.NoError(t, service.StartAdvertises(actx, topicA))
+	require.NoError(t, service.StartAdvertises(ctx, topicB))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-driver.advertised:
+		case <-time.After(time.Second):
+			require.FailNow(t, "topics should be advertised")
+		}
+	}
+
+	infos := service.ListAdvertises()
+	require.Len(t, infos, 2)
+	require.Equal(t, topicA, infos[0].Topic)
+	require.Equal(t, topicB, infos[1].Topic)
+	for _, info := range infos {
+		require.Equal(t, driver.Name(), info.Driver)
+		require.Equal(t, time.Hour, info.TTL)
+		require.False(t, info.LastAdvertise.IsZero())
+		require.NoError(t, info.Error)
+	}
+
+	lastAdvertiseA := infos[0].LastAdvertise
+
+	// force a new advertise of the first topic only
+	require.Equal(t, 1, service.RefreshAdvertises(topicA))
+
+	select {
+	case topic := <-driver.advertised:
+		require.Equal(t, topicA, topic)
+	case <-time.After(time.Second):
+		require.FailNow(t, "topic should be advertised again")
+	}
+
+	infos = service.ListAdvertises()
+	require.Len(t, infos, 2)
+	require.True(t, infos[0].LastAdvertise.After(lastAdvertiseA))
+
+	// refresh every topic
+	require.Equal(t, 2, service.RefreshAdvertises(""))
+
+	// once the advertise is stopped, the topic isn't listed anymore
+	acancel()
+	require.Eventually(t, func() bool {
+		return len(service.ListAdvertises()) == 1
+	}, time.Second, time.Millisecond*10)
+}
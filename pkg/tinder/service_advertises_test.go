@@ -0,0 +1,175 @@
+package tinder
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type failingAdvertiseDriver struct {
+	IDriver
+	clock      clock.Clock
+	advertised chan time.Time
+}
+
+func (d *failingAdvertiseDriver) Advertise(ctx context.Context, topic string, opts ...discovery.Option) (time.Duration, error) {
+	select {
+	case d.advertised <- d.clock.Now():
+	default:
+	}
+
+	return 0, fmt.Errorf("unable to reach rendezvous point")
+}
+
+// timeoutClock is a mocked clock reporting the timeouts waited on by the
+// advertise loop, once their timer is registered
+type timeoutClock struct {
+	*clock.Mock
+	timeouts chan time.Duration
+}
+
+func (c *timeoutClock) WithTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := c.Mock.WithTimeout(parent, timeout)
+	select {
+	case c.timeouts <- timeout:
+	case <-parent.Done():
+	}
+	return ctx, cancel
+}
+
+func TestJitterInterval(t *testing.T) {
+	const (
+		interval = time.Minute
+		jitter   = 0.2
+	)
+
+	rnd := rand.New(rand.NewSource(42)) // nolint:gosec
+
+	min, max := time.Duration(float64(interval)*(1-jitter)), time.Duration(float64(interval)*(1+jitter))
+	seen := map[time.Duration]struct{}{}
+	var total time.Duration
+	for i := 0; i < 1000; i++ {
+		d := jitterInterval(interval, jitter, rnd.Float64)
+		require.GreaterOrEqual(t, d, min)
+		require.LessOrEqual(t, d, max)
+
+		seen[d] = struct{}{}
+		total += d
+	}
+
+	// successive intervals must vary, while keeping the same average
+	require.Greater(t, len(seen), 1)
+	require.InDelta(t, float64(interval), float64(total/1000), float64(interval)/20)
+
+	require.Equal(t, interval, jitterInterval(interval, 0, rnd.Float64))
+}
+
+func TestBackoffInterval(t *testing.T) {
+	const (
+		min = time.Second
+		max = time.Second * 10
+	)
+
+	require.Equal(t, time.Second, backoffInterval(1, min, max))
+	require.Equal(t, time.Second*2, backoffInterval(2, min, max))
+	require.Equal(t, time.Second*4, backoffInterval(3, min, max))
+	require.Equal(t, time.Second*8, backoffInterval(4, min, max))
+	require.Equal(t, max, backoffInterval(5, min, max))
+	require.Equal(t, max, backoffInterval(100, min, max))
+}
+
+func TestAdvertiseOptionsValidation(t *testing.T) {
+	var opts Options
+	require.NoError(t, opts.apply())
+	require.Equal(t, defaultAdvertiseJitter, opts.AdvertiseJitter)
+	require.Equal(t, defaultAdvertiseBackoffMin, opts.AdvertiseBackoffMin)
+	require.Equal(t, defaultAdvertiseBackoffMax, opts.AdvertiseBackoffMax)
+
+	require.Error(t, opts.apply(WithAdvertiseJitter(-0.1)))
+	require.Error(t, opts.apply(WithAdvertiseJitter(1)))
+	require.Error(t, opts.apply(WithAdvertiseBackoff(0, time.Second)))
+	require.Error(t, opts.apply(WithAdvertiseBackoff(time.Second, time.Millisecond)))
+}
+
+func TestAdvertiseErrorsBackoff(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	clk := &timeoutClock{
+		Mock:     clock.NewMock(),
+		timeouts: make(chan time.Duration, 1),
+	}
+
+	driver := &failingAdvertiseDriver{
+		IDriver:    NewMockDriverServer().Client(p),
+		clock:      clk,
+		advertised: make(chan time.Time, 10),
+	}
+
+	service, err := NewService(p, zap.NewNop(), driver)
+	require.NoError(t, err)
+	defer service.Close()
+
+	service.clock = clk
+
+	err = service.StartAdvertises(ctx, topic,
+		WithAdvertiseJitter(0),
+		WithAdvertiseBackoff(time.Millisecond*50, time.Millisecond*400),
+	)
+	require.NoError(t, err)
+
+	waitAttempt := func() time.Time {
+		select {
+		case at := <-driver.advertised:
+			return at
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, "advertise should be retried")
+		}
+		return time.Time{}
+	}
+
+	waitTimeout := func() time.Duration {
+		select {
+		case timeout := <-clk.timeouts:
+			return timeout
+		case <-time.After(time.Second * 5):
+			require.FailNow(t, "advertise should wait before retrying")
+		}
+		return 0
+	}
+
+	// the delay between retries doubles until it reaches the max backoff
+	last := waitAttempt()
+	expected := []time.Duration{50, 100, 200, 400, 400}
+	for i, want := range expected {
+		want *= time.Millisecond
+
+		timeout := waitTimeout()
+		require.Equal(t, want, timeout, "retry %d", i)
+
+		// advertise must not be retried before the end of the backoff
+		clk.Add(timeout - time.Millisecond)
+		require.Empty(t, driver.advertised, "retry %d", i)
+
+		clk.Add(time.Millisecond)
+		at := waitAttempt()
+		require.Equal(t, want, at.Sub(last), "retry %d", i)
+		last = at
+	}
+}
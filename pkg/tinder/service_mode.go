@@ -0,0 +1,152 @@
+package tinder
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Mode controls how aggressively the service advertises and looks up topics
+type Mode int32
+
+const (
+	// ModeActive advertises and looks up topics at the default pace
+	ModeActive Mode = iota
+	// ModeReduced slows down advertises and lookups
+	ModeReduced
+	// ModePaused stops advertises and lookups until the service is resumed
+	ModePaused
+)
+
+// reducedModeFactor is applied to the advertise and lookup intervals while
+// the service is in reduced mode
+const reducedModeFactor = 4
+
+// reducedModeCallInterval is the minimum delay between two advertises or two
+// lookups of a topic on the drivers while the service is in reduced mode
+const reducedModeCallInterval = time.Minute
+
+func (m Mode) String() string {
+	switch m {
+	case ModeActive:
+		return "active"
+	case ModeReduced:
+		return "reduced"
+	case ModePaused:
+		return "paused"
+	}
+
+	return "unknown"
+}
+
+// ScaleInterval returns the interval to use in place of d for the given mode
+func (m Mode) ScaleInterval(d time.Duration) time.Duration {
+	if m == ModeReduced {
+		return d * reducedModeFactor
+	}
+
+	return d
+}
+
+// SetMode updates the service mode, jobs waiting on the previous mode are
+// woken up so switching back to active mode takes effect immediately
+func (s *Service) SetMode(mode Mode) {
+	s.muMode.Lock()
+	defer s.muMode.Unlock()
+
+	if s.mode == mode {
+		return
+	}
+
+	s.logger.Debug("updating mode", zap.Stringer("from", s.mode), zap.Stringer("to", mode))
+
+	s.mode = mode
+	close(s.modeChanged)
+	s.modeChanged = make(chan struct{})
+
+	// the calls are only throttled while in reduced mode
+	s.lastCalls = make(map[string]time.Time)
+}
+
+// waitCall blocks until the driver call identified by key is allowed by the
+// service mode: the calls are held while the service is paused and spaced by
+// callInterval while it is reduced. A value on force allows the
+// call right away, a pending one is consumed by the allowed call.
+func (s *Service) waitCall(ctx context.Context, key string, force <-chan struct{}) error {
+	for {
+		s.muMode.Lock()
+		mode, modeChanged := s.mode, s.modeChanged
+
+		// a paused service waits for a mode update
+		var wait time.Duration = -1
+		switch mode {
+		case ModeActive:
+			wait = 0
+		case ModeReduced:
+			now := s.clock.Now()
+			next := s.lastCalls[key].Add(s.callInterval)
+			if wait = max(next.Sub(now), 0); wait == 0 {
+				s.recordCall(key, now)
+			}
+		}
+		s.muMode.Unlock()
+
+		if wait == 0 {
+			select {
+			case <-force:
+			default:
+			}
+
+			return nil
+		}
+
+		forced, err := s.waitModeUpdate(ctx, wait, modeChanged, force)
+		if err != nil || forced {
+			return err
+		}
+	}
+}
+
+// waitModeUpdate waits for d if it isn't negative, for a mode update or for a
+// value on force
+func (s *Service) waitModeUpdate(ctx context.Context, d time.Duration, modeChanged <-chan struct{}, force <-chan struct{}) (forced bool, err error) {
+	var wait <-chan time.Time
+	if d >= 0 {
+		timer := s.clock.Timer(d)
+		defer timer.Stop()
+		wait = timer.C
+	}
+
+	select {
+	case <-wait:
+	case <-modeChanged:
+	case <-force:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	return false, nil
+}
+
+// recordCall must be called with muMode held, the expired calls are pruned
+// so the map only holds the calls of the last interval
+func (s *Service) recordCall(key string, at time.Time) {
+	for k, last := range s.lastCalls {
+		if at.Sub(last) >= s.callInterval {
+			delete(s.lastCalls, k)
+		}
+	}
+
+	s.lastCalls[key] = at
+}
+
+// WatchMode returns the current mode of the service along with a channel
+// closed on the next mode update
+func (s *Service) WatchMode() (Mode, <-chan struct{}) {
+	s.muMode.Lock()
+	defer s.muMode.Unlock()
+
+	return s.mode, s.modeChanged
+}
@@ -0,0 +1,210 @@
+package tinder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type advertiseCounterDriver struct {
+	IDriver
+	advertised chan string
+	ttl        time.Duration
+}
+
+func (d *advertiseCounterDriver) Advertise(ctx context.Context, topic string, opts ...discovery.Option) (time.Duration, error) {
+	select {
+	case d.advertised <- topic:
+	default:
+	}
+
+	return d.ttl, nil
+}
+
+type lookupCounterDriver struct {
+	IDriver
+	lookups chan string
+}
+
+func (d *lookupCounterDriver) FindPeers(ctx context.Context, topic string, opts ...discovery.Option) (<-chan peer.AddrInfo, error) {
+	d.lookups <- topic
+
+	out := make(chan peer.AddrInfo)
+	close(out)
+	return out, nil
+}
+
+func TestServiceModePausedStopsAdvertises(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	driver := &advertiseCounterDriver{
+		IDriver:    NewMockDriverServer().Client(p),
+		advertised: make(chan string, 100),
+		// use a short ttl so the service advertises often
+		ttl: time.Millisecond * 100,
+	}
+
+	service, err := NewService(p, zap.NewNop(), driver)
+	require.NoError(t, err)
+	defer service.Close()
+
+	err = service.StartAdvertises(ctx, topic)
+	require.NoError(t, err)
+
+	select {
+	case <-driver.advertised:
+	case <-time.After(time.Second):
+		require.FailNow(t, "topic should be advertised in active mode")
+	}
+
+	service.SetMode(ModePaused)
+
+	// drain advertises which could have been in progress during the update
+	time.Sleep(time.Millisecond * 50)
+	for len(driver.advertised) > 0 {
+		<-driver.advertised
+	}
+
+	select {
+	case <-driver.advertised:
+		require.FailNow(t, "topic should not be advertised in paused mode")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	service.SetMode(ModeActive)
+
+	select {
+	case <-driver.advertised:
+	case <-time.After(time.Second):
+		require.FailNow(t, "topic should be advertised again once resumed")
+	}
+}
+
+func TestServiceModeReducedSpacesAdvertises(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	driver := &advertiseCounterDriver{
+		IDriver:    NewMockDriverServer().Client(p),
+		advertised: make(chan string, 100),
+		// the ttl alone would make the service advertise every few
+		// milliseconds
+		ttl: time.Millisecond * 10,
+	}
+
+	service, err := NewService(p, zap.NewNop(), driver)
+	require.NoError(t, err)
+	defer service.Close()
+
+	service.callInterval = time.Millisecond * 500
+	service.SetMode(ModeReduced)
+
+	err = service.StartAdvertises(ctx, topic)
+	require.NoError(t, err)
+
+	select {
+	case <-driver.advertised:
+	case <-time.After(time.Second):
+		require.FailNow(t, "topic should be advertised in reduced mode")
+	}
+
+	// the next advertise is held until the call interval has passed
+	start := time.Now()
+	select {
+	case <-driver.advertised:
+		require.GreaterOrEqual(t, time.Since(start), time.Millisecond*400)
+	case <-time.After(time.Second * 2):
+		require.FailNow(t, "topic should be advertised again after the call interval")
+	}
+
+	// a forced advertise isn't held
+	start = time.Now()
+	require.Equal(t, 1, service.RefreshAdvertises(topic))
+
+	select {
+	case <-driver.advertised:
+		require.Less(t, time.Since(start), time.Millisecond*400)
+	case <-time.After(time.Second):
+		require.FailNow(t, "topic should be advertised on refresh")
+	}
+}
+
+func TestServiceModePausedHoldsLookups(t *testing.T) {
+	const topic = "test_topic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	p, err := mn.GenPeer()
+	require.NoError(t, err)
+
+	driver := &lookupCounterDriver{
+		IDriver: NewMockDriverServer().Client(p),
+		lookups: make(chan string, 10),
+	}
+
+	service, err := NewService(p, zap.NewNop(), driver)
+	require.NoError(t, err)
+	defer service.Close()
+
+	service.SetMode(ModePaused)
+
+	done := make(chan error, 1)
+	go func() { done <- service.LookupPeers(ctx, topic) }()
+
+	select {
+	case <-driver.lookups:
+		require.FailNow(t, "topic should not be looked up in paused mode")
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	service.SetMode(ModeActive)
+
+	select {
+	case <-driver.lookups:
+	case <-time.After(time.Second):
+		require.FailNow(t, "topic should be looked up once resumed")
+	}
+	require.NoError(t, <-done)
+
+	// a paused lookup ends with its context
+	service.SetMode(ModePaused)
+
+	lookupCtx, lookupCancel := context.WithCancel(ctx)
+	go func() { done <- service.LookupPeers(lookupCtx, topic) }()
+	lookupCancel()
+
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.Empty(t, driver.lookups)
+}
+
+func TestServiceModeScaleInterval(t *testing.T) {
+	require.Equal(t, time.Minute, ModeActive.ScaleInterval(time.Minute))
+	require.Equal(t, time.Minute*reducedModeFactor, ModeReduced.ScaleInterval(time.Minute))
+}
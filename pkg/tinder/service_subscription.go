@@ -3,6 +3,7 @@ package tinder
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 	"go.uber.org/zap"
@@ -56,6 +57,19 @@ func (s *Service) LookupPeers(ctx context.Context, topic string, opts ...Option)
 		return fmt.Errorf("unable to apply option: %w", err)
 	}
 
+	// the lookup is held while the service is paused or throttled
+	if err := s.waitCall(ctx, "lookup/"+topic, nil); err != nil {
+		return fmt.Errorf("unable to start lookup: %w", err)
+	}
+
+	// the lookup is queued while too many lookups are running
+	release, err := s.lookups.acquire(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("unable to start lookup: %w", err)
+	}
+
+	// the lookup runs until every driver has returned its peers
+	var wg sync.WaitGroup
 	for _, d := range s.drivers {
 		if aopts.DriverFilters.ShouldFilter(d.Name()) {
 			continue
@@ -66,7 +80,12 @@ func (s *Service) LookupPeers(ctx context.Context, topic string, opts ...Option)
 		case nil: // ok
 			success++
 			s.logger.Debug("lookup for topic started", zap.String("driver", d.Name()), zap.String("topic", topic))
-			go s.fadeIn(ctx, topic, in)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.fadeIn(ctx, topic, in)
+			}()
 		case ErrNotSupported: // do nothing
 		default:
 			s.logger.Error("lookup failed",
@@ -74,6 +93,11 @@ func (s *Service) LookupPeers(ctx context.Context, topic string, opts ...Option)
 		}
 	}
 
+	go func() {
+		wg.Wait()
+		release()
+	}()
+
 	if success == 0 {
 		return fmt.Errorf("no driver(s) were available for lookup")
 	}
@@ -0,0 +1,10 @@
+package weshnet
+
+// ProtocolVersion is the semantic version of the protocol implemented by this
+// package, it is returned by ServiceGetConfiguration so clients can check the
+// compatibility between devices before exchanging data.
+//
+// It must be bumped deliberately: the major version when a change breaks the
+// compatibility with the previous versions, the minor version when a backward
+// compatible feature is added and the patch version otherwise.
+const ProtocolVersion = "1.1.0"
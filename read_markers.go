@@ -0,0 +1,100 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// readMarkers holds the last read message of each group. Markers are local,
+// they are never sent to the other peers.
+type readMarkers struct {
+	ds datastore.Batching
+}
+
+func newReadMarkers(ds datastore.Batching) *readMarkers {
+	return &readMarkers{ds: ds}
+}
+
+func readMarkerKey(groupPK []byte) datastore.Key {
+	return datastore.NewKey(hex.EncodeToString(groupPK))
+}
+
+// Set marks the messages of the group as read up to the given message
+func (m *readMarkers) Set(ctx context.Context, groupPK []byte, id cid.Cid) error {
+	if err := m.ds.Put(ctx, readMarkerKey(groupPK), id.Bytes()); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// Get returns the last read message of the group, cid.Undef if none has been
+// read yet
+func (m *readMarkers) Get(ctx context.Context, groupPK []byte) (cid.Cid, error) {
+	data, err := m.ds.Get(ctx, readMarkerKey(groupPK))
+	if err == datastore.ErrNotFound {
+		return cid.Undef, nil
+	} else if err != nil {
+		return cid.Undef, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	id, err := cid.Cast(data)
+	if err != nil {
+		return cid.Undef, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return id, nil
+}
+
+// unreadCount returns the number of entries of the store which aren't the
+// marker nor one of its ancestors, the chunks of the streamed messages aren't
+// counted
+func unreadCount(store orbitdb.Store, marker cid.Cid, isChunk func(cid.Cid) bool) uint64 {
+	oplog := store.OpLog()
+	total := uint64(0)
+	for _, entry := range oplog.GetEntries().Slice() {
+		if !isChunk(entry.GetHash()) {
+			total++
+		}
+	}
+
+	if !marker.Defined() {
+		return total
+	}
+
+	read := uint64(0)
+	visited := map[cid.Cid]struct{}{}
+	pending := []cid.Cid{marker}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+
+		// the ancestors which haven't been replicated yet are unknown
+		entry, ok := oplog.Get(id)
+		if !ok {
+			continue
+		}
+
+		if !isChunk(id) {
+			read++
+		}
+		pending = append(pending, entry.GetNext()...)
+	}
+
+	if read > total {
+		return 0
+	}
+
+	return total - read
+}
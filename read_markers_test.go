@@ -0,0 +1,84 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestServiceUnreadCounts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Logger: logger}, nil)
+	defer cleanup()
+
+	created, err := node.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	unread := func() uint64 {
+		reply, err := node.Client.ServiceGetUnreadCounts(ctx, &protocoltypes.ServiceGetUnreadCounts_Request{})
+		require.NoError(t, err)
+
+		// the account group isn't counted
+		require.Len(t, reply.Groups, 1)
+		require.Equal(t, created.GroupPk, reply.Groups[0].GroupPk)
+		require.Equal(t, reply.Groups[0].Unread, reply.Total)
+
+		return reply.Total
+	}
+
+	send := func(payload string) []byte {
+		reply, err := node.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte(payload),
+		})
+		require.NoError(t, err)
+
+		return reply.Cid
+	}
+
+	markRead := func(id []byte) error {
+		_, err := node.Client.ServiceMarkRead(ctx, &protocoltypes.ServiceMarkRead_Request{GroupPk: created.GroupPk, Cid: id})
+		return err
+	}
+
+	require.Zero(t, unread())
+
+	// every message is unread until one is marked as read
+	sent := [][]byte{}
+	for _, payload := range []string{"first", "second", "third"} {
+		sent = append(sent, send(payload))
+		require.Equal(t, uint64(len(sent)), unread())
+	}
+
+	require.NoError(t, markRead(sent[1]))
+	require.Equal(t, uint64(1), unread())
+
+	require.NoError(t, markRead(sent[2]))
+	require.Zero(t, unread())
+
+	send("fourth")
+	require.Equal(t, uint64(1), unread())
+
+	// only the messages of the group can be marked as read
+	unknown, err := cid.Parse("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	require.NoError(t, err)
+
+	require.Error(t, markRead(unknown.Bytes()))
+	require.Equal(t, uint64(1), unread())
+
+	// the marker is kept in the datastore of the device
+	marker, err := node.Service.(*service).odb.readMarkers.Get(ctx, created.GroupPk)
+	require.NoError(t, err)
+	require.Equal(t, sent[2], marker.Bytes())
+}
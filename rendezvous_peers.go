@@ -0,0 +1,81 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+	"moul.io/srand"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+// rendezvousConnectTimeout bounds the connection to a new rendezvous point
+const rendezvousConnectTimeout = time.Second * 20
+
+// rendezvousLookupCacheTTL is the time during which the peers found on the
+// rendezvous points for a topic are reused, see tinder.CachedDriver
+const rendezvousLookupCacheTTL = time.Second * 30
+
+// setRendezvousPeers replaces the rendezvous points used for discovery, the
+// topics are advertised on the new ones right away. The connections to the
+// previous rendezvous points are left to the connection manager so the
+// connections to the other peers aren't dropped.
+func (s *service) setRendezvousPeers(addrs []string) error {
+	if s.rendezvousDrivers == nil || s.swiper == nil || s.host == nil {
+		return errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("the rendezvous points can't be set on this service"))
+	}
+
+	maddrs := make([]ma.Multiaddr, len(addrs))
+	for i, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid address `%s`: %w", addr, err))
+		}
+
+		maddrs[i] = maddr
+	}
+
+	infos, err := peer.AddrInfosFromP2pAddrs(maddrs...)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid rendezvous point address: %w", err))
+	}
+
+	rng := mrand.New(mrand.NewSource(srand.MustSecure())) // nolint:gosec // we need to use math/rand here, but it is seeded from crypto/rand
+
+	drivers := make([]tinder.IDriver, len(infos))
+	for i, info := range infos {
+		// the rendezvous points don't answer the challenges of the gater
+		if s.contactGater != nil {
+			s.contactGater.AllowPeers(info.ID)
+		}
+
+		s.host.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+		drivers[i] = tinder.NewRendezvousDiscovery(s.logger, s.host, info.ID, tinder.PublicAddrsOnlyFactory, rng)
+
+		// the rendezvous client connects on its own, connecting early
+		// avoids delaying the first advertise
+		go func(info peer.AddrInfo) {
+			ctx, cancel := context.WithTimeout(s.ctx, rendezvousConnectTimeout)
+			defer cancel()
+
+			if err := s.host.Connect(ctx, info); err != nil {
+				s.logger.Warn("unable to connect to rendezvous point", logutil.PrivateStringer("peer", info.ID), zap.Error(err))
+			}
+		}(info)
+	}
+
+	s.rendezvousDrivers.SetDrivers(drivers...)
+	s.swiper.tinder.RefreshAdvertises("")
+
+	s.logger.Info("rendezvous points set", zap.Int("count", len(drivers)))
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package weshnet
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxReplicationLagPending is the number of messages sent by the current
+// device for which the delivery acks are awaited, the oldest ones are dropped
+// first
+const maxReplicationLagPending = 1024
+
+// replicationLag holds the replication lag observed for a device of a group
+type replicationLag struct {
+	DevicePK []byte
+	Samples  int64
+	Last     time.Duration
+	Average  time.Duration
+	Max      time.Duration
+}
+
+type replicationLagPending struct {
+	groupPK []byte
+	sentAt  time.Time
+	acked   map[string]struct{}
+}
+
+// replicationLagTracker measures the time between a message being added by
+// the current device and its delivery ack by each of the other devices being
+// received. It is local only and best effort: the messages sent before the
+// service started are not measured.
+type replicationLagTracker struct {
+	pending map[string]*replicationLagPending // message id -> pending acks
+	order   []string
+	groups  map[string]map[string]*replicationLag // group pk -> device pk -> lag
+	mu      sync.Mutex
+}
+
+func newReplicationLagTracker() *replicationLagTracker {
+	return &replicationLagTracker{
+		pending: make(map[string]*replicationLagPending),
+		groups:  make(map[string]map[string]*replicationLag),
+	}
+}
+
+// Sent records that a message has been added to the group by the current
+// device
+func (t *replicationLagTracker) Sent(groupPK []byte, messageID []byte, at time.Time) {
+	if t == nil || len(messageID) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.pending[string(messageID)]; ok {
+		return
+	}
+
+	if len(t.order) >= maxReplicationLagPending {
+		delete(t.pending, t.order[0])
+		t.order = t.order[1:]
+	}
+
+	t.pending[string(messageID)] = &replicationLagPending{
+		groupPK: groupPK,
+		sentAt:  at,
+		acked:   make(map[string]struct{}),
+	}
+	t.order = append(t.order, string(messageID))
+}
+
+// Acked records the delivery ack of a message by a device, only the first ack
+// of a message sent by the current device is measured
+func (t *replicationLagTracker) Acked(groupPK []byte, messageID []byte, devicePK []byte, at time.Time) {
+	if t == nil || len(devicePK) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending, ok := t.pending[string(messageID)]
+	if !ok || !bytes.Equal(pending.groupPK, groupPK) {
+		return
+	}
+
+	if _, ok := pending.acked[string(devicePK)]; ok {
+		return
+	}
+	pending.acked[string(devicePK)] = struct{}{}
+
+	lag := at.Sub(pending.sentAt)
+	if lag < 0 {
+		lag = 0
+	}
+
+	devices, ok := t.groups[string(groupPK)]
+	if !ok {
+		devices = make(map[string]*replicationLag)
+		t.groups[string(groupPK)] = devices
+	}
+
+	device, ok := devices[string(devicePK)]
+	if !ok {
+		device = &replicationLag{DevicePK: devicePK}
+		devices[string(devicePK)] = device
+	}
+
+	device.Average = (device.Average*time.Duration(device.Samples) + lag) / time.Duration(device.Samples+1)
+	device.Samples++
+	device.Last = lag
+	if lag > device.Max {
+		device.Max = lag
+	}
+}
+
+// Group returns the replication lag observed for each device of the group,
+// sorted by device public key
+func (t *replicationLagTracker) Group(groupPK []byte) []replicationLag {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lags := make([]replicationLag, 0, len(t.groups[string(groupPK)]))
+	for _, device := range t.groups[string(groupPK)] {
+		lags = append(lags, *device)
+	}
+
+	sort.Slice(lags, func(i, j int) bool {
+		return bytes.Compare(lags[i].DevicePK, lags[j].DevicePK) < 0
+	})
+
+	return lags
+}
@@ -0,0 +1,102 @@
+package weshnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestDebugGroupReplicationLag(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:     mn,
+		Logger:      logger,
+		ConnectFunc: weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	// the lag is measured from the delivery acks of the group
+	_, err := nodes[0].Client.GroupDeliveryAcksSet(ctx, &protocoltypes.GroupDeliveryAcksSet_Request{
+		GroupPk: group.PublicKey,
+		Enabled: true,
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		info, err := nodes[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+		return info.DeliveryAcks
+	}, time.Second*30, time.Millisecond*100)
+
+	receiverInfo, err := nodes[1].Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+
+	// nothing is measured before a message is sent
+	lags, err := nodes[0].Client.DebugGroupReplicationLag(ctx, &protocoltypes.DebugGroupReplicationLag_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+	require.Empty(t, lags.Devices)
+
+	sentAt := time.Now()
+	sent, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: group.PublicKey,
+		Payload: []byte("test"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		status, err := nodes[0].Client.GroupMessageDeliveryStatus(ctx, &protocoltypes.GroupMessageDeliveryStatus_Request{
+			GroupPk:   group.PublicKey,
+			MessageId: sent.Cid,
+		})
+		require.NoError(t, err)
+		return status.AckedDevices == 1
+	}, time.Second*30, time.Millisecond*100)
+	ackedWithin := time.Since(sentAt)
+
+	var device *protocoltypes.DebugGroupReplicationLag_Device
+	require.Eventually(t, func() bool {
+		lags, err := nodes[0].Client.DebugGroupReplicationLag(ctx, &protocoltypes.DebugGroupReplicationLag_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+		if len(lags.Devices) != 1 {
+			return false
+		}
+
+		device = lags.Devices[0]
+		return true
+	}, time.Second*5, time.Millisecond*100)
+
+	// the lag is measured between the message being sent and its ack being
+	// received, it can't exceed the time the test waited for the ack
+	require.Equal(t, receiverInfo.DevicePk, device.DevicePk)
+	require.Equal(t, int64(1), device.Samples)
+	require.GreaterOrEqual(t, device.LastLagMs, int64(0))
+	require.LessOrEqual(t, device.LastLagMs, ackedWithin.Milliseconds())
+	require.Equal(t, device.LastLagMs, device.AverageLagMs)
+	require.Equal(t, device.LastLagMs, device.MaxLagMs)
+
+	// the receiver has not sent any message
+	lags, err = nodes[1].Client.DebugGroupReplicationLag(ctx, &protocoltypes.DebugGroupReplicationLag_Request{GroupPk: group.PublicKey})
+	require.NoError(t, err)
+	require.Empty(t, lags.Devices)
+}
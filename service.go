@@ -4,9 +4,11 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
 	mrand "math/rand"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -14,16 +16,19 @@ import (
 	ds "github.com/ipfs/go-datastore"
 	ds_sync "github.com/ipfs/go-datastore/sync"
 	badger "github.com/ipfs/go-ds-badger2"
+	ipfs_config "github.com/ipfs/kubo/config"
 	coreiface "github.com/ipfs/kubo/core/coreiface"
+	p2p "github.com/libp2p/go-libp2p"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
-	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
 	"github.com/libp2p/go-libp2p/core/network"
 	backoff "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"moul.io/srand"
@@ -33,12 +38,15 @@ import (
 	"berty.tech/go-orbit-db/pubsub/directchannel"
 	"berty.tech/go-orbit-db/pubsub/pubsubraw"
 	"berty.tech/weshnet/v2/internal/bertyversion"
+	"berty.tech/weshnet/v2/internal/capabilities"
 	"berty.tech/weshnet/v2/internal/datastoreutil"
 	"berty.tech/weshnet/v2/pkg/bertyvcissuer"
+	"berty.tech/weshnet/v2/pkg/contactgater"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/ipfsutil"
 	ipfs_mobile "berty.tech/weshnet/v2/pkg/ipfsutil/mobile"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/proximitytransport"
 	"berty.tech/weshnet/v2/pkg/secretstore"
 	tinder "berty.tech/weshnet/v2/pkg/tinder"
 	"berty.tech/weshnet/v2/pkg/tyber"
@@ -53,6 +61,11 @@ type Service interface {
 	Close() error
 	Status() Status
 	IpfsCoreAPI() coreiface.CoreAPI
+	ExportIdentity(ctx context.Context, output io.Writer, passphrase []byte) error
+	ExportDeviceKeystore(ctx context.Context, output io.Writer, passphrase []byte) error
+	ExportGroupBundle(ctx context.Context, output io.Writer, groupPK []byte, passphrase []byte) error
+	ImportGroupBundle(ctx context.Context, reader io.Reader, passphrase []byte) (*protocoltypes.Group, error)
+	MigrateGroupStore(ctx context.Context, groupPK []byte, targetDir string) error
 }
 
 type service struct {
@@ -77,6 +90,64 @@ type service struct {
 	contactRequestsManager *contactRequestsManager
 	vcClient               *bertyvcissuer.Client
 	secretStore            secretstore.SecretStore
+	outgoingInterceptor    OutgoingMessageInterceptor
+	capabilities           *capabilities.Manager
+	contactGater           *contactgater.Gater
+	deliveryAcksDisabled   bool
+	contactRequestRetry    bool
+	contactInvitationsOnly bool
+	rootDatastore          ds.Batching
+	datastoreDir           string
+	messageIndexer         MessageIndexer
+	bandwidthReporter      metrics.Reporter
+	maxGoroutines          int
+	shedding               atomic.Bool
+	// replicationMode is the protocoltypes.ServiceSetReplicationMode_Mode
+	// set by the app, see setReplicationMode
+	replicationMode atomic.Int32
+
+	// replicationAllowlist holds the groups which can be replicated, all the
+	// groups can be if nil, see setReplicationAllowlist
+	replicationAllowlist map[string]struct{}
+	// replicationRestricted holds the activated groups which have only been
+	// opened locally because they are outside of the allowlist
+	replicationRestricted map[string]struct{}
+	// localOnlyGroups holds the activated groups which have been opened
+	// locally at the request of the caller, they are reopened the same way
+	// when reactivated
+	localOnlyGroups map[string]struct{}
+
+	// groupSnapshotInterval is the interval at which the snapshots of the
+	// multi-member groups are published, see Opts.GroupSnapshotInterval
+	groupSnapshotInterval time.Duration
+
+	// closeNetwork closes the IPFS node and the network components owned by
+	// the service, it runs before the stores are closed, see Shutdown
+	closeNetwork func() error
+	shutdownOnce sync.Once
+	shutdownErr  error
+	// groupStoreDatastores holds the datastores of the migrated groups, by
+	// directory, see MigrateGroupStore
+	groupStoreDatastores   map[string]ds.Batching
+	muGroupStoreDatastores sync.Mutex
+	// datastoreKey and datastoreSalt encrypt the root datastore when it has
+	// been opened by the service, see Opts.DatastoreKey
+	datastoreKey  []byte
+	datastoreSalt []byte
+	// pendingDatastoreKey is the key the root datastore is rekeyed with once
+	// released, see ServiceRekeyStorage
+	pendingDatastoreKey   []byte
+	muPendingDatastoreKey sync.Mutex
+	// shutdownStepHook is called at the start of each shutdown step, it is
+	// only set by the tests
+	shutdownStepHook func(step string)
+
+	// tracer emits the spans of the key operations, see Opts.TracerProvider
+	tracer trace.Tracer
+
+	// rendezvousDrivers holds the clients of the rendezvous points, see
+	// setRendezvousPeers
+	rendezvousDrivers *tinder.DriverSet
 
 	protocoltypes.UnimplementedProtocolServiceServer
 }
@@ -94,12 +165,157 @@ type Opts struct {
 	GRPCInsecureMode   bool
 	LocalOnly          bool
 	close              func() error
+	rootDatastoreKey   []byte
+	closeNetwork       func() error
 	SecretStore        secretstore.SecretStore
 	PrometheusRegister prometheus.Registerer
 
+	// OutgoingMessageInterceptor is an optional hook called before a message is
+	// added to a group, see OutgoingMessageInterceptor
+	OutgoingMessageInterceptor OutgoingMessageInterceptor
+
+	// DisableDeliveryAcks prevents the device from acknowledging the delivery
+	// of the messages it receives, even in the groups where the delivery
+	// acknowledgements have been enabled, see GroupDeliveryAcksSet
+	DisableDeliveryAcks bool
+
+	// ContactInvitationsOnly rejects the invitations to multi-member groups
+	// which haven't been created by an added contact, to prevent being added
+	// to groups by strangers, the group bundles are rejected too as they
+	// don't identify who shared them. The groups joined by the other devices
+	// of the account are followed whatever their own setting is. The
+	// invitations are accepted from anyone by default.
+	ContactInvitationsOnly bool
+
+	// ContactGater closes the connections of the peers, over any transport,
+	// which can't prove they are a device of the account or of an added
+	// contact. It should also be given to the host with
+	// libp2p.ConnectionGater, so the inbound connections of the unknown peers
+	// are rejected before being upgraded. The peers which can't answer the
+	// challenges, such as the relays, the rendezvous points and the DHT
+	// nodes, must be given to contactgater.WithAllowedPeers, the rendezvous
+	// points set at runtime are allowed by the service. The challenges of
+	// the contacts are only answered while it is set, they must enable it
+	// too. The contact requests of strangers can't be received while it is
+	// set. The connections aren't verified by default.
+	ContactGater *contactgater.Gater
+
+	// ContactRequestRetry keeps retrying to send the outgoing contact
+	// requests which failed to be delivered, each time their target is
+	// connected and with an exponential backoff, until they are sent or
+	// canceled
+	ContactRequestRetry bool
+
+	// MessageIndexer is used to speed up the searches of group messages,
+	// the messages are scanned if nil, see MessageIndexer
+	MessageIndexer MessageIndexer
+
+	// BandwidthReporter is the reporter given to the host and to the
+	// proximity transports, it is used by ServiceGetBandwidthStats. Defaults
+	// to the reporter of the IPFS node when it is created by the service.
+	BandwidthReporter metrics.Reporter
+
+	// DatastoreKey encrypts the root datastore opened by the service in
+	// DatastoreDir when RootDatastore is nil, it is opened like
+	// GetRootDatastoreForPath with DatastoreSalt. The root datastore can only
+	// be rekeyed with ServiceRekeyStorage when it is set.
+	DatastoreKey  []byte
+	DatastoreSalt []byte
+
 	// These are used if OrbitDB is nil.
 	GroupMetadataStoreType string
 	GroupMessageStoreType  string
+	// InboundWorkers is the number of received group entries processed
+	// concurrently, defaults to 4
+	InboundWorkers int
+
+	// MaxGoroutines is a soft cap on the number of goroutines of the process,
+	// the replication concurrency is reduced while it is exceeded. Disabled
+	// if 0.
+	MaxGoroutines int
+
+	// DisableStrictSignatureVerification accepts the group entries and
+	// messages failing the signature verification instead of rejecting them,
+	// a warning is logged for each of them. It must only be used for
+	// debugging.
+	DisableStrictSignatureVerification bool
+
+	// MembershipValidator is an optional hook called before a device added to
+	// a group is listed as a member, see MembershipValidator. It is only used
+	// if OrbitDB is nil.
+	MembershipValidator MembershipValidator
+
+	// UnknownMemberPolicy defines how the messages sent by a device which
+	// isn't a known member of their group are handled, see
+	// UnknownMemberPolicy. It is only used if OrbitDB is nil.
+	UnknownMemberPolicy UnknownMemberPolicy
+
+	// DatastoreRetry configures the retries of the writes to the root
+	// datastore failing with a transient error, e.g. while the disk is full,
+	// the other errors are returned right away. The defaults of
+	// datastoreutil.RetryOptions are used if nil.
+	DatastoreRetry *datastoreutil.RetryOptions
+
+	// OrbitDBCacheDir is the directory of the datastore holding the caches of
+	// the OrbitDB stores, ie. their heads, so they can be kept on a faster or
+	// ephemeral storage than DatastoreDir. Once cleared, a store is empty
+	// until its heads have been exchanged again with the other peers. The
+	// caches are kept in the root datastore if it is empty and
+	// OrbitDBCacheDatastore is nil. It is only used if OrbitDB is nil.
+	OrbitDBCacheDir string
+	// OrbitDBCacheDatastore is the datastore holding the caches of the
+	// OrbitDB stores, see OrbitDBCacheDir
+	OrbitDBCacheDatastore ds.Batching
+
+	// SeparateEncryptionKeys encrypts the secrets shared with the other
+	// members using keys derived from the account key, the device keys are
+	// then only used to sign, see
+	// secretstore.NewSecretStoreOptions.SeparateEncryptionKeys. It is only used
+	// if SecretStore is nil.
+	SeparateEncryptionKeys bool
+
+	// CipherSuites and SealingCipherSuite are the cipher suites used to
+	// encrypt and open the group entries, see
+	// secretstore.NewSecretStoreOptions.CipherSuites. They are only used if
+	// SecretStore is nil.
+	CipherSuites       []secretstore.CipherSuite
+	SealingCipherSuite secretstore.CipherSuite
+
+	// GroupSnapshotInterval is the interval at which a signed snapshot of
+	// each activated multi-member group is published, so the new members can
+	// bootstrap from it, see GroupSnapshotGet. No snapshot is published
+	// periodically if zero.
+	GroupSnapshotInterval time.Duration
+
+	// MaxConcurrentLookups bounds the number of discovery lookups running at
+	// the same time, the other lookups are queued and the ones of the high
+	// priority groups run first, see ServiceSetGroupPriority. The lookups
+	// aren't bounded if zero.
+	MaxConcurrentLookups int
+
+	// TracerProvider is used to emit OpenTelemetry spans around the key
+	// operations, such as the message sends, the group activations, the
+	// connections to peers, the discovery lookups and the exports. The group
+	// public keys and the peer IDs set as attributes are redacted like the
+	// private fields of the logs, see logutil.SetRedactionMode. No span is
+	// emitted if nil.
+	TracerProvider trace.TracerProvider
+
+	// AdvertisedAddrsFilter restricts the multiaddrs advertised by the node,
+	// e.g. tinder.RelayAddrsOnlyFactory to only advertise the relayed addrs
+	// or tinder.ProtocolAddrsOnlyFactory with the code of a proximity driver
+	// to only advertise the proximity addrs. It is only applied to the node
+	// built by the service, a host given through IpfsCoreAPI must be
+	// configured with ipfsutil.AddrsFilterOption instead. All the addrs are
+	// advertised if nil.
+	AdvertisedAddrsFilter tinder.AddrsFilter
+
+	// RendezvousDrivers holds the clients of the rendezvous points, they are
+	// replaced by ServiceSetRendezvousPeers. It is added to the default
+	// tinder service, it must be one of the drivers of TinderService when
+	// both are given. The rendezvous points can't be set at runtime if it is
+	// nil while TinderService is given.
+	RendezvousDrivers *tinder.DriverSet
 }
 
 func (opts *Opts) applyPushDefaults() {
@@ -116,35 +332,101 @@ func (opts *Opts) applyDefaultsGetDatastore() error {
 	if opts.RootDatastore == nil {
 		if opts.DatastoreDir == "" || opts.DatastoreDir == InMemoryDirectory {
 			opts.RootDatastore = ds_sync.MutexWrap(ds.NewMapDatastore())
+		} else if len(opts.DatastoreKey) != 0 {
+			ds, err := opts.openEncryptedDatastore(opts.DatastoreDir)
+			if err != nil {
+				return err
+			}
+			opts.RootDatastore = ds
 		} else {
-			bopts := badger.DefaultOptions
-			bopts.ValueLogLoadingMode = options.FileIO
-
-			ds, err := badger.NewDatastore(opts.DatastoreDir, &bopts)
+			ds, err := opts.openBadgerDatastore(opts.DatastoreDir)
 			if err != nil {
-				return fmt.Errorf("unable to init badger datastore: %w", err)
+				return err
 			}
 			opts.RootDatastore = ds
+		}
+	}
 
-			oldClose := opts.close
-			opts.close = func() error {
-				var err error
-				if oldClose != nil {
-					err = oldClose()
-				}
-
-				if dserr := ds.Close(); dserr != nil {
-					err = multierr.Append(err, fmt.Errorf("unable to close datastore: %w", dserr))
-				}
-
+	if opts.OrbitDBCacheDatastore == nil && opts.OrbitDBCacheDir != "" {
+		if opts.OrbitDBCacheDir == InMemoryDirectory {
+			opts.OrbitDBCacheDatastore = ds_sync.MutexWrap(ds.NewMapDatastore())
+		} else {
+			ds, err := opts.openBadgerDatastore(opts.OrbitDBCacheDir)
+			if err != nil {
 				return err
 			}
+			opts.OrbitDBCacheDatastore = ds
 		}
 	}
 
 	return nil
 }
 
+// newBadgerDatastore opens a badger datastore in dir
+func newBadgerDatastore(dir string) (*badger.Datastore, error) {
+	bopts := badger.DefaultOptions
+	bopts.ValueLogLoadingMode = options.FileIO
+
+	ds, err := badger.NewDatastore(dir, &bopts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to init badger datastore: %w", err)
+	}
+
+	return ds, nil
+}
+
+// openBadgerDatastore opens a badger datastore in dir, it is closed along with
+// the service
+func (opts *Opts) openBadgerDatastore(dir string) (*badger.Datastore, error) {
+	ds, err := newBadgerDatastore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	oldClose := opts.close
+	opts.close = func() error {
+		var err error
+		if oldClose != nil {
+			err = oldClose()
+		}
+
+		if dserr := ds.Close(); dserr != nil {
+			err = multierr.Append(err, fmt.Errorf("unable to close datastore: %w", dserr))
+		}
+
+		return err
+	}
+
+	return ds, nil
+}
+
+// openEncryptedDatastore opens the root datastore in dir encrypted with
+// DatastoreKey, it is closed along with the service
+func (opts *Opts) openEncryptedDatastore(dir string) (ds.Batching, error) {
+	rootDS, err := GetRootDatastoreForPath(dir, opts.DatastoreKey, opts.DatastoreSalt, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.rootDatastoreKey = opts.DatastoreKey
+
+	oldClose := opts.close
+	opts.close = func() error {
+		var err error
+		if oldClose != nil {
+			err = oldClose()
+		}
+
+		if dserr := rootDS.Close(); dserr != nil {
+			err = multierr.Append(err, fmt.Errorf("unable to close datastore: %w", dserr))
+		}
+
+		return err
+	}
+
+	return rootDS, nil
+}
+
 func (opts *Opts) applyDefaults(ctx context.Context) error {
 	if opts.Logger == nil {
 		opts.Logger = zap.NewNop()
@@ -158,9 +440,17 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 
 	opts.applyPushDefaults()
 
+	// the components write through a datastore retrying the transient errors,
+	// the root datastore itself is kept for the storage maintenance
+	storeDatastore := datastoreutil.NewRetryDatastore(opts.RootDatastore, opts.DatastoreRetry)
+
 	if opts.SecretStore == nil {
-		secretStore, err := secretstore.NewSecretStore(opts.RootDatastore, &secretstore.NewSecretStoreOptions{
-			Logger: opts.Logger,
+		secretStore, err := secretstore.NewSecretStore(storeDatastore, &secretstore.NewSecretStoreOptions{
+			Logger:                             opts.Logger,
+			DisableStrictSignatureVerification: opts.DisableStrictSignatureVerification,
+			SeparateEncryptionKeys:             opts.SeparateEncryptionKeys,
+			CipherSuites:                       opts.CipherSuites,
+			SealingCipherSuite:                 opts.SealingCipherSuite,
 		})
 		if err != nil {
 			return errcode.ErrCode_ErrInternal.Wrap(err)
@@ -171,10 +461,7 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 
 	var mnode *ipfs_mobile.IpfsMobile
 	if opts.IpfsCoreAPI == nil {
-		dsync := opts.RootDatastore
-		if dsync == nil {
-			dsync = ds_sync.MutexWrap(ds.NewMapDatastore())
-		}
+		dsync := storeDatastore
 
 		repo, err := ipfsutil.CreateMockedRepo(dsync)
 		if err != nil {
@@ -182,7 +469,20 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 		}
 
 		mrepo := ipfs_mobile.NewRepoMobile(opts.DatastoreDir, repo)
-		mnode, err = ipfsutil.NewIPFSMobile(ctx, mrepo, &ipfsutil.MobileOptions{})
+		mnode, err = ipfsutil.NewIPFSMobile(ctx, mrepo, &ipfsutil.MobileOptions{
+			IpfsConfigPatch: func(cfg *ipfs_config.Config) ([]p2p.Option, error) {
+				p2popts := []p2p.Option{
+					ipfsutil.AddrsFilterOption(opts.AdvertisedAddrsFilter),
+				}
+
+				// the default dial ranker is kept without proximity transport
+				if ipfsutil.HasProximityListenAddrs(cfg.Addresses.Swarm) {
+					p2popts = append(p2popts, ipfsutil.ProximityPreferredOption())
+				}
+
+				return p2popts, nil
+			},
+		})
 		if err != nil {
 			return err
 		}
@@ -193,8 +493,12 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 		}
 		opts.Host = mnode.PeerHost()
 
-		oldClose := opts.close
-		opts.close = func() error {
+		if opts.BandwidthReporter == nil && mnode.IpfsNode.Reporter != nil {
+			opts.BandwidthReporter = mnode.IpfsNode.Reporter
+		}
+
+		oldClose := opts.closeNetwork
+		opts.closeNetwork = func() error {
 			if oldClose != nil {
 				_ = oldClose()
 			}
@@ -207,6 +511,22 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 		opts.Host = opts.IpfsCoreAPI
 	}
 
+	if opts.Host != nil {
+		latencyTracker, err := ipfsutil.NewConnLatencyTracker(opts.Host, opts.PrometheusRegister)
+		if err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to setup connection latency metrics: %w", err))
+		}
+
+		oldClose := opts.closeNetwork
+		opts.closeNetwork = func() error {
+			if oldClose != nil {
+				_ = oldClose()
+			}
+
+			return latencyTracker.Close()
+		}
+	}
+
 	// setup default tinder service
 	if opts.TinderService == nil {
 		drivers := []tinder.IDriver{}
@@ -223,12 +543,24 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 			drivers = append(drivers, dhtdisc)
 		}
 
+		// the rendezvous points are set at runtime
+		if opts.RendezvousDrivers == nil {
+			opts.RendezvousDrivers = tinder.NewDriverSet("rdvp")
+		}
+		// the lookups of the rendezvous points are cached so the peers of a
+		// topic aren't requested from them on each lookup
+		drivers = append(drivers, tinder.NewCachedDriver(opts.RendezvousDrivers, rendezvousLookupCacheTTL))
+
 		opts.TinderService, err = tinder.NewService(opts.Host, opts.Logger, drivers...)
 		if err != nil {
 			return fmt.Errorf("unable to setup tinder service: %w", err)
 		}
 	}
 
+	if opts.MaxConcurrentLookups > 0 {
+		opts.TinderService.SetMaxConcurrentLookups(opts.MaxConcurrentLookups)
+	}
+
 	if opts.PubSub == nil {
 		var err error
 
@@ -277,10 +609,16 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 				Logger:    opts.Logger,
 			},
 			PrometheusRegister:     opts.PrometheusRegister,
-			Datastore:              datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceOrbitDBDatastore)),
+			Datastore:              datastoreutil.NewNamespacedDatastore(storeDatastore, ds.NewKey(NamespaceOrbitDBDatastore)),
+			CacheDatastore:         opts.OrbitDBCacheDatastore,
 			SecretStore:            opts.SecretStore,
 			GroupMetadataStoreType: opts.GroupMetadataStoreType,
 			GroupMessageStoreType:  opts.GroupMessageStoreType,
+			InboundWorkers:         opts.InboundWorkers,
+			MembershipValidator:    opts.MembershipValidator,
+			UnknownMemberPolicy:    opts.UnknownMemberPolicy,
+
+			DisableStrictSignatureVerification: opts.DisableStrictSignatureVerification,
 		}
 
 		if opts.Host != nil {
@@ -292,13 +630,15 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 			return err
 		}
 
+		// the stores are closed before the datastore is released
 		oldClose := opts.close
 		opts.close = func() error {
+			err := odb.Close()
 			if oldClose != nil {
 				_ = oldClose()
 			}
 
-			return odb.Close()
+			return err
 		}
 
 		opts.OrbitDB = odb
@@ -346,7 +686,7 @@ func NewService(opts Opts) (_ Service, err error) {
 		swiper = NewSwiper(opts.Logger, opts.TinderService, opts.OrbitDB.rotationInterval)
 		opts.Logger.Debug("Tinder swiper is enabled", tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
 
-		if contactRequestsManager, err = newContactRequestsManager(swiper, accountGroupCtx.metadataStore, opts.IpfsCoreAPI, opts.Logger); err != nil {
+		if contactRequestsManager, err = newContactRequestsManager(swiper, accountGroupCtx.metadataStore, opts.IpfsCoreAPI, opts.Logger, newTracer(opts.TracerProvider), opts.ContactRequestRetry); err != nil {
 			cancel()
 			return nil, errcode.ErrCode_TODO.Wrap(err)
 		}
@@ -359,6 +699,31 @@ func NewService(opts Opts) (_ Service, err error) {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to add account group to group datastore, err: %w", err))
 	}
 
+	// optional features must be negotiated with each peer before being used
+	var capabilitiesManager *capabilities.Manager
+	if opts.Host != nil {
+		if capabilitiesManager, err = proximitytransport.NewCapabilitiesManager(opts.Logger, opts.Host, groupEncryptionFeature()); err != nil {
+			cancel()
+			return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to start capabilities manager, err: %w", err))
+		}
+
+		opts.OrbitDB.encryption.setCapabilities(capabilitiesManager)
+	}
+
+	if opts.Host != nil && opts.BandwidthReporter != nil {
+		for _, t := range proximitytransport.HostTransports(opts.Host) {
+			t.SetBandwidthReporter(opts.BandwidthReporter)
+		}
+	}
+
+	if opts.Host != nil && opts.ContactGater != nil {
+		contactKeys := contactGaterKeys(accountGroupCtx, opts.SecretStore)
+		if err := opts.ContactGater.Start(opts.Host, contactKeys); err != nil {
+			cancel()
+			return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to start contact gater, err: %w", err))
+		}
+	}
+
 	s := &service{
 		ctx:             ctx,
 		ctxCancel:       cancel,
@@ -367,6 +732,7 @@ func NewService(opts Opts) (_ Service, err error) {
 		logger:          opts.Logger,
 		odb:             opts.OrbitDB,
 		close:           opts.close,
+		closeNetwork:    opts.closeNetwork,
 		accountGroupCtx: accountGroupCtx,
 		swiper:          swiper,
 		startedAt:       time.Now(),
@@ -374,14 +740,36 @@ func NewService(opts Opts) (_ Service, err error) {
 			string(accountGroupCtx.Group().PublicKey): accountGroupCtx,
 		},
 		secretStore:            opts.SecretStore,
+		outgoingInterceptor:    opts.OutgoingMessageInterceptor,
 		grpcInsecure:           opts.GRPCInsecureMode,
 		refreshprocess:         make(map[string]context.CancelFunc),
 		peerStatusManager:      NewConnectednessManager(),
 		accountEventBus:        accountEventBus,
 		contactRequestsManager: contactRequestsManager,
+		capabilities:           capabilitiesManager,
+		contactGater:           opts.ContactGater,
+		deliveryAcksDisabled:   opts.DisableDeliveryAcks,
+		contactRequestRetry:    opts.ContactRequestRetry,
+		contactInvitationsOnly: opts.ContactInvitationsOnly,
+		rootDatastore:          opts.RootDatastore,
+		datastoreDir:           opts.DatastoreDir,
+		datastoreKey:           opts.rootDatastoreKey,
+		datastoreSalt:          opts.DatastoreSalt,
+		messageIndexer:         opts.MessageIndexer,
+		bandwidthReporter:      opts.BandwidthReporter,
+		maxGoroutines:          opts.MaxGoroutines,
+		groupSnapshotInterval:  opts.GroupSnapshotInterval,
+		tracer:                 newTracer(opts.TracerProvider),
+		rendezvousDrivers:      opts.RendezvousDrivers,
+	}
+
+	if s.host != nil {
+		s.host.SetStreamHandler(importFromPeerProtocol, s.handleImportFromPeer)
 	}
 
 	s.startGroupDeviceMonitor()
+	s.startLinkedDevicesMonitor()
+	s.startRuntimeMonitor()
 
 	return s, nil
 }
@@ -390,50 +778,9 @@ func (s *service) IpfsCoreAPI() coreiface.CoreAPI {
 	return s.ipfsCoreAPI
 }
 
+// Close shuts the service down without deadline, see Shutdown
 func (s *service) Close() error {
-	endSection := tyber.SimpleSection(tyber.ContextWithoutTraceID(s.ctx), s.logger, "Closing ProtocolService")
-
-	var err error
-	pks := []crypto.PubKey{}
-
-	// gather public keys
-	s.lock.Lock()
-
-	if s.contactRequestsManager != nil {
-		s.contactRequestsManager.close()
-		s.contactRequestsManager = nil
-	}
-
-	for _, gc := range s.openedGroups {
-		pk, subErr := gc.group.GetPubKey()
-		if subErr != nil {
-			err = multierr.Append(err, subErr)
-			continue
-		}
-
-		pks = append(pks, pk)
-	}
-	s.lock.Unlock()
-
-	// deactivate all groups
-	for _, pk := range pks {
-		derr := s.deactivateGroup(pk)
-		if derr != nil {
-			err = multierr.Append(derr, derr)
-		}
-	}
-
-	err = multierr.Append(err, s.odb.Close())
-
-	if s.close != nil {
-		err = multierr.Append(err, s.close())
-	}
-
-	endSection(err)
-
-	s.ctxCancel()
-
-	return err
+	return s.Shutdown(context.Background())
 }
 
 func (s *service) startGroupDeviceMonitor() {
@@ -480,10 +827,16 @@ func (s *service) startGroupDeviceMonitor() {
 				case network.NotConnected:
 					s.peerStatusManager.UpdateState(e.Peer, ConnectednessTypeDisconnected)
 				}
+
+				// a disconnection is also the last time we saw the device
+				if dpk, ok := s.odb.GetDevicePKForPeerID(e.Peer); ok {
+					s.odb.lastSeen.SeenPubKey(dpk.DevicePK, time.Now())
+				}
 			case baseorbitdb.EventExchangeHeads:
 				if dpk, ok := s.odb.GetDevicePKForPeerID(e.Peer); ok {
 					gkey := hex.EncodeToString(dpk.Group.PublicKey)
 					s.peerStatusManager.AssociatePeer(gkey, e.Peer)
+					s.odb.lastSeen.SeenPubKey(dpk.DevicePK, time.Now())
 				}
 			}
 		}
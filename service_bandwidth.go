@@ -0,0 +1,63 @@
+package weshnet
+
+import (
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/proximitytransport"
+)
+
+// weshnetProtocolPrefixes are the prefixes of the protocols used by weshnet:
+// its own protocols, the orbit-db direct channels and the pubsub used to
+// replicate the groups
+var weshnetProtocolPrefixes = []string{
+	"/wesh/",
+	"wesh/",
+	"/go-orbit-db/",
+	"/meshsub/",
+	"/floodsub/",
+}
+
+func isWeshnetProtocol(p protocol.ID) bool {
+	for _, prefix := range weshnetProtocolPrefixes {
+		if strings.HasPrefix(string(p), prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bandwidthStats returns the traffic of the weshnet protocols and of the
+// proximity transports recorded by the reporter
+func bandwidthStats(reporter metrics.Reporter) *protocoltypes.ServiceGetBandwidthStats_Reply {
+	reply := &protocoltypes.ServiceGetBandwidthStats_Reply{
+		Weshnet:   &protocoltypes.BandwidthStats{},
+		Protocols: map[string]*protocoltypes.BandwidthStats{},
+		Proximity: &protocoltypes.BandwidthStats{},
+	}
+
+	for p, stats := range reporter.GetBandwidthByProtocol() {
+		switch {
+		case strings.HasPrefix(string(p), proximitytransport.BandwidthProtocolPrefix):
+			addBandwidthStats(reply.Proximity, stats)
+
+		case isWeshnetProtocol(p):
+			reply.Protocols[string(p)] = &protocoltypes.BandwidthStats{}
+			addBandwidthStats(reply.Protocols[string(p)], stats)
+			addBandwidthStats(reply.Weshnet, stats)
+		}
+	}
+
+	return reply
+}
+
+func addBandwidthStats(dst *protocoltypes.BandwidthStats, stats metrics.Stats) {
+	dst.TotalIn += stats.TotalIn
+	dst.TotalOut += stats.TotalOut
+	dst.RateIn += stats.RateIn
+	dst.RateOut += stats.RateOut
+}
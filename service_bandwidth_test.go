@@ -0,0 +1,79 @@
+package weshnet_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestServiceGetBandwidthStats(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		ConnectFunc:     weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	group := weshnet.CreateMultiMemberGroupInstance(ctx, t, nodes...)
+
+	getStats := func(node *weshnet.TestingProtocol) *protocoltypes.ServiceGetBandwidthStats_Reply {
+		stats, err := node.Client.ServiceGetBandwidthStats(ctx, &protocoltypes.ServiceGetBandwidthStats_Request{})
+		require.NoError(t, err)
+		return stats
+	}
+
+	sender, receiver := getStats(nodes[0]), getStats(nodes[1])
+
+	const (
+		messages    = 5
+		payloadSize = 4096
+	)
+
+	for i := 0; i < messages; i++ {
+		_, err := nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: group.PublicKey,
+			Payload: make([]byte, payloadSize),
+		})
+		require.NoError(t, err)
+	}
+
+	// each message is at least sent once along with the new heads of the
+	// group log
+	require.Eventually(t, func() bool {
+		return getStats(nodes[0]).Weshnet.TotalOut-sender.Weshnet.TotalOut >= messages*payloadSize &&
+			getStats(nodes[1]).Weshnet.TotalIn-receiver.Weshnet.TotalIn >= messages*payloadSize
+	}, time.Second*10, time.Millisecond*200)
+
+	// only the weshnet protocols are reported, the mocknet doesn't use the
+	// proximity transports
+	stats := getStats(nodes[0])
+	require.NotEmpty(t, stats.Protocols)
+	for p := range stats.Protocols {
+		require.False(t, strings.HasPrefix(p, "/ipfs/"), p)
+	}
+	require.Zero(t, stats.Proximity.TotalIn)
+	require.Zero(t, stats.Proximity.TotalOut)
+}
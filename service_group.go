@@ -1,10 +1,13 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"berty.tech/go-orbit-db/iface"
@@ -70,6 +73,8 @@ func (s *service) deactivateGroup(pk crypto.PubKey) error {
 	}
 
 	delete(s.openedGroups, string(id))
+	delete(s.replicationRestricted, string(id))
+	delete(s.localOnlyGroups, string(id))
 
 	if cg.group.GroupType == protocoltypes.GroupType_GroupTypeAccount {
 		s.accountGroupCtx = nil
@@ -78,12 +83,15 @@ func (s *service) deactivateGroup(pk crypto.PubKey) error {
 	return nil
 }
 
-func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly bool) error {
+func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly bool) (err error) {
 	id, err := pk.Raw()
 	if err != nil {
 		return errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
+	ctx, span := s.tracer.Start(ctx, "ActivateGroup", trace.WithAttributes(traceGroupPK(id)))
+	defer func() { endSpan(span, err) }()
+
 	_, err = s.GetContextGroupForID(id)
 	if err != nil && err != errcode.ErrCode_ErrGroupUnknown {
 		return err
@@ -126,7 +134,7 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 		if s.contactRequestsManager != nil {
 			s.contactRequestsManager.close()
 
-			if s.contactRequestsManager, err = newContactRequestsManager(s.swiper, s.accountGroupCtx.metadataStore, s.ipfsCoreAPI, s.logger); err != nil {
+			if s.contactRequestsManager, err = newContactRequestsManager(s.swiper, s.accountGroupCtx.metadataStore, s.ipfsCoreAPI, s.logger, s.tracer, s.contactRequestRetry); err != nil {
 				return errcode.ErrCode_TODO.Wrap(err)
 			}
 		}
@@ -135,12 +143,30 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 		return errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unknown group type"))
 	}
 
+	requestedLocalOnly := localOnly
+
+	// the groups outside of the allowlist are neither advertised nor
+	// replicated with the other peers
+	restricted := !localOnly && !s.unsafeReplicationAllowed(id)
+	if restricted {
+		localOnly = true
+	}
+
+	// a migrated group is opened from the datastore it has been moved to
+	if err := s.restoreGroupStore(ctx, g); err != nil {
+		return errcode.ErrCode_ErrGroupOpen.Wrap(err)
+	}
+
 	dbOpts := &iface.CreateDBOptions{LocalOnly: &localOnly}
 	gc, err := s.odb.OpenGroup(ctx, g, dbOpts)
 	if err != nil {
 		return errcode.ErrCode_ErrGroupOpen.Wrap(err)
 	}
 
+	if g.GroupType == protocoltypes.GroupType_GroupTypeMultiMember && s.accountGroupCtx != nil {
+		gc.left = s.accountGroupCtx.metadataStore.isGroupLeft(id)
+	}
+
 	if err = gc.ActivateGroupContext(contactPK); err != nil {
 		gc.Close()
 		return errcode.ErrCode_ErrGroupActivate.Wrap(err)
@@ -148,10 +174,323 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 
 	s.openedGroups[string(id)] = gc
 
+	if restricted {
+		if s.replicationRestricted == nil {
+			s.replicationRestricted = map[string]struct{}{}
+		}
+		s.replicationRestricted[string(id)] = struct{}{}
+	}
+
+	if requestedLocalOnly {
+		if s.localOnlyGroups == nil {
+			s.localOnlyGroups = map[string]struct{}{}
+		}
+		s.localOnlyGroups[string(id)] = struct{}{}
+	}
+
+	if !s.deliveryAcksDisabled {
+		gc.AckDeliveredMessages()
+	}
+
+	if s.messageIndexer != nil {
+		gc.IndexMessages(s.messageIndexer)
+	}
+
+	s.setGroupLookupPriority(gc, s.odb.inboundPool.groupPriority(id))
+
+	if g.GroupType == protocoltypes.GroupType_GroupTypeMultiMember && s.groupSnapshotInterval > 0 {
+		s.startGroupSnapshots(gc, s.groupSnapshotInterval)
+	}
+
 	gc.TagGroupContextPeers(s.ipfsCoreAPI, 42)
 	return nil
 }
 
+// listAllGroups lists the groups recorded in the account group metadata, the
+// account group, the groups of the added contacts and the joined multi-member
+// groups, whether they are activated or not
+func (s *service) listAllGroups() ([]*protocoltypes.ServiceListAllGroups_GroupEntry, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	metadataStore := accountGroup.MetadataStore()
+
+	entries := []*protocoltypes.ServiceListAllGroups_GroupEntry{{
+		GroupPk:   accountGroup.Group().PublicKey,
+		GroupType: protocoltypes.GroupType_GroupTypeAccount,
+	}}
+
+	contacts := []*protocoltypes.ServiceListAllGroups_GroupEntry{}
+	for _, contact := range metadataStore.ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		contactPK, err := contact.GetPubKey()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		group, err := s.getContactGroup(contactPK)
+		if err != nil {
+			return nil, err
+		}
+
+		contacts = append(contacts, &protocoltypes.ServiceListAllGroups_GroupEntry{
+			GroupPk:   group.PublicKey,
+			GroupType: protocoltypes.GroupType_GroupTypeContact,
+			ContactPk: contact.Pk,
+		})
+	}
+
+	multiMembers := []*protocoltypes.ServiceListAllGroups_GroupEntry{}
+	for _, group := range metadataStore.ListMultiMemberGroups() {
+		multiMembers = append(multiMembers, &protocoltypes.ServiceListAllGroups_GroupEntry{
+			GroupPk:   group.PublicKey,
+			GroupType: protocoltypes.GroupType_GroupTypeMultiMember,
+		})
+	}
+
+	for _, groupPK := range metadataStore.ListLeftMultiMemberGroupPKs() {
+		multiMembers = append(multiMembers, &protocoltypes.ServiceListAllGroups_GroupEntry{
+			GroupPk:   groupPK,
+			GroupType: protocoltypes.GroupType_GroupTypeMultiMember,
+			Left:      true,
+		})
+	}
+
+	// the metadata index is a map, sort the groups to keep a stable order
+	for _, groups := range [][]*protocoltypes.ServiceListAllGroups_GroupEntry{contacts, multiMembers} {
+		sort.Slice(groups, func(i, j int) bool {
+			return bytes.Compare(groups[i].GroupPk, groups[j].GroupPk) < 0
+		})
+	}
+
+	entries = append(entries, contacts...)
+	entries = append(entries, multiMembers...)
+
+	s.lock.RLock()
+	for _, entry := range entries {
+		_, entry.Active = s.openedGroups[string(entry.GroupPk)]
+	}
+	s.lock.RUnlock()
+
+	return entries, nil
+}
+
+// leaveGroup leaves a multi-member group, the departure is recorded in the
+// account group so the other devices of the account leave it too, then the
+// group is deactivated which stops its replication and its advertising. If
+// notifyMembers is set, a GroupMemberLeft event is sent to the group first.
+// The local data of the group is kept.
+func (s *service) leaveGroup(ctx context.Context, pk crypto.PubKey, notifyMembers bool) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return err
+	}
+
+	if g.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return errcode.ErrCode_ErrGroupInvalidType.Wrap(fmt.Errorf("only multi-member groups can be left"))
+	}
+
+	if notifyMembers {
+		cg, err := s.GetContextGroupForID(g.PublicKey)
+		if err != nil {
+			if err := s.activateGroup(ctx, pk, false); err != nil {
+				return errcode.ErrCode_ErrGroupActivate.Wrap(err)
+			}
+
+			if cg, err = s.GetContextGroupForID(g.PublicKey); err != nil {
+				return errcode.ErrCode_ErrGroupUnknown.Wrap(err)
+			}
+		}
+
+		if _, err := cg.MetadataStore().MemberLeave(ctx); err != nil {
+			return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	if _, err := accountGroup.MetadataStore().GroupLeave(ctx, pk); err != nil {
+		return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	if err := s.deactivateGroup(pk); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// setGroupPriority sets the replication priority of a group of the account,
+// the entries received by its stores are picked up by the inbound worker
+// pool according to it
+func (s *service) setGroupPriority(ctx context.Context, pk crypto.PubKey, priority protocoltypes.GroupPriority) error {
+	if _, ok := protocoltypes.GroupPriority_name[int32(priority)]; !ok {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown group priority %d", priority))
+	}
+
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return err
+	}
+
+	s.odb.inboundPool.setGroupPriority(g.PublicKey, priority)
+	if gc, err := s.GetContextGroupForID(g.PublicKey); err == nil {
+		s.setGroupLookupPriority(gc, priority)
+	}
+
+	s.logger.Debug("group priority set", zap.Stringer("priority", priority))
+
+	return nil
+}
+
+// setGroupTopic sets the custom pubsub topic of a group of the account, the
+// default topics are used again if topic is empty. The topic is kept across
+// restarts. The group is reactivated if it is activated so its stores join
+// the new topics.
+func (s *service) setGroupTopic(ctx context.Context, pk crypto.PubKey, topic string) error {
+	if topic != "" {
+		if err := validateGroupTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return err
+	}
+
+	if g.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the topic of the account group can't be set"))
+	}
+
+	if err := s.odb.groupTopics.setGroup(ctx, g.GroupIDAsString(), topic); err != nil {
+		return err
+	}
+
+	if _, err := s.GetContextGroupForID(g.PublicKey); err == nil {
+		if err := s.reactivateGroup(ctx, pk); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Debug("group topic set", zap.Bool("custom", topic != ""))
+
+	return nil
+}
+
+// setGroupLookupPriority makes the queued discovery lookups of the stores of
+// the group run first if it has a high priority, see Opts.MaxConcurrentLookups
+func (s *service) setGroupLookupPriority(gc *GroupContext, priority protocoltypes.GroupPriority) {
+	if s.swiper == nil {
+		return
+	}
+
+	for _, store := range []iface.Store{gc.MetadataStore(), gc.MessageStore()} {
+		topic := s.odb.groupTopics.storeDiscoveryNamespace(store.Address().String())
+		s.swiper.tinder.SetTopicPriority(topic, priority == protocoltypes.GroupPriority_GroupPriorityHigh)
+	}
+}
+
+// setReplicationAllowlist restricts the replication to the given groups, the
+// account group is always allowed. The activated groups are reactivated when
+// they enter or leave the allowlist. A nil allowlist allows all the groups.
+func (s *service) setReplicationAllowlist(ctx context.Context, groupPKs []crypto.PubKey) error {
+	var allowlist map[string]struct{}
+	if groupPKs != nil {
+		allowlist = make(map[string]struct{}, len(groupPKs))
+		for _, pk := range groupPKs {
+			id, err := pk.Raw()
+			if err != nil {
+				return errcode.ErrCode_ErrSerialization.Wrap(err)
+			}
+
+			allowlist[string(id)] = struct{}{}
+		}
+	}
+
+	s.lock.Lock()
+	s.replicationAllowlist = allowlist
+
+	reactivate := []*protocoltypes.Group{}
+	for id, gc := range s.openedGroups {
+		// the groups opened locally by the caller aren't replicated anyway
+		if _, localOnly := s.localOnlyGroups[id]; localOnly || gc.group.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+			continue
+		}
+
+		_, restricted := s.replicationRestricted[id]
+		if restricted == s.unsafeReplicationAllowed([]byte(id)) {
+			reactivate = append(reactivate, gc.group)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, g := range reactivate {
+		pk, err := g.GetPubKey()
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if err := s.reactivateGroup(ctx, pk); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Debug("replication allowlist set", zap.Int("groups", len(groupPKs)), zap.Bool("enabled", allowlist != nil), zap.Int("reactivated", len(reactivate)))
+
+	return nil
+}
+
+// reactivateGroup closes an activated group and opens it again, locally
+// only if it was opened that way
+func (s *service) reactivateGroup(ctx context.Context, pk crypto.PubKey) error {
+	id, err := pk.Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	localOnly := s.isGroupLocalOnly(id)
+
+	if err := s.deactivateGroup(pk); err != nil {
+		return errcode.ErrCode_ErrGroupDeactivate.Wrap(err)
+	}
+
+	if err := s.activateGroup(ctx, pk, localOnly); err != nil {
+		return errcode.ErrCode_ErrGroupActivate.Wrap(err)
+	}
+
+	return nil
+}
+
+// isGroupLocalOnly returns true if the group has been activated locally only
+// by the caller
+func (s *service) isGroupLocalOnly(id []byte) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, localOnly := s.localOnlyGroups[string(id)]
+	return localOnly
+}
+
+// unsafeReplicationAllowed returns true if the group can be replicated, s.lock
+// must be held
+func (s *service) unsafeReplicationAllowed(id []byte) bool {
+	if s.replicationAllowlist == nil {
+		return true
+	}
+
+	if accountGroup := s.accountGroupCtx; accountGroup != nil && bytes.Equal(accountGroup.Group().PublicKey, id) {
+		return true
+	}
+
+	_, ok := s.replicationAllowlist[string(id)]
+	return ok
+}
+
 func (s *service) GetContextGroupForID(id []byte) (*GroupContext, error) {
 	if len(id) == 0 {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("no group id provided"))
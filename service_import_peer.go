@@ -0,0 +1,290 @@
+package weshnet
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.uber.org/zap"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/stores"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/protoio"
+)
+
+const (
+	// importFromPeerProtocol is used to request the heads of a group from the
+	// peer it is imported from
+	importFromPeerProtocol = protocol.ID("/wesh/import_heads/1.0.0")
+
+	// importFromPeerTimeout bounds an import when the request context has no
+	// deadline
+	importFromPeerTimeout = time.Minute
+
+	// importFromPeerMaxMessageSize bounds the messages of the heads request
+	importFromPeerMaxMessageSize = 64 * 1024
+)
+
+// importFromPeer connects to the given peer and replicates the logs of the
+// group from the heads it sends, it returns the number of entries imported
+// from those heads.
+//
+// The heads are requested explicitly, so the existing connections with the
+// peer are kept and the entries replicated from other peers in the meantime
+// aren't counted.
+func (s *service) importFromPeer(ctx context.Context, gc *GroupContext, info peer.AddrInfo) (int64, error) {
+	if s.host == nil {
+		return 0, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("no host available"))
+	}
+
+	if info.ID == s.host.ID() {
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to import from self"))
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, importFromPeerTimeout)
+		defer cancel()
+	}
+
+	if err := s.connectPeer(ctx, info); err != nil {
+		return 0, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to connect to peer: %w", err))
+	}
+
+	heads, err := s.requestGroupHeads(ctx, gc, info.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := int64(0)
+	for _, store := range []struct {
+		store orbitdb.Store
+		heads [][]byte
+	}{
+		{gc.metadataStore, heads.MetadataHeads},
+		{gc.messageStore, heads.MessageHeads},
+	} {
+		count, err := importStoreHeads(ctx, store.store, store.heads)
+		if err != nil {
+			return 0, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to replicate store: %w", err))
+		}
+
+		imported += count
+	}
+
+	s.logger.Info("imported group logs from peer",
+		logutil.PrivateStringer("peer", info.ID),
+		logutil.PrivateBinary("group", gc.Group().PublicKey),
+		zap.Int64("entries", imported))
+
+	return imported, nil
+}
+
+// requestGroupHeads requests the heads of the logs of the group to the peer
+func (s *service) requestGroupHeads(ctx context.Context, gc *GroupContext, pid peer.ID) (*protocoltypes.ImportFromPeerHeads_Reply, error) {
+	proof, err := importFromPeerProof(gc.Group(), s.host.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := s.host.NewStream(ctx, pid, importFromPeerProtocol)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(fmt.Errorf("unable to open stream: %w", err))
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	if err := protoio.NewDelimitedWriter(stream).WriteMsg(&protocoltypes.ImportFromPeerHeads_Request{
+		GroupPk: gc.Group().PublicKey,
+		Proof:   proof,
+	}); err != nil {
+		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	reply := &protocoltypes.ImportFromPeerHeads_Reply{}
+	if err := protoio.NewDelimitedReader(stream, importFromPeerMaxMessageSize).ReadMsg(reply); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(fmt.Errorf("no heads received from peer: %w", err))
+	}
+
+	return reply, nil
+}
+
+// handleImportFromPeer sends the heads of an activated group to a member
+// importing it
+func (s *service) handleImportFromPeer(stream network.Stream) {
+	defer stream.Close()
+
+	remote := stream.Conn().RemotePeer()
+
+	req := &protocoltypes.ImportFromPeerHeads_Request{}
+	if err := protoio.NewDelimitedReader(stream, importFromPeerMaxMessageSize).ReadMsg(req); err != nil {
+		s.logger.Warn("invalid heads request", logutil.PrivateStringer("peer", remote), zap.Error(err))
+		_ = stream.Reset()
+		return
+	}
+
+	gc, err := s.GetContextGroupForID(req.GroupPk)
+	if err != nil {
+		_ = stream.Reset()
+		return
+	}
+
+	proof, err := importFromPeerProof(gc.Group(), remote)
+	if err != nil || !hmac.Equal(proof, req.Proof) {
+		s.logger.Warn("heads requested by a peer outside of the group", logutil.PrivateStringer("peer", remote))
+		_ = stream.Reset()
+		return
+	}
+
+	if err := protoio.NewDelimitedWriter(stream).WriteMsg(&protocoltypes.ImportFromPeerHeads_Reply{
+		MetadataHeads: storeHeads(gc.metadataStore),
+		MessageHeads:  storeHeads(gc.messageStore),
+	}); err != nil {
+		s.logger.Warn("unable to send heads", logutil.PrivateStringer("peer", remote), zap.Error(err))
+		_ = stream.Reset()
+	}
+}
+
+// importFromPeerProof returns the proof that the given peer knows the link
+// key of the group
+func importFromPeerProof(g *protocoltypes.Group, pid peer.ID) ([]byte, error) {
+	linkKey, err := g.GetLinkKeyArray()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	mac := hmac.New(sha256.New, linkKey[:])
+	mac.Write([]byte(importFromPeerProtocol))
+	mac.Write([]byte(pid))
+
+	return mac.Sum(nil), nil
+}
+
+// importStoreHeads loads the given heads in the store and waits until they
+// are part of its log, it returns the number of entries reachable from them
+// which weren't part of the log before
+func importStoreHeads(ctx context.Context, store orbitdb.Store, heads [][]byte) (int64, error) {
+	known := map[cid.Cid]struct{}{}
+	for _, e := range store.OpLog().GetEntries().Slice() {
+		known[e.GetHash()] = struct{}{}
+	}
+
+	missing, err := missingStoreEntries(store, heads)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := waitForHeads(ctx, store, missing); err != nil {
+		return 0, err
+	}
+
+	imported := int64(0)
+	visited := map[cid.Cid]struct{}{}
+	pending := make([]cid.Cid, 0, len(missing))
+	for _, head := range missing {
+		pending = append(pending, head.GetHash())
+	}
+
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if _, ok := visited[id]; ok {
+			continue
+		}
+		visited[id] = struct{}{}
+
+		if _, ok := known[id]; ok {
+			continue
+		}
+
+		e, ok := store.OpLog().Get(id)
+		if !ok {
+			continue
+		}
+
+		imported++
+		pending = append(pending, e.GetNext()...)
+	}
+
+	return imported, nil
+}
+
+// waitForHeads loads the given heads in the store and waits until they are
+// part of its log
+func waitForHeads(ctx context.Context, store orbitdb.Store, heads []ipfslog.Entry) error {
+	if len(heads) == 0 {
+		return nil
+	}
+
+	sub, err := store.EventBus().Subscribe(new(stores.EventReplicated),
+		eventbus.Name("weshnet/service/import-from-peer-replicated"))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to EventReplicated: %w", err)
+	}
+	defer sub.Close()
+
+	missingHeads := func() []ipfslog.Entry {
+		missing := []ipfslog.Entry{}
+		for _, head := range heads {
+			if _, ok := store.OpLog().Get(head.GetHash()); !ok {
+				missing = append(missing, head)
+			}
+		}
+		return missing
+	}
+
+	missing := missingHeads()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	store.Replicator().Load(ctx, missing)
+
+	for len(missing) > 0 {
+		select {
+		case <-sub.Out():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		missing = missingHeads()
+	}
+
+	return nil
+}
+
+// peerAddrInfo parses the peer id and the optional addresses of a peer
+func peerAddrInfo(peerID string, addrs []string) (peer.AddrInfo, error) {
+	pid, err := peer.Decode(peerID)
+	if err != nil {
+		return peer.AddrInfo{}, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid peer id: %w", err))
+	}
+
+	info := peer.AddrInfo{ID: pid}
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return peer.AddrInfo{}, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid address `%s`: %w", addr, err))
+		}
+
+		info.Addrs = append(info.Addrs, maddr)
+	}
+
+	return info, nil
+}
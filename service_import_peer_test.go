@@ -0,0 +1,154 @@
+package weshnet_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestServiceImportFromPeer(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	// the nodes use distinct discovery servers so they can't find each other,
+	// the backlog can only be imported by dialing the source explicitly
+	source, sourceCleanup := weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger.Named("source"),
+		DiscoveryServer: tinder.NewMockDriverServer(),
+	}, nil)
+	defer sourceCleanup()
+
+	target, targetCleanup := weshnet.NewTestingProtocol(ctx, t, &weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger.Named("target"),
+		DiscoveryServer: tinder.NewMockDriverServer(),
+	}, nil)
+	defer targetCleanup()
+
+	require.NoError(t, mn.LinkAll())
+
+	group, _, err := weshnet.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	for _, node := range []*weshnet.TestingProtocol{source, target} {
+		_, err := node.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: group})
+		require.NoError(t, err)
+
+		_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: group.PublicKey})
+		require.NoError(t, err)
+	}
+
+	const backlog = 10
+	for i := 0; i < backlog; i++ {
+		_, err := source.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: group.PublicKey,
+			Payload: []byte("backlog"),
+		})
+		require.NoError(t, err)
+	}
+
+	sourceConfig, err := source.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	_, err = target.Client.ServiceImportFromPeer(ctx, &protocoltypes.ServiceImportFromPeer_Request{
+		GroupPk: group.PublicKey,
+		PeerId:  "invalid",
+	})
+	require.Error(t, err)
+
+	_, err = target.Client.ServiceImportFromPeer(ctx, &protocoltypes.ServiceImportFromPeer_Request{
+		GroupPk: []byte("unknown group"),
+		PeerId:  sourceConfig.PeerId,
+		Addrs:   sourceConfig.Listeners,
+	})
+	require.Error(t, err)
+
+	sourceEntries := groupLogEntries(ctx, t, source, group.PublicKey)
+	targetEntries := groupLogEntries(ctx, t, target, group.PublicKey)
+	for id := range sourceEntries {
+		require.NotContains(t, targetEntries, id)
+	}
+
+	reply, err := target.Client.ServiceImportFromPeer(ctx, &protocoltypes.ServiceImportFromPeer_Request{
+		GroupPk: group.PublicKey,
+		PeerId:  sourceConfig.PeerId,
+		Addrs:   sourceConfig.Listeners,
+	})
+	require.NoError(t, err)
+
+	// every entry of the source is imported, the metadata entries along the
+	// messages. The source may have added entries since, e.g. to send its
+	// secret to the target, but only the new entries are counted.
+	imported := groupLogEntries(ctx, t, target, group.PublicKey)
+	for id := range sourceEntries {
+		require.Contains(t, imported, id)
+	}
+	require.GreaterOrEqual(t, reply.ImportedEntries, int64(len(sourceEntries)))
+	require.LessOrEqual(t, reply.ImportedEntries, int64(len(imported)-len(targetEntries)))
+
+	sub, err := target.Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+		GroupPk:  group.PublicKey,
+		UntilNow: true,
+	})
+	require.NoError(t, err)
+
+	messages := 0
+	for {
+		evt, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		require.Equal(t, []byte("backlog"), evt.Message)
+		messages++
+	}
+	require.Equal(t, backlog, messages)
+}
+
+// groupLogEntries returns the cids of the entries of both logs of the group
+func groupLogEntries(ctx context.Context, t *testing.T, node *weshnet.TestingProtocol, groupPK []byte) map[string]struct{} {
+	t.Helper()
+
+	entries := map[string]struct{}{}
+	for _, logType := range []protocoltypes.DebugInspectGroupLogType{
+		protocoltypes.DebugInspectGroupLogType_DebugInspectGroupLogTypeMetadata,
+		protocoltypes.DebugInspectGroupLogType_DebugInspectGroupLogTypeMessage,
+	} {
+		sub, err := node.Client.DebugInspectGroupStore(ctx, &protocoltypes.DebugInspectGroupStore_Request{
+			GroupPk: groupPK,
+			LogType: logType,
+		})
+		require.NoError(t, err)
+
+		for {
+			reply, err := sub.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+
+			entries[string(reply.Cid)] = struct{}{}
+		}
+	}
+
+	return entries
+}
@@ -0,0 +1,232 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// messageEditIndex holds the edits of the messages of a group by the CID of
+// the message they replace, from the oldest. Their authors are checked when
+// they are applied. The index is loaded from the log the first time it is
+// used, then it is updated as the messages are processed.
+type messageEditIndex struct {
+	edits  map[string][]*protocoltypes.GroupMessageEvent
+	ids    map[string]struct{}
+	loaded bool
+	mu     sync.RWMutex
+}
+
+func newMessageEditIndex() *messageEditIndex {
+	return &messageEditIndex{
+		edits: map[string][]*protocoltypes.GroupMessageEvent{},
+		ids:   map[string]struct{}{},
+	}
+}
+
+// load reads the edits of the log of the store, if not already done
+func (i *messageEditIndex) load(ctx context.Context, m *MessageStore) error {
+	i.mu.RLock()
+	loaded := i.loaded
+	i.mu.RUnlock()
+
+	if loaded {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.loaded {
+		return nil
+	}
+
+	// the messages processed meanwhile are in the log, they wait for the
+	// index to be loaded
+	events, err := m.ListEvents(ctx, nil, nil, false)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	for evt := range events {
+		i.add(evt)
+	}
+
+	i.loaded = true
+
+	return nil
+}
+
+// reset drops the edits, they are read again from the log on the next use
+func (i *messageEditIndex) reset() {
+	i.mu.Lock()
+	i.edits = map[string][]*protocoltypes.GroupMessageEvent{}
+	i.ids = map[string]struct{}{}
+	i.loaded = false
+	i.mu.Unlock()
+}
+
+// UpdateIndex records a processed message if it is an edit, nothing is done
+// until the index is loaded as the message is then read from the log
+func (i *messageEditIndex) UpdateIndex(evt *protocoltypes.GroupMessageEvent) {
+	if len(evt.EditOf) == 0 {
+		return
+	}
+
+	i.mu.Lock()
+	if i.loaded {
+		i.add(evt)
+	}
+	i.mu.Unlock()
+}
+
+func (i *messageEditIndex) add(evt *protocoltypes.GroupMessageEvent) {
+	if len(evt.EditOf) == 0 {
+		return
+	}
+
+	id := string(evt.GetEventContext().GetId())
+	if _, ok := i.ids[id]; ok {
+		return
+	}
+
+	i.ids[id] = struct{}{}
+	i.edits[string(evt.EditOf)] = append(i.edits[string(evt.EditOf)], evt)
+}
+
+// editsOf returns the edits of a message, from the oldest
+func (i *messageEditIndex) editsOf(id []byte) []*protocoltypes.GroupMessageEvent {
+	if i == nil {
+		return nil
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return append([]*protocoltypes.GroupMessageEvent(nil), i.edits[string(id)]...)
+}
+
+// messageMember returns the member who sent a message
+func messageMember(md *MetadataStore, evt *protocoltypes.GroupMessageEvent) (crypto.PubKey, error) {
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(evt.GetHeaders().GetDevicePk())
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return md.GetMemberByDevice(devicePK)
+}
+
+// checkMessageAuthor checks that a message has been sent by the given member
+func checkMessageAuthor(md *MetadataStore, evt *protocoltypes.GroupMessageEvent, member crypto.PubKey) error {
+	author, err := messageMember(md, evt)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("unable to get the author of the message: %w", err))
+	}
+
+	if !author.Equals(member) {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the author of a message can edit it"))
+	}
+
+	return nil
+}
+
+// checkMessageEdit checks that an edit replaces a known message sent by the
+// same member
+func checkMessageEdit(ctx context.Context, gc *GroupContext, edit *protocoltypes.GroupMessageEvent) error {
+	id, err := cid.Cast(edit.EditOf)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	original, err := gc.MessageStore().GetMessageEventByCID(ctx, id)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to open the edited message: %w", err))
+	}
+
+	if len(original.EditOf) > 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an edit can't be edited"))
+	}
+
+	member, err := messageMember(gc.MetadataStore(), original)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("unable to get the author of the message: %w", err))
+	}
+
+	return checkMessageAuthor(gc.MetadataStore(), edit, member)
+}
+
+// applyMessageEdits replaces the content of a message by the latest edit sent
+// by its author. The edits themselves are merged into the message they
+// replace, nil is returned for them.
+func applyMessageEdits(md *MetadataStore, evt *protocoltypes.GroupMessageEvent, edits *messageEditIndex, withHistory bool) *protocoltypes.GroupMessageEvent {
+	if len(evt.EditOf) > 0 {
+		return nil
+	}
+
+	candidates := edits.editsOf(evt.GetEventContext().GetId())
+	if len(candidates) == 0 {
+		return evt
+	}
+
+	member, err := messageMember(md, evt)
+	if err != nil {
+		return evt
+	}
+
+	versions := []*protocoltypes.GroupMessageEvent{}
+	for _, edit := range candidates {
+		if checkMessageAuthor(md, edit, member) == nil {
+			versions = append(versions, edit)
+		}
+	}
+
+	if len(versions) == 0 {
+		return evt
+	}
+
+	edited := &protocoltypes.GroupMessageEvent{
+		EventContext: evt.EventContext,
+		Headers:      evt.Headers,
+		Message:      versions[len(versions)-1].Message,
+		ExpiresAt:    evt.ExpiresAt,
+		Edited:       true,
+	}
+
+	if withHistory {
+		edited.PreviousVersions = append([]*protocoltypes.GroupMessageEvent{evt}, versions[:len(versions)-1]...)
+	}
+
+	return edited
+}
+
+// latestMessageVersion returns the latest version of a message, or of the
+// message replaced by an edit
+func latestMessageVersion(ctx context.Context, gc *GroupContext, evt *protocoltypes.GroupMessageEvent) (*protocoltypes.GroupMessageEvent, error) {
+	edits, err := gc.MessageStore().messageEdits(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(evt.EditOf) > 0 {
+		if err := checkMessageEdit(ctx, gc, evt); err != nil {
+			return nil, err
+		}
+
+		id, err := cid.Cast(evt.EditOf)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if evt, err = gc.MessageStore().GetMessageEventByCID(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	return applyMessageEdits(gc.MetadataStore(), evt, edits, false), nil
+}
@@ -0,0 +1,82 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// resyncAccountLookupTimeout bounds the lookup of the other devices of the
+// account
+const resyncAccountLookupTimeout = 10 * time.Second
+
+// resyncAccount replicates the logs of the account group from each of the
+// other devices of the account. The devices are the ones whose peer is known
+// and the peers advertising the account group stores, only the devices of the
+// account know their topics.
+func (s *service) resyncAccount(ctx context.Context) (*protocoltypes.ServiceResyncAccount_Reply, error) {
+	if s.host == nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("no host available"))
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	candidates := map[peer.ID]peer.AddrInfo{}
+	for _, device := range accountGroup.MetadataStore().ListDevices() {
+		raw, err := device.Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if id, ok := s.odb.GetPeerIDForDevicePK(raw); ok {
+			candidates[id] = peer.AddrInfo{ID: id}
+		}
+	}
+
+	if s.swiper != nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, resyncAccountLookupTimeout)
+		lookupCtx, span := s.tracer.Start(lookupCtx, "DiscoveryLookup", trace.WithAttributes(traceGroupPK(accountGroup.Group().PublicKey)))
+		for _, store := range []iface.Store{accountGroup.MetadataStore(), accountGroup.MessageStore()} {
+			for info := range s.swiper.tinder.FindPeers(lookupCtx, s.odb.groupTopics.storeDiscoveryNamespace(store.Address().String())) {
+				candidates[info.ID] = info
+			}
+		}
+		endSpan(span, nil)
+		cancel()
+	}
+
+	delete(candidates, s.host.ID())
+	if len(candidates) == 0 {
+		return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no other device of the account found"))
+	}
+
+	reply := &protocoltypes.ServiceResyncAccount_Reply{}
+	for _, info := range candidates {
+		imported, err := s.importFromPeer(ctx, accountGroup, info)
+		if err != nil {
+			s.logger.Warn("unable to resync account from peer", logutil.PrivateStringer("peer", info.ID), zap.Error(err))
+			continue
+		}
+
+		reply.ImportedEntries += imported
+		reply.PeerIds = append(reply.PeerIds, info.ID.String())
+	}
+
+	if len(reply.PeerIds) == 0 {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to resync account from any of its %d devices", len(candidates)))
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,111 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/pubsub/pubsubraw"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestServiceResyncAccount(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	msrv := tinder.NewMockDriverServer()
+
+	nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		Logger:          logger.Named("A"),
+	}, nil)
+	defer closeNodeA()
+
+	// a single device can't be resynced
+	_, err := nodeA.Client.ServiceResyncAccount(ctx, &protocoltypes.ServiceResyncAccount_Request{})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrNotFound))
+
+	// link a second device to the account by restoring an export
+	export := &bytes.Buffer{}
+	require.NoError(t, nodeA.Service.(*service).export(ctx, export, exportOptions{}))
+
+	dsB := dsync.MutexWrap(ds.NewMapDatastore())
+	secretStoreB, err := secretstore.NewSecretStore(dsB, nil)
+	require.NoError(t, err)
+
+	ipfsNodeB := ipfsutil.TestingCoreAPIUsingMockNet(ctx, t, &ipfsutil.TestingAPIOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		Datastore:       dsB,
+	})
+
+	odb, err := NewWeshOrbitDB(ctx, ipfsNodeB.API(), &NewOrbitDBOptions{
+		NewOrbitDBOptions: orbitdb.NewOrbitDBOptions{
+			PubSub: pubsubraw.NewPubSub(ipfsNodeB.PubSub(), ipfsNodeB.MockNode().PeerHost.ID(), logger, nil),
+			Logger: logger,
+		},
+		Datastore:   dsB,
+		SecretStore: secretStoreB,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, RestoreAccountExport(ctx, export, ipfsNodeB.API(), odb, logger))
+
+	nodeB, closeNodeB := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet:         mn,
+		DiscoveryServer: msrv,
+		Logger:          logger.Named("B"),
+		SecretStore:     secretStoreB,
+		CoreAPIMock:     ipfsNodeB,
+		OrbitDB:         odb,
+	}, dsB)
+	defer closeNodeB()
+
+	// the settings are changed on the first device once the second one has
+	// been restored, the devices aren't linked yet so it is stale
+	_, err = nodeA.Client.ContactRequestEnable(ctx, &protocoltypes.ContactRequestEnable_Request{})
+	require.NoError(t, err)
+
+	refA, err := nodeA.Client.ContactRequestResetReference(ctx, &protocoltypes.ContactRequestResetReference_Request{})
+	require.NoError(t, err)
+
+	refB, err := nodeB.Client.ContactRequestReference(ctx, &protocoltypes.ContactRequestReference_Request{})
+	require.NoError(t, err)
+	require.False(t, refB.Enabled)
+	require.NotEqual(t, refA.PublicRendezvousSeed, refB.PublicRendezvousSeed)
+
+	require.NoError(t, mn.LinkAll())
+
+	configA, err := nodeA.Client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+
+	reply, err := nodeB.Client.ServiceResyncAccount(ctx, &protocoltypes.ServiceResyncAccount_Request{})
+	require.NoError(t, err)
+	require.Equal(t, []string{configA.PeerId}, reply.PeerIds)
+
+	refB, err = nodeB.Client.ContactRequestReference(ctx, &protocoltypes.ContactRequestReference_Request{})
+	require.NoError(t, err)
+	require.True(t, refB.Enabled)
+	require.Equal(t, refA.PublicRendezvousSeed, refB.PublicRendezvousSeed)
+}
@@ -0,0 +1,158 @@
+package weshnet
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+// runtimeMonitorInterval is the interval at which the number of goroutines is
+// compared to the soft cap
+const runtimeMonitorInterval = time.Second * 5
+
+// inboundPoolName is the name of the inbound worker pool in the runtime stats
+const inboundPoolName = "inbound"
+
+// runtimeStats returns the goroutines of the weshnet worker pools and the
+// messages cached by the opened groups
+func (s *service) runtimeStats() *protocoltypes.ServiceGetRuntimeStats_Reply {
+	inbound := s.odb.inboundPool.stats()
+
+	reply := &protocoltypes.ServiceGetRuntimeStats_Reply{
+		Goroutines:        int64(runtime.NumGoroutine()),
+		WeshnetGoroutines: inbound.Running,
+		WorkerPools: map[string]*protocoltypes.WorkerPoolStats{
+			inboundPoolName: inbound,
+		},
+		MaxGoroutines: int64(s.maxGoroutines),
+		Shedding:      s.shedding.Load(),
+	}
+
+	s.lock.RLock()
+	for _, gc := range s.openedGroups {
+		if gc.messageStore == nil {
+			continue
+		}
+
+		messages, size := gc.messageStore.CacheSize()
+		reply.CachedMessages += messages
+		reply.CacheBytes += size
+	}
+	s.lock.RUnlock()
+
+	return reply
+}
+
+// startRuntimeMonitor periodically checks the number of goroutines against
+// the soft cap
+func (s *service) startRuntimeMonitor() {
+	if s.maxGoroutines <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(runtimeMonitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.checkGoroutinesCap(runtime.NumGoroutine())
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// checkGoroutinesCap sheds the non-critical background work while the number
+// of goroutines is above the soft cap: the received entries are processed by
+// a single worker, which slows down the replication. The whole pool is used
+// again once the number of goroutines is back under the cap.
+func (s *service) checkGoroutinesCap(goroutines int) {
+	if s.maxGoroutines <= 0 {
+		return
+	}
+
+	shed := goroutines > s.maxGoroutines
+	if s.shedding.Swap(shed) == shed {
+		return
+	}
+
+	if shed {
+		s.logger.Warn("goroutines above the soft cap, reducing the replication concurrency",
+			zap.Int("goroutines", goroutines), zap.Int("max", s.maxGoroutines))
+	} else {
+		s.logger.Info("goroutines back under the soft cap, restoring the replication concurrency",
+			zap.Int("goroutines", goroutines), zap.Int("max", s.maxGoroutines))
+	}
+
+	s.updateInboundLimit()
+}
+
+// updateInboundLimit sets the number of workers of the inbound pool from the
+// replication mode and the goroutines soft cap: a single worker processes the
+// received entries while the goroutines are shed or the replication is
+// paused, half of them while it is reduced.
+func (s *service) updateInboundLimit() {
+	pool := s.odb.inboundPool
+	if pool == nil {
+		return
+	}
+
+	limit := pool.size
+	switch protocoltypes.ServiceSetReplicationMode_Mode(s.replicationMode.Load()) {
+	case protocoltypes.ServiceSetReplicationMode_Reduced:
+		limit /= 2
+	case protocoltypes.ServiceSetReplicationMode_Paused:
+		limit = 1
+	}
+
+	if s.shedding.Load() {
+		limit = 1
+	}
+
+	pool.setLimit(limit)
+}
+
+// setReplicationMode applies the replication mode set by the app: the
+// discovery advertises and lookups are throttled by the tinder service, the
+// received entries are processed by fewer workers, see updateInboundLimit,
+// and the connections above the low watermark of the connection manager are
+// trimmed when the replication is paused. The peers are only dialed once
+// found by a lookup so no new connection is made while it is paused.
+func (s *service) setReplicationMode(mode protocoltypes.ServiceSetReplicationMode_Mode) error {
+	var tinderMode tinder.Mode
+	switch mode {
+	case protocoltypes.ServiceSetReplicationMode_Active:
+		tinderMode = tinder.ModeActive
+	case protocoltypes.ServiceSetReplicationMode_Reduced:
+		tinderMode = tinder.ModeReduced
+	case protocoltypes.ServiceSetReplicationMode_Paused:
+		tinderMode = tinder.ModePaused
+	default:
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown replication mode: %d", mode))
+	}
+
+	if s.replicationMode.Swap(int32(mode)) == int32(mode) {
+		return nil
+	}
+
+	if s.swiper != nil {
+		s.swiper.tinder.SetMode(tinderMode)
+	}
+
+	s.updateInboundLimit()
+
+	if mode == protocoltypes.ServiceSetReplicationMode_Paused && s.host != nil {
+		go s.host.ConnManager().TrimOpenConns(s.ctx)
+	}
+
+	return nil
+}
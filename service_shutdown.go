@@ -0,0 +1,231 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+const (
+	shutdownStepStopWrites       = "stop_writes"
+	shutdownStepFlushWrites      = "flush_writes"
+	shutdownStepDeactivateGroups = "deactivate_groups"
+	shutdownStepCloseTransports  = "close_transports"
+	shutdownStepCloseStores      = "close_stores"
+	shutdownStepReleaseDatastore = "release_datastore"
+)
+
+// ShutdownService shuts the service down before the deadline of ctx if it
+// supports it, see service.Shutdown, it is closed otherwise
+func ShutdownService(ctx context.Context, s Service) error {
+	if shutdowner, ok := s.(interface{ Shutdown(context.Context) error }); ok {
+		return shutdowner.Shutdown(ctx)
+	}
+
+	return s.Close()
+}
+
+// Shutdown closes the service in order: the new writes are rejected, the
+// writes in flight are flushed, the groups are deactivated, the transports
+// are closed along with the IPFS node, then the stores are closed and the
+// datastore is released, it is rekeyed if requested by ServiceRekeyStorage.
+// If ctx is done before the end of the shutdown an ErrServiceShutdownTimeout
+// error is returned right away, the remaining steps go on in the background
+// without waiting for the writes in flight. Only the first call shuts the
+// service down, the next ones return its result.
+func (s *service) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+
+	return s.shutdownErr
+}
+
+func (s *service) shutdown(ctx context.Context) error {
+	s.shutdownStep(shutdownStepStopWrites)
+	s.odb.writes.close()
+
+	done := make(chan error, 1)
+	go func() { done <- s.shutdownSteps(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// the steps blocked on the service context are released
+	s.ctxCancel()
+
+	go func() {
+		if err := <-done; err != nil {
+			s.logger.Warn("service shut down after the deadline", zap.Error(err))
+		}
+	}()
+
+	return errcode.ErrCode_ErrServiceShutdownTimeout.Wrap(fmt.Errorf("shutdown not done before the deadline: %w", ctx.Err()))
+}
+
+// shutdownSteps runs the steps of the shutdown following the rejection of
+// the new writes
+func (s *service) shutdownSteps(ctx context.Context) error {
+	endSection := tyber.SimpleSection(tyber.ContextWithoutTraceID(s.ctx), s.logger, "Closing ProtocolService")
+
+	var err, flushErr error
+
+	s.shutdownStep(shutdownStepFlushWrites)
+	if flushErr = s.odb.writes.flush(ctx); flushErr != nil {
+		s.logger.Warn("closing the stores with writes in flight", zap.Error(flushErr))
+	}
+
+	s.shutdownStep(shutdownStepDeactivateGroups)
+	if s.host != nil {
+		s.host.RemoveStreamHandler(importFromPeerProtocol)
+	}
+	err = multierr.Append(err, s.deactivateAllGroups())
+
+	if s.capabilities != nil {
+		err = multierr.Append(err, s.capabilities.Close())
+	}
+
+	if s.contactGater != nil {
+		err = multierr.Append(err, s.contactGater.Close())
+	}
+
+	s.shutdownStep(shutdownStepCloseTransports)
+	if s.closeNetwork != nil {
+		err = multierr.Append(err, s.closeNetwork())
+	}
+
+	s.shutdownStep(shutdownStepCloseStores)
+	err = multierr.Append(err, s.odb.Close())
+
+	s.shutdownStep(shutdownStepReleaseDatastore)
+	err = multierr.Append(err, s.closeGroupStoreDatastores())
+	if s.close != nil {
+		err = multierr.Append(err, s.close())
+	}
+	err = multierr.Append(err, s.rekeyReleasedDatastore(ctx))
+
+	// the timeout is reported first, the other errors are kept along
+	if flushErr != nil {
+		err = errcode.ErrCode_ErrServiceShutdownTimeout.Wrap(multierr.Append(flushErr, err))
+	}
+
+	endSection(err)
+
+	s.ctxCancel()
+
+	return err
+}
+
+// deactivateAllGroups stops the contact requests manager and deactivates
+// the opened groups
+func (s *service) deactivateAllGroups() error {
+	var err error
+	pks := []crypto.PubKey{}
+
+	// gather public keys
+	s.lock.Lock()
+
+	if s.contactRequestsManager != nil {
+		s.contactRequestsManager.close()
+		s.contactRequestsManager = nil
+	}
+
+	for _, gc := range s.openedGroups {
+		pk, subErr := gc.group.GetPubKey()
+		if subErr != nil {
+			err = multierr.Append(err, subErr)
+			continue
+		}
+
+		pks = append(pks, pk)
+	}
+	s.lock.Unlock()
+
+	for _, pk := range pks {
+		if derr := s.deactivateGroup(pk); derr != nil {
+			err = multierr.Append(err, derr)
+		}
+	}
+
+	return err
+}
+
+// beginWrite registers a write in flight spanning several store writes, see
+// writeGuard.begin
+func (s *service) beginWrite(ctx context.Context) (_ context.Context, done func(), err error) {
+	return s.odb.writes.begin(ctx)
+}
+
+// writeInFlightKey marks the context of a registered write, the writes made
+// with it are part of the write in flight
+type writeInFlightKey struct{}
+
+// writeGuard tracks the writes in flight, the shutdown waits for them to be
+// done before closing the stores
+type writeGuard struct {
+	// mu guards closed and the registration of the writes
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// begin registers a write in flight, done must be called once it is over.
+// The writes made with the returned context are part of it, so they are not
+// rejected once the writes have been closed, the other writes fail.
+func (w *writeGuard) begin(ctx context.Context) (_ context.Context, done func(), err error) {
+	if ctx.Value(writeInFlightKey{}) == w {
+		return ctx, func() {}, nil
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ctx, nil, errcode.ErrCode_ErrServiceClosed.Wrap(fmt.Errorf("the service is shutting down"))
+	}
+
+	w.wg.Add(1)
+	return context.WithValue(ctx, writeInFlightKey{}, w), w.wg.Done, nil
+}
+
+// close rejects the new writes
+func (w *writeGuard) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+}
+
+// flush waits for the writes in flight to be done, the new writes must have
+// been rejected beforehand
+func (w *writeGuard) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("writes in flight not flushed before the deadline: %w", ctx.Err())
+	}
+}
+
+func (s *service) shutdownStep(step string) {
+	s.logger.Debug("service shutdown", zap.String("step", step))
+
+	if s.shutdownStepHook != nil {
+		s.shutdownStepHook(step)
+	}
+}
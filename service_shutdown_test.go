@@ -0,0 +1,262 @@
+package weshnet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// newBlockedWriteService returns a service with an opened group, the
+// messages sent on it are blocked until release is closed
+func newBlockedWriteService(ctx context.Context, t *testing.T) (s *service, groupPK []byte, intercepted <-chan struct{}, release chan struct{}) {
+	t.Helper()
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Mocknet: mn}, nil)
+	t.Cleanup(cleanup)
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	createRep, err := s.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	interceptedCh := make(chan struct{}, 1)
+	release = make(chan struct{})
+	s.outgoingInterceptor = func(_ context.Context, _ []byte, payload []byte) ([]byte, error) {
+		interceptedCh <- struct{}{}
+		<-release
+		return payload, nil
+	}
+
+	return s, createRep.GroupPk, interceptedCh, release
+}
+
+func TestServiceShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, groupPK, intercepted, release := newBlockedWriteService(ctx, t)
+
+	gc, err := s.GetContextGroupForID(groupPK)
+	require.NoError(t, err)
+	require.Equal(t, 0, gc.MessageStore().OpLog().Len())
+
+	var (
+		mu                  sync.Mutex
+		steps               []string
+		flushedBeforeStores bool
+	)
+
+	s.shutdownStepHook = func(step string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		steps = append(steps, step)
+		if step == shutdownStepCloseStores {
+			// the message in flight has been added to the log
+			flushedBeforeStores = gc.MessageStore().OpLog().Len() == 1
+		}
+	}
+
+	// a write is in flight when the shutdown starts
+	type sendResult struct {
+		reply *protocoltypes.AppMessageSend_Reply
+		err   error
+	}
+	sent := make(chan sendResult, 1)
+	go func() {
+		reply, err := s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: groupPK,
+			Payload: []byte("in flight"),
+		})
+		sent <- sendResult{reply: reply, err: err}
+	}()
+
+	select {
+	case <-intercepted:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the message should have been intercepted")
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(ctx) }()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(steps) == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	// the new writes are rejected, including the ones of the stores
+	_, err = s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: groupPK,
+		Payload: []byte("rejected"),
+	})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = s.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{
+		GroupPk: groupPK,
+		Payload: []byte("rejected"),
+	})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: groupPK})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	// the batch and the reactivations of the groups are rejected as a whole
+	_, err = s.ActivateGroups(ctx, &protocoltypes.ActivateGroups_Request{GroupPks: [][]byte{groupPK}})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = s.ServiceSetGroupTopic(ctx, &protocoltypes.ServiceSetGroupTopic_Request{GroupPk: groupPK, Topic: "rejected"})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = s.ServiceSetReplicationAllowlist(ctx, &protocoltypes.ServiceSetReplicationAllowlist_Request{GroupPks: [][]byte{groupPK}})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = s.ServiceLeaveGroup(ctx, &protocoltypes.ServiceLeaveGroup_Request{GroupPk: groupPK, NotifyMembers: true})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = gc.MessageStore().AddMessage(ctx, []byte("rejected"))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	_, err = gc.MetadataStore().SendAppMetadata(ctx, []byte("rejected"))
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceClosed))
+
+	// the shutdown waits for the write in flight
+	select {
+	case err := <-shutdownErr:
+		require.FailNow(t, "the shutdown should wait for the write in flight", err)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	close(release)
+
+	res := <-sent
+	require.NoError(t, res.err)
+	require.NotEmpty(t, res.reply.Cid)
+
+	// the write has been flushed in time
+	require.False(t, errcode.Is(<-shutdownErr, errcode.ErrCode_ErrServiceShutdownTimeout))
+
+	mu.Lock()
+	require.Equal(t, []string{
+		shutdownStepStopWrites,
+		shutdownStepFlushWrites,
+		shutdownStepDeactivateGroups,
+		shutdownStepCloseTransports,
+		shutdownStepCloseStores,
+		shutdownStepReleaseDatastore,
+	}, steps)
+	require.True(t, flushedBeforeStores)
+	mu.Unlock()
+
+	// the service is only shut down once
+	require.False(t, errcode.Is(s.Close(), errcode.ErrCode_ErrServiceShutdownTimeout))
+
+	mu.Lock()
+	require.Len(t, steps, 6)
+	mu.Unlock()
+}
+
+func TestServiceShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, groupPK, intercepted, release := newBlockedWriteService(ctx, t)
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: groupPK,
+			Payload: []byte("in flight"),
+		})
+		sent <- err
+	}()
+
+	select {
+	case <-intercepted:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the message should have been intercepted")
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer shutdownCancel()
+
+	// the shutdown goes on once the deadline is exceeded
+	err := s.Shutdown(shutdownCtx)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceShutdownTimeout))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the write in flight is released once the stores have been closed
+	close(release)
+	select {
+	case <-sent:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the write in flight should have returned")
+	}
+}
+
+func TestServiceShutdownStepTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Mocknet: mn}, nil)
+	defer cleanup()
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	// a step after the flush of the writes blocks
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	s.shutdownStepHook = func(step string) {
+		if step == shutdownStepCloseTransports {
+			close(blocked)
+			<-release
+		}
+	}
+	defer close(release)
+
+	shutdownCtx, shutdownCancel := context.WithCancel(ctx)
+	defer shutdownCancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- ShutdownService(shutdownCtx, s) }()
+
+	select {
+	case <-blocked:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the shutdown should have reached the blocked step")
+	}
+
+	// the whole shutdown is bounded by the context
+	shutdownCancel()
+
+	select {
+	case err := <-shutdownErr:
+		require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceShutdownTimeout))
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the shutdown should have returned once the context is done")
+	}
+
+	// the next calls return the result of the first one
+	require.True(t, errcode.Is(s.Close(), errcode.ErrCode_ErrServiceShutdownTimeout))
+}
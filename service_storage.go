@@ -0,0 +1,278 @@
+package weshnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/ipfs/boxo/path"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	badger "github.com/ipfs/go-ds-badger2"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// compactStorage reclaims the disk space used by deleted or overwritten
+// entries of the root datastore.
+//
+// It is safe to run while the service is live: badger compacts its tables and
+// rewrites its value log files concurrently with reads and writes, writes only
+// slow down the compaction as new tables keep being created. Entries
+// which are still in memory (ie. recently written or deleted) are only
+// reclaimed by a later compaction, once they have been flushed to disk.
+//
+// In-memory datastores and datastores which don't support garbage collection
+// are left untouched and reported as unsupported.
+func (s *service) compactStorage(ctx context.Context) (*protocoltypes.ServiceCompactStorage_Reply, error) {
+	if s.datastoreDir == "" || s.datastoreDir == InMemoryDirectory {
+		return &protocoltypes.ServiceCompactStorage_Reply{}, nil
+	}
+
+	gcds, ok := s.rootDatastore.(ds.GCDatastore)
+	if !ok {
+		return &protocoltypes.ServiceCompactStorage_Reply{}, nil
+	}
+
+	before, err := dirSize(s.datastoreDir)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to get storage size: %w", err))
+	}
+
+	// compact all the levels first so the value log gc knows which entries
+	// have been discarded
+	if bds, ok := s.rootDatastore.(*badger.Datastore); ok {
+		if err := bds.DB.Flatten(runtime.NumCPU()); err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to compact datastore: %w", err))
+		}
+	}
+
+	if err := gcds.CollectGarbage(ctx); err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to collect datastore garbage: %w", err))
+	}
+
+	after, err := dirSize(s.datastoreDir)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to get storage size: %w", err))
+	}
+
+	reply := &protocoltypes.ServiceCompactStorage_Reply{
+		Supported:   true,
+		StorageSize: after,
+	}
+
+	// the datastore can still be written to during the compaction
+	if before > after {
+		reply.ReclaimedBytes = before - after
+	}
+
+	s.logger.Info("storage compacted",
+		zap.Int64("reclaimed", reply.ReclaimedBytes),
+		zap.Int64("size", reply.StorageSize))
+
+	return reply, nil
+}
+
+// dirSize returns the total size of the regular files in dir
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+// groupStorageUsage estimates the disk space used by each group listed by
+// listAllGroups: the blocks of its log entries and its data kept in the
+// datastore, i.e. the caches of its stores, its pinned messages and its read
+// marker. The logs of the groups which aren't activated are read from the
+// local data without opening their stores.
+func (s *service) groupStorageUsage(ctx context.Context) (*protocoltypes.ServiceGetGroupStorageUsage_Reply, error) {
+	entries, err := s.listAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &protocoltypes.ServiceGetGroupStorageUsage_Reply{}
+	for _, entry := range entries {
+		usage, err := s.groupUsage(ctx, entry.GroupPk)
+		if err != nil {
+			s.logger.Warn("unable to get group storage usage", logutil.PrivateBinary("group", entry.GroupPk), zap.Error(err))
+			continue
+		}
+
+		usage.GroupType = entry.GroupType
+		reply.Groups = append(reply.Groups, usage)
+		reply.TotalBytes += usage.TotalBytes
+	}
+
+	sort.SliceStable(reply.Groups, func(i, j int) bool {
+		return reply.Groups[i].TotalBytes > reply.Groups[j].TotalBytes
+	})
+
+	return reply, nil
+}
+
+// groupLogs returns the logs of the metadata and the message stores of a
+// group, they are read from the local data without opening the stores if the
+// group isn't activated
+func (s *service) groupLogs(ctx context.Context, groupPK []byte) ([]groupLog, error) {
+	if gc, err := s.GetContextGroupForID(groupPK); err == nil {
+		return []groupLog{
+			&openedGroupLog{kind: storeKindMetadata, store: gc.MetadataStore()},
+			&openedGroupLog{kind: storeKindMessage, store: gc.MessageStore()},
+		}, nil
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(groupPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stores of a migrated group are kept in its own datastore
+	if err := s.restoreGroupStore(ctx, g); err != nil {
+		return nil, err
+	}
+
+	return s.odb.closedGroupLogs(ctx, s.ipfsCoreAPI, g)
+}
+
+// groupUsage estimates the disk space used by a group, see groupStorageUsage
+func (s *service) groupUsage(ctx context.Context, groupPK []byte) (*protocoltypes.ServiceGetGroupStorageUsage_GroupUsage, error) {
+	logs, err := s.groupLogs(ctx, groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &protocoltypes.ServiceGetGroupStorageUsage_GroupUsage{GroupPk: groupPK}
+	for _, log := range logs {
+		err := log.Walk(ctx, func(e ipfslog.Entry) error {
+			stat, err := s.ipfsCoreAPI.Block().Stat(ctx, path.FromCid(e.GetHash()))
+			if err != nil {
+				return errcode.ErrCode_ErrDBRead.Wrap(err)
+			}
+
+			usage.LogEntries++
+			usage.LogBytes += int64(stat.Size())
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		cacheBytes, err := datastoreSize(ctx, log.Cache(), "/")
+		if err != nil {
+			return nil, err
+		}
+
+		usage.DatastoreBytes += cacheBytes
+	}
+
+	pinsBytes, err := datastoreSize(ctx, s.odb.messagePins.ds, messagePinsGroupKey(groupPK).String())
+	if err != nil {
+		return nil, err
+	}
+	usage.DatastoreBytes += pinsBytes
+
+	markerBytes, err := s.odb.readMarkers.ds.GetSize(ctx, readMarkerKey(groupPK))
+	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	} else if err == nil {
+		usage.DatastoreBytes += int64(markerBytes)
+	}
+
+	usage.TotalBytes = usage.LogBytes + usage.DatastoreBytes
+
+	return usage, nil
+}
+
+// groupBlockCIDsBatchSize is the number of CIDs sent in each reply of
+// ServiceGetGroupBlockCIDs
+const groupBlockCIDsBatchSize = 256
+
+// groupBlockCIDs sends the CIDs of the blocks holding the log entries of the
+// stores of a group, in batches of groupBlockCIDsBatchSize CIDs. The logs of
+// a group which isn't activated are read one entry at a time as the batches
+// are sent.
+func (s *service) groupBlockCIDs(ctx context.Context, groupPK []byte, send func(*protocoltypes.ServiceGetGroupBlockCIDs_Reply) error) error {
+	logs, err := s.groupLogs(ctx, groupPK)
+	if err != nil {
+		return err
+	}
+
+	for _, log := range logs {
+		batch := &protocoltypes.ServiceGetGroupBlockCIDs_Reply{Store: log.Kind()}
+		err := log.Walk(ctx, func(e ipfslog.Entry) error {
+			batch.Cids = append(batch.Cids, e.GetHash().Bytes())
+			if len(batch.Cids) < groupBlockCIDsBatchSize {
+				return nil
+			}
+
+			if err := send(batch); err != nil {
+				return err
+			}
+			batch = &protocoltypes.ServiceGetGroupBlockCIDs_Reply{Store: log.Kind()}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(batch.Cids) > 0 {
+			if err := send(batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// datastoreSize returns the size of the keys and the values stored under
+// prefix
+func datastoreSize(ctx context.Context, d ds.Datastore, prefix string) (int64, error) {
+	results, err := d.Query(ctx, query.Query{Prefix: prefix})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	size := int64(0)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		size += int64(len(result.Key) + len(result.Value))
+	}
+
+	return size, nil
+}
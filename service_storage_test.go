@@ -0,0 +1,291 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ipfs/boxo/path"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
+	badger "github.com/ipfs/go-ds-badger2"
+	"github.com/ipfs/kubo/core/coreiface/options"
+	"github.com/ipfs/kubo/core/corerepo"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestCompactStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+
+	// use small value log files so the deleted values can be reclaimed
+	bopts := badger.DefaultOptions
+	bopts.ValueLogFileSize = 1 << 20
+	bopts.ValueLogMaxEntries = 100
+
+	rootDS, err := badger.NewDatastore(dir, &bopts)
+	require.NoError(t, err)
+
+	value := make([]byte, 32*1024)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, rootDS.Put(ctx, ds.NewKey(fmt.Sprintf("/prunable/%d", i)), value))
+	}
+
+	for i := 0; i < 200; i++ {
+		require.NoError(t, rootDS.Delete(ctx, ds.NewKey(fmt.Sprintf("/prunable/%d", i))))
+	}
+
+	// reopen the datastore to flush the deletions to disk
+	require.NoError(t, rootDS.Close())
+	rootDS, err = badger.NewDatastore(dir, &bopts)
+	require.NoError(t, err)
+	defer rootDS.Close()
+
+	before, err := dirSize(dir)
+	require.NoError(t, err)
+
+	s := &service{logger: zap.NewNop(), rootDatastore: rootDS, datastoreDir: dir}
+	reply, err := s.compactStorage(ctx)
+	require.NoError(t, err)
+	require.True(t, reply.Supported)
+	require.Greater(t, reply.ReclaimedBytes, int64(0))
+	require.Less(t, reply.StorageSize, before)
+	require.Equal(t, before-reply.StorageSize, reply.ReclaimedBytes)
+}
+
+func TestCompactStorageUnsupported(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &service{
+		logger:        zap.NewNop(),
+		rootDatastore: dsync.MutexWrap(ds.NewMapDatastore()),
+		datastoreDir:  InMemoryDirectory,
+	}
+
+	reply, err := s.compactStorage(ctx)
+	require.NoError(t, err)
+	require.False(t, reply.Supported)
+	require.Zero(t, reply.ReclaimedBytes)
+	require.Zero(t, reply.StorageSize)
+}
+
+func TestGroupStorageUsage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	svc, cleanup := TestingService(ctx, t, Opts{Logger: logger})
+	defer cleanup()
+
+	small, err := svc.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	large, err := svc.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	send := func(groupPK []byte, count int, size int) {
+		for i := 0; i < count; i++ {
+			_, err := svc.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+				GroupPk: groupPK,
+				Payload: make([]byte, size),
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	send(small.GroupPk, 2, 16)
+	send(large.GroupPk, 20, 4*1024)
+
+	// the logs of the groups which aren't activated are read without opening
+	// their stores
+	_, err = svc.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPk: large.GroupPk})
+	require.NoError(t, err)
+
+	reply, err := svc.ServiceGetGroupStorageUsage(ctx, &protocoltypes.ServiceGetGroupStorageUsage_Request{})
+	require.NoError(t, err)
+
+	usages := map[string]*protocoltypes.ServiceGetGroupStorageUsage_GroupUsage{}
+	total := int64(0)
+	for _, usage := range reply.Groups {
+		usages[string(usage.GroupPk)] = usage
+		total += usage.TotalBytes
+	}
+	require.Equal(t, total, reply.TotalBytes)
+
+	// the group hasn't been opened to read its logs
+	_, err = svc.(*service).GetContextGroupForID(large.GroupPk)
+	require.Error(t, err)
+
+	smallUsage, largeUsage := usages[string(small.GroupPk)], usages[string(large.GroupPk)]
+	require.NotNil(t, smallUsage)
+	require.NotNil(t, largeUsage)
+
+	require.Greater(t, largeUsage.LogEntries, smallUsage.LogEntries)
+	require.Greater(t, largeUsage.LogBytes, int64(20*4*1024))
+	require.Greater(t, largeUsage.TotalBytes, smallUsage.TotalBytes)
+	require.Equal(t, largeUsage.LogBytes+largeUsage.DatastoreBytes, largeUsage.TotalBytes)
+
+	// the groups are sorted from the largest
+	require.Equal(t, large.GroupPk, reply.Groups[0].GroupPk)
+	for i := 1; i < len(reply.Groups); i++ {
+		require.GreaterOrEqual(t, reply.Groups[i-1].TotalBytes, reply.Groups[i].TotalBytes)
+	}
+}
+
+func TestGroupBlockCIDs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	node := ipfsutil.TestingCoreAPI(ctx, t)
+
+	svc, cleanup := TestingService(ctx, t, Opts{Logger: logger, IpfsCoreAPI: node.API()})
+	defer cleanup()
+
+	client, cleanup := TestingClient(ctx, t, svc, nil, nil)
+	defer cleanup()
+
+	created, err := svc.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	sent := []cid.Cid{}
+	for i := 0; i < 5; i++ {
+		reply, err := svc.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+			GroupPk: created.GroupPk,
+			Payload: []byte(fmt.Sprintf("message %d", i)),
+		})
+		require.NoError(t, err)
+
+		c, err := cid.Cast(reply.Cid)
+		require.NoError(t, err)
+		sent = append(sent, c)
+	}
+
+	// the logs of the groups which aren't activated are read without opening
+	// their stores
+	_, err = svc.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+
+	sub, err := client.ServiceGetGroupBlockCIDs(ctx, &protocoltypes.ServiceGetGroupBlockCIDs_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+
+	listed := map[string][]cid.Cid{}
+	for {
+		reply, err := sub.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+
+		for _, b := range reply.Cids {
+			c, err := cid.Cast(b)
+			require.NoError(t, err)
+			listed[reply.Store] = append(listed[reply.Store], c)
+		}
+	}
+
+	// the group hasn't been opened to read its logs
+	_, err = svc.(*service).GetContextGroupForID(created.GroupPk)
+	require.Error(t, err)
+
+	require.NotEmpty(t, listed[storeKindMetadata])
+	require.ElementsMatch(t, sent, listed[storeKindMessage])
+
+	// the listed blocks survive the garbage collection once pinned, unlike
+	// the other blocks
+	unpinned, err := node.API().Block().Put(ctx, bytes.NewReader([]byte("unpinned")))
+	require.NoError(t, err)
+
+	for _, ids := range listed {
+		for _, c := range ids {
+			require.NoError(t, node.API().Pin().Add(ctx, path.FromCid(c), options.Pin.Recursive(false)))
+		}
+	}
+
+	require.NoError(t, corerepo.GarbageCollect(node.MockNode(), ctx))
+
+	has, err := node.MockNode().Blockstore.Has(ctx, unpinned.Path().RootCid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	for _, ids := range listed {
+		for _, c := range ids {
+			has, err := node.MockNode().Blockstore.Has(ctx, c)
+			require.NoError(t, err)
+			require.True(t, has, "block %s should have been kept", c.String())
+		}
+	}
+}
+
+func TestOrbitDBCacheDatastore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	countKeys := func(d ds.Datastore, prefix string) int {
+		results, err := d.Query(ctx, query.Query{Prefix: prefix, KeysOnly: true})
+		require.NoError(t, err)
+
+		entries, err := results.Rest()
+		require.NoError(t, err)
+
+		return len(entries)
+	}
+
+	rootDS := dsync.MutexWrap(ds.NewMapDatastore())
+	cacheDS := dsync.MutexWrap(ds.NewMapDatastore())
+
+	svc, cleanup := TestingService(ctx, t, Opts{
+		Logger:                logger,
+		RootDatastore:         rootDS,
+		OrbitDBCacheDatastore: cacheDS,
+	})
+	defer cleanup()
+
+	created, err := svc.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = svc.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: created.GroupPk,
+		Payload: []byte("test"),
+	})
+	require.NoError(t, err)
+
+	// the heads of the stores are only written to the cache datastore
+	require.NotZero(t, countKeys(cacheDS, "/"+NamespaceOrbitDBDatastore))
+	require.Zero(t, countKeys(rootDS, "/"+NamespaceOrbitDBDatastore+"/"+NamespaceOrbitDBDatastore))
+	require.NotZero(t, countKeys(rootDS, "/"))
+
+	// the cache datastore is opened in the given directory
+	dir := t.TempDir()
+	svc, cleanup = TestingService(ctx, t, Opts{
+		Logger:          logger,
+		OrbitDBCacheDir: dir,
+	})
+	defer cleanup()
+
+	_, err = svc.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	size, err := dirSize(dir)
+	require.NoError(t, err)
+	require.NotZero(t, size)
+}
@@ -0,0 +1,117 @@
+package weshnet
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// storeKindMetadata and storeKindMessage label the entries in the signature
+// metrics
+const (
+	storeKindMetadata = "metadata"
+	storeKindMessage  = "message"
+)
+
+const signatureMetricNamespace = "bty_store"
+
+var (
+	collectorSignatureRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: signatureMetricNamespace,
+			Name:      "signature_rejected_total",
+			Help:      "entries rejected because of an invalid signature",
+		}, []string{"store"},
+	)
+	collectorSignatureIgnored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: signatureMetricNamespace,
+			Name:      "signature_ignored_total",
+			Help:      "entries with an invalid signature accepted while the strict verification is disabled",
+		}, []string{"store"},
+	)
+	collectorsSignature = []prometheus.Collector{
+		collectorSignatureRejected,
+		collectorSignatureIgnored,
+	}
+)
+
+// signatureVerifier applies the signature verification policy to the
+// entries received by the stores: by default the entries failing the
+// verification are rejected, in lenient mode they are kept and a warning is
+// logged. A nil verifier is strict.
+type signatureVerifier struct {
+	lenient bool
+	quiet   bool
+	logger  *zap.Logger
+}
+
+func newSignatureVerifier(reg prometheus.Registerer, logger *zap.Logger, lenient bool) *signatureVerifier {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	if reg != nil {
+		for _, collector := range collectorsSignature {
+			if err := reg.Register(collector); err != nil {
+				if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+					panic(fmt.Errorf("signature metrics errors: %w", err))
+				}
+			}
+		}
+	}
+
+	return &signatureVerifier{
+		lenient: lenient,
+		logger:  logger,
+	}
+}
+
+// withoutReport returns a verifier applying the same policy without logging
+// nor counting the failures, it is used when the entries already checked on
+// reception are opened again, e.g. while rebuilding an index
+func (v *signatureVerifier) withoutReport() *signatureVerifier {
+	if v == nil {
+		return &signatureVerifier{quiet: true}
+	}
+
+	return &signatureVerifier{
+		lenient: v.lenient,
+		quiet:   true,
+		logger:  v.logger,
+	}
+}
+
+// check returns the error of a failed signature verification if the entry
+// must be rejected, nil if it is accepted anyway
+func (v *signatureVerifier) check(store string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if v == nil || !v.lenient {
+		v.rejected(store)
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	if v.quiet {
+		return nil
+	}
+
+	collectorSignatureIgnored.WithLabelValues(store).Inc()
+	v.logger.Warn("accepting an entry with an invalid signature, strict verification is disabled", zap.String("store", store), zap.Error(err))
+
+	return nil
+}
+
+// rejected records an entry rejected because of its signature
+func (v *signatureVerifier) rejected(store string) {
+	if v != nil && v.quiet {
+		return
+	}
+
+	collectorSignatureRejected.WithLabelValues(store).Inc()
+}
@@ -0,0 +1,76 @@
+package weshnet
+
+import (
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, devicePK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	devicePKBytes, err := devicePK.Raw()
+	require.NoError(t, err)
+
+	payload := &protocoltypes.AccountGroupJoined{
+		Group:    g,
+		DevicePk: devicePKBytes,
+	}
+
+	payloadBytes, err := proto.Marshal(payload)
+	require.NoError(t, err)
+
+	// the payload is signed by another device
+	otherDeviceSK, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	sig, err := otherDeviceSK.Sign(payloadBytes)
+	require.NoError(t, err)
+
+	env, err := sealGroupEnvelope(g, secretstore.DefaultCipherSuite(), secretstore.EncryptionVersionCurrent, protocoltypes.EventType_EventTypeAccountGroupJoined, payload, sig)
+	require.NoError(t, err)
+
+	rejected := func() float64 {
+		return testutil.ToFloat64(collectorSignatureRejected.WithLabelValues(storeKindMetadata))
+	}
+	ignored := func() float64 {
+		return testutil.ToFloat64(collectorSignatureIgnored.WithLabelValues(storeKindMetadata))
+	}
+
+	// strict by default
+	rejectedBefore := rejected()
+	_, _, err = openGroupEnvelope(g, env, nil, newSignatureVerifier(prometheus.NewRegistry(), nil, false))
+	require.Error(t, err)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrCryptoSignatureVerification))
+	require.Equal(t, rejectedBefore+1, rejected())
+
+	_, _, err = openGroupEnvelope(g, env, nil, nil)
+	require.Error(t, err)
+
+	// the entries opened again are not counted twice
+	rejectedBefore = rejected()
+	_, _, err = openGroupEnvelope(g, env, nil, newSignatureVerifier(nil, nil, false).withoutReport())
+	require.Error(t, err)
+	require.Equal(t, rejectedBefore, rejected())
+
+	// lenient mode
+	ignoredBefore := ignored()
+	meta, event, err := openGroupEnvelope(g, env, nil, newSignatureVerifier(nil, nil, true))
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.EventType_EventTypeAccountGroupJoined, meta.EventType)
+	require.Equal(t, devicePKBytes, event.(*protocoltypes.AccountGroupJoined).DevicePk)
+	require.Equal(t, ignoredBefore+1, ignored())
+}
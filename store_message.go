@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	coreiface "github.com/ipfs/kubo/core/coreiface"
@@ -40,6 +42,17 @@ type MessageStore struct {
 	}
 
 	secretStore               secretstore.SecretStore
+	lastSeen                  *lastSeenTracker
+	inboundPool               *inboundWorkerPool
+	sigVerifier               *signatureVerifier
+	writes                    *writeGuard
+	encryption                *groupEncryption
+	pins                      *messagePins
+	edits                     *messageEditIndex
+	streams                   *messageStreamIndex
+	replicationLag            *replicationLagTracker
+	groupErrors               *groupErrorTracker
+	unknownMemberPolicy       UnknownMemberPolicy
 	currentDevicePublicKey    crypto.PubKey
 	currentDevicePublicKeyRaw []byte
 	group                     *protocoltypes.Group
@@ -50,6 +63,11 @@ type MessageStore struct {
 	muDeviceCaches sync.RWMutex
 
 	messagesQueue *simpleMessageQueue
+	cacheTracer   *messageCacheTracer
+
+	// metadataStore is the metadata store of the group, it lists the members
+	// checked by the unknown member policy, see checkMembership
+	metadataStore atomic.Pointer[MetadataStore]
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -84,14 +102,26 @@ func (m *MessageStore) openMessage(ctx context.Context, e ipfslog.Entry) (*proto
 		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
-	if !m.secretStore.IsChainKeyKnownForDevice(ctx, m.groupPublicKey, devicePublicKey) {
-		if err := m.addToMessageQueue(ctx, e); err != nil {
+	// the key of the message is known if it has been imported from a group
+	// bundle, the chain key of its device is then not needed
+	if !m.secretStore.IsChainKeyKnownForDevice(ctx, m.groupPublicKey, devicePublicKey) && !m.secretStore.IsMessageKeyKnown(ctx, e.GetHash()) {
+		if err := m.addToMessageQueue(ctx, e, time.Time{}); err != nil {
 			m.logger.Error("unable to add message to cache", zap.Error(err))
 		}
 
 		return nil, fmt.Errorf("no secret for device")
 	}
 
+	if held, err := m.checkMembership(headers.DevicePk); err != nil {
+		return nil, err
+	} else if held {
+		if err := m.addToMessageQueue(ctx, e, time.Time{}); err != nil {
+			m.logger.Error("unable to add message to cache", zap.Error(err))
+		}
+
+		return nil, errcode.ErrCode_ErrGroupMemberUnknown.Wrap(fmt.Errorf("the message is held until its device is added to the group"))
+	}
+
 	return m.processMessage(ctx, &messageItem{
 		op:      op,
 		env:     env,
@@ -116,6 +146,17 @@ func (m *MessageStore) CacheSizeForDevicePK(devicePK []byte) (size int, ok bool)
 	return
 }
 
+// CacheSize returns the number of received messages waiting to be processed,
+// including the ones waiting for the key of their device, and their size in
+// bytes
+func (m *MessageStore) CacheSize() (messages int64, size int64) {
+	if m.cacheTracer == nil {
+		return 0, 0
+	}
+
+	return m.cacheTracer.messages.Load(), m.cacheTracer.bytes.Load()
+}
+
 func (m *MessageStore) ProcessMessageQueueForDevicePK(ctx context.Context, devicePK []byte) {
 	m.muDeviceCaches.Lock()
 	if device, ok := m.deviceCaches[string(devicePK)]; ok {
@@ -152,10 +193,87 @@ func (m *MessageStore) processMessage(ctx context.Context, message *messageItem)
 		EventContext: eventContext,
 		Headers:      message.headers,
 		Message:      msg.GetPlaintext(),
+		ExpiresAt:    msg.GetProtocolMetadata().GetExpiresAt(),
+		EditOf:       msg.GetProtocolMetadata().GetEditOf(),
+		StreamChunk:  msg.GetProtocolMetadata().GetStreamChunk(),
+		StreamChunks: msg.GetProtocolMetadata().GetStreamChunks(),
+		StreamSize:   msg.GetProtocolMetadata().GetStreamSize(),
 	}, nil
 }
 
-func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMetricsTracer) {
+// isMessageExpired checks whether the disappearing messages timer of a
+// message has elapsed
+func isMessageExpired(evt *protocoltypes.GroupMessageEvent, now time.Time) bool {
+	return evt.ExpiresAt != 0 && now.UnixMilli() >= evt.ExpiresAt
+}
+
+// isExpired checks whether a message of the store has expired, the messages
+// pinned on the device never expire
+func (m *MessageStore) isExpired(ctx context.Context, evt *protocoltypes.GroupMessageEvent, now time.Time) bool {
+	if !isMessageExpired(evt, now) {
+		return false
+	}
+
+	id, err := cid.Cast(evt.GetEventContext().GetId())
+	if err != nil {
+		return true
+	}
+
+	return !m.pins.IsPinned(ctx, m.group.PublicKey, id)
+}
+
+// expireMessage deletes the key of an expired message, the payload of the
+// message can't be opened locally anymore while the entry stays in the log
+func (m *MessageStore) expireMessage(ctx context.Context, evt *protocoltypes.GroupMessageEvent) {
+	if !m.isExpired(ctx, evt, time.Now()) {
+		return
+	}
+
+	id, err := cid.Cast(evt.GetEventContext().GetId())
+	if err != nil {
+		m.logger.Error("unable to parse the id of an expired message", zap.Error(err))
+		return
+	}
+
+	if err := m.secretStore.DeleteMessageKeys(ctx, []cid.Cid{id}); err != nil {
+		m.logger.Error("unable to delete the key of an expired message", logutil.PrivateString("cid", id.String()), zap.Error(err))
+		return
+	}
+
+	m.logger.Debug("expired message deleted", logutil.PrivateString("cid", id.String()))
+}
+
+// scheduleExpiration deletes the key of the message once it has expired
+func (m *MessageStore) scheduleExpiration(evt *protocoltypes.GroupMessageEvent) {
+	if evt.ExpiresAt == 0 {
+		return
+	}
+
+	time.AfterFunc(time.Until(time.UnixMilli(evt.ExpiresAt)), func() {
+		if m.ctx.Err() == nil {
+			m.expireMessage(m.ctx, evt)
+		}
+	})
+}
+
+// messageExpiresAt returns the expiration of a message sent at the given
+// time, following the disappearing messages timer of the group, 0 if the
+// message doesn't expire
+func (m *MessageStore) messageExpiresAt(now time.Time) int64 {
+	metadataStore := m.metadataStore.Load()
+	if metadataStore == nil {
+		return 0
+	}
+
+	expiration := metadataStore.MessageExpiration()
+	if expiration <= 0 {
+		return 0
+	}
+
+	return now.Add(expiration).UnixMilli()
+}
+
+func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageCacheTracer) {
 	for {
 		// wait for next message
 		message, ok := m.messagesQueue.WaitForItem(ctx)
@@ -164,6 +282,9 @@ func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMe
 			return
 		}
 
+		// the simple queue doesn't trace its pops
+		tracer.ItemPop("cache", message)
+
 		// get or create a device cache for the device from which we received the message.
 		device, hasKnownChainKey := m.getOrCreateDeviceCache(ctx, message, tracer)
 		if device == nil {
@@ -176,10 +297,41 @@ func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMe
 			continue
 		}
 
+		if held, err := m.checkMembership(message.headers.DevicePk); err != nil {
+			m.logger.Warn("dropping message of an unknown member", logutil.PrivateString("cid", message.hash.String()), zap.Error(err))
+			continue
+		} else if held {
+			// the message is processed again once its device is added to
+			// the group
+			device.queue.Add(message)
+			_ = m.emitters.groupCacheMessage.Emit(*message)
+			continue
+		}
+
 		// actually process the message
-		evt, err := m.processMessage(ctx, message)
-		if err != nil {
-			m.logger.Error("unable to process message", zap.Error(err))
+		var (
+			evt *protocoltypes.GroupMessageEvent
+			err error
+		)
+		if poolErr := m.inboundPool.DoForGroup(ctx, m.group.PublicKey, func(ctx context.Context) {
+			evt, err = m.processMessage(ctx, message)
+		}); poolErr != nil {
+			// the store is closing
+			return
+		}
+
+		if errcode.Has(err, errcode.ErrCode_ErrMessageKeyDeleted) {
+			// the message has expired, it can't be opened anymore
+			m.logger.Debug("dropping deleted message", logutil.PrivateString("cid", message.hash.String()))
+			continue
+		} else if errcode.Has(err, errcode.ErrCode_ErrCryptoSignatureVerification) {
+			// the message won't be valid later, drop it
+			m.sigVerifier.rejected(storeKindMessage)
+			m.logger.Warn("dropping message with an invalid signature", logutil.PrivateString("cid", message.hash.String()), zap.Error(err))
+			continue
+		} else if err != nil {
+			logOpenError(m.logger, "unable to process message", err)
+			m.groupErrors.Record(m.group.PublicKey, storeKindMessage, err)
 
 			// if we got any error here, put (back) the message into the device queue
 			// for ex: `too many open files` error
@@ -188,9 +340,25 @@ func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMe
 			continue
 		}
 
+		// the entries written by the current device are not an activity of
+		// a remote device
+		if !message.receivedAt.IsZero() && !bytes.Equal(evt.Headers.DevicePk, m.currentDevicePublicKeyRaw) {
+			m.lastSeen.Seen(evt.Headers.DevicePk, message.receivedAt)
+		}
+
 		// if we get here we probably can process other messages (if any) in the device queue
 		m.processDeviceMessagesInQueue(device)
 
+		// messages replicated after their expiration are deleted right away
+		if m.isExpired(ctx, evt, time.Now()) {
+			m.logger.Debug("dropping expired message", logutil.PrivateString("cid", message.hash.String()))
+			m.expireMessage(ctx, evt)
+			continue
+		}
+		m.scheduleExpiration(evt)
+		m.edits.UpdateIndex(evt)
+		m.streams.UpdateIndex(evt)
+
 		// emit new message event
 		if err := m.emitters.groupMessage.Emit(evt); err != nil {
 			m.logger.Warn("unable to emit group message event", zap.Error(err))
@@ -198,7 +366,7 @@ func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMe
 	}
 }
 
-func (m *MessageStore) getOrCreateDeviceCache(ctx context.Context, message *messageItem, tracer *messageMetricsTracer) (device *groupCache, hasKnownChainKey bool) {
+func (m *MessageStore) getOrCreateDeviceCache(ctx context.Context, message *messageItem, tracer *messageCacheTracer) (device *groupCache, hasKnownChainKey bool) {
 	devicePublicKeyString := string(message.headers.DevicePk)
 
 	m.muDeviceCaches.Lock()
@@ -233,7 +401,9 @@ func (m *MessageStore) processDeviceMessagesInQueue(device *groupCache) {
 	})
 }
 
-func (m *MessageStore) addToMessageQueue(_ context.Context, e ipfslog.Entry) error {
+// addToMessageQueue queues an entry to be processed, receivedAt is the time
+// the entry has been replicated or zero if it is only read from the log
+func (m *MessageStore) addToMessageQueue(_ context.Context, e ipfslog.Entry, receivedAt time.Time) error {
 	if e == nil {
 		return errcode.ErrCode_ErrInvalidInput
 	}
@@ -249,10 +419,11 @@ func (m *MessageStore) addToMessageQueue(_ context.Context, e ipfslog.Entry) err
 	}
 
 	msg := &messageItem{
-		hash:    e.GetHash(),
-		env:     env,
-		headers: headers,
-		op:      op,
+		hash:       e.GetHash(),
+		env:        env,
+		headers:    headers,
+		op:         op,
+		receivedAt: receivedAt,
 	}
 
 	m.messagesQueue.Add(msg)
@@ -275,8 +446,14 @@ func (m *MessageStore) ListEvents(ctx context.Context, since, until []byte, reve
 			reverse,
 			func(entry ipliface.IPFSLogEntry) {
 				message, err := m.openMessage(ctx, entry)
-				if err != nil {
-					m.logger.Error("unable to open message", zap.Error(err))
+				if errcode.Has(err, errcode.ErrCode_ErrMessageKeyDeleted) {
+					m.logger.Debug("skipping deleted message")
+				} else if err != nil {
+					logOpenError(m.logger, "unable to open message", err)
+				} else if m.isExpired(ctx, message, time.Now()) {
+					// the message may have been pinned until now
+					m.logger.Debug("skipping expired message")
+					m.expireMessage(ctx, message)
 				} else {
 					out <- message
 					m.logger.Info("message store - sent 1 event from log history")
@@ -307,20 +484,39 @@ func (m *MessageStore) AddMessage(ctx context.Context, payload []byte) (operatio
 		)...,
 	)
 
-	return messageStoreAddMessage(ctx, m.group, m, payload)
+	// messages sent on groups with a disappearing messages timer carry their
+	// expiration, so all the members delete them at the same time
+	return messageStoreAddMessage(ctx, m.group, m, payload, &protocoltypes.ProtocolMetadata{
+		ExpiresAt: m.messageExpiresAt(time.Now()),
+	})
+}
+
+// AddMessageEdit adds a new version of the original message, the edit expires
+// along with it
+func (m *MessageStore) AddMessageEdit(ctx context.Context, payload []byte, original *protocoltypes.GroupMessageEvent) (operation.Operation, error) {
+	return messageStoreAddMessage(ctx, m.group, m, payload, &protocoltypes.ProtocolMetadata{
+		ExpiresAt: original.ExpiresAt,
+		EditOf:    original.EventContext.Id,
+	})
 }
 
-func messageStoreAddMessage(ctx context.Context, g *protocoltypes.Group, m *MessageStore, payload []byte) (operation.Operation, error) {
+func messageStoreAddMessage(ctx context.Context, g *protocoltypes.Group, m *MessageStore, payload []byte, metadata *protocoltypes.ProtocolMetadata) (operation.Operation, error) {
+	ctx, done, err := m.writes.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	msg := &protocoltypes.EncryptedMessage{
 		Plaintext:        payload,
-		ProtocolMetadata: &protocoltypes.ProtocolMetadata{},
+		ProtocolMetadata: metadata,
 	}
 	msgBytes, err := proto.Marshal(msg)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
 	}
 
-	sealedEnvelope, err := m.secretStore.SealEnvelope(ctx, g, msgBytes)
+	sealedEnvelope, err := m.secretStore.SealEnvelope(secretstore.ContextWithEncryptionVersion(ctx, m.encryption.version()), g, msgBytes)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
 	}
@@ -341,6 +537,11 @@ func messageStoreAddMessage(ctx context.Context, g *protocoltypes.Group, m *Mess
 	if err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
+	// the chunks of a streamed message aren't acknowledged, only the message
+	// listing them is
+	if !metadata.GetStreamChunk() {
+		m.replicationLag.Sent(g.PublicKey, e.GetHash().Bytes(), time.Now())
+	}
 	m.logger.Debug(
 		"Envelope added to orbit-DB log successfully",
 		tyber.FormatStepLogFields(ctx, []tyber.Detail{})...,
@@ -377,15 +578,29 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 		}
 
 		replication := false
+		cacheTracer := newMessageCacheTracer(metricsTracer)
 
 		store := &MessageStore{
 			eventBus:       options.EventBus,
 			secretStore:    s.secretStore,
-			messagesQueue:  newMessageQueue("cache", metricsTracer),
+			lastSeen:       s.lastSeen,
+			inboundPool:    s.inboundPool,
+			sigVerifier:    s.sigVerifier,
+			writes:         s.writes,
+			encryption:     s.encryption,
+			pins:           s.messagePins,
+			edits:          newMessageEditIndex(),
+			streams:        newMessageStreamIndex(),
+			replicationLag: s.replicationLag,
+			groupErrors:    s.groupErrors,
+			messagesQueue:  newMessageQueue("cache", cacheTracer),
+			cacheTracer:    cacheTracer,
 			group:          g,
 			groupPublicKey: groupPublicKey,
 			logger:         logger,
 			deviceCaches:   make(map[string]*groupCache),
+
+			unknownMemberPolicy: s.unknownMemberPolicy,
 		}
 
 		if s.replicationMode {
@@ -411,7 +626,7 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 		store.ctx, store.cancel = context.WithCancel(context.Background())
 
 		go func() {
-			store.processMessageLoop(store.ctx, metricsTracer)
+			store.processMessageLoop(store.ctx, cacheTracer)
 			logger.Debug("store message process loop ended", zap.Error(store.ctx.Err()))
 		}()
 
@@ -455,7 +670,10 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 					return
 				}
 
-				var entries []ipfslog.Entry
+				var (
+					entries    []ipfslog.Entry
+					receivedAt time.Time
+				)
 
 				switch evt := e.(type) {
 				case stores.EventWrite:
@@ -463,6 +681,7 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 
 				case stores.EventReplicated:
 					entries = evt.Entries
+					receivedAt = time.Now()
 				}
 
 				for _, entry := range entries {
@@ -473,8 +692,18 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 						tyber.FormatStepLogFields(ctx, []tyber.Detail{{Name: "RawEvent", Description: fmt.Sprint(e)}})...,
 					)
 
-					if err := store.addToMessageQueue(ctx, entry); err != nil {
-						logger.Error("unable to add message to queue", zap.Error(err))
+					// the headers are decrypted on the shared pool, this blocks
+					// while the pool is busy which slows down the replication
+					var err error
+					if poolErr := store.inboundPool.DoForGroup(ctx, store.group.PublicKey, func(ctx context.Context) {
+						err = store.addToMessageQueue(ctx, entry, receivedAt)
+					}); poolErr != nil {
+						return
+					}
+
+					if err != nil {
+						logOpenError(logger, "unable to add message to queue", err)
+						store.groupErrors.Record(store.group.PublicKey, storeKindMessage, err)
 					}
 				}
 			}
@@ -498,6 +727,26 @@ func (m *MessageStore) GetMessageByCID(c cid.Cid) (operation.Operation, error) {
 	return op, nil
 }
 
+// messageEdits returns the index of the edits of the messages of the store,
+// it is loaded from the log on the first call
+func (m *MessageStore) messageEdits(ctx context.Context) (*messageEditIndex, error) {
+	if err := m.edits.load(ctx, m); err != nil {
+		return nil, err
+	}
+
+	return m.edits, nil
+}
+
+// GetMessageEventByCID opens the message with the given id
+func (m *MessageStore) GetMessageEventByCID(ctx context.Context, c cid.Cid) (*protocoltypes.GroupMessageEvent, error) {
+	logEntry, ok := m.OpLog().Get(c)
+	if !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to find message entry"))
+	}
+
+	return m.openMessage(ctx, logEntry)
+}
+
 func (m *MessageStore) GetOutOfStoreMessageEnvelope(_ context.Context, c cid.Cid) (*protocoltypes.OutOfStoreMessageEnvelope, error) {
 	op, err := m.GetMessageByCID(c)
 	if err != nil {
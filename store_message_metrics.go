@@ -3,8 +3,10 @@ package weshnet
 import (
 	"encoding/hex"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
 
 	"berty.tech/weshnet/v2/internal/queue"
 )
@@ -24,7 +26,10 @@ var (
 	}
 )
 
-var _ queue.MetricsTracer[*messageItem] = (*messageMetricsTracer)(nil)
+var (
+	_ queue.MetricsTracer[*messageItem] = (*messageMetricsTracer)(nil)
+	_ queue.MetricsTracer[*messageItem] = (*messageCacheTracer)(nil)
+)
 
 type messageMetricsTracer struct {
 	reg prometheus.Registerer
@@ -56,3 +61,28 @@ func (s *messageMetricsTracer) ItemPop(name string, m *messageItem) {
 		name, hex.EncodeToString(m.headers.DevicePk),
 	).Dec()
 }
+
+// messageCacheTracer counts the messages queued in a message store and their
+// size, in addition to the metrics shared by all the stores
+type messageCacheTracer struct {
+	*messageMetricsTracer
+
+	messages atomic.Int64
+	bytes    atomic.Int64
+}
+
+func newMessageCacheTracer(metrics *messageMetricsTracer) *messageCacheTracer {
+	return &messageCacheTracer{messageMetricsTracer: metrics}
+}
+
+func (s *messageCacheTracer) ItemQueued(name string, m *messageItem) {
+	s.messageMetricsTracer.ItemQueued(name, m)
+	s.messages.Add(1)
+	s.bytes.Add(int64(proto.Size(m.env)))
+}
+
+func (s *messageCacheTracer) ItemPop(name string, m *messageItem) {
+	s.messageMetricsTracer.ItemPop(name, m)
+	s.messages.Add(-1)
+	s.bytes.Add(-int64(proto.Size(m.env)))
+}
@@ -1,6 +1,8 @@
 package weshnet
 
 import (
+	"time"
+
 	"github.com/ipfs/go-cid"
 
 	"berty.tech/go-orbit-db/stores/operation"
@@ -14,6 +16,9 @@ type messageItem struct {
 	env     *protocoltypes.MessageEnvelope
 	headers *protocoltypes.MessageHeaders
 	hash    cid.Cid
+
+	// receivedAt is the time the entry has been replicated, zero if unknown
+	receivedAt time.Time
 }
 
 func (m *messageItem) Counter() uint64 {
@@ -0,0 +1,300 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// messageStreamChunkSize is the size of the chunks of a streamed payload, each
+// chunk is added to the store as a separate message
+const messageStreamChunkSize = 256 * 1024
+
+// AddMessageStream adds a message whose payload is read from r. The payload
+// is added to the store in chunks as it is read so it is never fully held in
+// memory, the chunks are followed by a message listing them which identifies
+// the streamed message. The message follows the disappearing messages timer
+// of the group and the chunks expire along with it.
+// The chunks are entries of the log, they are skipped wherever the messages
+// are counted or acknowledged. The chunks of an interrupted stream stay in
+// the log without any message referencing them, their keys are deleted so
+// they can't be opened on the device anymore.
+func (m *MessageStore) AddMessageStream(ctx context.Context, r io.Reader) (operation.Operation, error) {
+	expires := m.messageExpiresAt(time.Now())
+
+	chunks := [][]byte{}
+	size := uint64(0)
+
+	buf := make([]byte, messageStreamChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			op, err := messageStoreAddMessage(ctx, m.group, m, buf[:n], &protocoltypes.ProtocolMetadata{
+				ExpiresAt:   expires,
+				StreamChunk: true,
+			})
+			if err != nil {
+				m.dropStreamChunks(chunks)
+				return nil, err
+			}
+
+			chunks = append(chunks, op.GetEntry().GetHash().Bytes())
+			size += uint64(n)
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			m.dropStreamChunks(chunks)
+			return nil, errcode.ErrCode_ErrStreamRead.Wrap(readErr)
+		}
+	}
+
+	op, err := messageStoreAddMessage(ctx, m.group, m, nil, &protocoltypes.ProtocolMetadata{
+		ExpiresAt:    expires,
+		StreamChunks: chunks,
+		StreamSize:   size,
+	})
+	if err != nil {
+		m.dropStreamChunks(chunks)
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// dropStreamChunks deletes the keys of the chunks of an interrupted stream
+func (m *MessageStore) dropStreamChunks(chunks [][]byte) {
+	ids := make([]cid.Cid, 0, len(chunks))
+	for _, chunk := range chunks {
+		if id, err := cid.Cast(chunk); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	// the stream may have been interrupted by the cancellation of its context
+	if err := m.secretStore.DeleteMessageKeys(m.ctx, ids); err != nil {
+		m.logger.Error("unable to delete the keys of the chunks of an interrupted stream", zap.Error(err))
+		return
+	}
+
+	m.logger.Debug("chunks of an interrupted stream deleted", zap.Int("count", len(ids)))
+}
+
+// streamChunksOf returns the chunks of a streamed message, none for the other
+// messages or if the message can't be opened. A chunk can't be pinned on its
+// own.
+func (m *MessageStore) streamChunksOf(ctx context.Context, id cid.Cid) ([]cid.Cid, error) {
+	evt, err := m.GetMessageEventByCID(ctx, id)
+	if err != nil {
+		return nil, nil
+	}
+
+	if evt.StreamChunk {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a chunk is pinned along with its streamed message"))
+	}
+
+	chunks := make([]cid.Cid, 0, len(evt.StreamChunks))
+	for _, chunk := range evt.StreamChunks {
+		chunkID, err := cid.Cast(chunk)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		chunks = append(chunks, chunkID)
+	}
+
+	return chunks, nil
+}
+
+// messageStreamIndex holds the chunks of the streamed messages of a group,
+// so they can be told apart from the messages without opening the entries of
+// the log. The index is loaded from the log the first time it is used, then
+// it is updated as the messages are processed.
+type messageStreamIndex struct {
+	chunks map[cid.Cid]struct{}
+	loaded bool
+	mu     sync.RWMutex
+}
+
+func newMessageStreamIndex() *messageStreamIndex {
+	return &messageStreamIndex{
+		chunks: map[cid.Cid]struct{}{},
+	}
+}
+
+// load reads the chunks of the log of the store, if not already done
+func (i *messageStreamIndex) load(ctx context.Context, m *MessageStore) error {
+	i.mu.RLock()
+	loaded := i.loaded
+	i.mu.RUnlock()
+
+	if loaded {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.loaded {
+		return nil
+	}
+
+	events, err := m.ListEvents(ctx, nil, nil, false)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	for evt := range events {
+		i.add(evt)
+	}
+
+	i.loaded = true
+
+	return nil
+}
+
+// reset drops the chunks, they are read again from the log on the next use
+func (i *messageStreamIndex) reset() {
+	i.mu.Lock()
+	i.chunks = map[cid.Cid]struct{}{}
+	i.loaded = false
+	i.mu.Unlock()
+}
+
+// UpdateIndex records a processed message if it is a chunk, nothing is done
+// until the index is loaded as the message is then read from the log
+func (i *messageStreamIndex) UpdateIndex(evt *protocoltypes.GroupMessageEvent) {
+	if !evt.StreamChunk {
+		return
+	}
+
+	i.mu.Lock()
+	if i.loaded {
+		i.add(evt)
+	}
+	i.mu.Unlock()
+}
+
+func (i *messageStreamIndex) add(evt *protocoltypes.GroupMessageEvent) {
+	if !evt.StreamChunk {
+		return
+	}
+
+	if id, err := cid.Cast(evt.GetEventContext().GetId()); err == nil {
+		i.chunks[id] = struct{}{}
+	}
+}
+
+// isChunk checks whether an entry of the log is a chunk of a streamed message
+func (i *messageStreamIndex) isChunk(id cid.Cid) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	_, ok := i.chunks[id]
+	return ok
+}
+
+// messageStreams returns the index of the chunks of the streamed messages of
+// the store, it is loaded from the log on the first call
+func (m *MessageStore) messageStreams(ctx context.Context) (*messageStreamIndex, error) {
+	if err := m.streams.load(ctx, m); err != nil {
+		return nil, err
+	}
+
+	return m.streams, nil
+}
+
+// OpenMessageStream returns a reader of the payload of a message, the chunks
+// of a streamed message are opened one at a time as the payload is read
+func (m *MessageStore) OpenMessageStream(ctx context.Context, c cid.Cid) (io.Reader, error) {
+	evt, err := m.GetMessageEventByCID(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if evt.StreamChunk {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a chunk can't be read on its own, read the streamed message instead"))
+	}
+
+	if len(evt.StreamChunks) == 0 {
+		return bytes.NewReader(evt.Message), nil
+	}
+
+	return &messageStreamReader{
+		ctx:      ctx,
+		store:    m,
+		devicePK: evt.GetHeaders().GetDevicePk(),
+		chunks:   evt.StreamChunks,
+		size:     evt.StreamSize,
+	}, nil
+}
+
+type messageStreamReader struct {
+	ctx      context.Context
+	store    *MessageStore
+	devicePK []byte
+	chunks   [][]byte
+	current  []byte
+	size     uint64
+	read     uint64
+}
+
+func (r *messageStreamReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if len(r.chunks) == 0 {
+			if r.read != r.size {
+				return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the payload is %d bytes long, %d bytes expected", r.read, r.size))
+			}
+
+			return 0, io.EOF
+		}
+
+		if err := r.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	r.read += uint64(n)
+
+	return n, nil
+}
+
+// nextChunk opens the next chunk of the message, it must have been sent by the
+// device which sent the message
+func (r *messageStreamReader) nextChunk() error {
+	id, err := cid.Cast(r.chunks[0])
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+	r.chunks = r.chunks[1:]
+
+	chunk, err := r.store.GetMessageEventByCID(r.ctx, id)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to open a chunk of the message: %w", err))
+	}
+
+	if !chunk.StreamChunk || !bytes.Equal(chunk.GetHeaders().GetDevicePk(), r.devicePK) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("%s isn't a chunk of the message", id.String()))
+	}
+
+	r.current = chunk.Message
+
+	return nil
+}
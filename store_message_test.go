@@ -4,14 +4,19 @@ import (
 	"container/ring"
 	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	sqlite3 "github.com/mutecomm/go-sqlcipher/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/weshnet/v2/internal/datastoreutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/testutil"
 )
@@ -218,3 +223,127 @@ func Test_Add_Messages_To_Cache(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, 0, size)
 }
+
+func Test_AddMessage_Updates_LastSeen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers, _, cleanup := CreatePeersWithGroupTest(ctx, t, "/tmp/message_test", 2, 1)
+	defer cleanup()
+
+	dPK0 := peers[0].GC.DevicePubKey()
+	dPK0Raw, err := dPK0.Raw()
+	require.NoError(t, err)
+
+	ds0For1, err := peers[0].SecretStore.GetShareableChainKey(ctx, peers[0].GC.Group(), peers[1].GC.MemberPubKey())
+	require.NoError(t, err)
+
+	cadded, err := peers[1].GC.MessageStore().EventBus().Subscribe(new(messageItem))
+	require.NoError(t, err)
+	defer cadded.Close()
+
+	before := time.Now()
+
+	_, err = peers[0].GC.MessageStore().AddMessage(ctx, []byte("test message"))
+	require.NoError(t, err)
+
+	// the chain key of the device isn't known yet, the message is cached
+	select {
+	case <-cadded.Out():
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "timeout while waiting for replicated event")
+	}
+
+	received := time.Now()
+
+	cevent, err := peers[1].GC.MessageStore().EventBus().Subscribe(new(*protocoltypes.GroupMessageEvent))
+	require.NoError(t, err)
+	defer cevent.Close()
+
+	err = peers[1].SecretStore.RegisterChainKey(ctx, peers[0].GC.Group(), dPK0, ds0For1)
+	require.NoError(t, err)
+
+	peers[1].GC.MessageStore().ProcessMessageQueueForDevicePK(ctx, dPK0Raw)
+
+	select {
+	case <-cevent.Out():
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "timeout while waiting for group message event")
+	}
+
+	// the device is seen when the message has been received, not when it
+	// has been processed
+	lastSeen, ok := peers[1].DB.lastSeen.LastSeen(dPK0Raw)
+	require.True(t, ok)
+	require.False(t, lastSeen.Before(before))
+	require.False(t, lastSeen.After(received))
+
+	// the entries of the current device are not an activity
+	_, ok = peers[0].DB.lastSeen.LastSeen(dPK0Raw)
+	require.False(t, ok)
+}
+
+// busyDatastore fails its writes as a locked sqlite database would while
+// failures is positive
+type busyDatastore struct {
+	ds.Batching
+
+	failures atomic.Int32
+	failed   atomic.Int32
+}
+
+func (b *busyDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	if b.failures.Add(-1) >= 0 {
+		b.failed.Add(1)
+		return sqlite3.Error{Code: sqlite3.ErrBusy}
+	}
+
+	return b.Batching.Put(ctx, key, value)
+}
+
+func TestAddMessageRetriesTransientErrors(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	// the service retries the writes to its root datastore
+	busy := &busyDatastore{Batching: dsync.MutexWrap(ds.NewMapDatastore())}
+	svc, cleanup := TestingService(ctx, t, Opts{
+		Logger:        logger,
+		RootDatastore: busy,
+		DatastoreRetry: &datastoreutil.RetryOptions{
+			MinBackoff: time.Millisecond,
+			MaxBackoff: time.Millisecond * 10,
+		},
+	})
+	defer cleanup()
+
+	created, err := svc.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	// the database is busy for the next writes of the message
+	busy.failures.Store(3)
+
+	_, err = svc.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: created.GroupPk,
+		Payload: []byte("test message"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int32(3), busy.failed.Load())
+
+	gc, err := svc.(*service).GetContextGroupForID(created.GroupPk)
+	require.NoError(t, err)
+
+	out, err := gc.MessageStore().ListEvents(ctx, nil, nil, false)
+	require.NoError(t, err)
+
+	found := false
+	for evt := range out {
+		found = found || string(evt.Message) == "test message"
+	}
+	require.True(t, found)
+}
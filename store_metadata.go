@@ -1,12 +1,15 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	crand "crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	coreiface "github.com/ipfs/kubo/core/coreiface"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -41,8 +44,16 @@ type MetadataStore struct {
 	memberDevice       secretstore.OwnMemberDevice
 	devicePublicKeyRaw []byte
 	secretStore        secretstore.SecretStore
+	lastSeen           *lastSeenTracker
+	sigVerifier        *signatureVerifier
+	writes             *writeGuard
+	encryption         *groupEncryption
 	logger             *zap.Logger
 
+	// membershipValidator can reject the devices added to the group, see
+	// MembershipValidator
+	membershipValidator MembershipValidator
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -82,13 +93,13 @@ func (m *MetadataStore) setLogger(l *zap.Logger) {
 	}
 }
 
-func openMetadataEntry(log ipfslog.Log, e ipfslog.Entry, g *protocoltypes.Group) (*protocoltypes.GroupMetadataEvent, proto.Message, error) {
+func openMetadataEntry(log ipfslog.Log, e ipfslog.Entry, g *protocoltypes.Group, suites *secretstore.CipherSuites, verifier *signatureVerifier) (*protocoltypes.GroupMetadataEvent, proto.Message, error) {
 	op, err := operation.ParseOperation(e)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	meta, event, err := openGroupEnvelope(g, op.GetValue())
+	meta, event, err := openGroupEnvelope(g, op.GetValue(), suites, verifier)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -120,9 +131,9 @@ func (m *MetadataStore) ListEvents(_ context.Context, since, until []byte, rever
 			entries,
 			reverse,
 			func(entry ipliface.IPFSLogEntry) {
-				event, _, err := openMetadataEntry(m.OpLog(), entry, m.group)
+				event, _, err := openMetadataEntry(m.OpLog(), entry, m.group, m.secretStore.CipherSuites(), m.sigVerifier.withoutReport())
 				if err != nil {
-					m.logger.Error("unable to open metadata event", zap.Error(err))
+					logOpenError(m.logger, "unable to open metadata event", err)
 				} else {
 					out <- event
 					m.logger.Info("metadata store - sent 1 event from log history")
@@ -229,6 +240,81 @@ func MetadataStoreSendSecret(ctx context.Context, m *MetadataStore, g *protocolt
 	return metadataStoreAddEvent(ctx, m, g, protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded, event, sig)
 }
 
+// SendEpochKey shares the current epoch key of a multi-member group with a
+// member, nothing is sent if the group has never been rekeyed
+func (m *MetadataStore) SendEpochKey(ctx context.Context, memberPK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.CanRekey(m.memberDevice.Device()) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied
+	}
+
+	epoch, encryptedEpochKey, err := m.secretStore.GetShareableEpochKey(ctx, m.group, memberPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	if epoch == 0 {
+		return nil, nil
+	}
+
+	ok, err := m.Index().(*metadataStoreIndex).isEpochKeyAlreadySent(memberPK, epoch)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if ok {
+		return nil, errcode.ErrCode_ErrGroupSecretAlreadySentToMember
+	}
+
+	memberPKRaw, err := memberPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	event := &protocoltypes.MultiMemberGroupEpochKeyAdded{
+		DevicePk:     m.devicePublicKeyRaw,
+		DestMemberPk: memberPKRaw,
+		Epoch:        epoch,
+		Payload:      encryptedEpochKey,
+	}
+
+	sig, err := signProtoWithDevice(event, m.memberDevice)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return metadataStoreAddEvent(ctx, m, m.group, protocoltypes.EventType_EventTypeMultiMemberGroupEpochKeyAdded, event, sig)
+}
+
+// MultiMemberGroupRekey rotates the epoch key of a multi-member group and
+// shares it with the current members, messages sent afterward can't be
+// opened without the new key
+func (m *MetadataStore) MultiMemberGroupRekey(ctx context.Context) (uint64, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return 0, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.CanRekey(m.memberDevice.Device()) {
+		return 0, errcode.ErrCode_ErrGroupPermissionDenied
+	}
+
+	epoch, err := m.secretStore.RotateGroupEpochKey(ctx, m.group)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	for _, memberPK := range m.ListMembers() {
+		if _, err := m.SendEpochKey(ctx, memberPK); err != nil && !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) {
+			return 0, err
+		}
+	}
+
+	return epoch, nil
+}
+
 func (m *MetadataStore) ClaimGroupOwnership(ctx context.Context, groupSK crypto.PrivKey) (operation.Operation, error) {
 	if !m.typeChecker(isMultiMemberGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
@@ -282,7 +368,13 @@ func metadataStoreAddEvent(ctx context.Context, m *MetadataStore, g *protocoltyp
 		tyberLogError = tyber.LogFatalError
 	}
 
-	env, err := sealGroupEnvelope(g, eventType, event, sig)
+	ctx, done, err := m.writes.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	env, err := sealGroupEnvelope(g, m.secretStore.CipherSuites().Sealing(), m.encryption.version(), eventType, event, sig)
 	if err != nil {
 		return nil, tyberLogError(ctx, m.logger, "Failed to seal group envelope", errcode.ErrCode_ErrCryptoSignature.Wrap(err))
 	}
@@ -324,6 +416,11 @@ func (m *MetadataStore) GetDevicesForMember(pk crypto.PubKey) ([]crypto.PubKey,
 	return m.Index().(*metadataStoreIndex).getDevicesForMember(pk)
 }
 
+// CanRekey checks whether a device is allowed to rotate the group epoch key
+func (m *MetadataStore) CanRekey(devicePK crypto.PubKey) bool {
+	return m.Index().(*metadataStoreIndex).canRekey(devicePK)
+}
+
 func (m *MetadataStore) ListAdmins() []crypto.PubKey {
 	if m.typeChecker(isContactGroup, isAccountGroup) {
 		return m.ListMembers()
@@ -362,6 +459,18 @@ func (m *MetadataStore) ListMembers() []crypto.PubKey {
 	return nil
 }
 
+// validateMembership runs the membership validator of the store on a device
+// added to the group
+func (m *MetadataStore) validateMembership(added *protocoltypes.GroupMemberDeviceAdded) error {
+	return validateMembership(m.ctx, m.membershipValidator, m.group, m.memberDevice, added)
+}
+
+// isDeviceRejected checks whether a device added to the group has been
+// rejected by the membership validator of the store
+func (m *MetadataStore) isDeviceRejected(devicePK crypto.PubKey) bool {
+	return m.Index().(*metadataStoreIndex).isDeviceRejected(devicePK)
+}
+
 func (m *MetadataStore) ListDevices() []crypto.PubKey {
 	return m.Index().(*metadataStoreIndex).listDevices()
 }
@@ -391,6 +500,33 @@ func (m *MetadataStore) ListMultiMemberGroups() []*protocoltypes.Group {
 	return groups
 }
 
+// ListLeftMultiMemberGroupPKs lists the public keys of the multi-member groups
+// the account has left, the groups themselves aren't kept once left
+func (m *MetadataStore) ListLeftMultiMemberGroupPKs() [][]byte {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return nil
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	groupPKs := [][]byte(nil)
+
+	for groupPK, g := range idx.groups {
+		if g.state != accountGroupJoinedStateLeft {
+			continue
+		}
+
+		groupPKs = append(groupPKs, []byte(groupPK))
+	}
+
+	return groupPKs
+}
+
 func (m *MetadataStore) ListOtherMembersDevices() []crypto.PubKey {
 	return m.Index().(*metadataStoreIndex).listOtherMembersDevices()
 }
@@ -463,6 +599,21 @@ func (m *MetadataStore) GetContactFromGroupPK(groupPK []byte) *protocoltypes.Sha
 	return contact.contact
 }
 
+// isGroupLeft returns whether the account has left the group, it can still be
+// opened to read its history
+func (m *MetadataStore) isGroupLeft(pk []byte) bool {
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return false
+	}
+
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	existingGroup, ok := idx.groups[string(pk)]
+	return ok && existingGroup.state == accountGroupJoinedStateLeft
+}
+
 func (m *MetadataStore) checkIfInGroup(pk []byte) bool {
 	idx, ok := m.Index().(*metadataStoreIndex)
 	if !ok {
@@ -626,6 +777,33 @@ func (m *MetadataStore) ContactRequestOutgoingSent(ctx context.Context, pk crypt
 	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestOutgoingSent{}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent)
 }
 
+// ContactRequestOutgoingCancel indicates the payload includes that the deviceKeystore retracts a contact request, pending or already sent
+func (m *MetadataStore) ContactRequestOutgoingCancel(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	switch m.getContactStatus(pk) {
+	case protocoltypes.ContactState_ContactStateToRequest:
+
+	// a request already sent can be retracted, the contact may not have
+	// accepted it yet
+	case protocoltypes.ContactState_ContactStateAdded:
+		if !m.isContactRequestSent(pk) {
+			return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
+		}
+
+	case protocoltypes.ContactState_ContactStateUndefined:
+		return nil, errcode.ErrCode_ErrContactRequestContactUndefined
+	case protocoltypes.ContactState_ContactStateBlocked:
+		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
+	default:
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestOutgoingCanceled{}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingCanceled)
+}
+
 // ContactRequestIncomingReceived indicates the payload includes that the deviceKeystore has received a contact request
 func (m *MetadataStore) ContactRequestIncomingReceived(ctx context.Context, contact *protocoltypes.ShareableContact) (operation.Operation, error) {
 	m.logger.Debug("Sending ContactRequestIncomingReceived on Account group", tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
@@ -773,6 +951,152 @@ func (m *MetadataStore) SendAppMetadata(ctx context.Context, message []byte) (op
 	}, protocoltypes.EventType_EventTypeGroupMetadataPayloadSent)
 }
 
+// deliveryReceiptSigPrefix is prepended to the message id signed by the
+// receiving device, so the receipt can't be mistaken for another signature
+// made with the device key
+const deliveryReceiptSigPrefix = "weshnet/delivery-receipt:"
+
+func deliveryReceiptSignedData(messageID []byte) []byte {
+	return append([]byte(deliveryReceiptSigPrefix), messageID...)
+}
+
+// SendMessageDeliveryAck acknowledges the delivery of a message to the other
+// group members, nothing is sent if the message has already been acknowledged
+// by the current device
+func (m *MetadataStore) SendMessageDeliveryAck(ctx context.Context, messageID []byte) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup, isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if len(messageID) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no message id provided"))
+	}
+
+	index := m.Index().(*metadataStoreIndex)
+	if index.isMessageDeliveryAcked(messageID, m.devicePublicKeyRaw) {
+		return nil, nil
+	}
+
+	ack := &protocoltypes.GroupMessageDeliveryAcked{
+		MessageId: messageID,
+	}
+
+	// the receipt can then be verified by anyone knowing the device key
+	if index.areReceiptsSigned() {
+		sig, err := m.memberDevice.DeviceSign(deliveryReceiptSignedData(messageID))
+		if err != nil {
+			return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+		}
+
+		ack.Signature = sig
+	}
+
+	return m.attributeSignAndAddEvent(ctx, ack, protocoltypes.EventType_EventTypeGroupMessageDeliveryAcked)
+}
+
+// SetSignedReceipts enables or disables the signed delivery receipts of the
+// group, once enabled the devices sign the cid of the messages they
+// acknowledge
+func (m *MetadataStore) SetSignedReceipts(ctx context.Context, enabled bool) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup, isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupSignedReceiptsUpdated{
+		Enabled: enabled,
+	}, protocoltypes.EventType_EventTypeGroupSignedReceiptsUpdated)
+}
+
+// SignedReceipts returns true if the signed delivery receipts are enabled on
+// the group
+func (m *MetadataStore) SignedReceipts() bool {
+	return m.Index().(*metadataStoreIndex).areReceiptsSigned()
+}
+
+// SetDeliveryAcks enables or disables the delivery acknowledgements of the
+// group, once enabled the devices acknowledge the messages they receive
+func (m *MetadataStore) SetDeliveryAcks(ctx context.Context, enabled bool) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup, isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupDeliveryAcksUpdated{
+		Enabled: enabled,
+	}, protocoltypes.EventType_EventTypeGroupDeliveryAcksUpdated)
+}
+
+// DeliveryAcks returns true if the delivery acknowledgements are enabled on
+// the group
+func (m *MetadataStore) DeliveryAcks() bool {
+	return m.Index().(*metadataStoreIndex).areDeliveryAcksEnabled()
+}
+
+// SetMessageExpiration sets the disappearing messages timer of the group, the
+// messages sent afterward expire once it has elapsed, 0 disables the timer
+func (m *MetadataStore) SetMessageExpiration(ctx context.Context, expiration time.Duration) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup, isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if expiration < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expiration can't be negative"))
+	}
+
+	if expiration%time.Second != 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expiration must be a whole number of seconds"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupMessageExpirationUpdated{
+		Expiration: int64(expiration / time.Second),
+	}, protocoltypes.EventType_EventTypeGroupMessageExpirationUpdated)
+}
+
+// MemberLeave announces to the other members that the current member has left
+// the group
+func (m *MetadataStore) MemberLeave(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupMemberLeft{}, protocoltypes.EventType_EventTypeGroupMemberLeft)
+}
+
+// MessageExpiration returns the disappearing messages timer of the group, 0
+// if it is disabled
+func (m *MetadataStore) MessageExpiration() time.Duration {
+	return m.Index().(*metadataStoreIndex).getMessageExpiration()
+}
+
+// MessageDeliveryStatus returns the devices which have acknowledged the
+// delivery of a message, along with the number of known devices of the group
+// excluding the current one. Only the acks of the last
+// maxDeliveryAckedMessages acknowledged messages are kept.
+func (m *MetadataStore) MessageDeliveryStatus(messageID []byte) (ackedDevices [][]byte, totalDevices int) {
+	ackedDevices = [][]byte{}
+	for _, device := range m.Index().(*metadataStoreIndex).listMessageDeliveryAcks(messageID) {
+		if !bytes.Equal(device, m.devicePublicKeyRaw) {
+			ackedDevices = append(ackedDevices, device)
+		}
+	}
+
+	for _, device := range m.ListDevices() {
+		if !device.Equals(m.memberDevice.Device()) {
+			totalDevices++
+		}
+	}
+
+	return ackedDevices, totalDevices
+}
+
+// MessageDeliveryReceipts returns the signed delivery receipts of a message,
+// by device, the receipt of the current device is excluded
+func (m *MetadataStore) MessageDeliveryReceipts(messageID []byte) map[string][]byte {
+	receipts := m.Index().(*metadataStoreIndex).listMessageDeliveryReceipts(messageID)
+	delete(receipts, string(m.devicePublicKeyRaw))
+
+	return receipts
+}
+
 func (m *MetadataStore) SendAccountVerifiedCredentialAdded(ctx context.Context, token *protocoltypes.AccountVerifiedCredentialRegistered) (operation.Operation, error) {
 	if !m.typeChecker(isAccountGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
@@ -873,6 +1197,17 @@ func (m *MetadataStore) getContactStatus(pk crypto.PubKey) protocoltypes.Contact
 	return contact.state
 }
 
+// isContactRequestSent checks whether a contact has been added by sending it
+// a request
+func (m *MetadataStore) isContactRequestSent(pk crypto.PubKey) bool {
+	contact, err := m.Index().(*metadataStoreIndex).getContact(pk)
+	if err != nil {
+		return false
+	}
+
+	return contact.requestSent
+}
+
 func (m *MetadataStore) checkContactStatus(pk crypto.PubKey, states ...protocoltypes.ContactState) bool {
 	contactStatus := m.getContactStatus(pk)
 
@@ -910,6 +1245,12 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 			group:       g,
 			logger:      logger,
 			secretStore: s.secretStore,
+			lastSeen:    s.lastSeen,
+			sigVerifier: s.sigVerifier,
+			writes:      s.writes,
+			encryption:  s.encryption,
+
+			membershipValidator: s.membershipValidator,
 		}
 
 		if s.replicationMode {
@@ -971,7 +1312,10 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 					return
 				}
 
-				var entries []ipfslog.Entry
+				var (
+					entries    []ipfslog.Entry
+					receivedAt time.Time
+				)
 
 				switch evt := e.(type) {
 				case stores.EventWrite:
@@ -979,14 +1323,31 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 
 				case stores.EventReplicated:
 					entries = evt.Entries
+					receivedAt = time.Now()
 				}
 
 				for _, entry := range entries {
 					ctx = tyber.ContextWithConstantTraceID(ctx, "msgrcvd-"+entry.GetHash().String())
 					tyber.LogTraceStart(ctx, store.logger, fmt.Sprintf("Received metadata from %s group %s", shortGroupType, b64GroupPK))
 
-					metaEvent, event, err := openMetadataEntry(store.OpLog(), entry, g)
-					if err != nil {
+					var (
+						metaEvent *protocoltypes.GroupMetadataEvent
+						event     proto.Message
+						err       error
+					)
+					if poolErr := s.inboundPool.DoForGroup(ctx, g.PublicKey, func(context.Context) {
+						metaEvent, event, err = openMetadataEntry(store.OpLog(), entry, g, s.secretStore.CipherSuites(), store.sigVerifier)
+					}); poolErr != nil {
+						return
+					}
+
+					s.groupErrors.Record(g.PublicKey, storeKindMetadata, err)
+
+					if errors.Is(err, secretstore.ErrCipherSuiteUnsupported) {
+						store.logger.Warn("skipping metadata event encrypted using an unsupported cipher suite", zap.Error(err))
+						tyber.LogTraceEnd(ctx, store.logger, "Skipped metadata event", tyber.WithError(err), tyber.ForceReopen)
+						continue
+					} else if err != nil {
 						_ = tyber.LogFatalError(ctx, store.logger, "Unable to open metadata event", err, tyber.WithDetail("RawEvent", fmt.Sprint(e)), tyber.ForceReopen)
 						continue
 					}
@@ -999,6 +1360,12 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 						tyber.UpdateTraceName(fmt.Sprintf("Received %s from %s group %s", strings.TrimPrefix(metaEvent.GetMetadata().GetEventType().String(), "EventType"), shortGroupType, b64GroupPK)),
 					)
 
+					// the entries of the current device are skipped, they can be
+					// replicated back from another peer
+					if deviceEvent, ok := event.(eventDeviceSigned); ok && !receivedAt.IsZero() && !bytes.Equal(deviceEvent.GetDevicePk(), store.devicePublicKeyRaw) {
+						store.lastSeen.Seen(deviceEvent.GetDevicePk(), receivedAt)
+					}
+
 					recvEvent := EventMetadataReceived{
 						MetaEvent: metaEvent,
 						Event:     event,
@@ -1015,7 +1382,7 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 			}
 		}(store.ctx)
 
-		options.Index = newMetadataIndex(store.ctx, g, store.memberDevice, s.secretStore)
+		options.Index = newMetadataIndex(store.ctx, g, store.memberDevice, s.secretStore, store.sigVerifier.withoutReport(), store.membershipValidator)
 		if err := store.InitBaseStore(ipfs, identity, addr, options); err != nil {
 			store.cancel()
 			return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
@@ -1,10 +1,14 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
@@ -17,17 +21,35 @@ import (
 	"berty.tech/weshnet/v2/pkg/secretstore"
 )
 
+// maxDeliveryAckedMessages is the number of messages whose delivery acks are
+// kept by the index, the acks of the oldest messages are dropped beyond it
+const maxDeliveryAckedMessages = 10000
+
 // FIXME: replace members, devices, sentSecrets, contacts and groups by a circular buffer to avoid an attack by RAM saturation
 type metadataStoreIndex struct {
 	members                  map[string][]secretstore.MemberDevice
 	devices                  map[string]secretstore.MemberDevice
+	rejectedDevices          map[string]struct{}
+	leftMembers              map[string]struct{}
+	leftDevices              map[string]struct{}
+	joinedDevices            map[string]struct{}
 	handledEvents            map[string]struct{}
 	sentSecrets              map[string]struct{}
+	sentEpochKeys            map[string]uint64
+	deliveryAcks             map[string]map[string][]byte
+	deliveryAckedMessages    []string
+	messageExpiration        *time.Duration
+	signedReceipts           *bool
+	deliveryAcksEnabled      *bool
+	snapshot                 *protocoltypes.GroupSnapshot
+	snapshotMembers          map[string][]secretstore.MemberDevice
+	snapshotDevices          map[string]secretstore.MemberDevice
 	admins                   map[crypto.PubKey]struct{}
 	contacts                 map[string]*AccountContact
 	contactsFromGroupPK      map[string]*AccountContact
 	groups                   map[string]*accountGroup
 	contactRequestMetadata   map[string][]byte
+	canceledContactRequests  map[string]struct{}
 	verifiedCredentials      []*protocoltypes.AccountVerifiedCredentialRegistered
 	contactRequestSeed       []byte
 	contactRequestEnabled    *bool
@@ -39,6 +61,8 @@ type metadataStoreIndex struct {
 	group                    *protocoltypes.Group
 	ownMemberDevice          secretstore.MemberDevice
 	secretStore              secretstore.SecretStore
+	sigVerifier              *signatureVerifier
+	membershipValidator      MembershipValidator
 	ctx                      context.Context
 	lock                     sync.RWMutex
 	logger                   *zap.Logger
@@ -68,10 +92,17 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 	m.contactsFromGroupPK = map[string]*AccountContact{}
 	m.groups = map[string]*accountGroup{}
 	m.contactRequestMetadata = map[string][]byte{}
+	m.canceledContactRequests = map[string]struct{}{}
 	m.contactRequestEnabled = nil
+	m.messageExpiration = nil
+	m.signedReceipts = nil
+	m.deliveryAcksEnabled = nil
 	m.contactRequestSeed = []byte(nil)
 	m.verifiedCredentials = nil
 	m.handledEvents = map[string]struct{}{}
+	m.leftMembers = map[string]struct{}{}
+	m.leftDevices = map[string]struct{}{}
+	m.joinedDevices = map[string]struct{}{}
 
 	for i := len(entries) - 1; i >= 0; i-- {
 		e := entries[i]
@@ -83,9 +114,9 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 			continue
 		}
 
-		metaEvent, event, err := openMetadataEntry(log, e, m.group)
+		metaEvent, event, err := openMetadataEntry(log, e, m.group, m.secretStore.CipherSuites(), m.sigVerifier)
 		if err != nil {
-			m.logger.Error("unable to open metadata entry", zap.Error(err))
+			logOpenError(m.logger, "unable to open metadata entry", err)
 			continue
 		}
 
@@ -114,6 +145,9 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 		m.handledEvents[e.GetHash().String()] = struct{}{}
 	}
 
+	m.dropReplicatedSnapshot(log)
+	m.applySnapshotSettings()
+
 	for _, h := range m.postIndexActions {
 		if err := h(); err != nil {
 			return errcode.ErrCode_ErrInternal.Wrap(err)
@@ -139,10 +173,33 @@ func (m *metadataStoreIndex) handleGroupMemberDeviceAdded(event proto.Message) e
 		return errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
+	// the log is indexed from the newest entry, the member may have left the
+	// group after adding the device
+	if _, ok := m.leftDevices[string(e.DevicePk)]; ok {
+		if !m.isOwnMember(member) {
+			m.leftMembers[string(e.MemberPk)] = struct{}{}
+		}
+		return nil
+	}
+
+	if _, ok := m.leftMembers[string(e.MemberPk)]; ok {
+		m.leftDevices[string(e.DevicePk)] = struct{}{}
+		return nil
+	}
+
+	m.joinedDevices[string(e.DevicePk)] = struct{}{}
+
 	if _, ok := m.devices[string(e.DevicePk)]; ok {
 		return nil
 	}
 
+	// a rejected device is left out of the members, its entry stays in the log
+	if err := validateMembership(m.ctx, m.membershipValidator, m.group, m.ownMemberDevice, e); err != nil {
+		m.logger.Debug("member device rejected", zap.Error(err))
+		m.rejectedDevices[string(e.DevicePk)] = struct{}{}
+		return nil
+	}
+
 	memberDevice := secretstore.NewMemberDevice(member, device)
 
 	m.devices[string(e.DevicePk)] = memberDevice
@@ -174,6 +231,118 @@ func (m *metadataStoreIndex) handleGroupDeviceChainKeyAdded(event proto.Message)
 	return nil
 }
 
+func (m *metadataStoreIndex) handleMultiMemberGroupEpochKeyAdded(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupEpochKeyAdded)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	senderPK, err := crypto.UnmarshalEd25519PublicKey(e.DevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if m.ownMemberDevice.Device().Equals(senderPK) && e.Epoch > m.sentEpochKeys[string(e.DestMemberPk)] {
+		m.sentEpochKeys[string(e.DestMemberPk)] = e.Epoch
+	}
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleGroupMessageDeliveryAcked(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupMessageDeliveryAcked)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if len(e.MessageId) == 0 || len(e.DevicePk) == 0 {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	// a signed receipt must be verifiable by anyone knowing the device key
+	if len(e.Signature) > 0 {
+		devicePK, err := crypto.UnmarshalEd25519PublicKey(e.DevicePk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if ok, err := devicePK.Verify(deliveryReceiptSignedData(e.MessageId), e.Signature); err != nil || !ok {
+			return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("invalid delivery receipt signature"))
+		}
+	}
+
+	acks, ok := m.deliveryAcks[string(e.MessageId)]
+	if !ok {
+		acks = map[string][]byte{}
+		m.deliveryAcks[string(e.MessageId)] = acks
+		m.deliveryAckedMessages = append(m.deliveryAckedMessages, string(e.MessageId))
+
+		// the delivery status of the oldest messages isn't known anymore
+		if len(m.deliveryAckedMessages) > maxDeliveryAckedMessages {
+			delete(m.deliveryAcks, m.deliveryAckedMessages[0])
+			m.deliveryAckedMessages = m.deliveryAckedMessages[1:]
+		}
+	}
+
+	if _, ok := acks[string(e.DevicePk)]; !ok || len(e.Signature) > 0 {
+		acks[string(e.DevicePk)] = e.Signature
+	}
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleGroupSignedReceiptsUpdated(event proto.Message) error {
+	if m.signedReceipts != nil {
+		return nil
+	}
+
+	e, ok := event.(*protocoltypes.GroupSignedReceiptsUpdated)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	enabled := e.Enabled
+	m.signedReceipts = &enabled
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleGroupDeliveryAcksUpdated(event proto.Message) error {
+	if m.deliveryAcksEnabled != nil {
+		return nil
+	}
+
+	e, ok := event.(*protocoltypes.GroupDeliveryAcksUpdated)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	enabled := e.Enabled
+	m.deliveryAcksEnabled = &enabled
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleGroupMessageExpirationUpdated(event proto.Message) error {
+	if m.messageExpiration != nil {
+		return nil
+	}
+
+	e, ok := event.(*protocoltypes.GroupMessageExpirationUpdated)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if e.Expiration < 0 {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	expiration := time.Duration(e.Expiration) * time.Second
+	m.messageExpiration = &expiration
+
+	return nil
+}
+
 func (m *metadataStoreIndex) getMemberByDevice(devicePublicKey crypto.PubKey) (crypto.PubKey, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -183,7 +352,29 @@ func (m *metadataStoreIndex) getMemberByDevice(devicePublicKey crypto.PubKey) (c
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	return m.unsafeGetMemberByDevice(publicKeyBytes)
+	member, err := m.unsafeGetMemberByDevice(publicKeyBytes)
+	if err != nil {
+		if device, ok := m.snapshotDevices[string(publicKeyBytes)]; ok {
+			return device.Member(), nil
+		}
+	}
+
+	return member, err
+}
+
+// isDeviceRejected checks whether a device added to the group has been
+// rejected by the membership validator
+func (m *metadataStoreIndex) isDeviceRejected(devicePublicKey crypto.PubKey) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	publicKeyBytes, err := devicePublicKey.Raw()
+	if err != nil {
+		return false
+	}
+
+	_, ok := m.rejectedDevices[string(publicKeyBytes)]
+	return ok
 }
 
 func (m *metadataStoreIndex) unsafeGetMemberByDevice(publicKeyBytes []byte) (crypto.PubKey, error) {
@@ -208,7 +399,7 @@ func (m *metadataStoreIndex) getDevicesForMember(pk crypto.PubKey) ([]crypto.Pub
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	mds, ok := m.members[string(id)]
+	mds, ok := m.unsafeMembers()[string(id)]
 	if !ok {
 		return nil, errcode.ErrCode_ErrInvalidInput
 	}
@@ -225,14 +416,14 @@ func (m *metadataStoreIndex) MemberCount() int {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return len(m.members)
+	return len(m.unsafeMembers())
 }
 
 func (m *metadataStoreIndex) DeviceCount() int {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return len(m.devices)
+	return len(m.unsafeDevices())
 }
 
 func (m *metadataStoreIndex) listContacts() map[string]*AccountContact {
@@ -266,10 +457,11 @@ func (m *metadataStoreIndex) listMembers() []crypto.PubKey {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	members := make([]crypto.PubKey, len(m.members))
+	allMembers := m.unsafeMembers()
+	members := make([]crypto.PubKey, len(allMembers))
 	i := 0
 
-	for _, md := range m.members {
+	for _, md := range allMembers {
 		members[i] = md[0].Member()
 		i++
 	}
@@ -281,10 +473,11 @@ func (m *metadataStoreIndex) listDevices() []crypto.PubKey {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	devices := make([]crypto.PubKey, len(m.devices))
+	allDevices := m.unsafeDevices()
+	devices := make([]crypto.PubKey, len(allDevices))
 	i := 0
 
-	for _, md := range m.devices {
+	for _, md := range allDevices {
 		devices[i] = md.Device()
 		i++
 	}
@@ -305,6 +498,315 @@ func (m *metadataStoreIndex) areSecretsAlreadySent(pk crypto.PubKey) (bool, erro
 	return ok, nil
 }
 
+func (m *metadataStoreIndex) isEpochKeyAlreadySent(pk crypto.PubKey, epoch uint64) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key, err := pk.Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	return m.sentEpochKeys[string(key)] >= epoch, nil
+}
+
+// listMessageDeliveryAcks returns the devices which have acknowledged the
+// given message
+func (m *metadataStoreIndex) listMessageDeliveryAcks(messageID []byte) [][]byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	acks := m.deliveryAcks[string(messageID)]
+	devices := make([][]byte, 0, len(acks))
+	for device := range acks {
+		devices = append(devices, []byte(device))
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return bytes.Compare(devices[i], devices[j]) < 0
+	})
+
+	return devices
+}
+
+// getMessageExpiration returns the disappearing messages timer of the group,
+// 0 if it is disabled
+func (m *metadataStoreIndex) getMessageExpiration() time.Duration {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.messageExpiration == nil {
+		return 0
+	}
+
+	return *m.messageExpiration
+}
+
+// areReceiptsSigned returns true if the delivery acknowledgements of the
+// group must be signed
+func (m *metadataStoreIndex) areReceiptsSigned() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.signedReceipts != nil && *m.signedReceipts
+}
+
+// areDeliveryAcksEnabled returns true if the members of the group must
+// acknowledge the messages they receive
+func (m *metadataStoreIndex) areDeliveryAcksEnabled() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.deliveryAcksEnabled != nil && *m.deliveryAcksEnabled
+}
+
+// applySnapshot lists the members of a snapshot along with the ones of the
+// log, its settings are used until the log provides them. The members of the
+// snapshot are kept apart from the ones of the log, so they are dropped once
+// the log has been replicated up to the heads of the snapshot.
+func (m *metadataStoreIndex) applySnapshot(snapshot *protocoltypes.GroupSnapshot) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	members := map[string][]secretstore.MemberDevice{}
+	devices := map[string]secretstore.MemberDevice{}
+
+	for _, member := range snapshot.Members {
+		memberPK, err := crypto.UnmarshalEd25519PublicKey(member.MemberPk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		for _, devicePK := range member.DevicePks {
+			devicePubKey, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+			if err != nil {
+				return errcode.ErrCode_ErrDeserialization.Wrap(err)
+			}
+
+			if _, ok := devices[string(devicePK)]; ok {
+				continue
+			}
+
+			if err := validateMembership(m.ctx, m.membershipValidator, m.group, m.ownMemberDevice, &protocoltypes.GroupMemberDeviceAdded{
+				MemberPk: member.MemberPk,
+				DevicePk: devicePK,
+			}); err != nil {
+				m.logger.Debug("snapshot member device rejected", zap.Error(err))
+				m.rejectedDevices[string(devicePK)] = struct{}{}
+				continue
+			}
+
+			memberDevice := secretstore.NewMemberDevice(memberPK, devicePubKey)
+			devices[string(devicePK)] = memberDevice
+			members[string(member.MemberPk)] = append(members[string(member.MemberPk)], memberDevice)
+		}
+	}
+
+	m.snapshot = snapshot
+	m.snapshotMembers = members
+	m.snapshotDevices = devices
+	m.applySnapshotSettings()
+
+	return nil
+}
+
+// dropReplicatedSnapshot drops the applied snapshot, if any, once the log
+// contains all of its metadata heads, the log then replaces it entirely
+func (m *metadataStoreIndex) dropReplicatedSnapshot(log ipfslog.Log) {
+	if m.snapshot == nil {
+		return
+	}
+
+	for _, head := range m.snapshot.MetadataHeads {
+		id, err := cid.Cast(head)
+		if err != nil {
+			return
+		}
+
+		if _, ok := log.Get(id); !ok {
+			return
+		}
+	}
+
+	m.snapshot = nil
+	m.snapshotMembers = nil
+	m.snapshotDevices = nil
+}
+
+// unsafeMembers returns the members of the log along with the ones of the
+// applied snapshot which aren't part of the log yet
+func (m *metadataStoreIndex) unsafeMembers() map[string][]secretstore.MemberDevice {
+	if len(m.snapshotMembers) == 0 {
+		return m.members
+	}
+
+	members := make(map[string][]secretstore.MemberDevice, len(m.members)+len(m.snapshotMembers))
+	for pk, mds := range m.snapshotMembers {
+		if _, ok := m.leftMembers[pk]; !ok {
+			members[pk] = mds
+		}
+	}
+
+	for pk, mds := range m.members {
+		members[pk] = mds
+	}
+
+	return members
+}
+
+// unsafeDevices returns the devices of the log along with the ones of the
+// applied snapshot which aren't part of the log yet
+func (m *metadataStoreIndex) unsafeDevices() map[string]secretstore.MemberDevice {
+	if len(m.snapshotDevices) == 0 {
+		return m.devices
+	}
+
+	devices := make(map[string]secretstore.MemberDevice, len(m.devices)+len(m.snapshotDevices))
+	for pk, md := range m.snapshotDevices {
+		if _, ok := m.leftDevices[pk]; ok {
+			continue
+		}
+
+		if memberPK, err := md.Member().Raw(); err == nil {
+			if _, ok := m.leftMembers[string(memberPK)]; ok {
+				continue
+			}
+		}
+
+		devices[pk] = md
+	}
+
+	for pk, md := range m.devices {
+		devices[pk] = md
+	}
+
+	return devices
+}
+
+// rebuild drops the state derived from the log and indexes the whole log
+// again, the applied snapshot, if any, is kept until the log replaces it
+func (m *metadataStoreIndex) rebuild(log ipfslog.Log) error {
+	m.lock.Lock()
+
+	m.members = map[string][]secretstore.MemberDevice{}
+	m.devices = map[string]secretstore.MemberDevice{}
+	m.rejectedDevices = map[string]struct{}{}
+	m.admins = map[crypto.PubKey]struct{}{}
+	m.sentSecrets = map[string]struct{}{}
+	m.sentEpochKeys = map[string]uint64{}
+	m.deliveryAcks = map[string]map[string][]byte{}
+	m.deliveryAckedMessages = nil
+	m.eventsContactAddAliasKey = nil
+	m.ownAliasKeySent = false
+	m.otherAliasKey = nil
+
+	m.lock.Unlock()
+
+	// UpdateIndex resets the rest of the state
+	return m.UpdateIndex(log, nil)
+}
+
+// applySnapshotSettings sets the settings not found in the log from the
+// applied snapshot, if any
+func (m *metadataStoreIndex) applySnapshotSettings() {
+	if m.snapshot == nil {
+		return
+	}
+
+	if m.signedReceipts == nil {
+		enabled := m.snapshot.SignedReceipts
+		m.signedReceipts = &enabled
+	}
+
+	if m.deliveryAcksEnabled == nil {
+		enabled := m.snapshot.DeliveryAcks
+		m.deliveryAcksEnabled = &enabled
+	}
+
+	if m.messageExpiration == nil {
+		expiration := time.Duration(m.snapshot.MessageExpiration) * time.Second
+		m.messageExpiration = &expiration
+	}
+}
+
+// listSnapshotMembers returns the members of the group found in the log
+// along with their devices, the ones of an applied snapshot are left out
+func (m *metadataStoreIndex) listSnapshotMembers() ([]*protocoltypes.GroupSnapshot_Member, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	members := make([]*protocoltypes.GroupSnapshot_Member, 0, len(m.members))
+	for memberPK, devices := range m.members {
+		member := &protocoltypes.GroupSnapshot_Member{MemberPk: []byte(memberPK)}
+		for _, md := range devices {
+			devicePK, err := md.Device().Raw()
+			if err != nil {
+				return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+			}
+
+			member.DevicePks = append(member.DevicePks, devicePK)
+		}
+
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// listMessageDeliveryReceipts returns the signatures of the given message by
+// the devices which have acknowledged it with a signed receipt
+func (m *metadataStoreIndex) listMessageDeliveryReceipts(messageID []byte) map[string][]byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	receipts := map[string][]byte{}
+	for device, signature := range m.deliveryAcks[string(messageID)] {
+		if len(signature) > 0 {
+			receipts[device] = signature
+		}
+	}
+
+	return receipts
+}
+
+func (m *metadataStoreIndex) isMessageDeliveryAcked(messageID []byte, devicePKRaw []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.deliveryAcks[string(messageID)][string(devicePKRaw)]
+	return ok
+}
+
+// canRekey checks whether a device is allowed to rotate the group epoch key,
+// when the group has admins only their devices are allowed to, otherwise any
+// member can.
+func (m *metadataStoreIndex) canRekey(devicePublicKey crypto.PubKey) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	publicKeyBytes, err := devicePublicKey.Raw()
+	if err != nil {
+		return false
+	}
+
+	md, ok := m.devices[string(publicKeyBytes)]
+	if !ok {
+		return false
+	}
+
+	if len(m.admins) == 0 {
+		return true
+	}
+
+	for admin := range m.admins {
+		if admin.Equals(md.Device()) || admin.Equals(md.Member()) {
+			return true
+		}
+	}
+
+	return false
+}
+
 type accountGroupJoinedState uint32
 
 const (
@@ -320,6 +822,9 @@ type accountGroup struct {
 type AccountContact struct {
 	state   protocoltypes.ContactState
 	contact *protocoltypes.ShareableContact
+	// requestSent is set when the contact has been added by sending it a
+	// request, which can still be canceled
+	requestSent bool
 }
 
 func (m *metadataStoreIndex) handleGroupJoined(event proto.Message) error {
@@ -444,6 +949,10 @@ func (m *metadataStoreIndex) handleContactRequestOutgoingEnqueued(event proto.Me
 		return nil
 	}
 
+	if m.resetCanceledContactRequest(evt.Contact.Pk) {
+		return nil
+	}
+
 	if data, ok := m.contactRequestMetadata[string(evt.Contact.Pk)]; !ok || len(data) == 0 {
 		m.contactRequestMetadata[string(evt.Contact.Pk)] = evt.OwnMetadata
 	}
@@ -473,11 +982,16 @@ func (m *metadataStoreIndex) handleContactRequestOutgoingSent(event proto.Messag
 		return nil
 	}
 
+	if m.resetCanceledContactRequest(evt.ContactPk) {
+		return nil
+	}
+
 	ac := &AccountContact{
 		state: protocoltypes.ContactState_ContactStateAdded,
 		contact: &protocoltypes.ShareableContact{
 			Pk: evt.ContactPk,
 		},
+		requestSent: true,
 	}
 
 	m.contacts[string(evt.ContactPk)] = ac
@@ -486,6 +1000,42 @@ func (m *metadataStoreIndex) handleContactRequestOutgoingSent(event proto.Messag
 	return err
 }
 
+func (m *metadataStoreIndex) handleContactRequestOutgoingCanceled(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestOutgoingCanceled)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	// the events are handled from the newest, the request is reset when its
+	// older events are handled
+	m.canceledContactRequests[string(evt.ContactPk)] = struct{}{}
+
+	return nil
+}
+
+// resetCanceledContactRequest puts a contact whose request has been canceled
+// back to its initial state, so a new request can be enqueued or received.
+// It returns false if the request hasn't been canceled.
+func (m *metadataStoreIndex) resetCanceledContactRequest(contactPK []byte) bool {
+	if _, ok := m.canceledContactRequests[string(contactPK)]; !ok {
+		return false
+	}
+
+	delete(m.canceledContactRequests, string(contactPK))
+	m.contacts[string(contactPK)] = &AccountContact{
+		state: protocoltypes.ContactState_ContactStateUndefined,
+		contact: &protocoltypes.ShareableContact{
+			Pk: contactPK,
+		},
+	}
+
+	return true
+}
+
 func (m *metadataStoreIndex) handleContactRequestIncomingReceived(event proto.Message) error {
 	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingReceived)
 	if !ok {
@@ -653,6 +1203,85 @@ func (m *metadataStoreIndex) handleGroupMetadataPayloadSent(_ proto.Message) err
 	return nil
 }
 
+func (m *metadataStoreIndex) isOwnMember(member crypto.PubKey) bool {
+	return m.ownMemberDevice != nil && m.ownMemberDevice.Member() != nil && m.ownMemberDevice.Member().Equals(member)
+}
+
+// handleGroupMemberLeft drops the member who left the group along with the
+// devices it added before leaving, unless the device announced itself again
+// afterward, e.g. once invited again: the leaves are indexed again on each
+// update so they aren't permanent. Only the leaving device is dropped for the own member, it is
+// announced again once the group is joined again, see AddDeviceToGroup.
+func (m *metadataStoreIndex) handleGroupMemberLeft(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupMemberLeft)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	// the device joined the group again after leaving it
+	if _, ok := m.joinedDevices[string(e.DevicePk)]; ok {
+		return nil
+	}
+
+	m.leftDevices[string(e.DevicePk)] = struct{}{}
+
+	md, ok := m.devices[string(e.DevicePk)]
+	if !ok {
+		md, ok = m.snapshotDevices[string(e.DevicePk)]
+	}
+	if !ok {
+		// the device is indexed later, see handleGroupMemberDeviceAdded
+		return nil
+	}
+
+	memberPK, err := md.Member().Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if m.isOwnMember(md.Member()) {
+		m.removeDevice(string(memberPK), string(e.DevicePk))
+		return nil
+	}
+
+	m.leftMembers[string(memberPK)] = struct{}{}
+	for _, memberDevice := range m.members[string(memberPK)] {
+		devicePK, err := memberDevice.Device().Raw()
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if _, ok := m.joinedDevices[string(devicePK)]; ok {
+			continue
+		}
+
+		m.leftDevices[string(devicePK)] = struct{}{}
+		m.removeDevice(string(memberPK), string(devicePK))
+	}
+
+	return nil
+}
+
+// removeDevice drops a device of a member from the index, the member is
+// dropped along with its last device
+func (m *metadataStoreIndex) removeDevice(memberPK, devicePK string) {
+	delete(m.devices, devicePK)
+
+	devices := m.members[memberPK][:0]
+	for _, md := range m.members[memberPK] {
+		if raw, err := md.Device().Raw(); err == nil && string(raw) == devicePK {
+			continue
+		}
+		devices = append(devices, md)
+	}
+
+	if len(devices) == 0 {
+		delete(m.members, memberPK)
+	} else {
+		m.members[memberPK] = devices
+	}
+}
+
 func (m *metadataStoreIndex) handleAccountVerifiedCredentialRegistered(event proto.Message) error {
 	e, ok := event.(*protocoltypes.AccountVerifiedCredentialRegistered)
 	if !ok {
@@ -764,23 +1393,32 @@ func (m *metadataStoreIndex) postHandlerSentAliases() error {
 
 // nolint:staticcheck,revive
 // newMetadataIndex returns a new index to manage the list of the group members
-func newMetadataIndex(ctx context.Context, g *protocoltypes.Group, md secretstore.MemberDevice, secretStore secretstore.SecretStore) iface.IndexConstructor {
+func newMetadataIndex(ctx context.Context, g *protocoltypes.Group, md secretstore.MemberDevice, secretStore secretstore.SecretStore, sigVerifier *signatureVerifier, membershipValidator MembershipValidator) iface.IndexConstructor {
 	return func(publicKey []byte) iface.StoreIndex {
 		m := &metadataStoreIndex{
-			members:                map[string][]secretstore.MemberDevice{},
-			devices:                map[string]secretstore.MemberDevice{},
-			admins:                 map[crypto.PubKey]struct{}{},
-			sentSecrets:            map[string]struct{}{},
-			handledEvents:          map[string]struct{}{},
-			contacts:               map[string]*AccountContact{},
-			contactsFromGroupPK:    map[string]*AccountContact{},
-			groups:                 map[string]*accountGroup{},
-			contactRequestMetadata: map[string][]byte{},
-			group:                  g,
-			ownMemberDevice:        md,
-			secretStore:            secretStore,
-			ctx:                    ctx,
-			logger:                 zap.NewNop(),
+			members:                 map[string][]secretstore.MemberDevice{},
+			devices:                 map[string]secretstore.MemberDevice{},
+			rejectedDevices:         map[string]struct{}{},
+			leftMembers:             map[string]struct{}{},
+			leftDevices:             map[string]struct{}{},
+			joinedDevices:           map[string]struct{}{},
+			admins:                  map[crypto.PubKey]struct{}{},
+			sentSecrets:             map[string]struct{}{},
+			sentEpochKeys:           map[string]uint64{},
+			deliveryAcks:            map[string]map[string][]byte{},
+			handledEvents:           map[string]struct{}{},
+			contacts:                map[string]*AccountContact{},
+			contactsFromGroupPK:     map[string]*AccountContact{},
+			groups:                  map[string]*accountGroup{},
+			contactRequestMetadata:  map[string][]byte{},
+			canceledContactRequests: map[string]struct{}{},
+			group:                   g,
+			ownMemberDevice:         md,
+			secretStore:             secretStore,
+			sigVerifier:             sigVerifier,
+			membershipValidator:     membershipValidator,
+			ctx:                     ctx,
+			logger:                  zap.NewNop(),
 		}
 
 		m.eventHandlers = map[protocoltypes.EventType][]func(event proto.Message) error{
@@ -794,6 +1432,7 @@ func newMetadataIndex(ctx context.Context, g *protocoltypes.Group, md secretstor
 			protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent:      {m.handleContactRequestOutgoingSent},
 			protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset:    {m.handleContactRequestReferenceReset},
 			protocoltypes.EventType_EventTypeAccountContactUnblocked:                {m.handleContactUnblocked},
+			protocoltypes.EventType_EventTypeAccountContactRequestOutgoingCanceled:  {m.handleContactRequestOutgoingCanceled},
 			protocoltypes.EventType_EventTypeAccountGroupJoined:                     {m.handleGroupJoined},
 			protocoltypes.EventType_EventTypeAccountGroupLeft:                       {m.handleGroupLeft},
 			protocoltypes.EventType_EventTypeContactAliasKeyAdded:                   {m.handleContactAliasKeyAdded},
@@ -801,6 +1440,12 @@ func newMetadataIndex(ctx context.Context, g *protocoltypes.Group, md secretstor
 			protocoltypes.EventType_EventTypeGroupMemberDeviceAdded:                 {m.handleGroupMemberDeviceAdded},
 			protocoltypes.EventType_EventTypeMultiMemberGroupAdminRoleGranted:       {m.handleMultiMemberGrantAdminRole},
 			protocoltypes.EventType_EventTypeMultiMemberGroupInitialMemberAnnounced: {m.handleMultiMemberInitialMember},
+			protocoltypes.EventType_EventTypeMultiMemberGroupEpochKeyAdded:          {m.handleMultiMemberGroupEpochKeyAdded},
+			protocoltypes.EventType_EventTypeGroupMessageDeliveryAcked:              {m.handleGroupMessageDeliveryAcked},
+			protocoltypes.EventType_EventTypeGroupMessageExpirationUpdated:          {m.handleGroupMessageExpirationUpdated},
+			protocoltypes.EventType_EventTypeGroupMemberLeft:                        {m.handleGroupMemberLeft},
+			protocoltypes.EventType_EventTypeGroupSignedReceiptsUpdated:             {m.handleGroupSignedReceiptsUpdated},
+			protocoltypes.EventType_EventTypeGroupDeliveryAcksUpdated:               {m.handleGroupDeliveryAcksUpdated},
 			protocoltypes.EventType_EventTypeGroupMetadataPayloadSent:               {m.handleGroupMetadataPayloadSent},
 			protocoltypes.EventType_EventTypeAccountVerifiedCredentialRegistered:    {m.handleAccountVerifiedCredentialRegistered},
 		}
@@ -0,0 +1,36 @@
+package weshnet
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestMetadataStoreIndexDeliveryAcksBounded(t *testing.T) {
+	m := &metadataStoreIndex{deliveryAcks: map[string]map[string][]byte{}}
+	device := []byte("device")
+
+	for i := 0; i < maxDeliveryAckedMessages+10; i++ {
+		require.NoError(t, m.handleGroupMessageDeliveryAcked(&protocoltypes.GroupMessageDeliveryAcked{
+			MessageId: []byte(fmt.Sprintf("message %d", i)),
+			DevicePk:  device,
+		}))
+	}
+
+	// the acks of the same message don't count twice
+	require.NoError(t, m.handleGroupMessageDeliveryAcked(&protocoltypes.GroupMessageDeliveryAcked{
+		MessageId: []byte(fmt.Sprintf("message %d", maxDeliveryAckedMessages)),
+		DevicePk:  []byte("other device"),
+	}))
+
+	require.Len(t, m.deliveryAcks, maxDeliveryAckedMessages)
+	require.Len(t, m.deliveryAckedMessages, maxDeliveryAckedMessages)
+
+	// the oldest messages are dropped first
+	require.False(t, m.isMessageDeliveryAcked([]byte("message 9"), device))
+	require.True(t, m.isMessageDeliveryAcked([]byte("message 10"), device))
+	require.Len(t, m.listMessageDeliveryAcks([]byte(fmt.Sprintf("message %d", maxDeliveryAckedMessages))), 2)
+}
@@ -22,11 +22,11 @@ import (
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/proto"
 
-	encrepo "berty.tech/go-ipfs-repo-encrypted"
 	orbitdb "berty.tech/go-orbit-db"
 	"berty.tech/go-orbit-db/pubsub/pubsubraw"
 	"berty.tech/weshnet/v2/internal/datastoreutil"
@@ -103,6 +103,16 @@ type TestingOpts struct {
 	CoreAPIMock     ipfsutil.CoreAPIMock
 	OrbitDB         *WeshOrbitDB
 	ConnectFunc     ConnectTestingProtocolFunc
+
+	DisableDeliveryAcks        bool
+	ContactRequestRetry        bool
+	ContactInvitationsOnly     bool
+	MessageIndexer             MessageIndexer
+	OutgoingMessageInterceptor OutgoingMessageInterceptor
+	MembershipValidator        MembershipValidator
+	UnknownMemberPolicy        UnknownMemberPolicy
+	InboundWorkers             int
+	TracerProvider             trace.TracerProvider
 }
 
 func NewTestingProtocol(ctx context.Context, t testing.TB, opts *TestingOpts, ds datastore.Batching) (*TestingProtocol, func()) {
@@ -145,8 +155,11 @@ func NewTestingProtocol(ctx context.Context, t testing.TB, opts *TestingOpts, ds
 				PubSub: pubSub,
 				Logger: opts.Logger,
 			},
-			Datastore:   ds,
-			SecretStore: secretStore,
+			Datastore:           ds,
+			SecretStore:         secretStore,
+			MembershipValidator: opts.MembershipValidator,
+			UnknownMemberPolicy: opts.UnknownMemberPolicy,
+			InboundWorkers:      opts.InboundWorkers,
 		})
 		require.NoError(t, err)
 	}
@@ -160,6 +173,15 @@ func NewTestingProtocol(ctx context.Context, t testing.TB, opts *TestingOpts, ds
 		OrbitDB:       odb,
 		TinderService: node.Tinder(),
 		SecretStore:   secretStore,
+
+		DisableDeliveryAcks:        opts.DisableDeliveryAcks,
+		ContactRequestRetry:        opts.ContactRequestRetry,
+		ContactInvitationsOnly:     opts.ContactInvitationsOnly,
+		MessageIndexer:             opts.MessageIndexer,
+		OutgoingMessageInterceptor: opts.OutgoingMessageInterceptor,
+		TracerProvider:             opts.TracerProvider,
+
+		BandwidthReporter: node.MockNode().Reporter,
 	}
 
 	service, cleanupService := TestingService(ctx, t, serviceOpts)
@@ -344,9 +366,41 @@ func ConnectInLine(t testing.TB, m mocknet.Mocknet) {
 	}
 }
 
+// CreatePeersWithGroupTest opens a group on several peers, the devices of the
+// peers are added to the group so their messages are applied by the others
 func CreatePeersWithGroupTest(ctx context.Context, t testing.TB, pathBase string, memberCount int, deviceCount int) ([]*mockedPeer, crypto.PrivKey, func()) {
 	t.Helper()
 
+	peers, groupPrivateKey, cleanup := createPeersWithGroupTest(ctx, t, memberCount, deviceCount)
+
+	for _, peer := range peers {
+		if _, err := peer.GC.MetadataStore().AddDeviceToGroup(ctx); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+
+	// the messages of the devices which aren't known yet are held
+	require.Eventually(t, func() bool {
+		for _, peer := range peers {
+			for _, other := range peers {
+				if _, err := peer.GC.MetadataStore().GetMemberByDevice(other.GC.DevicePubKey()); err != nil {
+					return false
+				}
+			}
+		}
+
+		return true
+	}, time.Second*10, time.Millisecond*50)
+
+	return peers, groupPrivateKey, cleanup
+}
+
+// createPeersWithGroupTest opens a group on several peers without adding
+// their devices to the group
+func createPeersWithGroupTest(ctx context.Context, t testing.TB, memberCount int, deviceCount int) ([]*mockedPeer, crypto.PrivKey, func()) {
+	t.Helper()
+
 	logger, cleanupLogger := testutil.Logger(t)
 
 	var secretStore secretstore.SecretStore
@@ -492,9 +546,7 @@ func GetRootDatastoreForPath(dir string, key []byte, salt []byte, logger *zap.Lo
 			return nil, errcode.ErrCode_TODO.Wrap(err)
 		}
 
-		dbPath := filepath.Join(dir, "datastore.sqlite")
-		sqldsOpts := encrepo.SQLCipherDatastoreOptions{JournalMode: "WAL", PlaintextHeader: len(salt) != 0, Salt: salt}
-		ds, err = encrepo.NewSQLCipherDatastore("sqlite3", dbPath, "blocks", key, sqldsOpts)
+		ds, err = openSQLCipherDatastore(filepath.Join(dir, rootDatastoreFilename), key, salt)
 		if err != nil {
 			return nil, errcode.ErrCode_TODO.Wrap(err)
 		}
@@ -506,15 +558,24 @@ func GetRootDatastoreForPath(dir string, key []byte, salt []byte, logger *zap.Lo
 }
 
 func CreateMultiMemberGroupInstance(ctx context.Context, t *testing.T, tps ...*TestingProtocol) *protocoltypes.Group {
-	testutil.LogTree(t, "Create and Join MultiMember Group", 0, true)
-	start := time.Now()
-
-	ntps := len(tps)
-
 	// Create group
 	group, _, err := NewGroupMultiMember()
 	require.NoError(t, err)
 
+	JoinMultiMemberGroupInstance(ctx, t, group, tps...)
+
+	return group
+}
+
+// JoinMultiMemberGroupInstance makes the given protocols join an existing
+// group, activate it and exchange their secrets
+func JoinMultiMemberGroupInstance(ctx context.Context, t *testing.T, group *protocoltypes.Group, tps ...*TestingProtocol) {
+	testutil.LogTree(t, "Join MultiMember Group", 0, true)
+	start := time.Now()
+
+	ntps := len(tps)
+	var err error
+
 	// Get Instance Configurations
 	{
 		testutil.LogTree(t, "Get Instance Configuration", 1, true)
@@ -663,8 +724,6 @@ func CreateMultiMemberGroupInstance(ctx context.Context, t *testing.T, tps ...*T
 	}
 
 	testutil.LogTree(t, "duration: %s", 0, false, time.Since(start))
-
-	return group
 }
 
 func isEventAddSecretTargetedToMember(ownRawPK []byte, evt *protocoltypes.GroupMetadataEvent) ([]byte, error) {
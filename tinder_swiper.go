@@ -183,13 +183,24 @@ func (s *Swiper) watchPeers(ctx context.Context, _ backoff.BackoffStrategy, out
 	go func() {
 		timeout := time.Minute // @TODO(gfanton): do we need to use backoffstartegy here ?
 		for ctx.Err() == nil {
+			mode, modeChanged := s.tinder.WatchMode()
+			if mode == tinder.ModePaused {
+				// don't pull until the lookups are resumed
+				select {
+				case <-modeChanged:
+				case <-ctx.Done():
+				}
+				continue
+			}
+
 			s.logger.Debug("swiper pulling for peers", logutil.PrivateString("topic", topic))
 			if err := sub.Pull(); err != nil {
 				s.logger.Error("unable to pull for peer on subscription", zap.Error(err))
 			}
 
 			select {
-			case <-time.After(timeout):
+			case <-time.After(mode.ScaleInterval(timeout)):
+			case <-modeChanged:
 			case <-ctx.Done():
 			}
 		}
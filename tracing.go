@@ -0,0 +1,75 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+)
+
+// tracerName is the instrumentation scope of the spans emitted by weshnet
+const tracerName = "berty.tech/weshnet/v2"
+
+const (
+	traceAttrGroupPK = "weshnet.group_pk"
+	traceAttrPeerID  = "weshnet.peer_id"
+)
+
+// newTracer returns the tracer of the service, the spans are dropped if
+// provider is nil
+func newTracer(provider trace.TracerProvider) trace.Tracer {
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+
+	return provider.Tracer(tracerName)
+}
+
+// contextTracer returns a tracer using the provider of the span of ctx, it is
+// used by the functions running outside of a service, such as the restores.
+// The spans are dropped if ctx has no span.
+func contextTracer(ctx context.Context) trace.Tracer {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+}
+
+// traceGroupPK returns the span attribute of a group public key, it is
+// redacted the same way as the private fields of the logs
+func traceGroupPK(groupPK []byte) attribute.KeyValue {
+	return attribute.String(traceAttrGroupPK, logutil.Redact(base64.RawURLEncoding.EncodeToString(groupPK)))
+}
+
+// tracePeerID returns the span attribute of a peer ID, it is redacted the
+// same way as the private fields of the logs
+func tracePeerID(id peer.ID) attribute.KeyValue {
+	return attribute.String(traceAttrPeerID, logutil.Redact(id.String()))
+}
+
+// connectPeer connects the host to a peer within a span
+func (s *service) connectPeer(ctx context.Context, info peer.AddrInfo) (err error) {
+	ctx, span := s.tracer.Start(ctx, "Connect", trace.WithAttributes(tracePeerID(info.ID)))
+	defer func() { endSpan(span, err) }()
+
+	return s.host.Connect(ctx, info)
+}
+
+// endSpan ends a span, marking it as failed if err is not nil. Only the code
+// of the error is recorded as its message may hold private values.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		description := "error"
+		if code := errcode.Code(err); code != -1 {
+			description = code.String()
+		}
+
+		span.SetStatus(codes.Error, description)
+	}
+
+	span.End()
+}
@@ -0,0 +1,82 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestAppMessageSendTracing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(ctx)
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	node, cleanup := NewTestingProtocol(ctx, t, &TestingOpts{Mocknet: mn, TracerProvider: provider}, nil)
+	defer cleanup()
+
+	createRep, err := node.Service.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	_, err = node.Service.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: createRep.GroupPk})
+	require.NoError(t, err)
+
+	exporter.Reset()
+
+	_, err = node.Service.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: createRep.GroupPk,
+		Payload: []byte("traced"),
+	})
+	require.NoError(t, err)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	send, ok := spans["AppMessageSend"]
+	require.True(t, ok)
+	require.False(t, send.Parent.IsValid())
+	require.Contains(t, send.Attributes, traceGroupPK(createRep.GroupPk))
+	require.Equal(t, codes.Unset, send.Status.Code)
+
+	// the steps of the send are children of its span
+	for _, name := range []string{"InterceptOutgoingMessage", "StoreAppend"} {
+		child, ok := spans[name]
+		require.True(t, ok, name)
+		require.Equal(t, send.SpanContext.TraceID(), child.SpanContext.TraceID(), name)
+		require.Equal(t, send.SpanContext.SpanID(), child.Parent.SpanID(), name)
+	}
+
+	// a failed send is reported with the code of its error only
+	exporter.Reset()
+
+	_, err = node.Service.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: []byte("unknown"),
+		Payload: []byte("traced"),
+	})
+	require.Error(t, err)
+
+	spans = map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	failed, ok := spans["AppMessageSend"]
+	require.True(t, ok)
+	require.Equal(t, codes.Error, failed.Status.Code)
+	require.Equal(t, errcode.ErrCode_ErrGroupMissing.String(), failed.Status.Description)
+}
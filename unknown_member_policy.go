@@ -0,0 +1,77 @@
+package weshnet
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// UnknownMemberPolicy defines how the messages sent by a device which isn't a
+// known member of the group are handled. The entries of the group stores are
+// replicated out of order, a message can be received before the metadata
+// entry adding its device to the group.
+type UnknownMemberPolicy int
+
+const (
+	// UnknownMemberPolicyHold holds the messages until the device is added to
+	// the group, they are then applied. It is the default policy. The held
+	// messages are only kept in memory, the holds don't survive a restart: a
+	// message still held when the store is closed is only applied if it is
+	// processed again once the store is reopened.
+	UnknownMemberPolicyHold UnknownMemberPolicy = iota
+
+	// UnknownMemberPolicyReject drops the messages, they aren't applied even
+	// if the device is added to the group afterward
+	UnknownMemberPolicyReject
+
+	// UnknownMemberPolicyAccept applies the messages as soon as they can be
+	// decrypted, whether their device is a member or not
+	UnknownMemberPolicyAccept
+)
+
+func (p UnknownMemberPolicy) String() string {
+	switch p {
+	case UnknownMemberPolicyHold:
+		return "hold"
+	case UnknownMemberPolicyReject:
+		return "reject"
+	case UnknownMemberPolicyAccept:
+		return "accept"
+	}
+
+	return fmt.Sprintf("UnknownMemberPolicy(%d)", int(p))
+}
+
+// checkMembership applies the unknown member policy of the store to a message
+// sent by the given device. held is true if the message must be kept until
+// the device is added to the group, ErrGroupMemberUnknown is returned if it
+// must be dropped. The members are unknown until the metadata store of the
+// group is set, the messages are held meanwhile whatever the policy.
+func (m *MessageStore) checkMembership(devicePK []byte) (held bool, err error) {
+	if m.unknownMemberPolicy == UnknownMemberPolicyAccept || bytes.Equal(devicePK, m.currentDevicePublicKeyRaw) {
+		return false, nil
+	}
+
+	metadataStore := m.metadataStore.Load()
+	if metadataStore == nil {
+		return true, nil
+	}
+
+	devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil {
+		return false, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := metadataStore.GetMemberByDevice(devicePublicKey); err == nil {
+		return false, nil
+	}
+
+	if m.unknownMemberPolicy == UnknownMemberPolicyReject {
+		return false, errcode.ErrCode_ErrGroupMemberUnknown.Wrap(fmt.Errorf("the device isn't a member of the group"))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestUnknownMemberPolicyHold(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	peers, _, cleanup := createPeersWithGroupTest(ctx, t, 2, 1)
+	defer cleanup()
+
+	sender, receiver := peers[0], peers[1]
+
+	// the receiver handles the metadata events of the group
+	require.NoError(t, receiver.GC.ActivateGroupContext(nil))
+
+	senderDevicePK := sender.GC.DevicePubKey()
+	senderDevicePKRaw, err := senderDevicePK.Raw()
+	require.NoError(t, err)
+
+	// the receiver is able to decrypt the messages of the sender, which isn't
+	// a member yet
+	chainKey, err := sender.SecretStore.GetShareableChainKey(ctx, sender.GC.Group(), receiver.GC.MemberPubKey())
+	require.NoError(t, err)
+	require.NoError(t, receiver.SecretStore.RegisterChainKey(ctx, receiver.GC.Group(), senderDevicePK, chainKey))
+
+	sub, err := receiver.GC.MessageStore().EventBus().Subscribe(new(*protocoltypes.GroupMessageEvent))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	payload := []byte("sent before being added")
+	_, err = sender.GC.MessageStore().AddMessage(ctx, payload)
+	require.NoError(t, err)
+
+	// the message is held until the sender is added to the group
+	require.Eventually(t, func() bool {
+		size, ok := receiver.GC.MessageStore().CacheSizeForDevicePK(senderDevicePKRaw)
+		return ok && size == 1
+	}, time.Second*10, time.Millisecond*50)
+
+	select {
+	case <-sub.Out():
+		require.FailNow(t, "the message of an unknown member should be held")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	_, err = sender.GC.MetadataStore().AddDeviceToGroup(ctx)
+	require.NoError(t, err)
+
+	// the message is applied once the membership is replicated
+	select {
+	case evt := <-sub.Out():
+		require.Equal(t, payload, evt.(*protocoltypes.GroupMessageEvent).Message)
+	case <-time.After(time.Second * 10):
+		require.FailNow(t, "the held message should be applied once its device is added")
+	}
+
+	size, ok := receiver.GC.MessageStore().CacheSizeForDevicePK(senderDevicePKRaw)
+	require.True(t, ok)
+	require.Equal(t, 0, size)
+}
@@ -0,0 +1,85 @@
+package weshnet_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+	"berty.tech/weshnet/v2/pkg/tinder"
+)
+
+func TestDeriveWellKnownGroup(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	mn := mocknet.New()
+	defer mn.Close()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:         mn,
+		Logger:          logger,
+		DiscoveryServer: tinder.NewMockDriverServer(),
+		ConnectFunc:     weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	// each node derives the group on its own
+	groupA, _, err := weshnet.DeriveWellKnownGroup("weshnet-test-channel")
+	require.NoError(t, err)
+
+	groupB, _, err := weshnet.DeriveWellKnownGroup("weshnet-test-channel")
+	require.NoError(t, err)
+
+	require.True(t, proto.Equal(groupA, groupB))
+	require.Equal(t, protocoltypes.GroupType_GroupTypeMultiMember, groupA.GroupType)
+	require.NoError(t, groupA.IsValid())
+
+	other, _, err := weshnet.DeriveWellKnownGroup("weshnet-other-channel")
+	require.NoError(t, err)
+	require.NotEqual(t, groupA.PublicKey, other.PublicKey)
+
+	_, _, err = weshnet.DeriveWellKnownGroup("")
+	require.Error(t, err)
+
+	weshnet.JoinMultiMemberGroupInstance(ctx, t, groupA, nodes...)
+
+	_, err = nodes[0].Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: groupB.PublicKey,
+		Payload: []byte("public message"),
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		sub, err := nodes[1].Client.GroupMessageList(ctx, &protocoltypes.GroupMessageList_Request{
+			GroupPk:  groupB.PublicKey,
+			UntilNow: true,
+		})
+		require.NoError(t, err)
+
+		received := false
+		for {
+			evt, err := sub.Recv()
+			if err == io.EOF {
+				return received
+			}
+			require.NoError(t, err)
+
+			received = received || string(evt.Message) == "public message"
+		}
+	}, time.Second*5, time.Millisecond*100)
+}